@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/APTrust/bagman/bagman"
 	"github.com/APTrust/bagman/dpn"
 	"github.com/APTrust/bagman/workers"
 )
@@ -10,13 +11,19 @@ import (
 // test bags to DPN test bags.
 func main() {
 	procUtil := workers.CreateProcUtil("dpn")
+	// We run the packager and storer ourselves, so keep the
+	// items they would send on to the next stage out of nsqd.
+	procUtil.Queue = bagman.NewMemoryQueue()
 	pathToConfigFile := "dpn/dpn_config.json"
 	dpnConfig, err := dpn.LoadConfig(pathToConfigFile)
 	if err != nil {
 		procUtil.MessageLog.Fatal(err.Error())
 	}
 	fmt.Println("Creating packager...")
-	packager := dpn.NewPackager(procUtil, dpnConfig)
+	packager, err := dpn.NewPackager(procUtil, dpnConfig)
+	if err != nil {
+		procUtil.MessageLog.Fatal(err.Error())
+	}
 
 	bags := []string {
 		"test.edu/test.edu.bag1",
@@ -0,0 +1,54 @@
+/*
+apt_abort_uploads aborts multipart uploads to the preservation bucket
+that were started long ago and never finished. These are left behind
+when apt_store dies or gives up partway through storing a large file,
+and S3 charges for their parts until they're aborted.
+
+Usage:
+
+apt_abort_uploads -config=production -older=168h -dryrun
+
+Use -dryrun first to see what would be aborted. Don't set -older
+lower than the time it takes to store the largest bag, or this will
+abort uploads that are still in progress.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"os"
+	"time"
+)
+
+func main() {
+	bucket := flag.String("bucket", "", "Bucket to clean up (default: the preservation bucket)")
+	prefix := flag.String("prefix", "", "Only abort uploads of keys that start with this prefix")
+	older := flag.String("older", "168h", "Abort uploads started longer ago than this (e.g. 72h)")
+	dryRun := flag.Bool("dryrun", false, "Report stale uploads without aborting them")
+	procUtil := workers.CreateProcUtil("aptrust")
+	maxAge, err := time.ParseDuration(*older)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid value for -older: %v\n", err)
+		os.Exit(1)
+	}
+	if *bucket == "" {
+		*bucket = procUtil.Config.PreservationBucket
+	}
+	procUtil.MessageLog.Info("apt_abort_uploads started")
+
+	cleanup := &bagman.MultipartCleanup{
+		Client: procUtil.S3Client,
+		Logger: procUtil.MessageLog,
+		MaxAge: maxAge,
+		DryRun: *dryRun,
+	}
+	summary := cleanup.Run(*bucket, *prefix)
+	fmt.Println(summary.String())
+	procUtil.MessageLog.Info(summary.String())
+	if len(summary.Errors) > 0 {
+		os.Exit(1)
+	}
+}
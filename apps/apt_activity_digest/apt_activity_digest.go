@@ -0,0 +1,77 @@
+/*
+apt_activity_digest sends each institution a plain-text email
+summarizing the past day's activity: bags ingested, bags that
+failed and whether the institution needs to do anything about
+them, bags still in progress, and restores completed. Recipients,
+the SMTP server or webhook, and the state file that keeps digests
+from repeating items are under ActivityDigest in config.json. Run
+it once a day from cron.
+
+With -dry-run, it prints the digests instead of sending them, and
+does not update the state file.
+
+Usage:
+
+apt_activity_digest -config=production [-dry-run]
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "Print the digests instead of sending them")
+	procUtil := workers.CreateProcUtil("aptrust")
+	procUtil.MessageLog.Info("apt_activity_digest started")
+	digestConfig := procUtil.Config.ActivityDigest
+	generator := &bagman.DigestGenerator{
+		Fluctus:    procUtil.FluctusClient,
+		Notifier:   newNotifier(digestConfig),
+		Recipients: digestConfig.Recipients,
+		AttachJson: digestConfig.AttachJson,
+		StateFile:  digestConfig.StateFile,
+		DryRun:     *dryRun,
+	}
+	digests, err := generator.Run()
+	for _, digest := range digests {
+		if *dryRun {
+			text, _ := digest.Text()
+			fmt.Printf("To: %s\nSubject: %s\n\n%s\n",
+				strings.Join(digestConfig.Recipients[digest.Institution], ", "),
+				digest.Subject(), text)
+		}
+		procUtil.MessageLog.Info("Digest for %s: %d ingested, %d failed, %d in progress, %d restored",
+			digest.Institution, len(digest.Ingested), len(digest.Failed),
+			len(digest.InProgress), len(digest.Restored))
+	}
+	if err != nil {
+		procUtil.MessageLog.Error(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	procUtil.MessageLog.Info("apt_activity_digest sent %d digests", len(digests))
+}
+
+// Posts to the webhook if there is one, and sends email otherwise.
+func newNotifier(digestConfig bagman.ActivityDigestConfig) (bagman.Notifier) {
+	if digestConfig.WebhookURL != "" {
+		return &bagman.WebhookNotifier{URL: digestConfig.WebhookURL}
+	}
+	notifier := &bagman.SMTPNotifier{
+		Server: digestConfig.SMTPServer,
+		From:   digestConfig.FromAddress,
+	}
+	if os.Getenv("SMTP_USER") != "" {
+		host := strings.Split(digestConfig.SMTPServer, ":")[0]
+		notifier.Auth = smtp.PlainAuth("", os.Getenv("SMTP_USER"),
+			os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return notifier
+}
@@ -0,0 +1,73 @@
+/*
+apt_estimate estimates when an institution's pending bags will finish
+ingest, for answering partners who ask "when will my bags be done?"
+
+It counts the institution's pending ingest items in Fluctus, and the
+bags uploaded before its last one, and divides by the throughput that
+apt_record saves in the log directory. It reports a range, from the
+fastest to the slowest quarter of recent hours.
+
+Usage:
+
+apt_estimate -config=production -institution=unc.edu [-workers=3]
+
+With -workers, the estimate assumes that many record workers, rather
+than the number that saved throughput files. Use -stats to read
+throughput files from somewhere other than the log directory, e.g.
+-stats="/mnt/apt/logs/*.throughput.json".
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	institution := flag.String("institution", "", "Institution identifier, e.g. unc.edu. REQUIRED")
+	workerCount := flag.Int("workers", 0, "Assume this many record workers (default: as observed)")
+	stats := flag.String("stats", "", "Glob of throughput files (default: all in the log directory)")
+	procUtil := workers.CreateProcUtil("aptrust")
+	if *institution == "" {
+		fmt.Println("apt_estimate estimates when an institution's pending bags will finish ingest")
+		fmt.Println("Usage: apt_estimate -config=some_config -institution=example.edu " +
+			"[-workers=n] [-stats=path/to/*.throughput.json]")
+		os.Exit(0)
+	}
+	if *stats == "" {
+		*stats = filepath.Join(procUtil.Config.AbsLogDirectory(), "*.throughput.json")
+	}
+	window, err := procUtil.Config.ThroughputWindowDuration()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	files, err := filepath.Glob(*stats)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -stats pattern: %v\n", err)
+		os.Exit(1)
+	}
+	now := bagman.NowUTC()
+	throughputs := make([]*bagman.Throughput, 0)
+	for _, filePath := range files {
+		tracker, err := bagman.LoadThroughputTracker(filePath, window)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		throughputs = append(throughputs, tracker.Measure(now))
+	}
+
+	pending, err := bagman.PendingIngests(procUtil.FluctusClient)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get pending items from Fluctus: %v\n", err)
+		os.Exit(1)
+	}
+	estimate := bagman.EstimateBacklog(*institution, pending,
+		bagman.CombineThroughput(throughputs), *workerCount)
+	fmt.Println(estimate.String())
+}
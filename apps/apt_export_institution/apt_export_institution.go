@@ -0,0 +1,73 @@
+/*
+apt_export_institution writes everything Fluctus knows about an
+institution's holdings to a directory: all of its ProcessedItems,
+each of its objects with files, checksums and events, the
+preservation keys of every file, and a summary with counts and
+total bytes. We hand this to institutions that leave APTrust. See
+bagman.InstitutionExporter for the layout.
+
+If an export is interrupted, run the same command again. Objects
+that were already exported are skipped. Objects that could not be
+exported are listed at the end and in summary.json, and are retried
+on the next run. This exits with status 2 if any objects failed.
+
+Usage:
+
+apt_export_institution -config=production -institution=<identifier> -dir=<output dir> [-throttle=250ms] [-tar=<file.tar>]
+
+For example:
+
+apt_export_institution -config=production -institution=test.edu -dir=/mnt/export/test.edu -throttle=250ms -tar=/mnt/export/test.edu.tar
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"os"
+	"time"
+)
+
+func main() {
+	institution := flag.String("institution", "", "Identifier of the institution to export, e.g. test.edu")
+	outputDir := flag.String("dir", "", "Directory to write the export to")
+	throttle := flag.Duration("throttle", 100 * time.Millisecond, "Pause before each request to Fluctus")
+	tarPath := flag.String("tar", "", "Also write the export to this tar file. OPTIONAL")
+	procUtil := workers.CreateProcUtil("aptrust")
+	if *institution == "" || *outputDir == "" {
+		fmt.Fprintln(os.Stderr, "Usage: apt_export_institution -config=<config> "+
+			"-institution=<identifier> -dir=<output dir> [-throttle=100ms] [-tar=<file.tar>]")
+		os.Exit(1)
+	}
+
+	exporter := bagman.NewInstitutionExporter(procUtil.FluctusClient, *institution,
+		*outputDir, procUtil.MessageLog)
+	exporter.Throttle = *throttle
+	summary, err := exporter.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d of %d objects for %s to %s (%d from an earlier run)\n",
+		summary.ExportedCount, summary.ObjectCount, *institution, *outputDir, summary.ResumedCount)
+	fmt.Printf("%d processed items, %d files, %d bytes\n",
+		summary.ProcessedItemCount, summary.FileCount, summary.TotalBytes)
+
+	if *tarPath != "" {
+		if err = exporter.Tar(*tarPath); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s\n", *tarPath)
+	}
+
+	if summary.FailedCount > 0 {
+		fmt.Printf("\n%d objects could not be exported:\n", summary.FailedCount)
+		for _, failure := range summary.Failures {
+			fmt.Printf("  %s: %s\n", failure.ObjectIdentifier, failure.Message)
+		}
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+apt_lifecycle prints everything that ever happened to a bag: the
+PREMIS events of the object and its files, its ProcessedItem records
+for ingest, fixity, restore, delete and DPN, and, if there's a DPN
+config for this environment, its DPN bags, replication transfers and
+fixity checks, all in one timeline. If some source can't be reached,
+the timeline says so at the end instead of failing.
+
+Usage:
+
+apt_lifecycle -config=production [-json] <object identifier>
+
+For example:
+
+apt_lifecycle -config=production ncsu.edu/ncsu.1840.16-1004
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"github.com/APTrust/bagman/workers"
+	"os"
+)
+
+func main() {
+	asJson := flag.Bool("json", false, "Print the timeline as JSON")
+	procUtil := workers.CreateProcUtil("aptrust")
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: apt_lifecycle -config=<config> [-json] <object identifier>")
+		os.Exit(1)
+	}
+	objectIdentifier := flag.Arg(0)
+
+	sources := make([]bagman.LifecycleSource, 0)
+	dpnConfig, err := dpn.LoadConfig("dpn/dpn_config.json", procUtil.ConfigName)
+	if err != nil {
+		procUtil.MessageLog.Info("Not including DPN history: %v", err)
+	} else {
+		client, err := dpn.NewDPNRestClient(
+			dpnConfig.RestClient.LocalServiceURL,
+			dpnConfig.RestClient.LocalAPIRoot,
+			dpnConfig.RestClient.LocalAuthToken,
+			dpnConfig.LocalNode,
+			dpnConfig,
+			procUtil.MessageLog)
+		if err != nil {
+			sources = append(sources, &unavailableSource{err})
+		} else {
+			sources = append(sources, &dpn.LifecycleSource{Client: client})
+		}
+	}
+
+	timeline, err := bagman.BagLifecycle(procUtil.FluctusClient, objectIdentifier, sources...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if *asJson {
+		data, err := timeline.JSON()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(timeline.Text())
+	}
+}
+
+// unavailableSource reports a DPN client we couldn't create
+// as a gap in the timeline.
+type unavailableSource struct {
+	err error
+}
+
+func (source *unavailableSource) Name() (string) {
+	return "dpn"
+}
+
+func (source *unavailableSource) LifecycleEntries(objectIdentifier string) ([]*bagman.LifecycleEntry, error) {
+	return nil, fmt.Errorf("Cannot create DPN REST client: %v", source.err)
+}
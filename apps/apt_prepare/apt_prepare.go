@@ -12,7 +12,7 @@ func main() {
 	procUtil := workers.CreateProcUtil("aptrust")
 	procUtil.MessageLog.Info("Connecting to NSQLookupd at %s", procUtil.Config.NsqLookupd)
 	procUtil.MessageLog.Info("NSQDHttpAddress is %s", procUtil.Config.NsqdHttpAddress)
-	consumer, err := workers.CreateNsqConsumer(&procUtil.Config, &procUtil.Config.PrepareWorker)
+	consumer, err := workers.CreateIngestNsqConsumer(&procUtil.Config, &procUtil.Config.PrepareWorker)
 	if err != nil {
 		procUtil.MessageLog.Fatalf(err.Error())
 	}
@@ -0,0 +1,68 @@
+/*
+apt_preview shows what's in a bag in a receiving bucket, and whether
+it's roughly valid, without downloading the whole bag. It reads the
+tar headers, tag files and manifests through S3 range requests, and
+prints the tags, the declared Payload-Oxum, the first entries in the
+payload manifest, and any missing tag files or required tags. It
+does not verify checksums, so a bag that looks valid here can still
+fail ingest.
+
+Usage:
+
+apt_preview [-entries=20] [-json] <bucket>/<key>
+
+For example:
+
+apt_preview aptrust.receiving.ncsu.edu/ncsu.1840.16-1004.tar
+
+apt_preview gets AWS credentials from the environment, like the
+other APTrust apps.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/aws"
+	"os"
+	"strings"
+)
+
+func main() {
+	entries := flag.Int("entries", bagman.DEFAULT_PREVIEW_MANIFEST_ENTRIES,
+		"Number of manifest entries to show")
+	asJson := flag.Bool("json", false, "Print the preview as JSON")
+	flag.Parse()
+	if flag.NArg() != 1 || !strings.Contains(flag.Arg(0), "/") {
+		fmt.Fprintln(os.Stderr, "Usage: apt_preview [-entries=20] [-json] <bucket>/<key>")
+		os.Exit(1)
+	}
+	parts := strings.SplitN(flag.Arg(0), "/", 2)
+	bucketName, key := parts[0], parts[1]
+
+	client, err := bagman.NewS3Client(aws.USEast)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot init S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	preview, err := client.PreviewBag(bucketName, key, *entries)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if *asJson {
+		data, err := json.MarshalIndent(preview, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(preview.String())
+	}
+	if !preview.IsRoughlyValid() {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"github.com/crowdmob/goamz/aws"
+	"os"
+)
+
+/*
+apt_purge_quarantine permanently deletes files that apt_file_delete
+moved to quarantine, once they have been there longer than the
+DeletedFileRetention period in the config. Run this as a cron job.
+Files still within the retention period are left alone, so they
+can be undeleted with apt_undelete.
+*/
+func main() {
+	procUtil := workers.CreateProcUtil("aptrust")
+	procUtil.MessageLog.Info("apt_purge_quarantine started")
+	retention, err := procUtil.Config.DeletedFileRetentionDuration()
+	if err != nil {
+		procUtil.MessageLog.Fatalf("Invalid config: %v", err)
+	}
+	replicationClient, err := bagman.NewS3Client(aws.USWest2)
+	if err != nil {
+		procUtil.MessageLog.Fatalf("Cannot create S3 client for replication bucket: %v", err)
+	}
+	quarantines := []*bagman.Quarantine{
+		bagman.NewQuarantine(procUtil.S3Client, procUtil.Config.PreservationBucket, retention),
+		bagman.NewQuarantine(replicationClient, procUtil.Config.ReplicationBucket, retention),
+	}
+	exitCode := 0
+	for _, quarantine := range quarantines {
+		purged, err := quarantine.Purge()
+		for _, key := range purged {
+			procUtil.MessageLog.Info("Purged %s/%s", quarantine.Bucket, key)
+		}
+		if err != nil {
+			procUtil.MessageLog.Error(err.Error())
+			exitCode = 1
+		}
+		procUtil.MessageLog.Info("Purged %d expired files from %s",
+			len(purged), quarantine.Bucket)
+	}
+	os.Exit(exitCode)
+}
@@ -10,7 +10,7 @@ info about Intellectual Objects, Generic Files and Premis Events.
 */
 func main() {
 	procUtil := workers.CreateProcUtil("aptrust")
-	consumer, err := workers.CreateNsqConsumer(&procUtil.Config, &procUtil.Config.RecordWorker)
+	consumer, err := workers.CreateIngestNsqConsumer(&procUtil.Config, &procUtil.Config.RecordWorker)
 	if err != nil {
 		procUtil.MessageLog.Fatal(err.Error())
 	}
@@ -0,0 +1,91 @@
+/*
+apt_replay_events re-sends GenericFile registrations and PremisEvents
+that the record step failed to save in Fluctus, using the
+FedoraResults in apt_record's JSON log, or in a directory of per-bag
+results such as /mnt/apt/logs/ingest_failures. Fluctus is checked
+first, so nothing it already has is sent again.
+
+Usage:
+
+apt_replay_events -config=production -log=/mnt/apt/logs/apt_record.json \
+    -since=2015-10-01 -until=2015-10-08 -institution=ncsu.edu \
+    -checkpoint=/mnt/apt/logs/replay_checkpoint.json -dryrun
+
+Use -dryrun first to see what would be sent. With -checkpoint, an
+interrupted replay picks up where it left off when run again.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"os"
+	"time"
+)
+
+func main() {
+	logFile := flag.String("log", "", "JSON log to replay")
+	resultsDir := flag.String("dir", "", "Directory of per-bag JSON results to replay")
+	since := flag.String("since", "", "Replay bags uploaded on or after this date (YYYY-MM-DD)")
+	until := flag.String("until", "", "Replay bags uploaded before this date (YYYY-MM-DD)")
+	institution := flag.String("institution", "", "Replay bags from this institution only (e.g. ncsu.edu)")
+	checkpointFile := flag.String("checkpoint", "", "File that records replay progress, so it can resume")
+	dryRun := flag.Bool("dryrun", false, "Report what would be replayed without sending anything")
+	procUtil := workers.CreateProcUtil("aptrust")
+	if *logFile == "" && *resultsDir == "" {
+		fmt.Println("apt_replay_events re-sends failed file registrations and events to Fluctus")
+		fmt.Println("Usage: apt_replay_events -config=some_config -log=path/to/log.json " +
+			"[-dir=path/to/results] [-since=YYYY-MM-DD] [-until=YYYY-MM-DD] " +
+			"[-institution=example.edu] [-checkpoint=path/to/checkpoint.json] [-dryrun]")
+		os.Exit(0)
+	}
+	procUtil.MessageLog.Info("apt_replay_events started")
+
+	replayer := bagman.NewEventReplayer(procUtil.FluctusClient, procUtil.MessageLog)
+	replayer.DryRun = *dryRun
+	replayer.Filter = &bagman.ReplayFilter{
+		Since:       parseDate(*since),
+		Until:       parseDate(*until),
+		Institution: *institution,
+	}
+	if *checkpointFile != "" {
+		checkpoint, err := bagman.LoadReplayCheckpoint(*checkpointFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		replayer.Checkpoint = checkpoint
+	}
+
+	summary := bagman.NewReplaySummary()
+	var err error
+	if *logFile != "" {
+		err = replayer.ReplayLog(*logFile, summary)
+	}
+	if err == nil && *resultsDir != "" {
+		err = replayer.ReplayDirectory(*resultsDir, summary)
+	}
+	fmt.Print(summary.String())
+	procUtil.MessageLog.Info(summary.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay stopped early: %v\n", err)
+		os.Exit(1)
+	}
+	if summary.Count(bagman.ReplayFailed) > 0 {
+		os.Exit(2)
+	}
+}
+
+func parseDate(value string) (time.Time) {
+	if value == "" {
+		return time.Time{}
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Date '%s' is not in the format YYYY-MM-DD\n", value)
+		os.Exit(1)
+	}
+	return date
+}
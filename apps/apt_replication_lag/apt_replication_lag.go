@@ -0,0 +1,65 @@
+/*
+apt_replication_lag reports files that have been in the preservation
+bucket longer than ReplicationLagThreshold (see config.json) with no
+verified copy in the replication bucket. These are files whose
+replication is failing or stuck in the retry queue. It prints the
+report as JSON, oldest first, and exits with status 2 if any files
+are lagging, so it can run as a cron job that alerts someone.
+
+Usage:
+
+apt_replication_lag -config=production [-threshold=48h]
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"os"
+	"time"
+)
+
+const batchSize = 100
+
+func main() {
+	thresholdFlag := flag.String("threshold", "", "Report files stored longer ago than this, e.g. 48h (default: from config)")
+	procUtil := workers.CreateProcUtil("aptrust")
+	procUtil.MessageLog.Info("apt_replication_lag started")
+	threshold, err := procUtil.Config.ReplicationLagThresholdDuration()
+	if *thresholdFlag != "" {
+		threshold, err = time.ParseDuration(*thresholdFlag)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid threshold: %v\n", err)
+		os.Exit(1)
+	}
+	now := bagman.NowUTC()
+	files := make([]*bagman.GenericFile, 0)
+	for start := 0; ; start += batchSize {
+		batch, err := procUtil.FluctusClient.GetFilesNotReplicated(now.Add(-threshold), start, batchSize)
+		if err != nil {
+			procUtil.MessageLog.Error("Cannot get unreplicated files from Fluctus: %v", err)
+			fmt.Fprintf(os.Stderr, "Cannot get unreplicated files from Fluctus: %v\n", err)
+			os.Exit(1)
+		}
+		files = append(files, batch...)
+		if len(batch) < batchSize {
+			break
+		}
+	}
+	report := bagman.NewReplicationLagReport(files, threshold, now)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+	procUtil.MessageLog.Info("%d files (%d bytes) stored more than %s ago have not been replicated",
+		len(report.Files), report.TotalBytes, threshold)
+	if len(report.Files) > 0 {
+		os.Exit(2)
+	}
+}
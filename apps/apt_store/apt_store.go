@@ -8,7 +8,7 @@ import (
 // by apt_prepare.
 func main() {
 	procUtil := workers.CreateProcUtil("aptrust")
-	consumer, err := workers.CreateNsqConsumer(&procUtil.Config, &procUtil.Config.StoreWorker)
+	consumer, err := workers.CreateIngestNsqConsumer(&procUtil.Config, &procUtil.Config.StoreWorker)
 	if err != nil {
 		procUtil.MessageLog.Fatal(err.Error())
 	}
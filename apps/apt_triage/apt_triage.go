@@ -0,0 +1,168 @@
+/*
+apt_triage summarizes the items in the ingest and DPN trouble queues.
+It classifies each failure, groups the items by classification, and
+prints the suggested next action for each group, with the bag, stage
+and most relevant error of each item.
+
+It reads the JSON files that apt_trouble and dpn_trouble write (the
+full results or the .report.json files next to them), or files of
+trouble messages with one JSON object per line. With -topic, it reads
+messages from an NSQ topic instead, through its own channel, so the
+trouble workers still get every message. NSQ channels only see
+messages published after they're created, so the first run on a
+topic shows nothing, and each run after that shows the messages
+published since the last one.
+
+Usage:
+
+apt_triage /mnt/apt/logs/ingest_failures/* /mnt/apt/logs/dpn_trouble/*
+apt_triage -config=production -topic=trouble_topic [-channel=apt_triage] [-wait=10s]
+
+Add -json to print the groups as JSON.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"github.com/nsqio/go-nsq"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+func main() {
+	configName := flag.String("config", "", "Configuration with the NSQ lookup address. Required with -topic.")
+	topic := flag.String("topic", "", "NSQ topic to read trouble messages from")
+	channel := flag.String("channel", "apt_triage", "NSQ channel to read the topic through")
+	wait := flag.Duration("wait", 10*time.Second, "With -topic, stop after this long without a message")
+	asJson := flag.Bool("json", false, "Print the groups as JSON")
+	flag.Parse()
+
+	var reports []*bagman.FailureReport
+	var err error
+	if *topic != "" {
+		config := bagman.LoadRequestedConfig(configName)
+		reports, err = readTopic(config.NsqLookupd, *topic, *channel, *wait)
+	} else if flag.NArg() > 0 {
+		reports, err = readFiles(flag.Args())
+	} else {
+		fmt.Fprintln(os.Stderr, "Specify trouble files to read, or -topic.")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	groups := bagman.GroupFailureReports(reports)
+	if *asJson {
+		data, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	printSummary(reports, groups)
+}
+
+// Returns a report for each trouble message in files. The same
+// failure may be in a dump and in the report next to it, so this
+// returns only one report per bag, classification and error.
+func readFiles(files []string) ([]*bagman.FailureReport, error) {
+	reports := make([]*bagman.FailureReport, 0)
+	seen := make(map[string]bool)
+	for _, filePath := range files {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(file)
+		for {
+			var message json.RawMessage
+			err = decoder.Decode(&message)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("Cannot read %s: %v", filePath, err)
+			}
+			report, err := dpn.FailureReportFromJSON(message)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping message in %s: %v\n", filePath, err)
+				continue
+			}
+			key := fmt.Sprintf("%s|%s|%s", report.Bag, report.Classification, report.Error)
+			if !seen[key] {
+				seen[key] = true
+				reports = append(reports, report)
+			}
+		}
+		file.Close()
+	}
+	return reports, nil
+}
+
+// Reads trouble messages from topic until none arrive for wait.
+func readTopic(nsqLookupd, topic, channel string, wait time.Duration) ([]*bagman.FailureReport, error) {
+	nsqConfig := nsq.NewConfig()
+	nsqConfig.Set("max_in_flight", 200)
+	consumer, err := nsq.NewConsumer(topic, channel, nsqConfig)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*bagman.FailureReport, 0)
+	lastMessage := time.Now()
+	mutex := &sync.Mutex{}
+	consumer.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
+		report, err := dpn.FailureReportFromJSON(message.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		lastMessage = time.Now()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping message %s: %v\n", message.ID, err)
+			return nil
+		}
+		reports = append(reports, report)
+		return nil
+	}))
+	if err = consumer.ConnectToNSQLookupd(nsqLookupd); err != nil {
+		return nil, err
+	}
+	for {
+		time.Sleep(time.Second)
+		mutex.Lock()
+		idle := time.Since(lastMessage)
+		mutex.Unlock()
+		if idle >= wait {
+			break
+		}
+	}
+	consumer.Stop()
+	<-consumer.StopChan
+	return reports, nil
+}
+
+func printSummary(reports []*bagman.FailureReport, groups []*bagman.TriageGroup) {
+	fmt.Printf("%d items in trouble, in %d groups\n", len(reports), len(groups))
+	for _, group := range groups {
+		fmt.Printf("\n%s: %d items, %s\n", group.Classification,
+			len(group.Reports), bagman.FormatBytes(group.TotalBytes))
+		fmt.Printf("  Suggested action: %s\n", group.Remediation)
+		for _, report := range group.Reports {
+			fmt.Printf("  - %s (%s stage, %s, retry=%t)\n", report.Bag, report.Stage,
+				bagman.FormatBytes(report.BagSize), report.Retry)
+			if report.Remediation != group.Remediation {
+				fmt.Printf("      Suggested action: %s\n", report.Remediation)
+			}
+			fmt.Printf("      %s\n", report.Error)
+		}
+	}
+}
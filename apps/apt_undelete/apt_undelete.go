@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/workers"
+	"github.com/crowdmob/goamz/aws"
+	"os"
+)
+
+/*
+apt_undelete restores a GenericFile that apt_file_delete moved to
+quarantine. It moves the file back to its original location in the
+preservation and replication buckets, and marks it active in Fluctus.
+This only works until the DeletedFileRetention period expires.
+*/
+func main() {
+	identifier := flag.String("file", "", "Identifier of the GenericFile to undelete")
+	procUtil := workers.CreateProcUtil("aptrust")
+	if *identifier == "" {
+		fmt.Println("apt_undelete restores a deleted file from quarantine")
+		fmt.Println("Usage: apt_undelete -file=<GenericFile identifier> -config=some_config")
+		os.Exit(0)
+	}
+	procUtil.MessageLog.Info("apt_undelete started for %s", *identifier)
+	genericFile, err := procUtil.FluctusClient.GenericFileGet(*identifier, false)
+	if err != nil {
+		exitWithError(procUtil, fmt.Sprintf("Cannot get GenericFile %s from Fluctus: %v",
+			*identifier, err))
+	}
+	if genericFile == nil {
+		exitWithError(procUtil, fmt.Sprintf("GenericFile %s does not exist", *identifier))
+	}
+	retention, err := procUtil.Config.DeletedFileRetentionDuration()
+	if err != nil {
+		exitWithError(procUtil, fmt.Sprintf("Invalid config: %v", err))
+	}
+	replicationClient, err := bagman.NewS3Client(aws.USWest2)
+	if err != nil {
+		exitWithError(procUtil, fmt.Sprintf(
+			"Cannot create S3 client for replication bucket: %v", err))
+	}
+	err = bagman.UndeleteGenericFile(procUtil.FluctusClient, genericFile,
+		bagman.NewQuarantine(procUtil.S3Client, procUtil.Config.PreservationBucket, retention),
+		bagman.NewQuarantine(replicationClient, procUtil.Config.ReplicationBucket, retention))
+	if err != nil {
+		exitWithError(procUtil, err.Error())
+	}
+	message := fmt.Sprintf("Undeleted %s", *identifier)
+	procUtil.MessageLog.Info(message)
+	fmt.Println(message)
+}
+
+func exitWithError(procUtil *bagman.ProcessUtil, message string) {
+	procUtil.MessageLog.Error(message)
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(1)
+}
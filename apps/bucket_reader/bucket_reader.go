@@ -3,11 +3,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/APTrust/bagman/workers"
 	"github.com/crowdmob/goamz/aws"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
@@ -31,6 +33,11 @@ TODO: Get rid of status cache and handle 409 from Fluctus
 var workReader *bagman.WorkReader
 var statusCache map[string]*bagman.ProcessStatus
 
+// InitializeReader parses this along with the standard flags.
+var staleSweep = flag.Bool("stale", false, "Instead of the usual run, queue bags "+
+	"that have been in the receiving buckets longer than StaleBagThreshold "+
+	"with no ProcessedItem, and report on stale bags that failed. OPTIONAL")
+
 func main() {
 	var err error = nil
 	workReader, err = workers.InitializeReader()
@@ -39,7 +46,11 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Initialization failed for bucket_reader: %v", err)
 		os.Exit(1)
 	}
-	run()
+	if *staleSweep {
+		runStaleSweep()
+	} else {
+		run()
+	}
 }
 
 type DateParseError struct {
@@ -47,6 +58,15 @@ type DateParseError struct {
 }
 func (e DateParseError) Error() string { return e.message }
 
+// Returns the nsqd URL for queueing bags to ingest.
+func ingestQueueUrl() (string) {
+	topic, err := workReader.Config.TopicForAction(bagman.ActionIngest)
+	if err != nil {
+		workReader.MessageLog.Fatal(err.Error())
+	}
+	return fmt.Sprintf("%s/mput?topic=%s", workReader.Config.NsqdHttpAddress, topic)
+}
+
 func run() {
 	s3Client, err := bagman.NewS3Client(aws.USEast)
 	if err != nil {
@@ -58,11 +78,12 @@ func run() {
 		workReader.MessageLog.Error(err.Error())
 	}
 	loadStatusCache()
-	url := fmt.Sprintf("%s/mput?topic=%s", workReader.Config.NsqdHttpAddress, workReader.Config.PrepareWorker.NsqTopic)
+	url := ingestQueueUrl()
 	workReader.MessageLog.Debug("Sending S3 file info to %s", url)
 	s3Files := filterLargeFiles(bucketSummaries)
 	workReader.MessageLog.Debug("%d S3 Files are within our size limit",
 		len(s3Files))
+	logNameCollisions(s3Files)
 	filesToProcess := s3Files
 	// SkipAlreadyProcessed will almost always be true.
 	// The exception is when we want to reprocess items to test new code.
@@ -98,6 +119,52 @@ func run() {
 	}
 }
 
+// runStaleSweep queues bags that have been sitting in the receiving
+// buckets past the stale bag threshold without being picked up, and
+// logs a summary for each institution that has stale bags.
+func runStaleSweep() {
+	s3Client, err := bagman.NewS3Client(aws.USEast)
+	if err != nil {
+		workReader.MessageLog.Error(err.Error())
+		return
+	}
+	threshold, err := workReader.Config.StaleBagThresholdDuration()
+	if err != nil {
+		workReader.MessageLog.Error(err.Error())
+		return
+	}
+	url := ingestQueueUrl()
+	sweep := &bagman.StaleBagSweep{
+		S3:        s3Client,
+		Fluctus:   workReader.FluctusClient,
+		Threshold: threshold,
+		Queue: func(s3Files []*bagman.S3File) error {
+			genericSlice := make([]interface{}, len(s3Files))
+			for i := range s3Files {
+				genericSlice[i] = s3Files[i]
+			}
+			err := bagman.QueueToNSQ(url, genericSlice)
+			if err == nil {
+				logBatch(s3Files)
+			}
+			return err
+		},
+	}
+	workReader.MessageLog.Info("Sweeping receiving buckets for bags older than %s", threshold)
+	summaries, errors := sweep.Run(workReader.Config.ReceivingBuckets)
+	for _, err := range errors {
+		workReader.MessageLog.Error(err.Error())
+	}
+	for _, summary := range summaries {
+		workReader.MessageLog.Warning(summary.String())
+		for _, key := range summary.FailedKeys {
+			workReader.MessageLog.Warning("Stale bag %s/%s failed and will not be retried",
+				summary.Bucket, key)
+		}
+	}
+	workReader.MessageLog.Info("Stale bag sweep found stale bags for %d institutions", len(summaries))
+}
+
 // filterLargeFiles returns only those S3 files that are not larger
 // than config.MaxFileSize. This is useful when running tests and
 // demos on your local machine, so that you can limit your test
@@ -105,6 +172,9 @@ func run() {
 // You don't want to pull down lots of multi-gig files when you're
 // just running local tests. In production, set maxFileSize to
 // zero, or to some huge value to get all files.
+//
+// Bags over config.MaxBagSize are left out too. Those are rejected
+// for good, with a note telling the depositor why.
 func filterLargeFiles(bucketSummaries []*bagman.BucketSummary) (s3Files []*bagman.S3File) {
 	for _, bucketSummary := range bucketSummaries {
 		for _, key := range bucketSummary.Keys {
@@ -112,7 +182,9 @@ func filterLargeFiles(bucketSummaries []*bagman.BucketSummary) (s3Files []*bagma
 				BucketName: bucketSummary.BucketName,
 				Key: key,
 			}
-			if workReader.Config.MaxFileSize == 0 || key.Size < workReader.Config.MaxFileSize {
+			if note := workReader.Config.OversizeBagNote(key.Key, key.Size); note != "" {
+				rejectOversizeBag(s3File, note)
+			} else if workReader.Config.MaxFileSize == 0 || key.Size < workReader.Config.MaxFileSize {
 				// OK. Process this.
 				s3Files = append(s3Files, s3File)
 			} else {
@@ -124,8 +196,42 @@ func filterLargeFiles(bucketSummaries []*bagman.BucketSummary) (s3Files []*bagma
 	return s3Files
 }
 
+// logNameCollisions warns about tar files that would be ingested as
+// the same intellectual object, such as "mybag.tar" and
+// "mybag.b001.of001.tar" in the same receiving bucket, and about
+// files whose names are malformed. Names are compared in sorted
+// order, so the warnings are the same on every run.
+func logNameCollisions(s3Files []*bagman.S3File) {
+	namesByObject := make(map[string][]string)
+	for _, s3File := range s3Files {
+		objectName, err := bagman.CleanBagName(s3File.BagName())
+		if err != nil {
+			workReader.MessageLog.Warning(err.Error())
+			continue
+		}
+		namesByObject[objectName] = append(namesByObject[objectName], s3File.BagName())
+	}
+	objectNames := make([]string, 0, len(namesByObject))
+	for objectName := range namesByObject {
+		objectNames = append(objectNames, objectName)
+	}
+	sort.Strings(objectNames)
+	for _, objectName := range objectNames {
+		names := namesByObject[objectName]
+		sort.Strings(names)
+		for i := 0; i < len(names); i++ {
+			for j := i + 1; j < len(names); j++ {
+				if bagman.WouldCollide(names[i], names[j]) {
+					workReader.MessageLog.Warning("%s and %s would both be ingested as %s",
+						names[i], names[j], objectName)
+				}
+			}
+		}
+	}
+}
+
 func getStatusRecord(s3File *bagman.S3File) (status *bagman.ProcessStatus, err error) {
-	bagDate, err := time.Parse(bagman.S3DateFormat, s3File.Key.LastModified)
+	bagDate, err := bagman.ParseS3Time(s3File.Key.LastModified)
 	if err != nil {
 		msg := fmt.Sprintf("Cannot parse S3File mod date '%s'. "+
 			"File %s will be re-processed.",
@@ -219,19 +325,52 @@ func tellFluctusWeWontProcessThis(s3File *bagman.S3File) {
 			workReader.MessageLog.Error("Could not create Fluctus ProcessedItem "+
 				"for %s: %v", s3File.Key.Key, err)
 		} else {
-			workReader.MessageLog.Info("%s will not be processed because it is %d bytes " +
-				"and the size limit for this system is %d bytes.",
-				s3File.Key.Key, s3File.Key.Size, workReader.Config.MaxFileSize)
+			workReader.MessageLog.Info("%s will not be processed because it is %s (%d bytes) " +
+				"and the size limit for this system is %s (%d bytes).",
+				s3File.Key.Key, bagman.FormatBytes(s3File.Key.Size), s3File.Key.Size,
+				bagman.FormatBytes(workReader.Config.MaxFileSize), workReader.Config.MaxFileSize)
 		}
 	}
 }
 
-func createFluctusRecord(s3File *bagman.S3File, tryToIngest bool) (err error) {
+// rejectOversizeBag records in Fluctus that the bag in s3File is
+// over config.MaxBagSize, so the depositor can see why it was not
+// ingested. The record is failed, with no retry, so we don't look
+// at the bag again.
+func rejectOversizeBag(s3File *bagman.S3File, note string) {
+	status, err := getStatusRecord(s3File)
+	if err != nil {
+		// Without the status, we can't tell whether the bag was
+		// already rejected. Try again on the next run.
+		workReader.MessageLog.Error("Cannot get Fluctus status of oversize bag %s: %v",
+			s3File.Key.Key, err)
+		return
+	}
+	if status != nil {
+		return
+	}
+	status = newFluctusRecord(s3File)
+	status.Note = note
+	status.Status = bagman.StatusFailed
+	status.Retry = false
+	status.SetOutcome(bagman.OutcomeFailure, "Bag exceeds the maximum bag size.")
+	err = workReader.FluctusClient.UpdateProcessedItem(status)
+	if err != nil {
+		workReader.MessageLog.Error("Could not create Fluctus ProcessedItem "+
+			"for %s: %v", s3File.Key.Key, err)
+		return
+	}
+	workReader.MessageLog.Warning("Rejected %s: %s", s3File.Key.Key, note)
+}
+
+// Returns a new ProcessStatus for the ingest of s3File, in the
+// receive stage.
+func newFluctusRecord(s3File *bagman.S3File) (*bagman.ProcessStatus) {
 	status := &bagman.ProcessStatus{}
-	status.Date = time.Now().UTC()
+	status.Date = bagman.NowUTC()
 	status.Action = "Ingest"
 	status.Name = s3File.Key.Key
-	bagDate, _ := time.Parse(bagman.S3DateFormat, s3File.Key.LastModified)
+	bagDate, _ := bagman.ParseS3Time(s3File.Key.LastModified)
 	status.BagDate = bagDate
 	status.Bucket = s3File.BucketName
 	// Strip the quotes off the ETag
@@ -239,19 +378,25 @@ func createFluctusRecord(s3File *bagman.S3File, tryToIngest bool) (err error) {
 	status.Stage = bagman.StageReceive
 	status.Institution = bagman.OwnerOf(s3File.BucketName)
 	status.Reviewed = false
+	return status
+}
+
+func createFluctusRecord(s3File *bagman.S3File, tryToIngest bool) (err error) {
+	status := newFluctusRecord(s3File)
 
 	if tryToIngest == true {
 		status.Note = "Item is in receiving bucket. Processing has not started."
 		status.Status = bagman.StatusPending
 		status.Retry = true
 	} else {
-		status.Note = fmt.Sprintf("Item will not be processed because it is %d bytes " +
-			"and the size limit for this system is %d bytes.",
-			s3File.Key.Size, workReader.Config.MaxFileSize)
+		status.Note = fmt.Sprintf("Item will not be processed because it is %s (%d bytes) " +
+			"and the size limit for this system is %s (%d bytes).",
+			bagman.FormatBytes(s3File.Key.Size), s3File.Key.Size,
+			bagman.FormatBytes(workReader.Config.MaxFileSize), workReader.Config.MaxFileSize)
 		status.Status = bagman.StatusFailed
 		status.Retry = false
+		status.SetOutcome(bagman.OutcomeSkipped, "Bag exceeds the size limit for this system.")
 	}
-	status.Outcome = string(status.Status)
 
 
 	err = workReader.FluctusClient.UpdateProcessedItem(status)
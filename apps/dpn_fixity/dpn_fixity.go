@@ -0,0 +1,51 @@
+package main
+import (
+	"github.com/APTrust/bagman/dpn"
+	"github.com/APTrust/bagman/workers"
+)
+
+// dpn_fixity checks the fixity of the bags we store for other DPN
+// nodes. It streams each stored tar file from the DPN preservation
+// bucket, compares the sha256 digest of its tag manifest with the
+// bag's registered digest, records the outcome in the DPN registry,
+// and sends failures to the DPN trouble queue.
+//
+// Each run checks only its share of the bags we hold, most overdue
+// first, so the checks are spread evenly over FixityCheckInterval in
+// dpn_config.json. Set FixityRunInterval to match the cron schedule.
+//
+// This is meant to be run as a cron job. A typical cron entry for
+// this to run daily might look like this:
+//
+// 0 2 * * * . $HOME/.bash_profile /home/ubuntu/go/src/github.com/APTrust/bagman/bin/dpn_fixity -config=demo
+func main() {
+	procUtil := workers.CreateProcUtil("dpn")
+	procUtil.MessageLog.Info("dpn_fixity started")
+	dpnConfig, err := dpn.LoadConfig("dpn/dpn_config.json", procUtil.ConfigName)
+	if err != nil {
+		procUtil.MessageLog.Fatal(err.Error())
+	}
+	localClient, err := dpn.NewDPNRestClient(
+		dpnConfig.RestClient.LocalServiceURL,
+		dpnConfig.RestClient.LocalAPIRoot,
+		dpnConfig.RestClient.LocalAuthToken,
+		dpnConfig.LocalNode,
+		dpnConfig,
+		procUtil.MessageLog)
+	if err != nil {
+		procUtil.MessageLog.Fatal(err.Error())
+	}
+	checker, err := dpn.NewFixityChecker(localClient, procUtil.S3Client,
+		procUtil.Config.DPNPreservationBucket, dpnConfig, procUtil.MessageLog)
+	if err != nil {
+		procUtil.MessageLog.Fatal(err.Error())
+	}
+	checker.Trouble = func(result *dpn.DPNResult) {
+		dpn.SendToTroubleQueue(result, procUtil)
+	}
+	checked, failed, err := checker.Run()
+	if err != nil {
+		procUtil.MessageLog.Fatal(err.Error())
+	}
+	procUtil.MessageLog.Info("dpn_fixity checked %d bags; %d failed", checked, failed)
+}
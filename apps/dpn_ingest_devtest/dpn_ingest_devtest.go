@@ -17,6 +17,9 @@ func main() {
 	// some of ProcUtil's internal variables, like success count
 	// and failure count will be updated by each worker.
 	procUtil := workers.CreateProcUtil("dpn")
+	// We run each stage ourselves, so keep the items the
+	// workers would send on to the next stage out of nsqd.
+	procUtil.Queue = bagman.NewMemoryQueue()
 
 	pathToConfigFile := "dpn/dpn_config.json"
 	dpnConfig, err := dpn.LoadConfig(pathToConfigFile, "test")
@@ -24,7 +27,10 @@ func main() {
 		procUtil.MessageLog.Fatal(err.Error())
 	}
 	fmt.Println("Creating packager...")
-	packager := dpn.NewPackager(procUtil, dpnConfig)
+	packager, err := dpn.NewPackager(procUtil, dpnConfig)
+	if err != nil {
+		procUtil.MessageLog.Fatal(err.Error())
+	}
 	dpnResult := packager.RunTest("test.edu/ncsu.1840.16-1004")
 	if dpnResult.ErrorMessage == "" {
 		fmt.Println("Packager succeeded. Moving to storage.")
@@ -18,7 +18,10 @@ func main() {
 	if err != nil {
 		procUtil.MessageLog.Fatal(err.Error())
 	}
-	packager := dpn.NewPackager(procUtil, dpnConfig)
+	packager, err := dpn.NewPackager(procUtil, dpnConfig)
+	if err != nil {
+		procUtil.MessageLog.Fatal(err.Error())
+	}
 	consumer.AddHandler(packager)
 	consumer.ConnectToNSQLookupd(procUtil.Config.NsqLookupd)
 
@@ -104,8 +104,11 @@ func getSinceWhenDate() (time.Time) {
 // Fetches a batch of generic files needing fixity check and queues them
 // in NSQ. Returns the number of items queued.
 func fetchAndQueueBatch(sinceWhen time.Time, start, rows int) (int, error) {
-	url := fmt.Sprintf("%s/mput?topic=%s", workReader.Config.NsqdHttpAddress,
-		workReader.Config.FixityWorker.NsqTopic)
+	topic, err := workReader.Config.TopicForAction(bagman.ActionFixityCheck)
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("%s/mput?topic=%s", workReader.Config.NsqdHttpAddress, topic)
 	genericFiles, err := workReader.FluctusClient.GetFilesNotCheckedSince(sinceWhen, start, rows)
 	if err != nil {
 		return 0, err
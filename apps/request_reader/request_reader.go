@@ -61,25 +61,18 @@ func queueAllDeletionItems() {
 }
 
 
-// Queues a batch of items for restoration or deletion,
-// depending on the url param.
+// Queues a batch of items for restoration or deletion. Each item
+// goes to the NSQ topic for its action. See Config.ActionTopics.
 func queueBatch(results []*bagman.ProcessStatus, queueName string) {
 	start := 0
 	end := bagman.Min(len(results), batchSize)
 	for start <= end {
 		batch := results[start:end]
 		workReader.MessageLog.Info("Queuing batch of %d items", len(batch))
-		url := fmt.Sprintf("%s/mput?topic=%s", workReader.Config.NsqdHttpAddress,
-			workReader.Config.RestoreWorker.NsqTopic)
-		if queueName == "delete" {
-			url = fmt.Sprintf("%s/mput?topic=%s", workReader.Config.NsqdHttpAddress,
-				workReader.Config.FileDeleteWorker.NsqTopic)
+		err := bagman.QueueByAction(&workReader.Config, batch)
+		if err != nil {
+			workReader.MessageLog.Error("Error queuing %s batch: %v", queueName, err)
 		}
-		genericSlice := make([]interface{}, len(batch))
-		for i := range batch {
-			genericSlice[i] = batch[i]
-		}
-		bagman.QueueToNSQ(url, genericSlice)
 		logBatch(batch, queueName)
 		start = end + 1
 		if start < len(results) {
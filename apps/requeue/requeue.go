@@ -18,7 +18,6 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
-	"time"
 )
 
 
@@ -192,7 +191,7 @@ func sliceContains(slice []string, item string) (bool) {
 // CHANGE: This should retrieve the status record, set retry to true, then save it.
 // Use bagman.FluctusClient.SendProcessedItem to update the status record.
 func getStatusRecord(s3File *bagman.S3File) (status *bagman.ProcessStatus, err error) {
-	bagDate, err := time.Parse(bagman.S3DateFormat, s3File.Key.LastModified)
+	bagDate, err := bagman.ParseS3Time(s3File.Key.LastModified)
 	if err != nil {
 		msg := fmt.Sprintf("Cannot parse S3File mod date '%s'. "+
 			"File %s will be re-processed.",
@@ -0,0 +1,54 @@
+package bagman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LegacyAccessValues maps access (rights) spellings that depositors
+// have used in the past to the canonical values in AccessRights.
+// "consortial" and "institutional" come from early partner bags,
+// written before the spec settled on "consortia" and "institution".
+// Legacy values are accepted with a warning, so bags built with old
+// tools still ingest. Keys are lower-case.
+var LegacyAccessValues = map[string]string{
+	"consortial":    "consortia",
+	"institutional": "institution",
+}
+
+// NormalizeAccess returns the canonical form of an access (rights)
+// value: one of consortia, institution or restricted. Matching
+// ignores case and surrounding whitespace. Legacy spellings in
+// LegacyAccessValues are mapped to their canonical value, and the
+// mapping is described in warnings. Empty and unknown values return
+// an error.
+//
+// Ingest, restore and the DPN packager all go through this function,
+// so an object's access value means the same thing at every stage.
+func NormalizeAccess(value string) (canonical string, warnings []string, err error) {
+	warnings = make([]string, 0)
+	lcValue := strings.ToLower(strings.TrimSpace(value))
+	if lcValue == "" {
+		return "", warnings, fmt.Errorf("Access (rights) value is missing")
+	}
+	if stringInList(lcValue, AccessRights) {
+		return lcValue, warnings, nil
+	}
+	if mapped, ok := LegacyAccessValues[lcValue]; ok {
+		warnings = append(warnings, fmt.Sprintf(
+			"Access (rights) value '%s' is a legacy spelling of '%s'",
+			strings.TrimSpace(value), mapped))
+		return mapped, warnings, nil
+	}
+	return "", warnings, fmt.Errorf("Access (rights) value '%s' is not valid. "+
+		"Valid values are %s.", strings.TrimSpace(value), validAccessList())
+}
+
+// Returns the valid access values as a comma-separated list.
+func validAccessList() (string) {
+	values := make([]string, len(AccessRights))
+	copy(values, AccessRights)
+	sort.Strings(values)
+	return strings.Join(values, ", ")
+}
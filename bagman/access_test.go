@@ -0,0 +1,132 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type accessTestCase struct {
+	value     string
+	canonical string
+	warns     bool
+	valid     bool
+}
+
+var accessTestCases = []accessTestCase{
+	{"consortia", "consortia", false, true},
+	{"institution", "institution", false, true},
+	{"restricted", "restricted", false, true},
+	{"Consortia", "consortia", false, true},
+	{"INSTITUTION", "institution", false, true},
+	{"Restricted", "restricted", false, true},
+	{"  consortia\t", "consortia", false, true},
+	{"Consortia   ", "consortia", false, true},
+	{"consortial", "consortia", true, true},
+	{"Consortial", "consortia", true, true},
+	{" CONSORTIAL ", "consortia", true, true},
+	{"institutional", "institution", true, true},
+	{"Institutional", "institution", true, true},
+	{"\tinstitutional\n", "institution", true, true},
+	{"", "", false, false},
+	{"   ", "", false, false},
+	{"public", "", false, false},
+	{"Hands Off!", "", false, false},
+	{"consortia institution", "", false, false},
+	{"restrict", "", false, false},
+	{"instituion", "", false, false},
+}
+
+func TestNormalizeAccess(t *testing.T) {
+	for _, tc := range accessTestCases {
+		canonical, warnings, err := bagman.NormalizeAccess(tc.value)
+		if tc.valid && err != nil {
+			t.Errorf("NormalizeAccess('%s') returned error: %v", tc.value, err)
+			continue
+		}
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("NormalizeAccess('%s') should have returned an error", tc.value)
+			} else if strings.TrimSpace(tc.value) != "" && !strings.Contains(err.Error(), "not valid") {
+				t.Errorf("NormalizeAccess('%s') returned unexpected error: %v", tc.value, err)
+			}
+		}
+		if canonical != tc.canonical {
+			t.Errorf("NormalizeAccess('%s') returned '%s', expected '%s'",
+				tc.value, canonical, tc.canonical)
+		}
+		if tc.warns && len(warnings) != 1 {
+			t.Errorf("NormalizeAccess('%s') should have returned one warning, got %v",
+				tc.value, warnings)
+		} else if !tc.warns && len(warnings) != 0 {
+			t.Errorf("NormalizeAccess('%s') returned unexpected warnings: %v",
+				tc.value, warnings)
+		}
+	}
+}
+
+// Ingest and restore used to handle legacy access values differently.
+// Ingest corrected them, while restore wrote back whatever was in
+// Fedora. Both should now produce the same canonical value.
+func TestIngestAndRestoreAccessAgree(t *testing.T) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range accessTestCases {
+		if !tc.valid {
+			continue
+		}
+		for i := range result.BagReadResult.Tags {
+			if result.BagReadResult.Tags[i].Label == "Access" {
+				result.BagReadResult.Tags[i].Value = tc.value
+			}
+		}
+		ingested, err := result.IntellectualObject()
+		if err != nil {
+			t.Errorf("IntellectualObject() with access '%s' returned error: %v", tc.value, err)
+			continue
+		}
+		if ingested.Access != tc.canonical {
+			t.Errorf("Ingest recorded access '%s' for '%s', expected '%s'",
+				ingested.Access, tc.value, tc.canonical)
+		}
+
+		// Restore from what ingest recorded, and from a Fedora
+		// record that still has the depositor's original spelling.
+		fedoraRecord := *ingested
+		fedoraRecord.Access = tc.value
+		for _, obj := range []*bagman.IntellectualObject{ingested, &fedoraRecord} {
+			tags, err := obj.APTrustInfoTags()
+			if err != nil {
+				t.Errorf("APTrustInfoTags() with access '%s' returned error: %v", obj.Access, err)
+				continue
+			}
+			restored := ""
+			for _, tag := range tags {
+				if tag.Label == "Access" {
+					restored = tag.Value
+				}
+			}
+			if restored != ingested.Access {
+				t.Errorf("Restore wrote access '%s' for '%s', but ingest recorded '%s'",
+					restored, obj.Access, ingested.Access)
+			}
+		}
+	}
+
+	// Unknown values fail at both ends, rather than passing through.
+	for i := range result.BagReadResult.Tags {
+		if result.BagReadResult.Tags[i].Label == "Access" {
+			result.BagReadResult.Tags[i].Value = "public"
+		}
+	}
+	if _, err := result.IntellectualObject(); err == nil {
+		t.Errorf("IntellectualObject() should reject access 'public'")
+	}
+	obj := &bagman.IntellectualObject{Title: "Title", Access: "public"}
+	if _, err := obj.APTrustInfoTags(); err == nil {
+		t.Errorf("APTrustInfoTags() should reject access 'public'")
+	}
+}
@@ -0,0 +1,555 @@
+// +build !partners
+
+// Don't include this in the partners build: it uses the failure
+// classifications in failurereport.go.
+
+package bagman
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// How much activity a digest covers, if the generator doesn't say.
+const DEFAULT_DIGEST_PERIOD = 24 * time.Hour
+
+// How far back a digest reaches to catch up on activity that
+// earlier runs missed because they failed or didn't run.
+const DIGEST_MAX_CATCHUP = 7 * 24 * time.Hour
+
+// How many ProcessStatus records to request from Fluctus at once.
+const DIGEST_PAGE_SIZE = 200
+
+// What we tell depositors to do about failures that only they
+// can fix. We handle the other failures ourselves.
+var depositorActions = map[FailureClass]string{
+	FailureInvalidBag:  "Fix the problem described above and upload the bag again.",
+	FailureBadBagName:  "Rename the tar file so it follows the APTrust naming rules, and upload it again.",
+	FailureBagTooLarge: "Split the bag into a multipart bag, with each part under the size limit, and upload the parts.",
+	FailureMissingBag:  "The bag was removed from your receiving bucket before we could ingest it. Upload it again if you still want it ingested.",
+}
+
+// DigestStatusClient is the part of the FluctusClient that
+// DigestGenerator needs.
+type DigestStatusClient interface {
+	BulkStatusGetPage(since time.Time, offset, limit int) ([]*ProcessStatus, error)
+}
+
+// DigestItem describes one bag or restore in an ActivityDigest.
+type DigestItem struct {
+	Id               int        `json:"id"`
+	Name             string     `json:"name"`
+	ObjectIdentifier string     `json:"object_identifier,omitempty"`
+	Action           ActionType `json:"action"`
+	Stage            StageType  `json:"stage"`
+	Status           StatusType `json:"status"`
+	Date             time.Time  `json:"date"`
+	// Reason is the note from the ProcessedItem. For failures,
+	// it says what went wrong.
+	Reason           string     `json:"reason,omitempty"`
+	// ActionNeeded is true if the depositor has to fix a failure.
+	// Advice says what to do.
+	ActionNeeded     bool       `json:"action_needed"`
+	Advice           string     `json:"advice,omitempty"`
+}
+
+// NewDigestItem returns a DigestItem describing status.
+func NewDigestItem(status *ProcessStatus) (*DigestItem) {
+	item := &DigestItem{
+		Id:               status.Id,
+		Name:             status.Name,
+		ObjectIdentifier: status.ObjectIdentifier,
+		Action:           status.Action,
+		Stage:            status.Stage,
+		Status:           status.Status,
+		Date:             status.Date,
+		Reason:           strings.TrimSpace(status.Note),
+	}
+	if len(item.Reason) > MAX_FAILURE_ERROR_LENGTH {
+		item.Reason = item.Reason[:MAX_FAILURE_ERROR_LENGTH] + "..."
+	}
+	if status.Status == StatusFailed {
+		item.Advice, item.ActionNeeded = depositorActions[ClassifyErrorMessage(status.Note)]
+	}
+	return item
+}
+
+/*
+ActivityDigest summarizes what happened to one institution's
+deposits and restores during the digest period: bags ingested, bags
+that failed, bags still in progress and restores completed. It's
+meant to be emailed to the institution once a day. See
+DigestGenerator.
+*/
+type ActivityDigest struct {
+	Institution     string        `json:"institution"`
+	InstitutionName string        `json:"institution_name"`
+	Start           time.Time     `json:"start"`
+	End             time.Time     `json:"end"`
+	Ingested        []*DigestItem `json:"ingested"`
+	Failed          []*DigestItem `json:"failed"`
+	InProgress      []*DigestItem `json:"in_progress"`
+	Restored        []*DigestItem `json:"restored"`
+}
+
+// IsEmpty returns true if nothing happened.
+func (digest *ActivityDigest) IsEmpty() (bool) {
+	return len(digest.Ingested) == 0 && len(digest.Failed) == 0 &&
+		len(digest.InProgress) == 0 && len(digest.Restored) == 0
+}
+
+// ActionNeededCount returns the number of failures the depositor
+// has to fix.
+func (digest *ActivityDigest) ActionNeededCount() (int) {
+	count := 0
+	for _, item := range digest.Failed {
+		if item.ActionNeeded {
+			count++
+		}
+	}
+	return count
+}
+
+// Items returns all of the items in the digest.
+func (digest *ActivityDigest) Items() ([]*DigestItem) {
+	items := make([]*DigestItem, 0)
+	items = append(items, digest.Ingested...)
+	items = append(items, digest.Failed...)
+	items = append(items, digest.InProgress...)
+	return append(items, digest.Restored...)
+}
+
+// Subject returns the subject line for the digest's email.
+func (digest *ActivityDigest) Subject() (string) {
+	counts := make([]string, 0)
+	if len(digest.Ingested) > 0 {
+		counts = append(counts, fmt.Sprintf("%d ingested", len(digest.Ingested)))
+	}
+	if len(digest.Failed) > 0 {
+		counts = append(counts, fmt.Sprintf("%d failed", len(digest.Failed)))
+	}
+	if len(digest.InProgress) > 0 {
+		counts = append(counts, fmt.Sprintf("%d in progress", len(digest.InProgress)))
+	}
+	if len(digest.Restored) > 0 {
+		counts = append(counts, fmt.Sprintf("%d restored", len(digest.Restored)))
+	}
+	subject := fmt.Sprintf("APTrust activity for %s, %s: %s", digest.InstitutionName,
+		digest.End.UTC().Format("2006-01-02"), strings.Join(counts, ", "))
+	if digest.ActionNeededCount() > 0 {
+		subject = "Action needed: " + subject
+	}
+	return subject
+}
+
+var activityDigestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"date": func(t time.Time) (string) { return t.UTC().Format("2006-01-02 15:04 MST") },
+}).Parse(`APTrust activity for {{.InstitutionName}}
+from {{date .Start}} to {{date .End}}
+{{if .Failed}}
+FAILED ({{len .Failed}}){{if .ActionNeededCount}}, {{.ActionNeededCount}} of which need action from you{{end}}
+{{range .Failed}}
+  {{.Name}} ({{.Action}} failed in {{.Stage}} at {{date .Date}})
+    {{.Reason}}
+{{if .ActionNeeded}}    ACTION NEEDED: {{.Advice}}
+{{else}}    APTrust is looking into this. You don't need to do anything.
+{{end}}{{end}}{{end}}{{if .Ingested}}
+INGESTED ({{len .Ingested}})
+{{range .Ingested}}  {{.Name}} => {{.ObjectIdentifier}}
+{{end}}{{end}}{{if .Restored}}
+RESTORED ({{len .Restored}})
+{{range .Restored}}  {{.ObjectIdentifier}} => {{.Name}}
+{{end}}{{end}}{{if .InProgress}}
+IN PROGRESS ({{len .InProgress}})
+{{range .InProgress}}  {{.Name}} ({{.Action}}, {{.Stage}} {{.Status}})
+{{end}}{{end}}
+Questions? Write to help@aptrust.org.
+`))
+
+// Text returns the digest as the plain-text body of an email.
+func (digest *ActivityDigest) Text() (string, error) {
+	buffer := &bytes.Buffer{}
+	if err := activityDigestTemplate.Execute(buffer, digest); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// Notification returns the digest as a notification for recipients.
+// If attachJson is true, the digest is also attached as JSON.
+func (digest *ActivityDigest) Notification(recipients []string, attachJson bool) (*Notification, error) {
+	body, err := digest.Text()
+	if err != nil {
+		return nil, err
+	}
+	notification := &Notification{
+		Recipients:  recipients,
+		Subject:     digest.Subject(),
+		Body:        body,
+		Attachments: make([]*NotificationAttachment, 0),
+	}
+	if attachJson {
+		data, err := json.MarshalIndent(digest, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		notification.Attachments = append(notification.Attachments, &NotificationAttachment{
+			FileName: fmt.Sprintf("aptrust-activity-%s-%s.json", digest.Institution,
+				digest.End.UTC().Format("2006-01-02")),
+			ContentType: "application/json",
+			Data:        data,
+		})
+	}
+	return notification, nil
+}
+
+// DigestMark is an institution's high-water mark: the newest
+// ProcessStatus date its last digest covered, and the ids of the
+// items with that date. Items at or before the mark are not
+// reported again.
+type DigestMark struct {
+	Through time.Time `json:"through"`
+	Ids     []int     `json:"ids"`
+}
+
+// Covers returns true if the item with this id and date was
+// already reported.
+func (mark *DigestMark) Covers(id int, date time.Time) (bool) {
+	if mark == nil || date.After(mark.Through) {
+		return false
+	}
+	if date.Before(mark.Through) {
+		return true
+	}
+	for _, markId := range mark.Ids {
+		if markId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// DigestState is what DigestGenerator remembers between runs.
+type DigestState struct {
+	// LastRun is when every digest was last sent successfully.
+	LastRun time.Time              `json:"last_run"`
+	// Marks are keyed by institution identifier.
+	Marks   map[string]*DigestMark `json:"marks"`
+}
+
+// LoadDigestState reads the DigestState from filePath. If the file
+// doesn't exist, it returns an empty state.
+func LoadDigestState(filePath string) (*DigestState, error) {
+	state := &DigestState{Marks: make(map[string]*DigestMark)}
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Cannot read digest state from %s: %v", filePath, err)
+	}
+	if state.Marks == nil {
+		state.Marks = make(map[string]*DigestMark)
+	}
+	return state, nil
+}
+
+// Save writes the state to filePath as JSON. It writes to a temp
+// file first, so a crash doesn't leave a partial file.
+func (state *DigestState) Save(filePath string) (error) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := filePath + ".tmp"
+	if err = ioutil.WriteFile(tempFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, filePath)
+}
+
+// Since returns the start of the period a digest ending at now
+// should cover. That's period before now, or the last successful
+// run if that was earlier, but never more than DIGEST_MAX_CATCHUP.
+func (state *DigestState) Since(now time.Time, period time.Duration) (time.Time) {
+	since := now.Add(-period)
+	if !state.LastRun.IsZero() && state.LastRun.Before(since) {
+		since = state.LastRun
+	}
+	if since.Before(now.Add(-DIGEST_MAX_CATCHUP)) {
+		since = now.Add(-DIGEST_MAX_CATCHUP)
+	}
+	return since
+}
+
+// Advance moves the institution's mark past every item in digest,
+// so the next digest won't repeat them.
+func (state *DigestState) Advance(digest *ActivityDigest) {
+	mark := state.Marks[digest.Institution]
+	if mark == nil {
+		mark = &DigestMark{Ids: make([]int, 0)}
+		state.Marks[digest.Institution] = mark
+	}
+	for _, item := range digest.Items() {
+		if item.Date.After(mark.Through) {
+			mark.Through = item.Date
+			mark.Ids = []int{item.Id}
+		} else if item.Date.Equal(mark.Through) && !mark.Covers(item.Id, item.Date) {
+			mark.Ids = append(mark.Ids, item.Id)
+		}
+	}
+}
+
+// GroupActivity sorts records into one ActivityDigest per
+// institution, covering start to end. It leaves out records that
+// the institution's mark in state says were already reported, and
+// records that partners don't need to hear about, such as deletions
+// and fixity checks. Institutions with nothing to report have no
+// digest. Digests are sorted by institution, and items by date.
+func GroupActivity(records []*ProcessStatus, state *DigestState, start, end time.Time) ([]*ActivityDigest) {
+	digests := make(map[string]*ActivityDigest)
+	for _, status := range records {
+		if status.Institution == "" || state.Marks[status.Institution].Covers(status.Id, status.Date) {
+			continue
+		}
+		digest := digests[status.Institution]
+		if digest == nil {
+			digest = &ActivityDigest{
+				Institution:     status.Institution,
+				InstitutionName: status.InstitutionName,
+				Start:           start,
+				End:             end,
+				Ingested:        make([]*DigestItem, 0),
+				Failed:          make([]*DigestItem, 0),
+				InProgress:      make([]*DigestItem, 0),
+				Restored:        make([]*DigestItem, 0),
+			}
+			if digest.InstitutionName == "" {
+				digest.InstitutionName = InstitutionNameLookup(status.Institution)
+			}
+		}
+		item := NewDigestItem(status)
+		switch digestGroup(status) {
+		case "ingested":
+			digest.Ingested = append(digest.Ingested, item)
+		case "failed":
+			digest.Failed = append(digest.Failed, item)
+		case "in progress":
+			digest.InProgress = append(digest.InProgress, item)
+		case "restored":
+			digest.Restored = append(digest.Restored, item)
+		default:
+			continue
+		}
+		digests[status.Institution] = digest
+	}
+	institutions := make([]string, 0, len(digests))
+	for institution := range digests {
+		institutions = append(institutions, institution)
+	}
+	sort.Strings(institutions)
+	sorted := make([]*ActivityDigest, len(institutions))
+	for i, institution := range institutions {
+		digest := digests[institution]
+		for _, items := range [][]*DigestItem{digest.Ingested, digest.Failed,
+			digest.InProgress, digest.Restored} {
+			sort.Sort(digestItemsByDate(items))
+		}
+		sorted[i] = digest
+	}
+	return sorted
+}
+
+// Returns the digest section status belongs in, or an empty
+// string if it doesn't belong in the digest.
+func digestGroup(status *ProcessStatus) (string) {
+	switch status.Action {
+	case ActionIngest:
+		switch status.Status {
+		case StatusFailed:
+			return "failed"
+		case StatusSuccess:
+			if status.Stage == StageRecord || status.Stage == StageCleanup {
+				return "ingested"
+			}
+			return "in progress"
+		case StatusStarted, StatusPending:
+			return "in progress"
+		}
+	case ActionRestore:
+		switch status.Status {
+		case StatusFailed:
+			return "failed"
+		case StatusSuccess:
+			return "restored"
+		case StatusStarted, StatusPending:
+			return "in progress"
+		}
+	}
+	return ""
+}
+
+type digestItemsByDate []*DigestItem
+
+func (items digestItemsByDate) Len() int {
+	return len(items)
+}
+
+func (items digestItemsByDate) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+}
+
+func (items digestItemsByDate) Less(i, j int) bool {
+	if items[i].Date.Equal(items[j].Date) {
+		return items[i].Name < items[j].Name
+	}
+	return items[i].Date.Before(items[j].Date)
+}
+
+// FetchActivity returns all of the ProcessStatus records that
+// changed since the specified time, requesting pageSize records at
+// a time. If pageSize is less than 1, it uses DIGEST_PAGE_SIZE.
+func FetchActivity(client DigestStatusClient, since time.Time, pageSize int) ([]*ProcessStatus, error) {
+	if pageSize < 1 {
+		pageSize = DIGEST_PAGE_SIZE
+	}
+	records := make([]*ProcessStatus, 0)
+	seen := make(map[int]bool)
+	for offset := 0; ; offset += pageSize {
+		page, err := client.BulkStatusGetPage(since, offset, pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get activity since %s from Fluctus: %v",
+				FormatUTC(since), err)
+		}
+		added := 0
+		for _, status := range page {
+			if seen[status.Id] {
+				continue
+			}
+			seen[status.Id] = true
+			records = append(records, status)
+			added++
+		}
+		// A page with nothing new means Fluctus ignored the paging
+		// params and sent everything the first time.
+		if len(page) < pageSize || added == 0 {
+			break
+		}
+	}
+	return records, nil
+}
+
+/*
+DigestGenerator sends each institution a digest of its activity
+since the last run. It's meant to run once a day, from cron or from
+another process.
+
+Each institution's high-water mark in StateFile keeps consecutive
+runs from reporting the same item twice. An item that changes
+after it's reported, such as a bag that was in progress and then
+ingested, shows up again in its new section. Institutions with no
+activity, and institutions with no recipients, get no digest.
+*/
+type DigestGenerator struct {
+	// Fluctus supplies the ProcessStatus records.
+	Fluctus    DigestStatusClient
+
+	// Notifier delivers the digests.
+	Notifier   Notifier
+
+	// Recipients are keyed by institution identifier.
+	Recipients map[string][]string
+
+	// AttachJson attaches each digest as JSON.
+	AttachJson bool
+
+	// StateFile holds the high-water marks. If it's empty, the
+	// generator starts with no marks each run and saves nothing.
+	StateFile  string
+
+	// Period is how far back the digest reaches, if the last run
+	// was more recent. Defaults to DEFAULT_DIGEST_PERIOD.
+	Period     time.Duration
+
+	// PageSize is how many records to request from Fluctus at
+	// once. Defaults to DIGEST_PAGE_SIZE.
+	PageSize   int
+
+	// DryRun builds the digests without sending them or
+	// saving the state.
+	DryRun     bool
+
+	// Now is the end of the digest period. If zero, the
+	// generator uses the current time.
+	Now        time.Time
+}
+
+// Run builds and sends the digests, and returns the ones it sent,
+// or would have sent in a dry run. If some digests can't be sent,
+// it sends the rest, and the error lists the ones that failed.
+// Their marks don't advance, so the next run reports their items.
+func (generator *DigestGenerator) Run() ([]*ActivityDigest, error) {
+	now := generator.Now
+	if now.IsZero() {
+		now = NowUTC()
+	}
+	period := generator.Period
+	if period <= 0 {
+		period = DEFAULT_DIGEST_PERIOD
+	}
+	state := &DigestState{Marks: make(map[string]*DigestMark)}
+	if generator.StateFile != "" {
+		var err error
+		if state, err = LoadDigestState(generator.StateFile); err != nil {
+			return nil, err
+		}
+	}
+	since := state.Since(now, period)
+	records, err := FetchActivity(generator.Fluctus, since, generator.PageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	sent := make([]*ActivityDigest, 0)
+	errors := make([]string, 0)
+	for _, digest := range GroupActivity(records, state, since, now) {
+		recipients := generator.Recipients[digest.Institution]
+		if len(recipients) == 0 {
+			continue
+		}
+		notification, err := digest.Notification(recipients, generator.AttachJson)
+		if err == nil && !generator.DryRun {
+			err = generator.Notifier.Notify(notification)
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", digest.Institution, err))
+			continue
+		}
+		state.Advance(digest)
+		sent = append(sent, digest)
+	}
+	if generator.DryRun {
+		return sent, nil
+	}
+	if len(errors) == 0 {
+		state.LastRun = now
+	}
+	if generator.StateFile != "" {
+		if err = state.Save(generator.StateFile); err != nil {
+			errors = append(errors, fmt.Sprintf("Cannot save digest state: %v", err))
+		}
+	}
+	if len(errors) > 0 {
+		return sent, fmt.Errorf("Could not send every digest: %s", strings.Join(errors, "; "))
+	}
+	return sent, nil
+}
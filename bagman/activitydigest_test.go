@@ -0,0 +1,386 @@
+// +build !partners
+
+package bagman_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var digestNow = time.Date(2016, 6, 2, 6, 0, 0, 0, time.UTC)
+
+// fakeDigestClient serves canned ProcessStatus records a page at a
+// time, or all at once if ignorePaging is true, as older versions
+// of Fluctus do.
+type fakeDigestClient struct {
+	records      []*bagman.ProcessStatus
+	ignorePaging bool
+	requests     int
+}
+
+func (fake *fakeDigestClient) BulkStatusGetPage(since time.Time, offset, limit int) ([]*bagman.ProcessStatus, error) {
+	fake.requests++
+	page := make([]*bagman.ProcessStatus, 0)
+	for _, status := range fake.records {
+		if !status.Date.Before(since) {
+			page = append(page, status)
+		}
+	}
+	if fake.ignorePaging {
+		return page, nil
+	}
+	if offset >= len(page) {
+		return page[:0], nil
+	}
+	return page[offset:bagman.Min(offset+limit, len(page))], nil
+}
+
+// fakeNotifier remembers the notifications it sends, or fails.
+type fakeNotifier struct {
+	sent []*bagman.Notification
+	fail bool
+}
+
+func (fake *fakeNotifier) Notify(notification *bagman.Notification) (error) {
+	if fake.fail {
+		return fmt.Errorf("Connection refused")
+	}
+	fake.sent = append(fake.sent, notification)
+	return nil
+}
+
+func digestStatus(id int, institution, name string, action bagman.ActionType, stage bagman.StageType,
+	status bagman.StatusType, hoursAgo int, note string) (*bagman.ProcessStatus) {
+	return &bagman.ProcessStatus{
+		Id:               id,
+		Institution:      institution,
+		Name:             name,
+		ObjectIdentifier: institution + "/" + strings.TrimSuffix(name, ".tar"),
+		Action:           action,
+		Stage:            stage,
+		Status:           status,
+		Date:             digestNow.Add(time.Duration(-hoursAgo) * time.Hour),
+		Note:             note,
+	}
+}
+
+// Returns canned activity for two institutions, and a deletion
+// and a fixity check that don't belong in a digest.
+func digestRecords() ([]*bagman.ProcessStatus) {
+	return []*bagman.ProcessStatus{
+		digestStatus(1, "unc.edu", "unc.edu.bag1.tar", bagman.ActionIngest, bagman.StageCleanup,
+			bagman.StatusSuccess, 20, "Bag ingested"),
+		digestStatus(2, "unc.edu", "unc.edu.bag2.tar", bagman.ActionIngest, bagman.StageRecord,
+			bagman.StatusSuccess, 10, "Bag ingested"),
+		digestStatus(3, "unc.edu", "unc.edu.bag3.tar", bagman.ActionIngest, bagman.StageValidate,
+			bagman.StatusFailed, 12, "Bag is missing required file 'bagit.txt'"),
+		digestStatus(4, "unc.edu", "unc.edu.bag4.tar", bagman.ActionIngest, bagman.StageRecord,
+			bagman.StatusFailed, 8, "Error saving IntellectualObject in Fluctus"),
+		digestStatus(5, "unc.edu", "unc.edu.bag5.tar", bagman.ActionIngest, bagman.StageFetch,
+			bagman.StatusSuccess, 2, "Bag fetched"),
+		digestStatus(6, "unc.edu", "unc.edu.bag6.tar", bagman.ActionIngest, bagman.StageReceive,
+			bagman.StatusPending, 1, "Bag is in receiving bucket"),
+		digestStatus(7, "unc.edu", "unc.edu.bag7.tar", bagman.ActionRestore, bagman.StageRecord,
+			bagman.StatusSuccess, 5, "Object restored"),
+		digestStatus(8, "unc.edu", "unc.edu.bag8.tar", bagman.ActionDelete, bagman.StageResolve,
+			bagman.StatusSuccess, 5, "File deleted"),
+		digestStatus(9, "virginia.edu", "virginia.edu.bag1.tar", bagman.ActionIngest, bagman.StageRecord,
+			bagman.StatusSuccess, 3, "Bag ingested"),
+		digestStatus(10, "virginia.edu", "virginia.edu.bag2.tar", bagman.ActionFixityCheck,
+			bagman.StageResolve, bagman.StatusSuccess, 3, "Fixity ok"),
+		digestStatus(11, "virginia.edu", "virginia.edu.bag3.tar", bagman.ActionIngest, bagman.StageFetch,
+			bagman.StatusFailed, 4, "virginia.edu.bag 3.tar is not a valid bag name"),
+	}
+}
+
+func digestItemNames(items []*bagman.DigestItem) (string) {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestGroupActivity(t *testing.T) {
+	state := &bagman.DigestState{Marks: make(map[string]*bagman.DigestMark)}
+	start := digestNow.Add(-24 * time.Hour)
+	digests := bagman.GroupActivity(digestRecords(), state, start, digestNow)
+	if len(digests) != 2 {
+		t.Fatalf("Expected 2 digests, got %d", len(digests))
+	}
+	unc := digests[0]
+	if unc.Institution != "unc.edu" || digests[1].Institution != "virginia.edu" {
+		t.Errorf("Digests should be sorted by institution")
+	}
+	if unc.InstitutionName != "unc.edu" || !unc.Start.Equal(start) || !unc.End.Equal(digestNow) {
+		t.Errorf("Digest has wrong name or period: %s, %s, %s", unc.InstitutionName, unc.Start, unc.End)
+	}
+	if names := digestItemNames(unc.Ingested); names != "unc.edu.bag1.tar,unc.edu.bag2.tar" {
+		t.Errorf("Wrong ingested bags, in wrong order: %s", names)
+	}
+	if names := digestItemNames(unc.Failed); names != "unc.edu.bag3.tar,unc.edu.bag4.tar" {
+		t.Errorf("Wrong failed bags: %s", names)
+	}
+	if names := digestItemNames(unc.InProgress); names != "unc.edu.bag5.tar,unc.edu.bag6.tar" {
+		t.Errorf("Wrong bags in progress: %s", names)
+	}
+	if names := digestItemNames(unc.Restored); names != "unc.edu.bag7.tar" {
+		t.Errorf("Wrong restores: %s", names)
+	}
+	if !unc.Failed[0].ActionNeeded || unc.Failed[0].Advice == "" {
+		t.Errorf("Invalid bag should need action from the depositor")
+	}
+	if unc.Failed[1].ActionNeeded || unc.Failed[1].Advice != "" {
+		t.Errorf("Fluctus error should not need action from the depositor")
+	}
+	if unc.ActionNeededCount() != 1 || unc.IsEmpty() {
+		t.Errorf("Expected 1 failure needing action, got %d", unc.ActionNeededCount())
+	}
+
+	virginia := digests[1]
+	if len(virginia.Items()) != 2 || len(virginia.Ingested) != 1 || len(virginia.Failed) != 1 {
+		t.Errorf("Virginia digest should have 1 ingest and 1 failure, and no fixity check")
+	}
+	if !virginia.Failed[0].ActionNeeded {
+		t.Errorf("Bad bag name should need action from the depositor")
+	}
+
+	// Marks leave out items that were already reported.
+	state.Advance(unc)
+	state.Advance(virginia)
+	if digests = bagman.GroupActivity(digestRecords(), state, start, digestNow); len(digests) != 0 {
+		t.Errorf("Expected no digests after marks advanced, got %d", len(digests))
+	}
+}
+
+func TestActivityDigestText(t *testing.T) {
+	state := &bagman.DigestState{Marks: make(map[string]*bagman.DigestMark)}
+	digests := bagman.GroupActivity(digestRecords(), state, digestNow.Add(-24*time.Hour), digestNow)
+	unc, virginia := digests[0], digests[1]
+	text, err := unc.Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"APTrust activity for unc.edu\nfrom 2016-06-01 06:00 UTC to 2016-06-02 06:00 UTC\n",
+		"FAILED (2), 1 of which need action from you\n",
+		"  unc.edu.bag3.tar (Ingest failed in Validate at 2016-06-01 18:00 UTC)\n" +
+			"    Bag is missing required file 'bagit.txt'\n    ACTION NEEDED: ",
+		"    APTrust is looking into this. You don't need to do anything.\n",
+		"INGESTED (2)\n  unc.edu.bag1.tar => unc.edu/unc.edu.bag1\n",
+		"RESTORED (1)\n  unc.edu/unc.edu.bag7 => unc.edu.bag7.tar\n",
+		"IN PROGRESS (2)\n  unc.edu.bag5.tar (Ingest, Fetch Success)\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Digest text should contain %q:\n%s", expected, text)
+		}
+	}
+	subject := unc.Subject()
+	if subject != "Action needed: APTrust activity for unc.edu, 2016-06-02: "+
+		"2 ingested, 2 failed, 2 in progress, 1 restored" {
+		t.Errorf("Wrong subject: %s", subject)
+	}
+
+	text, err = virginia.Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(text, "RESTORED") || strings.Contains(text, "IN PROGRESS") {
+		t.Errorf("Digest text should leave out empty sections:\n%s", text)
+	}
+
+	notification, err := unc.Notification([]string{"a@unc.edu"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.Subject != subject || len(notification.Recipients) != 1 ||
+		len(notification.Attachments) != 1 {
+		t.Fatalf("Notification has wrong subject, recipients or attachments: %+v", notification)
+	}
+	attachment := notification.Attachments[0]
+	if attachment.FileName != "aptrust-activity-unc.edu-2016-06-02.json" {
+		t.Errorf("Wrong attachment name %s", attachment.FileName)
+	}
+	fromJson := &bagman.ActivityDigest{}
+	if err = json.Unmarshal(attachment.Data, fromJson); err != nil {
+		t.Fatal(err)
+	}
+	if len(fromJson.Failed) != 2 || !fromJson.Failed[0].ActionNeeded {
+		t.Errorf("JSON attachment doesn't match digest")
+	}
+	if notification, _ = unc.Notification([]string{"a@unc.edu"}, false); len(notification.Attachments) != 0 {
+		t.Errorf("Notification should have no attachments")
+	}
+}
+
+func TestDigestState(t *testing.T) {
+	mark := &bagman.DigestMark{Through: digestNow, Ids: []int{1}}
+	if !mark.Covers(2, digestNow.Add(-time.Second)) || !mark.Covers(1, digestNow) {
+		t.Errorf("Mark should cover older items and items it lists")
+	}
+	if mark.Covers(2, digestNow) || mark.Covers(1, digestNow.Add(time.Second)) {
+		t.Errorf("Mark should not cover newer items or unlisted items at its time")
+	}
+	var noMark *bagman.DigestMark
+	if noMark.Covers(1, digestNow) {
+		t.Errorf("Missing mark should cover nothing")
+	}
+
+	// Two items at the newest time both go in the mark.
+	state := &bagman.DigestState{Marks: make(map[string]*bagman.DigestMark)}
+	state.Advance(&bagman.ActivityDigest{
+		Institution: "unc.edu",
+		Ingested: []*bagman.DigestItem{
+			{Id: 1, Date: digestNow.Add(-time.Hour)},
+			{Id: 2, Date: digestNow},
+		},
+		Failed: []*bagman.DigestItem{{Id: 3, Date: digestNow}},
+	})
+	mark = state.Marks["unc.edu"]
+	if !mark.Through.Equal(digestNow) || len(mark.Ids) != 2 {
+		t.Errorf("Expected mark at %s with ids 2 and 3, got %s and %v", digestNow, mark.Through, mark.Ids)
+	}
+
+	// Since reaches back to the last run, but not too far.
+	day := 24 * time.Hour
+	if since := state.Since(digestNow, day); !since.Equal(digestNow.Add(-day)) {
+		t.Errorf("First run should cover one period, got %s", since)
+	}
+	state.LastRun = digestNow.Add(-3 * day)
+	if since := state.Since(digestNow, day); !since.Equal(state.LastRun) {
+		t.Errorf("Run should cover the days since the last run, got %s", since)
+	}
+	state.LastRun = digestNow.Add(-30 * day)
+	if since := state.Since(digestNow, day); !since.Equal(digestNow.Add(-bagman.DIGEST_MAX_CATCHUP)) {
+		t.Errorf("Run should catch up at most DIGEST_MAX_CATCHUP, got %s", since)
+	}
+
+	dir, err := ioutil.TempDir("", "digest_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	loaded, err := bagman.LoadDigestState(stateFile)
+	if err != nil || len(loaded.Marks) != 0 || !loaded.LastRun.IsZero() {
+		t.Errorf("Missing state file should give an empty state: %v", err)
+	}
+	if err = state.Save(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = bagman.LoadDigestState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.LastRun.Equal(state.LastRun) || !loaded.Marks["unc.edu"].Covers(3, digestNow) {
+		t.Errorf("Loaded state doesn't match saved state: %+v", loaded)
+	}
+}
+
+func TestFetchActivity(t *testing.T) {
+	since := digestNow.Add(-24 * time.Hour)
+	client := &fakeDigestClient{records: digestRecords()}
+	records, err := bagman.FetchActivity(client, since, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 11 || client.requests != 3 {
+		t.Errorf("Expected 11 records in 3 requests, got %d in %d", len(records), client.requests)
+	}
+
+	// Fluctus sends everything each time, so we stop after the
+	// second page has nothing new.
+	client = &fakeDigestClient{records: digestRecords(), ignorePaging: true}
+	records, err = bagman.FetchActivity(client, since, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 11 || client.requests != 2 {
+		t.Errorf("Expected 11 records in 2 requests, got %d in %d", len(records), client.requests)
+	}
+}
+
+func TestDigestGeneratorRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest_generator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := &fakeDigestClient{records: digestRecords()}
+	notifier := &fakeNotifier{}
+	generator := &bagman.DigestGenerator{
+		Fluctus:  client,
+		Notifier: notifier,
+		// No recipients for virginia.edu.
+		Recipients: map[string][]string{
+			"unc.edu": {"a@unc.edu", "b@unc.edu"},
+			"jhu.edu": {"a@jhu.edu"},
+		},
+		StateFile: filepath.Join(dir, "state.json"),
+		PageSize:  4,
+		Now:       digestNow,
+	}
+
+	// Dry run sends and saves nothing.
+	generator.DryRun = true
+	digests, err := generator.Run()
+	if err != nil || len(digests) != 1 || len(notifier.sent) != 0 {
+		t.Errorf("Dry run should return 1 digest and send none: %v", err)
+	}
+	if bagman.FileExists(generator.StateFile) {
+		t.Errorf("Dry run should not save state")
+	}
+	generator.DryRun = false
+
+	digests, err = generator.Run()
+	if err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	if len(digests) != 1 || len(notifier.sent) != 1 {
+		t.Fatalf("Expected 1 digest for unc.edu, got %d", len(notifier.sent))
+	}
+	if notifier.sent[0].Recipients[1] != "b@unc.edu" ||
+		!strings.Contains(notifier.sent[0].Subject, "unc.edu") {
+		t.Errorf("Digest went to the wrong place: %+v", notifier.sent[0])
+	}
+
+	// An hour later, nothing new has happened.
+	generator.Now = digestNow.Add(time.Hour)
+	if digests, err = generator.Run(); err != nil || len(digests) != 0 || len(notifier.sent) != 1 {
+		t.Errorf("Second run should not repeat the first: %d digests, %v", len(digests), err)
+	}
+
+	// Bag 5 finishes, and a new bag arrives at the same time.
+	finished := digestStatus(5, "unc.edu", "unc.edu.bag5.tar", bagman.ActionIngest, bagman.StageCleanup,
+		bagman.StatusSuccess, -2, "Bag ingested")
+	arrived := digestStatus(12, "unc.edu", "unc.edu.bag12.tar", bagman.ActionIngest, bagman.StageReceive,
+		bagman.StatusPending, -2, "Bag is in receiving bucket")
+	client.records[4] = finished
+	client.records = append(client.records, arrived)
+	generator.Now = digestNow.Add(3 * time.Hour)
+
+	// If the email fails, the mark doesn't move.
+	notifier.fail = true
+	if _, err = generator.Run(); err == nil || !strings.Contains(err.Error(), "unc.edu") {
+		t.Errorf("Run should return an error naming the institution: %v", err)
+	}
+	notifier.fail = false
+	digests, err = generator.Run()
+	if err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	if len(digests) != 1 || digestItemNames(digests[0].Ingested) != "unc.edu.bag5.tar" ||
+		digestItemNames(digests[0].InProgress) != "unc.edu.bag12.tar" || len(digests[0].Failed) != 0 {
+		t.Errorf("Third digest should have only the finished and new bags")
+	}
+	if len(notifier.sent) != 2 {
+		t.Errorf("Expected 2 digests sent in all, got %d", len(notifier.sent))
+	}
+}
@@ -0,0 +1,159 @@
+package bagman
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// BacklogEstimate estimates when an institution's pending bags will
+// finish ingest. Since we queue bags in roughly the order they were
+// uploaded, an institution's last bag finishes after every bag
+// uploaded before it, whoever owns them.
+type BacklogEstimate struct {
+	Institution      string
+	// The institution's bags that are waiting or in process.
+	InstitutionBags  int
+	// All pending bags uploaded no later than the institution's
+	// most recent pending bag, including its own. These all have
+	// to finish before the institution's last bag does.
+	BagsAhead        int
+	// The number of workers the estimate assumes.
+	Workers          int
+	Throughput       *Throughput
+	// Likely is the time until the institution's last bag finishes
+	// at the median hourly rate. Soonest and Latest are the times at
+	// the 75th and 25th percentile rates.
+	Soonest          time.Duration
+	Likely           time.Duration
+	Latest           time.Duration
+	// InsufficientData is true if we don't have enough throughput
+	// data to make an estimate. Reason says why.
+	InsufficientData bool
+	Reason           string
+}
+
+// EstimateBacklog estimates when the institution's pending bags will
+// finish. Param pending should include the pending ingest items of
+// all institutions. Param throughput should be the combined
+// throughput of the workers that recorded it. If workers is greater
+// than zero, the estimate scales the rate to that many workers, for
+// answering questions like "what if we add a worker?"
+func EstimateBacklog(institution string, pending []*ProcessStatus, throughput *Throughput, workers int) (*BacklogEstimate) {
+	estimate := &BacklogEstimate{
+		Institution: institution,
+		Throughput:  throughput,
+		Workers:     throughput.Workers,
+	}
+	estimate.InstitutionBags, estimate.BagsAhead = backlogPosition(institution, pending)
+	if estimate.InstitutionBags == 0 {
+		return estimate
+	}
+	if throughput.Span < ThroughputInterval {
+		estimate.InsufficientData = true
+		estimate.Reason = fmt.Sprintf("only %s of throughput data", FormatDuration(throughput.Span))
+		return estimate
+	}
+	rates := throughput.BusyRates()
+	if len(rates) == 0 {
+		estimate.InsufficientData = true
+		estimate.Reason = fmt.Sprintf("no bags finished in the last %s", FormatDuration(throughput.Span))
+		return estimate
+	}
+	scale := 1.0
+	if workers > 0 && throughput.Workers > 0 {
+		scale = float64(workers) / float64(throughput.Workers)
+		estimate.Workers = workers
+	}
+	bags := float64(estimate.BagsAhead)
+	estimate.Soonest = hoursToDuration(bags / (percentile(rates, 0.75) * scale))
+	estimate.Likely = hoursToDuration(bags / (percentile(rates, 0.5) * scale))
+	estimate.Latest = hoursToDuration(bags / (percentile(rates, 0.25) * scale))
+	return estimate
+}
+
+// Returns the number of the institution's bags in pending, and the
+// number of pending bags uploaded no later than the institution's
+// most recently uploaded bag.
+func backlogPosition(institution string, pending []*ProcessStatus) (institutionBags, bagsAhead int) {
+	var lastUploaded time.Time
+	for _, status := range pending {
+		if status.Institution == institution {
+			institutionBags++
+			if status.BagDate.After(lastUploaded) {
+				lastUploaded = status.BagDate
+			}
+		}
+	}
+	if institutionBags == 0 {
+		return 0, 0
+	}
+	for _, status := range pending {
+		if !status.BagDate.After(lastUploaded) {
+			bagsAhead++
+		}
+	}
+	return institutionBags, bagsAhead
+}
+
+// Returns the pth percentile (0.0 - 1.0) of sorted values,
+// interpolating between the closest values.
+func percentile(sorted []float64, p float64) (float64) {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	position := p * float64(len(sorted) - 1)
+	lower := int(math.Floor(position))
+	upper := int(math.Ceil(position))
+	fraction := position - float64(lower)
+	return sorted[lower] + (sorted[upper] - sorted[lower]) * fraction
+}
+
+func hoursToDuration(hours float64) (time.Duration) {
+	return time.Duration(hours * float64(time.Hour)).Round(time.Minute)
+}
+
+// String returns a summary suitable for telling a partner when
+// their bags should finish.
+func (estimate *BacklogEstimate) String() (string) {
+	if estimate.InstitutionBags == 0 {
+		return fmt.Sprintf("%s: no bags pending", estimate.Institution)
+	}
+	text := fmt.Sprintf("%s: %d bags pending, %d bags to finish up to and including its last bag",
+		estimate.Institution, estimate.InstitutionBags, estimate.BagsAhead)
+	if estimate.InsufficientData {
+		return text + fmt.Sprintf(". Insufficient data to estimate: %s.", estimate.Reason)
+	}
+	rate := estimate.Throughput.String()
+	if estimate.Workers != estimate.Throughput.Workers {
+		rate += fmt.Sprintf(", scaled to %d workers", estimate.Workers)
+	}
+	return text + fmt.Sprintf(". At %s, the last bag should finish in about %s "+
+		"(between %s and %s).", rate, FormatDuration(estimate.Likely),
+		FormatDuration(estimate.Soonest), FormatDuration(estimate.Latest))
+}
+
+// PendingIngests returns the ingest items in Fluctus that are waiting
+// or in process, for all institutions, oldest upload first.
+func PendingIngests(client *FluctusClient) ([]*ProcessStatus, error) {
+	pending := make([]*ProcessStatus, 0)
+	for _, status := range []StatusType{StatusPending, StatusStarted} {
+		records, err := client.ProcessStatusSearch(&ProcessStatus{
+			Action: ActionIngest,
+			Status: status,
+		}, false, false)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, records...)
+	}
+	sort.Sort(processStatusesByDate(pending))
+	return pending, nil
+}
+
+type processStatusesByDate []*ProcessStatus
+
+func (s processStatusesByDate) Len() int           { return len(s) }
+func (s processStatusesByDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s processStatusesByDate) Less(i, j int) bool { return s[i].BagDate.Before(s[j].BagDate) }
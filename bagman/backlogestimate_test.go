@@ -0,0 +1,103 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns count pending items for the institution, uploaded at
+// one-minute intervals starting at start.
+func pendingItems(institution string, count int, start time.Time) ([]*bagman.ProcessStatus) {
+	items := make([]*bagman.ProcessStatus, count)
+	for i := range items {
+		items[i] = &bagman.ProcessStatus{
+			Institution: institution,
+			Action:      bagman.ActionIngest,
+			Status:      bagman.StatusPending,
+			BagDate:     start.Add(time.Duration(i) * time.Minute),
+		}
+	}
+	return items
+}
+
+// Throughput with the specified busy hourly rates over a 24h span.
+func syntheticThroughput(workers int, rates ...float64) (*bagman.Throughput) {
+	throughput := &bagman.Throughput{
+		Span:          24 * time.Hour,
+		IntervalRates: make([]float64, 24),
+		Workers:       workers,
+	}
+	for i, rate := range rates {
+		throughput.IntervalRates[23 - i] = rate
+		throughput.Bags += int(rate)
+	}
+	throughput.BagsPerHour = float64(throughput.Bags) / 24
+	return throughput
+}
+
+func TestEstimateBacklog(t *testing.T) {
+	start := time.Date(2016, 4, 11, 0, 0, 0, 0, time.UTC)
+	pending := pendingItems("virginia.edu", 30, start)
+	pending = append(pending, pendingItems("unc.edu", 20, start.Add(10 * time.Minute))...)
+	// Uploaded after unc's last bag, so they don't hold it up.
+	pending = append(pending, pendingItems("ncsu.edu", 50, start.Add(time.Hour))...)
+
+	throughput := syntheticThroughput(2, 5, 10, 10, 20, 20)
+	estimate := bagman.EstimateBacklog("unc.edu", pending, throughput, 0)
+	if estimate.InsufficientData {
+		t.Fatalf("Unexpected insufficient data: %s", estimate.Reason)
+	}
+	if estimate.InstitutionBags != 20 || estimate.BagsAhead != 50 {
+		t.Errorf("Expected 20 bags pending and 50 to finish, got %d and %d",
+			estimate.InstitutionBags, estimate.BagsAhead)
+	}
+	// Busy rates 5, 10, 10, 20, 20: quartiles 10, 10, 20.
+	if estimate.Likely != 5 * time.Hour || estimate.Soonest != 150 * time.Minute ||
+		estimate.Latest != 5 * time.Hour {
+		t.Errorf("Expected 2h30m / 5h / 5h, got %s / %s / %s",
+			estimate.Soonest, estimate.Likely, estimate.Latest)
+	}
+	if estimate.Workers != 2 {
+		t.Errorf("Expected the observed 2 workers, got %d", estimate.Workers)
+	}
+	if !strings.Contains(estimate.String(), "finish in about 5h 0m (between 2h 30m and 5h 0m)") {
+		t.Errorf("Unexpected summary: %s", estimate.String())
+	}
+}
+
+func TestEstimateBacklogScalesWorkers(t *testing.T) {
+	pending := pendingItems("unc.edu", 40, time.Now().UTC())
+	throughput := syntheticThroughput(1, 10, 10, 10)
+	estimate := bagman.EstimateBacklog("unc.edu", pending, throughput, 4)
+	if estimate.Workers != 4 || estimate.Likely != time.Hour {
+		t.Errorf("With 4 workers at 10 bags/hour each, 40 bags should take 1h; got %s with %d workers",
+			estimate.Likely, estimate.Workers)
+	}
+	if !strings.Contains(estimate.String(), "scaled to 4 workers") {
+		t.Errorf("Summary should mention the scaling: %s", estimate.String())
+	}
+}
+
+func TestEstimateBacklogInsufficientData(t *testing.T) {
+	pending := pendingItems("unc.edu", 3, time.Now().UTC())
+	estimate := bagman.EstimateBacklog("unc.edu", pending, syntheticThroughput(1), 0)
+	if !estimate.InsufficientData || estimate.Likely != 0 {
+		t.Errorf("An empty window should give insufficient data")
+	}
+	if !strings.Contains(estimate.String(), "Insufficient data to estimate: no bags finished in the last 1d 0h") {
+		t.Errorf("Unexpected summary: %s", estimate.String())
+	}
+
+	short := &bagman.Throughput{Span: 20 * time.Minute, Bags: 4, Workers: 1}
+	estimate = bagman.EstimateBacklog("unc.edu", pending, short, 0)
+	if !estimate.InsufficientData || !strings.Contains(estimate.Reason, "only 20m") {
+		t.Errorf("Less than an hour of data should be insufficient, got %s", estimate.String())
+	}
+
+	estimate = bagman.EstimateBacklog("ncsu.edu", pending, syntheticThroughput(1, 10), 0)
+	if estimate.InsufficientData || estimate.String() != "ncsu.edu: no bags pending" {
+		t.Errorf("Expected no bags pending, got %s", estimate.String())
+	}
+}
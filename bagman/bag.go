@@ -2,8 +2,7 @@ package bagman
 
 import (
 	"archive/tar"
-	"crypto/md5"
-	"crypto/sha256"
+	"compress/gzip"
 	"fmt"
 	"github.com/APTrust/bagins"
 	"github.com/satori/go.uuid"
@@ -38,6 +37,15 @@ import (
 // would cause the application to crash. So buildIngestData == false on
 // the client!!
 func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (result *TarResult) {
+	return UntarTo(tarFilePath, "", instDomain, bagName, buildIngestData, DigestSettings{})
+}
+
+// UntarTo is like Untar, but unpacks the bag into a directory
+// under outputDir instead of next to the tar file, so the tar file
+// and its contents can be on different disks. If outputDir is
+// empty, this unpacks next to the tar file. If buildIngestData
+// is true, digestSettings say how to calculate checksums.
+func UntarTo(tarFilePath, outputDir, instDomain, bagName string, buildIngestData bool, digestSettings DigestSettings) (result *TarResult) {
 
 	// Set up our result
 	tarResult := new(TarResult)
@@ -48,6 +56,15 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 		return tarResult
 	}
 	tarResult.InputFile = absInputFile
+	if outputDir == "" {
+		outputDir = filepath.Dir(absInputFile)
+	}
+	absOutputDir, err := filepath.Abs(outputDir)
+	if err != nil {
+		tarResult.ErrorMessage = fmt.Sprintf("Before untarring, could not determine "+
+			"absolute path to output directory: %v", err)
+		return tarResult
+	}
 
 	_, err = GetInstitutionFromBagName(filepath.Base(absInputFile))
 	if err != nil {
@@ -65,12 +82,62 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 			tarFilePath, err)
 		return tarResult
 	}
+	untarStream(file, tarFilePath, absOutputDir, bagName, buildIngestData, digestSettings, tarResult)
+	return tarResult
+}
+
+// UntarStream is like UntarTo, but reads the tar file from reader,
+// so a bag can be unpacked as it comes in from S3, without saving
+// the tar file to disk first. Param tarFileName is the name of the
+// tar file, which determines whether it's gzipped and what directory
+// it should untar to. Unlike UntarTo, outputDir is required.
+func UntarStream(reader io.Reader, tarFileName, outputDir, instDomain, bagName string, buildIngestData bool, digestSettings DigestSettings) (result *TarResult) {
+	tarResult := new(TarResult)
+	tarResult.InputFile = tarFileName
+	if outputDir == "" {
+		tarResult.ErrorMessage = "UntarStream requires an output directory"
+		return tarResult
+	}
+	absOutputDir, err := filepath.Abs(outputDir)
+	if err != nil {
+		tarResult.ErrorMessage = fmt.Sprintf("Before untarring, could not determine "+
+			"absolute path to output directory: %v", err)
+		return tarResult
+	}
+	_, err = GetInstitutionFromBagName(path.Base(tarFileName))
+	if err != nil {
+		tarResult.ErrorMessage = err.Error()
+		return tarResult
+	}
+	untarStream(reader, tarFileName, absOutputDir, bagName, buildIngestData, digestSettings, tarResult)
+	return tarResult
+}
+
+// untarStream does the work of UntarTo and UntarStream, reading
+// the tar file named tarFilePath from reader and recording what it
+// unpacks in tarResult.
+func untarStream(reader io.Reader, tarFilePath, absOutputDir, bagName string, buildIngestData bool, digestSettings DigestSettings, tarResult *TarResult) {
+	// Gzipped bags are decompressed as we read them. Checksums
+	// are still calculated on the uncompressed payload files.
+	var tarStream io.Reader = reader
+	if IsGzippedTar(tarFilePath) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			tarResult.ErrorMessage = fmt.Sprintf("Could not decompress file %s: %v. "+
+				"Files ending in .tar.gz or .tgz must be gzipped tar files.",
+				path.Base(tarFilePath), err)
+			return
+		}
+		defer gzipReader.Close()
+		tarStream = gzipReader
+	}
 
 	// Record the name of the top-level directory in the tar
 	// file. Our spec says that the name of the directory into
 	// which the file untars should be the same as the tar file
-	// name, minus the .tar extension. So uva-123.tar should
-	// untar into a directory called uva-123. This is required
+	// name, minus the .tar extension. So uva-123.tar (or
+	// uva-123.tar.gz) should untar into a directory called
+	// uva-123. This is required
 	// so that IntellectualObject and GenericFile identifiers
 	// in Fedora can be traced back to the named bag from which
 	// they came. Other parts of bagman, such as the file cleanup
@@ -80,8 +147,28 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 	// untarred files, and we'll end up losing a lot of disk space.
 	topLevelDir := ""
 
+	// Everything should be inside one top-level directory. We
+	// record all of the top-level entries, but unpack only the
+	// first, so a malformed bag doesn't scatter files across the
+	// output directory where cleanup won't find them.
+	topLevelEntries := make(map[string]bool)
+	firstEntry := ""
+	recordTopLevelEntries := func() {
+		tarResult.TopLevelEntries = make([]string, 0, len(topLevelEntries))
+		for entry := range topLevelEntries {
+			tarResult.TopLevelEntries = append(tarResult.TopLevelEntries, entry)
+		}
+		sort.Strings(tarResult.TopLevelEntries)
+	}
+	defer recordTopLevelEntries()
+
+	// With more than one digest worker, we hash the data files
+	// after they're all written, instead of one at a time as we
+	// unpack them.
+	hashInPool := buildIngestData && digestSettings.Workers > 1
+
 	// Untar the file and record the results.
-	tarReader := tar.NewReader(file)
+	tarReader := tar.NewReader(tarStream)
 
 	for {
 		header, err := tarReader.Next()
@@ -92,7 +179,17 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 			tarResult.ErrorMessage = fmt.Sprintf(
 				"Error reading tar file header: %v. " +
 					"Either this is not a tar file, or the file is corrupt.", err)
-			return tarResult
+			return
+		}
+
+		entry := tarTopLevelEntry(header.Name, header.Typeflag == tar.TypeDir)
+		if entry != "" {
+			topLevelEntries[entry] = true
+			if firstEntry == "" {
+				firstEntry = entry
+			} else if entry != firstEntry {
+				continue
+			}
 		}
 
 		// Top-level dir will be the first header entry.
@@ -103,27 +200,24 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 			if runtime.GOOS == "windows" && strings.Contains(tarFilePath, "\\") {
 				systemNormalizedPath = strings.Replace(tarFilePath, "\\", "/", -1)
 			}
-			expectedDir := path.Base(systemNormalizedPath)
-			if strings.HasSuffix(expectedDir, ".tar") {
-				expectedDir = expectedDir[0 : len(expectedDir)-4]
-			}
+			expectedDir := TrimTarExtension(path.Base(systemNormalizedPath))
 			if topLevelDir != expectedDir {
 				tarResult.ErrorMessage = fmt.Sprintf(
 					"Bag '%s' should untar to a folder named '%s', but "+
 						"it untars to '%s'. Please repackage this bag and try again.",
 					path.Base(tarFilePath), expectedDir, topLevelDir)
-				return tarResult
+				return
 			}
 		}
 
-		outputPath := filepath.Join(filepath.Dir(absInputFile), header.Name)
+		outputPath := filepath.Join(absOutputDir, header.Name)
 		// PT #114804083 - Make sure there's a slash in the path before setting
 		// tarfile.OutputDir, or we'll set it incorrectly and when we call
 		// bagman.ReadBag(tarResult.OutputDir), it will fail with "file not found".
 		pathParts := strings.Split(header.Name, "/")
 		tarDirectory := pathParts[0]
-		if (tarResult.OutputDir == "" || tarResult.OutputDir == filepath.Dir(absInputFile)) && len(pathParts) > 1 {
-			tarResult.OutputDir = filepath.Join(filepath.Dir(absInputFile), tarDirectory)
+		if (tarResult.OutputDir == "" || tarResult.OutputDir == absOutputDir) && len(pathParts) > 1 {
+			tarResult.OutputDir = filepath.Join(absOutputDir, tarDirectory)
 		}
 
 		// Make sure the directory that we're about to write into exists.
@@ -131,7 +225,7 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 		if err != nil {
 			tarResult.ErrorMessage = fmt.Sprintf("Could not create destination file '%s' "+
 				"while unpacking tar archive: %v", outputPath, err)
-			return tarResult
+			return
 		}
 
 		// Copy the file, if it's an actual file. Otherwise, ignore it and record
@@ -140,28 +234,29 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 			pathParts := strings.SplitN(header.Name, "/", 2)
 			if len(pathParts) < 2 {
 				tarResult.ErrorMessage = fmt.Sprintf("File %s in tar archive should be in format dir/filename", header.Name)
-				return tarResult
+				return
 			}
 			fileName := pathParts[1]
 			if HasSavableName(fileName) {
 				var dataFile *File = nil
-				dataFile = buildFile(tarReader, filepath.Dir(absInputFile), header.Name,
-					header.Size, header.ModTime, buildIngestData)
+				dataFile = buildFile(tarReader, absOutputDir, header.Name,
+					header.Size, header.ModTime, buildIngestData, !hashInPool,
+					digestSettings.BufferSize)
 				if dataFile.ErrorMessage != "" {
 					tarResult.ErrorMessage = fmt.Sprintf("Error reading file from tar archive: %v",
 						dataFile.ErrorMessage)
-					return tarResult
+					return
 				}
 				cleanBagName, _ := CleanBagName(bagName)
 				dataFile.Identifier = fmt.Sprintf("%s/%s", cleanBagName, dataFile.Path)
-				dataFile.IdentifierAssigned = time.Now()
+				dataFile.IdentifierAssigned = NowUTC()
 				tarResult.Files = append(tarResult.Files, dataFile)
 			} else {
 				err = saveFile(outputPath, tarReader)
 				if err != nil {
 					tarResult.ErrorMessage = fmt.Sprintf("Error copying file from tar archive "+
 						"to '%s': %v", outputPath, err)
-					return tarResult
+					return
 				}
 			}
 
@@ -175,7 +270,38 @@ func Untar(tarFilePath, instDomain, bagName string, buildIngestData bool) (resul
 		}
 	}
 	sort.Strings(tarResult.FilesUnpacked)
-	return tarResult
+	if hashInPool {
+		err := calculateFileDigests(tarResult.OutputDir, tarResult.Files, digestSettings)
+		if err != nil {
+			tarResult.ErrorMessage = err.Error()
+			return
+		}
+	}
+	recordTopLevelEntries()
+	if len(tarResult.TopLevelEntries) == 0 {
+		tarResult.ErrorMessage = fmt.Sprintf("Bag '%s' is empty. "+
+			"It should untar to a single top-level directory.", path.Base(tarFilePath))
+	} else if !tarResult.HasSingleTopLevelDir() {
+		tarResult.ErrorMessage = fmt.Sprintf(
+			"Bag '%s' should untar to a single top-level directory, but "+
+				"its top level contains: %s. Please repackage this bag and try again.",
+			path.Base(tarFilePath), strings.Join(tarResult.TopLevelEntries, ", "))
+	}
+}
+
+// Returns the name of the entry at the root of a tar file that
+// contains the item named name, with a trailing slash if it's
+// a directory. Returns an empty string for the root itself.
+func tarTopLevelEntry(name string, isDir bool) (string) {
+	name = strings.TrimPrefix(name, "./")
+	if name == "" || name == "." {
+		return ""
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 || isDir {
+		return parts[0] + "/"
+	}
+	return parts[0]
 }
 
 // Reads an untarred bag. The tarFilePath parameter should be a path to
@@ -240,7 +366,22 @@ func ReadBag(tarFilePath string) (result *BagReadResult) {
 		errMsg += " Bag's data directory is missing or empty.\n"
 	}
 
-	extractTags(bag, bagReadResult)
+	extractTags(bagReadResult)
+	bagReadResult.ManifestFiles = manifestChecksums(bag, "md5")
+	bagReadResult.ManifestSha256Files = manifestChecksums(bag, "sha256")
+
+	// Payload-Oxum lets us catch missing or truncated payload files
+	// with a quick stat of the data directory. Do this before running
+	// checksums, which can take hours on very large bags.
+	oxumWarning, err := CheckPayloadOxum(tarFilePath, bagReadResult.TagValue("Payload-Oxum"))
+	if oxumWarning != "" {
+		bagReadResult.Warnings = append(bagReadResult.Warnings, oxumWarning)
+	}
+	if err != nil {
+		errMsg += fmt.Sprintf(" %s.\n", err.Error())
+		bagReadResult.ErrorMessage += errMsg
+		return bagReadResult
+	}
 
 	for _, manifest := range bag.Manifests {
 		checksumErrors := manifest.RunChecksums()
@@ -261,30 +402,52 @@ func ReadBag(tarFilePath string) (result *BagReadResult) {
 	return bagReadResult
 }
 
+// Returns a map of path to checksum from the bag's payload manifest
+// for the specified algorithm, e.g. manifest-md5.txt for "md5". Paths
+// are exactly as they appear in the manifest. The map is empty if
+// the bag has no manifest for that algorithm.
+func manifestChecksums(bag *bagins.Bag, algorithm string) (map[string]string) {
+	checksums := make(map[string]string)
+	manifestName := fmt.Sprintf("manifest-%s.txt", algorithm)
+	for _, manifest := range bag.Manifests {
+		if filepath.Base(manifest.Name()) != manifestName {
+			continue
+		}
+		for filePath, checksum := range manifest.Data {
+			checksums[filePath] = checksum
+		}
+	}
+	return checksums
+}
+
 // Extract all of the tags from tag files "bagit.txt", "bag-info.txt",
 // and "aptrust-info.txt", and put those tags into the Tags member
 // of the BagReadResult structure.
-func extractTags(bag *bagins.Bag, bagReadResult *BagReadResult) {
+func extractTags(bagReadResult *BagReadResult) {
 	tagFiles := []string{"bagit.txt", "bag-info.txt", "aptrust-info.txt"}
 	accessRights := ""
 	bagTitle := ""
 	for _, file := range tagFiles {
-		tagFile, err := bag.TagFile(file)
-		if err != nil {
+		// We parse the tag files ourselves, because bagins doesn't
+		// handle folded values, byte order marks or CRLF line endings.
+		// ReadBag reports missing tag files, so skip those here.
+		tags, warnings, err := ReadTagFile(filepath.Join(bagReadResult.Path, file))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
 			bagReadResult.ErrorMessage = fmt.Sprintf("Error reading tags from bag: %v", err)
 			return
 		}
-		tagFields := tagFile.Data.Fields()
+		bagReadResult.Warnings = append(bagReadResult.Warnings, warnings...)
 
-		for _, tagField := range tagFields {
-			tag := Tag{tagField.Label(), strings.TrimSpace(tagField.Value())}
+		for _, tag := range tags {
 			bagReadResult.Tags = append(bagReadResult.Tags, tag)
 
 			lcLabel := strings.ToLower(tag.Label)
 			if lcLabel == "access" {
-				accessRights = strings.TrimSpace(strings.ToLower(tag.Value))
+				accessRights = tag.Value
 			} else if accessRights == "" && lcLabel == "rights" {
-				accessRights = strings.TrimSpace(strings.ToLower(tag.Value))
+				accessRights = tag.Value
 			} else if lcLabel == "title" {
 				bagTitle = strings.TrimSpace(tag.Value)
 			}
@@ -293,15 +456,12 @@ func extractTags(bag *bagins.Bag, bagReadResult *BagReadResult) {
 
 	// Make sure access rights are valid, or Fluctus will reject
 	// this data when we try to register it.
-	accessValid := false
-	for _, value := range AccessRights {
-		if accessRights == value {
-			accessValid = true
-		}
-	}
-	if false == accessValid {
+	_, accessWarnings, err := NormalizeAccess(accessRights)
+	bagReadResult.Warnings = append(bagReadResult.Warnings, accessWarnings...)
+	if err != nil {
 		bagReadResult.ErrorMessage += fmt.Sprintf(
-			"In tag file, access (rights) value '%s' is not valid.\n", accessRights)
+			"In tag file, access (rights) value '%s' is not valid.\n",
+			strings.TrimSpace(strings.ToLower(accessRights)))
 	}
 
 	// Fluctus will reject IntellectualObjects that don't have a title.
@@ -328,10 +488,36 @@ func saveFile(destination string, tarReader *tar.Reader) error {
 	return nil
 }
 
+// calculateFileDigests sets the md5 and sha256 digests of files
+// that untarStream has already written to bagDir, hashing up to
+// digestSettings.Workers files at once. The digests go into
+// ChecksumCache, as they do in buildFile.
+func calculateFileDigests(bagDir string, files []*File, digestSettings DigestSettings) (error) {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = filepath.Join(bagDir, file.Path)
+	}
+	digests, errors := NewDigestPool(digestSettings.Workers,
+		digestSettings.BufferSize).CalculateDigests(paths)
+	if len(errors) > 0 {
+		return fmt.Errorf("Error calculating checksums of unpacked files: %v", errors[0])
+	}
+	generated := NowUTC()
+	for i, file := range files {
+		file.Md5 = digests[i].Md5Digest
+		file.Sha256 = digests[i].Sha256Digest
+		file.Sha256Generated = generated
+	}
+	return nil
+}
+
 // buildFile saves a data file from the tar archive to disk,
 // then returns a struct with data we'll need to construct the
-// GenericFile object in Fedora later.
-func buildFile(tarReader *tar.Reader, tarDirectory string, fileName string, size int64, modTime time.Time, buildIngestData bool) (file *File) {
+// GenericFile object in Fedora later. If calculateDigests is
+// false, the caller has to fill in the file's md5 and sha256
+// digests. See calculateFileDigests. Param bufferSize is the
+// size of the buffer to hash with.
+func buildFile(tarReader *tar.Reader, tarDirectory string, fileName string, size int64, modTime time.Time, buildIngestData, calculateDigests bool, bufferSize int) (file *File) {
 	file = NewFile()
 	pathParts := strings.SplitN(fileName, "/", 2)
 	if len(pathParts) < 2 {
@@ -346,13 +532,12 @@ func buildFile(tarReader *tar.Reader, tarDirectory string, fileName string, size
 	}
 	uuid := uuid.NewV4()
 	file.Uuid = uuid.String()
-	file.UuidGenerated = time.Now().UTC()
+	file.UuidGenerated = NowUTC()
 	file.Size = size
-	file.Modified = modTime
+	file.Modified = modTime.UTC()
 
-	// Set up a MultiWriter to stream data ONCE to file,
-	// md5 and sha256. We don't want to process the stream
-	// three separate times.
+	// Stream data ONCE to file, md5 and sha256. We don't want
+	// to process the stream three separate times.
 	outputWriter, err := os.OpenFile(absPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if outputWriter != nil {
 		defer outputWriter.Close()
@@ -370,15 +555,25 @@ func buildFile(tarReader *tar.Reader, tarDirectory string, fileName string, size
 	// the additional sums & take a guess at mime type.
 	if buildIngestData == false {
 		io.Copy(outputWriter, tarReader)
+	} else if calculateDigests == false {
+		io.Copy(outputWriter, tarReader)
+		file.MimeType, err = GuessMimeType(absPath)
 	} else {
-		md5Hash := md5.New()
-		shaHash := sha256.New()
-		multiWriter := io.MultiWriter(md5Hash, shaHash, outputWriter)
-		io.Copy(multiWriter, tarReader)
-
-		file.Md5 = fmt.Sprintf("%x", md5Hash.Sum(nil))
-		file.Sha256 = fmt.Sprintf("%x", shaHash.Sum(nil))
-		file.Sha256Generated = time.Now().UTC()
+		digester, _ := NewMultiDigestWriter(bufferSize, DigestMd5, DigestSha256)
+		digester.Copy(outputWriter, tarReader)
+
+		file.Md5 = digester.Sum(DigestMd5)
+		file.Sha256 = digester.Sum(DigestSha256)
+		file.Sha256Generated = NowUTC()
+
+		// Later stages in this process can use these
+		// digests instead of reading the file again.
+		ChecksumCache.Store(absPath, &FileDigest{
+			PathToFile:   absPath,
+			Md5Digest:    file.Md5,
+			Sha256Digest: file.Sha256,
+			Size:         size,
+		})
 
 		file.MimeType, err = GuessMimeType(absPath)
 	}
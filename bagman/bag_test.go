@@ -1,12 +1,15 @@
 package bagman_test
 
 import (
+	"archive/tar"
 	"errors"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/s3"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +19,7 @@ var gopath string = os.Getenv("GOPATH")
 var testDataPath = filepath.Join(gopath, "src/github.com/APTrust/bagman/testdata")
 var sampleBadChecksums string = filepath.Join(testDataPath, "example.edu.sample_bad_checksums.tar")
 var sampleGood string = filepath.Join(testDataPath, "example.edu.sample_good.tar")
+var sampleGoodGzipped string = filepath.Join(testDataPath, "example.edu.sample_good.tar.gz")
 var sampleMultipart1 string = filepath.Join(testDataPath, "example.edu.multipart.b01.of02.tar")
 var sampleMultipart2 string = filepath.Join(testDataPath, "example.edu.multipart.b02.of02.tar")
 var sampleGoodUntarred string = filepath.Join(testDataPath, "example.edu.sample_good")
@@ -24,6 +28,7 @@ var sampleNoBagInfo string = filepath.Join(testDataPath, "example.edu.sample_no_
 var sampleNoBagit string = filepath.Join(testDataPath, "example.edu.sample_no_bagit.tar")
 var sampleWrongFolderName string = filepath.Join(testDataPath, "example.edu.sample_wrong_folder_name.tar")
 var sampleNoTitle string = filepath.Join(testDataPath, "example.edu.sample_no_title.tar")
+var sampleTitleInBagInfo string = filepath.Join(testDataPath, "example.edu.sample_title_in_bag_info.tar")
 var sampleBadAccess string = filepath.Join(testDataPath, "example.edu.sample_bad_access.tar")
 var sampleNoMd5Manifest string = filepath.Join(testDataPath, "example.edu.sample_no_md5_manifest.tar")
 var sampleNoAPTrustInfo string = filepath.Join(testDataPath, "example.edu.sample_no_aptrust_info.tar")
@@ -356,6 +361,38 @@ func TestErrorOnMissingTitle(t *testing.T) {
 	}
 }
 
+func TestTitleOnlyInBagInfo(t *testing.T) {
+	setup()
+	defer teardown()
+	tarResult := bagman.Untar(sampleTitleInBagInfo, "example.edu", "sample_title_in_bag_info.tar", true)
+	readResult := bagman.ReadBag(tarResult.OutputDir)
+	if readResult.ErrorMessage != "" {
+		t.Errorf("ReadBag() should have found no errors in %s, "+
+			"but it found the following:\n%s", sampleTitleInBagInfo, readResult.ErrorMessage)
+	}
+	if readResult.TagValueFromFile("Title", "aptrust-info.txt") != "" {
+		t.Errorf("Title should not come from aptrust-info.txt")
+	}
+	if readResult.TagValueFromFile("Title", "bag-info.txt") != "Strabo De situ orbis." {
+		t.Errorf("Title was not found in bag-info.txt")
+	}
+	result := &bagman.ProcessResult{
+		S3File: &bagman.S3File{
+			BucketName: "aptrust.receiving.example.edu",
+			Key:        s3.Key{Key: "example.edu.sample_title_in_bag_info.tar"},
+		},
+		TarResult:     tarResult,
+		BagReadResult: readResult,
+	}
+	obj, err := result.IntellectualObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Title != "Strabo De situ orbis." {
+		t.Errorf("IntellectualObject.Title is '%s', expected 'Strabo De situ orbis.'", obj.Title)
+	}
+}
+
 
 func TestGoodCustomTags(t *testing.T) {
 	setup()
@@ -392,3 +429,378 @@ func TestBadCustomTags(t *testing.T) {
 		t.Errorf("Validator did not report missing file custom_tags/tag_file_xyz.pdf")
 	}
 }
+
+// Reads a payload manifest and returns its path-to-checksum pairs.
+func readManifest(t *testing.T, manifestPath string) (map[string]string) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 2 {
+			entries[parts[1]] = parts[0]
+		}
+	}
+	return entries
+}
+
+func TestReadBagManifestChecksums(t *testing.T) {
+	setup()
+	defer teardown()
+	tarResult := bagman.Untar(tagSampleGood, "example.edu", "example.edu.tagsample_good.tar", true)
+	result := bagman.ReadBag(tarResult.OutputDir)
+	manifests := map[string]map[string]string{
+		"manifest-md5.txt":    result.ManifestFiles,
+		"manifest-sha256.txt": result.ManifestSha256Files,
+	}
+	for manifestName, actual := range manifests {
+		expected := readManifest(t, filepath.Join(tarResult.OutputDir, manifestName))
+		if len(expected) == 0 {
+			t.Fatalf("Fixture %s has no entries", manifestName)
+		}
+		if len(actual) != len(expected) {
+			t.Errorf("Expected %d entries from %s, got %d", len(expected), manifestName, len(actual))
+		}
+		for filePath, checksum := range expected {
+			if actual[filePath] != checksum {
+				t.Errorf("%s: expected %s to have checksum %s, got '%s'",
+					manifestName, filePath, checksum, actual[filePath])
+			}
+		}
+	}
+
+	// sample_good has no sha256 manifest.
+	tarResult = bagman.Untar(sampleGood, "example.edu", "example.edu.sample_good.tar", true)
+	result = bagman.ReadBag(tarResult.OutputDir)
+	if len(result.ManifestFiles) != 4 || len(result.ManifestSha256Files) != 0 {
+		t.Errorf("Expected 4 md5 and 0 sha256 manifest entries, got %d and %d",
+			len(result.ManifestFiles), len(result.ManifestSha256Files))
+	}
+}
+
+// Builds a tar file of a bag with Mac and Windows junk in the
+// payload, in a temp directory. Caller should remove the directory.
+func makeJunkBag(t *testing.T) (string) {
+	tempDir, err := ioutil.TempDir("", "junk_bag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarFilePath := filepath.Join(tempDir, "test.edu.junk_bag.tar")
+	tarFile, err := os.Create(tarFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	tarWriter := tar.NewWriter(tarFile)
+	entries := [][2]string{
+		{"bagit.txt", "BagIt-Version: 0.97\n"},
+		{"data/image.jpg", "not really a jpeg"},
+		{"data/.DS_Store", "Bud1"},
+		{"data/docs/Thumbs.db", "thumbnails"},
+		{"data/__MACOSX/image.jpg", "resource fork"},
+		{"data/__MACOSX/._image.jpg", "AppleDouble"},
+		{"data/docs/report.txt", "The real thing"},
+	}
+	tarWriter.WriteHeader(&tar.Header{Name: "test.edu.junk_bag/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     "test.edu.junk_bag/" + entry[0],
+			Mode:     0644,
+			Size:     int64(len(entry[1])),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if err = tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write([]byte(entry[1]))
+	}
+	if err = tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarFilePath
+}
+
+func TestUntarJunkFiles(t *testing.T) {
+	tarFilePath := makeJunkBag(t)
+	defer os.RemoveAll(filepath.Dir(tarFilePath))
+	tarResult := bagman.Untar(tarFilePath, "test.edu", "test.edu.junk_bag.tar", false)
+	if tarResult.ErrorMessage != "" {
+		t.Fatal(tarResult.ErrorMessage)
+	}
+	junkFiles := tarResult.JunkFiles(bagman.DefaultJunkFilePatterns)
+	expected := []string{"data/.DS_Store", "data/__MACOSX/image.jpg", "data/docs/Thumbs.db"}
+	sortedJunk := append([]string{}, junkFiles...)
+	sort.Strings(sortedJunk)
+	if strings.Join(sortedJunk, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected junk files %v, got %v", expected, sortedJunk)
+	}
+	tarResult.RemoveFiles(junkFiles)
+	paths := tarResult.FilePaths()
+	sort.Strings(paths)
+	if strings.Join(paths, ",") != "data/docs/report.txt,data/image.jpg" {
+		t.Errorf("After removing junk, expected only the real payload files, got %v", paths)
+	}
+	// Skipped files are still on disk, so the bag still validates.
+	if !bagman.FileExists(filepath.Join(tarResult.OutputDir, "data", ".DS_Store")) {
+		t.Errorf("RemoveFiles should not delete files from disk")
+	}
+}
+
+func TestUntarTo(t *testing.T) {
+	tarFilePath := makeJunkBag(t)
+	defer os.RemoveAll(filepath.Dir(tarFilePath))
+	extractDir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(extractDir)
+	tarResult := bagman.UntarTo(tarFilePath, extractDir, "test.edu", "test.edu.junk_bag.tar", false,
+		bagman.DigestSettings{})
+	if tarResult.ErrorMessage != "" {
+		t.Fatal(tarResult.ErrorMessage)
+	}
+	absExtractDir, _ := filepath.Abs(extractDir)
+	if tarResult.OutputDir != filepath.Join(absExtractDir, "test.edu.junk_bag") {
+		t.Errorf("Bag should untar under %s, but OutputDir is %s", extractDir, tarResult.OutputDir)
+	}
+	for _, path := range []string{"bagit.txt", "data/docs/report.txt"} {
+		if !bagman.FileExists(filepath.Join(tarResult.OutputDir, path)) {
+			t.Errorf("%s was not unpacked into the extract directory", path)
+		}
+	}
+	if bagman.FileExists(filepath.Join(filepath.Dir(tarFilePath), "test.edu.junk_bag")) {
+		t.Errorf("Nothing should be unpacked next to the tar file")
+	}
+}
+
+// Writes a tar file named test.edu.multi_root.tar in a new temp
+// dir, containing the named entries. Names ending in a slash are
+// directories.
+func makeTarFile(t *testing.T, names []string) (string) {
+	tempDir, err := ioutil.TempDir("", "multi_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarFilePath := filepath.Join(tempDir, "test.edu.multi_root.tar")
+	tarFile, err := os.Create(tarFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	tarWriter := tar.NewWriter(tarFile)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0644, ModTime: time.Now(), Typeflag: tar.TypeReg}
+		content := []byte("content of " + name)
+		if strings.HasSuffix(name, "/") {
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+			content = nil
+		}
+		header.Size = int64(len(content))
+		if err = tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write(content)
+	}
+	if err = tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarFilePath
+}
+
+func TestUntarSingleTopLevelDir(t *testing.T) {
+	tarFilePath := makeTarFile(t, []string{
+		"test.edu.multi_root/",
+		"test.edu.multi_root/bagit.txt",
+		"test.edu.multi_root/data/file.txt",
+	})
+	defer os.RemoveAll(filepath.Dir(tarFilePath))
+	tarResult := bagman.Untar(tarFilePath, "test.edu", "test.edu.multi_root.tar", false)
+	if tarResult.ErrorMessage != "" {
+		t.Fatal(tarResult.ErrorMessage)
+	}
+	if !tarResult.HasSingleTopLevelDir() {
+		t.Errorf("Expected a single top-level dir, got %v", tarResult.TopLevelEntries)
+	}
+	if len(tarResult.TopLevelEntries) != 1 || tarResult.TopLevelEntries[0] != "test.edu.multi_root/" {
+		t.Errorf("Wrong top-level entries: %v", tarResult.TopLevelEntries)
+	}
+}
+
+func TestUntarMultipleTopLevelEntries(t *testing.T) {
+	tarFilePath := makeTarFile(t, []string{
+		"test.edu.multi_root/",
+		"test.edu.multi_root/bagit.txt",
+		"test.edu.multi_root/data/file.txt",
+		"other_dir/data/stray.txt",
+		"README.txt",
+	})
+	tempDir := filepath.Dir(tarFilePath)
+	defer os.RemoveAll(tempDir)
+	tarResult := bagman.Untar(tarFilePath, "test.edu", "test.edu.multi_root.tar", false)
+	if !strings.Contains(tarResult.ErrorMessage, "single top-level directory") {
+		t.Errorf("Expected a top-level directory error, got '%s'", tarResult.ErrorMessage)
+	}
+	if tarResult.HasSingleTopLevelDir() {
+		t.Errorf("HasSingleTopLevelDir should be false for %v", tarResult.TopLevelEntries)
+	}
+	expected := []string{"README.txt", "other_dir/", "test.edu.multi_root/"}
+	if strings.Join(tarResult.TopLevelEntries, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected top-level entries %v, got %v", expected, tarResult.TopLevelEntries)
+	}
+	// Nothing outside the bag directory is unpacked.
+	for _, name := range []string{"other_dir", "README.txt"} {
+		if bagman.FileExists(filepath.Join(tempDir, name)) {
+			t.Errorf("%s should not have been unpacked", name)
+		}
+	}
+}
+
+// A gzipped bag should ingest as the same object, with the same
+// files and checksums, as the plain tar file it was made from.
+func TestUntarGzippedBag(t *testing.T) {
+	untarred := make(map[string]*bagman.TarResult)
+	for _, tarFile := range []string{sampleGood, sampleGoodGzipped} {
+		extractDir, err := ioutil.TempDir("", "gzipped_bag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(extractDir)
+		tarResult := bagman.UntarTo(tarFile, extractDir, "example.edu",
+			filepath.Base(tarFile), false, bagman.DigestSettings{})
+		if tarResult.ErrorMessage != "" {
+			t.Fatalf("Error untarring %s: %s", tarFile, tarResult.ErrorMessage)
+		}
+		if filepath.Base(tarResult.OutputDir) != "example.edu.sample_good" {
+			t.Errorf("%s untarred into %s", tarFile, tarResult.OutputDir)
+		}
+		untarred[filepath.Base(tarFile)] = tarResult
+	}
+	plain := untarred["example.edu.sample_good.tar"]
+	gzipped := untarred["example.edu.sample_good.tar.gz"]
+	if len(plain.Files) == 0 || len(plain.Files) != len(gzipped.Files) {
+		t.Fatalf("Plain tar has %d files, gzipped tar has %d",
+			len(plain.Files), len(gzipped.Files))
+	}
+	for i, file := range plain.Files {
+		gzFile := gzipped.Files[i]
+		if gzFile.Path != file.Path || gzFile.Identifier != file.Identifier ||
+			gzFile.Size != file.Size || gzFile.Md5 != file.Md5 {
+			t.Errorf("Gzipped file %s (%s, %d bytes, md5 %s) does not match "+
+				"plain file %s (%s, %d bytes, md5 %s)",
+				gzFile.Path, gzFile.Identifier, gzFile.Size, gzFile.Md5,
+				file.Path, file.Identifier, file.Size, file.Md5)
+		}
+	}
+
+	for _, key := range []string{"example.edu.sample_good.tar.gz", "example.edu.sample_good.tgz"} {
+		s3File := &bagman.S3File{
+			BucketName: "aptrust.receiving.example.edu",
+			Key:        s3.Key{Key: key},
+		}
+		objName, err := s3File.ObjectName()
+		if err != nil || objName != "example.edu/example.edu.sample_good" {
+			t.Errorf("ObjectName() for %s returned %s, %v", key, objName, err)
+		}
+	}
+}
+
+func TestUntarCorruptGzippedBag(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "corrupt_gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	// A plain tar file with a .tgz extension is not gzipped.
+	tarFilePath := filepath.Join(tempDir, "example.edu.sample_good.tgz")
+	data, err := ioutil.ReadFile(sampleGood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(tarFilePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tarResult := bagman.Untar(tarFilePath, "example.edu", "example.edu.sample_good.tgz", false)
+	if !strings.Contains(tarResult.ErrorMessage, "Could not decompress") {
+		t.Errorf("Expected a decompression error, got '%s'", tarResult.ErrorMessage)
+	}
+}
+
+// Untarring a bag as it streams in should give the same result as
+// untarring it from disk.
+func TestUntarStreamMatchesUntarTo(t *testing.T) {
+	for _, tarFile := range []string{sampleGood, sampleGoodGzipped} {
+		diskDir, err := ioutil.TempDir("", "untar_disk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(diskDir)
+		streamDir, err := ioutil.TempDir("", "untar_stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(streamDir)
+
+		fromDisk := bagman.UntarTo(tarFile, diskDir, "example.edu", filepath.Base(tarFile), true,
+			bagman.DigestSettings{})
+		reader, err := os.Open(tarFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed := bagman.UntarStream(reader, filepath.Base(tarFile), streamDir,
+			"example.edu", filepath.Base(tarFile), true, bagman.DigestSettings{})
+		reader.Close()
+
+		if fromDisk.ErrorMessage != "" || streamed.ErrorMessage != "" {
+			t.Fatalf("Error untarring %s: disk '%s', stream '%s'",
+				tarFile, fromDisk.ErrorMessage, streamed.ErrorMessage)
+		}
+		if streamed.OutputDir != filepath.Join(streamDir, "example.edu.sample_good") {
+			t.Errorf("%s streamed into %s", tarFile, streamed.OutputDir)
+		}
+		if strings.Join(streamed.FilesUnpacked, ",") != strings.Join(fromDisk.FilesUnpacked, ",") {
+			t.Errorf("Streamed %s unpacked %v, but from disk it unpacked %v",
+				tarFile, streamed.FilesUnpacked, fromDisk.FilesUnpacked)
+		}
+		if len(fromDisk.Files) == 0 || len(streamed.Files) != len(fromDisk.Files) {
+			t.Fatalf("Streamed %s has %d files, from disk it has %d",
+				tarFile, len(streamed.Files), len(fromDisk.Files))
+		}
+		for i, file := range fromDisk.Files {
+			streamedFile := streamed.Files[i]
+			if streamedFile.Path != file.Path || streamedFile.Identifier != file.Identifier ||
+				streamedFile.Size != file.Size || streamedFile.Md5 != file.Md5 ||
+				streamedFile.Sha256 != file.Sha256 || streamedFile.MimeType != file.MimeType {
+				t.Errorf("Streamed file %s (%d bytes, md5 %s, sha256 %s) does not match "+
+					"file %s from disk (%d bytes, md5 %s, sha256 %s)",
+					streamedFile.Path, streamedFile.Size, streamedFile.Md5, streamedFile.Sha256,
+					file.Path, file.Size, file.Md5, file.Sha256)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(streamed.OutputDir, streamedFile.Path))
+			if err != nil || int64(len(data)) != file.Size {
+				t.Errorf("Streamed file %s was not written to disk: %v", streamedFile.Path, err)
+			}
+		}
+	}
+
+	// Streams get the same bag name checks as files.
+	reader, err := os.Open(sampleGood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	result := bagman.UntarStream(reader, "example.edu.misnamed.tar", os.TempDir(),
+		"example.edu", "example.edu.misnamed.tar", false, bagman.DigestSettings{})
+	if !strings.Contains(result.ErrorMessage, "should untar to a folder named") {
+		t.Errorf("UntarStream should reject a bag that untars to the wrong folder, got '%s'",
+			result.ErrorMessage)
+	}
+	if result = bagman.UntarStream(reader, "example.edu.sample_good.tar", "",
+		"example.edu", "example.edu.sample_good.tar", false,
+		bagman.DigestSettings{}); result.ErrorMessage == "" {
+		t.Errorf("UntarStream should require an output directory")
+	}
+}
@@ -0,0 +1,327 @@
+package bagman
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// LifecycleKind says what sort of thing happened to a bag.
+type LifecycleKind string
+
+const (
+	LifecycleIngest      LifecycleKind = "ingest"
+	LifecycleFixity                    = "fixity"
+	LifecycleRestore                   = "restore"
+	LifecycleDelete                    = "delete"
+	LifecycleReplication               = "replication"
+	LifecycleDPN                       = "dpn"
+	LifecycleOther                     = "other"
+)
+
+// Sources of lifecycle entries.
+const (
+	LifecycleSourcePremis        = "premis"
+	LifecycleSourceProcessedItem = "processed_item"
+	LifecycleSourceFluctus       = "fluctus"
+)
+
+// LifecycleEntry is one thing that happened to a bag or one of its
+// files, such as a PREMIS event, a ProcessedItem record, or a DPN
+// replication.
+type LifecycleEntry struct {
+	Time       time.Time     `json:"time"`
+	Kind       LifecycleKind `json:"kind"`
+	// Source is where this entry came from: "premis",
+	// "processed_item", "dpn", etc.
+	Source     string        `json:"source"`
+	// Subject is the identifier of the object, file or DPN
+	// bag the entry describes.
+	Subject    string        `json:"subject"`
+	Summary    string        `json:"summary"`
+	Outcome    string        `json:"outcome,omitempty"`
+	// Identifier is the id of the source record, such as
+	// the PREMIS event identifier.
+	Identifier string        `json:"identifier,omitempty"`
+}
+
+// LifecycleGap notes a source we couldn't get lifecycle
+// entries from, so the timeline may be incomplete.
+type LifecycleGap struct {
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// LifecycleTimeline is everything we know that happened to a bag,
+// in chronological order. See BagLifecycle.
+type LifecycleTimeline struct {
+	ObjectIdentifier string            `json:"object_identifier"`
+	GeneratedAt      time.Time         `json:"generated_at"`
+	Entries          []*LifecycleEntry `json:"entries"`
+	Gaps             []*LifecycleGap   `json:"gaps"`
+}
+
+// LifecycleClient is the part of the FluctusClient that
+// BagLifecycle needs. It's an interface so the timeline
+// can be tested without Fluctus.
+type LifecycleClient interface {
+	IntellectualObjectGet(identifier string, includeRelations bool) (*IntellectualObject, error)
+	ProcessStatusSearch(ps *ProcessStatus, retrySpecified, reviewedSpecified bool) ([]*ProcessStatus, error)
+}
+
+// LifecycleSource provides lifecycle entries from outside Fluctus,
+// such as the DPN REST service. LifecycleEntries may return some
+// entries along with an error, if it could get only part of its data.
+type LifecycleSource interface {
+	Name() (string)
+	LifecycleEntries(objectIdentifier string) ([]*LifecycleEntry, error)
+}
+
+/*
+BagLifecycle returns everything that ever happened to the object
+with the specified identifier: the PREMIS events of the object and
+its files, all of its ProcessedItem records, and the entries from
+any other sources, such as DPN. Entries are sorted by time. Ties
+are broken by source, kind, subject, identifier and summary, so
+the same history always comes out in the same order.
+
+If a source can't be reached, the timeline includes whatever the
+other sources returned, and a gap describing what's missing.
+This returns an error only if objectIdentifier is not a valid
+object identifier.
+*/
+func BagLifecycle(client LifecycleClient, objectIdentifier string, sources ...LifecycleSource) (*LifecycleTimeline, error) {
+	slash := strings.Index(objectIdentifier, "/")
+	if slash < 1 || slash == len(objectIdentifier) - 1 {
+		return nil, fmt.Errorf("'%s' is not a valid object identifier", objectIdentifier)
+	}
+	timeline := &LifecycleTimeline{
+		ObjectIdentifier: objectIdentifier,
+		GeneratedAt:      NowUTC(),
+		Entries:          make([]*LifecycleEntry, 0),
+		Gaps:             make([]*LifecycleGap, 0),
+	}
+
+	obj, err := client.IntellectualObjectGet(objectIdentifier, true)
+	if err != nil {
+		timeline.AddGap(LifecycleSourceFluctus, fmt.Sprintf(
+			"Cannot get object and events: %v", err))
+	} else if obj == nil {
+		timeline.AddGap(LifecycleSourceFluctus, "Object not found")
+	} else {
+		timeline.Add(ObjectLifecycleEntries(obj)...)
+	}
+
+	// Ingest records may not have the object identifier, so
+	// we also look them up by the name of the tar file.
+	searches := []*ProcessStatus{
+		&ProcessStatus{ObjectIdentifier: objectIdentifier},
+		&ProcessStatus{Name: objectIdentifier[slash+1:] + ".tar"},
+	}
+	seen := make(map[int]bool)
+	for _, search := range searches {
+		records, err := client.ProcessStatusSearch(search, false, false)
+		if err != nil {
+			timeline.AddGap(LifecycleSourceProcessedItem, fmt.Sprintf(
+				"Cannot get processed items: %v", err))
+			continue
+		}
+		for _, record := range records {
+			if record.Id != 0 && seen[record.Id] {
+				continue
+			}
+			seen[record.Id] = true
+			timeline.Add(ProcessStatusLifecycleEntry(record))
+		}
+	}
+
+	for _, source := range sources {
+		entries, err := source.LifecycleEntries(objectIdentifier)
+		timeline.Add(entries...)
+		if err != nil {
+			timeline.AddGap(source.Name(), err.Error())
+		}
+	}
+	timeline.Sort()
+	return timeline, nil
+}
+
+// ObjectLifecycleEntries returns lifecycle entries for the PREMIS
+// events of an object and all of its files.
+func ObjectLifecycleEntries(obj *IntellectualObject) ([]*LifecycleEntry) {
+	entries := make([]*LifecycleEntry, 0)
+	for _, event := range obj.Events {
+		entries = append(entries, PremisEventLifecycleEntry(obj.Identifier, event))
+	}
+	for _, gf := range obj.GenericFiles {
+		for _, event := range gf.Events {
+			entries = append(entries, PremisEventLifecycleEntry(gf.Identifier, event))
+		}
+	}
+	return entries
+}
+
+// PremisEventLifecycleEntry returns a lifecycle entry for an event
+// on the object or file with identifier subject.
+func PremisEventLifecycleEntry(subject string, event *PremisEvent) (*LifecycleEntry) {
+	summary := event.Detail
+	if event.OutcomeDetail != "" {
+		summary = fmt.Sprintf("%s (%s)", event.Detail, event.OutcomeDetail)
+	}
+	return &LifecycleEntry{
+		Time:       event.DateTime,
+		Kind:       premisEventKind(event.EventType),
+		Source:     LifecycleSourcePremis,
+		Subject:    subject,
+		Summary:    summary,
+		Outcome:    event.Outcome,
+		Identifier: event.Identifier,
+	}
+}
+
+func premisEventKind(eventType string) (LifecycleKind) {
+	switch strings.ToLower(eventType) {
+	case "ingest":
+		return LifecycleIngest
+	case "fixity_check", "fixity_generation":
+		return LifecycleFixity
+	case "delete":
+		return LifecycleDelete
+	case "replication":
+		return LifecycleReplication
+	}
+	return LifecycleOther
+}
+
+// ProcessStatusLifecycleEntry returns a lifecycle entry for a
+// ProcessedItem record.
+func ProcessStatusLifecycleEntry(record *ProcessStatus) (*LifecycleEntry) {
+	subject := record.ObjectIdentifier
+	if record.GenericFileIdentifier != "" {
+		subject = record.GenericFileIdentifier
+	} else if subject == "" {
+		subject = record.Name
+	}
+	summary := fmt.Sprintf("%s %s %s", record.Action, record.Stage, record.Status)
+	if record.Note != "" {
+		summary = fmt.Sprintf("%s: %s", summary, record.Note)
+	}
+	outcome := string(record.Outcome)
+	if record.Outcome == OutcomeLegacy && record.LegacyOutcome != "" {
+		outcome = record.LegacyOutcome
+	} else if outcome == "" {
+		outcome = string(record.Status)
+	}
+	identifier := ""
+	if record.Id != 0 {
+		identifier = strconv.Itoa(record.Id)
+	}
+	return &LifecycleEntry{
+		Time:       record.Date,
+		Kind:       actionKind(record.Action),
+		Source:     LifecycleSourceProcessedItem,
+		Subject:    subject,
+		Summary:    summary,
+		Outcome:    outcome,
+		Identifier: identifier,
+	}
+}
+
+func actionKind(action ActionType) (LifecycleKind) {
+	switch action {
+	case ActionIngest:
+		return LifecycleIngest
+	case ActionFixityCheck:
+		return LifecycleFixity
+	case ActionRestore:
+		return LifecycleRestore
+	case ActionDelete:
+		return LifecycleDelete
+	case ActionDPN:
+		return LifecycleDPN
+	}
+	return LifecycleOther
+}
+
+// Add adds entries to the timeline. Call Sort after adding.
+func (timeline *LifecycleTimeline) Add(entries ...*LifecycleEntry) {
+	timeline.Entries = append(timeline.Entries, entries...)
+}
+
+// AddGap notes that we couldn't get all of the entries from source.
+func (timeline *LifecycleTimeline) AddGap(source, message string) {
+	timeline.Gaps = append(timeline.Gaps, &LifecycleGap{Source: source, Message: message})
+}
+
+// Sort puts the entries in chronological order. See BagLifecycle
+// for how ties are broken.
+func (timeline *LifecycleTimeline) Sort() {
+	sort.Stable(lifecycleEntriesByTime(timeline.Entries))
+}
+
+// JSON returns the timeline as indented JSON.
+func (timeline *LifecycleTimeline) JSON() ([]byte, error) {
+	return json.MarshalIndent(timeline, "", "  ")
+}
+
+// Text returns the timeline as a human-readable table, one entry
+// per line, followed by any gaps.
+func (timeline *LifecycleTimeline) Text() (string) {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "Lifecycle of %s as of %s\n\n",
+		timeline.ObjectIdentifier, FormatUTC(timeline.GeneratedAt))
+	if len(timeline.Entries) == 0 {
+		fmt.Fprintln(buffer, "No entries.")
+	} else {
+		writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "TIME\tKIND\tSOURCE\tSUBJECT\tOUTCOME\tSUMMARY")
+		for _, entry := range timeline.Entries {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", FormatUTC(entry.Time),
+				entry.Kind, entry.Source, entry.Subject, entry.Outcome,
+				strings.Replace(entry.Summary, "\n", " ", -1))
+		}
+		writer.Flush()
+	}
+	if len(timeline.Gaps) > 0 {
+		fmt.Fprintln(buffer, "\nThis timeline may be incomplete:")
+		for _, gap := range timeline.Gaps {
+			fmt.Fprintf(buffer, "  %s: %s\n", gap.Source, gap.Message)
+		}
+	}
+	return buffer.String()
+}
+
+type lifecycleEntriesByTime []*LifecycleEntry
+
+func (entries lifecycleEntriesByTime) Len() int {
+	return len(entries)
+}
+
+func (entries lifecycleEntriesByTime) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
+
+func (entries lifecycleEntriesByTime) Less(i, j int) bool {
+	a, b := entries[i], entries[j]
+	if !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	if a.Source != b.Source {
+		return a.Source < b.Source
+	}
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	if a.Subject != b.Subject {
+		return a.Subject < b.Subject
+	}
+	if a.Identifier != b.Identifier {
+		return a.Identifier < b.Identifier
+	}
+	return a.Summary < b.Summary
+}
@@ -0,0 +1,219 @@
+package bagman_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeLifecycleClient struct {
+	obj       *bagman.IntellectualObject
+	objErr    error
+	records   []*bagman.ProcessStatus
+	searchErr error
+	searches  []*bagman.ProcessStatus
+}
+
+func (client *fakeLifecycleClient) IntellectualObjectGet(identifier string, includeRelations bool) (*bagman.IntellectualObject, error) {
+	return client.obj, client.objErr
+}
+
+func (client *fakeLifecycleClient) ProcessStatusSearch(ps *bagman.ProcessStatus, retrySpecified, reviewedSpecified bool) ([]*bagman.ProcessStatus, error) {
+	client.searches = append(client.searches, ps)
+	if client.searchErr != nil {
+		return nil, client.searchErr
+	}
+	matches := make([]*bagman.ProcessStatus, 0)
+	for _, record := range client.records {
+		if (ps.ObjectIdentifier != "" && record.ObjectIdentifier == ps.ObjectIdentifier) ||
+			(ps.Name != "" && record.Name == ps.Name) {
+			matches = append(matches, record)
+		}
+	}
+	return matches, nil
+}
+
+type fakeLifecycleSource struct {
+	entries []*bagman.LifecycleEntry
+	err     error
+}
+
+func (source *fakeLifecycleSource) Name() (string) {
+	return "dpn"
+}
+
+func (source *fakeLifecycleSource) LifecycleEntries(objectIdentifier string) ([]*bagman.LifecycleEntry, error) {
+	return source.entries, source.err
+}
+
+func lifecycleTime(day, hour int) (time.Time) {
+	return time.Date(2016, 3, day, hour, 0, 0, 0, time.UTC)
+}
+
+func newFakeLifecycleClient() (*fakeLifecycleClient) {
+	obj := &bagman.IntellectualObject{
+		Identifier: "test.edu/bag1",
+		Events: []*bagman.PremisEvent{
+			{Identifier: "e-obj-ingest", EventType: "ingest", DateTime: lifecycleTime(2, 10),
+				Detail: "Object ingested", Outcome: "Success"},
+		},
+		GenericFiles: []*bagman.GenericFile{
+			{Identifier: "test.edu/bag1/data/b.txt", Events: []*bagman.PremisEvent{
+				{Identifier: "e-b-ingest", EventType: "ingest", DateTime: lifecycleTime(2, 10),
+					Detail: "Completed copy to S3", Outcome: "Success"},
+				{Identifier: "e-b-fixity", EventType: "fixity_check", DateTime: lifecycleTime(20, 1),
+					Detail: "Fixity check", OutcomeDetail: "md5:1234", Outcome: "Failure"},
+			}},
+			{Identifier: "test.edu/bag1/data/a.txt", Events: []*bagman.PremisEvent{
+				{Identifier: "e-a-ingest", EventType: "ingest", DateTime: lifecycleTime(2, 10),
+					Detail: "Completed copy to S3", Outcome: "Success"},
+			}},
+		},
+	}
+	records := []*bagman.ProcessStatus{
+		// The ingest record has only the bag name.
+		{Id: 1, Name: "bag1.tar", Date: lifecycleTime(2, 9), Action: bagman.ActionIngest,
+			Stage: bagman.StageRecord, Status: bagman.StatusSuccess, Outcome: bagman.OutcomeSuccess},
+		// This one matches both searches, and should appear once.
+		{Id: 2, Name: "bag1.tar", ObjectIdentifier: "test.edu/bag1", Date: lifecycleTime(15, 8),
+			Action: bagman.ActionRestore, Stage: bagman.StageResolve, Status: bagman.StatusSuccess,
+			Note: "Restored to test.edu bucket"},
+		{Id: 3, ObjectIdentifier: "test.edu/bag1", GenericFileIdentifier: "test.edu/bag1/data/b.txt",
+			Date: lifecycleTime(25, 12), Action: bagman.ActionDelete, Stage: bagman.StageRequested,
+			Status: bagman.StatusPending},
+	}
+	return &fakeLifecycleClient{obj: obj, records: records}
+}
+
+func TestBagLifecycle(t *testing.T) {
+	client := newFakeLifecycleClient()
+	dpnSource := &fakeLifecycleSource{entries: []*bagman.LifecycleEntry{
+		{Time: lifecycleTime(10, 0), Kind: bagman.LifecycleDPN, Source: "dpn",
+			Subject: "uuid-1", Summary: "Registered in DPN"},
+	}}
+	timeline, err := bagman.BagLifecycle(client, "test.edu/bag1", dpnSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.searches) != 2 || client.searches[0].ObjectIdentifier != "test.edu/bag1" ||
+		client.searches[1].Name != "bag1.tar" {
+		t.Errorf("Expected searches by object identifier and bag name")
+	}
+	if len(timeline.Gaps) != 0 {
+		t.Errorf("Expected no gaps, got %v", timeline.Gaps[0])
+	}
+
+	// Entries at the same time are ordered by source, kind,
+	// subject and identifier.
+	expected := []string{
+		"processed_item ingest bag1.tar",
+		"premis ingest test.edu/bag1",
+		"premis ingest test.edu/bag1/data/a.txt",
+		"premis ingest test.edu/bag1/data/b.txt",
+		"dpn dpn uuid-1",
+		"processed_item restore test.edu/bag1",
+		"premis fixity test.edu/bag1/data/b.txt",
+		"processed_item delete test.edu/bag1/data/b.txt",
+	}
+	if len(timeline.Entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(timeline.Entries))
+	}
+	for i, entry := range timeline.Entries {
+		actual := fmt.Sprintf("%s %s %s", entry.Source, entry.Kind, entry.Subject)
+		if actual != expected[i] {
+			t.Errorf("Entry %d: expected '%s', got '%s'", i, expected[i], actual)
+		}
+	}
+	if timeline.Entries[5].Summary != "Restore Resolve Success: Restored to test.edu bucket" ||
+		timeline.Entries[5].Outcome != "Success" || timeline.Entries[5].Identifier != "2" {
+		t.Errorf("Wrong entry for restore record: %+v", timeline.Entries[5])
+	}
+	if timeline.Entries[6].Summary != "Fixity check (md5:1234)" ||
+		timeline.Entries[6].Outcome != "Failure" {
+		t.Errorf("Wrong entry for fixity event: %+v", timeline.Entries[6])
+	}
+
+	// Sorting doesn't depend on the order the entries arrived in.
+	client.obj.GenericFiles[0], client.obj.GenericFiles[1] =
+		client.obj.GenericFiles[1], client.obj.GenericFiles[0]
+	client.records[0], client.records[2] = client.records[2], client.records[0]
+	again, _ := bagman.BagLifecycle(client, "test.edu/bag1", dpnSource)
+	for i := range timeline.Entries {
+		if again.Entries[i].Identifier != timeline.Entries[i].Identifier ||
+			again.Entries[i].Subject != timeline.Entries[i].Subject {
+			t.Errorf("Entry %d changed when input order changed", i)
+		}
+	}
+}
+
+func TestBagLifecycleGaps(t *testing.T) {
+	client := newFakeLifecycleClient()
+	client.searchErr = fmt.Errorf("connection refused")
+	dpnSource := &fakeLifecycleSource{
+		entries: []*bagman.LifecycleEntry{
+			{Time: lifecycleTime(10, 0), Kind: bagman.LifecycleDPN, Source: "dpn", Subject: "uuid-1"},
+		},
+		err: fmt.Errorf("Cannot get fixity checks for bag uuid-1"),
+	}
+	timeline, err := bagman.BagLifecycle(client, "test.edu/bag1", dpnSource)
+	if err != nil {
+		t.Fatalf("Unreachable sources should be gaps, not errors: %v", err)
+	}
+	// Object events and the partial DPN data are still there.
+	if len(timeline.Entries) != 5 {
+		t.Errorf("Expected 5 entries, got %d", len(timeline.Entries))
+	}
+	if len(timeline.Gaps) != 3 || timeline.Gaps[0].Source != "processed_item" ||
+		timeline.Gaps[2].Source != "dpn" ||
+		!strings.Contains(timeline.Gaps[2].Message, "fixity checks") {
+		t.Errorf("Wrong gaps: %d", len(timeline.Gaps))
+	}
+
+	client.obj = nil
+	timeline, _ = bagman.BagLifecycle(client, "test.edu/bag1")
+	if len(timeline.Gaps) != 3 || timeline.Gaps[0].Message != "Object not found" {
+		t.Errorf("Missing object should be a gap")
+	}
+
+	if _, err = bagman.BagLifecycle(client, "bag1"); err == nil {
+		t.Errorf("BagLifecycle should reject an invalid identifier")
+	}
+}
+
+func TestLifecycleTimelineRenderers(t *testing.T) {
+	client := newFakeLifecycleClient()
+	timeline, err := bagman.BagLifecycle(client, "test.edu/bag1",
+		&fakeLifecycleSource{err: fmt.Errorf("DPN REST service unreachable")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := timeline.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &bagman.LifecycleTimeline{}
+	if err = json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ObjectIdentifier != "test.edu/bag1" || len(decoded.Entries) != len(timeline.Entries) ||
+		decoded.Entries[0].Kind != bagman.LifecycleIngest || len(decoded.Gaps) != 1 {
+		t.Errorf("JSON did not round-trip: %s", data)
+	}
+
+	text := timeline.Text()
+	lines := strings.Split(text, "\n")
+	if !strings.HasPrefix(lines[0], "Lifecycle of test.edu/bag1 as of ") {
+		t.Errorf("Wrong heading: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[2], "TIME") ||
+		!strings.HasPrefix(lines[3], "2016-03-02T09:00:00Z  ingest") ||
+		!strings.Contains(lines[3], "Ingest Record Success") {
+		t.Errorf("Wrong table:\n%s", text)
+	}
+	if !strings.Contains(text, "This timeline may be incomplete:\n  dpn: DPN REST service unreachable\n") {
+		t.Errorf("Text should list gaps:\n%s", text)
+	}
+}
@@ -0,0 +1,188 @@
+package bagman
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches anything that looks like an attempt at a multipart suffix,
+// including malformed ones like ".b01.of" and ".b.of12". Names that
+// match this but not MultipartSuffix are rejected.
+var partialMultipartSuffix = regexp.MustCompile("\\.b\\d*\\.of\\d*$")
+
+// TarExtensions lists the extensions of the bag files we ingest.
+// Partners may gzip their bags, as .tar.gz or .tgz. Longer
+// extensions come first, so .tar.gz matches before .tar would.
+var TarExtensions = []string{".tar.gz", ".tgz", ".tar"}
+
+// BagNameErrorKind describes what is wrong with a bag name.
+type BagNameErrorKind string
+
+const (
+	// The name is too short to be a tar file name, or is
+	// empty once the extension and suffix are removed.
+	BagNameTooShort          BagNameErrorKind = "TooShort"
+	// The name does not end with one of TarExtensions, or with
+	// the extension passed to ParseBagNameWithExtension.
+	BagNameBadExtension                       = "BadExtension"
+	// The name ends with ".tar.tar", ".tar.tgz" or similar.
+	BagNameDoubleExtension                    = "DoubleExtension"
+	// The name has a partial multipart suffix, such as
+	// ".b01.of", which is missing the part count.
+	BagNameBadMultipartSuffix                 = "BadMultipartSuffix"
+	// The multipart suffix is well-formed, but the part
+	// number is zero or greater than the part count.
+	BagNameBadPartNumber                      = "BadPartNumber"
+)
+
+// BagNameError is returned by ParseBagName and CleanBagName when
+// a tar file name is malformed. Kind says what's wrong with it.
+type BagNameError struct {
+	Name    string
+	Kind    BagNameErrorKind
+	Message string
+}
+
+func (err *BagNameError) Error() (string) {
+	return fmt.Sprintf("'%s' is not a valid bag name: %s", err.Name, err.Message)
+}
+
+// BagNameInfo describes the parts of a tar file name.
+type BagNameInfo struct {
+	// The name passed to ParseBagName.
+	Original   string
+
+	// The name minus the extension and any multipart suffix.
+	// For "inst.edu/my_bag.b001.of008.tar", this is
+	// "inst.edu/my_bag".
+	CleanName  string
+
+	// The part number and total number of parts of a multipart
+	// bag. These are zero if the bag is not multipart.
+	PartNumber int
+	TotalParts int
+}
+
+// Returns true if the name had a multipart suffix.
+func (info *BagNameInfo) IsMultipart() (bool) {
+	return info.TotalParts > 0
+}
+
+// ParseBagName breaks a tar file name into its clean name and
+// multipart info. The name may include a path prefix, such as an
+// institution domain. Returns a *BagNameError if the name does not
+// end in .tar, .tar.gz or .tgz, has a double extension, has a
+// malformed multipart suffix, or has nothing left after cleaning.
+func ParseBagName(bagName string) (*BagNameInfo, error) {
+	ext := TarExtension(bagName)
+	if ext == "" {
+		if len(bagName) > len(".tar") {
+			return nil, &BagNameError{bagName, BagNameBadExtension,
+				fmt.Sprintf("name must end with %s", strings.Join(TarExtensions, ", "))}
+		}
+		ext = ".tar"
+	} else if TarExtension(strings.ToLower(bagName[0:len(bagName)-len(ext)])) != "" {
+		return nil, &BagNameError{bagName, BagNameDoubleExtension,
+			"name has more than one tar extension"}
+	}
+	return ParseBagNameWithExtension(bagName, ext)
+}
+
+// TarExtension returns whichever of TarExtensions the name ends
+// with, or an empty string if it ends with none of them. Matching
+// is case-sensitive, so "bag.TAR" has no tar extension.
+func TarExtension(name string) (string) {
+	for _, ext := range TarExtensions {
+		if strings.HasSuffix(name, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// Returns true if name ends with .tar.gz or .tgz.
+func IsGzippedTar(name string) (bool) {
+	ext := TarExtension(name)
+	return ext == ".tar.gz" || ext == ".tgz"
+}
+
+// TrimTarExtension returns name minus its tar extension. So
+// "my_bag.tar.gz" and "my_bag.tar" both return "my_bag". Names
+// without a tar extension are returned unchanged.
+func TrimTarExtension(name string) (string) {
+	return name[0:len(name)-len(TarExtension(name))]
+}
+
+// ParseBagNameWithExtension is like ParseBagName, for bags packaged
+// as something other than tar files. Param ext is the extension to
+// strip, including the leading dot, e.g. ".zip" or ".tar.gz". The
+// name must end with ext exactly, but the double extension check
+// ignores case, as it does for ".tar".
+func ParseBagNameWithExtension(bagName, ext string) (*BagNameInfo, error) {
+	if len(ext) < 2 || !strings.HasPrefix(ext, ".") {
+		return nil, fmt.Errorf("Invalid bag file extension '%s'", ext)
+	}
+	if len(bagName) <= len(ext) {
+		return nil, &BagNameError{bagName, BagNameTooShort,
+			fmt.Sprintf("name is too short to be a %s file name", ext)}
+	}
+	if !strings.HasSuffix(bagName, ext) {
+		return nil, &BagNameError{bagName, BagNameBadExtension,
+			fmt.Sprintf("name must end with %s", ext)}
+	}
+	nameWithoutExt := bagName[0:len(bagName)-len(ext)]
+	if strings.HasSuffix(strings.ToLower(nameWithoutExt), strings.ToLower(ext)) {
+		return nil, &BagNameError{bagName, BagNameDoubleExtension,
+			fmt.Sprintf("name has more than one %s extension", ext)}
+	}
+	info := &BagNameInfo{
+		Original:  bagName,
+		CleanName: nameWithoutExt,
+	}
+	if MultipartSuffix.MatchString(nameWithoutExt) {
+		suffix := MultipartSuffix.FindString(nameWithoutExt)
+		info.CleanName = nameWithoutExt[0:len(nameWithoutExt)-len(suffix)]
+		// Suffix is .bN.ofM, and the regex guarantees N and M are digits.
+		parts := strings.Split(suffix[2:], ".of")
+		info.PartNumber, _ = strconv.Atoi(parts[0])
+		info.TotalParts, _ = strconv.Atoi(parts[1])
+		if info.PartNumber < 1 || info.PartNumber > info.TotalParts {
+			return nil, &BagNameError{bagName, BagNameBadPartNumber,
+				fmt.Sprintf("part number %d is not between 1 and %d",
+					info.PartNumber, info.TotalParts)}
+		}
+	} else if partialMultipartSuffix.MatchString(nameWithoutExt) {
+		return nil, &BagNameError{bagName, BagNameBadMultipartSuffix,
+			fmt.Sprintf("multipart suffix '%s' should look like .b001.of008",
+				partialMultipartSuffix.FindString(nameWithoutExt))}
+	}
+	baseName := info.CleanName[strings.LastIndex(info.CleanName, "/")+1:]
+	if baseName == "" {
+		return nil, &BagNameError{bagName, BagNameTooShort,
+			"nothing is left of the name after removing extension and suffix"}
+	}
+	return info, nil
+}
+
+// WouldCollide returns true if nameA and nameB are different tar
+// files that would be ingested as the same intellectual object.
+// For example, "mybag.tar" and "mybag.b001.of001.tar" collide.
+// Different parts of the same multipart bag, such as
+// "mybag.b001.of002.tar" and "mybag.b002.of002.tar", do not
+// collide, and neither do names that cannot be parsed.
+func WouldCollide(nameA, nameB string) (bool) {
+	if nameA == nameB {
+		return false
+	}
+	infoA, errA := ParseBagName(nameA)
+	infoB, errB := ParseBagName(nameB)
+	if errA != nil || errB != nil || infoA.CleanName != infoB.CleanName {
+		return false
+	}
+	samePartSet := (infoA.IsMultipart() && infoB.IsMultipart() &&
+		infoA.TotalParts == infoB.TotalParts &&
+		infoA.PartNumber != infoB.PartNumber)
+	return !samePartSet
+}
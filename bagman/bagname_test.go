@@ -0,0 +1,182 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"testing"
+)
+
+func TestParseBagNameValid(t *testing.T) {
+	testCases := []struct {
+		name       string
+		cleanName  string
+		partNumber int
+		totalParts int
+	}{
+		{"mybag.tar", "mybag", 0, 0},
+		{"x.tar", "x", 0, 0},
+		{"some.file.tar", "some.file", 0, 0},
+		{"some.file.b001.of200.tar", "some.file", 1, 200},
+		{"some.file.b1.of2.tar", "some.file", 1, 2},
+		{"some.file.b2.of2.tar", "some.file", 2, 2},
+		{"inst.edu/my_bag.b001.of008.tar", "inst.edu/my_bag", 1, 8},
+		{"inst.edu/my_bag.tar", "inst.edu/my_bag", 0, 0},
+		{"bag.b01.tar", "bag.b01", 0, 0},
+		{"bag.of2.tar", "bag.of2", 0, 0},
+		{"bag.tarball.tar", "bag.tarball", 0, 0},
+		{"mybag.tar.gz", "mybag", 0, 0},
+		{"mybag.tgz", "mybag", 0, 0},
+		{"inst.edu/my_bag.b001.of008.tar.gz", "inst.edu/my_bag", 1, 8},
+		{"some.file.b2.of2.tgz", "some.file", 2, 2},
+	}
+	for _, tc := range testCases {
+		info, err := bagman.ParseBagName(tc.name)
+		if err != nil {
+			t.Errorf("ParseBagName(%q) returned error: %v", tc.name, err)
+			continue
+		}
+		if info.Original != tc.name {
+			t.Errorf("ParseBagName(%q): Original is %q", tc.name, info.Original)
+		}
+		if info.CleanName != tc.cleanName {
+			t.Errorf("ParseBagName(%q): CleanName is %q, expected %q",
+				tc.name, info.CleanName, tc.cleanName)
+		}
+		if info.PartNumber != tc.partNumber || info.TotalParts != tc.totalParts {
+			t.Errorf("ParseBagName(%q): part %d of %d, expected %d of %d",
+				tc.name, info.PartNumber, info.TotalParts, tc.partNumber, tc.totalParts)
+		}
+		if info.IsMultipart() != (tc.totalParts > 0) {
+			t.Errorf("ParseBagName(%q): IsMultipart is %t", tc.name, info.IsMultipart())
+		}
+		cleanName, err := bagman.CleanBagName(tc.name)
+		if err != nil || cleanName != tc.cleanName {
+			t.Errorf("CleanBagName(%q) returned %q, %v; expected %q",
+				tc.name, cleanName, err, tc.cleanName)
+		}
+	}
+}
+
+func TestParseBagNameInvalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		kind bagman.BagNameErrorKind
+	}{
+		{"", bagman.BagNameTooShort},
+		{".tar", bagman.BagNameTooShort},
+		{"inst.edu/.tar", bagman.BagNameTooShort},
+		{".b001.of002.tar", bagman.BagNameTooShort},
+		{"mybag", bagman.BagNameBadExtension},
+		{"mybag.zip", bagman.BagNameBadExtension},
+		{"mybag.TAR", bagman.BagNameBadExtension},
+		{"mybag.gz", bagman.BagNameBadExtension},
+		{"mybag.TGZ", bagman.BagNameBadExtension},
+		{".tgz", bagman.BagNameTooShort},
+		{".tar.gz", bagman.BagNameTooShort},
+		{"mybag.tar ", bagman.BagNameBadExtension},
+		{"data.tar.tar", bagman.BagNameDoubleExtension},
+		{"data.TAR.tar", bagman.BagNameDoubleExtension},
+		{"data.b001.of002.tar.tar", bagman.BagNameDoubleExtension},
+		{"data.tar.tar.gz", bagman.BagNameDoubleExtension},
+		{"data.TAR.tgz", bagman.BagNameDoubleExtension},
+		{"data.tgz.tar", bagman.BagNameDoubleExtension},
+		{"bag.b01.of.tar", bagman.BagNameBadMultipartSuffix},
+		{"bag.b.of12.tar", bagman.BagNameBadMultipartSuffix},
+		{"bag.b.of.tar", bagman.BagNameBadMultipartSuffix},
+		{"inst.edu/bag.b01.of.tar", bagman.BagNameBadMultipartSuffix},
+		{"bag.b0.of2.tar", bagman.BagNameBadPartNumber},
+		{"bag.b3.of2.tar", bagman.BagNameBadPartNumber},
+		{"bag.b001.of000.tar", bagman.BagNameBadPartNumber},
+	}
+	for _, tc := range testCases {
+		info, err := bagman.ParseBagName(tc.name)
+		if err == nil {
+			t.Errorf("ParseBagName(%q) should have failed, but returned %q",
+				tc.name, info.CleanName)
+			continue
+		}
+		bagNameError, ok := err.(*bagman.BagNameError)
+		if !ok {
+			t.Errorf("ParseBagName(%q) returned %T, expected *BagNameError", tc.name, err)
+			continue
+		}
+		if bagNameError.Kind != tc.kind {
+			t.Errorf("ParseBagName(%q) returned error kind %s, expected %s: %v",
+				tc.name, bagNameError.Kind, tc.kind, err)
+		}
+		if bagNameError.Name != tc.name {
+			t.Errorf("BagNameError has name %q, expected %q", bagNameError.Name, tc.name)
+		}
+		if _, err := bagman.CleanBagName(tc.name); err == nil {
+			t.Errorf("CleanBagName(%q) should have failed", tc.name)
+		}
+	}
+}
+
+func TestWouldCollide(t *testing.T) {
+	testCases := []struct {
+		nameA    string
+		nameB    string
+		expected bool
+	}{
+		// Different uploads of the same object.
+		{"mybag.tar", "mybag.b001.of001.tar", true},
+		{"mybag.tar", "mybag.b1.of2.tar", true},
+		{"mybag.b001.of002.tar", "mybag.b001.of003.tar", true},
+		{"mybag.b002.of002.tar", "mybag.b001.of003.tar", true},
+		{"mybag.b1.of2.tar", "mybag.b001.of002.tar", true},
+		{"inst.edu/mybag.tar", "inst.edu/mybag.b001.of001.tar", true},
+		{"mybag.tar", "mybag.tar.gz", true},
+		{"mybag.tgz", "mybag.b001.of001.tar.gz", true},
+		// Parts of the same multipart bag.
+		{"mybag.b001.of002.tar", "mybag.b002.of002.tar", false},
+		{"mybag.b1.of3.tar", "mybag.b03.of3.tar", false},
+		// Same file.
+		{"mybag.tar", "mybag.tar", false},
+		{"mybag.b001.of002.tar", "mybag.b001.of002.tar", false},
+		// Different objects.
+		{"mybag.tar", "mybag2.tar", false},
+		{"mybag.tar", "Mybag.tar", false},
+		{"inst.edu/mybag.tar", "other.edu/mybag.tar", false},
+		{"mybag.b01.tar", "mybag.tar", false},
+		// Names that can't be parsed don't collide.
+		{"mybag.tar", "mybag.tar.tar", false},
+		{"mybag.b01.of.tar", "mybag.tar", false},
+	}
+	for _, tc := range testCases {
+		if bagman.WouldCollide(tc.nameA, tc.nameB) != tc.expected {
+			t.Errorf("WouldCollide(%q, %q) should be %t", tc.nameA, tc.nameB, tc.expected)
+		}
+		if bagman.WouldCollide(tc.nameB, tc.nameA) != tc.expected {
+			t.Errorf("WouldCollide(%q, %q) should be %t", tc.nameB, tc.nameA, tc.expected)
+		}
+	}
+}
+
+func TestTarExtension(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ext     string
+		gzipped bool
+		trimmed string
+	}{
+		{"bag.tar", ".tar", false, "bag"},
+		{"bag.tar.gz", ".tar.gz", true, "bag"},
+		{"bag.tgz", ".tgz", true, "bag"},
+		{"inst.edu/bag.b01.of02.tgz", ".tgz", true, "inst.edu/bag.b01.of02"},
+		{"/mnt/data/bag.tar.gz", ".tar.gz", true, "/mnt/data/bag"},
+		{"bag.gz", "", false, "bag.gz"},
+		{"bag.TAR", "", false, "bag.TAR"},
+		{"bag", "", false, "bag"},
+	}
+	for _, tc := range testCases {
+		if ext := bagman.TarExtension(tc.name); ext != tc.ext {
+			t.Errorf("TarExtension(%q) returned %q, expected %q", tc.name, ext, tc.ext)
+		}
+		if bagman.IsGzippedTar(tc.name) != tc.gzipped {
+			t.Errorf("IsGzippedTar(%q) should be %t", tc.name, tc.gzipped)
+		}
+		if trimmed := bagman.TrimTarExtension(tc.name); trimmed != tc.trimmed {
+			t.Errorf("TrimTarExtension(%q) returned %q, expected %q", tc.name, trimmed, tc.trimmed)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package bagman
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How many manifest entries a preview lists, if the caller
+// doesn't say.
+const DEFAULT_PREVIEW_MANIFEST_ENTRIES = 20
+
+// How long the presigned URL for a preview is good for.
+const PREVIEW_URL_EXPIRATION = 15 * time.Minute
+
+// Tag files whose contents a preview reads. It also reads every
+// manifest and tag manifest.
+var previewTagFiles = []string{"bagit.txt", "bag-info.txt", "aptrust-info.txt"}
+
+/*
+BagPreview describes a tarred bag from its tag files and manifests,
+without reading its payload. Support staff can use it to see what's
+in a bag, and whether it's roughly valid, before committing to a
+long ingest. A preview does not verify any checksums.
+*/
+type BagPreview struct {
+	BucketName         string
+	Key                string
+	// The name of the top-level directory in the tar file.
+	BagName            string
+	// Tags from bagit.txt, bag-info.txt and aptrust-info.txt.
+	Tags               []Tag
+	// The tag files and manifests the preview read.
+	TagFiles           []string
+	// Payload-Oxum from bag-info.txt, and the byte and file
+	// counts it declares. The counts are zero if the tag is
+	// missing or malformed.
+	PayloadOxum        string
+	OxumByteCount      int64
+	OxumFileCount      int64
+	// The payload manifest the entries come from, usually
+	// manifest-md5.txt, and the number of files it lists.
+	Manifest           string
+	ManifestFileCount  int
+	// The first entries in Manifest, as "checksum path".
+	ManifestEntries    []string
+	// The number and total size of the payload files whose tar
+	// headers the preview read. These count the whole payload
+	// only if ScannedAllHeaders is true.
+	PayloadFileCount   int64
+	PayloadByteCount   int64
+	// ScannedAllHeaders is false if the preview stopped at the
+	// first payload file because it had already found the
+	// required tag files.
+	ScannedAllHeaders  bool
+	// Required tag files that are not in the bag.
+	MissingTagFiles    []string
+	// Required tags that are missing or empty.
+	MissingTags        []string
+	// Problems that would make the bag fail ingest.
+	Errors             []string
+	// Problems that would not.
+	Warnings           []string
+	// The number of range requests and bytes the preview
+	// needed. Zero if the bag was not read from S3.
+	RangeRequests      int
+	BytesFetched       int64
+}
+
+// TagValue returns the value of the first tag with the specified
+// label, or an empty string. Labels are not case sensitive.
+func (preview *BagPreview) TagValue(tagLabel string) (string) {
+	lcTagLabel := strings.ToLower(tagLabel)
+	for _, tag := range preview.Tags {
+		if strings.ToLower(tag.Label) == lcTagLabel {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// IsRoughlyValid returns true if the preview found nothing that
+// would make the bag fail ingest.
+func (preview *BagPreview) IsRoughlyValid() (bool) {
+	return len(preview.Errors) == 0 && len(preview.MissingTagFiles) == 0 &&
+		len(preview.MissingTags) == 0
+}
+
+// String returns a plain-text version of the preview.
+func (preview *BagPreview) String() (string) {
+	buffer := &bytes.Buffer{}
+	if preview.BucketName != "" {
+		fmt.Fprintf(buffer, "Bag %s/%s", preview.BucketName, preview.Key)
+	} else {
+		fmt.Fprintf(buffer, "Bag %s", preview.BagName)
+	}
+	if preview.IsRoughlyValid() {
+		fmt.Fprintf(buffer, " looks valid.\n")
+	} else {
+		fmt.Fprintf(buffer, " has problems.\n")
+	}
+	fmt.Fprintf(buffer, "\nTag files read: %s\n", strings.Join(preview.TagFiles, ", "))
+	fmt.Fprintf(buffer, "\nTags:\n")
+	for _, tag := range preview.Tags {
+		fmt.Fprintf(buffer, "  %s: %s\n", tag.Label, tag.Value)
+	}
+	if preview.PayloadOxum != "" {
+		fmt.Fprintf(buffer, "\nPayload-Oxum: %s (%s in %d files)\n", preview.PayloadOxum,
+			FormatBytes(preview.OxumByteCount), preview.OxumFileCount)
+	} else {
+		fmt.Fprintf(buffer, "\nPayload-Oxum: none\n")
+	}
+	if preview.ScannedAllHeaders {
+		fmt.Fprintf(buffer, "Payload in tar file: %s in %d files\n",
+			FormatBytes(preview.PayloadByteCount), preview.PayloadFileCount)
+	} else {
+		fmt.Fprintf(buffer, "Payload in tar file: not counted; the tag files came first\n")
+	}
+	if preview.Manifest != "" {
+		fmt.Fprintf(buffer, "\n%s lists %d files", preview.Manifest, preview.ManifestFileCount)
+		if len(preview.ManifestEntries) < preview.ManifestFileCount {
+			fmt.Fprintf(buffer, ". The first %d are", len(preview.ManifestEntries))
+		}
+		fmt.Fprintf(buffer, ":\n")
+		for _, entry := range preview.ManifestEntries {
+			fmt.Fprintf(buffer, "  %s\n", entry)
+		}
+	}
+	buffer.WriteString(reportSection("Missing tag files", preview.MissingTagFiles))
+	buffer.WriteString(reportSection("Missing or empty tags", preview.MissingTags))
+	buffer.WriteString(reportSection("Errors", preview.Errors))
+	buffer.WriteString(reportSection("Warnings", preview.Warnings))
+	if preview.RangeRequests > 0 {
+		fmt.Fprintf(buffer, "\nRead %s in %d range requests.\n",
+			FormatBytes(preview.BytesFetched), preview.RangeRequests)
+	}
+	return buffer.String()
+}
+
+// PreviewBag previews the tarred bag at bucketName/key, reading
+// only its tar headers, tag files and manifests through range
+// requests. It lists up to maxEntries manifest entries, or
+// DEFAULT_PREVIEW_MANIFEST_ENTRIES if maxEntries is less than 1.
+// Gzipped bags can't be skipped through, so previewing one reads
+// the bag from the start until it has the tag files it needs.
+func (client *S3Client) PreviewBag(bucketName, key string, maxEntries int) (*BagPreview, error) {
+	url, err := client.PresignGet(bucketName, key, PREVIEW_URL_EXPIRATION)
+	if err != nil {
+		return nil, err
+	}
+	reader := NewRangeReader(nil, url, DEFAULT_RANGE_CHUNK_SIZE)
+	preview, err := PreviewTar(reader, key, maxEntries)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot preview %s/%s: %v", bucketName, key, err)
+	}
+	preview.BucketName = bucketName
+	preview.Key = key
+	preview.RangeRequests = reader.Requests
+	preview.BytesFetched = reader.BytesFetched
+	return preview, nil
+}
+
+// PreviewTar previews the tarred bag in reader. It reads the tag
+// files and manifests, and only the headers of payload files. If
+// reader is an io.Seeker, such as a RangeReader or an os.File, the
+// tar reader seeks past payload file bodies instead of reading them.
+// If the required tag files all come before the first payload
+// file, it stops there. Param tarFileName is the name of the tar
+// file, which determines whether it's gzipped. It returns an error
+// only if it cannot read the tar file; problems with the bag are in
+// the preview.
+func PreviewTar(reader io.Reader, tarFileName string, maxEntries int) (*BagPreview, error) {
+	if maxEntries < 1 {
+		maxEntries = DEFAULT_PREVIEW_MANIFEST_ENTRIES
+	}
+	var tarStream io.Reader = reader
+	if IsGzippedTar(tarFileName) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decompress %s: %v", tarFileName, err)
+		}
+		defer gzipReader.Close()
+		tarStream = gzipReader
+	}
+	preview := &BagPreview{
+		Tags:            make([]Tag, 0),
+		TagFiles:        make([]string, 0),
+		ManifestEntries: make([]string, 0),
+		MissingTagFiles: make([]string, 0),
+		MissingTags:     make([]string, 0),
+		Errors:          make([]string, 0),
+		Warnings:        make([]string, 0),
+	}
+	contents := make(map[string][]byte)
+	tarReader := tar.NewReader(tarStream)
+	preview.ScannedAllHeaders = true
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		bagName, pathInBag := header.Name, ""
+		if slash := strings.Index(header.Name, "/"); slash > -1 {
+			bagName, pathInBag = header.Name[:slash], header.Name[slash+1:]
+		}
+		if preview.BagName == "" {
+			preview.BagName = bagName
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if IsPayloadPath(pathInBag) {
+			if hasRequiredTagFiles(contents) {
+				preview.ScannedAllHeaders = false
+				break
+			}
+			preview.PayloadFileCount++
+			preview.PayloadByteCount += header.Size
+			continue
+		}
+		if !IsManifestPath(pathInBag) && !stringInList(pathInBag, previewTagFiles) {
+			continue
+		}
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		contents[pathInBag] = data
+	}
+	for name := range contents {
+		preview.TagFiles = append(preview.TagFiles, name)
+	}
+	sort.Strings(preview.TagFiles)
+	preview.readTags(contents)
+	preview.readManifest(contents, maxEntries)
+	preview.checkRequiredTags(contents)
+	return preview, nil
+}
+
+// Returns true if contents has all of the required tag files,
+// and bag-info.txt, which may hold the Payload-Oxum.
+func hasRequiredTagFiles(contents map[string][]byte) (bool) {
+	for _, name := range append([]string{"bag-info.txt"}, requiredTagFiles...) {
+		if _, found := contents[name]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses the tag files, and the Payload-Oxum if there is one.
+func (preview *BagPreview) readTags(contents map[string][]byte) {
+	for _, name := range previewTagFiles {
+		data, found := contents[name]
+		if !found {
+			continue
+		}
+		tags, warnings, err := ParseTagFile(bytes.NewReader(data), name)
+		if err != nil {
+			preview.Errors = append(preview.Errors,
+				fmt.Sprintf("Error reading tags from %s: %v", name, err))
+			continue
+		}
+		preview.Tags = append(preview.Tags, tags...)
+		preview.Warnings = append(preview.Warnings, warnings...)
+	}
+	preview.PayloadOxum = preview.TagValue("Payload-Oxum")
+	if preview.PayloadOxum == "" {
+		return
+	}
+	byteCount, fileCount, err := ParsePayloadOxum(preview.PayloadOxum)
+	if err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+		return
+	}
+	preview.OxumByteCount, preview.OxumFileCount = byteCount, fileCount
+	if preview.ScannedAllHeaders && (byteCount != preview.PayloadByteCount ||
+		fileCount != preview.PayloadFileCount) {
+		preview.Errors = append(preview.Errors, fmt.Sprintf(
+			"Payload-Oxum says %d bytes in %d files, but the tar file has %d bytes in %d files",
+			byteCount, fileCount, preview.PayloadByteCount, preview.PayloadFileCount))
+	}
+}
+
+// Counts the entries in the payload manifest, preferring
+// manifest-md5.txt, and keeps the first maxEntries of them.
+func (preview *BagPreview) readManifest(contents map[string][]byte, maxEntries int) {
+	if _, found := contents["manifest-md5.txt"]; found {
+		preview.Manifest = "manifest-md5.txt"
+	} else {
+		for _, name := range preview.TagFiles {
+			if reManifest.MatchString(name) {
+				preview.Manifest = name
+				break
+			}
+		}
+	}
+	if preview.Manifest == "" {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents[preview.Manifest]))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		preview.ManifestFileCount++
+		if len(preview.ManifestEntries) < maxEntries {
+			preview.ManifestEntries = append(preview.ManifestEntries, line)
+		}
+	}
+	if preview.OxumFileCount > 0 && int64(preview.ManifestFileCount) != preview.OxumFileCount {
+		preview.Warnings = append(preview.Warnings, fmt.Sprintf(
+			"Payload-Oxum says %d files, but %s lists %d",
+			preview.OxumFileCount, preview.Manifest, preview.ManifestFileCount))
+	}
+}
+
+// Checks for the tag files and tags that ingest requires.
+func (preview *BagPreview) checkRequiredTags(contents map[string][]byte) {
+	for _, name := range requiredTagFiles {
+		if _, found := contents[name]; !found {
+			preview.MissingTagFiles = append(preview.MissingTagFiles, name)
+		}
+	}
+	if strings.TrimSpace(preview.TagValue("Title")) == "" {
+		preview.MissingTags = append(preview.MissingTags, "Title")
+	}
+	access := preview.TagValue("Access")
+	if access == "" {
+		access = preview.TagValue("Rights")
+	}
+	if strings.TrimSpace(access) == "" {
+		preview.MissingTags = append(preview.MissingTags, "Access")
+	} else if _, _, err := NormalizeAccess(access); err != nil {
+		preview.Errors = append(preview.Errors, fmt.Sprintf(
+			"In tag file, access (rights) value '%s' is not valid.",
+			strings.ToLower(strings.TrimSpace(access))))
+	}
+}
+
+// Returns true if list contains value.
+func stringInList(value string, list []string) (bool) {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package bagman_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+)
+
+// Returns a tarred bag with the tag files after a large payload,
+// so a preview has to scan all of the headers.
+func tagsLastTar(oxum string, withAPTrustInfo bool) ([]byte) {
+	tarData := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(tarData)
+	files := []struct{ name, data string }{
+		{"data/big.bin", strings.Repeat("x", 2*1024*1024)},
+		{"data/small.txt", "small"},
+		{"bagit.txt", "BagIt-Version: 0.97\nTag-File-Character-Encoding: UTF-8\n"},
+		{"bag-info.txt", fmt.Sprintf("Source-Organization: ncsu.edu\nPayload-Oxum: %s\n", oxum)},
+		{"manifest-md5.txt", "0123 data/big.bin\n4567 data/small.txt\n"},
+	}
+	if withAPTrustInfo {
+		files = append(files, struct{ name, data string }{
+			"aptrust-info.txt", "Title: Big Bag\nAccess: Consortia\n"})
+	}
+	for _, file := range files {
+		tarWriter.WriteHeader(&tar.Header{Name: "ncsu.edu.big_bag/" + file.name,
+			Mode: 0644, Size: int64(len(file.data))})
+		tarWriter.Write([]byte(file.data))
+	}
+	tarWriter.Close()
+	return tarData.Bytes()
+}
+
+func TestPreviewTarStopsAtPayload(t *testing.T) {
+	data := loadFixtureTar(t, "example.edu.sample_good.tar")
+	server := rangeServer(data)
+	defer server.Close()
+	reader := bagman.NewRangeReader(nil, server.URL, 1024)
+	preview, err := bagman.PreviewTar(reader, "example.edu.sample_good.tar", 2)
+	if err != nil {
+		t.Fatalf("PreviewTar returned error %v", err)
+	}
+	if preview.BagName != "example.edu.sample_good" {
+		t.Errorf("Expected bag name example.edu.sample_good, got %s", preview.BagName)
+	}
+	// The tag files come first, so the preview stops at the
+	// first payload file and never fetches the payload.
+	if preview.ScannedAllHeaders {
+		t.Errorf("Preview should have stopped at the first payload file")
+	}
+	if reader.BytesFetched > int64(len(data)/2) {
+		t.Errorf("Preview fetched %d of %d bytes", reader.BytesFetched, len(data))
+	}
+	if !preview.IsRoughlyValid() {
+		t.Errorf("Good bag should look valid: %s", preview.String())
+	}
+	if preview.TagValue("Title") == "" || preview.TagValue("Source-Organization") != "virginia.edu" {
+		t.Errorf("Preview is missing tags: %v", preview.Tags)
+	}
+	if preview.Manifest != "manifest-md5.txt" || preview.ManifestFileCount != 4 ||
+		len(preview.ManifestEntries) != 2 {
+		t.Errorf("Expected 2 of 4 entries from manifest-md5.txt, got %d of %d from %s",
+			len(preview.ManifestEntries), preview.ManifestFileCount, preview.Manifest)
+	}
+	if !strings.Contains(preview.String(), "The first 2 are") {
+		t.Errorf("Preview text should say it lists only the first 2 entries")
+	}
+}
+
+func TestPreviewTarScansHeaders(t *testing.T) {
+	data := tagsLastTar("2097157.2", true)
+	server := rangeServer(data)
+	defer server.Close()
+	reader := bagman.NewRangeReader(nil, server.URL, 4096)
+	preview, err := bagman.PreviewTar(reader, "ncsu.edu.big_bag.tar", 0)
+	if err != nil {
+		t.Fatalf("PreviewTar returned error %v", err)
+	}
+	if !preview.ScannedAllHeaders || preview.PayloadFileCount != 2 ||
+		preview.PayloadByteCount != 2097157 {
+		t.Errorf("Expected all headers with 2 files and 2097157 bytes, got %t, %d, %d",
+			preview.ScannedAllHeaders, preview.PayloadFileCount, preview.PayloadByteCount)
+	}
+	if preview.OxumByteCount != 2097157 || preview.OxumFileCount != 2 {
+		t.Errorf("Wrong Payload-Oxum counts: %d, %d", preview.OxumByteCount, preview.OxumFileCount)
+	}
+	if !preview.IsRoughlyValid() {
+		t.Errorf("Bag should look valid: %s", preview.String())
+	}
+	if reader.BytesFetched > 64*1024 {
+		t.Errorf("Preview fetched %d bytes; it should skip the payload", reader.BytesFetched)
+	}
+
+	// Payload-Oxum that doesn't match, and no aptrust-info.txt.
+	preview, err = bagman.PreviewTar(bytes.NewReader(tagsLastTar("100.2", false)),
+		"ncsu.edu.big_bag.tar", 0)
+	if err != nil {
+		t.Fatalf("PreviewTar returned error %v", err)
+	}
+	if preview.IsRoughlyValid() {
+		t.Errorf("Bag with bad Payload-Oxum and no aptrust-info.txt should not look valid")
+	}
+	if len(preview.Errors) != 1 || !strings.Contains(preview.Errors[0], "Payload-Oxum says 100 bytes") {
+		t.Errorf("Expected a Payload-Oxum error, got %v", preview.Errors)
+	}
+	if len(preview.MissingTagFiles) != 1 || preview.MissingTagFiles[0] != "aptrust-info.txt" {
+		t.Errorf("Expected aptrust-info.txt to be missing, got %v", preview.MissingTagFiles)
+	}
+	if len(preview.MissingTags) != 2 {
+		t.Errorf("Expected Title and Access to be missing, got %v", preview.MissingTags)
+	}
+
+	if _, err = bagman.PreviewTar(strings.NewReader("not a tar file"), "bad.tar", 0); err == nil {
+		t.Errorf("PreviewTar should reject a file that isn't a tar file")
+	}
+}
+
+func TestPreviewTarGzipped(t *testing.T) {
+	for _, name := range []string{"ncsu.edu.big_bag.tar.gz", "ncsu.edu.big_bag.tgz"} {
+		gzipped := &bytes.Buffer{}
+		gzipWriter := gzip.NewWriter(gzipped)
+		gzipWriter.Write(tagsLastTar("2097157.2", true))
+		gzipWriter.Close()
+		preview, err := bagman.PreviewTar(bytes.NewReader(gzipped.Bytes()), name, 0)
+		if err != nil {
+			t.Fatalf("PreviewTar(%s) returned error %v", name, err)
+		}
+		if preview.BagName != "ncsu.edu.big_bag" || !preview.ScannedAllHeaders ||
+			preview.PayloadFileCount != 2 || preview.PayloadByteCount != 2097157 {
+			t.Errorf("%s: expected 2 files and 2097157 bytes in ncsu.edu.big_bag, "+
+				"got %d and %d in %s", name, preview.PayloadFileCount,
+				preview.PayloadByteCount, preview.BagName)
+		}
+		if !preview.IsRoughlyValid() {
+			t.Errorf("%s should look valid: %s", name, preview.String())
+		}
+	}
+	_, err := bagman.PreviewTar(bytes.NewReader(tagsLastTar("2097157.2", true)),
+		"ncsu.edu.big_bag.tar.gz", 0)
+	if err == nil {
+		t.Errorf("PreviewTar should reject a .tar.gz file that isn't gzipped")
+	}
+}
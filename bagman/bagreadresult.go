@@ -1,6 +1,7 @@
 package bagman
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -8,12 +9,84 @@ import (
 // processing a single bag. If there were any processing
 // errors, this structure should tell us exactly what
 // happened and where.
+//
+// ManifestFiles and ManifestSha256Files map each payload path to
+// its checksum, exactly as they appear in manifest-md5.txt and
+// manifest-sha256.txt. Either map is empty if the bag does not
+// have that manifest.
 type BagReadResult struct {
-	Path           string
-	Files          []string
-	ErrorMessage   string
-	Tags           []Tag
-	ChecksumErrors []error
+	Path                string
+	Files               []string
+	ManifestFiles       map[string]string
+	ManifestSha256Files map[string]string
+	ErrorMessage        string
+	Tags                []Tag
+	ChecksumErrors      []error
+	Warnings            []string
+}
+
+// ManifestPaths returns the sorted paths of all files listed in
+// the bag's payload manifests.
+func (result *BagReadResult) ManifestPaths() ([]string) {
+	paths := make([]string, 0, len(result.ManifestFiles))
+	for filePath := range result.ManifestFiles {
+		paths = append(paths, filePath)
+	}
+	for filePath := range result.ManifestSha256Files {
+		if _, inMd5Manifest := result.ManifestFiles[filePath]; !inMd5Manifest {
+			paths = append(paths, filePath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// StoredChecksumMismatches compares the checksums of files we stored
+// in S3 with the checksums in the bag's manifests. It uses the md5
+// S3 verified when we stored each file and the sha256 we saved in the
+// object's metadata, so it does not have to re-read the bag files.
+// Files that have not been stored, and files that are not in a
+// manifest, are skipped.
+func (result *BagReadResult) StoredChecksumMismatches(files []*File) ([]*ChecksumMismatch) {
+	md5s := normalizedManifest(result.ManifestFiles)
+	sha256s := normalizedManifest(result.ManifestSha256Files)
+	mismatches := make([]*ChecksumMismatch, 0)
+	for _, file := range files {
+		if file.StorageURL == "" {
+			continue
+		}
+		filePath, _ := NormalizeBagPath(file.Path)
+		expected, listed := md5s[filePath]
+		if listed && !strings.EqualFold(expected, file.StorageMd5) {
+			mismatches = append(mismatches, &ChecksumMismatch{
+				Path:      file.Path,
+				Algorithm: "md5",
+				Expected:  expected,
+				Actual:    file.StorageMd5,
+			})
+		}
+		expected, listed = sha256s[filePath]
+		if listed && !strings.EqualFold(expected, file.Sha256) {
+			mismatches = append(mismatches, &ChecksumMismatch{
+				Path:      file.Path,
+				Algorithm: "sha256",
+				Expected:  expected,
+				Actual:    file.Sha256,
+			})
+		}
+	}
+	return mismatches
+}
+
+// Returns a copy of the manifest with normalized paths, so they
+// match the paths of files unpacked from the tar file.
+func normalizedManifest(manifest map[string]string) (map[string]string) {
+	normalized := make(map[string]string, len(manifest))
+	for filePath, checksum := range manifest {
+		normalizedPath, _ := NormalizeBagPath(filePath)
+		normalized[normalizedPath] = checksum
+	}
+	return normalized
 }
 
 // TagValue returns the value of the tag with the specified label.
@@ -27,3 +100,45 @@ func (result *BagReadResult) TagValue(tagLabel string) (tagValue string) {
 	}
 	return tagValue
 }
+
+// AltIdentifierTags are the labels of bag-info.txt tags whose values
+// become alternate identifiers of the IntellectualObject. Both may
+// be repeated.
+var AltIdentifierTags = []string{
+	"Internal-Sender-Identifier",
+	"External-Identifier",
+}
+
+// AltIdentifiers returns the values of the tags in AltIdentifierTags,
+// in the order they appear in the bag, without blanks or duplicates.
+func (result *BagReadResult) AltIdentifiers() ([]string) {
+	recognized := make(map[string]bool, len(AltIdentifierTags))
+	for _, label := range AltIdentifierTags {
+		recognized[strings.ToLower(label)] = true
+	}
+	altIds := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, tag := range result.Tags {
+		value := strings.TrimSpace(tag.Value)
+		if !recognized[strings.ToLower(tag.Label)] || value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		altIds = append(altIds, value)
+	}
+	return altIds
+}
+
+// TagValueFromFile returns the value of the tag with the specified
+// label, looking only at tags that came from the specified tag file,
+// such as "aptrust-info.txt".
+func (result *BagReadResult) TagValueFromFile(tagLabel, fileName string) (tagValue string) {
+	lcTagLabel := strings.ToLower(tagLabel)
+	for _, tag := range result.Tags {
+		if tag.SourceFile == fileName && strings.ToLower(tag.Label) == lcTagLabel {
+			tagValue = tag.Value
+			break
+		}
+	}
+	return tagValue
+}
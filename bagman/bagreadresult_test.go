@@ -24,3 +24,100 @@ func TestTagValue(t *testing.T) {
 		t.Error("TagValue returned wrong result.")
 	}
 }
+
+func TestTagValueFromFile(t *testing.T) {
+	result := &bagman.BagReadResult{}
+	result.Tags = []bagman.Tag{
+		bagman.Tag{Label: "Title", Value: "Bag Info Title", SourceFile: "bag-info.txt"},
+		bagman.Tag{Label: "Title", Value: "APTrust Title", SourceFile: "aptrust-info.txt"},
+		bagman.Tag{Label: "Access", Value: "Institution", SourceFile: "aptrust-info.txt"},
+	}
+	if result.TagValueFromFile("TITLE", "aptrust-info.txt") != "APTrust Title" {
+		t.Error("TagValueFromFile returned wrong result.")
+	}
+	if result.TagValueFromFile("title", "bag-info.txt") != "Bag Info Title" {
+		t.Error("TagValueFromFile returned wrong result.")
+	}
+	if result.TagValueFromFile("Access", "bag-info.txt") != "" {
+		t.Error("TagValueFromFile returned a tag from the wrong file.")
+	}
+	if result.TagValue("Title") != "Bag Info Title" {
+		t.Error("TagValue should still return the first matching tag.")
+	}
+}
+
+func TestManifestPaths(t *testing.T) {
+	result := &bagman.BagReadResult{
+		ManifestFiles: map[string]string{
+			"data/b.txt": "md5-b",
+			"data/a.txt": "md5-a",
+		},
+		ManifestSha256Files: map[string]string{
+			"data/a.txt": "sha256-a",
+			"data/c.txt": "sha256-c",
+		},
+	}
+	paths := result.ManifestPaths()
+	expected := []string{"data/a.txt", "data/b.txt", "data/c.txt"}
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected paths %v, got %v", expected, paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected paths %v, got %v", expected, paths)
+			break
+		}
+	}
+	if len((&bagman.BagReadResult{}).ManifestPaths()) != 0 {
+		t.Errorf("ManifestPaths should be empty when there are no manifests")
+	}
+}
+
+func TestStoredChecksumMismatches(t *testing.T) {
+	result := &bagman.BagReadResult{
+		ManifestFiles: map[string]string{
+			"data/good.txt":  "44d85cf4810d6c6fe87750117633e461",
+			"data/bad.txt":   "93e381dfa9ad0086dbe3b92e0324bae6",
+			"data/unstored":  "ff731b9a1758618f6cc22538dede6174",
+		},
+		ManifestSha256Files: map[string]string{
+			"data/good.txt": "248fac506a5c46b3c760312b99827b6fb5df4698d6cf9a9cdc4c54746728ab99",
+			"data/bad.txt":  "cf9cbce06ae9a2e1e1b4cf2e0f1a5cd0ea1f6d4e3a7af4e8e4d3b1b4fbd09b3e",
+		},
+	}
+	files := []*bagman.File{
+		&bagman.File{
+			Path:       "data/good.txt",
+			StorageURL: "https://s3.amazonaws.com/aptrust.preservation.storage/1",
+			StorageMd5: "44D85CF4810D6C6FE87750117633E461",
+			Sha256:     "248fac506a5c46b3c760312b99827b6fb5df4698d6cf9a9cdc4c54746728ab99",
+		},
+		&bagman.File{
+			Path:       "data/bad.txt",
+			StorageURL: "https://s3.amazonaws.com/aptrust.preservation.storage/2",
+			StorageMd5: "00000000000000000000000000000000",
+			Sha256:     "0000",
+		},
+		&bagman.File{
+			Path:       "data/unstored",
+			StorageMd5: "00000000000000000000000000000000",
+		},
+		&bagman.File{
+			Path:       "data/not_in_manifest.txt",
+			StorageURL: "https://s3.amazonaws.com/aptrust.preservation.storage/3",
+			StorageMd5: "00000000000000000000000000000000",
+		},
+	}
+	mismatches := result.StoredChecksumMismatches(files)
+	if len(mismatches) != 2 {
+		t.Fatalf("Expected 2 mismatches, got %d", len(mismatches))
+	}
+	if mismatches[0].Path != "data/bad.txt" || mismatches[0].Algorithm != "md5" ||
+		mismatches[0].Expected != "93e381dfa9ad0086dbe3b92e0324bae6" {
+		t.Errorf("Wrong md5 mismatch: %+v", mismatches[0])
+	}
+	if mismatches[1].Path != "data/bad.txt" || mismatches[1].Algorithm != "sha256" ||
+		mismatches[1].Actual != "0000" {
+		t.Errorf("Wrong sha256 mismatch: %+v", mismatches[1])
+	}
+}
@@ -1,6 +1,7 @@
 package bagman
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -8,14 +9,24 @@ import (
 ChecksumAttribute contains information about a checksum that
 can be used to validate the integrity of a GenericFile.
 
-DateTime should be in ISO8601 format for local time or UTC.
+Fluctus accepts DateTime in ISO8601 format for local time or UTC.
 For example:
 
 1994-11-05T08:15:30-05:00     (Local Time)
 1994-11-05T08:15:30Z          (UTC)
+
+We always send UTC.
 */
 type ChecksumAttribute struct {
 	Algorithm string    `json:"algorithm"`
 	DateTime  time.Time `json:"datetime"`
 	Digest    string    `json:"digest"`
 }
+
+// MarshalJSON writes DateTime in UTC.
+func (checksum *ChecksumAttribute) MarshalJSON() ([]byte, error) {
+	type checksumAttributeJson ChecksumAttribute // without this method
+	attr := checksumAttributeJson(*checksum)
+	attr.DateTime = attr.DateTime.UTC()
+	return json.Marshal(attr)
+}
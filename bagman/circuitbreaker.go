@@ -0,0 +1,173 @@
+package bagman
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerState describes whether a CircuitBreaker is letting
+// requests through.
+type BreakerState string
+
+const (
+	// Requests go through as usual.
+	BreakerClosed   BreakerState = "closed"
+	// Requests fail right away, until the cooldown is over.
+	BreakerOpen                  = "open"
+	// The cooldown is over. One trial request goes through,
+	// and the others fail right away until we know whether
+	// the service has recovered.
+	BreakerHalfOpen              = "half-open"
+)
+
+// Defaults for the Fluctus client's circuit breaker.
+const DEFAULT_FLUCTUS_BREAKER_THRESHOLD = 5
+const DEFAULT_FLUCTUS_BREAKER_COOLDOWN = 30 * time.Second
+
+/*
+CircuitBreaker stops us from sending requests to a service that is
+down. After threshold consecutive failures, the breaker opens, and
+Allow returns a *CircuitOpenError without a request being sent. Once
+the cooldown is over, the breaker is half-open: it lets one request
+through to see whether the service has recovered. If that request
+succeeds, the breaker closes; if it fails, the breaker opens for
+another cooldown. It's safe to use across go routines.
+*/
+type CircuitBreaker struct {
+	name          string
+	threshold     int
+	cooldown      time.Duration
+	state         BreakerState
+	failures      int
+	openedAt      time.Time
+	trialInFlight bool
+	mutex         *sync.Mutex
+}
+
+// BreakerStatus is a snapshot of a CircuitBreaker's state,
+// for monitoring.
+type BreakerStatus struct {
+	State               BreakerState
+	ConsecutiveFailures int
+	// When the breaker last opened. Zero if it never has.
+	OpenedAt            time.Time
+}
+
+func (status BreakerStatus) String() (string) {
+	if status.State == BreakerClosed {
+		return fmt.Sprintf("%s, %d consecutive failures", status.State,
+			status.ConsecutiveFailures)
+	}
+	return fmt.Sprintf("%s since %s, %d consecutive failures", status.State,
+		status.OpenedAt.Format(time.RFC3339), status.ConsecutiveFailures)
+}
+
+// CircuitOpenError is returned by CircuitBreaker.Allow when the
+// breaker is not letting requests through.
+type CircuitOpenError struct {
+	Name     string
+	Failures int
+	RetryAt  time.Time
+}
+
+func (err *CircuitOpenError) Error() (string) {
+	return fmt.Sprintf("Not sending request: %s circuit breaker is open after %d "+
+		"consecutive failures. Next trial request after %s.", err.Name, err.Failures,
+		err.RetryAt.Format(time.RFC3339))
+}
+
+// Returns true if err is a CircuitOpenError.
+func IsCircuitOpen(err error) (bool) {
+	_, isOpen := err.(*CircuitOpenError)
+	return isOpen
+}
+
+// Creates a new, closed CircuitBreaker. Param name identifies the
+// service in error messages. The breaker opens after threshold
+// consecutive failures, and stays open for cooldown. Values less
+// than one mean use the Fluctus defaults.
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) (*CircuitBreaker) {
+	if threshold < 1 {
+		threshold = DEFAULT_FLUCTUS_BREAKER_THRESHOLD
+	}
+	if cooldown <= 0 {
+		cooldown = DEFAULT_FLUCTUS_BREAKER_COOLDOWN
+	}
+	return &CircuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Allow returns nil if a request may go through, or a
+// *CircuitOpenError if not. Each request that goes through must
+// be followed by a call to RecordSuccess or RecordFailure.
+func (breaker *CircuitBreaker) Allow() (error) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.state == BreakerOpen && time.Since(breaker.openedAt) >= breaker.cooldown {
+		breaker.state = BreakerHalfOpen
+		breaker.trialInFlight = false
+	}
+	if breaker.state == BreakerClosed {
+		return nil
+	}
+	if breaker.state == BreakerHalfOpen && !breaker.trialInFlight {
+		breaker.trialInFlight = true
+		return nil
+	}
+	return &CircuitOpenError{
+		Name:     breaker.name,
+		Failures: breaker.failures,
+		RetryAt:  breaker.openedAt.Add(breaker.cooldown),
+	}
+}
+
+// RecordSuccess closes the breaker and resets the failure count.
+// Returns true if the breaker was not already closed.
+func (breaker *CircuitBreaker) RecordSuccess() (closed bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	closed = breaker.state != BreakerClosed
+	breaker.state = BreakerClosed
+	breaker.failures = 0
+	breaker.trialInFlight = false
+	return closed
+}
+
+// RecordFailure counts a failed request, and opens the breaker if
+// that makes threshold failures in a row, or if the failed request
+// was the half-open breaker's trial. Returns true if this opened
+// the breaker.
+func (breaker *CircuitBreaker) RecordFailure() (opened bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.failures++
+	if breaker.state == BreakerHalfOpen ||
+		(breaker.state == BreakerClosed && breaker.failures >= breaker.threshold) {
+		breaker.state = BreakerOpen
+		breaker.openedAt = time.Now()
+		breaker.trialInFlight = false
+		return true
+	}
+	return false
+}
+
+// Status returns the breaker's current state.
+func (breaker *CircuitBreaker) Status() (BreakerStatus) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	state := breaker.state
+	if state == BreakerOpen && time.Since(breaker.openedAt) >= breaker.cooldown {
+		state = BreakerHalfOpen
+	}
+	return BreakerStatus{
+		State:               state,
+		ConsecutiveFailures: breaker.failures,
+		OpenedAt:            breaker.openedAt,
+	}
+}
@@ -0,0 +1,93 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	breaker := bagman.NewCircuitBreaker("Fluctus", 3, 20*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := breaker.Allow(); err != nil {
+			t.Fatalf("Closed breaker should allow requests, got %v", err)
+		}
+		if breaker.RecordFailure() {
+			t.Errorf("Breaker opened after only %d failures", i+1)
+		}
+	}
+	// A success resets the count.
+	breaker.RecordSuccess()
+	if status := breaker.Status(); status.State != bagman.BreakerClosed || status.ConsecutiveFailures != 0 {
+		t.Errorf("Success should reset the breaker, got %s", status)
+	}
+
+	for i := 0; i < 3; i++ {
+		breaker.Allow()
+		breaker.RecordFailure()
+	}
+	status := breaker.Status()
+	if status.State != bagman.BreakerOpen || status.ConsecutiveFailures != 3 {
+		t.Fatalf("Breaker should be open after 3 failures, got %s", status)
+	}
+	err := breaker.Allow()
+	if !bagman.IsCircuitOpen(err) {
+		t.Fatalf("Open breaker should fail fast, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Fluctus circuit breaker is open after 3 consecutive failures") {
+		t.Errorf("Unexpected error message: %s", err.Error())
+	}
+
+	// After the cooldown, one trial request goes through.
+	time.Sleep(25 * time.Millisecond)
+	if state := breaker.Status().State; state != bagman.BreakerHalfOpen {
+		t.Errorf("Breaker should be half-open after the cooldown, got %s", state)
+	}
+	if err = breaker.Allow(); err != nil {
+		t.Fatalf("Half-open breaker should allow a trial request, got %v", err)
+	}
+	if err = breaker.Allow(); !bagman.IsCircuitOpen(err) {
+		t.Errorf("Half-open breaker should allow only one trial request, got %v", err)
+	}
+
+	// The trial fails, so the breaker opens again right away.
+	if !breaker.RecordFailure() {
+		t.Errorf("Failed trial should reopen the breaker")
+	}
+	if err = breaker.Allow(); !bagman.IsCircuitOpen(err) {
+		t.Errorf("Breaker should be open after the failed trial, got %v", err)
+	}
+
+	// The next trial succeeds, and the breaker closes.
+	time.Sleep(25 * time.Millisecond)
+	if err = breaker.Allow(); err != nil {
+		t.Fatalf("Half-open breaker should allow a trial request, got %v", err)
+	}
+	if !breaker.RecordSuccess() {
+		t.Errorf("Successful trial should close the breaker")
+	}
+	if err = breaker.Allow(); err != nil {
+		t.Errorf("Closed breaker should allow requests, got %v", err)
+	}
+}
+
+func TestNewCircuitBreakerDefaults(t *testing.T) {
+	breaker := bagman.NewCircuitBreaker("Fluctus", 0, 0)
+	for i := 0; i < bagman.DEFAULT_FLUCTUS_BREAKER_THRESHOLD-1; i++ {
+		breaker.RecordFailure()
+	}
+	if breaker.Status().State != bagman.BreakerClosed {
+		t.Errorf("Breaker opened before the default threshold")
+	}
+	breaker.RecordFailure()
+	err := breaker.Allow()
+	openError, ok := err.(*bagman.CircuitOpenError)
+	if !ok {
+		t.Fatalf("Breaker should open at the default threshold, got %v", err)
+	}
+	cooldown := openError.RetryAt.Sub(breaker.Status().OpenedAt)
+	if cooldown != bagman.DEFAULT_FLUCTUS_BREAKER_COOLDOWN {
+		t.Errorf("Expected the default cooldown, got %s", cooldown)
+	}
+}
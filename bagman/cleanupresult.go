@@ -0,0 +1,41 @@
+package bagman
+
+import (
+	"time"
+)
+
+// CleanupFile describes a file we deleted, or tried to delete,
+// after ingesting a bag.
+type CleanupFile struct {
+	BucketName   string
+	Key          string
+	// ErrorMessage is empty if the file was deleted.
+	ErrorMessage string
+	DeletedAt    time.Time
+}
+
+// Succeeded returns true if the file was deleted.
+func (file *CleanupFile) Succeeded() (bool) {
+	return file.ErrorMessage == "" && !file.DeletedAt.IsZero()
+}
+
+// CleanupResult describes the files deleted after ingest of a bag:
+// the tar file in the receiving bucket, and any other files we no
+// longer need. Use LoadCleanupResult to read one from JSON.
+type CleanupResult struct {
+	BagName          string
+	ETag             string
+	BagDate          time.Time
+	ObjectIdentifier string
+	Files            []*CleanupFile
+}
+
+// Succeeded returns true if all of the files were deleted.
+func (result *CleanupResult) Succeeded() (bool) {
+	for _, file := range result.Files {
+		if !file.Succeeded() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadCleanupResult(t *testing.T) {
+	result, err := bagman.LoadCleanupResult(filepath.Join("testdata", "cleanup_result.json"))
+	if err != nil {
+		t.Fatalf("LoadCleanupResult returned error %v", err)
+	}
+	if result.BagName != "test_bag" || result.ETag != "12345" ||
+		result.ObjectIdentifier != "aptrust.org/test_bag" {
+		t.Errorf("Cleanup result has wrong bag name, etag or identifier: %s, %s, %s",
+			result.BagName, result.ETag, result.ObjectIdentifier)
+	}
+	expectedDate := time.Date(2014, 6, 4, 15, 19, 21, 0, time.UTC)
+	if !result.BagDate.Equal(expectedDate) {
+		t.Errorf("Expected BagDate %v, got %v", expectedDate, result.BagDate)
+	}
+	if len(result.Files) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(result.Files))
+	}
+	if result.Files[0].BucketName != "aptrust.receiving.aptrust.org" ||
+		result.Files[0].Key != "test_bag.tar" {
+		t.Errorf("First file is wrong: %s/%s", result.Files[0].BucketName, result.Files[0].Key)
+	}
+	if !result.Succeeded() {
+		t.Errorf("All files in the fixture were deleted")
+	}
+
+	result.Files[1].ErrorMessage = "Access denied"
+	if result.Succeeded() || result.Files[1].Succeeded() {
+		t.Errorf("Cleanup with a failed delete should not succeed")
+	}
+
+	if _, err = bagman.LoadCleanupResult(filepath.Join("testdata", "no_such_file.json")); err == nil {
+		t.Errorf("LoadCleanupResult should fail for a missing file")
+	}
+}
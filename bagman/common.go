@@ -11,6 +11,11 @@ import (
 // the .tar suffix, you'll have a name like "my_bag.b04.of12"
 var MultipartSuffix = regexp.MustCompile("\\.b\\d+\\.of\\d+$")
 
+// System files that Mac and Windows leave behind when depositors
+// build bags. Config.JunkFilePatterns overrides this list. AppleDouble
+// files (._*) are never ingested; see HasSavableName.
+var DefaultJunkFilePatterns = []string{".DS_Store", "Thumbs.db", "__MACOSX"}
+
 const (
 	APTrustNamespace        = "urn:mace:aptrust.org"
 	ReceiveBucketPrefix     = "aptrust.receiving."
@@ -50,6 +55,49 @@ const (
 	StageResolve             = "Resolve"
 )
 
+// Outcome enumerations describe how processing of an item turned
+// out. Items that are still in process have no outcome (""). Use
+// ProcessStatus.OutcomeDetails for prose.
+type OutcomeType string
+
+const (
+	OutcomeSuccess        OutcomeType = "Success"
+	OutcomeFailure                    = "Failure"
+	OutcomePartialSuccess             = "PartialSuccess"
+	OutcomeCancelled                  = "Cancelled"
+	OutcomeSkipped                    = "Skipped"
+	// OutcomeLegacy is for records Fluctus created before outcomes
+	// were limited to the values above. We don't set it ourselves.
+	OutcomeLegacy                     = "Legacy"
+)
+
+// Returns true if outcome is one of the Outcome enumerations,
+// or empty.
+func (outcome OutcomeType) IsValid() (bool) {
+	switch outcome {
+	case "", OutcomeSuccess, OutcomeFailure, OutcomePartialSuccess,
+		OutcomeCancelled, OutcomeSkipped, OutcomeLegacy:
+		return true
+	}
+	return false
+}
+
+// Returns the outcome that goes with a final status: OutcomeSuccess
+// for StatusSuccess, OutcomeFailure for StatusFailed, and
+// OutcomeCancelled for StatusCancelled. Items that are started or
+// pending have no outcome yet.
+func OutcomeForStatus(status StatusType) (OutcomeType) {
+	switch status {
+	case StatusSuccess:
+		return OutcomeSuccess
+	case StatusFailed:
+		return OutcomeFailure
+	case StatusCancelled:
+		return OutcomeCancelled
+	}
+	return ""
+}
+
 // Action enumerations match values defined in
 // https://github.com/APTrust/fluctus/blob/develop/config/application.rb
 type ActionType string
@@ -62,6 +110,14 @@ const (
 	ActionDPN                    = "DPN"
 )
 
+// GenericFile states. Fluctus marks deleted files with state D
+// rather than removing them, so a file can be undeleted while its
+// preservation copy is still in quarantine.
+const (
+	StateActive  = "A"
+	StateDeleted = "D"
+)
+
 
 // List of valid APTrust IntellectualObject AccessRights.
 var AccessRights []string = []string{
@@ -78,4 +134,6 @@ var EventTypes []string = []string{
 	"identifier_assignment",
 	"quarentine",
 	"delete_action",
+	"migration",
+	"replication",
 }
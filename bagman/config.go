@@ -3,12 +3,24 @@ package bagman
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/crowdmob/goamz/aws"
 	"github.com/op/go-logging"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type WorkerConfig struct {
+	// The maximum number of items the worker may record in
+	// Fluctus at the same time. Each item takes many sequential
+	// calls to Fluctus, and too many items at once can overwhelm
+	// it, so this is separate from Workers. If zero, the worker
+	// records as many items at once as it has Workers. Only
+	// apt_record uses this.
+	FluctusConnections int
+
 	// This describes how often the NSQ client should ping
 	// the NSQ server to let it know it's still there. The
 	// setting must be formatted like so:
@@ -76,11 +88,211 @@ type WorkerConfig struct {
 	WriteTimeout       string
 }
 
+// Returns the maximum number of items the worker may record in
+// Fluctus at the same time.
+func (workerConfig *WorkerConfig) FluctusConnectionLimit() (int) {
+	if workerConfig.FluctusConnections > 0 {
+		return workerConfig.FluctusConnections
+	}
+	return workerConfig.Workers
+}
+
+// S3ClientConfig describes how the S3 client should manage its
+// connections to S3. The timeout settings use the same format
+// as WorkerConfig.HeartbeatInterval. Leave any setting empty
+// or zero to use the default.
+type S3ClientConfig struct {
+	// The maximum number of idle connections the client will
+	// keep open to each S3 host. Under high concurrency, the
+	// default of 2 causes connections to be opened and closed
+	// constantly, which can exhaust the available sockets.
+	MaxIdleConnsPerHost   int
+
+	// How long to wait for a connection to S3 to be established.
+	DialTimeout           string
+
+	// How long to wait for S3 to send response headers after
+	// we've finished sending the request. This does not limit
+	// the time it takes to read the response body.
+	ResponseHeaderTimeout string
+
+	// The maximum time a single get, put, head, delete or list
+	// operation may take. For get, this is the time it takes to
+	// open the stream, not the time to read all of it. For put,
+	// this covers the entire upload of files smaller than
+	// S3_LARGE_FILE, so it must allow time to send the largest of
+	// those. Operations that exceed this return an S3TimeoutError,
+	// which the fetch and store stages treat as retryable.
+	OperationTimeout      string
+}
+
+// NewTransport returns an http.Transport configured with the
+// connection pool and timeout settings in S3ClientConfig.
+func (s3Config *S3ClientConfig) NewTransport() (*http.Transport, error) {
+	dialTimeout, err := parseOptionalDuration("DialTimeout", s3Config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	responseHeaderTimeout, err := parseOptionalDuration("ResponseHeaderTimeout",
+		s3Config.ResponseHeaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  dialer.Dial,
+		MaxIdleConnsPerHost:   s3Config.MaxIdleConnsPerHost,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+	return transport, nil
+}
+
+// Returns the DialTimeout as a time.Duration.
+func (s3Config *S3ClientConfig) DialTimeoutDuration() (time.Duration, error) {
+	return parseOptionalDuration("DialTimeout", s3Config.DialTimeout)
+}
+
+// Returns the OperationTimeout as a time.Duration.
+func (s3Config *S3ClientConfig) OperationTimeoutDuration() (time.Duration, error) {
+	return parseOptionalDuration("OperationTimeout", s3Config.OperationTimeout)
+}
+
+// Parses a duration string like "10s" from the config file.
+// Returns zero if the string is empty.
+func parseOptionalDuration(settingName, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value '%s' for %s: %v", value, settingName, err)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("Invalid value '%s' for %s: duration cannot be negative",
+			value, settingName)
+	}
+	return duration, nil
+}
+
+// StageTimeouts maps ingest stages to NSQ message timeouts.
+// In the config file, the timeouts are duration strings like
+// "90m", as with the other durations in the config.
+type StageTimeouts map[StageType]time.Duration
+
+func (timeouts *StageTimeouts) UnmarshalJSON(data []byte) (error) {
+	values := make(map[StageType]string)
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*timeouts = make(StageTimeouts, len(values))
+	for stage, value := range values {
+		duration, err := parseOptionalDuration(
+			fmt.Sprintf("StageMsgTimeout[%s]", stage), value)
+		if err != nil {
+			return err
+		}
+		(*timeouts)[stage] = duration
+	}
+	return nil
+}
+
+// Returns the longest timeout, or zero if there are none.
+func (timeouts StageTimeouts) Max() (time.Duration) {
+	var max time.Duration
+	for _, timeout := range timeouts {
+		if timeout > max {
+			max = timeout
+		}
+	}
+	return max
+}
+
+// EncryptionConfig describes client-side encryption for one
+// institution's preservation files. See encryption.go.
+type EncryptionConfig struct {
+	// Identifies the institution's key pair. This is recorded
+	// with each encrypted file, so use a new id when the
+	// institution gives us a new key.
+	KeyId          string
+
+	// PEM file containing the RSA public key we use to wrap
+	// data keys. If this is empty, we use the public half of
+	// PrivateKeyFile.
+	PublicKeyFile  string
+
+	// PEM file containing the matching private key. The restore
+	// worker needs this to decrypt files, and so does the fixity
+	// worker in FIXITY_MODE_DECRYPT. Leave it empty on hosts that
+	// should only be able to encrypt.
+	PrivateKeyFile string
+
+	// How the fixity worker checks this institution's encrypted
+	// files:
+	//
+	// "ciphertext" (the default) checks the sha256 digest of the
+	// encrypted file against the digest we calculated when we
+	// stored it. This shows the stored bytes have not changed,
+	// without needing the private key.
+	//
+	// "decrypt" decrypts the file as it streams from S3 and checks
+	// the plaintext against the sha256 digest in Fedora. This
+	// requires PrivateKeyFile.
+	//
+	// "skip" does not check the file at all.
+	FixityMode     string
+}
+
+// ActivityDigestConfig describes the daily activity digest that
+// apt_activity_digest sends to each institution. See
+// activitydigest.go.
+type ActivityDigestConfig struct {
+	// Email addresses that get each institution's digest, keyed
+	// by institution identifier (e.g. "virginia.edu"). We don't
+	// send digests to institutions not listed here.
+	Recipients  map[string][]string
+
+	// The SMTP server's host and port, e.g. "localhost:25". If
+	// the environment variables SMTP_USER and SMTP_PASSWORD are
+	// set, we log in with them.
+	SMTPServer  string
+
+	// The address digests come from.
+	FromAddress string
+
+	// If WebhookURL is set, we post digests there as JSON instead
+	// of sending email.
+	WebhookURL  string
+
+	// AttachJson attaches each digest as JSON, for partners who
+	// want to process it with a script.
+	AttachJson  bool
+
+	// StateFile records the newest item each institution's last
+	// digest covered, so the next digest doesn't repeat it.
+	StateFile   string
+}
+
 type Config struct {
+	// ActionTopics maps bag actions (Ingest, Restore, Delete and
+	// Fixity Check) to the NSQ topics that work for those actions
+	// goes to. Actions not listed here use the NsqTopic of the
+	// worker that handles them: PrepareWorker, RestoreWorker,
+	// FileDeleteWorker and FixityWorker. LoadRequestedConfig
+	// copies these topics into those workers, so they listen
+	// where the readers send.
+	ActionTopics            map[ActionType]string
+
 	// ActiveConfig is the configuration currently
 	// in use.
 	ActiveConfig            string
 
+	// Configuration options for apt_activity_digest.
+	ActivityDigest          ActivityDigestConfig
+
 	// Configuration options for apt_bag_delete
 	BagDeleteWorker         WorkerConfig
 
@@ -94,6 +306,24 @@ type Config struct {
 	// bucket after successfully processing this bag?
 	DeleteOnSuccess         bool
 
+	// How long files deleted by apt_file_delete stay in quarantine
+	// before apt_purge_quarantine removes them for good. Files can
+	// be undeleted with apt_undelete during this period. The format
+	// is the same as for WorkerConfig.HeartbeatInterval. If this is
+	// empty, we keep deleted files for 30 days.
+	DeletedFileRetention    string
+
+	// DigestBufferSize is the size, in bytes, of the buffer we read
+	// into when calculating checksums. If this is zero, we use
+	// DEFAULT_DIGEST_BUFFER_SIZE. See MultiDigestWriter.
+	DigestBufferSize        int
+
+	// DigestWorkers is the number of files the unpack stage of
+	// ingest hashes at once. Zero or one hashes each file as it
+	// comes out of the tar file. Higher values help on machines
+	// with many cores. See DigestSettings in multidigest.go.
+	DigestWorkers           int
+
 	// DPNCopyWorker copies tarred bags from other nodes into our
 	// DPN staging area, so we can replication them. Currently,
 	// copying is done by rsync over ssh.
@@ -142,6 +372,12 @@ type Config struct {
 	// bucket in Oregon.
 	FailedReplicationWorker WorkerConfig
 
+	// Encryption lists the institutions whose files we encrypt
+	// before sending them to the preservation bucket, keyed by
+	// institution identifier (e.g. "virginia.edu"). Files for
+	// institutions not listed here are stored unencrypted.
+	Encryption              map[string]EncryptionConfig
+
 	// Configuration options for apt_file_delete
 	FileDeleteWorker        WorkerConfig
 
@@ -149,10 +385,39 @@ type Config struct {
 	// handles ongoing fixity checks.
 	FixityWorker            WorkerConfig
 
+	// FixityCheckReplicas causes apt_fixity to check the copy of
+	// each file in the replication bucket, as well as the copy in
+	// the preservation bucket.
+	FixityCheckReplicas     bool
+
 	// The version of the Fluctus API we're using. This should
 	// start with a v, like v1, v2.2, etc.
 	FluctusAPIVersion       string
 
+	// The number of consecutive failed requests after which
+	// the Fluctus client stops sending requests to Fluctus for
+	// FluctusBreakerCooldown. Connection errors and 5xx responses
+	// count as failures. Zero means use the client's default.
+	FluctusBreakerThreshold int
+
+	// How long the Fluctus client waits, once it has stopped
+	// sending requests, before it tries one to see whether Fluctus
+	// is back. The format is the same as for
+	// WorkerConfig.HeartbeatInterval. Leave this empty to use the
+	// client's default.
+	FluctusBreakerCooldown  string
+
+	// The number of times the Fluctus client should retry a
+	// request when it cannot resolve the Fluctus host name.
+	// Zero means use the client's default.
+	FluctusDNSRetries       int
+
+	// How long the Fluctus client should wait before retrying
+	// a request that failed on DNS resolution. The format is
+	// the same as for WorkerConfig.HeartbeatInterval. Leave
+	// this empty to use the client's default.
+	FluctusDNSRetryBackoff  string
+
 	// FluctusURL is the URL of the Fluctus server where
 	// we will be recording results and metadata. This should
 	// start with http:// or https://
@@ -193,6 +458,15 @@ type Config struct {
 	// receiving buckets.
 	MaxFileSize             int64
 
+	// MaxBagSize is the size in bytes of the largest bag we
+	// will ingest. Unlike MaxFileSize, which is for limiting
+	// test runs, this is a real limit: the bucket reader marks
+	// bags over this size failed, without retry, and tells the
+	// depositor why, instead of queueing them. The prepare
+	// worker checks it again before fetching, in case a bag
+	// was queued some other way. Zero means no limit.
+	MaxBagSize              int64
+
 	// NsqdHttpAddress is the address of the NSQ server.
 	// We can put items into queues by issuing PUT requests
 	// to this URL. This should start with http:// or https://
@@ -204,6 +478,10 @@ type Config struct {
 	// discover available queues.
 	NsqLookupd              string
 
+	// PremisEvents describes which PREMIS events ingest generates
+	// for files and objects. See PremisEventConfig.
+	PremisEvents            PremisEventConfig
+
 	// Configuration options for apt_prepare
 	PrepareWorker           WorkerConfig
 
@@ -218,6 +496,24 @@ type Config struct {
 	// Configuration options for apt_record
 	RecordWorker            WorkerConfig
 
+	// RejectZeroByteFiles causes validation to fail bags that
+	// contain empty payload files. When false, empty files are
+	// reported as warnings, and the bag is ingested.
+	RejectZeroByteFiles     bool
+
+	// JunkFilePatterns lists the names of system files, like
+	// .DS_Store, that shouldn't be ingested as generic files.
+	// Patterns use filepath.Match syntax, and a pattern that
+	// matches a directory name matches everything inside it.
+	// If this is empty, we use DefaultJunkFilePatterns.
+	JunkFilePatterns        []string
+
+	// SkipJunkFiles causes ingest to skip payload files that
+	// match JunkFilePatterns, so they are neither stored nor
+	// recorded. When false, junk files are reported as warnings,
+	// and ingested like any other file.
+	SkipJunkFiles           bool
+
 	// The bucket that stores a second copy of our perservation
 	// files. This should be in a different region than the
 	// preseration bucket. As of November 2014, the preservation
@@ -230,6 +526,22 @@ type Config struct {
 	// in US East to the replication bucket in USWest2.
 	ReplicationDirectory    string
 
+	// ReplicationLagThreshold is how long a file can sit in the
+	// preservation bucket without a replication copy before it
+	// shows up in the replication lag report. E.g. "24h".
+	// Defaults to DEFAULT_REPLICATION_LAG_THRESHOLD.
+	ReplicationLagThreshold string
+
+	// ReplicationRegion is the AWS region of ReplicationBucket,
+	// e.g. "us-west-2". Defaults to us-west-2.
+	ReplicationRegion       string
+
+	// ReplicationSameAccount should be true if the preservation
+	// and replication buckets belong to the same AWS account.
+	// apt_replicate can then copy files of up to 5GB within S3,
+	// instead of streaming them through this machine.
+	ReplicationSameAccount  bool
+
 	// Configuration options for apt_replicate
 	ReplicationWorker       WorkerConfig
 
@@ -245,9 +557,17 @@ type Config struct {
 	// that CustomRestoreBucket overrides this.
 	RestoreToTestBuckets    bool
 
+	// If true, restored bags include the object's PREMIS event
+	// history in aptrust-tags/premis-events.json, so the object's
+	// provenance goes with it when partners migrate it elsewhere.
+	RestoreEventHistory     bool
+
 	// Configuration options for apt_restore
 	RestoreWorker           WorkerConfig
 
+	// Connection pool and timeout settings for the S3 client.
+	S3Client                S3ClientConfig
+
 	// SkipAlreadyProcessed indicates whether or not the
 	// bucket_reader should  put successfully-processed items into
 	// NSQ for re-processing. This is amost always set to false.
@@ -255,14 +575,53 @@ type Config struct {
 	// items to test code changes.
 	SkipAlreadyProcessed    bool
 
+	// StageMsgTimeout is how long each ingest stage may hold an
+	// NSQ message before nsqd gives up on it, e.g.
+	// {"Fetch": "120m", "Record": "5m"}. Workers ask for this
+	// timeout as they enter each stage. See ProcessResult.EnterStage.
+	// Stages not listed here use the worker's MessageTimeout.
+	StageMsgTimeout         StageTimeouts
+
+	// StaleBagThreshold is how long a bag can sit in a receiving
+	// bucket without a ProcessedItem before the bucket reader's
+	// stale bag sweep queues it for a late pickup. E.g. "72h".
+	// Defaults to DEFAULT_STALE_BAG_THRESHOLD.
+	StaleBagThreshold       string
+
+	// InventoryMaxAge is the oldest an S3 Inventory report can be
+	// for storage audits to run against it, e.g. "48h". Defaults
+	// to DEFAULT_INVENTORY_MAX_AGE.
+	InventoryMaxAge         string
+
 	// Configuration options for apt_store
 	StoreWorker             WorkerConfig
 
+	// ThroughputWindow is how far back apt_record keeps track of
+	// the bags it finished, for estimating how long the ingest
+	// backlog will take. E.g. "24h". Defaults to
+	// DEFAULT_THROUGHPUT_WINDOW.
+	ThroughputWindow        string
+
 	// TarDirectory is the directory in which we will
 	// untar files from S3. This should be on a volume
 	// with lots of free disk space.
 	TarDirectory            string
 
+	// DownloadDirectory is where apt_prepare downloads tar
+	// files from S3, and ExtractDirectory is where it untars
+	// them. Either may be on its own disk, or on tmpfs. Both
+	// default to TarDirectory. See DownloadDir and ExtractDir.
+	DownloadDirectory       string
+	ExtractDirectory        string
+
+	// StreamUntar tells apt_prepare to untar bags as they come in
+	// from the receiving bucket, instead of downloading the tar
+	// file first. That halves the disk space each bag needs. This
+	// applies only to multi-part uploads. Bags with a single-part
+	// ETag are still downloaded, so we can check the tar file's
+	// md5 against the ETag.
+	StreamUntar             bool
+
 	// Configuration options for apt_trouble
 	TroubleWorker           WorkerConfig
 
@@ -295,6 +654,11 @@ func LoadRequestedConfig(requestedConfig *string) (config Config) {
 		os.Exit(1)
 	}
 	config.ActiveConfig = *requestedConfig
+	if err := config.ApplyActionTopics(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	config.LoadDPNDirectoriesFromEnv()
 	config.ExpandFilePaths()
 	config.createDirectories()
 	return config
@@ -327,6 +691,70 @@ func loadConfigFile() (configurations map[string]Config) {
 	return configurations
 }
 
+// LoadDPNDirectoriesFromEnv sets DPNStagingDirectory and
+// DPNHomeDirectory from the environment variables
+// DPN_STAGING_DIRECTORY and DPN_HOME_DIRECTORY, if they are set.
+// This lets containerised deployments override the config file.
+// See also dpn.LoadDPNConfigFromEnv.
+func (config *Config) LoadDPNDirectoriesFromEnv() {
+	if stagingDir := os.Getenv("DPN_STAGING_DIRECTORY"); stagingDir != "" {
+		config.DPNStagingDirectory = stagingDir
+	}
+	if homeDir := os.Getenv("DPN_HOME_DIRECTORY"); homeDir != "" {
+		config.DPNHomeDirectory = homeDir
+	}
+}
+
+// Returns the config of the worker that handles the specified
+// action, or nil if no single worker handles it.
+func (config *Config) actionWorker(action ActionType) (*WorkerConfig) {
+	switch action {
+	case ActionIngest:
+		return &config.PrepareWorker
+	case ActionRestore:
+		return &config.RestoreWorker
+	case ActionDelete:
+		return &config.FileDeleteWorker
+	case ActionFixityCheck:
+		return &config.FixityWorker
+	}
+	return nil
+}
+
+// Returns the NSQ topic for the specified action. This is the
+// topic in ActionTopics, if there is one, or else the NsqTopic of
+// the worker that handles the action.
+func (config *Config) TopicForAction(action ActionType) (string, error) {
+	if topic := config.ActionTopics[action]; topic != "" {
+		return topic, nil
+	}
+	worker := config.actionWorker(action)
+	if worker == nil || worker.NsqTopic == "" {
+		return "", fmt.Errorf("No NSQ topic is configured for action '%s'", action)
+	}
+	return worker.NsqTopic, nil
+}
+
+// ApplyActionTopics sets the NsqTopic of each worker listed in
+// ActionTopics, so the worker reads from the topic its action is
+// routed to. Returns an error if ActionTopics includes an action
+// we can't route, or an empty topic.
+func (config *Config) ApplyActionTopics() (error) {
+	for action, topic := range config.ActionTopics {
+		worker := config.actionWorker(action)
+		if worker == nil {
+			return fmt.Errorf("ActionTopics: cannot route action '%s'. "+
+				"Valid actions are %s, %s, %s and %s.", action, ActionIngest,
+				ActionRestore, ActionDelete, ActionFixityCheck)
+		}
+		if topic == "" {
+			return fmt.Errorf("ActionTopics: topic for action '%s' is empty", action)
+		}
+		worker.NsqTopic = topic
+	}
+	return nil
+}
+
 func (config *Config) EnsureFluctusConfig() error {
 	if config.FluctusURL == "" {
 		return fmt.Errorf("FluctusUrl is not set in config file")
@@ -340,12 +768,190 @@ func (config *Config) EnsureFluctusConfig() error {
 	return nil
 }
 
+// Returns DeletedFileRetention as a time.Duration, or
+// DEFAULT_DELETE_RETENTION if DeletedFileRetention is empty.
+func (config *Config) DeletedFileRetentionDuration() (time.Duration, error) {
+	retention, err := parseOptionalDuration("DeletedFileRetention", config.DeletedFileRetention)
+	if err == nil && retention == 0 {
+		retention = DEFAULT_DELETE_RETENTION
+	}
+	return retention, err
+}
+
+// Returns StaleBagThreshold as a time.Duration, or
+// DEFAULT_STALE_BAG_THRESHOLD if StaleBagThreshold is empty.
+func (config *Config) StaleBagThresholdDuration() (time.Duration, error) {
+	threshold, err := parseOptionalDuration("StaleBagThreshold", config.StaleBagThreshold)
+	if err == nil && threshold == 0 {
+		threshold = DEFAULT_STALE_BAG_THRESHOLD
+	}
+	return threshold, err
+}
+
+// Returns InventoryMaxAge as a time.Duration, or
+// DEFAULT_INVENTORY_MAX_AGE if InventoryMaxAge is empty.
+func (config *Config) InventoryMaxAgeDuration() (time.Duration, error) {
+	maxAge, err := parseOptionalDuration("InventoryMaxAge", config.InventoryMaxAge)
+	if err == nil && maxAge == 0 {
+		maxAge = DEFAULT_INVENTORY_MAX_AGE
+	}
+	return maxAge, err
+}
+
+// OversizeBagNote returns a note for the depositor explaining that
+// the bag in the tar file tarFileName, which is size bytes, is over
+// MaxBagSize and will not be ingested. It returns an empty string if
+// the bag is within the limit, or if there is no limit. The note
+// starts with "bag too large", which is how failure reports
+// recognize it.
+func (config *Config) OversizeBagNote(tarFileName string, size int64) (string) {
+	if config.MaxBagSize <= 0 || size <= config.MaxBagSize {
+		return ""
+	}
+	return fmt.Sprintf("bag too large: %s is %s (%d bytes), and the size limit "+
+		"for a single bag is %s (%d bytes), so it will not be ingested. "+
+		"Split it into a multipart bag with each part under the limit, "+
+		"and upload the parts.", tarFileName, FormatBytes(size), size,
+		FormatBytes(config.MaxBagSize), config.MaxBagSize)
+}
+
+// Returns ReplicationLagThreshold as a time.Duration, or
+// DEFAULT_REPLICATION_LAG_THRESHOLD if ReplicationLagThreshold
+// is empty.
+func (config *Config) ReplicationLagThresholdDuration() (time.Duration, error) {
+	threshold, err := parseOptionalDuration("ReplicationLagThreshold", config.ReplicationLagThreshold)
+	if err == nil && threshold == 0 {
+		threshold = DEFAULT_REPLICATION_LAG_THRESHOLD
+	}
+	return threshold, err
+}
+
+// Returns the AWS region of the replication bucket.
+func (config *Config) ReplicationAWSRegion() (aws.Region, error) {
+	if config.ReplicationRegion == "" {
+		return aws.USWest2, nil
+	}
+	region, ok := aws.Regions[config.ReplicationRegion]
+	if !ok {
+		return aws.Region{}, fmt.Errorf("Invalid ReplicationRegion '%s'", config.ReplicationRegion)
+	}
+	return region, nil
+}
+
+// Returns the encryption config for the specified institution,
+// or nil if we don't encrypt that institution's files.
+func (config *Config) EncryptionFor(institution string) (*EncryptionConfig) {
+	encConfig, ok := config.Encryption[institution]
+	if !ok {
+		return nil
+	}
+	return &encConfig
+}
+
+// Returns the KeyWrapper for the specified institution's files,
+// or nil if we don't encrypt that institution's files.
+func (config *Config) KeyWrapperFor(institution string) (KeyWrapper, error) {
+	encConfig := config.EncryptionFor(institution)
+	if encConfig == nil {
+		return nil, nil
+	}
+	publicKeyFile, err := ExpandTilde(encConfig.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyFile, err := ExpandTilde(encConfig.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	wrapper, err := LoadRSAKeyWrapper(encConfig.KeyId, publicKeyFile, privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load encryption keys for %s: %v", institution, err)
+	}
+	return wrapper, nil
+}
+
+// Returns the fixity mode for the specified institution's encrypted
+// files. This is FIXITY_MODE_CIPHERTEXT if the institution has no
+// FixityMode, or is no longer in the Encryption list.
+func (config *Config) EncryptedFixityMode(institution string) (string, error) {
+	encConfig := config.EncryptionFor(institution)
+	if encConfig == nil || encConfig.FixityMode == "" {
+		return FIXITY_MODE_CIPHERTEXT, nil
+	}
+	switch encConfig.FixityMode {
+	case FIXITY_MODE_CIPHERTEXT, FIXITY_MODE_DECRYPT, FIXITY_MODE_SKIP:
+		return encConfig.FixityMode, nil
+	}
+	return "", fmt.Errorf("Invalid FixityMode '%s' for %s", encConfig.FixityMode, institution)
+}
+
+// Returns JunkFilePatterns, or DefaultJunkFilePatterns if
+// JunkFilePatterns is empty.
+func (config *Config) JunkFilePatternList() ([]string) {
+	if len(config.JunkFilePatterns) == 0 {
+		return DefaultJunkFilePatterns
+	}
+	return config.JunkFilePatterns
+}
+
+// Returns ThroughputWindow as a time.Duration, or
+// DEFAULT_THROUGHPUT_WINDOW if ThroughputWindow is empty.
+func (config *Config) ThroughputWindowDuration() (time.Duration, error) {
+	window, err := parseOptionalDuration("ThroughputWindow", config.ThroughputWindow)
+	if err == nil && window == 0 {
+		window = DEFAULT_THROUGHPUT_WINDOW
+	}
+	return window, err
+}
+
+// Returns FluctusBreakerCooldown as a time.Duration.
+func (config *Config) FluctusBreakerCooldownDuration() (time.Duration, error) {
+	return parseOptionalDuration("FluctusBreakerCooldown", config.FluctusBreakerCooldown)
+}
+
+// Returns FluctusDNSRetryBackoff as a time.Duration.
+func (config *Config) FluctusDNSRetryBackoffDuration() (time.Duration, error) {
+	return parseOptionalDuration("FluctusDNSRetryBackoff", config.FluctusDNSRetryBackoff)
+}
+
+// Returns the directory where tar files are downloaded from S3.
+func (config *Config) DownloadDir() (string) {
+	if config.DownloadDirectory != "" {
+		return config.DownloadDirectory
+	}
+	return config.TarDirectory
+}
+
+// Returns the directory where tar files are untarred.
+func (config *Config) ExtractDir() (string) {
+	if config.ExtractDirectory != "" {
+		return config.ExtractDirectory
+	}
+	return config.TarDirectory
+}
+
+// Returns the settings the unpack stage uses to calculate checksums.
+func (config *Config) DigestSettings() (DigestSettings) {
+	return DigestSettings{
+		BufferSize: config.DigestBufferSize,
+		Workers:    config.DigestWorkers,
+	}
+}
+
 // Expands ~ file paths
 func (config *Config) ExpandFilePaths() {
 	expanded, err := ExpandTilde(config.TarDirectory)
 	if err == nil {
 		config.TarDirectory = expanded
 	}
+	expanded, err = ExpandTilde(config.DownloadDirectory)
+	if err == nil {
+		config.DownloadDirectory = expanded
+	}
+	expanded, err = ExpandTilde(config.ExtractDirectory)
+	if err == nil {
+		config.ExtractDirectory = expanded
+	}
 	expanded, err = ExpandTilde(config.LogDirectory)
 	if err == nil {
 		config.LogDirectory = expanded
@@ -366,13 +972,19 @@ func (config *Config) ExpandFilePaths() {
 	if err == nil {
 		config.DPNHomeDirectory = expanded
 	}
+	expanded, err = ExpandTilde(config.ActivityDigest.StateFile)
+	if err == nil {
+		config.ActivityDigest.StateFile = expanded
+	}
 }
 
 func (config *Config) createDirectories() (error) {
-	if !FileExists(config.TarDirectory) {
-		err := os.MkdirAll(config.TarDirectory, 0755)
-		if err != nil {
-			return err
+	for _, dir := range []string{config.TarDirectory, config.DownloadDir(), config.ExtractDir()} {
+		if !FileExists(dir) {
+			err := os.MkdirAll(dir, 0755)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	if !FileExists(config.LogDirectory) {
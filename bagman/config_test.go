@@ -1,8 +1,14 @@
 package bagman_test
 
 import (
+	"encoding/json"
 	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestExpandFilePaths(t *testing.T) {
@@ -26,3 +32,280 @@ func TestExpandFilePaths(t *testing.T) {
 		t.Errorf("ReplicationDirectory was not expanded: %s", config.ReplicationDirectory)
 	}
 }
+
+func TestS3ClientConfigNewTransport(t *testing.T) {
+	s3Config := bagman.S3ClientConfig{
+		MaxIdleConnsPerHost:   16,
+		DialTimeout:           "5s",
+		ResponseHeaderTimeout: "2m",
+		OperationTimeout:      "30m",
+	}
+	transport, err := s3Config.NewTransport()
+	if err != nil {
+		t.Errorf("NewTransport returned error: %v", err)
+		return
+	}
+	if transport.MaxIdleConnsPerHost != 16 {
+		t.Errorf("MaxIdleConnsPerHost: expected 16, got %d", transport.MaxIdleConnsPerHost)
+	}
+	if transport.ResponseHeaderTimeout != 2*time.Minute {
+		t.Errorf("ResponseHeaderTimeout: expected 2m, got %s", transport.ResponseHeaderTimeout)
+	}
+	operationTimeout, err := s3Config.OperationTimeoutDuration()
+	if err != nil || operationTimeout != 30*time.Minute {
+		t.Errorf("OperationTimeoutDuration: expected 30m, got %s (%v)", operationTimeout, err)
+	}
+}
+
+func TestS3ClientConfigInvalidDuration(t *testing.T) {
+	s3Config := bagman.S3ClientConfig{DialTimeout: "five seconds"}
+	_, err := s3Config.NewTransport()
+	if err == nil {
+		t.Errorf("NewTransport should have rejected invalid DialTimeout")
+	}
+	s3Config = bagman.S3ClientConfig{OperationTimeout: "-1m"}
+	_, err = s3Config.OperationTimeoutDuration()
+	if err == nil {
+		t.Errorf("OperationTimeoutDuration should have rejected negative timeout")
+	}
+}
+
+func TestJunkFilePatternList(t *testing.T) {
+	config := &bagman.Config{}
+	if len(config.JunkFilePatternList()) != len(bagman.DefaultJunkFilePatterns) {
+		t.Errorf("Empty JunkFilePatterns should fall back to the defaults")
+	}
+	config.JunkFilePatterns = []string{"*.tmp"}
+	patterns := config.JunkFilePatternList()
+	if len(patterns) != 1 || patterns[0] != "*.tmp" {
+		t.Errorf("Expected configured patterns, got %v", patterns)
+	}
+}
+
+func TestReplicationSettings(t *testing.T) {
+	config := &bagman.Config{}
+	threshold, err := config.ReplicationLagThresholdDuration()
+	if err != nil || threshold != bagman.DEFAULT_REPLICATION_LAG_THRESHOLD {
+		t.Errorf("Empty ReplicationLagThreshold should fall back to the default, got %s, %v",
+			threshold, err)
+	}
+	region, err := config.ReplicationAWSRegion()
+	if err != nil || region.Name != "us-west-2" {
+		t.Errorf("Empty ReplicationRegion should fall back to us-west-2, got %s, %v",
+			region.Name, err)
+	}
+	config.ReplicationLagThreshold = "48h"
+	config.ReplicationRegion = "us-east-1"
+	if threshold, _ = config.ReplicationLagThresholdDuration(); threshold != 48*time.Hour {
+		t.Errorf("Expected threshold 48h, got %s", threshold)
+	}
+	if region, _ = config.ReplicationAWSRegion(); region.Name != "us-east-1" {
+		t.Errorf("Expected region us-east-1, got %s", region.Name)
+	}
+	config.ReplicationRegion = "mars-north-1"
+	if _, err = config.ReplicationAWSRegion(); err == nil {
+		t.Errorf("ReplicationAWSRegion should reject unknown regions")
+	}
+}
+
+func TestLoadDPNDirectoriesFromEnv(t *testing.T) {
+	defer os.Setenv("DPN_STAGING_DIRECTORY", os.Getenv("DPN_STAGING_DIRECTORY"))
+	defer os.Setenv("DPN_HOME_DIRECTORY", os.Getenv("DPN_HOME_DIRECTORY"))
+	config := &bagman.Config{
+		DPNStagingDirectory: "/mnt/dpn/staging",
+		DPNHomeDirectory:    "/home",
+	}
+	os.Setenv("DPN_STAGING_DIRECTORY", "/data/staging")
+	os.Setenv("DPN_HOME_DIRECTORY", "")
+	config.LoadDPNDirectoriesFromEnv()
+	if config.DPNStagingDirectory != "/data/staging" {
+		t.Errorf("DPNStagingDirectory should come from the environment, got %s",
+			config.DPNStagingDirectory)
+	}
+	if config.DPNHomeDirectory != "/home" {
+		t.Errorf("Empty DPN_HOME_DIRECTORY should not override %s", config.DPNHomeDirectory)
+	}
+}
+
+func TestDownloadAndExtractDir(t *testing.T) {
+	config := &bagman.Config{TarDirectory: "/mnt/apt/data"}
+	if config.DownloadDir() != "/mnt/apt/data" || config.ExtractDir() != "/mnt/apt/data" {
+		t.Errorf("Download and extract directories should default to TarDirectory")
+	}
+	config.DownloadDirectory = "/mnt/downloads"
+	config.ExtractDirectory = "/dev/shm/extract"
+	if config.DownloadDir() != "/mnt/downloads" || config.ExtractDir() != "/dev/shm/extract" {
+		t.Errorf("Expected /mnt/downloads and /dev/shm/extract, got %s and %s",
+			config.DownloadDir(), config.ExtractDir())
+	}
+}
+
+func TestPremisEventConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config bagman.PremisEventConfig
+		valid  bool
+	}{
+		{"default", bagman.PremisEventConfig{}, true},
+		{"default strict", bagman.PremisEventConfig{Strict: true}, true},
+		{"full set strict", bagman.PremisEventConfig{
+			FileEvents:   bagman.FileEventNames,
+			ObjectEvents: bagman.ObjectEventNames,
+			Strict:       true}, true},
+		{"minimum strict", bagman.PremisEventConfig{
+			FileEvents:   []string{"ingest", "fixity_generation", "identifier_assignment"},
+			ObjectEvents: []string{"ingest", "identifier_assignment"},
+			Strict:       true}, true},
+		{"no url id, not strict", bagman.PremisEventConfig{
+			FileEvents: []string{"ingest", "fixity_check"}}, true},
+		{"no friendly id, strict", bagman.PremisEventConfig{
+			FileEvents: []string{"ingest", "fixity_generation", "identifier_assignment_url"},
+			Strict:     true}, false},
+		{"no object ingest, strict", bagman.PremisEventConfig{
+			ObjectEvents: []string{"identifier_assignment"},
+			Strict:       true}, false},
+		{"unknown file event", bagman.PremisEventConfig{
+			FileEvents: []string{"ingest", "replication"}}, false},
+		{"unknown object event", bagman.PremisEventConfig{
+			ObjectEvents: []string{"fixity_generation"}}, false},
+	}
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: Validate() returned error: %v", tc.name, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%s: Validate() should have returned an error", tc.name)
+		}
+	}
+
+	config := bagman.PremisEventConfig{FileEvents: []string{"ingest"}, Strict: true}
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "'fixity_generation' cannot be disabled") ||
+		!strings.Contains(err.Error(), "'identifier_assignment' cannot be disabled") {
+		t.Errorf("Validate() should name each missing required event, got %v", err)
+	}
+}
+
+func TestPremisEventConfigParsing(t *testing.T) {
+	// Every config we ship must be valid, and the production
+	// config must be strict.
+	bagmanHome, err := bagman.BagmanHome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(bagmanHome, "config", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configurations := make(map[string]bagman.Config)
+	if err = json.Unmarshal(data, &configurations); err != nil {
+		t.Fatal(err)
+	}
+	for name, config := range configurations {
+		if err = config.PremisEvents.Validate(); err != nil {
+			t.Errorf("Config %s: %v", name, err)
+		}
+	}
+	if !configurations["production"].PremisEvents.Strict {
+		t.Errorf("Production config should have strict PremisEvents")
+	}
+
+	// A config without a PremisEvents section generates everything.
+	config := bagman.Config{}
+	if err = json.Unmarshal([]byte(`{"TarDirectory": "/tmp"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.PremisEvents.FileEventList()) != len(bagman.FileEventNames) ||
+		len(config.PremisEvents.ObjectEventList()) != len(bagman.ObjectEventNames) {
+		t.Errorf("Missing PremisEvents section should default to all events")
+	}
+
+	configJson := `{"PremisEvents": {"FileEvents": ["ingest", "fixity_generation"],
+		"ObjectEvents": ["ingest"], "Strict": false}}`
+	if err = json.Unmarshal([]byte(configJson), &config); err != nil {
+		t.Fatal(err)
+	}
+	if !config.PremisEvents.GeneratesFileEvent("fixity_generation") ||
+		config.PremisEvents.GeneratesFileEvent("identifier_assignment_url") ||
+		config.PremisEvents.GeneratesObjectEvent("identifier_assignment") {
+		t.Errorf("Parsed PremisEvents config does not match: %v", config.PremisEvents)
+	}
+}
+
+func TestTopicForAction(t *testing.T) {
+	config := bagman.Config{
+		ActionTopics:  map[bagman.ActionType]string{bagman.ActionRestore: "restore_v2_topic"},
+		PrepareWorker: bagman.WorkerConfig{NsqTopic: "prepare_topic"},
+		RestoreWorker: bagman.WorkerConfig{NsqTopic: "restore_topic"},
+	}
+	if topic, _ := config.TopicForAction(bagman.ActionRestore); topic != "restore_v2_topic" {
+		t.Errorf("Expected restore_v2_topic from ActionTopics, got '%s'", topic)
+	}
+	if topic, _ := config.TopicForAction(bagman.ActionIngest); topic != "prepare_topic" {
+		t.Errorf("Expected Ingest to default to prepare_topic, got '%s'", topic)
+	}
+	// No topic configured anywhere.
+	if _, err := config.TopicForAction(bagman.ActionDelete); err == nil {
+		t.Errorf("TopicForAction(Delete) should return an error")
+	}
+	if _, err := config.TopicForAction(bagman.ActionDPN); err == nil {
+		t.Errorf("TopicForAction(DPN) should return an error")
+	}
+
+	// Workers listen to the topics their actions are routed to.
+	if err := config.ApplyActionTopics(); err != nil {
+		t.Errorf("ApplyActionTopics() returned error: %v", err)
+	}
+	if config.RestoreWorker.NsqTopic != "restore_v2_topic" ||
+		config.PrepareWorker.NsqTopic != "prepare_topic" {
+		t.Errorf("ApplyActionTopics() set worker topics %s and %s",
+			config.RestoreWorker.NsqTopic, config.PrepareWorker.NsqTopic)
+	}
+	config.ActionTopics[bagman.ActionDPN] = "dpn_topic"
+	if err := config.ApplyActionTopics(); err == nil {
+		t.Errorf("ApplyActionTopics() should reject actions it can't route")
+	}
+	delete(config.ActionTopics, bagman.ActionDPN)
+	config.ActionTopics[bagman.ActionIngest] = ""
+	if err := config.ApplyActionTopics(); err == nil {
+		t.Errorf("ApplyActionTopics() should reject empty topics")
+	}
+
+	// ActionTopics keys are action names in the config file.
+	jsonConfig := `{"ActionTopics": {"Ingest": "ingest_topic", "Fixity Check": "fixity_v2_topic"}}`
+	parsed := bagman.Config{}
+	if err := json.Unmarshal([]byte(jsonConfig), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if topic, _ := parsed.TopicForAction(bagman.ActionFixityCheck); topic != "fixity_v2_topic" {
+		t.Errorf("Expected fixity_v2_topic, got '%s'", topic)
+	}
+}
+
+// The bucket reader admits a bag only if OversizeBagNote is empty.
+func TestOversizeBagNote(t *testing.T) {
+	config := bagman.Config{}
+	if note := config.OversizeBagNote("test.edu.huge.tar", 5 << 40); note != "" {
+		t.Errorf("Zero MaxBagSize should admit any bag, got '%s'", note)
+	}
+	config.MaxBagSize = 1 << 30
+	if note := config.OversizeBagNote("test.edu.ok.tar", 1 << 30); note != "" {
+		t.Errorf("A bag at the limit should be admitted, got '%s'", note)
+	}
+	if note := config.OversizeBagNote("test.edu.ok.tar", 1024); note != "" {
+		t.Errorf("A bag under the limit should be admitted, got '%s'", note)
+	}
+	note := config.OversizeBagNote("test.edu.huge.tar", 5 << 40)
+	if note == "" {
+		t.Fatalf("A bag over the limit should be rejected")
+	}
+	for _, expected := range []string{"test.edu.huge.tar", "5497558138880 bytes",
+		"1073741824 bytes", "multipart bag"} {
+		if !strings.Contains(note, expected) {
+			t.Errorf("Note should mention '%s': %s", expected, note)
+		}
+	}
+	if bagman.ClassifyErrorMessage(note) != bagman.FailureBagTooLarge {
+		t.Errorf("Failure reports should classify the note as BagTooLarge")
+	}
+}
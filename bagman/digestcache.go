@@ -0,0 +1,135 @@
+package bagman
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The maximum number of digests DigestCache holds by default.
+// At a few hundred bytes per entry, this is a few megabytes.
+const DEFAULT_DIGEST_CACHE_SIZE = 20000
+
+// digestCacheEntry is a cached FileDigest, along with the size and
+// modification time the file had when we calculated the digest.
+type digestCacheEntry struct {
+	digest  FileDigest
+	size    int64
+	modTime time.Time
+}
+
+/*
+DigestCache holds md5 and sha256 digests of local files, so that
+stages that need the digest of a file we've already read don't have
+to read it again. Entries are keyed by absolute path and are valid
+only while the file's size and modification time are unchanged, so
+a file that changes on disk is always re-read.
+
+The cache is in memory, so it only helps within a single process,
+such as when apt_prepare unpacks a bag and then validates it, or
+when dpn_package builds a bag and then checksums it. When the cache
+is full, it drops an arbitrary entry to make room for a new one.
+It's safe to use across go routines.
+*/
+type DigestCache struct {
+	entries    map[string]*digestCacheEntry
+	maxEntries int
+	hits       int64
+	misses     int64
+	mutex      *sync.Mutex
+}
+
+// ChecksumCache is the digest cache shared by everything in a
+// process. CalculateDigests consults it before reading a file.
+var ChecksumCache = NewDigestCache(DEFAULT_DIGEST_CACHE_SIZE)
+
+// Creates a new, empty DigestCache that holds up to maxEntries
+// digests.
+func NewDigestCache(maxEntries int) (*DigestCache) {
+	return &DigestCache{
+		entries:    make(map[string]*digestCacheEntry),
+		maxEntries: maxEntries,
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// Returns the cached digest for the file at pathToFile, or nil if
+// we don't have one, or if the file has changed since we cached it.
+func (cache *DigestCache) Lookup(pathToFile string) (*FileDigest) {
+	absPath, fileInfo := statForCache(pathToFile)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, exists := cache.entries[absPath]
+	if !exists || fileInfo == nil || entry.size != fileInfo.Size() ||
+		!entry.modTime.Equal(fileInfo.ModTime()) {
+		if exists {
+			delete(cache.entries, absPath)
+		}
+		cache.misses++
+		return nil
+	}
+	cache.hits++
+	digest := entry.digest
+	digest.PathToFile = pathToFile
+	return &digest
+}
+
+// Adds the digest of the file at pathToFile to the cache. The file
+// must not have changed since the digest was calculated. Does nothing
+// if the file does not exist.
+func (cache *DigestCache) Store(pathToFile string, digest *FileDigest) {
+	absPath, fileInfo := statForCache(pathToFile)
+	if fileInfo == nil || digest == nil || cache.maxEntries <= 0 {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if _, exists := cache.entries[absPath]; !exists && len(cache.entries) >= cache.maxEntries {
+		for key := range cache.entries {
+			delete(cache.entries, key)
+			break
+		}
+	}
+	cache.entries[absPath] = &digestCacheEntry{
+		digest:  *digest,
+		size:    fileInfo.Size(),
+		modTime: fileInfo.ModTime(),
+	}
+}
+
+// Removes the file at pathToFile from the cache.
+func (cache *DigestCache) Invalidate(pathToFile string) {
+	absPath, _ := statForCache(pathToFile)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.entries, absPath)
+}
+
+// Returns the number of lookups that found a valid digest.
+func (cache *DigestCache) Hits() (int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.hits
+}
+
+// Returns the number of lookups that did not find a valid digest.
+func (cache *DigestCache) Misses() (int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.misses
+}
+
+// Returns the absolute path to the file, and its FileInfo,
+// or nil if the file can't be stat'ed.
+func statForCache(pathToFile string) (string, os.FileInfo) {
+	absPath, err := filepath.Abs(pathToFile)
+	if err != nil {
+		absPath = pathToFile
+	}
+	fileInfo, err := os.Stat(absPath)
+	if err != nil {
+		return absPath, nil
+	}
+	return absPath, fileInfo
+}
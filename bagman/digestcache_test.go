@@ -0,0 +1,121 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCalculateDigestsUsesCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digestcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pathToFile := filepath.Join(dir, "data.txt")
+	if err = ioutil.WriteFile(pathToFile, []byte("original contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := bagman.ChecksumCache.Hits()
+	first, err := bagman.CalculateDigests(pathToFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bagman.ChecksumCache.Hits() != hits {
+		t.Errorf("First CalculateDigests call should not hit the cache")
+	}
+
+	// Unchanged file: digests come from the cache.
+	second, err := bagman.CalculateDigests(pathToFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bagman.ChecksumCache.Hits() != hits+1 {
+		t.Errorf("Second CalculateDigests call should hit the cache")
+	}
+	if *second != *first {
+		t.Errorf("Cached digest %+v does not match original %+v", second, first)
+	}
+
+	// Changed file: digests are recalculated. Set the mod time
+	// explicitly, in case the file system's clock is coarse.
+	if err = ioutil.WriteFile(pathToFile, []byte("changed contents!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pathToFile, later, later)
+	third, err := bagman.CalculateDigests(pathToFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bagman.ChecksumCache.Hits() != hits+1 {
+		t.Errorf("CalculateDigests should not use the cache for a changed file")
+	}
+	if third.Md5Digest == first.Md5Digest || third.Sha256Digest == first.Sha256Digest {
+		t.Errorf("CalculateDigests returned stale digests for a changed file")
+	}
+	expectedMd5 := "c5b2b68a3e0832e3439c7e2387eda85f"
+	if third.Md5Digest != expectedMd5 {
+		t.Errorf("Expected md5 %s, got %s", expectedMd5, third.Md5Digest)
+	}
+}
+
+func TestDigestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digestcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := make([]string, 3)
+	for i, name := range []string{"one", "two", "three"} {
+		paths[i] = filepath.Join(dir, name)
+		ioutil.WriteFile(paths[i], []byte(name), 0644)
+	}
+	cache := bagman.NewDigestCache(2)
+	cache.Store(paths[0], &bagman.FileDigest{Md5Digest: "md5-one", Size: 3})
+	cache.Store(paths[1], &bagman.FileDigest{Md5Digest: "md5-two", Size: 3})
+
+	// Lookups work on relative paths too, and report the path
+	// the caller asked for.
+	workingDir, _ := os.Getwd()
+	relPath, _ := filepath.Rel(workingDir, paths[0])
+	digest := cache.Lookup(relPath)
+	if digest == nil || digest.Md5Digest != "md5-one" || digest.PathToFile != relPath {
+		t.Errorf("Expected cached digest for %s, got %+v", relPath, digest)
+	}
+
+	// The cache is full, so storing a third entry drops one.
+	cache.Store(paths[2], &bagman.FileDigest{Md5Digest: "md5-three", Size: 5})
+	found := 0
+	for _, path := range paths {
+		if cache.Lookup(path) != nil {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("Cache should hold 2 entries, found %d", found)
+	}
+	if cache.Lookup(paths[2]) == nil {
+		t.Errorf("Newest entry should be in the cache")
+	}
+
+	cache.Invalidate(paths[2])
+	if cache.Lookup(paths[2]) != nil {
+		t.Errorf("Invalidated entry should not be in the cache")
+	}
+
+	// Deleted files are never found.
+	cache.Store(paths[2], &bagman.FileDigest{Md5Digest: "md5-three", Size: 5})
+	os.Remove(paths[2])
+	if cache.Lookup(paths[2]) != nil {
+		t.Errorf("Cache should not return a digest for a deleted file")
+	}
+	cache.Store(paths[2], &bagman.FileDigest{Md5Digest: "md5-three", Size: 5})
+	if cache.Lookup(paths[2]) != nil {
+		t.Errorf("Cache should not store a digest for a missing file")
+	}
+}
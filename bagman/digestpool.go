@@ -0,0 +1,72 @@
+package bagman
+
+import (
+	"runtime"
+	"sync"
+)
+
+/*
+DigestPool calculates md5 and sha256 digests for a number of files
+at once. Each file is still read only once, as in CalculateDigests,
+but on a machine with several cores, the pool can hash several
+files concurrently. That speeds things up for bags with many files.
+For a bag with one huge file, it doesn't help.
+
+The pool starts its go routines on each call to CalculateDigests,
+and they exit when the call returns, so a DigestPool has nothing
+to clean up.
+*/
+type DigestPool struct {
+	workers    int
+	bufferSize int
+}
+
+// Creates a new DigestPool that hashes up to workers files at a
+// time, reading each into a buffer of bufferSize bytes. If workers
+// is less than one, the pool uses one worker per CPU. If bufferSize
+// is zero, the pool uses DEFAULT_DIGEST_BUFFER_SIZE.
+func NewDigestPool(workers, bufferSize int) (*DigestPool) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	return &DigestPool{workers: workers, bufferSize: bufferSize}
+}
+
+// Returns the maximum number of files the pool hashes at once.
+func (pool *DigestPool) Workers() (int) {
+	return pool.workers
+}
+
+// CalculateDigests returns the digests of the files at paths, in
+// the same order as paths. Like the CalculateDigests function, it
+// uses ChecksumCache, and it stores the digests it calculates there. If any file can't be read, its digest will
+// be nil, and errors will describe what went wrong. The errors
+// slice is empty if all files were read successfully.
+func (pool *DigestPool) CalculateDigests(paths []string) (digests []*FileDigest, errors []error) {
+	digests = make([]*FileDigest, len(paths))
+	fileErrors := make([]error, len(paths))
+	indexes := make(chan int)
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < Min(pool.workers, len(paths)); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for index := range indexes {
+				digests[index], fileErrors[index] = calculateDigests(paths[index], pool.bufferSize)
+			}
+		}()
+	}
+	for index := range paths {
+		indexes <- index
+	}
+	close(indexes)
+	waitGroup.Wait()
+
+	errors = make([]error, 0)
+	for _, err := range fileErrors {
+		if err != nil {
+			errors = append(errors, err)
+		}
+	}
+	return digests, errors
+}
@@ -0,0 +1,111 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns the paths of all the files in the sample_good bag,
+// plus the JSON fixtures in testdata.
+func digestPoolFixtures(t testing.TB) ([]string) {
+	bagmanHome, _ := bagman.BagmanHome()
+	testdata := filepath.Join(bagmanHome, "testdata")
+	paths, err := bagman.RecursiveFileList(filepath.Join(testdata, "example.edu.sample_good"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFiles, _ := filepath.Glob(filepath.Join(testdata, "*.json"))
+	paths = append(paths, jsonFiles...)
+	if len(paths) < 10 {
+		t.Fatalf("Expected at least 10 fixture files, found %d", len(paths))
+	}
+	return paths
+}
+
+// Removes paths from the ChecksumCache, so CalculateDigests has
+// to read the files.
+func uncacheDigests(paths []string) {
+	for _, path := range paths {
+		bagman.ChecksumCache.Invalidate(path)
+	}
+}
+
+func TestDigestPoolMatchesSerial(t *testing.T) {
+	paths := digestPoolFixtures(t)
+	uncacheDigests(paths)
+	expected := make([]*bagman.FileDigest, len(paths))
+	for i, path := range paths {
+		digest, err := bagman.CalculateDigests(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = digest
+	}
+
+	for _, workers := range []int{1, 3, 0} {
+		uncacheDigests(paths)
+		pool := bagman.NewDigestPool(workers, 0)
+		digests, errors := pool.CalculateDigests(paths)
+		if len(errors) != 0 {
+			t.Errorf("Pool with %d workers returned errors: %v", pool.Workers(), errors)
+		}
+		if len(digests) != len(paths) {
+			t.Fatalf("Expected %d digests, got %d", len(paths), len(digests))
+		}
+		for i := range paths {
+			if digests[i] == nil || *digests[i] != *expected[i] {
+				t.Errorf("Pool with %d workers: digest of %s is %+v, expected %+v",
+					pool.Workers(), paths[i], digests[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestDigestPoolErrors(t *testing.T) {
+	paths := digestPoolFixtures(t)[:2]
+	paths = append(paths, "/path/does/not/exist")
+	digests, errors := bagman.NewDigestPool(2, 0).CalculateDigests(paths)
+	if len(errors) != 1 || !strings.Contains(errors[0].Error(), "/path/does/not/exist") {
+		t.Errorf("Expected one error about the missing file, got %v", errors)
+	}
+	if digests[0] == nil || digests[1] == nil || digests[2] != nil {
+		t.Errorf("Expected digests for the first two files only, got %v", digests)
+	}
+}
+
+func TestNewDigestPoolDefaultsToNumCPU(t *testing.T) {
+	if bagman.NewDigestPool(0, 0).Workers() < 1 {
+		t.Errorf("Pool should have at least one worker")
+	}
+	if bagman.NewDigestPool(4, 0).Workers() != 4 {
+		t.Errorf("Pool should have the requested number of workers")
+	}
+}
+
+func benchmarkDigests(b *testing.B, calculate func([]string)) {
+	paths := digestPoolFixtures(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		uncacheDigests(paths)
+		b.StartTimer()
+		calculate(paths)
+	}
+}
+
+func BenchmarkCalculateDigestsSerial(b *testing.B) {
+	benchmarkDigests(b, func(paths []string) {
+		for _, path := range paths {
+			bagman.CalculateDigests(path)
+		}
+	})
+}
+
+func BenchmarkDigestPool(b *testing.B) {
+	pool := bagman.NewDigestPool(0, 0)
+	benchmarkDigests(b, func(paths []string) {
+		pool.CalculateDigests(paths)
+	})
+}
@@ -0,0 +1,529 @@
+package bagman
+
+/*
+Client-side envelope encryption for preservation files.
+
+Institutions listed in Config.Encryption have their files encrypted
+before the store stage sends them to the preservation bucket. Each
+file gets its own random 256-bit data key. We encrypt the file with
+that key, wrap (encrypt) the data key with the institution's public
+key, and store the wrapped key with the object, in the S3 metadata,
+and on the GenericFile. Only someone holding the institution's
+private key can recover the data key.
+
+Files are encrypted with AES-256-GCM in chunks of ChunkSize bytes,
+so we can encrypt and decrypt streams of any size without holding
+them in memory. Each sealed chunk is the chunk's ciphertext followed
+by a 16-byte GCM tag. The 12-byte nonce for each chunk is the chunk
+number (big-endian, in the first eight bytes) plus a flag in the last
+byte that is 1 for the final chunk and 0 for all others. Since every
+file has its own data key, nonces are never reused under one key.
+The final-chunk flag means that truncating the ciphertext, or adding
+to it, causes decryption to fail. Empty files have one empty chunk.
+
+Checksums recorded in Fedora are always those of the plaintext.
+*/
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// The cipher we use to encrypt preservation files.
+	ENCRYPTION_ALGORITHM = "AES-256-GCM"
+
+	// Number of plaintext bytes in each encrypted chunk.
+	ENCRYPTION_CHUNK_SIZE = 64 * 1024
+
+	// Data keys are 256 bits.
+	ENCRYPTION_KEY_SIZE = 32
+
+	// Each sealed chunk is this many bytes longer than
+	// its plaintext.
+	ENCRYPTION_TAG_SIZE = 16
+
+	// Data keys are wrapped with RSA-OAEP using SHA-256.
+	KEY_WRAP_RSA_OAEP = "RSA-OAEP-SHA256"
+
+	// Fixity modes for encrypted files. See EncryptionConfig.FixityMode.
+	FIXITY_MODE_CIPHERTEXT = "ciphertext"
+	FIXITY_MODE_DECRYPT    = "decrypt"
+	FIXITY_MODE_SKIP       = "skip"
+)
+
+// EncryptionInfo describes how a preservation file was encrypted.
+// It's stored on the File and GenericFile, and everything except
+// EncryptedSize and EncryptedSha256 is also stored in the S3
+// object's metadata.
+type EncryptionInfo struct {
+	// The cipher. Always ENCRYPTION_ALGORITHM.
+	Algorithm        string `json:"algorithm"`
+
+	// The number of plaintext bytes in each chunk.
+	ChunkSize        int    `json:"chunk_size"`
+
+	// How the data key was wrapped. Always KEY_WRAP_RSA_OAEP.
+	KeyWrapAlgorithm string `json:"key_wrap_algorithm"`
+
+	// Identifies the institution's key that wrapped the data key.
+	KeyId            string `json:"key_id"`
+
+	// The base64-encoded wrapped data key.
+	WrappedKey       string `json:"wrapped_key"`
+
+	// The size of the encrypted file in S3.
+	EncryptedSize    int64  `json:"encrypted_size"`
+
+	// The SHA256 digest of the encrypted file in S3, calculated
+	// during upload. Fixity checks in FIXITY_MODE_CIPHERTEXT
+	// compare against this.
+	EncryptedSha256  string `json:"encrypted_sha256"`
+}
+
+// Returns an error if info describes an encryption scheme we
+// don't know how to decrypt.
+func (info *EncryptionInfo) validate() (error) {
+	if info.Algorithm != ENCRYPTION_ALGORITHM {
+		return fmt.Errorf("Unsupported encryption algorithm '%s'", info.Algorithm)
+	}
+	if info.KeyWrapAlgorithm != KEY_WRAP_RSA_OAEP {
+		return fmt.Errorf("Unsupported key wrap algorithm '%s'", info.KeyWrapAlgorithm)
+	}
+	if info.ChunkSize <= 0 {
+		return fmt.Errorf("Invalid encryption chunk size %d", info.ChunkSize)
+	}
+	return nil
+}
+
+// S3Metadata returns the encryption metadata to store with the
+// S3 object. These are sent as x-amz-meta-* headers.
+func (info *EncryptionInfo) S3Metadata() (map[string][]string) {
+	return map[string][]string{
+		"encryption":             []string{info.Algorithm},
+		"encryption-chunk-size":  []string{strconv.Itoa(info.ChunkSize)},
+		"encryption-key-wrap":    []string{info.KeyWrapAlgorithm},
+		"encryption-key-id":      []string{info.KeyId},
+		"encryption-wrapped-key": []string{info.WrappedKey},
+	}
+}
+
+// EncryptionInfoFromS3Headers reads the encryption metadata from
+// the headers of an S3 HEAD or GET response. It returns nil if the
+// object is not encrypted, and an error if the metadata is
+// incomplete or describes an encryption scheme we don't support.
+// EncryptedSize comes from the Content-Length header, if present.
+func EncryptionInfoFromS3Headers(header http.Header) (*EncryptionInfo, error) {
+	algorithm := header.Get("X-Amz-Meta-Encryption")
+	if algorithm == "" {
+		return nil, nil
+	}
+	chunkSize, err := strconv.Atoi(header.Get("X-Amz-Meta-Encryption-Chunk-Size"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encryption chunk size in S3 metadata: %v", err)
+	}
+	info := &EncryptionInfo{
+		Algorithm:        algorithm,
+		ChunkSize:        chunkSize,
+		KeyWrapAlgorithm: header.Get("X-Amz-Meta-Encryption-Key-Wrap"),
+		KeyId:            header.Get("X-Amz-Meta-Encryption-Key-Id"),
+		WrappedKey:       header.Get("X-Amz-Meta-Encryption-Wrapped-Key"),
+	}
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		info.EncryptedSize, _ = strconv.ParseInt(contentLength, 10, 64)
+	}
+	if info.WrappedKey == "" {
+		return nil, fmt.Errorf("S3 metadata says object is encrypted, but has no wrapped key")
+	}
+	if err = info.validate(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// KeyWrapper wraps and unwraps data keys with an institution's
+// key. RSAKeyWrapper is the only implementation for now. Other
+// implementations, such as one that calls a key management service,
+// need only return a different Algorithm.
+type KeyWrapper interface {
+	KeyId() (string)
+	Algorithm() (string)
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// RSAKeyWrapper wraps data keys with an RSA public key, using
+// RSA-OAEP with SHA-256. It can unwrap keys only if it has the
+// private key.
+type RSAKeyWrapper struct {
+	keyId      string
+	publicKey  *rsa.PublicKey
+	privateKey *rsa.PrivateKey
+}
+
+// NewRSAKeyWrapper returns a KeyWrapper that uses the specified
+// keys. privateKey may be nil. If publicKey is nil, we use the
+// public half of privateKey.
+func NewRSAKeyWrapper(keyId string, publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey) (*RSAKeyWrapper, error) {
+	if keyId == "" {
+		return nil, fmt.Errorf("Param keyId cannot be empty")
+	}
+	if publicKey == nil && privateKey != nil {
+		publicKey = &privateKey.PublicKey
+	}
+	if publicKey == nil {
+		return nil, fmt.Errorf("Key %s needs a public key, a private key, or both", keyId)
+	}
+	return &RSAKeyWrapper{
+		keyId:      keyId,
+		publicKey:  publicKey,
+		privateKey: privateKey,
+	}, nil
+}
+
+// LoadRSAKeyWrapper loads PEM-encoded keys from the specified files.
+// Either file name may be empty, but not both. The public key may be
+// in PKIX ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY") format, and
+// the private key in PKCS #1 ("RSA PRIVATE KEY") or PKCS #8
+// ("PRIVATE KEY") format.
+func LoadRSAKeyWrapper(keyId, publicKeyFile, privateKeyFile string) (*RSAKeyWrapper, error) {
+	var publicKey *rsa.PublicKey
+	var privateKey *rsa.PrivateKey
+	if publicKeyFile != "" {
+		block, err := readPemFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err = parseRSAPublicKey(block)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse public key in %s: %v", publicKeyFile, err)
+		}
+	}
+	if privateKeyFile != "" {
+		block, err := readPemFile(privateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err = parseRSAPrivateKey(block)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse private key in %s: %v", privateKeyFile, err)
+		}
+	}
+	return NewRSAKeyWrapper(keyId, publicKey, privateKey)
+}
+
+func readPemFile(fileName string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read key file: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Key file %s does not contain PEM data", fileName)
+	}
+	return block, nil
+}
+
+func parseRSAPublicKey(block *pem.Block) (*rsa.PublicKey, error) {
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func parseRSAPrivateKey(block *pem.Block) (*rsa.PrivateKey, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func (wrapper *RSAKeyWrapper) KeyId() (string) {
+	return wrapper.keyId
+}
+
+func (wrapper *RSAKeyWrapper) Algorithm() (string) {
+	return KEY_WRAP_RSA_OAEP
+}
+
+func (wrapper *RSAKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, wrapper.publicKey, dataKey, nil)
+}
+
+func (wrapper *RSAKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	if wrapper.privateKey == nil {
+		return nil, fmt.Errorf("Cannot unwrap data key: no private key for key %s",
+			wrapper.keyId)
+	}
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, wrapper.privateKey, wrappedKey, nil)
+}
+
+// NewDataKey generates a random data key for one file and wraps it
+// with wrapper. It returns the data key, which must never be stored,
+// and the EncryptionInfo to store with the encrypted file.
+func NewDataKey(wrapper KeyWrapper) ([]byte, *EncryptionInfo, error) {
+	dataKey := make([]byte, ENCRYPTION_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, fmt.Errorf("Cannot generate data key: %v", err)
+	}
+	wrappedKey, err := wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot wrap data key with key %s: %v",
+			wrapper.KeyId(), err)
+	}
+	info := &EncryptionInfo{
+		Algorithm:        ENCRYPTION_ALGORITHM,
+		ChunkSize:        ENCRYPTION_CHUNK_SIZE,
+		KeyWrapAlgorithm: wrapper.Algorithm(),
+		KeyId:            wrapper.KeyId(),
+		WrappedKey:       base64.StdEncoding.EncodeToString(wrappedKey),
+	}
+	return dataKey, info, nil
+}
+
+// UnwrapDataKey returns the data key for the file that info
+// describes. wrapper must hold the private half of the key that
+// wrapped the data key.
+func (info *EncryptionInfo) UnwrapDataKey(wrapper KeyWrapper) ([]byte, error) {
+	if err := info.validate(); err != nil {
+		return nil, err
+	}
+	if info.KeyId != wrapper.KeyId() || info.KeyWrapAlgorithm != wrapper.Algorithm() {
+		return nil, fmt.Errorf("Data key was wrapped with %s key %s, but we have %s key %s",
+			info.KeyWrapAlgorithm, info.KeyId, wrapper.Algorithm(), wrapper.KeyId())
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(info.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("Wrapped data key is not valid base64: %v", err)
+	}
+	dataKey, err := wrapper.UnwrapKey(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataKey) != ENCRYPTION_KEY_SIZE {
+		return nil, fmt.Errorf("Unwrapped data key is %d bytes, expected %d",
+			len(dataKey), ENCRYPTION_KEY_SIZE)
+	}
+	return dataKey, nil
+}
+
+// EncryptedSize returns the size of the encrypted version of a
+// file of plainSize bytes.
+func EncryptedSize(plainSize int64, chunkSize int) (int64) {
+	chunks := plainSize / int64(chunkSize)
+	if plainSize == 0 || plainSize % int64(chunkSize) != 0 {
+		chunks++
+	}
+	return plainSize + chunks * ENCRYPTION_TAG_SIZE
+}
+
+// DecryptionError means a chunk of an encrypted file could not be
+// authenticated: the ciphertext was corrupted, truncated or altered,
+// or we have the wrong data key. Unlike I/O errors, retrying won't
+// help.
+type DecryptionError struct {
+	Chunk uint64
+}
+
+func (err *DecryptionError) Error() string {
+	return fmt.Sprintf("Decryption failed at chunk %d: ciphertext is corrupt, "+
+		"truncated or was encrypted with a different key", err.Chunk)
+}
+
+// Returns true if err is a DecryptionError.
+func IsDecryptionError(err error) (bool) {
+	_, ok := err.(*DecryptionError)
+	return ok
+}
+
+func newChunkCipher(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != ENCRYPTION_KEY_SIZE {
+		return nil, fmt.Errorf("Data key must be %d bytes, not %d",
+			ENCRYPTION_KEY_SIZE, len(dataKey))
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(chunkNumber uint64, final bool) ([]byte) {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, chunkNumber)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Reads up to len(buf) bytes from source, and returns the number of
+// bytes read and whether they are the last bytes in the stream.
+func readChunk(source *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(source, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	_, err = source.Peek(1)
+	if err == io.EOF {
+		return n, true, nil
+	}
+	return n, false, err
+}
+
+// EncryptingReader encrypts the stream it reads from source. It
+// calculates the plaintext md5 and sha256 digests and the ciphertext
+// sha256 digest as it goes, so we can verify the plaintext we
+// encrypted matches the checksums we're about to record.
+type EncryptingReader struct {
+	source       *bufio.Reader
+	aead         cipher.AEAD
+	chunkNumber  uint64
+	plaintext    []byte
+	sealed       []byte
+	pending      []byte
+	done         bool
+	plainMd5     hash.Hash
+	plainSha256  hash.Hash
+	cipherSha256 hash.Hash
+}
+
+// NewEncryptingReader returns a reader that encrypts source with
+// dataKey, in chunks of chunkSize plaintext bytes.
+func NewEncryptingReader(source io.Reader, dataKey []byte, chunkSize int) (*EncryptingReader, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("Encryption chunk size must be greater than zero")
+	}
+	aead, err := newChunkCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptingReader{
+		source:       bufio.NewReaderSize(source, chunkSize + 1),
+		aead:         aead,
+		plaintext:    make([]byte, chunkSize),
+		sealed:       make([]byte, 0, chunkSize + aead.Overhead()),
+		plainMd5:     md5.New(),
+		plainSha256:  sha256.New(),
+		cipherSha256: sha256.New(),
+	}, nil
+}
+
+func (reader *EncryptingReader) Read(p []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		if err := reader.sealNextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+func (reader *EncryptingReader) sealNextChunk() (error) {
+	n, final, err := readChunk(reader.source, reader.plaintext)
+	if err != nil {
+		return err
+	}
+	chunk := reader.plaintext[:n]
+	reader.plainMd5.Write(chunk)
+	reader.plainSha256.Write(chunk)
+	reader.sealed = reader.aead.Seal(reader.sealed[:0],
+		chunkNonce(reader.chunkNumber, final), chunk, nil)
+	reader.cipherSha256.Write(reader.sealed)
+	reader.pending = reader.sealed
+	reader.chunkNumber++
+	reader.done = final
+	return nil
+}
+
+// Returns the hex md5 digest of the plaintext read so far.
+func (reader *EncryptingReader) PlaintextMd5() (string) {
+	return fmt.Sprintf("%x", reader.plainMd5.Sum(nil))
+}
+
+// Returns the hex sha256 digest of the plaintext read so far.
+func (reader *EncryptingReader) PlaintextSha256() (string) {
+	return fmt.Sprintf("%x", reader.plainSha256.Sum(nil))
+}
+
+// Returns the hex sha256 digest of the ciphertext returned so far.
+func (reader *EncryptingReader) CiphertextSha256() (string) {
+	return fmt.Sprintf("%x", reader.cipherSha256.Sum(nil))
+}
+
+// DecryptStream decrypts src, which must have been encrypted with
+// dataKey in chunks of chunkSize plaintext bytes, and writes the
+// plaintext to dst. It returns the number of plaintext bytes written.
+// Chunks are authenticated before they're written, so dst never
+// receives unauthenticated plaintext, but it may receive the first
+// part of a file whose later chunks fail authentication. In that
+// case, the error is a DecryptionError.
+func DecryptStream(dst io.Writer, src io.Reader, dataKey []byte, chunkSize int) (int64, error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("Encryption chunk size must be greater than zero")
+	}
+	aead, err := newChunkCipher(dataKey)
+	if err != nil {
+		return 0, err
+	}
+	source := bufio.NewReaderSize(src, chunkSize + aead.Overhead() + 1)
+	sealed := make([]byte, chunkSize + aead.Overhead())
+	plaintext := make([]byte, 0, chunkSize)
+	written := int64(0)
+	for chunkNumber := uint64(0); ; chunkNumber++ {
+		n, final, err := readChunk(source, sealed)
+		if err != nil {
+			return written, err
+		}
+		plaintext, err = aead.Open(plaintext[:0], chunkNonce(chunkNumber, final),
+			sealed[:n], nil)
+		if err != nil {
+			return written, &DecryptionError{Chunk: chunkNumber}
+		}
+		bytesWritten, err := dst.Write(plaintext)
+		written += int64(bytesWritten)
+		if err != nil {
+			return written, err
+		}
+		if final {
+			return written, nil
+		}
+	}
+}
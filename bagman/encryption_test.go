@@ -0,0 +1,362 @@
+package bagman_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testRSAKey *rsa.PrivateKey
+var testRSAKeyOnce sync.Once
+
+// Returns an RSA key for tests. Generating one takes a moment,
+// so we share it.
+func getTestRSAKey(t *testing.T) (*rsa.PrivateKey) {
+	testRSAKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRSAKey = key
+	})
+	return testRSAKey
+}
+
+// Writes the test key pair to PEM files in dir, and returns
+// the paths to the public and private key files.
+func writeTestKeyFiles(t *testing.T, dir string) (string, string) {
+	key := getTestRSAKey(t)
+	publicDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyFile := filepath.Join(dir, "public.pem")
+	privateKeyFile := filepath.Join(dir, "private.pem")
+	err = ioutil.WriteFile(publicKeyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(privateKeyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKeyFile, privateKeyFile
+}
+
+func getTestKeyWrapper(t *testing.T) (*bagman.RSAKeyWrapper) {
+	wrapper, err := bagman.NewRSAKeyWrapper("test.edu-1", nil, getTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapper
+}
+
+func TestKeyWrapRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	publicKeyFile, privateKeyFile := writeTestKeyFiles(t, dir)
+
+	// Hosts that only store files have only the public key.
+	encryptOnly, err := bagman.LoadRSAKeyWrapper("test.edu-1", publicKeyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, info, err := bagman.NewDataKey(encryptOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataKey) != bagman.ENCRYPTION_KEY_SIZE {
+		t.Errorf("Data key is %d bytes, expected %d", len(dataKey), bagman.ENCRYPTION_KEY_SIZE)
+	}
+	if info.Algorithm != bagman.ENCRYPTION_ALGORITHM || info.KeyId != "test.edu-1" ||
+		info.KeyWrapAlgorithm != bagman.KEY_WRAP_RSA_OAEP ||
+		info.ChunkSize != bagman.ENCRYPTION_CHUNK_SIZE {
+		t.Errorf("Unexpected EncryptionInfo: %+v", info)
+	}
+	if strings.Contains(info.WrappedKey, fmt.Sprintf("%x", dataKey)) {
+		t.Errorf("Wrapped key should not contain the data key")
+	}
+	if _, err = info.UnwrapDataKey(encryptOnly); err == nil {
+		t.Errorf("UnwrapDataKey should fail without the private key")
+	}
+
+	// Restore hosts have the private key.
+	decrypter, err := bagman.LoadRSAKeyWrapper("test.edu-1", "", privateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := info.UnwrapDataKey(decrypter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("Unwrapped key does not match original data key")
+	}
+
+	// Key ids must match, so we know we have the right key.
+	otherKey, _ := bagman.LoadRSAKeyWrapper("test.edu-2", "", privateKeyFile)
+	_, err = info.UnwrapDataKey(otherKey)
+	if err == nil || !strings.Contains(err.Error(), "test.edu-1") {
+		t.Errorf("UnwrapDataKey should reject the wrong key id, got %v", err)
+	}
+
+	// No keys at all.
+	if _, err = bagman.LoadRSAKeyWrapper("test.edu-1", "", ""); err == nil {
+		t.Errorf("LoadRSAKeyWrapper should require at least one key")
+	}
+	if _, err = bagman.LoadRSAKeyWrapper("test.edu-1", filepath.Join(dir, "nope.pem"), ""); err == nil {
+		t.Errorf("LoadRSAKeyWrapper should fail on missing key file")
+	}
+}
+
+func encryptBytes(t *testing.T, plaintext, dataKey []byte, chunkSize int) (*bagman.EncryptingReader, []byte) {
+	reader, err := bagman.NewEncryptingReader(bytes.NewReader(plaintext), dataKey, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader, ciphertext
+}
+
+func TestEncryptDecryptStream(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{7}, bagman.ENCRYPTION_KEY_SIZE)
+	chunkSize := 16
+	// Empty, partial chunk, exact chunks, and chunks plus a bit.
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 53} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		reader, ciphertext := encryptBytes(t, plaintext, dataKey, chunkSize)
+
+		expectedSize := bagman.EncryptedSize(int64(size), chunkSize)
+		if int64(len(ciphertext)) != expectedSize {
+			t.Errorf("Size %d: ciphertext is %d bytes, EncryptedSize says %d",
+				size, len(ciphertext), expectedSize)
+		}
+		if reader.PlaintextMd5() != fmt.Sprintf("%x", md5.Sum(plaintext)) {
+			t.Errorf("Size %d: wrong plaintext md5", size)
+		}
+		if reader.PlaintextSha256() != fmt.Sprintf("%x", sha256.Sum256(plaintext)) {
+			t.Errorf("Size %d: wrong plaintext sha256", size)
+		}
+		if reader.CiphertextSha256() != fmt.Sprintf("%x", sha256.Sum256(ciphertext)) {
+			t.Errorf("Size %d: wrong ciphertext sha256", size)
+		}
+		if size > 0 && bytes.Contains(ciphertext, plaintext) {
+			t.Errorf("Size %d: ciphertext contains plaintext", size)
+		}
+
+		decrypted := &bytes.Buffer{}
+		written, err := bagman.DecryptStream(decrypted, bytes.NewReader(ciphertext), dataKey, chunkSize)
+		if err != nil {
+			t.Errorf("Size %d: %v", size, err)
+			continue
+		}
+		if written != int64(size) || !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("Size %d: decrypted data does not match plaintext", size)
+		}
+	}
+}
+
+// Encryption is deterministic for a given key, so store
+// retries produce the same object.
+func TestEncryptionIsRepeatable(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{9}, bagman.ENCRYPTION_KEY_SIZE)
+	plaintext := []byte("The same plaintext, encrypted twice")
+	_, first := encryptBytes(t, plaintext, dataKey, 8)
+	_, second := encryptBytes(t, plaintext, dataKey, 8)
+	if !bytes.Equal(first, second) {
+		t.Errorf("Encrypting the same plaintext with the same key gave different results")
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{7}, bagman.ENCRYPTION_KEY_SIZE)
+	chunkSize := 16
+	chunkLength := chunkSize + bagman.ENCRYPTION_TAG_SIZE
+	plaintext := bytes.Repeat([]byte("abcdefgh"), 6) // three full chunks
+	_, ciphertext := encryptBytes(t, plaintext, dataKey, chunkSize)
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[chunkLength + 3] ^= 1
+	wrongKey := bytes.Repeat([]byte{8}, bagman.ENCRYPTION_KEY_SIZE)
+
+	testCases := []struct {
+		name       string
+		ciphertext []byte
+		key        []byte
+		chunk      uint64
+	}{
+		{"flipped bit", flipped, dataKey, 1},
+		{"truncated at chunk boundary", ciphertext[:2*chunkLength], dataKey, 1},
+		{"truncated mid-chunk", ciphertext[:len(ciphertext)-5], dataKey, 2},
+		{"extra chunk appended", append(append([]byte{}, ciphertext...), ciphertext[:chunkLength]...), dataKey, 2},
+		{"empty", []byte{}, dataKey, 0},
+		{"wrong key", ciphertext, wrongKey, 0},
+	}
+	for _, tc := range testCases {
+		_, err := bagman.DecryptStream(ioutil.Discard, bytes.NewReader(tc.ciphertext), tc.key, chunkSize)
+		if !bagman.IsDecryptionError(err) {
+			t.Errorf("%s: expected DecryptionError, got %v", tc.name, err)
+			continue
+		}
+		if err.(*bagman.DecryptionError).Chunk != tc.chunk {
+			t.Errorf("%s: decryption failed at chunk %d, expected %d",
+				tc.name, err.(*bagman.DecryptionError).Chunk, tc.chunk)
+		}
+	}
+}
+
+func TestEncryptionInfoS3MetadataRoundTrip(t *testing.T) {
+	_, info, err := bagman.NewDataKey(getTestKeyWrapper(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.EncryptedSize = 12345
+
+	// The S3 client sends each metadata key as an x-amz-meta-* header.
+	header := http.Header{}
+	for key, value := range info.S3Metadata() {
+		header.Set("x-amz-meta-"+key, value[0])
+	}
+	header.Set("Content-Length", "12345")
+	fromHeaders, err := bagman.EncryptionInfoFromS3Headers(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, fromHeaders) {
+		t.Errorf("EncryptionInfo changed in S3 metadata round trip.\nBefore: %+v\nAfter:  %+v",
+			info, fromHeaders)
+	}
+
+	// Unencrypted objects have no encryption metadata.
+	fromHeaders, err = bagman.EncryptionInfoFromS3Headers(http.Header{})
+	if fromHeaders != nil || err != nil {
+		t.Errorf("Expected nil info and no error for unencrypted object, got %v, %v",
+			fromHeaders, err)
+	}
+
+	// Encrypted, but the wrapped key is gone.
+	header.Del("X-Amz-Meta-Encryption-Wrapped-Key")
+	if _, err = bagman.EncryptionInfoFromS3Headers(header); err == nil {
+		t.Errorf("EncryptionInfoFromS3Headers should reject metadata with no wrapped key")
+	}
+}
+
+func TestEncryptionConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	publicKeyFile, privateKeyFile := writeTestKeyFiles(t, dir)
+	config := bagman.Config{
+		Encryption: map[string]bagman.EncryptionConfig{
+			"test.edu": bagman.EncryptionConfig{
+				KeyId:          "test.edu-1",
+				PublicKeyFile:  publicKeyFile,
+				PrivateKeyFile: privateKeyFile,
+				FixityMode:     bagman.FIXITY_MODE_DECRYPT,
+			},
+			"default.edu": bagman.EncryptionConfig{
+				KeyId:         "default.edu-1",
+				PublicKeyFile: publicKeyFile,
+			},
+			"typo.edu": bagman.EncryptionConfig{
+				KeyId:         "typo.edu-1",
+				PublicKeyFile: publicKeyFile,
+				FixityMode:    "sometimes",
+			},
+		},
+	}
+	wrapper, err := config.KeyWrapperFor("test.edu")
+	if err != nil || wrapper == nil || wrapper.KeyId() != "test.edu-1" {
+		t.Errorf("Expected key wrapper for test.edu, got %v, %v", wrapper, err)
+	}
+	wrapper, err = config.KeyWrapperFor("plain.edu")
+	if wrapper != nil || err != nil {
+		t.Errorf("plain.edu is not encrypted, but got key wrapper %v, %v", wrapper, err)
+	}
+
+	expectedModes := map[string]string{
+		"test.edu":    bagman.FIXITY_MODE_DECRYPT,
+		"default.edu": bagman.FIXITY_MODE_CIPHERTEXT,
+		"plain.edu":   bagman.FIXITY_MODE_CIPHERTEXT,
+	}
+	for institution, expected := range expectedModes {
+		mode, err := config.EncryptedFixityMode(institution)
+		if err != nil || mode != expected {
+			t.Errorf("Fixity mode for %s is '%s' (%v), expected '%s'",
+				institution, mode, err, expected)
+		}
+	}
+	if _, err = config.EncryptedFixityMode("typo.edu"); err == nil {
+		t.Errorf("EncryptedFixityMode should reject mode 'sometimes'")
+	}
+}
+
+func TestEncryptedFixityResult(t *testing.T) {
+	gf := getGenericFile()
+	gf.Encryption = &bagman.EncryptionInfo{
+		Algorithm:       bagman.ENCRYPTION_ALGORITHM,
+		EncryptedSha256: "0a1b2c3d",
+	}
+
+	// Ciphertext mode compares with the digest from ingest,
+	// not the plaintext digest in Fedora.
+	result := bagman.NewFixityResult(gf)
+	result.FixityMode = bagman.FIXITY_MODE_CIPHERTEXT
+	result.Sha256 = "0a1b2c3d"
+	if matches, err := result.Sha256Matches(); !matches || err != nil {
+		t.Errorf("Ciphertext digest should match, got %v, %v", matches, err)
+	}
+	event, err := result.BuildPremisEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Outcome != "success" || !strings.Contains(event.Detail, "encrypted file") {
+		t.Errorf("Unexpected event for ciphertext fixity check: %+v", event)
+	}
+
+	// Decrypt mode compares the plaintext with Fedora.
+	result = bagman.NewFixityResult(gf)
+	result.FixityMode = bagman.FIXITY_MODE_DECRYPT
+	result.Sha256 = sha256sum
+	if matches, err := result.Sha256Matches(); !matches || err != nil {
+		t.Errorf("Plaintext digest should match, got %v, %v", matches, err)
+	}
+
+	// Failed decryption is a failed fixity check.
+	result = bagman.NewFixityResult(gf)
+	result.FixityMode = bagman.FIXITY_MODE_DECRYPT
+	result.DecryptionFailed = true
+	result.ErrorMessage = "Decryption failed at chunk 3"
+	event, err = result.BuildPremisEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Outcome != "failure" || !strings.Contains(event.OutcomeInformation, "chunk 3") {
+		t.Errorf("Unexpected event for failed decryption: %+v", event)
+	}
+}
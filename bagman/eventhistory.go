@@ -0,0 +1,113 @@
+package bagman
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// EventHistoryTagFile is where restored bags keep the PREMIS event
+// history of the object they came from, relative to the bag root.
+const EventHistoryTagFile = "aptrust-tags/premis-events.json"
+
+// EventHistoryTag is the bag-info.txt tag that tells partners where
+// to find the event history.
+const EventHistoryTag = "APTrust-Event-History"
+
+// EventHistoryEntry is one PREMIS event in a restored bag's event
+// history. FileIdentifier is empty for events that describe the
+// object as a whole.
+type EventHistoryEntry struct {
+	ObjectIdentifier   string    `json:"object_identifier"`
+	FileIdentifier     string    `json:"file_identifier,omitempty"`
+	Identifier         string    `json:"identifier"`
+	EventType          string    `json:"type"`
+	DateTime           time.Time `json:"date_time"`
+	Detail             string    `json:"detail"`
+	Outcome            string    `json:"outcome"`
+	OutcomeDetail      string    `json:"outcome_detail"`
+	Object             string    `json:"object"`
+	Agent              string    `json:"agent"`
+	OutcomeInformation string    `json:"outcome_information"`
+}
+
+// EventHistory returns the events of obj, and the events of the
+// files in obj whose identifiers are in files, sorted by file
+// identifier, then date. Object events come first. Events of
+// files that aren't in files are left out, so each part of a
+// multi-part restore describes only the files it contains.
+// Param obj must include its events and its files' events. See
+// FluctusClient.IntellectualObjectGet.
+func EventHistory(obj *IntellectualObject, files []*GenericFile) ([]*EventHistoryEntry) {
+	included := make(map[string]bool, len(files))
+	for _, gf := range files {
+		included[gf.Identifier] = true
+	}
+	entries := make([]*EventHistoryEntry, 0)
+	for _, event := range obj.Events {
+		entries = append(entries, newEventHistoryEntry(obj.Identifier, "", event))
+	}
+	for _, gf := range obj.GenericFiles {
+		if !included[gf.Identifier] {
+			continue
+		}
+		for _, event := range gf.Events {
+			entries = append(entries, newEventHistoryEntry(obj.Identifier, gf.Identifier, event))
+		}
+	}
+	sort.Stable(eventHistoryOrder(entries))
+	return entries
+}
+
+func newEventHistoryEntry(objIdentifier, fileIdentifier string, event *PremisEvent) (*EventHistoryEntry) {
+	return &EventHistoryEntry{
+		ObjectIdentifier:   objIdentifier,
+		FileIdentifier:     fileIdentifier,
+		Identifier:         event.Identifier,
+		EventType:          event.EventType,
+		DateTime:           event.DateTime.UTC(),
+		Detail:             event.Detail,
+		Outcome:            event.Outcome,
+		OutcomeDetail:      event.OutcomeDetail,
+		Object:             event.Object,
+		Agent:              event.Agent,
+		OutcomeInformation: event.OutcomeInformation,
+	}
+}
+
+// RenderEventHistory returns entries as indented JSON. The same
+// entries always render to the same bytes, so restoring an object
+// twice produces identical event history files.
+func RenderEventHistory(entries []*EventHistoryEntry) ([]byte, error) {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Sorts by file identifier, then date. Events with the same file
+// and date are sorted by their other fields, so the order doesn't
+// depend on the order Fluctus returned them in.
+type eventHistoryOrder []*EventHistoryEntry
+
+func (s eventHistoryOrder) Len() int      { return len(s) }
+func (s eventHistoryOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s eventHistoryOrder) Less(i, j int) bool {
+	if s[i].FileIdentifier != s[j].FileIdentifier {
+		return s[i].FileIdentifier < s[j].FileIdentifier
+	}
+	if !s[i].DateTime.Equal(s[j].DateTime) {
+		return s[i].DateTime.Before(s[j].DateTime)
+	}
+	a := []string{s[i].Identifier, s[i].EventType, s[i].Detail, s[i].Outcome,
+		s[i].OutcomeDetail, s[i].Object, s[i].Agent, s[i].OutcomeInformation}
+	b := []string{s[j].Identifier, s[j].EventType, s[j].Detail, s[j].Outcome,
+		s[j].OutcomeDetail, s[j].Object, s[j].Agent, s[j].OutcomeInformation}
+	for k := range a {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return false
+}
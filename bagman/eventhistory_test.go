@@ -0,0 +1,114 @@
+package bagman_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/APTrust/bagman/bagman"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns the object in result_good.json, with its files' events
+// and an object-level event, in the order given.
+func eventHistoryObject(t *testing.T) (*bagman.IntellectualObject) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := result.IntellectualObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Events = []*bagman.PremisEvent{
+		&bagman.PremisEvent{
+			Identifier: "obj-event-2",
+			EventType:  "identifier_assignment",
+			DateTime:   time.Date(2014, 6, 2, 12, 0, 0, 0, time.UTC),
+		},
+		&bagman.PremisEvent{
+			Identifier: "obj-event-1",
+			EventType:  "ingest",
+			DateTime:   time.Date(2014, 6, 1, 8, 0, 0, 0, eastern),
+		},
+	}
+	return obj
+}
+
+func TestEventHistory(t *testing.T) {
+	obj := eventHistoryObject(t)
+	entries := bagman.EventHistory(obj, obj.GenericFiles)
+	expected := len(obj.Events)
+	for _, gf := range obj.GenericFiles {
+		expected += len(gf.Events)
+	}
+	if len(entries) != expected {
+		t.Fatalf("Expected %d events, got %d", expected, len(entries))
+	}
+	// Object events come first, by date.
+	if entries[0].Identifier != "obj-event-1" || entries[1].Identifier != "obj-event-2" {
+		t.Errorf("Object events should come first, oldest first: got %s, %s",
+			entries[0].Identifier, entries[1].Identifier)
+	}
+	if entries[0].DateTime.Location() != time.UTC {
+		t.Errorf("Event dates should be in UTC")
+	}
+	for i := 1; i < len(entries); i++ {
+		prev, entry := entries[i-1], entries[i]
+		if entry.ObjectIdentifier != obj.Identifier {
+			t.Errorf("Entry %d has object identifier %s", i, entry.ObjectIdentifier)
+		}
+		if entry.FileIdentifier < prev.FileIdentifier ||
+			(entry.FileIdentifier == prev.FileIdentifier && entry.DateTime.Before(prev.DateTime)) {
+			t.Errorf("Entry %d (%s %v) is out of order", i, entry.FileIdentifier, entry.DateTime)
+		}
+	}
+}
+
+func TestEventHistoryFiltersExcludedFiles(t *testing.T) {
+	obj := eventHistoryObject(t)
+	included := obj.GenericFiles[1:2]
+	entries := bagman.EventHistory(obj, included)
+	if len(entries) != len(obj.Events) + len(included[0].Events) {
+		t.Fatalf("Expected %d events, got %d", len(obj.Events) + len(included[0].Events), len(entries))
+	}
+	for _, entry := range entries {
+		if entry.FileIdentifier != "" && entry.FileIdentifier != included[0].Identifier {
+			t.Errorf("Event history includes event for excluded file %s", entry.FileIdentifier)
+		}
+	}
+}
+
+func TestRenderEventHistoryIsDeterministic(t *testing.T) {
+	obj := eventHistoryObject(t)
+	first, err := bagman.RenderEventHistory(bagman.EventHistory(obj, obj.GenericFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fluctus may return files and events in any order.
+	for i, j := 0, len(obj.GenericFiles)-1; i < j; i, j = i+1, j-1 {
+		obj.GenericFiles[i], obj.GenericFiles[j] = obj.GenericFiles[j], obj.GenericFiles[i]
+	}
+	for _, gf := range obj.GenericFiles {
+		for i, j := 0, len(gf.Events)-1; i < j; i, j = i+1, j-1 {
+			gf.Events[i], gf.Events[j] = gf.Events[j], gf.Events[i]
+		}
+	}
+	obj.Events[0], obj.Events[1] = obj.Events[1], obj.Events[0]
+	second, err := bagman.RenderEventHistory(bagman.EventHistory(obj, obj.GenericFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("Rendering the same events in a different order produced different output")
+	}
+
+	parsed := make([]*bagman.EventHistoryEntry, 0)
+	if err = json.Unmarshal(first, &parsed); err != nil {
+		t.Fatalf("Rendered event history is not valid JSON: %v", err)
+	}
+	if len(parsed) == 0 || parsed[0].Identifier != "obj-event-1" {
+		t.Errorf("Rendered event history did not round trip")
+	}
+}
@@ -0,0 +1,307 @@
+// +build !partners
+
+// Don't include this in the partners build: it's for the admins
+// who triage our trouble queues, and it uses Volume's errors.
+
+package bagman
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FailureClass says what kind of problem sent an item to the
+// trouble queue.
+type FailureClass string
+
+const (
+	FailureFluctus         FailureClass = "FluctusError"
+	FailureS3                           = "S3Error"
+	FailureS3Timeout                    = "S3Timeout"
+	FailureNetwork                      = "NetworkError"
+	FailureDiskSpace                    = "DiskSpace"
+	FailureInvalidBag                   = "InvalidBag"
+	FailureBadBagName                   = "BadBagName"
+	FailureBagTooLarge                  = "BagTooLarge"
+	FailureMissingBag                   = "MissingBag"
+	FailureFetchChecksum                = "FetchChecksum"
+	FailureStorageMismatch              = "StorageMismatch"
+	FailureFileCount                    = "FileCountMismatch"
+	FailureDecryption                   = "DecryptionError"
+	FailureEncryptionKeys               = "EncryptionKeys"
+	FailureQueue                        = "QueueError"
+	FailurePanic                        = "Panic"
+	FailureDPNNode                      = "DPNNodeError"
+	FailureDPNCopy                      = "DPNCopyError"
+	FailureCancelled                    = "TransferCancelled"
+	FailureUnknown                      = "Unknown"
+)
+
+// FailureRemediations is the suggested next action for each class
+// of failure.
+var FailureRemediations = map[FailureClass]string{
+	FailureFluctus:         "Requeue after Fluctus recovers. If Fluctus is up, check its log for the request that failed.",
+	FailureS3:              "Requeue. If S3 keeps failing, check the AWS status page and our credentials.",
+	FailureS3Timeout:       "Requeue. If it times out again, check the network or raise S3OperationTimeout.",
+	FailureNetwork:         "Requeue once the network problem is resolved.",
+	FailureDiskSpace:       "Free up space on the staging volume, then requeue.",
+	FailureInvalidBag:      "Invalid bag. Contact the depositor with the error; they need to fix the bag and upload it again.",
+	FailureBadBagName:      "Contact the depositor. The tar file name is invalid, so they need to rename the bag and upload it again.",
+	FailureBagTooLarge:     "Contact the depositor. They need to split the bag into a multipart bag under the size limit.",
+	FailureMissingBag:      "The bag is gone from the receiving bucket. Ask the depositor whether they deleted it, then mark the item resolved.",
+	FailureFetchChecksum:   "Requeue to download the bag again. If the md5 still doesn't match, the upload is corrupt; contact the depositor.",
+	FailureStorageMismatch: "Don't requeue or delete anything. A stored file doesn't match the bag manifest; compare the preservation copy with the bag.",
+	FailureFileCount:       "Don't requeue or delete anything. Files went missing between stages without an error; check the listed files in the preservation bucket and Fluctus, and find out why.",
+	FailureDecryption:      "Don't requeue. Check that the institution's encryption keys are right, then check the stored file for corruption.",
+	FailureEncryptionKeys:  "Fix the institution's encryption key configuration, then requeue.",
+	FailureQueue:           "Check that nsqd is running, then requeue.",
+	FailurePanic:           "This is a bug. Open an issue with the stack trace from the result JSON, and requeue after the fix is deployed.",
+	FailureDPNNode:         "Check that the DPN node is reachable and our API token is valid, then requeue.",
+	FailureDPNCopy:         "Check that we can rsync from the remote node over ssh, then requeue.",
+	FailureCancelled:       "The remote node cancelled the transfer. Mark the item resolved; nothing else to do.",
+	FailureUnknown:         "Unrecognized error. Read the full result JSON to find the cause.",
+}
+
+// Error messages longer than this are truncated in failure reports.
+const MAX_FAILURE_ERROR_LENGTH = 500
+
+// These are added to error messages when items go to the trouble
+// queue. They don't say anything about the failure.
+var troubleBoilerplate = []string{
+	"This item has been queued for administrative review.",
+	"Processing failed and we reached the maximum number of retries.",
+}
+
+type failurePattern struct {
+	class   FailureClass
+	pattern *regexp.Regexp
+}
+
+// Known error messages, most specific first. Messages we produce
+// from typed errors are here too, because results lose the type
+// of their errors when they go through the queue as JSON.
+var failurePatterns = []failurePattern{
+	{FailureFileCount, regexp.MustCompile(`\[FILE COUNT MISMATCH\]`)},
+	{FailurePanic, regexp.MustCompile(`Panic in stage `)},
+	{FailureDiskSpace, regexp.MustCompile(`(?i)bytes \(.*\) on volume, but only|no space left on device|not enough disk space`)},
+	{FailureS3Timeout, regexp.MustCompile(`S3 \S+ operation timed out after`)},
+	{FailureDecryption, regexp.MustCompile(`Decryption failed at chunk`)},
+	{FailureEncryptionKeys, regexp.MustCompile(`Cannot load encryption keys for`)},
+	{FailureBadBagName, regexp.MustCompile(`is not a valid bag name`)},
+	{FailureBagTooLarge, regexp.MustCompile(`bag too large`)},
+	{FailureMissingBag, regexp.MustCompile(`key does not exist`)},
+	{FailureCancelled, regexp.MustCompile(`marked as cancelled on the remote node|cancels the transfer request`)},
+	{FailureQueue, regexp.MustCompile(`(?i)to \S+ queue: |nsqd`)},
+	{FailureStorageMismatch, regexp.MustCompile(`Stored file .* but the bag manifest says|failed its fixity check`)},
+	{FailureFetchChecksum, regexp.MustCompile(`does not match the S3 md5 sum|copied only \d+ of \d+ bytes`)},
+	{FailureInvalidBag, regexp.MustCompile(`Bag is missing|is missing from|Bag's data directory|` +
+		`Required (field|tag|checksum file)|checksums could not be verified|[Aa]ccess \(rights\) value|` +
+		`Invalid file name|does not conform to naming|should be in format dir/filename|` +
+		`should untar to|Payload-Oxum|DPN tag |Bag name is not valid|Error unpacking bag|` +
+		`Error reading tags from|Could not open file .* for untarring|BagIt profile`)},
+	{FailureFluctus, regexp.MustCompile(`Fluctus|Fedora|GenericFileSave|ProcessedItem|PremisEvent|PREMIS event|IntellectualObject`)},
+	{FailureDPNNode, regexp.MustCompile(`DPN|[Rr]emote node|transfer request|copy receipt|storage receipt|replication requests`)},
+	{FailureDPNCopy, regexp.MustCompile(`rsync`)},
+	{FailureS3, regexp.MustCompile(`S3|long-term storage|receiving bucket|preservation bucket|[Bb]ucket '`)},
+	{FailureNetwork, regexp.MustCompile(`(?i)connection reset by peer|connection refused|no such host|i/o timeout|` +
+		`broken pipe|network is unreachable|TLS handshake timeout|unexpected EOF`)},
+}
+
+// ClassifyErrorMessage returns the class of failure that message
+// describes, or FailureUnknown.
+func ClassifyErrorMessage(message string) (FailureClass) {
+	for _, known := range failurePatterns {
+		if known.pattern.MatchString(message) {
+			return known.class
+		}
+	}
+	return FailureUnknown
+}
+
+// ClassifyError returns the class of failure that err describes.
+// Typed errors are classified by type; other errors by message.
+func ClassifyError(err error) (FailureClass) {
+	switch err.(type) {
+	case nil:
+		return FailureUnknown
+	case *StagePanic:
+		return FailurePanic
+	case *InsufficientSpaceError:
+		return FailureDiskSpace
+	case *S3TimeoutError:
+		return FailureS3Timeout
+	case *DecryptionError:
+		return FailureDecryption
+	case *BagNameError:
+		return FailureBadBagName
+	case *FileCountError:
+		return FailureFileCount
+	case *net.DNSError, *net.OpError:
+		return FailureNetwork
+	}
+	return ClassifyErrorMessage(err.Error())
+}
+
+// SuggestedAction returns the remediation for class. For disk space
+// failures, it names the directory that holds localPath, if we know
+// localPath.
+func SuggestedAction(class FailureClass, localPath string) (string) {
+	if class == FailureDiskSpace && localPath != "" {
+		return fmt.Sprintf("Free up space on the volume that holds %s, then requeue.",
+			filepath.Dir(localPath))
+	}
+	if remediation, ok := FailureRemediations[class]; ok {
+		return remediation
+	}
+	return FailureRemediations[FailureUnknown]
+}
+
+// FailureReport is a compact description of an item in the trouble
+// queue, for the admins who triage it. The full result is still
+// dumped alongside it.
+type FailureReport struct {
+	Classification FailureClass `json:"classification"`
+	Error          string       `json:"error"`
+	ErrorCount     int          `json:"error_count"`
+	Stage          string       `json:"stage"`
+	Bag            string       `json:"bag"`
+	Institution    string       `json:"institution,omitempty"`
+	BagSize        int64        `json:"bag_size"`
+	FileCount      int          `json:"file_count"`
+	FilesStored    int          `json:"files_stored"`
+	BytesStored    int64        `json:"bytes_stored"`
+	LocalPath      string       `json:"local_path,omitempty"`
+	Retry          bool         `json:"retry"`
+	Remediation    string       `json:"remediation"`
+}
+
+// NewFailureReport returns a report with the classification, error
+// and error count filled in from errorMessages. Put the messages
+// most likely to describe the failure first, such as the error from
+// the stage where processing stopped. The report's error is the
+// first message we can classify, or the first message if we can't
+// classify any. The caller fills in the rest of the report.
+func NewFailureReport(errorMessages []string) (*FailureReport) {
+	report := &FailureReport{Classification: FailureUnknown}
+	seen := make(map[string]bool)
+	for _, message := range errorMessages {
+		message = cleanTroubleMessage(message)
+		if message == "" || seen[message] {
+			continue
+		}
+		seen[message] = true
+		report.ErrorCount++
+		if report.Error != "" && report.Classification != FailureUnknown {
+			continue
+		}
+		class := ClassifyErrorMessage(message)
+		if report.Error == "" || class != FailureUnknown {
+			report.Error = message
+			report.Classification = class
+		}
+	}
+	if len(report.Error) > MAX_FAILURE_ERROR_LENGTH {
+		report.Error = report.Error[:MAX_FAILURE_ERROR_LENGTH] + "..."
+	}
+	return report
+}
+
+// Removes trouble queue boilerplate and collapses whitespace.
+func cleanTroubleMessage(message string) (string) {
+	for _, boilerplate := range troubleBoilerplate {
+		message = strings.Replace(message, boilerplate, "", -1)
+	}
+	return strings.Join(strings.Fields(message), " ")
+}
+
+// FailureReport returns a report describing why this result failed.
+func (result *ProcessResult) FailureReport() (*FailureReport) {
+	stageErrors := map[StageType]string{}
+	pipelineErrors := make([]string, 0)
+	if result.FetchResult != nil {
+		stageErrors[StageFetch] = result.FetchResult.ErrorMessage
+		pipelineErrors = append(pipelineErrors, result.FetchResult.ErrorMessage)
+	}
+	if result.TarResult != nil {
+		stageErrors[StageUnpack] = result.TarResult.ErrorMessage
+		pipelineErrors = append(pipelineErrors, result.TarResult.ErrorMessage)
+	}
+	if result.BagReadResult != nil {
+		stageErrors[StageValidate] = result.BagReadResult.ErrorMessage
+		pipelineErrors = append(pipelineErrors, result.BagReadResult.ErrorMessage)
+	}
+	if result.FedoraResult != nil {
+		stageErrors[StageRecord] = result.FedoraResult.ErrorMessage
+		pipelineErrors = append(pipelineErrors, result.FedoraResult.ErrorMessage)
+	}
+	messages := append([]string{stageErrors[result.Stage]}, pipelineErrors...)
+	report := NewFailureReport(append(messages, result.ErrorMessage))
+	report.Stage = string(result.Stage)
+	report.Retry = result.Retry
+	if result.S3File != nil {
+		report.Bag = result.S3File.Key.Key
+		report.Institution = OwnerOf(result.S3File.BucketName)
+		report.BagSize = result.S3File.Key.Size
+	}
+	if result.FetchResult != nil {
+		report.LocalPath = result.FetchResult.LocalFile
+	}
+	if result.TarResult != nil {
+		report.FileCount = len(result.TarResult.Files)
+		for _, file := range result.TarResult.Files {
+			if file.StorageURL != "" {
+				report.FilesStored++
+				report.BytesStored += file.Size
+			}
+		}
+	}
+	report.Remediation = SuggestedAction(report.Classification, report.LocalPath)
+	return report
+}
+
+// TriageGroup is a set of failure reports with the same
+// classification.
+type TriageGroup struct {
+	Classification FailureClass
+	Remediation    string
+	Reports        []*FailureReport
+	TotalBytes     int64
+}
+
+// GroupFailureReports groups reports by classification, largest
+// group first. Groups of the same size are sorted by name.
+func GroupFailureReports(reports []*FailureReport) ([]*TriageGroup) {
+	groupFor := make(map[FailureClass]*TriageGroup)
+	groups := make([]*TriageGroup, 0)
+	for _, report := range reports {
+		group := groupFor[report.Classification]
+		if group == nil {
+			group = &TriageGroup{
+				Classification: report.Classification,
+				Remediation:    SuggestedAction(report.Classification, ""),
+				Reports:        make([]*FailureReport, 0),
+			}
+			groupFor[report.Classification] = group
+			groups = append(groups, group)
+		}
+		group.Reports = append(group.Reports, report)
+		group.TotalBytes += report.BagSize
+	}
+	sort.Sort(triageGroupsBySize(groups))
+	return groups
+}
+
+type triageGroupsBySize []*TriageGroup
+
+func (s triageGroupsBySize) Len() int      { return len(s) }
+func (s triageGroupsBySize) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s triageGroupsBySize) Less(i, j int) bool {
+	if len(s[i].Reports) != len(s[j].Reports) {
+		return len(s[i].Reports) > len(s[j].Reports)
+	}
+	return s[i].Classification < s[j].Classification
+}
@@ -0,0 +1,283 @@
+// +build !partners
+
+package bagman_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Error messages from the ingest and DPN logs, with the class each
+// should get.
+var troubleMessages = []struct {
+	message  string
+	expected bagman.FailureClass
+}{
+	// Panics
+	{"Panic in stage store.save: runtime error: invalid memory address or nil pointer dereference", bagman.FailurePanic},
+	{"Error copying file '/mnt/apt/data/test.edu/bag/data/a.pdf'to long-term storage: EOF Panic in stage record.fedora: assignment to entry in nil map", bagman.FailurePanic},
+
+	// Disk space
+	{"Requested 6442450944 bytes (6.0 GB) on volume, but only 2147483648 (2.0 GB) are available", bagman.FailureDiskSpace},
+	{"Requeueing aptrust-1234 from chron (9663676416 bytes) - not enough disk space: Requested 19327352832 bytes (18.0 GB) on volume, but only 1073741824 (1.0 GB) are available", bagman.FailureDiskSpace},
+	{"Error copying file from tar archive to '/mnt/apt/data/virginia.edu/uva-lib_2278801/data/img.tif': write /mnt/apt/data/virginia.edu/uva-lib_2278801/data/img.tif: no space left on device", bagman.FailureDiskSpace},
+
+	// S3 timeouts
+	{"Error copying file '/mnt/apt/data/ncsu.edu/ncsu.1840.16-1028/data/object.properties'to long-term storage: S3 PutReader operation timed out after 10m0s", bagman.FailureS3Timeout},
+	{"Error retrieving file aptrust.receiving.ncsu.edu/ncsu.1840.16-1028.tar: S3 GetReader operation timed out after 1h0m0s", bagman.FailureS3Timeout},
+
+	// Encryption
+	{"Decryption failed at chunk 12: ciphertext is corrupt, truncated or was encrypted with a different key", bagman.FailureDecryption},
+	{"Cannot load encryption keys for virginia.edu: open /home/ubuntu/.keys/virginia.edu.key: no such file or directory", bagman.FailureEncryptionKeys},
+
+	// Bag names and sizes
+	{"'ncsu.1840.16-1028.b01.of00.tar' is not a valid bag name: total number of parts must be greater than zero", bagman.FailureBadBagName},
+	{"bag too large: uva-lib_2278801.tar is 268435456000 bytes, and the size limit for this system is 214748364800 bytes", bagman.FailureBagTooLarge},
+
+	// Missing from the receiving bucket
+	{"Error retrieving file aptrust.receiving.test.edu/sample_bag.tar: The specified key does not exist.", bagman.FailureMissingBag},
+
+	// DPN cancellations
+	{"This transfer request has been marked as cancelled on the remote node. This bag will not be copied to storage.", bagman.FailureCancelled},
+	{"We sent fixity value 'a8b6d4'. Remote node returned fixity_accept value of false for this bag. This cancels the transfer request, and we will not store the bag.", bagman.FailureCancelled},
+
+	// Queues
+	{"Could not send 'test.edu/sample_bag' (at /mnt/dpn/staging/sample_bag.tar) to record queue: No response from nsqd at 'http://127.0.0.1:4151/put?topic=dpn_record_topic'. Is it running?", bagman.FailureQueue},
+	{"nsqd returned status code 500 when attempting to queue data. nsqd response: E_INVALID", bagman.FailureQueue},
+
+	// Checksums
+	{"Stored file data/images/photo.jpg has md5 4d66f1ec9491addded54d17b96df8c96, but the bag manifest says 2b6e3e9a1b5bda55d3fc6a8e8e1b1a3a. ", bagman.FailureStorageMismatch},
+	{"Our md5 sum '8d7b0e3a0b7f4f6d9f3c5b6d2f1e0a9c' does not match the S3 md5 sum '4d66f1ec9491addded54d17b96df8c96'", bagman.FailureFetchChecksum},
+	{"While downloading from receiving bucket, copied only 1048576 of 52428800 bytes for ncsu.1840.16-1028.tar", bagman.FailureFetchChecksum},
+
+	// Invalid bags
+	{"Bag is missing the data directory, which should contain the payload files.", bagman.FailureInvalidBag},
+	{"Required checksum file manifest-md5.txt is missing.", bagman.FailureInvalidBag},
+	{"In tag file, access (rights) value 'public' is not valid.\nRequired field Title is missing from tag file.\n", bagman.FailureInvalidBag},
+	{"The following checksums could not be verified:\n  data/hemingway.txt md5 checksum 8d7b0e3a does not match 4d66f1ec (manifest-md5.txt).\n", bagman.FailureInvalidBag},
+	{"This looks like a multipart bag, but it does not conform to naming conventions. Multipart bags should end with a suffix like '.b01.of12.tar'. See the APTrust BagIt specification for details.", bagman.FailureInvalidBag},
+	{"File sample_bag/tagmanifest.txt in tar archive should be in format dir/filename", bagman.FailureInvalidBag},
+	{" Payload does not match Payload-Oxum: expected 4 files / 86,420 bytes; found 3 / 86,400.\n", bagman.FailureInvalidBag},
+	{" Invalid file name: data/-bad~name.txt", bagman.FailureInvalidBag},
+	{"Required tag 'Ingest-Node-Name' is missing from dpn-tags/dpn-info.txt", bagman.FailureInvalidBag},
+	{"DPN tag Version-Number must be an integer.", bagman.FailureInvalidBag},
+	{"Tar file '/mnt/dpn/staging/4d11736c.tar' should untar to '/mnt/dpn/staging/4d11736c', but it untars to '/mnt/dpn/staging/bag'", bagman.FailureInvalidBag},
+
+	// Fluctus
+	{"Error saving generic file batch to Fedora: GenericFileSaveBatch Expected status code 201 but got 500. URL: http://localhost:3000/api/v1/objects/test.edu%2Fsample_bag/files/save_batch\n Failure is due to a technical error in Fedora. Giving up after 3 failed attempts. ", bagman.FailureFluctus},
+	{"Error saving intellectual object 'test.edu/sample_bag' to Fedora: Error executing POST request for http://fluctus:3000/api/v1/objects: dial tcp 10.0.0.5:3000: connection refused", bagman.FailureFluctus},
+	{"Error updating ProcessedItem status in Fluctus: Fluctus replied to POST /itemresults/search.json with status code 502", bagman.FailureFluctus},
+	{"Error creating DPN ingest PREMIS event for bag 4d11736c-c0ab-44b0-66c6-a947f414d4f1: Fluctus returned status 422", bagman.FailureFluctus},
+
+	// DPN nodes and copies
+	{"Error creating DPN bag 4d11736c-c0ab-44b0-66c6-a947f414d4f1 in our local registry: POST to http://127.0.0.1:8000/api-v1/bag/ returned status code 400. Post data: ...", bagman.FailureDPNNode},
+	{"Can't send copy receipt to chron: Can't get REST client for that node.", bagman.FailureDPNNode},
+	{"Error updating transfer request on remote node: Get https://dpn.hathitrust.org/api-v1/replicate/: x509: certificate has expired or is not yet valid", bagman.FailureDPNNode},
+	{"exit status 23: rsync: link_stat \"/dpn/outbound/4d11736c.tar\" failed: No such file or directory (2)\nrsync error: some files/attrs were not transferred (see previous errors) (code 23) at main.c(1183) [Receiver=3.1.0]\n", bagman.FailureDPNCopy},
+	{"exit status 255: ssh: connect to host dpn.chronopolis.org port 22: Connection refused\r\nrsync: connection unexpectedly closed (0 bytes received so far) [Receiver]", bagman.FailureDPNCopy},
+
+	// S3
+	{"Error copying file '/mnt/apt/data/test.edu/sample_bag/data/a.pdf'to long-term storage: Put https://s3.amazonaws.com/aptrust.preservation.storage/6a2d.pdf: read tcp 10.0.0.5:40312->54.231.1.2:443: read: connection reset by peer ", bagman.FailureS3},
+	{"Some files could not be copied to S3.", bagman.FailureS3},
+	{"Error saving file 'uuid' to bucket 'aptrust.preservation.oregon': 503 Slow Down", bagman.FailureS3},
+
+	// Network
+	{"Get http://apt-util.example.org/: dial tcp: lookup apt-util.example.org: no such host", bagman.FailureNetwork},
+	{"read tcp 10.0.0.5:40312->10.0.0.9:443: read: connection reset by peer", bagman.FailureNetwork},
+	{"Post https://example.org/: net/http: TLS handshake timeout", bagman.FailureNetwork},
+
+	// Unknown
+	{"IngestHelper.SaveFile(): Cannot rewind to beginning of file: seek: bad file descriptor", bagman.FailureUnknown},
+	{"", bagman.FailureUnknown},
+}
+
+func TestClassifyErrorMessage(t *testing.T) {
+	for _, testCase := range troubleMessages {
+		class := bagman.ClassifyErrorMessage(testCase.message)
+		if class != testCase.expected {
+			t.Errorf("Expected %s, got %s for message '%s'", testCase.expected, class, testCase.message)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bagman.FailureClass
+	}{
+		{&bagman.StagePanic{Stage: "prepare.fetch", Value: "boom"}, bagman.FailurePanic},
+		{&bagman.InsufficientSpaceError{Requested: 100, Available: 10}, bagman.FailureDiskSpace},
+		{&bagman.S3TimeoutError{Operation: "GetReader", Timeout: time.Minute}, bagman.FailureS3Timeout},
+		{&bagman.DecryptionError{Chunk: 3}, bagman.FailureDecryption},
+		{&bagman.BagNameError{Name: "bag.tar.tar", Kind: bagman.BagNameBadPartNumber}, bagman.FailureBadBagName},
+		{&bagman.FileCountError{Stage: bagman.StageStore, Problems: []string{"lost one"}}, bagman.FailureFileCount},
+		{&net.DNSError{Err: "no such host", Name: "fluctus"}, bagman.FailureNetwork},
+		{fmt.Errorf("Error saving intellectual object 'test.edu/bag' to Fedora: 500"), bagman.FailureFluctus},
+		{fmt.Errorf("Something nobody has seen before"), bagman.FailureUnknown},
+		{nil, bagman.FailureUnknown},
+	}
+	for _, testCase := range testCases {
+		class := bagman.ClassifyError(testCase.err)
+		if class != testCase.expected {
+			t.Errorf("Expected %s, got %s for error %v", testCase.expected, class, testCase.err)
+		}
+	}
+	// Typed errors and their messages get the same class, since
+	// results lose the type when they go through the queue.
+	typed := []error{
+		&bagman.StagePanic{Stage: "store", Value: "boom"},
+		&bagman.InsufficientSpaceError{Requested: 100, Available: 10},
+		&bagman.S3TimeoutError{Operation: "PutReader", Timeout: time.Minute},
+		&bagman.DecryptionError{Chunk: 3},
+		&bagman.BagNameError{Name: "bag.tar.tar", Message: "too many extensions"},
+		&bagman.FileCountError{Stage: bagman.StageRecord, Problems: []string{"lost one"},
+			Missing: []string{"data/is missing from.pdf"}},
+	}
+	for _, err := range typed {
+		if bagman.ClassifyErrorMessage(err.Error()) != bagman.ClassifyError(err) {
+			t.Errorf("Message '%s' is classified as %s, but its error is %s", err.Error(),
+				bagman.ClassifyErrorMessage(err.Error()), bagman.ClassifyError(err))
+		}
+	}
+}
+
+func TestSuggestedAction(t *testing.T) {
+	for _, testCase := range troubleMessages {
+		if bagman.SuggestedAction(testCase.expected, "") == "" {
+			t.Errorf("No remediation for %s", testCase.expected)
+		}
+	}
+	action := bagman.SuggestedAction(bagman.FailureDiskSpace, "/mnt/apt/data/bag.tar")
+	if !strings.Contains(action, "/mnt/apt/data") {
+		t.Errorf("Disk space remediation should name the volume: %s", action)
+	}
+	if bagman.SuggestedAction(bagman.FailureInvalidBag, "/mnt/apt/data/bag.tar") !=
+		bagman.FailureRemediations[bagman.FailureInvalidBag] {
+		t.Errorf("Only disk space remediation should depend on the local path")
+	}
+	if bagman.SuggestedAction("NoSuchClass", "") != bagman.FailureRemediations[bagman.FailureUnknown] {
+		t.Errorf("Unknown classes should get the remediation for unknown failures")
+	}
+}
+
+func TestNewFailureReport(t *testing.T) {
+	report := bagman.NewFailureReport([]string{
+		"",
+		"Mystery error",
+		"Required field Title is missing from tag file.\n",
+		"Mystery error",
+		"Error saving intellectual object 'test.edu/bag' to Fedora: 500",
+	})
+	if report.Classification != bagman.FailureInvalidBag {
+		t.Errorf("Expected InvalidBag, got %s", report.Classification)
+	}
+	if report.Error != "Required field Title is missing from tag file." {
+		t.Errorf("Report has the wrong error: '%s'", report.Error)
+	}
+	if report.ErrorCount != 3 {
+		t.Errorf("Expected 3 distinct errors, got %d", report.ErrorCount)
+	}
+
+	report = bagman.NewFailureReport([]string{"Mystery error  This item has been queued for administrative review."})
+	if report.Classification != bagman.FailureUnknown || report.Error != "Mystery error" {
+		t.Errorf("Expected unknown 'Mystery error', got %s '%s'", report.Classification, report.Error)
+	}
+
+	report = bagman.NewFailureReport([]string{strings.Repeat("x", bagman.MAX_FAILURE_ERROR_LENGTH * 2)})
+	if len(report.Error) != bagman.MAX_FAILURE_ERROR_LENGTH + 3 {
+		t.Errorf("Long error was not truncated: %d chars", len(report.Error))
+	}
+}
+
+func TestProcessResultFailureReport(t *testing.T) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Stage = bagman.StageRecord
+	result.Retry = false
+	result.FetchResult = &bagman.FetchResult{LocalFile: "/mnt/apt/data/sample_bag.tar"}
+	result.FedoraResult = bagman.NewFedoraResult("ncsu.edu/ncsu.1840.16-2928", nil)
+	result.FedoraResult.ErrorMessage = "Error saving generic file batch to Fedora: " +
+		"GenericFileSaveBatch Expected status code 201 but got 500."
+	result.ErrorMessage = result.FedoraResult.ErrorMessage + " Failure is due to a technical " +
+		"error in Fedora. Giving up after 3 failed attempts. This item has been queued " +
+		"for administrative review. "
+	report := result.FailureReport()
+	if report.Classification != bagman.FailureFluctus {
+		t.Errorf("Expected FluctusError, got %s", report.Classification)
+	}
+	if report.Error != result.FedoraResult.ErrorMessage {
+		t.Errorf("Report should use the record stage error, got '%s'", report.Error)
+	}
+	if report.Stage != "Record" || report.Retry {
+		t.Errorf("Report has wrong stage or retry: %s %t", report.Stage, report.Retry)
+	}
+	if report.Bag != result.S3File.Key.Key || report.BagSize != result.S3File.Key.Size {
+		t.Errorf("Report has wrong bag: %s (%d bytes)", report.Bag, report.BagSize)
+	}
+	if report.Institution != bagman.OwnerOf(result.S3File.BucketName) {
+		t.Errorf("Report has wrong institution: %s", report.Institution)
+	}
+	if report.FileCount != len(result.TarResult.Files) {
+		t.Errorf("Expected %d files, got %d", len(result.TarResult.Files), report.FileCount)
+	}
+	storedFiles, storedBytes := 0, int64(0)
+	for _, file := range result.TarResult.Files {
+		if file.StorageURL != "" {
+			storedFiles++
+			storedBytes += file.Size
+		}
+	}
+	if report.FilesStored != storedFiles || report.BytesStored != storedBytes {
+		t.Errorf("Expected %d files and %d bytes stored, got %d and %d", storedFiles,
+			storedBytes, report.FilesStored, report.BytesStored)
+	}
+	if report.Remediation != bagman.FailureRemediations[bagman.FailureFluctus] {
+		t.Errorf("Wrong remediation: %s", report.Remediation)
+	}
+
+	// Disk space failures name the volume.
+	result.Stage = bagman.StageFetch
+	result.FedoraResult.ErrorMessage = ""
+	result.ErrorMessage = "Requested 6442450944 bytes (6.0 GB) on volume, but only 1024 (1.0 KB) are available"
+	report = result.FailureReport()
+	if report.Classification != bagman.FailureDiskSpace || !strings.Contains(report.Remediation, "/mnt/apt/data") {
+		t.Errorf("Expected disk space failure on /mnt/apt/data, got %s: %s", report.Classification,
+			report.Remediation)
+	}
+}
+
+func TestGroupFailureReports(t *testing.T) {
+	reports := []*bagman.FailureReport{
+		&bagman.FailureReport{Bag: "a.tar", Classification: bagman.FailureFluctus, BagSize: 10},
+		&bagman.FailureReport{Bag: "b.tar", Classification: bagman.FailureInvalidBag, BagSize: 20},
+		&bagman.FailureReport{Bag: "c.tar", Classification: bagman.FailureFluctus, BagSize: 30},
+		&bagman.FailureReport{Bag: "d.tar", Classification: bagman.FailureDiskSpace, BagSize: 40},
+	}
+	groups := bagman.GroupFailureReports(reports)
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, got %d", len(groups))
+	}
+	expected := []bagman.FailureClass{bagman.FailureFluctus, bagman.FailureDiskSpace, bagman.FailureInvalidBag}
+	for i, class := range expected {
+		if groups[i].Classification != class {
+			t.Errorf("Group %d should be %s, got %s", i, class, groups[i].Classification)
+		}
+	}
+	if len(groups[0].Reports) != 2 || groups[0].TotalBytes != 40 {
+		t.Errorf("Fluctus group should have 2 reports and 40 bytes, got %d and %d",
+			len(groups[0].Reports), groups[0].TotalBytes)
+	}
+	if groups[0].Remediation != bagman.FailureRemediations[bagman.FailureFluctus] {
+		t.Errorf("Group has wrong remediation: %s", groups[0].Remediation)
+	}
+	if len(bagman.GroupFailureReports(nil)) != 0 {
+		t.Errorf("No reports should produce no groups")
+	}
+}
@@ -70,27 +70,61 @@ func (result *FedoraResult) RecordSucceeded(recordType, action, eventObject stri
 	return record != nil && record.Succeeded()
 }
 
+// RequiredRecordCount returns the number of MetadataRecords that
+// have to succeed before all of the files are recorded in Fluctus:
+// one file_registered record for each of GenericFilePaths.
+func (result *FedoraResult) RequiredRecordCount() (int) {
+	return len(result.GenericFilePaths)
+}
+
+// SaveProgress returns the percentage of required records that were
+// saved successfully, from 0.0 to 100.0. It returns 0.0 if there are
+// no required records.
+func (result *FedoraResult) SaveProgress() (float64) {
+	required := result.RequiredRecordCount()
+	if required == 0 {
+		return 0.0
+	}
+	succeeded := 0
+	for _, record := range result.MetadataRecords {
+		if record.Type == "GenericFile" && record.Action == "file_registered" && record.Succeeded() {
+			succeeded++
+		}
+	}
+	return (float64(Min(succeeded, required)) / float64(required)) * 100.0
+}
+
+// ExpectedRecordCount returns the number of MetadataRecords apt_record
+// adds when it records a new object: one object_registered record, one
+// PremisEvent record for each object event in GeneratedPremisEvents,
+// and one file_registered record for each of GenericFilePaths. File
+// events are saved along with their files, so they don't get records
+// of their own. Re-ingest may add fewer records, since we don't resend
+// events Fluctus already has.
+func (result *FedoraResult) ExpectedRecordCount() (int) {
+	return 1 + len(GeneratedPremisEvents.ObjectEventList()) + len(result.GenericFilePaths)
+}
+
 // Returns true if all metadata was recorded successfully in Fluctus/Fedora.
 // A true result means that all of the following were successfully recorded:
 //
 // 1) Registration of the IntellectualObject. This may mean creating a new
 // IntellectualObject or updating an existing one.
 //
-// 2) Recording the ingest PremisEvent for the IntellectualObject.
+// 2) Recording each of the object's PremisEvents, as configured in
+// GeneratedPremisEvents.
 //
-// 3) Registration of EACH of the object's GenericFiles. This may mean
-// creating a new GenericFile or updating an existing one.
+// 3) Registration of EACH of the object's GenericFiles, along with the
+// file events GeneratedPremisEvents lists. This may mean creating a new
+// GenericFile or updating an existing one.
 //
-// 4) Recording the intentifier_assignment for EACH GenericFile. The
-// identifier is typically a UUID.
-//
-// 5) Recording the fixity_generation for EACH GenericFile. Although most
-// files already come with md5 checksums from S3, we always generate a
-// sha256 as well.
-//
-// A successful FedoraResult will have (2 + (3 * len(GenericFilePaths)))
-// successful MetadataRecords.
+// A successful FedoraResult for a new object will have
+// ExpectedRecordCount() successful MetadataRecords, so for new
+// objects, this returns false if any of those are missing.
 func (result *FedoraResult) AllRecordsSucceeded() bool {
+	if result.IsNewObject && len(result.MetadataRecords) < result.ExpectedRecordCount() {
+		return false
+	}
 	for _, record := range result.MetadataRecords {
 		if false == record.Succeeded() {
 			return false
@@ -98,3 +132,15 @@ func (result *FedoraResult) AllRecordsSucceeded() bool {
 	}
 	return true
 }
+
+// Returns the MetadataRecords that could not be saved in
+// Fluctus/Fedora, in the order they were attempted.
+func (result *FedoraResult) FailedRecords() []*MetadataRecord {
+	failed := make([]*MetadataRecord, 0)
+	for _, record := range result.MetadataRecords {
+		if false == record.Succeeded() {
+			failed = append(failed, record)
+		}
+	}
+	return failed
+}
@@ -145,3 +145,95 @@ func TestAllRecordsSucceeded(t *testing.T) {
 		t.Error("FedoraResult.AllRecordsSucceeded() returned true when it should have returned false")
 	}
 }
+
+// A new object needs every record it's expected to have, not just
+// no failed ones.
+func TestAllRecordsSucceededNewObject(t *testing.T) {
+	paths := []string{"data/1.pdf", "data/2.pdf"}
+	fedoraResult := bagman.NewFedoraResult("ncsu.edu/bag", paths)
+	fedoraResult.AddRecord("IntellectualObject", "object_registered", "ncsu.edu/bag", "")
+	fedoraResult.AddRecord("GenericFile", "file_registered", paths[0], "")
+	if fedoraResult.AllRecordsSucceeded() {
+		t.Errorf("New object with %d of %d records should not have succeeded",
+			len(fedoraResult.MetadataRecords), fedoraResult.ExpectedRecordCount())
+	}
+
+	// Re-ingest may need fewer records.
+	fedoraResult.IsNewObject = false
+	if !fedoraResult.AllRecordsSucceeded() {
+		t.Errorf("Existing object with no failed records should have succeeded")
+	}
+
+	fedoraResult.IsNewObject = true
+	for _, eventType := range bagman.GeneratedPremisEvents.ObjectEventList() {
+		fedoraResult.AddRecord("PremisEvent", eventType, "ncsu.edu/bag", "")
+	}
+	fedoraResult.AddRecord("GenericFile", "file_registered", paths[1], "")
+	if !fedoraResult.AllRecordsSucceeded() {
+		t.Errorf("New object with all %d records should have succeeded",
+			fedoraResult.ExpectedRecordCount())
+	}
+}
+
+func TestSaveProgress(t *testing.T) {
+	paths := []string{"data/1.pdf", "data/2.pdf", "data/3.pdf", "data/4.pdf"}
+	fedoraResult := bagman.NewFedoraResult("ncsu.edu/bag", paths)
+	if fedoraResult.RequiredRecordCount() != 4 {
+		t.Errorf("Expected 4 required records, got %d", fedoraResult.RequiredRecordCount())
+	}
+	if progress := fedoraResult.SaveProgress(); progress != 0.0 {
+		t.Errorf("Expected 0%% before saving anything, got %f", progress)
+	}
+
+	// The object record and the failed file don't count.
+	fedoraResult.AddRecord("IntellectualObject", "object_registered", "ncsu.edu/bag", "")
+	fedoraResult.AddRecord("GenericFile", "file_registered", paths[0], "")
+	fedoraResult.AddRecord("GenericFile", "file_registered", paths[1], "Fluctus returned 500")
+	fedoraResult.AddRecord("GenericFile", "file_registered", paths[2], "")
+	if progress := fedoraResult.SaveProgress(); progress != 50.0 {
+		t.Errorf("Expected 50%%, got %f", progress)
+	}
+	fedoraResult.AddRecord("GenericFile", "file_registered", paths[3], "")
+	if progress := fedoraResult.SaveProgress(); progress != 75.0 {
+		t.Errorf("Expected 75%%, got %f", progress)
+	}
+
+	empty := bagman.NewFedoraResult("ncsu.edu/bag", []string{})
+	empty.AddRecord("IntellectualObject", "object_registered", "ncsu.edu/bag", "")
+	if progress := empty.SaveProgress(); progress != 0.0 {
+		t.Errorf("Expected 0%% with no required records, got %f", progress)
+	}
+}
+
+func TestExpectedRecordCount(t *testing.T) {
+	defer func(original *bagman.PremisEventConfig) {
+		bagman.GeneratedPremisEvents = original
+	}(bagman.GeneratedPremisEvents)
+
+	paths := []string{"data/1.pdf", "data/2.pdf", "data/3.pdf"}
+	testCases := []struct {
+		config   *bagman.PremisEventConfig
+		expected int
+	}{
+		// object_registered + ingest + identifier_assignment + 3 files
+		{&bagman.PremisEventConfig{}, 6},
+		{nil, 6},
+		{&bagman.PremisEventConfig{ObjectEvents: []string{"ingest"}}, 5},
+		// File events are saved with their files, so they
+		// don't change the count.
+		{&bagman.PremisEventConfig{FileEvents: []string{"ingest"},
+			ObjectEvents: []string{"ingest"}}, 5},
+	}
+	for i, tc := range testCases {
+		bagman.GeneratedPremisEvents = tc.config
+		fedoraResult := bagman.NewFedoraResult("ncsu.edu/bag", paths)
+		if count := fedoraResult.ExpectedRecordCount(); count != tc.expected {
+			t.Errorf("Case %d: expected %d records, got %d", i, tc.expected, count)
+		}
+	}
+	bagman.GeneratedPremisEvents = &bagman.PremisEventConfig{}
+	empty := bagman.NewFedoraResult("ncsu.edu/bag", []string{})
+	if count := empty.ExpectedRecordCount(); count != 3 {
+		t.Errorf("Expected 3 records for an object with no files, got %d", count)
+	}
+}
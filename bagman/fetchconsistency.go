@@ -0,0 +1,168 @@
+package bagman
+
+import (
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long to wait before re-checking a receiving bucket key that
+// S3 said does not exist. The bucket reader may queue a key it just
+// saw in a LIST before a GET can see it, since S3 is only eventually
+// consistent.
+const NO_SUCH_KEY_RECHECK_DELAY = 10 * time.Second
+
+// How many times to re-check a missing key before deciding it's
+// really gone.
+const NO_SUCH_KEY_RECHECKS = 3
+
+// MissingKeyVerdict says what we found when we re-checked a key
+// that S3 said does not exist.
+type MissingKeyVerdict string
+
+const (
+	// The key is there, with the ETag we expected. The GET was
+	// too soon after the upload, and fetching again should work.
+	MissingKeyLagged   MissingKeyVerdict = "Lagged"
+	// The key is there, but with a different ETag. The depositor
+	// uploaded a new version, which has its own work item.
+	MissingKeyReplaced                   = "Replaced"
+	// The key is gone.
+	MissingKeyDeleted                    = "Deleted"
+	// We couldn't re-check the key.
+	MissingKeyUnknown                    = "Unknown"
+)
+
+// ReceivingBucketClient is the part of the S3Client that
+// MissingKeyChecker needs. It's an interface so each timing
+// scenario can be tested without S3.
+type ReceivingBucketClient interface {
+	FetchToFile(bucketName string, key s3.Key, path string) (*FetchResult)
+	Head(bucketName, key string) (*http.Response, error)
+}
+
+// Returns true if errorMessage is S3's way of saying the key we
+// asked for does not exist.
+func IsNoSuchKey(errorMessage string) (bool) {
+	return strings.Contains(errorMessage, "NoSuchKey") ||
+		strings.Contains(errorMessage, "key does not exist")
+}
+
+// MissingKeyChecker fetches bags from receiving buckets. When a GET
+// says the key does not exist, it re-checks the key with HEAD before
+// deciding what that means, so S3 consistency lag doesn't cost the
+// bag one of its attempts.
+type MissingKeyChecker struct {
+	Client   ReceivingBucketClient
+	// How long to wait before each HEAD.
+	Delay    time.Duration
+	// How many HEAD requests to try before deciding the key is gone.
+	Rechecks int
+	// Sleep is time.Sleep, unless a test replaces it.
+	Sleep    func(time.Duration)
+}
+
+// Returns a MissingKeyChecker with the default delay and number of
+// rechecks.
+func NewMissingKeyChecker(client ReceivingBucketClient) (*MissingKeyChecker) {
+	return &MissingKeyChecker{
+		Client:   client,
+		Delay:    NO_SUCH_KEY_RECHECK_DELAY,
+		Rechecks: NO_SUCH_KEY_RECHECKS,
+		Sleep:    time.Sleep,
+	}
+}
+
+// Check re-checks a key that S3 said does not exist. It returns
+// MissingKeyLagged if the key now has the ETag in key.ETag, and
+// MissingKeyReplaced, along with the new ETag, if it has a different
+// one. It returns MissingKeyDeleted only if every recheck says the
+// key does not exist, and MissingKeyUnknown, with an error, if a
+// HEAD request fails for any other reason.
+func (checker *MissingKeyChecker) Check(bucketName string, key s3.Key) (MissingKeyVerdict, string, error) {
+	expectedETag := strings.Trim(key.ETag, "\"")
+	sleep := checker.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	for attempt := 0; attempt < checker.Rechecks; attempt++ {
+		sleep(checker.Delay)
+		resp, err := checker.Client.Head(bucketName, key.Key)
+		statusCode := 0
+		if resp != nil {
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			statusCode = resp.StatusCode
+		}
+		if statusCode == 404 || (err != nil && (IsNoSuchKey(err.Error()) ||
+			strings.Contains(err.Error(), "404"))) {
+			continue
+		}
+		if err != nil {
+			return MissingKeyUnknown, "", fmt.Errorf("Head request for %s/%s returned error: %v",
+				bucketName, key.Key, err)
+		}
+		if statusCode != 200 {
+			return MissingKeyUnknown, "", fmt.Errorf(
+				"Head request for %s/%s returned HTTP Status Code %d",
+				bucketName, key.Key, statusCode)
+		}
+		currentETag := strings.Trim(resp.Header.Get("ETag"), "\"")
+		if currentETag == expectedETag {
+			return MissingKeyLagged, currentETag, nil
+		}
+		return MissingKeyReplaced, currentETag, nil
+	}
+	return MissingKeyDeleted, "", nil
+}
+
+// Fetch fetches key from bucketName to path, like S3Client.FetchToFile.
+// If S3 says the key does not exist, Fetch re-checks it, and records
+// the verdict in the result's MissingKey. If the key was just slow to
+// show up, Fetch tries the download again. If the depositor replaced
+// it with a new upload, the result says so and does not retry, since
+// the new upload will be ingested on its own.
+func (checker *MissingKeyChecker) Fetch(bucketName string, key s3.Key, path string) (*FetchResult) {
+	return checker.FetchWith(bucketName, key, func() (*FetchResult) {
+		return checker.Client.FetchToFile(bucketName, key, path)
+	})
+}
+
+// FetchWith is like Fetch, but calls fetch to get the key, so
+// callers that don't download to a file, such as the streaming
+// untar, get the same handling of missing keys.
+func (checker *MissingKeyChecker) FetchWith(bucketName string, key s3.Key, fetch func() (*FetchResult)) (*FetchResult) {
+	result := fetch()
+	if result.ErrorMessage == "" || !IsNoSuchKey(result.ErrorMessage) {
+		return result
+	}
+	verdict, currentETag, err := checker.Check(bucketName, key)
+	switch verdict {
+	case MissingKeyLagged:
+		result = fetch()
+		if result.ErrorMessage != "" && IsNoSuchKey(result.ErrorMessage) {
+			result.ErrorMessage += " HEAD finds the key, so this is probably " +
+				"S3 consistency lag. Will try again later."
+			result.Retry = true
+		}
+	case MissingKeyReplaced:
+		result.ErrorMessage = fmt.Sprintf("Cancelled: %s/%s was replaced by a new upload "+
+			"(ETag %s) before we could fetch this one (ETag %s). The new upload "+
+			"will be ingested on its own.", bucketName, key.Key, currentETag,
+			strings.Trim(key.ETag, "\""))
+		result.Retry = false
+	case MissingKeyDeleted:
+		result.ErrorMessage = fmt.Sprintf("%s/%s no longer exists. The depositor may "+
+			"have deleted it after uploading it. Original error: %s",
+			bucketName, key.Key, result.ErrorMessage)
+		result.Retry = false
+	default:
+		result.ErrorMessage += fmt.Sprintf(" Could not re-check the key: %v", err)
+		result.Retry = true
+	}
+	result.MissingKey = verdict
+	return result
+}
@@ -0,0 +1,188 @@
+package bagman_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/s3"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeReceivingBucket plays back a list of GET and HEAD results,
+// one per call, so each test can script what S3 says over time.
+type fakeReceivingBucket struct {
+	fetchErrors []string
+	headResults []fakeHead
+	fetches     int
+	heads       int
+}
+
+type fakeHead struct {
+	statusCode int
+	etag       string
+	err        error
+}
+
+func (bucket *fakeReceivingBucket) FetchToFile(bucketName string, key s3.Key, path string) (*bagman.FetchResult) {
+	result := &bagman.FetchResult{BucketName: bucketName, Key: key.Key, LocalFile: path}
+	if bucket.fetches < len(bucket.fetchErrors) && bucket.fetchErrors[bucket.fetches] != "" {
+		result.ErrorMessage = bucket.fetchErrors[bucket.fetches]
+		result.Retry = !strings.Contains(result.ErrorMessage, "key does not exist")
+	}
+	bucket.fetches++
+	return result
+}
+
+func (bucket *fakeReceivingBucket) Head(bucketName, key string) (*http.Response, error) {
+	head := fakeHead{statusCode: 404}
+	if bucket.heads < len(bucket.headResults) {
+		head = bucket.headResults[bucket.heads]
+	}
+	bucket.heads++
+	if head.err != nil {
+		return nil, head.err
+	}
+	resp := &http.Response{StatusCode: head.statusCode, Header: http.Header{}}
+	if head.etag != "" {
+		resp.Header.Set("ETag", fmt.Sprintf("\"%s\"", head.etag))
+	}
+	return resp, nil
+}
+
+const noSuchKey = "Error retrieving file from receiving bucket: The specified key does not exist."
+
+var receivingKey = s3.Key{Key: "test.edu.bag.tar", ETag: "\"4d66f1ec9491addded54d17b96df8c96\""}
+
+func missingKeyChecker(bucket *fakeReceivingBucket) (*bagman.MissingKeyChecker, *[]time.Duration) {
+	sleeps := make([]time.Duration, 0)
+	checker := bagman.NewMissingKeyChecker(bucket)
+	checker.Sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return checker, &sleeps
+}
+
+func TestIsNoSuchKey(t *testing.T) {
+	if !bagman.IsNoSuchKey(noSuchKey) || !bagman.IsNoSuchKey("NoSuchKey: not here") {
+		t.Errorf("IsNoSuchKey should recognize S3 missing key errors")
+	}
+	if bagman.IsNoSuchKey("connection reset by peer") {
+		t.Errorf("IsNoSuchKey should not match network errors")
+	}
+}
+
+// Errors other than NoSuchKey pass through without rechecking.
+func TestMissingKeyFetchOtherErrors(t *testing.T) {
+	for _, fetchErrors := range [][]string{nil, []string{"connection reset by peer"}} {
+		bucket := &fakeReceivingBucket{fetchErrors: fetchErrors}
+		checker, sleeps := missingKeyChecker(bucket)
+		result := checker.Fetch("aptrust.receiving.test.edu", receivingKey, "/tmp/x")
+		if bucket.heads != 0 || len(*sleeps) != 0 || result.MissingKey != "" {
+			t.Errorf("Fetch should not recheck after %v", fetchErrors)
+		}
+	}
+}
+
+// The key shows up with the ETag we expected, so the first GET was
+// just too soon after the upload.
+func TestMissingKeyLagged(t *testing.T) {
+	bucket := &fakeReceivingBucket{
+		fetchErrors: []string{noSuchKey, ""},
+		headResults: []fakeHead{{statusCode: 200, etag: "4d66f1ec9491addded54d17b96df8c96"}},
+	}
+	checker, sleeps := missingKeyChecker(bucket)
+	result := checker.Fetch("aptrust.receiving.test.edu", receivingKey, "/tmp/x")
+	if result.ErrorMessage != "" || result.MissingKey != bagman.MissingKeyLagged {
+		t.Errorf("Expected a successful refetch, got '%s' (%s)", result.ErrorMessage, result.MissingKey)
+	}
+	if bucket.fetches != 2 || bucket.heads != 1 {
+		t.Errorf("Expected 2 GETs and 1 HEAD, got %d and %d", bucket.fetches, bucket.heads)
+	}
+	if len(*sleeps) != 1 || (*sleeps)[0] != bagman.NO_SUCH_KEY_RECHECK_DELAY {
+		t.Errorf("Expected one sleep of %s, got %v", bagman.NO_SUCH_KEY_RECHECK_DELAY, *sleeps)
+	}
+
+	// If the refetch still can't see the key, try again later.
+	bucket = &fakeReceivingBucket{
+		fetchErrors: []string{noSuchKey, noSuchKey},
+		headResults: []fakeHead{{statusCode: 200, etag: "4d66f1ec9491addded54d17b96df8c96"}},
+	}
+	checker, _ = missingKeyChecker(bucket)
+	result = checker.Fetch("aptrust.receiving.test.edu", receivingKey, "/tmp/x")
+	if result.ErrorMessage == "" || !result.Retry {
+		t.Errorf("A lagged key that still can't be fetched should be retried")
+	}
+}
+
+// HEAD lags too, but finds the key on a later recheck.
+func TestMissingKeyLaggedHead(t *testing.T) {
+	bucket := &fakeReceivingBucket{
+		fetchErrors: []string{noSuchKey, ""},
+		headResults: []fakeHead{
+			{statusCode: 404},
+			{err: fmt.Errorf("404 Not Found")},
+			{statusCode: 200, etag: "4d66f1ec9491addded54d17b96df8c96"},
+		},
+	}
+	checker, sleeps := missingKeyChecker(bucket)
+	result := checker.Fetch("aptrust.receiving.test.edu", receivingKey, "/tmp/x")
+	if result.ErrorMessage != "" || result.MissingKey != bagman.MissingKeyLagged {
+		t.Errorf("Expected a successful refetch, got '%s' (%s)", result.ErrorMessage, result.MissingKey)
+	}
+	if bucket.heads != 3 || len(*sleeps) != 3 {
+		t.Errorf("Expected 3 HEADs and 3 sleeps, got %d and %d", bucket.heads, len(*sleeps))
+	}
+}
+
+// The depositor uploaded a new version of the bag before we could
+// fetch the one in this work item.
+func TestMissingKeyReplaced(t *testing.T) {
+	bucket := &fakeReceivingBucket{
+		fetchErrors: []string{noSuchKey},
+		headResults: []fakeHead{{statusCode: 200, etag: "aaaabbbbccccddddeeeeffff00001111"}},
+	}
+	checker, _ := missingKeyChecker(bucket)
+	result := checker.Fetch("aptrust.receiving.test.edu", receivingKey, "/tmp/x")
+	if result.MissingKey != bagman.MissingKeyReplaced || result.Retry {
+		t.Errorf("Expected Replaced with no retry, got %s (retry %t)", result.MissingKey, result.Retry)
+	}
+	if !strings.Contains(result.ErrorMessage, "aaaabbbbccccddddeeeeffff00001111") ||
+		!strings.Contains(result.ErrorMessage, "Cancelled") {
+		t.Errorf("Error message should explain the cancellation: %s", result.ErrorMessage)
+	}
+	if bucket.fetches != 1 {
+		t.Errorf("Fetch should not download the replacement, got %d GETs", bucket.fetches)
+	}
+}
+
+// The key never comes back.
+func TestMissingKeyDeleted(t *testing.T) {
+	bucket := &fakeReceivingBucket{fetchErrors: []string{noSuchKey}}
+	checker, sleeps := missingKeyChecker(bucket)
+	result := checker.Fetch("aptrust.receiving.test.edu", receivingKey, "/tmp/x")
+	if result.MissingKey != bagman.MissingKeyDeleted || result.Retry {
+		t.Errorf("Expected Deleted with no retry, got %s (retry %t)", result.MissingKey, result.Retry)
+	}
+	if bucket.heads != bagman.NO_SUCH_KEY_RECHECKS || len(*sleeps) != bagman.NO_SUCH_KEY_RECHECKS {
+		t.Errorf("Expected %d HEADs, got %d", bagman.NO_SUCH_KEY_RECHECKS, bucket.heads)
+	}
+}
+
+// If we can't recheck, we don't know what happened, so try again later.
+func TestMissingKeyUnknown(t *testing.T) {
+	heads := []fakeHead{{err: fmt.Errorf("connection reset by peer")}, {statusCode: 503}}
+	for _, head := range heads {
+		bucket := &fakeReceivingBucket{
+			fetchErrors: []string{noSuchKey},
+			headResults: []fakeHead{head},
+		}
+		checker, _ := missingKeyChecker(bucket)
+		result := checker.Fetch("aptrust.receiving.test.edu", receivingKey, "/tmp/x")
+		if result.MissingKey != bagman.MissingKeyUnknown || !result.Retry {
+			t.Errorf("Expected Unknown with retry, got %s (retry %t)", result.MissingKey, result.Retry)
+		}
+		if bucket.heads != 1 {
+			t.Errorf("Expected 1 HEAD, got %d", bucket.heads)
+		}
+	}
+}
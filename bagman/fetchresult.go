@@ -13,4 +13,12 @@ type FetchResult struct {
 	ErrorMessage  string
 	Warning       string
 	Retry         bool
+	// MissingKey says what we found on re-checking a key that
+	// S3 said does not exist. See MissingKeyChecker.Fetch.
+	MissingKey    MissingKeyVerdict `json:",omitempty"`
+	// Streamed is true if the bag was untarred as it came in from
+	// S3, without saving the tar file. LocalFile is still the path
+	// the tar file would have been saved to, so cleanup can find
+	// the untarred files, but there's nothing there.
+	Streamed      bool              `json:",omitempty"`
 }
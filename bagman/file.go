@@ -50,6 +50,12 @@ type File struct {
 	StorageURL string
 	StoredAt   time.Time
 	StorageMd5 string
+	// UploadId is the id of an unfinished multipart upload of this
+	// file to the preservation bucket. It's set while a large file
+	// is being stored, and if storage fails partway, the next attempt
+	// resumes the upload instead of starting over. It's cleared when
+	// the upload completes.
+	UploadId   string
 	// The unique id of this GenericFile. Institution domain name +
 	// "/" + bag name.
 	Identifier         string
@@ -65,11 +71,23 @@ type File struct {
 	// file whose contents have changed since it was last ingested.
 	NeedsSave bool
 
+	// RenamedFrom is the identifier of an existing file with the same
+	// content that this file replaces, because the depositor renamed
+	// it. Renamed files reuse the existing preservation copy instead
+	// of being stored again. This is empty for files that were not
+	// renamed.
+	RenamedFrom string
+
 	// ReplicationError describes the last error that occurred while
 	// trying to send this file to the replication bucket in Oregon.
 	// Replication is the last step in the ingest process, and before
 	// that step, this property will contain an empty string.
 	ReplicationError string
+
+	// Encryption describes how the preservation copy of this file
+	// was encrypted. This is nil if the file was stored unencrypted.
+	// Md5 and Sha256 are always the digests of the plaintext.
+	Encryption *EncryptionInfo
 }
 
 func NewFile() (*File) {
@@ -80,6 +98,23 @@ func NewFile() (*File) {
 }
 
 
+// ReuseStorage points this file at the preservation copy of
+// existingFile, which has the same content under its old name.
+// The file still needs to be saved, since its metadata is new,
+// but it won't be uploaded again.
+func (file *File) ReuseStorage(existingFile *GenericFile) {
+	file.RenamedFrom = existingFile.Identifier
+	file.StorageURL = existingFile.URI
+	file.StoredAt = lastIngestTime(existingFile)
+	file.Encryption = existingFile.Encryption
+	if md5 := existingFile.GetChecksum("md5"); md5 != nil {
+		file.StorageMd5 = md5.Digest
+	}
+	if uuid, err := existingFile.PreservationStorageFileName(); err == nil {
+		file.Uuid = uuid
+	}
+}
+
 // Converts bagman.File to GenericFile, which is what
 // Fluctus understands.
 func (file *File) ToGenericFile() (*GenericFile, error) {
@@ -104,19 +139,22 @@ func (file *File) ToGenericFile() (*GenericFile, error) {
 		Modified:           file.Modified,
 		ChecksumAttributes: checksumAttributes,
 		Events:             events,
+		Encryption:         file.Encryption,
 	}
 	return genericFile, nil
 }
 
 // PremisEvents returns a list of Premis events generated during bag
 // processing. Ingest, Fixity Generation (sha256), identifier
-// assignment.
+// assignment. We generate only the events GeneratedPremisEvents
+// lists in its FileEvents.
 func (file *File) PremisEvents() (events []*PremisEvent) {
-	events = make([]*PremisEvent, 5)
+	eventConfig := GeneratedPremisEvents
+	events = make([]*PremisEvent, 0, 5)
 	// Fixity check
 	fCheckEventUuid := uuid.NewV4()
 	// Fixity check event
-	events[0] = &PremisEvent{
+	fixityCheckEvent := &PremisEvent{
 		Identifier:         fCheckEventUuid.String(),
 		EventType:          "fixity_check",
 		DateTime:           file.Md5Verified,
@@ -125,13 +163,22 @@ func (file *File) PremisEvents() (events []*PremisEvent) {
 		OutcomeDetail:      fmt.Sprintf("md5:%s", file.Md5),
 		Object:             "Go crypto/md5",
 		Agent:              "http://golang.org/pkg/crypto/md5/",
-		OutcomeInformation: "Fixity matches",
+		OutcomeInformation: VersionedOutcome("Fixity matches"),
+	}
+	if eventConfig.GeneratesFileEvent("fixity_check") {
+		events = append(events, fixityCheckEvent)
 	}
 
 	// Ingest
+	ingestInfo := "Put using md5 checksum"
+	if file.Encryption != nil {
+		ingestInfo = fmt.Sprintf("Put encrypted with %s, data key wrapped with %s key %s; "+
+			"plaintext md5 verified during encryption", file.Encryption.Algorithm,
+			file.Encryption.KeyWrapAlgorithm, file.Encryption.KeyId)
+	}
 	ingestEventUuid := uuid.NewV4()
 	// Ingest event
-	events[1] = &PremisEvent{
+	ingestEvent := &PremisEvent{
 		Identifier:         ingestEventUuid.String(),
 		EventType:          "ingest",
 		DateTime:           file.StoredAt,
@@ -140,11 +187,14 @@ func (file *File) PremisEvents() (events []*PremisEvent) {
 		OutcomeDetail:      file.StorageMd5,
 		Object:             "bagman + goamz s3 client",
 		Agent:              "https://github.com/APTrust/bagman",
-		OutcomeInformation: "Put using md5 checksum",
+		OutcomeInformation: VersionedOutcome(ingestInfo),
+	}
+	if eventConfig.GeneratesFileEvent("ingest") {
+		events = append(events, ingestEvent)
 	}
 	// Fixity Generation (sha256)
 	fixityGenUuid := uuid.NewV4()
-	events[2] = &PremisEvent{
+	fixityGenEvent := &PremisEvent{
 		Identifier:         fixityGenUuid.String(),
 		EventType:          "fixity_generation",
 		DateTime:           file.Sha256Generated,
@@ -153,11 +203,14 @@ func (file *File) PremisEvents() (events []*PremisEvent) {
 		OutcomeDetail:      fmt.Sprintf("sha256:%s", file.Sha256),
 		Object:             "Go language crypto/sha256",
 		Agent:              "http://golang.org/pkg/crypto/sha256/",
-		OutcomeInformation: "",
+		OutcomeInformation: VersionedOutcome(""),
+	}
+	if eventConfig.GeneratesFileEvent("fixity_generation") {
+		events = append(events, fixityGenEvent)
 	}
 	// Identifier assignment (Friendly ID)
 	idAssignmentUuid := uuid.NewV4()
-	events[3] = &PremisEvent{
+	idAssignmentEvent := &PremisEvent{
 		Identifier:         idAssignmentUuid.String(),
 		EventType:          "identifier_assignment",
 		DateTime:           file.UuidGenerated,
@@ -166,11 +219,14 @@ func (file *File) PremisEvents() (events []*PremisEvent) {
 		OutcomeDetail:      file.Identifier,
 		Object:             "APTrust bag processor",
 		Agent:              "https://github.com/APTrust/bagman",
-		OutcomeInformation: "",
+		OutcomeInformation: VersionedOutcome(""),
+	}
+	if eventConfig.GeneratesFileEvent("identifier_assignment") {
+		events = append(events, idAssignmentEvent)
 	}
 	// Identifier assignment (S3 URL)
 	urlAssignmentUuid := uuid.NewV4()
-	events[4] = &PremisEvent{
+	urlAssignmentEvent := &PremisEvent{
 		Identifier:         urlAssignmentUuid.String(),
 		EventType:          "identifier_assignment",
 		DateTime:           file.UuidGenerated,
@@ -179,14 +235,34 @@ func (file *File) PremisEvents() (events []*PremisEvent) {
 		OutcomeDetail:      file.StorageURL,
 		Object:             "Go uuid library + goamz S3 library",
 		Agent:              "https://github.com/satori/go.uuid",
-		OutcomeInformation: "",
+		OutcomeInformation: VersionedOutcome(""),
+	}
+	if eventConfig.GeneratesFileEvent("identifier_assignment_url") {
+		events = append(events, urlAssignmentEvent)
+	}
+	// Identifier assignment (rename). This goes with the friendly
+	// id assignment, since the rename changes that identifier.
+	if file.RenamedFrom != "" && eventConfig.GeneratesFileEvent("identifier_assignment") {
+		renameUuid := uuid.NewV4()
+		events = append(events, &PremisEvent{
+			Identifier:         renameUuid.String(),
+			EventType:          "identifier_assignment",
+			DateTime:           file.UuidGenerated,
+			Detail:             fmt.Sprintf("Renamed from %s", file.RenamedFrom),
+			Outcome:            string(StatusSuccess),
+			OutcomeDetail:      fmt.Sprintf("%s -> %s", file.RenamedFrom, file.Identifier),
+			Object:             "APTrust bag processor",
+			Agent:              "https://github.com/APTrust/bagman",
+			OutcomeInformation: VersionedOutcome("Matched by sha256; reused existing preservation copy"),
+		})
 	}
 	return events
 }
 
-// Returns a replication event, saying the file was saved to
-// the S3 replication bucket in Oregon. Param replicationUrl
-// is the URL of the file in the replication bucket.
+// Returns a replication event, saying the file was copied to
+// the S3 replication bucket, and the copy's size and checksum
+// were verified. Param replicationUrl is the URL of the file
+// in the replication bucket.
 func (file *File) ReplicationEvent(replicationUrl string) (*PremisEvent, error) {
 	if LooksLikeURL(replicationUrl) == false {
 		return nil, fmt.Errorf("Param replicationUrl must be a valid URL. '%s' won't cut it!",
@@ -195,14 +271,14 @@ func (file *File) ReplicationEvent(replicationUrl string) (*PremisEvent, error)
 	eventId := uuid.NewV4()
 	event := &PremisEvent{
 		Identifier:         eventId.String(),
-		EventType:          "ingest",
-		DateTime:           time.Now().UTC(),
-		Detail:             "Ingested to replication storage and assigned replication URL identifier",
+		EventType:          "replication",
+		DateTime:           NowUTC(),
+		Detail:             "Copied to replication storage and verified size and checksum",
 		Outcome:            string(StatusSuccess),
 		OutcomeDetail:      replicationUrl,
 		Object:             "Go uuid library + goamz S3 library",
 		Agent:              "https://github.com/satori/go.uuid",
-		OutcomeInformation: "",
+		OutcomeInformation: VersionedOutcome(""),
 	}
 	return event, nil
 }
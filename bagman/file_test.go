@@ -124,8 +124,8 @@ func TestPremisEvents(t *testing.T) {
 	if event.Agent != expectedAgent {
 		t.Errorf("Event.Agent expected '%s', got '%s'", expectedAgent, event.Agent)
 	}
-	if event.OutcomeInformation != "Fixity matches" {
-		t.Errorf("event.OutcomeInformation expected 'Fixity matches', got '%s'", event.OutcomeInformation)
+	if event.OutcomeInformation != "Fixity matches; bagman dev" {
+		t.Errorf("event.OutcomeInformation expected 'Fixity matches; bagman dev', got '%s'", event.OutcomeInformation)
 	}
 
 	// Copy to S3 event
@@ -191,6 +191,9 @@ func TestReplicationEvent(t *testing.T) {
 	if event.DateTime.IsZero() {
 		t.Errorf("Event DateTime is missing.")
 	}
+	if event.EventType != "replication" || !event.EventTypeValid() {
+		t.Errorf("Expected valid EventType 'replication', got '%s'", event.EventType)
+	}
 
 	badUrl := "i am not a url"
 	event, err = file.ReplicationEvent(badUrl)
@@ -211,3 +214,58 @@ func TestS3UUID(t *testing.T) {
 		t.Errorf("Expected empty UUID, got '%s'", file.S3UUID())
 	}
 }
+
+func TestPremisEventsConfigured(t *testing.T) {
+	defer func(original *bagman.PremisEventConfig) {
+		bagman.GeneratedPremisEvents = original
+	}(bagman.GeneratedPremisEvents)
+
+	file, err := loadGenericFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		fileEvents []string
+		details    []string
+	}{
+		{nil, []string{"Fixity check against registered hash", "Completed copy to S3",
+			"Calculated new fixity value", "Assigned new institution.bag/path identifier",
+			"Assigned new storage URL identifier"}},
+		{[]string{"ingest", "fixity_generation", "identifier_assignment"},
+			[]string{"Completed copy to S3", "Calculated new fixity value",
+				"Assigned new institution.bag/path identifier"}},
+		{[]string{"identifier_assignment_url", "ingest"},
+			[]string{"Completed copy to S3", "Assigned new storage URL identifier"}},
+	}
+	for _, tc := range testCases {
+		bagman.GeneratedPremisEvents = &bagman.PremisEventConfig{FileEvents: tc.fileEvents}
+		events := file.PremisEvents()
+		if len(events) != len(tc.details) {
+			t.Errorf("FileEvents %v: expected %d events, got %d",
+				tc.fileEvents, len(tc.details), len(events))
+			continue
+		}
+		// Events come in the usual order, whatever order the
+		// config lists them in.
+		for i, event := range events {
+			if event.Detail != tc.details[i] {
+				t.Errorf("FileEvents %v: expected event %d to be '%s', got '%s'",
+					tc.fileEvents, i, tc.details[i], event.Detail)
+			}
+		}
+	}
+
+	// The rename event goes with the friendly id assignment.
+	renamed := *file
+	renamed.RenamedFrom = "ncsu.edu/ncsu.1840.16-2928/data/old.xml"
+	bagman.GeneratedPremisEvents = &bagman.PremisEventConfig{}
+	if events := renamed.PremisEvents(); len(events) != 6 {
+		t.Errorf("Expected 6 events for a renamed file, got %d", len(events))
+	}
+	bagman.GeneratedPremisEvents = &bagman.PremisEventConfig{
+		FileEvents: []string{"ingest", "identifier_assignment_url"}}
+	if events := renamed.PremisEvents(); len(events) != 2 {
+		t.Errorf("Expected no rename event without identifier_assignment, got %d events",
+			len(events))
+	}
+}
@@ -0,0 +1,187 @@
+package bagman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FileCountError messages list at most this many paths of each kind.
+const MAX_FILE_COUNT_PATHS = 100
+
+// FileCountError means that a stage finished without accounting
+// for all of the files unpacked from a bag. Missing lists the paths
+// of the files that the stage lost track of, and Unexpected lists
+// the paths it has but shouldn't.
+type FileCountError struct {
+	Stage      StageType
+	Problems   []string
+	Missing    []string
+	Unexpected []string
+}
+
+func (err *FileCountError) Error() (string) {
+	message := fmt.Sprintf("[FILE COUNT MISMATCH] %s stage: %s.",
+		err.Stage, strings.Join(err.Problems, "; "))
+	if len(err.Missing) > 0 {
+		message += fmt.Sprintf(" Missing %d file(s): %s.", len(err.Missing),
+			listPaths(err.Missing))
+	}
+	if len(err.Unexpected) > 0 {
+		message += fmt.Sprintf(" Unexpected %d file(s): %s.", len(err.Unexpected),
+			listPaths(err.Unexpected))
+	}
+	return message
+}
+
+// Returns true if err is a FileCountError.
+func IsFileCountError(err error) (bool) {
+	_, isFileCount := err.(*FileCountError)
+	return isFileCount
+}
+
+// Returns up to MAX_FILE_COUNT_PATHS of paths, sorted, as a
+// comma-separated list.
+func listPaths(paths []string) (string) {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	if len(sorted) <= MAX_FILE_COUNT_PATHS {
+		return strings.Join(sorted, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(sorted[:MAX_FILE_COUNT_PATHS], ", "),
+		len(sorted)-MAX_FILE_COUNT_PATHS)
+}
+
+// RecordUnpackedFiles records the number and total size of the
+// files we're going to store, so later stages can make sure none
+// went missing. Call this after junk files have been skipped.
+func (result *ProcessResult) RecordUnpackedFiles() {
+	result.UnpackedFileCount = len(result.TarResult.Files)
+	result.UnpackedByteCount = 0
+	for _, file := range result.TarResult.Files {
+		result.UnpackedByteCount += file.Size
+	}
+}
+
+// CheckStoredFiles returns a *FileCountError if the store stage
+// lost track of any files. That's the case if TarResult has more or
+// fewer files or bytes than RecordUnpackedFiles counted, or if any
+// file that needed saving has no StorageURL. Files that haven't
+// changed since the last ingest don't need saving, and junk files
+// we skipped were never counted. Returns nil if all is well.
+// Results from before we counted files are checked for StorageURLs
+// only.
+func (result *ProcessResult) CheckStoredFiles() (error) {
+	countError := &FileCountError{Stage: StageStore}
+	files := result.TarResult.Files
+	if result.UnpackedFileCount > 0 {
+		var byteCount int64
+		paths := make(map[string]bool, len(files))
+		for _, file := range files {
+			byteCount += file.Size
+			paths[file.Path] = true
+		}
+		if len(files) != result.UnpackedFileCount || byteCount != result.UnpackedByteCount {
+			countError.Problems = append(countError.Problems, fmt.Sprintf(
+				"unpacked %d files (%d bytes), but have %d files (%d bytes)",
+				result.UnpackedFileCount, result.UnpackedByteCount, len(files), byteCount))
+			skipped := make(map[string]bool, len(result.TarResult.SkippedFiles))
+			for _, filePath := range result.TarResult.SkippedFiles {
+				skipped[filePath] = true
+			}
+			unpacked := make(map[string]bool, len(result.TarResult.FilesUnpacked))
+			for _, filePath := range result.TarResult.FilesUnpacked {
+				unpacked[filePath] = true
+				if HasSavableName(filePath) && !skipped[filePath] && !paths[filePath] {
+					countError.Missing = append(countError.Missing, filePath)
+				}
+			}
+			for _, file := range files {
+				if !unpacked[file.Path] {
+					countError.Unexpected = append(countError.Unexpected, file.Path)
+				}
+			}
+		}
+	}
+	needSaving := 0
+	notStored := make([]string, 0)
+	for _, file := range files {
+		if file.NeedsSave {
+			needSaving++
+			if file.StorageURL == "" {
+				notStored = append(notStored, file.Path)
+			}
+		}
+	}
+	if len(notStored) > 0 {
+		countError.Problems = append(countError.Problems, fmt.Sprintf(
+			"%d files needed saving, but only %d were stored",
+			needSaving, needSaving-len(notStored)))
+		countError.Missing = append(countError.Missing, notStored...)
+	}
+	if len(countError.Problems) > 0 {
+		return countError
+	}
+	return nil
+}
+
+// FilesToRecord returns the paths of the files that the record stage
+// needs to register in Fluctus: the files that are new or changed
+// since the last ingest. Call this before recording, and pass the
+// paths to CheckRecordedFiles when done.
+func (result *ProcessResult) FilesToRecord() ([]string) {
+	paths := make([]string, 0)
+	for _, file := range result.TarResult.Files {
+		if file.NeedsSave {
+			paths = append(paths, file.Path)
+		}
+	}
+	return paths
+}
+
+// CheckRecordedFiles returns a *FileCountError unless FedoraResult
+// has exactly one file_registered record for each of paths, which
+// should come from FilesToRecord. Records for files that Fluctus
+// failed to save still count here; AllRecordsSucceeded reports
+// those. Returns nil if all is well.
+func (result *ProcessResult) CheckRecordedFiles(paths []string) (error) {
+	countError := &FileCountError{Stage: StageRecord}
+	registered := make(map[string]int)
+	recordCount := 0
+	if result.FedoraResult != nil {
+		for _, record := range result.FedoraResult.MetadataRecords {
+			if record.Type == "GenericFile" && record.Action == "file_registered" {
+				registered[record.EventObject]++
+				recordCount++
+			}
+		}
+	}
+	expected := make(map[string]bool, len(paths))
+	for _, filePath := range paths {
+		expected[filePath] = true
+		if registered[filePath] == 0 {
+			countError.Missing = append(countError.Missing, filePath)
+		}
+	}
+	for filePath, count := range registered {
+		if !expected[filePath] || count > 1 {
+			countError.Unexpected = append(countError.Unexpected, filePath)
+		}
+	}
+	if recordCount != len(paths) || len(countError.Missing) > 0 || len(countError.Unexpected) > 0 {
+		countError.Problems = append(countError.Problems, fmt.Sprintf(
+			"expected %d file_registered records, but found %d", len(paths), recordCount))
+		return countError
+	}
+	return nil
+}
+
+// FailFileCount fails the result because of err, which should be a
+// FileCountError. The error goes first in ErrorMessage, so it's the
+// first thing anyone sees in the logs and in the ProcessStatus note.
+// This turns off Retry, because files went missing without any other
+// error, and someone needs to find out why.
+func (result *ProcessResult) FailFileCount(err error) {
+	result.ErrorMessage = strings.TrimSpace(err.Error() + " " + result.ErrorMessage)
+	result.Retry = false
+}
@@ -0,0 +1,196 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+)
+
+// Returns a result for a bag with three files, plus a junk file that
+// was skipped. data/unchanged.txt hasn't changed since it was last
+// ingested, so it doesn't need saving.
+func fileCountResult() (*bagman.ProcessResult) {
+	files := make([]*bagman.File, 0)
+	for _, path := range []string{"aptrust-info.txt", "data/new.pdf", "data/unchanged.txt"} {
+		file := bagman.NewFile()
+		file.Path = path
+		file.Size = 100
+		files = append(files, file)
+	}
+	files[2].NeedsSave = false
+	files[2].StorageURL = "https://s3.amazonaws.com/aptrust.preservation.storage/unchanged"
+	result := &bagman.ProcessResult{
+		S3File: &bagman.S3File{BucketName: "aptrust.receiving.ncsu.edu"},
+		TarResult: &bagman.TarResult{
+			FilesUnpacked: []string{"aptrust-info.txt", "bagit.txt", "data/.DS_Store",
+				"data/new.pdf", "data/unchanged.txt", "manifest-md5.txt"},
+			Files:        files,
+			SkippedFiles: []string{"data/.DS_Store"},
+		},
+	}
+	result.RecordUnpackedFiles()
+	return result
+}
+
+// Marks the files in result that need saving as stored.
+func storeFiles(result *bagman.ProcessResult) {
+	for _, file := range result.TarResult.Files {
+		if file.NeedsSave {
+			file.StorageURL = "https://s3.amazonaws.com/aptrust.preservation.storage/" + file.Path
+		}
+	}
+}
+
+func TestRecordUnpackedFiles(t *testing.T) {
+	result := fileCountResult()
+	if result.UnpackedFileCount != 3 || result.UnpackedByteCount != 300 {
+		t.Errorf("Expected 3 files and 300 bytes, got %d files and %d bytes",
+			result.UnpackedFileCount, result.UnpackedByteCount)
+	}
+}
+
+func TestCheckStoredFiles(t *testing.T) {
+	result := fileCountResult()
+	storeFiles(result)
+	if err := result.CheckStoredFiles(); err != nil {
+		t.Errorf("All files were stored or unchanged, but got %v", err)
+	}
+
+	// A file that needed saving was never stored.
+	result = fileCountResult()
+	storeFiles(result)
+	result.TarResult.Files[1].StorageURL = ""
+	err := result.CheckStoredFiles()
+	if !bagman.IsFileCountError(err) {
+		t.Fatalf("Expected FileCountError, got %v", err)
+	}
+	countError := err.(*bagman.FileCountError)
+	if countError.Stage != bagman.StageStore || len(countError.Missing) != 1 ||
+		countError.Missing[0] != "data/new.pdf" {
+		t.Errorf("Wrong stage or missing files: %s %v", countError.Stage, countError.Missing)
+	}
+	if !strings.Contains(err.Error(), "2 files needed saving, but only 1 were stored") {
+		t.Errorf("Error message doesn't describe the problem: %s", err.Error())
+	}
+
+	// A file dropped out of TarResult.Files altogether. The junk
+	// file and the tag files aren't missing.
+	result = fileCountResult()
+	storeFiles(result)
+	result.TarResult.Files = result.TarResult.Files[:2]
+	err = result.CheckStoredFiles()
+	if !bagman.IsFileCountError(err) {
+		t.Fatalf("Expected FileCountError, got %v", err)
+	}
+	countError = err.(*bagman.FileCountError)
+	if len(countError.Missing) != 1 || countError.Missing[0] != "data/unchanged.txt" {
+		t.Errorf("Expected data/unchanged.txt to be missing, got %v", countError.Missing)
+	}
+	if !strings.Contains(err.Error(), "unpacked 3 files (300 bytes), but have 2 files (200 bytes)") {
+		t.Errorf("Error message doesn't describe the problem: %s", err.Error())
+	}
+
+	// A file we never unpacked.
+	result = fileCountResult()
+	extra := bagman.NewFile()
+	extra.Path = "data/extra.txt"
+	extra.StorageURL = "https://s3.amazonaws.com/aptrust.preservation.storage/extra"
+	result.TarResult.Files = append(result.TarResult.Files, extra)
+	storeFiles(result)
+	err = result.CheckStoredFiles()
+	if !bagman.IsFileCountError(err) {
+		t.Fatalf("Expected FileCountError, got %v", err)
+	}
+	countError = err.(*bagman.FileCountError)
+	if len(countError.Unexpected) != 1 || countError.Unexpected[0] != "data/extra.txt" {
+		t.Errorf("Expected data/extra.txt to be unexpected, got %v", countError.Unexpected)
+	}
+
+	// Results from before we counted files get only the StorageURL check.
+	result = fileCountResult()
+	storeFiles(result)
+	result.UnpackedFileCount = 0
+	result.UnpackedByteCount = 0
+	result.TarResult.Files = result.TarResult.Files[:2]
+	if err = result.CheckStoredFiles(); err != nil {
+		t.Errorf("Uncounted result should pass, got %v", err)
+	}
+}
+
+func TestCheckRecordedFiles(t *testing.T) {
+	result := fileCountResult()
+	toRecord := result.FilesToRecord()
+	if len(toRecord) != 2 || toRecord[0] != "aptrust-info.txt" || toRecord[1] != "data/new.pdf" {
+		t.Fatalf("FilesToRecord returned %v", toRecord)
+	}
+
+	result.FedoraResult = bagman.NewFedoraResult("ncsu.edu/bag", result.TarResult.FilePaths())
+	result.FedoraResult.AddRecord("IntellectualObject", "object_registered", "ncsu.edu/bag", "")
+	result.FedoraResult.AddRecord("GenericFile", "file_registered", "aptrust-info.txt", "")
+	err := result.CheckRecordedFiles(toRecord)
+	if !bagman.IsFileCountError(err) {
+		t.Fatalf("Expected FileCountError, got %v", err)
+	}
+	countError := err.(*bagman.FileCountError)
+	if countError.Stage != bagman.StageRecord || len(countError.Missing) != 1 ||
+		countError.Missing[0] != "data/new.pdf" {
+		t.Errorf("Wrong stage or missing files: %s %v", countError.Stage, countError.Missing)
+	}
+	if !strings.Contains(err.Error(), "expected 2 file_registered records, but found 1") {
+		t.Errorf("Error message doesn't describe the problem: %s", err.Error())
+	}
+
+	// A failed record still counts. AllRecordsSucceeded reports it.
+	result.FedoraResult.AddRecord("GenericFile", "file_registered", "data/new.pdf", "Fluctus returned 500")
+	if err = result.CheckRecordedFiles(toRecord); err != nil {
+		t.Errorf("All files have records, but got %v", err)
+	}
+
+	// Registering a file twice, or one we didn't mean to, is wrong too.
+	result.FedoraResult.AddRecord("GenericFile", "file_registered", "data/new.pdf", "")
+	result.FedoraResult.AddRecord("GenericFile", "file_registered", "data/unchanged.txt", "")
+	err = result.CheckRecordedFiles(toRecord)
+	if !bagman.IsFileCountError(err) {
+		t.Fatalf("Expected FileCountError, got %v", err)
+	}
+	countError = err.(*bagman.FileCountError)
+	if len(countError.Missing) != 0 || len(countError.Unexpected) != 2 {
+		t.Errorf("Expected 2 unexpected files and none missing, got %v and %v",
+			countError.Unexpected, countError.Missing)
+	}
+}
+
+func TestFailFileCount(t *testing.T) {
+	result := fileCountResult()
+	result.ErrorMessage = "Stored file data/new.pdf has md5 123, but the bag manifest says 456."
+	result.Retry = true
+	result.TarResult.Files = result.TarResult.Files[:2]
+	storeFiles(result)
+	err := result.CheckStoredFiles()
+	result.FailFileCount(err)
+	if !strings.HasPrefix(result.ErrorMessage, "[FILE COUNT MISMATCH] Store stage:") ||
+		!strings.HasSuffix(result.ErrorMessage, "but the bag manifest says 456.") {
+		t.Errorf("File count error should come first: %s", result.ErrorMessage)
+	}
+	if result.Retry {
+		t.Errorf("File count errors should not be retried")
+	}
+	status := result.IngestStatus(bagman.DiscardLogger("filecount_test"))
+	if status.Status != bagman.StatusFailed || !strings.HasPrefix(status.Note, "[FILE COUNT MISMATCH]") {
+		t.Errorf("Status should be failed with the mismatch first in the note: %s %s",
+			status.Status, status.Note)
+	}
+}
+
+func TestFileCountErrorListsPaths(t *testing.T) {
+	countError := &bagman.FileCountError{
+		Stage:    bagman.StageStore,
+		Problems: []string{"lost files"},
+	}
+	for i := 0; i < bagman.MAX_FILE_COUNT_PATHS+5; i++ {
+		countError.Missing = append(countError.Missing, "data/file")
+	}
+	if !strings.HasSuffix(countError.Error(), "and 5 more.") {
+		t.Errorf("Long path lists should be truncated: %s", countError.Error())
+	}
+}
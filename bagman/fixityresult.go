@@ -2,7 +2,6 @@ package bagman
 
 import (
 	"fmt"
-	"github.com/nsqio/go-nsq"
 	"github.com/satori/go.uuid"
 	"time"
 	"strings"
@@ -17,10 +16,11 @@ type FixityResult struct {
 	// This file is sitting somewhere on S3.
 	GenericFile   *GenericFile
 
-	// The NSQ message being worked on. This is only relevant
-	// if we using this struct in the context of an NSQ worker.
-	// The struct is still valid if this member is nil.
-	NsqMessage    *nsq.Message `json:"-"` // Don't serialize
+	// The message being worked on. This is only relevant
+	// if we using this struct in the context of a worker, under
+	// NSQ or the SyncDriver. The struct is still valid if this
+	// member is nil.
+	NsqMessage    Message      `json:"-"` // Don't serialize
 
 	// Does the file exist in S3?
 	S3FileExists  bool
@@ -43,6 +43,30 @@ type FixityResult struct {
 	// false on fatal errors, such as if the remote file
 	// does not exist.
 	Retry         bool
+
+	// How we checked an encrypted file: FIXITY_MODE_CIPHERTEXT,
+	// FIXITY_MODE_DECRYPT or FIXITY_MODE_SKIP. This is empty for
+	// unencrypted files. In ciphertext mode, Sha256 is the digest
+	// of the encrypted file, and we compare it with the digest we
+	// calculated when we stored the file. In decrypt mode, Sha256
+	// is the digest of the decrypted file.
+	FixityMode    string
+
+	// True if the encrypted file failed authenticated decryption.
+	// This means the stored file was corrupted or altered, so the
+	// fixity check fails.
+	DecryptionFailed bool
+
+	// True if this is a check of the copy in the replication
+	// bucket, rather than the copy in the preservation bucket.
+	// GenericFile.URI is then the replication URL.
+	Replica       bool
+
+	// The check of the replication copy, if we checked it. The
+	// fixity worker saves its event only after it saves the event
+	// for this check, so a requeued check doesn't record the
+	// replica twice.
+	ReplicaResult *FixityResult `json:"-"` // Don't serialize
 }
 
 
@@ -54,6 +78,19 @@ func NewFixityResult(gf *GenericFile) (*FixityResult) {
 	}
 }
 
+// Returns a FixityResult for checking the copy of gf in the
+// replication bucket, or nil if gf has not been replicated.
+func NewReplicaFixityResult(gf *GenericFile) (*FixityResult) {
+	if !gf.IsReplicated() {
+		return nil
+	}
+	replica := *gf
+	replica.URI = gf.ReplicationURL
+	result := NewFixityResult(&replica)
+	result.Replica = true
+	return result
+}
+
 // Returns the name of the S3 bucket and key for the GenericFile.
 func (result *FixityResult) BucketAndKey() (string, string, error) {
 	parts := strings.Split(result.GenericFile.URI, "/")
@@ -76,7 +113,20 @@ func (result *FixityResult) GotDigestFromPreservationFile() (bool) {
 
 // Returns true if the underlying GenericFile includes a SHA256 checksum.
 func (result *FixityResult) GenericFileHasDigest() (bool) {
-	return result.FedoraSha256() != ""
+	return result.ExpectedSha256() != ""
+}
+
+// Returns the SHA256 checksum we expect the preservation file to
+// have. In ciphertext mode, that's the digest of the encrypted file
+// we recorded at ingest. Otherwise, it's the digest in Fedora.
+func (result *FixityResult) ExpectedSha256() (string) {
+	if result.FixityMode == FIXITY_MODE_CIPHERTEXT {
+		if result.GenericFile.Encryption == nil {
+			return ""
+		}
+		return result.GenericFile.Encryption.EncryptedSha256
+	}
+	return result.FedoraSha256()
 }
 
 // Returns the SHA256 checksum that Fedora has on record.
@@ -97,10 +147,13 @@ func (result *FixityResult) FixityCheckPossible() (bool) {
 // Returns true if the sha256 sum we calculated for this file
 // matches the sha256 sum recorded in Fedora.
 func (result *FixityResult) Sha256Matches() (bool, error) {
+	if result.DecryptionFailed {
+		return false, nil
+	}
 	if result.FixityCheckPossible() == false {
 		return false, fmt.Errorf("Fixity check is not possible because one or more checksums are not available.")
 	}
-	return result.FedoraSha256() == result.Sha256, nil
+	return result.ExpectedSha256() == result.Sha256, nil
 }
 
 // Returns a PremisEvent describing the result of this fixity check.
@@ -112,11 +165,23 @@ func (result *FixityResult) BuildPremisEvent() (*PremisEvent, error) {
 	if err != nil {
 		return nil, err
 	}
-	if ok == false {
+	if result.FixityMode == FIXITY_MODE_CIPHERTEXT {
+		detail = "Fixity check of encrypted file against digest recorded at ingest"
+	} else if result.FixityMode == FIXITY_MODE_DECRYPT {
+		detail = "Fixity check of decrypted file against registered hash"
+	}
+	if result.DecryptionFailed {
+		detail = "Encrypted file failed authenticated decryption"
+		outcome = "failure"
+		outcomeInformation = result.ErrorMessage
+	} else if ok == false {
 		detail = "Fixity does not match expected value"
 		outcome = "failure"
 		outcomeInformation = fmt.Sprintf("Expected digest '%s', got '%s'",
-			result.FedoraSha256(), result.Sha256)
+			result.ExpectedSha256(), result.Sha256)
+	}
+	if result.Replica {
+		detail = detail + " (replication copy)"
 	}
 
 	youyoueyedee := uuid.NewV4()
@@ -124,13 +189,13 @@ func (result *FixityResult) BuildPremisEvent() (*PremisEvent, error) {
 	premisEvent := &PremisEvent {
 		Identifier: youyoueyedee.String(),
 		EventType: "fixity_check",
-		DateTime: time.Now().UTC(),
+		DateTime: NowUTC(),
 		Detail: detail,
 		Outcome: outcome,
 		OutcomeDetail: result.Sha256,
 		Object: "Go language cryptohash",
 		Agent: "http://golang.org/pkg/crypto/sha256/",
-		OutcomeInformation: outcomeInformation,
+		OutcomeInformation: VersionedOutcome(outcomeInformation),
 	}
 
 	return premisEvent, nil
@@ -182,8 +182,8 @@ func TestBuildPremisEvent_Success(t *testing.T) {
 		t.Errorf("PremisEvent.Outcome expected 'http://golang.org/pkg/crypto/sha256/' but got '%s'",
 			premisEvent.Agent)
 	}
-	if premisEvent.OutcomeInformation != "Fixity matches" {
-		t.Errorf("PremisEvent.OutcomeInformation expected 'Fixity matches' but got '%s'",
+	if premisEvent.OutcomeInformation != "Fixity matches; bagman dev" {
+		t.Errorf("PremisEvent.OutcomeInformation expected 'Fixity matches; bagman dev' but got '%s'",
 			premisEvent.OutcomeInformation)
 	}
 }
@@ -222,8 +222,35 @@ func TestBuildPremisEvent_Failure(t *testing.T) {
 		t.Errorf("PremisEvent.Outcome expected 'http://golang.org/pkg/crypto/sha256/' but got '%s'",
 			premisEvent.Agent)
 	}
-	if premisEvent.OutcomeInformation != "Expected digest 'fedcba9876543210', got 'xxx-xxx-xxx'" {
+	if premisEvent.OutcomeInformation != "Expected digest 'fedcba9876543210', got 'xxx-xxx-xxx'; bagman dev" {
 		t.Errorf("PremisEvent.OutcomeInformation expected '%s' but got '%s'",
 			result.ErrorMessage, premisEvent.OutcomeInformation)
 	}
 }
+
+func TestNewReplicaFixityResult(t *testing.T) {
+	gf := getGenericFile()
+	if bagman.NewReplicaFixityResult(gf) != nil {
+		t.Errorf("File that has not been replicated should have no replica result")
+	}
+	gf.ReplicationURL = "https://s3.amazonaws.com/aptrust.preservation.oregon/52a928da-89ef-48c6-4627-826d1858349b"
+	result := bagman.NewReplicaFixityResult(gf)
+	if result == nil || !result.Replica {
+		t.Fatalf("Expected replica result")
+	}
+	bucket, _, _ := result.BucketAndKey()
+	if bucket != "aptrust.preservation.oregon" {
+		t.Errorf("Replica result should check the replication bucket, not %s", bucket)
+	}
+	if gf.URI != "https://s3.amazonaws.com/aptrust.preservation.storage/52a928da-89ef-48c6-4627-826d1858349b" {
+		t.Errorf("NewReplicaFixityResult changed the original GenericFile's URI")
+	}
+	result.Sha256 = sha256sum
+	premisEvent, err := result.BuildPremisEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if premisEvent.Detail != "Fixity check against registered hash (replication copy)" {
+		t.Errorf("Unexpected PremisEvent.Detail '%s'", premisEvent.Detail)
+	}
+}
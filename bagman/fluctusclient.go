@@ -4,10 +4,12 @@ package bagman
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -29,15 +31,47 @@ const MAX_FLUCTUS_ERR_MSG_SIZE = 1000
 // Regex to match the top-level domain suffixes we expect to see.
 var domainPattern *regexp.Regexp = regexp.MustCompile("\\.edu|org|com$")
 
+// Default number of times to retry a request when we can't
+// resolve the Fluctus host name.
+const DEFAULT_FLUCTUS_DNS_RETRIES = 3
+
+// Default time to wait between DNS retries.
+const DEFAULT_FLUCTUS_DNS_BACKOFF = 2 * time.Second
+
+// ErrProcessStatusNotFound means Fluctus has no ProcessedItem with
+// the id we asked for.
+var ErrProcessStatusNotFound = errors.New("ProcessedItem not found")
+
 type FluctusClient struct {
-	hostUrl      string
-	apiVersion   string
-	apiUser      string
-	apiKey       string
-	httpClient   *http.Client
-	transport    *http.Transport
-	logger       *logging.Logger
-	institutions map[string]string
+	hostUrl         string
+	apiVersion      string
+	apiUser         string
+	apiKey          string
+	httpClient      *http.Client
+	transport       *http.Transport
+	logger          *logging.Logger
+	institutions    map[string]string
+	dnsRetries      int
+	dnsRetryBackoff time.Duration
+	breaker         *CircuitBreaker
+}
+
+// ErrDNSFailure is returned when the Fluctus client still
+// cannot resolve the Fluctus host name after retrying.
+type ErrDNSFailure struct {
+	// The host name we tried to resolve.
+	Host     string
+
+	// The number of times we tried the request.
+	Attempts int
+
+	// The error from the last attempt.
+	Err      *net.DNSError
+}
+
+func (e *ErrDNSFailure) Error() (string) {
+	return fmt.Sprintf("Cannot resolve Fluctus host %s after %d attempts: %v",
+		e.Host, e.Attempts, e.Err)
 }
 
 // Creates a new fluctus client. Param hostUrl should come from
@@ -54,7 +88,46 @@ func NewFluctusClient(hostUrl, apiVersion, apiUser, apiKey string, logger *loggi
 		DisableKeepAlives:   false,
 	}
 	httpClient := &http.Client{Jar: cookieJar, Transport: transport}
-	return &FluctusClient{hostUrl, apiVersion, apiUser, apiKey, httpClient, transport, logger, nil}, nil
+	return &FluctusClient{hostUrl, apiVersion, apiUser, apiKey, httpClient, transport,
+		logger, nil, DEFAULT_FLUCTUS_DNS_RETRIES, DEFAULT_FLUCTUS_DNS_BACKOFF,
+		NewCircuitBreaker("Fluctus", DEFAULT_FLUCTUS_BREAKER_THRESHOLD,
+			DEFAULT_FLUCTUS_BREAKER_COOLDOWN)}, nil
+}
+
+// SetDNSRetry sets the number of times the client retries a request
+// that failed because the Fluctus host name could not be resolved,
+// and how long it waits between tries. This is separate from any
+// retry logic for HTTP errors, since DNS failures are usually brief
+// and say nothing about whether Fluctus accepted the request. Zero
+// values leave the current setting unchanged.
+func (client *FluctusClient) SetDNSRetry(maxRetries int, backoff time.Duration) {
+	if maxRetries > 0 {
+		client.dnsRetries = maxRetries
+	}
+	if backoff > 0 {
+		client.dnsRetryBackoff = backoff
+	}
+}
+
+// SetCircuitBreaker replaces the client's circuit breaker with one
+// that opens after threshold consecutive failed requests, and stays
+// open for cooldown. While the breaker is open, requests fail with
+// a *CircuitOpenError without going to Fluctus. Connection errors
+// and 5xx responses count as failures. Zero values mean use the
+// defaults.
+func (client *FluctusClient) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	client.breaker = NewCircuitBreaker("Fluctus", threshold, cooldown)
+}
+
+// BreakerStatus returns the state of the client's circuit breaker.
+func (client *FluctusClient) BreakerStatus() (BreakerStatus) {
+	return client.breaker.Status()
+}
+
+// SetDialer replaces the function the client uses to open network
+// connections. This is for testing.
+func (client *FluctusClient) SetDialer(dial func(network, address string) (net.Conn, error)) {
+	client.transport.Dial = dial
 }
 
 // Caches a map of institutions in which institution domain name
@@ -174,7 +247,7 @@ func (client *FluctusClient) NewJsonRequest(method, targetUrl string, body io.Re
 func (client *FluctusClient) GetBagStatus(etag, name string, bag_date time.Time) (status *ProcessStatus, err error) {
 	statusUrl := client.BuildUrl(fmt.Sprintf("/api/%s/itemresults/%s/%s/%s",
 		client.apiVersion, etag, name,
-		url.QueryEscape(bag_date.Format(time.RFC3339))))
+		url.QueryEscape(FormatUTC(bag_date))))
 	req, err := client.NewJsonRequest("GET", statusUrl, nil)
 	if err != nil {
 		return nil, err
@@ -183,7 +256,9 @@ func (client *FluctusClient) GetBagStatus(etag, name string, bag_date time.Time)
 	return status, err
 }
 
-// GetBagStatusById returns the processed item with the specified ID, or nil.
+// GetBagStatusById returns the processed item with the specified ID.
+// If Fluctus has no such item, this returns ErrProcessStatusNotFound,
+// so callers can tell a missing record from a failed request.
 func (client *FluctusClient) GetBagStatusById(id int) (status *ProcessStatus, err error) {
 	statusUrl := client.BuildUrl(fmt.Sprintf("/api/%s/itemresults/%d", client.apiVersion, id))
 	req, err := client.NewJsonRequest("GET", statusUrl, nil)
@@ -191,6 +266,9 @@ func (client *FluctusClient) GetBagStatusById(id int) (status *ProcessStatus, er
 		return nil, err
 	}
 	status, err = client.doStatusRequest(req, 200)
+	if err == nil && status == nil {
+		return nil, ErrProcessStatusNotFound
+	}
 	return status, err
 }
 
@@ -206,7 +284,18 @@ func (client *FluctusClient) GetBagStatusById(id int) (status *ProcessStatus, er
 // retrySpecified and reviewSpecified indicate whether you want
 // ps.Retry and ps.Reviewed to be added in to the search criteria.
 func (client *FluctusClient) ProcessStatusSearch(ps *ProcessStatus, retrySpecified, reviewedSpecified bool) (statusRecords []*ProcessStatus, err error) {
-	queryString := ""
+	return client.processStatusSearch(ps, retrySpecified, reviewedSpecified, "")
+}
+
+// ProcessStatusSearchPage returns one page of the records that
+// ProcessStatusSearch returns, starting at offset. Use it when
+// the full list may be too large for one request.
+func (client *FluctusClient) ProcessStatusSearchPage(ps *ProcessStatus, retrySpecified, reviewedSpecified bool, offset, limit int) (statusRecords []*ProcessStatus, err error) {
+	return client.processStatusSearch(ps, retrySpecified, reviewedSpecified,
+		fmt.Sprintf("start=%d&rows=%d&", offset, limit))
+}
+
+func (client *FluctusClient) processStatusSearch(ps *ProcessStatus, retrySpecified, reviewedSpecified bool, queryString string) (statusRecords []*ProcessStatus, err error) {
 	if ps.ETag != "" { queryString += fmt.Sprintf("etag=%s&", ps.ETag) }
 	if ps.Name != "" { queryString += fmt.Sprintf("name=%s&", ps.Name) }
 	if ps.Action != "" { queryString += fmt.Sprintf("action=%s&", ps.Action) }
@@ -223,7 +312,7 @@ func (client *FluctusClient) ProcessStatusSearch(ps *ProcessStatus, retrySpecifi
 	}
 	if ps.BagDate.IsZero() == false {
 		queryString += fmt.Sprintf("bag_date=%s&",
-			url.QueryEscape(ps.BagDate.Format(time.RFC3339)))
+			url.QueryEscape(FormatUTC(ps.BagDate)))
 	}
 	statusUrl := client.BuildUrl(fmt.Sprintf("/api/%s/itemresults/search?%s",
 		client.apiVersion, queryString))
@@ -259,7 +348,7 @@ func (client *FluctusClient) GetFilesNotCheckedSince(daysAgo time.Time, offset,
 		fmt.Sprintf(
 			"/api/%s/files/not_checked_since.json?date=%s&start=%d&rows=%d",
 			client.apiVersion,
-			url.QueryEscape(daysAgo.UTC().Format(time.RFC3339)),
+			url.QueryEscape(FormatUTC(daysAgo)),
 			offset,
 			limit))
 
@@ -281,6 +370,35 @@ func (client *FluctusClient) GetFilesNotCheckedSince(daysAgo time.Time, offset,
 	return files, nil
 }
 
+// Returns a list of active GenericFiles that were stored before
+// the specified datetime and have no replication copy.
+func (client *FluctusClient) GetFilesNotReplicated(storedBefore time.Time, offset, limit int) (files []*GenericFile, err error) {
+	notReplicatedUrl := client.BuildUrl(
+		fmt.Sprintf(
+			"/api/%s/files/not_replicated.json?stored_before=%s&start=%d&rows=%d",
+			client.apiVersion,
+			url.QueryEscape(FormatUTC(storedBefore)),
+			offset,
+			limit))
+
+	request, err := client.NewJsonRequest("GET", notReplicatedUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := client.doRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	files = make([]*GenericFile, 0)
+	err = json.Unmarshal(body, &files)
+	if err != nil {
+		return nil, client.formatJsonError("GetFilesNotReplicated", body, err)
+	}
+
+	return files, nil
+}
+
 // Returns a lightweight version of the generic files belonging
 // to an intellectual object. See the comments above on IntellectualObjectGetForRestore.
 func (client *FluctusClient) GetGenericFileSummaries(intelObjIdentifier string) (files []*GenericFile, err error) {
@@ -309,10 +427,32 @@ func (client *FluctusClient) GetGenericFileSummaries(intelObjIdentifier string)
 // processing succeeded or failed. If it failed, the ProcessStatus
 // object includes some details of what went wrong.
 func (client *FluctusClient) UpdateProcessedItem(status *ProcessStatus) (err error) {
+	var remoteStatus *ProcessStatus
+	if status.Id > 0 {
+		// Workers sometimes send the same update twice, e.g. when a
+		// retry and the final log both report a failure. Look up
+		// what Fluctus has, so we can skip the PUT. If we can't
+		// tell, do the PUT.
+		remoteStatus, _ = client.GetBagStatusById(status.Id)
+	}
+	_, err = client.saveProcessedItem(status, remoteStatus)
+	return err
+}
+
+// Creates or updates the processed item and returns Fluctus' copy
+// of it. Param remoteStatus is Fluctus' current copy, if the caller
+// has already fetched it, or nil. If it matches status, this skips
+// the update and returns remoteStatus.
+func (client *FluctusClient) saveProcessedItem(status, remoteStatus *ProcessStatus) (*ProcessStatus, error) {
 	relativeUrl := fmt.Sprintf("/api/%s/itemresults", client.apiVersion)
 	httpMethod := "POST"
 	expectedResponseCode := 201
 	if status.Id > 0 {
+		if remoteStatus != nil && remoteStatus.SameProgressAs(status) {
+			client.logger.Debug("Not updating processed item %d: Fluctus already has %s/%s",
+				status.Id, status.Stage, status.Status)
+			return remoteStatus, nil
+		}
 		relativeUrl = fmt.Sprintf("/api/%s/itemresults/%d",
 			client.apiVersion, status.Id)
 		httpMethod = "PUT"
@@ -321,18 +461,19 @@ func (client *FluctusClient) UpdateProcessedItem(status *ProcessStatus) (err err
 	statusUrl := client.BuildUrl(relativeUrl)
 	postData, err := status.SerializeForFluctus()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req, err := client.NewJsonRequest(httpMethod, statusUrl, bytes.NewBuffer(postData))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	status, err = client.doStatusRequest(req, expectedResponseCode)
+	savedStatus, err := client.doStatusRequest(req, expectedResponseCode)
 	if err != nil {
 		client.logger.Error("JSON for failed Fluctus request: %s",
 			string(postData))
+		return nil, err
 	}
-	return err
+	return savedStatus, nil
 }
 
 func (client *FluctusClient) doStatusRequest(request *http.Request, expectedStatus int) (status *ProcessStatus, err error) {
@@ -366,7 +507,7 @@ func (client *FluctusClient) doStatusRequest(request *http.Request, expectedStat
 
 func (client *FluctusClient) BulkStatusGet(since time.Time) (statusRecords []*ProcessStatus, err error) {
 	objUrl := client.BuildUrl(fmt.Sprintf("/api/%s/itemresults/ingested_since/%s",
-		client.apiVersion, url.QueryEscape(since.UTC().Format(time.RFC3339))))
+		client.apiVersion, url.QueryEscape(FormatUTC(since))))
 	client.logger.Debug("Requesting bulk bag status from fluctus: %s", objUrl)
 	request, err := client.NewJsonRequest("GET", objUrl, nil)
 	if err != nil {
@@ -393,6 +534,37 @@ func (client *FluctusClient) BulkStatusGet(since time.Time) (statusRecords []*Pr
 }
 
 
+// BulkStatusGetPage returns one page of the ProcessStatus records
+// that BulkStatusGet returns, starting at offset. Use it when the
+// full list may be too large for one request.
+func (client *FluctusClient) BulkStatusGetPage(since time.Time, offset, limit int) (statusRecords []*ProcessStatus, err error) {
+	objUrl := client.BuildUrl(fmt.Sprintf("/api/%s/itemresults/ingested_since/%s?start=%d&rows=%d",
+		client.apiVersion, url.QueryEscape(FormatUTC(since)), offset, limit))
+	client.logger.Debug("Requesting page of bulk bag status from fluctus: %s", objUrl)
+	request, err := client.NewJsonRequest("GET", objUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, response, err := client.doRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// 400 or 500
+	if response.StatusCode != 200 {
+		message := "Request for bulk status page returned status code %d."
+		err = client.buildAndLogError(body, message, response.StatusCode)
+		return nil, err
+	}
+
+	statusRecords = make([]*ProcessStatus, 0)
+	err = json.Unmarshal(body, &statusRecords)
+	if err != nil {
+		return nil, client.formatJsonError(objUrl, body, err)
+	}
+	return statusRecords, nil
+}
+
 /*
 Returns a list of items that need to be restored.
 If param objectIdentifier is not an empty string, this
@@ -524,6 +696,9 @@ func (client *FluctusClient) IntellectualObjectGetForRestore(identifier string)
 	if err != nil {
 		return nil, err
 	}
+	if obj == nil {
+		return nil, fmt.Errorf("IntellectualObject %s not found", identifier)
+	}
 	files, err := client.GetGenericFileSummaries(identifier)
 	if err != nil {
 		return nil, err
@@ -675,6 +850,98 @@ func (client *FluctusClient) GenericFileGet(genericFileIdentifier string, includ
 	return obj, nil
 }
 
+// Sets the state of the GenericFile with the specified identifier.
+// Use StateDeleted to soft-delete a file and StateActive to undelete
+// it. Fluctus keeps deleted files, so their history is not lost.
+func (client *FluctusClient) GenericFileSetState(genericFileIdentifier, state string) (error) {
+	if state != StateActive && state != StateDeleted {
+		return fmt.Errorf("Invalid GenericFile state '%s'", state)
+	}
+	fileUrl := client.BuildUrl(fmt.Sprintf("/api/%s/files/%s",
+		client.apiVersion, escapeSlashes(genericFileIdentifier)))
+	data, err := json.Marshal(map[string]string{"state": state})
+	if err != nil {
+		return err
+	}
+	request, err := client.NewJsonRequest("PUT", fileUrl, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	client.logger.Debug("Setting state of GenericFile %s to %s", genericFileIdentifier, state)
+	body, response, err := client.doRequest(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != 204 && response.StatusCode != 200 {
+		return client.buildAndLogError(body,
+			"Fluctus replied to request to set state of GenericFile %s with status code %d.",
+			genericFileIdentifier, response.StatusCode)
+	}
+	return nil
+}
+
+// Marks the GenericFile oldIdentifier as superseded by newIdentifier,
+// which is the same content under the name the depositor renamed it
+// to. The old record is soft-deleted, and keeps a pointer to the new
+// one, so its history is not lost. The two share a preservation copy,
+// so the copy must not be deleted along with the old record.
+func (client *FluctusClient) GenericFileSetSuperseded(oldIdentifier, newIdentifier string) (error) {
+	fileUrl := client.BuildUrl(fmt.Sprintf("/api/%s/files/%s",
+		client.apiVersion, escapeSlashes(oldIdentifier)))
+	data, err := json.Marshal(map[string]string{
+		"state":         StateDeleted,
+		"superseded_by": newIdentifier,
+	})
+	if err != nil {
+		return err
+	}
+	request, err := client.NewJsonRequest("PUT", fileUrl, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	client.logger.Debug("Marking GenericFile %s as superseded by %s", oldIdentifier, newIdentifier)
+	body, response, err := client.doRequest(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != 204 && response.StatusCode != 200 {
+		return client.buildAndLogError(body,
+			"Fluctus replied to request to supersede GenericFile %s with status code %d.",
+			oldIdentifier, response.StatusCode)
+	}
+	return nil
+}
+
+// Records the URL of the verified copy of the GenericFile in the
+// replication bucket, and the time it was made.
+func (client *FluctusClient) GenericFileSetReplication(genericFileIdentifier, replicationUrl string, replicatedAt time.Time) (error) {
+	fileUrl := client.BuildUrl(fmt.Sprintf("/api/%s/files/%s",
+		client.apiVersion, escapeSlashes(genericFileIdentifier)))
+	data, err := json.Marshal(map[string]interface{}{
+		"replication_url": replicationUrl,
+		"replicated_at":   replicatedAt.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	request, err := client.NewJsonRequest("PUT", fileUrl, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	client.logger.Debug("Setting replication URL of GenericFile %s to %s",
+		genericFileIdentifier, replicationUrl)
+	body, response, err := client.doRequest(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != 204 && response.StatusCode != 200 {
+		return client.buildAndLogError(body,
+			"Fluctus replied to request to set replication URL of GenericFile %s with status code %d.",
+			genericFileIdentifier, response.StatusCode)
+	}
+	return nil
+}
+
 // Saves a GenericFile to fluctus. This function
 // figures out whether the save is a create or an update.
 // Param objId is the Id of the IntellectualObject to which
@@ -684,6 +951,14 @@ func (client *FluctusClient) GenericFileSave(objId string, gf *GenericFile) (new
 	if err != nil {
 		return nil, err
 	}
+	// When a file with a changed checksum is re-ingested, it gets a
+	// new UUID, and therefore a new URI in the preservation bucket.
+	uriChanged := (existingObj != nil && existingObj.URI != "" &&
+		gf.URI != "" && existingObj.URI != gf.URI)
+	if uriChanged {
+		client.logger.Info("URI changed for GenericFile %s: old URI %s, new URI %s",
+			gf.Identifier, existingObj.URI, gf.URI)
+	}
 	// URL & method for create
 	fileUrl := client.BuildUrl(fmt.Sprintf("/api/%s/objects/%s/files.json",
 		client.apiVersion, escapeSlashes(objId)))
@@ -722,16 +997,25 @@ func (client *FluctusClient) GenericFileSave(objId string, gf *GenericFile) (new
 	}
 
 	// On create, Fluctus returns the new object. On update, it returns nothing.
+	newGf = gf
 	if len(body) > 0 {
 		newGf = &GenericFile{}
 		err = json.Unmarshal(body, newGf)
 		if err != nil {
 			return nil, client.formatJsonError(request.URL.RequestURI(), body, err)
 		}
-		return newGf, nil
-	} else {
-		return gf, nil
 	}
+
+	// Record the move from the old URI to the new one.
+	if uriChanged {
+		event := gf.MigrationEvent(existingObj.URI)
+		_, err = client.PremisEventSave(gf.Identifier, "GenericFile", event)
+		if err != nil {
+			return nil, fmt.Errorf("GenericFile %s was saved, but its migration "+
+				"event could not be recorded: %v", gf.Identifier, err)
+		}
+	}
+	return newGf, nil
 }
 
 // Saves a batch of GenericFiles to fluctus. This is
@@ -776,6 +1060,57 @@ func (client *FluctusClient) GenericFileSaveBatch(objId string, files []*Generic
 }
 
 
+// AutoBatchGenericFileSave saves files to Fluctus, creating new
+// files in batches of batchSize with GenericFileSaveBatch, and
+// updating existing files one at a time with GenericFileSave,
+// since the batch call can only create. A file is new if its Id is
+// empty. If batchSize is less than one, this uses
+// MAX_FILES_FOR_CREATE. This saves as many files as it can, and
+// returns an error describing the first failure, if any.
+func (client *FluctusClient) AutoBatchGenericFileSave(objId string, files []*GenericFile, batchSize int) (error) {
+	if batchSize < 1 {
+		batchSize = MAX_FILES_FOR_CREATE
+	}
+	newFiles := make([]*GenericFile, 0)
+	existingFiles := make([]*GenericFile, 0)
+	for _, gf := range files {
+		if gf.Id == "" {
+			newFiles = append(newFiles, gf)
+		} else {
+			existingFiles = append(existingFiles, gf)
+		}
+	}
+	client.logger.Debug("Saving %d new and %d existing GenericFiles for object %s",
+		len(newFiles), len(existingFiles), objId)
+
+	failed := 0
+	var firstErr error
+	for start := 0; start < len(newFiles); start += batchSize {
+		end := start + batchSize
+		if end > len(newFiles) {
+			end = len(newFiles)
+		}
+		if err := client.GenericFileSaveBatch(objId, newFiles[start:end]); err != nil {
+			failed += end - start
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	for _, gf := range existingFiles {
+		if _, err := client.GenericFileSave(objId, gf); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("Could not save %d of %d generic files for %s: %v",
+			failed, len(files), objId, firstErr)
+	}
+	return nil
+}
 // Saves a PremisEvent to Fedora. Param objId should be the IntellectualObject id
 // if you're recording an object-related event, such as ingest; or a GenericFile id
 // if you're recording a file-related event, such as fixity generation.
@@ -839,21 +1174,42 @@ func escapeSlashes(s string) string {
 // SendProcessedItem sends information about the status of
 // processing this item to Fluctus. Param localStatus should come from
 // ProcessResult.ProcessStatus(), which gives information about
-// the current state of processing.
+// the current state of processing. If Fluctus already has the
+// record, this logs how the record is changing at DEBUG level, and
+// skips the update if nothing meaningful changed. See
+// ProcessStatus.Diff.
 func (client *FluctusClient) SendProcessedItem(localStatus *ProcessStatus) (err error) {
-	// Look up the status record in Fluctus. It should already exist.
-	// We want to get its ID and update the existing record, rather
-	// than creating a new record. Each bag should have no more than
-	// one ProcessedItem record.
-	remoteStatus, err := client.GetBagStatus(
-		localStatus.ETag, localStatus.Name, localStatus.BagDate)
-	if err != nil {
-		return err
+	var remoteStatus *ProcessStatus
+	if localStatus.Id > 0 {
+		// We already know which record this is. See
+		// RegisterProcessedItem. If we can't fetch it,
+		// update it anyway.
+		remoteStatus, _ = client.GetBagStatusById(localStatus.Id)
+	} else {
+		// Look up the status record in Fluctus. It should already
+		// exist. We want to get its ID and update the existing
+		// record, rather than creating a new record. Each bag
+		// should have no more than one ProcessedItem record.
+		remoteStatus, err = client.GetBagStatus(
+			localStatus.ETag, localStatus.Name, localStatus.BagDate)
+		if err != nil {
+			return err
+		}
+		if remoteStatus != nil {
+			localStatus.Id = remoteStatus.Id
+		}
 	}
 	if remoteStatus != nil {
-		localStatus.Id = remoteStatus.Id
+		diff := remoteStatus.Diff(localStatus)
+		if diff == "" {
+			client.logger.Debug("Not updating status in Fluctus for %s: no changes from %s/%s",
+				localStatus.Name, localStatus.Stage, localStatus.Status)
+			return nil
+		}
+		client.logger.Debug("Changes to status in Fluctus for %s (item %d): %s",
+			localStatus.Name, localStatus.Id, diff)
 	}
-	err = client.UpdateProcessedItem(localStatus)
+	_, err = client.saveProcessedItem(localStatus, remoteStatus)
 	if err != nil {
 		return err
 	}
@@ -862,6 +1218,36 @@ func (client *FluctusClient) SendProcessedItem(localStatus *ProcessStatus) (err
 	return nil
 }
 
+// RegisterProcessedItem makes sure Fluctus has a ProcessedItem
+// record for the bag described by localStatus, and returns the
+// record. If Fluctus already has one for this etag, name and bag
+// date, this updates it. Otherwise it creates one. Workers call this
+// before they start work on a bag, and send the record's Id with
+// all later updates, so those go straight to the right record.
+func (client *FluctusClient) RegisterProcessedItem(localStatus *ProcessStatus) (*ProcessStatus, error) {
+	remoteStatus, err := client.GetBagStatus(
+		localStatus.ETag, localStatus.Name, localStatus.BagDate)
+	if err != nil {
+		return nil, err
+	}
+	if remoteStatus != nil {
+		localStatus.Id = remoteStatus.Id
+	}
+	savedStatus, err := client.saveProcessedItem(localStatus, remoteStatus)
+	if err != nil {
+		return nil, err
+	}
+	if savedStatus != nil && savedStatus.Id == 0 {
+		savedStatus.Id = localStatus.Id
+	}
+	if savedStatus == nil || savedStatus.Id == 0 {
+		return nil, fmt.Errorf("Fluctus did not return an id for processed item %s", localStatus.Name)
+	}
+	client.logger.Info("Registered %s in Fluctus as item %d: %s/%s",
+		localStatus.Name, savedStatus.Id, localStatus.Stage, localStatus.Status)
+	return savedStatus, nil
+}
+
 /*
 This sets the status of the bag restore operation on all
 ProcessedItem records for all bag parts that make up the
@@ -878,6 +1264,9 @@ func (client *FluctusClient) RestorationStatusSet(processStatus *ProcessStatus)
 	client.logger.Debug("Setting restoration status: %s - stage = %s, status = %s, retry = %t",
 		objUrl, processStatus.Stage, processStatus.Status, processStatus.Retry)
 	jsonData, err := processStatus.SerializeForFluctus()
+	if err != nil {
+		return err
+	}
 	request, err := client.NewJsonRequest("POST", objUrl, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("Could not build POST request for %s: %v", objUrl, err)
@@ -897,6 +1286,36 @@ func (client *FluctusClient) RestorationStatusSet(processStatus *ProcessStatus)
 	return nil
 }
 
+// CompleteRestore marks the restoration of the specified object as
+// successful and finished, so it will not be retried, and records
+// the download URL and its expiration time in the note that the
+// depositor sees in Fluctus. Like RestorationStatusSet, this updates
+// the status of all parts of the object.
+func (client *FluctusClient) CompleteRestore(objectIdentifier, downloadURL string, expiry time.Time) (error) {
+	if downloadURL == "" {
+		return fmt.Errorf("Download URL cannot be empty.")
+	}
+	processStatus := &ProcessStatus{
+		ObjectIdentifier: objectIdentifier,
+		Date:             NowUTC(),
+		Note:             restoreDownloadNote(expiry, downloadURL),
+		Action:           ActionRestore,
+		Stage:            StageResolve,
+		Status:           StatusSuccess,
+		Outcome:          OutcomeSuccess,
+		Retry:            false,
+		NeedsAdminReview: false,
+	}
+	return client.RestorationStatusSet(processStatus)
+}
+
+// Returns the note telling depositors where to download their
+// restored bags, and until when.
+func restoreDownloadNote(expiry time.Time, urls ...string) (string) {
+	return fmt.Sprintf("Restored bag is available for download until %s at %s",
+		expiry.UTC().Format(time.RFC3339), strings.Join(urls, " "))
+}
+
 // Delete the data we created with our integration tests
 func (client *FluctusClient) DeleteFluctusTestData() error {
 	urls := make([]string, 1)
@@ -939,8 +1358,59 @@ func readResponse(body io.ReadCloser) (data []byte, err error) {
 	return data, err
 }
 
+// Sends the request and reads the response. If the request fails
+// because the Fluctus host name can't be resolved, this waits and
+// tries again, up to client.dnsRetries times, and then returns an
+// *ErrDNSFailure.
+// Sends request through the client's circuit breaker. If the
+// breaker is open, this returns a *CircuitOpenError without
+// sending anything.
 func (client *FluctusClient) doRequest(request *http.Request) (data []byte, response *http.Response, err error) {
-	response, err = client.httpClient.Do(request)
+	if err = client.breaker.Allow(); err != nil {
+		return nil, nil, err
+	}
+	data, response, err = client.sendRequest(request)
+	if err != nil || response.StatusCode >= 500 {
+		if client.breaker.RecordFailure() {
+			client.logger.Error("Fluctus circuit breaker opened after %s %s failed. "+
+				"Status: %s", request.Method, request.URL, client.breaker.Status())
+		}
+	} else if client.breaker.RecordSuccess() {
+		client.logger.Info("Fluctus circuit breaker closed: %s %s succeeded",
+			request.Method, request.URL)
+	}
+	return data, response, err
+}
+
+func (client *FluctusClient) sendRequest(request *http.Request) (data []byte, response *http.Response, err error) {
+	attempts := 0
+	for {
+		attempts++
+		response, err = client.httpClient.Do(request)
+		dnsError := getDNSError(err)
+		if dnsError == nil {
+			break
+		}
+		if attempts > client.dnsRetries {
+			return nil, nil, &ErrDNSFailure{
+				Host:     request.URL.Host,
+				Attempts: attempts,
+				Err:      dnsError,
+			}
+		}
+		client.logger.Warning("DNS lookup failed for %s %s (attempt %d): %v. Retrying in %s.",
+			request.Method, request.URL, attempts, dnsError, client.dnsRetryBackoff)
+		time.Sleep(client.dnsRetryBackoff)
+		if request.Body != nil {
+			if request.GetBody == nil {
+				return nil, nil, err
+			}
+			request.Body, err = request.GetBody()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -951,6 +1421,20 @@ func (client *FluctusClient) doRequest(request *http.Request) (data []byte, resp
 	return data, response, err
 }
 
+// Returns the *net.DNSError underlying err, or nil if err
+// is not a DNS error. The http client wraps dial errors in
+// a *url.Error, and the dialer may wrap them in a *net.OpError.
+func getDNSError(err error) (*net.DNSError) {
+	if urlError, ok := err.(*url.Error); ok {
+		err = urlError.Err
+	}
+	if opError, ok := err.(*net.OpError); ok {
+		err = opError.Err
+	}
+	dnsError, _ := err.(*net.DNSError)
+	return dnsError
+}
+
 func (client *FluctusClient) buildAndLogError(body []byte, formatString string, args ...interface{}) (err error) {
 	if len(body) < MAX_FLUCTUS_ERR_MSG_SIZE {
 		formatString += " Response body: %s"
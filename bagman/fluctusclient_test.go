@@ -3,10 +3,14 @@
 package bagman_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -390,6 +394,70 @@ func TestGenericFileSave(t *testing.T) {
 	}
 }
 
+// This test does not need a Fluctus server. It uses a mock server
+// that already has the GenericFile at URI A, and checks that saving
+// the file with URI B records a migration event.
+func TestGenericFileSaveWithChangedURI(t *testing.T) {
+	oldURI := "https://s3.amazonaws.com/aptrust.test.preservation/a"
+	newURI := "https://s3.amazonaws.com/aptrust.test.preservation/b"
+	var savedEvent *bagman.PremisEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET":
+			existingGf := &bagman.GenericFile{Identifier: gfId, URI: oldURI}
+			data, _ := json.Marshal(existingGf)
+			w.Write(data)
+		case r.Method == "PUT":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/events"):
+			body, _ := ioutil.ReadAll(r.Body)
+			savedEvent = &bagman.PremisEvent{}
+			json.Unmarshal(body, savedEvent)
+			w.WriteHeader(http.StatusCreated)
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	logger := bagman.DiscardLogger("client_test")
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, fluctusAPIVersion,
+		"user", "key", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gf := &bagman.GenericFile{Identifier: gfId, URI: newURI}
+	_, err = fluctusClient.GenericFileSave(objId, gf)
+	if err != nil {
+		t.Errorf("GenericFileSave returned error: %v", err)
+		return
+	}
+	if savedEvent == nil {
+		t.Errorf("GenericFileSave did not save a migration event")
+		return
+	}
+	if savedEvent.EventType != "migration" {
+		t.Errorf("Expected event type 'migration', got '%s'", savedEvent.EventType)
+	}
+	if !strings.Contains(savedEvent.OutcomeDetail, oldURI) ||
+		!strings.Contains(savedEvent.OutcomeDetail, newURI) {
+		t.Errorf("Migration event outcome detail '%s' should include old and new URIs",
+			savedEvent.OutcomeDetail)
+	}
+
+	// Saving with an unchanged URI should not create a migration event.
+	savedEvent = nil
+	gf.URI = oldURI
+	_, err = fluctusClient.GenericFileSave(objId, gf)
+	if err != nil {
+		t.Errorf("GenericFileSave returned error: %v", err)
+	}
+	if savedEvent != nil {
+		t.Errorf("GenericFileSave should not save a migration event when URI is unchanged")
+	}
+}
+
 func TestEventSave(t *testing.T) {
 	if runFluctusTests() == false {
 		return
@@ -568,7 +636,7 @@ func TestSendProcessedItem(t *testing.T) {
 		Action:      "Ingest",
 		Stage:       "Receive",
 		Status:      "Pending",
-		Outcome:     "O-diddly Kay!",
+		OutcomeDetails: "O-diddly Kay!",
 		Retry:       true,
 		Reviewed:    false,
 		State:       "{ \"msg\": \"This should be a blob of JSON\" }",
@@ -596,6 +664,46 @@ func TestSendProcessedItem(t *testing.T) {
 	}
 }
 
+func TestSendProcessedItemSkipsUnchanged(t *testing.T) {
+	fakeFluctus := &itemResultServer{records: make([]map[string]interface{}, 0)}
+	server := httptest.NewServer(fakeFluctus)
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("fluctusclient_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := ProcessStatusSample()
+	status.Id = 0
+	status.Name = "sample_bag.tar"
+	if err = fluctusClient.SendProcessedItem(status); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote record matches, so there's nothing to PUT.
+	unchanged := ProcessStatusSample()
+	unchanged.Id = 0
+	unchanged.Name = "sample_bag.tar"
+	if err = fluctusClient.SendProcessedItem(unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if fakeFluctus.posts != 1 || fakeFluctus.puts != 0 {
+		t.Errorf("Expected 1 POST and no PUT, got %d posts and %d puts",
+			fakeFluctus.posts, fakeFluctus.puts)
+	}
+	if unchanged.Id != 1 {
+		t.Errorf("SendProcessedItem should set the id of the existing record, got %d", unchanged.Id)
+	}
+
+	unchanged.Note = "Something new"
+	if err = fluctusClient.SendProcessedItem(unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if fakeFluctus.puts != 1 {
+		t.Errorf("Changed note should be sent in 1 PUT, got %d", fakeFluctus.puts)
+	}
+}
+
 func TestRestorationItemsGet(t *testing.T) {
 	if runFluctusTests() == false {
 		return
@@ -782,7 +890,7 @@ func TestRestorationStatusSet(t *testing.T) {
 		Action:      "Restore",
 		Stage:       "Requested",
 		Status:      "Pending",
-		Outcome:     "la de da",
+		OutcomeDetails: "la de da",
 		Retry:       true,
 		Reviewed:    false,
 	}
@@ -849,6 +957,91 @@ func TestRestorationStatusSet(t *testing.T) {
 
 }
 
+func TestGenericFileSetSuperseded(t *testing.T) {
+	var method, requestURI string
+	var payload map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		requestURI = r.RequestURI
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &payload)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fluctusClient.GenericFileSetSuperseded("test.edu/bag/data/old.txt", "test.edu/bag/data/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedURI := "/api/v1/files/test.edu%2Fbag%2Fdata%2Fold.txt"
+	if method != "PUT" || requestURI != expectedURI {
+		t.Errorf("Sent %s to %s, expected PUT to %s", method, requestURI, expectedURI)
+	}
+	if payload["state"] != bagman.StateDeleted || payload["superseded_by"] != "test.edu/bag/data/new.txt" {
+		t.Errorf("Wrong payload %v", payload)
+	}
+}
+
+func TestCompleteRestore(t *testing.T) {
+	var requestURI string
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloadURL := "https://s3.amazonaws.com/aptrust.restore.test.edu/cin.675812.tar?Signature=abc"
+	expiry := time.Date(2015, 7, 1, 12, 0, 0, 0, time.UTC)
+	err = fluctusClient.CompleteRestore("test.edu/cin.675812", downloadURL, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedURI := "/api/v1/itemresults/restoration_status/test.edu%2Fcin.675812"
+	if requestURI != expectedURI {
+		t.Errorf("Posted to %s, expected %s", requestURI, expectedURI)
+	}
+	if payload["stage"] != bagman.StageResolve {
+		t.Errorf("Stage should be Resolve, but is %v", payload["stage"])
+	}
+	if payload["status"] != bagman.StatusSuccess {
+		t.Errorf("Status should be Success, but is %v", payload["status"])
+	}
+	if payload["action"] != bagman.ActionRestore {
+		t.Errorf("Action should be Restore, but is %v", payload["action"])
+	}
+	if payload["retry"] != false {
+		t.Errorf("Retry should be false, but is %v", payload["retry"])
+	}
+	if payload["object_identifier"] != "test.edu/cin.675812" {
+		t.Errorf("Wrong object identifier %v", payload["object_identifier"])
+	}
+	note, _ := payload["note"].(string)
+	if !strings.Contains(note, downloadURL) || !strings.Contains(note, "until 2015-07-01T12:00:00Z") {
+		t.Errorf("Note should include download URL and expiry, but is '%s'", note)
+	}
+
+	err = fluctusClient.CompleteRestore("test.edu/cin.675812", "", expiry)
+	if err == nil {
+		t.Errorf("CompleteRestore should require a download URL")
+	}
+	err = fluctusClient.CompleteRestore("", downloadURL, expiry)
+	if err == nil {
+		t.Errorf("CompleteRestore should require an object identifier")
+	}
+}
+
 func TestNewJsonRequest(t *testing.T) {
 	fluctusClient := getClient(t)
 	request, err := fluctusClient.NewJsonRequest("GET",
@@ -973,3 +1166,397 @@ func TestGetFilesNotCheckedSince(t *testing.T) {
 		t.Errorf("GenericFile records are missing checksums")
 	}
 }
+
+// Returns a dialer that fails DNS lookup the first failures times
+// it's called, and then connects to serverAddr.
+func flakyDNSDialer(failures int, serverAddr string, calls *int) (func(network, address string) (net.Conn, error)) {
+	return func(network, address string) (net.Conn, error) {
+		*calls++
+		if *calls <= failures {
+			return nil, &net.OpError{
+				Op:  "dial",
+				Net: network,
+				Err: &net.DNSError{Err: "no such host", Name: address, IsNotFound: true},
+			}
+		}
+		return net.Dial(network, serverAddr)
+	}
+}
+
+func newDNSTestServer() (*httptest.Server) {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"pid":"aptrust-test:1","name":"Test University","identifier":"test.edu"}`)
+	}))
+}
+
+func TestDoRequestRetriesDNSFailure(t *testing.T) {
+	server := newDNSTestServer()
+	defer server.Close()
+	client, err := bagman.NewFluctusClient("http://fluctus.example.com", "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialCalls := 0
+	client.SetDialer(flakyDNSDialer(2, server.Listener.Addr().String(), &dialCalls))
+	client.SetDNSRetry(3, time.Millisecond)
+
+	institution, err := client.InstitutionGet("test.edu")
+	if err != nil {
+		t.Fatalf("InstitutionGet should have succeeded after DNS retries: %v", err)
+	}
+	if dialCalls != 3 {
+		t.Errorf("Expected 3 dial attempts, got %d", dialCalls)
+	}
+	if institution.Pid != "aptrust-test:1" || institution.Identifier != "test.edu" {
+		t.Errorf("Got wrong institution from response body: %v", institution)
+	}
+}
+
+func TestDoRequestReturnsErrDNSFailure(t *testing.T) {
+	server := newDNSTestServer()
+	defer server.Close()
+	client, err := bagman.NewFluctusClient("http://fluctus.example.com", "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialCalls := 0
+	client.SetDialer(flakyDNSDialer(10, server.Listener.Addr().String(), &dialCalls))
+	client.SetDNSRetry(2, time.Millisecond)
+
+	_, err = client.InstitutionGet("test.edu")
+	dnsFailure, ok := err.(*bagman.ErrDNSFailure)
+	if !ok {
+		t.Fatalf("Expected *ErrDNSFailure, got %v", err)
+	}
+	if dnsFailure.Attempts != 3 || dialCalls != 3 {
+		t.Errorf("Expected 3 attempts, got %d (dialer called %d times)",
+			dnsFailure.Attempts, dialCalls)
+	}
+	if dnsFailure.Host != "fluctus.example.com" || !dnsFailure.Err.IsNotFound {
+		t.Errorf("ErrDNSFailure has wrong details: %v", dnsFailure)
+	}
+}
+
+func TestUpdateProcessedItemSkipsRedundantPut(t *testing.T) {
+	remote := ProcessStatusSample()
+	remote.Id = 42
+	puts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/itemresults/42" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "PUT" {
+			puts++
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+			return
+		}
+		data, _ := remote.SerializeForFluctus()
+		w.Write(data)
+	}))
+	defer server.Close()
+	client, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := ProcessStatusSample()
+	local.Id = 42
+	if err = client.UpdateProcessedItem(local); err != nil {
+		t.Fatal(err)
+	}
+	if puts != 0 {
+		t.Errorf("UpdateProcessedItem should not PUT a status Fluctus already has")
+	}
+
+	local.Status = bagman.StatusFailed
+	if err = client.UpdateProcessedItem(local); err != nil {
+		t.Fatal(err)
+	}
+	if puts != 1 {
+		t.Errorf("UpdateProcessedItem should PUT a changed status, made %d PUTs", puts)
+	}
+}
+
+// With a known id, SendProcessedItem fetches the record once and
+// uses that copy for both the diff and the PUT.
+func TestSendProcessedItemFetchesOnce(t *testing.T) {
+	remote := ProcessStatusSample()
+	remote.Id = 42
+	gets, puts := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/itemresults/42" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "PUT" {
+			puts++
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+			return
+		}
+		gets++
+		data, _ := remote.SerializeForFluctus()
+		w.Write(data)
+	}))
+	defer server.Close()
+	client, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := ProcessStatusSample()
+	local.Id = 42
+	if err = client.SendProcessedItem(local); err != nil {
+		t.Fatal(err)
+	}
+	if gets != 1 || puts != 0 {
+		t.Errorf("Unchanged status: expected 1 GET and no PUT, got %d and %d", gets, puts)
+	}
+
+	local.Status = bagman.StatusFailed
+	if err = client.SendProcessedItem(local); err != nil {
+		t.Fatal(err)
+	}
+	if gets != 2 || puts != 1 {
+		t.Errorf("Changed status: expected 2 GETs and 1 PUT in all, got %d and %d", gets, puts)
+	}
+}
+
+func TestFluctusCircuitBreaker(t *testing.T) {
+	requests := 0
+	healthy := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{"pid":"aptrust-test:1","name":"Test University","identifier":"test.edu"}`)
+	}))
+	defer server.Close()
+	client, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetCircuitBreaker(3, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if _, err = client.InstitutionGet("test.edu"); err == nil || bagman.IsCircuitOpen(err) {
+			t.Errorf("Request %d should have reached Fluctus and failed, got %v", i+1, err)
+		}
+	}
+	if state := client.BreakerStatus().State; state != bagman.BreakerOpen {
+		t.Fatalf("Breaker should be open after 3 failures, got %s", state)
+	}
+
+	// While the breaker is open, requests fail without going to Fluctus.
+	_, err = client.InstitutionGet("test.edu")
+	if !bagman.IsCircuitOpen(err) {
+		t.Errorf("Expected CircuitOpenError, got %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Fluctus got %d requests, expected 3", requests)
+	}
+
+	// Once Fluctus is back and the cooldown is over, the trial
+	// request goes through and the breaker closes.
+	healthy = true
+	time.Sleep(60 * time.Millisecond)
+	institution, err := client.InstitutionGet("test.edu")
+	if err != nil {
+		t.Fatalf("Trial request should have succeeded, got %v", err)
+	}
+	if institution.Identifier != "test.edu" || requests != 4 {
+		t.Errorf("Got institution %v after %d requests", institution, requests)
+	}
+	if state := client.BreakerStatus().State; state != bagman.BreakerClosed {
+		t.Errorf("Breaker should be closed after a successful trial, got %s", state)
+	}
+}
+
+func TestRegisterProcessedItem(t *testing.T) {
+	existingId := 0
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method + " " + r.URL.Path)
+		data, _ := ioutil.ReadAll(r.Body)
+		status := &bagman.ProcessStatus{}
+		json.Unmarshal(data, status)
+		switch {
+		case r.Method == "GET" && existingId == 0:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.Method == "GET":
+			status = &bagman.ProcessStatus{Id: existingId, Stage: bagman.StageValidate,
+				Status: bagman.StatusFailed}
+		case r.Method == "POST":
+			status.Id = 42
+			w.WriteHeader(http.StatusCreated)
+		}
+		data, _ = json.Marshal(status)
+		w.Write(data)
+	}))
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	localStatus := &bagman.ProcessStatus{Name: "bag.tar", ETag: "1234",
+		Stage: bagman.StageFetch, Status: bagman.StatusStarted}
+
+	// No record yet, so this creates one.
+	record, err := fluctusClient.RegisterProcessedItem(localStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Id != 42 || len(requests) != 2 || requests[1] != "POST /api/v1/itemresults" {
+		t.Errorf("Expected to create item 42, got item %d with requests %v", record.Id, requests)
+	}
+
+	// A record from an earlier attempt is updated.
+	existingId = 7
+	requests = make([]string, 0)
+	localStatus.Id = 0
+	record, err = fluctusClient.RegisterProcessedItem(localStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Id != 7 || requests[len(requests) - 1] != "PUT /api/v1/itemresults/7" {
+		t.Errorf("Expected to update item 7, got item %d with requests %v", record.Id, requests)
+	}
+
+	// Once we know the id, updates skip the lookup by etag,
+	// name and date.
+	requests = make([]string, 0)
+	localStatus.Stage = bagman.StageUnpack
+	if err = fluctusClient.SendProcessedItem(localStatus); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"GET /api/v1/itemresults/7", "PUT /api/v1/itemresults/7"}
+	if len(requests) != 2 || requests[0] != expected[0] || requests[1] != expected[1] {
+		t.Errorf("Expected requests %v, got %v", expected, requests)
+	}
+}
+
+func TestAutoBatchGenericFileSave(t *testing.T) {
+	batchSizes := make([]int, 0)
+	updates := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/files/save_batch"):
+			data, _ := ioutil.ReadAll(r.Body)
+			postData := make(map[string][]map[string]interface{})
+			json.Unmarshal(data, &postData)
+			batchSizes = append(batchSizes, len(postData["generic_files"]))
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "GET":
+			// GenericFileSave checks whether the file exists.
+			w.Write([]byte(`{"id": "existing"}`))
+		case r.Method == "PUT":
+			if strings.HasSuffix(r.RequestURI, "bad.txt") {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			updates = append(updates, r.RequestURI)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.RequestURI)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make([]*bagman.GenericFile, 0)
+	for i := 0; i < 5; i++ {
+		files = append(files, &bagman.GenericFile{
+			Identifier: fmt.Sprintf("test.edu/bag/data/new%d.txt", i),
+		})
+	}
+	files = append(files, &bagman.GenericFile{Id: "test:1", Identifier: "test.edu/bag/data/old1.txt"})
+	files = append(files, &bagman.GenericFile{Id: "test:2", Identifier: "test.edu/bag/data/old2.txt"})
+	err = fluctusClient.AutoBatchGenericFileSave("test.edu/bag", files, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Five new files in batches of two, and two updates.
+	if len(batchSizes) != 3 || batchSizes[0] != 2 || batchSizes[1] != 2 || batchSizes[2] != 1 {
+		t.Errorf("Expected batches of 2, 2 and 1, got %v", batchSizes)
+	}
+	if len(updates) != 2 || updates[0] != "/api/v1/files/test.edu%2Fbag%2Fdata%2Fold1.txt" {
+		t.Errorf("Expected updates of the two existing files, got %v", updates)
+	}
+
+	// A failed update doesn't stop the others.
+	updates = make([]string, 0)
+	files = append(files, &bagman.GenericFile{Id: "test:3", Identifier: "test.edu/bag/data/bad.txt"})
+	err = fluctusClient.AutoBatchGenericFileSave("test.edu/bag", files[5:], 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "Could not save 1 of 3 generic files") {
+		t.Errorf("Expected an error for 1 of 3 files, got %v", err)
+	}
+	if len(updates) != 2 {
+		t.Errorf("Expected 2 successful updates, got %v", updates)
+	}
+}
+
+func TestGetBagStatusByIdResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/itemresults/42":
+			json.NewEncoder(w).Encode(&bagman.ProcessStatus{
+				Id: 42,
+				Name: "bag.tar",
+				Institution: "test.edu",
+				Status: bagman.StatusPending,
+			})
+		case "/api/v1/itemresults/500":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": "Something broke"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := fluctusClient.GetBagStatusById(42)
+	if err != nil {
+		t.Errorf("GetBagStatusById(42) returned error: %v", err)
+	} else if status == nil || status.Id != 42 || status.Institution != "test.edu" {
+		t.Errorf("GetBagStatusById(42) returned %v", status)
+	}
+
+	status, err = fluctusClient.GetBagStatusById(7)
+	if err != bagman.ErrProcessStatusNotFound {
+		t.Errorf("Expected ErrProcessStatusNotFound on 404, got %v", err)
+	}
+	if status != nil {
+		t.Errorf("Expected nil status on 404, got %v", status)
+	}
+
+	// Server errors are not the same as missing records.
+	status, err = fluctusClient.GetBagStatusById(500)
+	if err == nil || err == bagman.ErrProcessStatusNotFound {
+		t.Errorf("Expected a server error on 500, got %v", err)
+	}
+	if status != nil {
+		t.Errorf("Expected nil status on 500, got %v", status)
+	}
+}
@@ -3,6 +3,7 @@ package bagman
 import (
 	"fmt"
 	"encoding/json"
+	"github.com/satori/go.uuid"
 	"strings"
 	"time"
 )
@@ -32,6 +33,15 @@ such as:
 
 1994-11-05T08:15:30-05:00     (Local Time)
 1994-11-05T08:15:30Z          (UTC)
+
+State is StateActive ("A") or StateDeleted ("D").
+
+Encryption describes how the preservation copy was encrypted,
+or is nil if it's stored unencrypted. See encryption.go.
+
+ReplicationURL is the location of the copy of the file in the
+replication bucket, and ReplicatedAt is when apt_replicate made
+and verified that copy. ReplicationURL is empty until then.
 */
 type GenericFile struct {
 	Id                 string               `json:"id"`
@@ -43,19 +53,58 @@ type GenericFile struct {
 	Modified           time.Time            `json:"modified"`
 	ChecksumAttributes []*ChecksumAttribute `json:"checksum"`
 	Events             []*PremisEvent       `json:"premisEvents"`
+	State              string               `json:"state"`
+	Encryption         *EncryptionInfo      `json:"encryption,omitempty"`
+	ReplicationURL     string               `json:"replication_url,omitempty"`
+	ReplicatedAt       time.Time            `json:"replicated_at"`
 }
 
 // Serializes a version of GenericFile that Fluctus will accept as post/put input.
 func (gf *GenericFile) SerializeForFluctus() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
+	data := map[string]interface{}{
 		"identifier":          gf.Identifier,
 		"file_format":         gf.Format,
 		"uri":                 gf.URI,
 		"size":                gf.Size,
-		"created":             gf.Created,
-		"modified":            gf.Modified,
+		"created":             gf.Created.UTC(),
+		"modified":            gf.Modified.UTC(),
 		"checksum_attributes": gf.ChecksumAttributes,
-	})
+	}
+	if gf.Encryption != nil {
+		data["encryption"] = gf.Encryption
+	}
+	if gf.IsReplicated() {
+		data["replication_url"] = gf.ReplicationURL
+		data["replicated_at"] = gf.ReplicatedAt.UTC()
+	}
+	return json.Marshal(data)
+}
+
+// Returns true if the preservation copy of this file is encrypted.
+func (gf *GenericFile) IsEncrypted() (bool) {
+	return gf.Encryption != nil
+}
+
+// Returns true if the file has a verified copy in the replication
+// bucket.
+func (gf *GenericFile) IsReplicated() (bool) {
+	return gf.ReplicationURL != ""
+}
+
+// Returns the time the file was stored in the preservation bucket,
+// which is the time of its earliest ingest event. Files without
+// ingest events return Created, which is usually earlier.
+func (gf *GenericFile) StoredAt() (time.Time) {
+	storedAt := time.Time{}
+	for _, event := range gf.FindEventsByType("ingest") {
+		if !event.DateTime.IsZero() && (storedAt.IsZero() || event.DateTime.Before(storedAt)) {
+			storedAt = event.DateTime
+		}
+	}
+	if storedAt.IsZero() {
+		return gf.Created
+	}
+	return storedAt
 }
 
 // Returns the original path of the file within the original bag.
@@ -70,6 +119,29 @@ func (gf *GenericFile) OriginalPath() (string, error) {
 	return parts[2], nil
 }
 
+// IsPayloadFile returns true if the file was in the original bag's
+// data directory.
+func (gf *GenericFile) IsPayloadFile() (bool) {
+	originalPath, err := gf.OriginalPath()
+	return err == nil && IsPayloadPath(originalPath)
+}
+
+// IsTagFile returns true if the file was a tag file in the original
+// bag, either in the top-level directory or in a custom tag directory.
+// Manifests are not tag files. See IsTagPath.
+func (gf *GenericFile) IsTagFile() (bool) {
+	originalPath, err := gf.OriginalPath()
+	return err == nil && IsTagPath(originalPath)
+}
+
+// IsManifest returns true if the file was a payload manifest or tag
+// manifest in the original bag. We don't normally store these, but
+// older ingests did.
+func (gf *GenericFile) IsManifest() (bool) {
+	originalPath, err := gf.OriginalPath()
+	return err == nil && IsManifestPath(originalPath)
+}
+
 // Returns the name of the original bag.
 func (gf *GenericFile) BagName() (string, error) {
 	parts := strings.Split(gf.Identifier, "/")
@@ -117,6 +189,15 @@ func (gf *GenericFile) FindEventsByType(eventType string) ([]PremisEvent) {
 	return events
 }
 
+// MergeEvents drops from gf.Events the events that are already in
+// existing, which should be the events Fluctus has for this file.
+// Events match if they have the same type and outcome detail. Call
+// this before saving a file we're ingesting again, so unchanged
+// checksums don't get a second set of fixity and ingest events.
+func (gf *GenericFile) MergeEvents(existing []*PremisEvent) {
+	gf.Events = mergeEvents(gf.Identifier, gf.Events, existing)
+}
+
 // Returns the name of this file in the preservation storage bucket
 // (that should be a UUID), or an error if the GenericFile does not
 // have a valid preservation storage URL.
@@ -128,21 +209,48 @@ func (gf *GenericFile) PreservationStorageFileName() (string, error) {
 	return parts[len(parts) - 1], nil
 }
 
+// Returns a PremisEvent describing the move of this file's
+// preservation copy from oldURI to its current URI. This happens
+// when a file whose checksum has changed is re-ingested and
+// stored under a new UUID.
+func (gf *GenericFile) MigrationEvent(oldURI string) (*PremisEvent) {
+	eventId := uuid.NewV4()
+	return &PremisEvent{
+		Identifier:         eventId.String(),
+		EventType:          "migration",
+		DateTime:           NowUTC(),
+		Detail:             "File moved to new preservation storage URI",
+		Outcome:            string(StatusSuccess),
+		OutcomeDetail:      fmt.Sprintf("%s -> %s", oldURI, gf.URI),
+		Object:             "bagman + goamz s3 client",
+		Agent:              "https://github.com/APTrust/bagman",
+		OutcomeInformation: VersionedOutcome(fmt.Sprintf("Old URI: %s; New URI: %s", oldURI, gf.URI)),
+	}
+}
+
 // Converts a generic file to a map structure which can then be
 // serialized to JSON. The resulting structure includes both checksums
 // and premis events, and is intended for the save_batch action of
 // Fluctus' generic_files controller.
 func (gf *GenericFile) ToMapForBulkSave() (map[string]interface{}) {
-	return map[string]interface{}{
+	data := map[string]interface{}{
 		"identifier":   gf.Identifier,
 		"file_format":  gf.Format,
 		"uri":          gf.URI,
 		"size":         gf.Size,
-		"created":      gf.Created,
-		"modified":     gf.Modified,
+		"created":      gf.Created.UTC(),
+		"modified":     gf.Modified.UTC(),
 		"checksum":     gf.ChecksumAttributes,
 		"premisEvents": gf.Events,
 	}
+	if gf.Encryption != nil {
+		data["encryption"] = gf.Encryption
+	}
+	if gf.IsReplicated() {
+		data["replication_url"] = gf.ReplicationURL
+		data["replicated_at"] = gf.ReplicatedAt.UTC()
+	}
+	return data
 }
 
 // Converts generic files to maps, so we can serialize to JSON.
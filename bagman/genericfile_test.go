@@ -1,8 +1,10 @@
 package bagman_test
 
 import (
+	"encoding/json"
 	"github.com/APTrust/bagman/bagman"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -44,6 +46,51 @@ func TestOriginalPath(t *testing.T) {
 	}
 }
 
+func TestPayloadTagAndManifestFiles(t *testing.T) {
+	testCases := []struct {
+		originalPath string
+		payload      bool
+		tag          bool
+		manifest     bool
+	}{
+		// Payload files
+		{"data/object.properties", true, false, false},
+		{"data/images/photo_01.jpg", true, false, false},
+		{"data/manifest-md5.txt", true, false, false},
+		{"data/bag-info.txt", true, false, false},
+		// Top-level tag files
+		{"bagit.txt", false, true, false},
+		{"bag-info.txt", false, true, false},
+		{"aptrust-info.txt", false, true, false},
+		// Nested tag files
+		{"custom_tags/notes.txt", false, true, false},
+		{"dpn-tags/dpn-info.txt", false, true, false},
+		{"custom_tags/manifest-md5.txt", false, true, false},
+		{"metadata/data/file.xml", false, true, false},
+		// Manifests
+		{"manifest-md5.txt", false, false, true},
+		{"manifest-sha256.txt", false, false, true},
+		{"tagmanifest-md5.txt", false, false, true},
+		{"tagmanifest-sha256.txt", false, false, true},
+	}
+	for _, tc := range testCases {
+		gf := &bagman.GenericFile{Identifier: "uc.edu/cin.675812/" + tc.originalPath}
+		if gf.IsPayloadFile() != tc.payload {
+			t.Errorf("%s: IsPayloadFile should be %t", tc.originalPath, tc.payload)
+		}
+		if gf.IsTagFile() != tc.tag {
+			t.Errorf("%s: IsTagFile should be %t", tc.originalPath, tc.tag)
+		}
+		if gf.IsManifest() != tc.manifest {
+			t.Errorf("%s: IsManifest should be %t", tc.originalPath, tc.manifest)
+		}
+	}
+	// A file with an invalid identifier is none of these.
+	gf := &bagman.GenericFile{Identifier: "uc.edu/cin.675812"}
+	if gf.IsPayloadFile() || gf.IsTagFile() || gf.IsManifest() {
+		t.Errorf("GenericFile with invalid identifier should be neither payload, tag nor manifest")
+	}
+}
 
 func TestGetChecksum(t *testing.T) {
 	filename := filepath.Join("testdata", "intel_obj.json")
@@ -166,7 +213,7 @@ func TestGenericFilesToFluctusMap(t *testing.T) {
 		t.Errorf("size expected %d, got %d", 80, gfMap["size"])
 	}
 
-	expectedTime := "1980-01-01T00:00:00-05:00"
+	expectedTime := "1980-01-01T05:00:00Z"
 	created := gfMap["created"].(time.Time).Format(time.RFC3339)
 	if created != expectedTime {
 		t.Errorf("created expected %v, got %v", expectedTime, created)
@@ -230,3 +277,155 @@ func TestFindEventsByType(t *testing.T) {
 	}
 
 }
+
+func TestStoredAt(t *testing.T) {
+	created := time.Date(2014, 4, 25, 18, 5, 51, 0, time.UTC)
+	firstIngest := time.Date(2014, 6, 12, 9, 30, 0, 0, time.UTC)
+	gf := &bagman.GenericFile{Created: created}
+	if !gf.StoredAt().Equal(created) {
+		t.Errorf("File with no ingest events should use Created, got %v", gf.StoredAt())
+	}
+	gf.Events = []*bagman.PremisEvent{
+		&bagman.PremisEvent{EventType: "ingest", DateTime: firstIngest.Add(24 * time.Hour)},
+		&bagman.PremisEvent{EventType: "fixity_check", DateTime: created},
+		&bagman.PremisEvent{EventType: "ingest", DateTime: firstIngest},
+	}
+	if !gf.StoredAt().Equal(firstIngest) {
+		t.Errorf("Expected StoredAt %v, got %v", firstIngest, gf.StoredAt())
+	}
+}
+
+// Returns a GenericFile with every field set, including
+// fields of its checksums and events.
+func TestGenericFileMergeEvents(t *testing.T) {
+	fixity := &bagman.PremisEvent{Identifier: "1", EventType: "fixity_check", OutcomeDetail: "md5:1234"}
+	ingest := &bagman.PremisEvent{Identifier: "2", EventType: "ingest", OutcomeDetail: "1234"}
+	newFixity := &bagman.PremisEvent{Identifier: "3", EventType: "fixity_check", OutcomeDetail: "md5:5678"}
+	genericFile := &bagman.GenericFile{
+		Identifier: "uc.edu/cin.675812/data/object.properties",
+		Events: []*bagman.PremisEvent{
+			&bagman.PremisEvent{Identifier: "4", EventType: "fixity_check", OutcomeDetail: "md5:1234"},
+			newFixity,
+			&bagman.PremisEvent{Identifier: "5", EventType: "Ingest", OutcomeDetail: "1234"},
+			&bagman.PremisEvent{Identifier: "6", EventType: "fixity_check", OutcomeDetail: "md5:5678"},
+		},
+	}
+	genericFile.MergeEvents([]*bagman.PremisEvent{fixity, ingest})
+	if len(genericFile.Events) != 1 || genericFile.Events[0] != newFixity {
+		t.Errorf("Expected only the new fixity event after merge, got %d events",
+			len(genericFile.Events))
+	}
+
+	// Nothing in common: keep everything.
+	genericFile.Events = []*bagman.PremisEvent{fixity, ingest}
+	genericFile.MergeEvents([]*bagman.PremisEvent{newFixity})
+	if len(genericFile.Events) != 2 {
+		t.Errorf("Merge dropped events that were not duplicates")
+	}
+	genericFile.MergeEvents(nil)
+	if len(genericFile.Events) != 2 {
+		t.Errorf("Merge with no existing events dropped events")
+	}
+}
+
+func fullyPopulatedGenericFile() (*bagman.GenericFile) {
+	created := time.Date(2014, 4, 25, 18, 5, 51, 123456789, time.UTC)
+	modified := time.Date(2014, 6, 12, 9, 30, 0, 0, time.UTC)
+	return &bagman.GenericFile{
+		Id:         "28082",
+		Identifier: "uc.edu/cin.675812/data/object.properties",
+		Format:     "text/plain",
+		URI:        "https://s3.amazonaws.com/aptrust.test.preservation/9a8bf6f2-50ef-4cf4-a0c1-b0e6ff6c3b2d",
+		Size:       80,
+		Created:    created,
+		Modified:   modified,
+		ChecksumAttributes: []*bagman.ChecksumAttribute{
+			&bagman.ChecksumAttribute{
+				Algorithm: "md5",
+				DateTime:  modified,
+				Digest:    "8d7b0e3a24fc899b1d92a73537401805",
+			},
+			&bagman.ChecksumAttribute{
+				Algorithm: "sha256",
+				DateTime:  modified,
+				Digest:    "a418d61067718141d7254d7376d5499369706e3ade27cb84c4d5519f7cfed790",
+			},
+		},
+		Events: []*bagman.PremisEvent{
+			&bagman.PremisEvent{
+				Identifier:         "6c2c5a2a-9ad7-4e7a-8b26-3a9e4c1b7c39",
+				EventType:          "fixity_check",
+				DateTime:           modified,
+				Detail:             "Fixity check against registered hash",
+				Outcome:            "success",
+				OutcomeDetail:      "sha256:a418d61067718141d7254d7376d5499369706e3ade27cb84c4d5519f7cfed790",
+				Object:             "Go language cryptohash",
+				Agent:              "http://golang.org/pkg/crypto/sha256/",
+				OutcomeInformation: "Fixity matches",
+			},
+		},
+		State: bagman.StateActive,
+		Encryption: &bagman.EncryptionInfo{
+			Algorithm:        bagman.ENCRYPTION_ALGORITHM,
+			ChunkSize:        bagman.ENCRYPTION_CHUNK_SIZE,
+			KeyWrapAlgorithm: bagman.KEY_WRAP_RSA_OAEP,
+			KeyId:            "uc.edu-2016",
+			WrappedKey:       "c2VjcmV0IGtleQ==",
+			EncryptedSize:    96,
+			EncryptedSha256:  "4f1b0e27b58cb2a8a8ee5dd4f8d35bd0ad3af9d3c2bbf0b9ae5eb1a90c6f2f3e",
+		},
+		ReplicationURL: "https://s3.amazonaws.com/aptrust.test.preservation.oregon/9a8bf6f2-50ef-4cf4-a0c1-b0e6ff6c3b2d",
+		ReplicatedAt:   time.Date(2014, 6, 12, 10, 15, 0, 0, time.UTC),
+	}
+}
+
+// GenericFiles travel between bagman and Fluctus as JSON, and
+// between our own services in NSQ messages. Make sure nothing
+// is lost along the way.
+func TestGenericFileRoundTrip(t *testing.T) {
+	original := fullyPopulatedGenericFile()
+
+	// Straight serialization, as in NSQ messages and
+	// GenericFileGet responses, should preserve every field.
+	jsonData, err := json.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := &bagman.GenericFile{}
+	err = json.Unmarshal(jsonData, copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(original, copied) {
+		t.Errorf("GenericFile changed in JSON round trip.\nBefore: %s\nAfter:  %s",
+			jsonData, mustMarshal(t, copied))
+	}
+
+	// The bulk save map is what we send to Fluctus. Fluctus
+	// assigns the id and state, so those are not included, but
+	// everything else should come back in the GenericFile format.
+	jsonData, err = json.Marshal(original.ToMapForBulkSave())
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied = &bagman.GenericFile{}
+	err = json.Unmarshal(jsonData, copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fullyPopulatedGenericFile()
+	expected.Id = ""
+	expected.State = ""
+	if !reflect.DeepEqual(expected, copied) {
+		t.Errorf("GenericFile changed in bulk save round trip.\nBefore: %s\nAfter:  %s",
+			mustMarshal(t, expected), mustMarshal(t, copied))
+	}
+}
+
+func mustMarshal(t *testing.T, value interface{}) (string) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -3,11 +3,11 @@ package bagman
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/nsqio/go-nsq"
 	"github.com/crowdmob/goamz/s3"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -18,10 +18,18 @@ type IngestHelper struct {
 	Result          *ProcessResult
 	bytesInS3       int64
 	bytesProcessed  int64
+	// keyWrapper wraps the data keys for encrypted files. This is
+	// nil if we don't encrypt this institution's files.
+	keyWrapper      KeyWrapper
+	// The number of bytes reserved on ProcUtil.Volume for this bag.
+	volumeReserved  uint64
+	// The number of bytes reserved on the extract volume for this
+	// bag. See ProcessUtil.ExtractDirVolume.
+	extractReserved uint64
 }
 
 // Returns a new IngestHelper
-func NewIngestHelper(procUtil *ProcessUtil, message *nsq.Message, s3File *S3File) (*IngestHelper){
+func NewIngestHelper(procUtil *ProcessUtil, message Message, s3File *S3File) (*IngestHelper){
 	return &IngestHelper{
 		ProcUtil: procUtil,
 		Result: newResult(message, s3File),
@@ -32,7 +40,7 @@ func NewIngestHelper(procUtil *ProcessUtil, message *nsq.Message, s3File *S3File
 
 // Returns a new ProcessResult for the specified NSQ message
 // and S3 bag (tar file)
-func newResult(message *nsq.Message, s3File *S3File) (*ProcessResult) {
+func newResult(message Message, s3File *S3File) (*ProcessResult) {
 	return &ProcessResult{
 		NsqMessage:    message,
 		S3File:        s3File,
@@ -53,7 +61,7 @@ func newResult(message *nsq.Message, s3File *S3File) (*ProcessResult) {
 // If we get rid of NSQ and read directly from the
 // database, we can get rid of this.
 func BagNeedsProcessing(s3File *S3File, procUtil *ProcessUtil) bool {
-	bagDate, err := time.Parse(S3DateFormat, s3File.Key.LastModified)
+	bagDate, err := ParseS3Time(s3File.Key.LastModified)
 	if err != nil {
 		procUtil.MessageLog.Error("Cannot parse S3File mod date '%s'. "+
 			"File %s will be re-processed.",
@@ -73,6 +81,21 @@ func BagNeedsProcessing(s3File *S3File, procUtil *ProcessUtil) bool {
 	return true
 }
 
+// Returns true if the bag is larger than Config.MaxBagSize.
+// In that case, this also sets the result's error message and
+// sets Retry to false, since the bag will never fit. Call this
+// before fetching the bag.
+func (helper *IngestHelper) BagTooLarge() (bool) {
+	s3Key := helper.Result.S3File.Key
+	note := helper.ProcUtil.Config.OversizeBagNote(s3Key.Key, s3Key.Size)
+	if note == "" {
+		return false
+	}
+	helper.Result.ErrorMessage = note
+	helper.Result.Retry = false
+	return true
+}
+
 func (helper *IngestHelper) IncompleteCopyToS3() (bool) {
 	return (helper.Result.TarResult.AnyFilesCopiedToPreservation() == true &&
 		helper.Result.TarResult.AllFilesCopiedToPreservation() == false)
@@ -80,15 +103,101 @@ func (helper *IngestHelper) IncompleteCopyToS3() (bool) {
 
 func (helper *IngestHelper) FailedAndNoMoreRetries() (bool) {
 	return (helper.Result.ErrorMessage != "" &&
-		helper.Result.NsqMessage.Attempts >= uint16(helper.ProcUtil.Config.StoreWorker.MaxAttempts))
+		helper.Result.NsqMessage.Attempts() >= uint16(helper.ProcUtil.Config.StoreWorker.MaxAttempts))
+}
+
+// Reserves numBytes on ProcUtil.Volume for this bag. Returns an
+// error if there isn't enough disk space.
+func (helper *IngestHelper) ReserveVolume(numBytes uint64) (error) {
+	err := helper.ProcUtil.Volume.Reserve(numBytes)
+	if err == nil {
+		helper.volumeReserved += numBytes
+	}
+	return err
+}
+
+// Reserves space for this bag's tar file on the download volume,
+// and the same amount for its untarred files on the extract volume.
+// Bags we stream need only the extract volume. Returns an error,
+// and reserves nothing, if either doesn't have enough space.
+func (helper *IngestHelper) ReserveBagSpace(tarFileSize uint64) (error) {
+	// Streamed bags never write the tar file to the download volume.
+	if !helper.StreamsUntar() {
+		if err := helper.ReserveVolume(tarFileSize); err != nil {
+			return err
+		}
+	}
+	err := helper.ProcUtil.ExtractDirVolume().Reserve(tarFileSize)
+	if err != nil {
+		helper.ReleaseDownloadVolume()
+		return err
+	}
+	helper.extractReserved += tarFileSize
+	return nil
+}
+
+// Returns true if this bag will be untarred as it comes in from S3,
+// rather than downloaded first. See Config.StreamUntar. We stream
+// only multi-part uploads, since we can't check their md5 against
+// the ETag anyway.
+func (helper *IngestHelper) StreamsUntar() (bool) {
+	return helper.ProcUtil.Config.StreamUntar && isMultipartETag(helper.Result.S3File.Key.ETag)
+}
+
+// Releases whatever space this bag has reserved on ProcUtil.Volume
+// and the extract volume. It's safe to call this more than once.
+func (helper *IngestHelper) ReleaseVolume() {
+	helper.ReleaseDownloadVolume()
+	if helper.extractReserved > 0 {
+		helper.ProcUtil.ExtractDirVolume().Release(helper.extractReserved)
+		helper.extractReserved = 0
+	}
+}
+
+// Releases the space this bag reserved on ProcUtil.Volume, which
+// holds the tar file. DeleteTarFile calls this.
+func (helper *IngestHelper) ReleaseDownloadVolume() {
+	if helper.volumeReserved > 0 {
+		helper.ProcUtil.Volume.Release(helper.volumeReserved)
+		helper.volumeReserved = 0
+	}
+}
+
+// Returns the directory this bag untars into.
+func (helper *IngestHelper) UnpackDir() (string) {
+	bagDir := TrimTarExtension(helper.Result.S3File.Key.Key)
+	return filepath.Join(helper.ProcUtil.Config.ExtractDir(), bagDir)
+}
+
+// UntarredDir returns the directory the bag was actually untarred
+// into, as recorded in TarResult.OutputDir. That's usually the same
+// as UnpackDir, but not when the folder inside the tar file is named
+// differently from the tar file. If the bag hasn't been untarred, or
+// OutputDir isn't a subdirectory of the extract directory, this
+// returns UnpackDir, so cleanup never removes the extract directory
+// itself.
+func (helper *IngestHelper) UntarredDir() (string) {
+	unpackDir := helper.UnpackDir()
+	if helper.Result.TarResult == nil || helper.Result.TarResult.OutputDir == "" {
+		return unpackDir
+	}
+	extractDir, err := filepath.Abs(helper.ProcUtil.Config.ExtractDir())
+	if err != nil {
+		return unpackDir
+	}
+	outputDir := filepath.Clean(helper.Result.TarResult.OutputDir)
+	relPath, err := filepath.Rel(extractDir, outputDir)
+	if err != nil || relPath == "." || relPath == ".." ||
+		strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return unpackDir
+	}
+	return outputDir
 }
 
 // Returns an OPEN reader for the specified File (reading it from
 // the local disk). Caller is responsible for closing the reader.
 func (helper *IngestHelper) GetFileReader(file *File) (*os.File, string, error) {
-	re := regexp.MustCompile("\\.tar$")
-	bagDir := re.ReplaceAllString(helper.Result.S3File.Key.Key, "")
-	filePath := filepath.Join(helper.ProcUtil.Config.TarDirectory, bagDir, file.Path)
+	filePath := filepath.Join(helper.UntarredDir(), file.Path)
 	absPath, err := filepath.Abs(filePath)
 	if err != nil {
 		// Consider this error transient. Leave retry = true.
@@ -136,10 +245,14 @@ func (helper *IngestHelper) GetS3Options(file *File) (*s3.Options, error) {
 // Unpacks the bag file at path, extracts tag info and returns information
 // about whether it was successfully unpacked, valid and complete.
 func (helper *IngestHelper) ProcessBagFile() {
-	helper.Result.Stage = "Unpack"
+	helper.Result.EnterStage(StageUnpack, &helper.ProcUtil.Config)
 	instDomain := OwnerOf(helper.Result.S3File.BucketName)
-	helper.Result.TarResult = Untar(helper.Result.FetchResult.LocalFile,
-		instDomain, helper.Result.S3File.BagName(), true)
+	// Streamed bags were untarred during the fetch.
+	if !helper.Result.FetchResult.Streamed {
+		helper.Result.TarResult = UntarTo(helper.Result.FetchResult.LocalFile,
+			helper.ProcUtil.Config.ExtractDir(), instDomain, helper.Result.S3File.BagName(), true,
+			helper.ProcUtil.Config.DigestSettings())
+	}
 	if helper.Result.TarResult.ErrorMessage != "" {
 		helper.Result.ErrorMessage = helper.Result.TarResult.ErrorMessage
 		// If we can't untar this, there's no reason to retry...
@@ -147,22 +260,105 @@ func (helper *IngestHelper) ProcessBagFile() {
 		// where we do want to retry, such as if disk was full.
 		helper.Result.Retry = false
 	} else {
-		helper.Result.Stage = "Validate"
+		helper.Result.CompleteStage(StageUnpack)
+		helper.Result.EnterStage(StageValidate, &helper.ProcUtil.Config)
 		helper.Result.BagReadResult = ReadBag(helper.Result.TarResult.OutputDir)
 		if helper.Result.BagReadResult.ErrorMessage != "" {
 			helper.Result.ErrorMessage = helper.Result.BagReadResult.ErrorMessage
 			// Something was wrong with this bag. Bad checksum,
 			// missing file, etc. Don't reprocess it.
 			helper.Result.Retry = false
+		} else if err := helper.checkRequiredFiles(); err != nil {
+			helper.Result.BagReadResult.ErrorMessage = err.Error()
+			helper.Result.ErrorMessage = err.Error()
+			helper.Result.Retry = false
+		} else if err := ReconcileTarAndManifest(helper.Result.TarResult,
+			helper.Result.BagReadResult); err != nil {
+			// A file in the tar but not the manifest would be stored
+			// with no checksum from the depositor. A file in the
+			// manifest but not the tar is missing. Either way, the
+			// bag is invalid, and retrying won't help.
+			helper.Result.BagReadResult.ErrorMessage = err.Error()
+			helper.Result.ErrorMessage = err.Error()
+			helper.Result.Retry = false
 		} else {
-			for i := range helper.Result.TarResult.Files {
-				file := helper.Result.TarResult.Files[i]
-				file.Md5Verified = time.Now()
+			// Check for junk first, so skipped junk files aren't
+			// also reported as empty.
+			helper.checkJunkFiles()
+			if err := helper.checkZeroByteFiles(); err != nil {
+				helper.Result.BagReadResult.ErrorMessage = err.Error()
+				helper.Result.ErrorMessage = err.Error()
+				helper.Result.Retry = false
+			} else {
+				for i := range helper.Result.TarResult.Files {
+					file := helper.Result.TarResult.Files[i]
+					file.Md5Verified = NowUTC()
+				}
+				helper.Result.RecordUnpackedFiles()
+				helper.Result.CompleteStage(StageValidate)
 			}
 		}
 	}
 }
 
+// Makes sure every file listed in the payload manifests was in the
+// tar file. Each missing file goes into BagReadResult.ChecksumErrors,
+// since we can't verify its checksum, and the bag is invalid.
+func (helper *IngestHelper) checkRequiredFiles() (error) {
+	bagReadResult := helper.Result.BagReadResult
+	missing := helper.Result.TarResult.HasAllRequiredFiles(bagReadResult.ManifestPaths())
+	for _, filePath := range missing {
+		bagReadResult.ChecksumErrors = append(bagReadResult.ChecksumErrors,
+			fmt.Errorf("%s is listed in the manifest, but it is not in the bag", filePath))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Bag is missing %d file(s) listed in its manifests: %s",
+			len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Adds a warning for each payload file that looks like an operating
+// system's junk, such as .DS_Store. If the config says to skip junk
+// files, this removes them from the TarResult, so they won't be
+// stored or recorded.
+func (helper *IngestHelper) checkJunkFiles() {
+	tarResult := helper.Result.TarResult
+	junkFiles := tarResult.JunkFiles(helper.ProcUtil.Config.JunkFilePatternList())
+	if len(junkFiles) == 0 {
+		return
+	}
+	skip := helper.ProcUtil.Config.SkipJunkFiles
+	for _, filePath := range junkFiles {
+		if skip {
+			tarResult.Warnings = append(tarResult.Warnings,
+				fmt.Sprintf("Skipping system file %s", filePath))
+		} else {
+			tarResult.Warnings = append(tarResult.Warnings,
+				fmt.Sprintf("Payload file %s looks like a system file, but will be ingested", filePath))
+		}
+	}
+	if skip {
+		tarResult.RemoveFiles(junkFiles)
+		tarResult.SkippedFiles = append(tarResult.SkippedFiles, junkFiles...)
+	}
+}
+
+// Adds a warning for each empty payload file. Returns an error
+// if there are empty files and the config says to reject them.
+func (helper *IngestHelper) checkZeroByteFiles() (error) {
+	zeroByteFiles := helper.Result.TarResult.ZeroByteFiles()
+	for _, filePath := range zeroByteFiles {
+		helper.Result.TarResult.Warnings = append(helper.Result.TarResult.Warnings,
+			fmt.Sprintf("Payload file %s is empty (zero bytes)", filePath))
+	}
+	if len(zeroByteFiles) > 0 && helper.ProcUtil.Config.RejectZeroByteFiles {
+		return fmt.Errorf("Bag contains %d empty payload file(s): %s",
+			len(zeroByteFiles), strings.Join(zeroByteFiles, ", "))
+	}
+	return nil
+}
+
 func (helper *IngestHelper) LogResult() {
 		// Log full results to the JSON log
 		json, err := json.Marshal(helper.Result)
@@ -173,7 +369,10 @@ func (helper *IngestHelper) LogResult() {
 
 		// Add a message to the message log
 		atomic.AddInt64(&helper.bytesInS3, int64(helper.Result.S3File.Key.Size))
-		if helper.Result.ErrorMessage != "" {
+		if helper.Result.Cancelled {
+			helper.ProcUtil.MessageLog.Info("%s -> cancelled: %s", helper.Result.S3File.BagName(),
+				helper.Result.ErrorMessage)
+		} else if helper.Result.ErrorMessage != "" {
 			helper.ProcUtil.IncrementFailed()
 			helper.ProcUtil.MessageLog.Error("%s -> %s", helper.Result.S3File.BagName(), helper.Result.ErrorMessage)
 		} else {
@@ -216,48 +415,158 @@ func (helper *IngestHelper) MergeFedoraRecord() (error) {
 	}
 	if fedoraObj != nil {
 		helper.Result.TarResult.MergeExistingFiles(fedoraObj.GenericFiles)
+		helper.Result.DetectReingestNoOp()
 	}
 	return nil
 }
 
+// This deletes the tar file we downloaded from S3. If the fetch
+// failed before we knew where to put the file, FetchResult.LocalFile
+// will be empty, and there's nothing to delete. If the file has already
+// been deleted, that's fine too. Neither case is an error, and neither
+// should show up in the logs as a warning.
+func (helper *IngestHelper) DeleteTarFile() (error) {
+	if helper.Result.FetchResult == nil || helper.Result.FetchResult.LocalFile == "" {
+		helper.ProcUtil.MessageLog.Debug("No local tar file to delete")
+		return nil
+	}
+	if helper.Result.FetchResult.Streamed {
+		helper.ProcUtil.MessageLog.Debug("%s was streamed, so there's no local tar file to delete",
+			helper.Result.S3File.Key.Key)
+		return nil
+	}
+	err := os.Remove(helper.Result.FetchResult.LocalFile)
+	if err != nil && os.IsNotExist(err) {
+		helper.ProcUtil.MessageLog.Debug("Tar file %s was already deleted",
+			helper.Result.FetchResult.LocalFile)
+		err = nil
+	}
+	if err == nil {
+		helper.ReleaseDownloadVolume()
+	}
+	return err
+}
+
 // This deletes the tar file and all of the files that were
 // unpacked from it. Param file is the path the tar file.
 func (helper *IngestHelper) DeleteLocalFiles() (errors []error) {
 	errors = make([]error, 0)
-	if FileExists(helper.Result.FetchResult.LocalFile) {
-		err := os.Remove(helper.Result.FetchResult.LocalFile)
+	if helper.Result.FetchResult == nil || helper.Result.FetchResult.LocalFile == "" {
+		// Without a tar file name, we don't know the untarred dir
+		// name either, and we certainly don't want to RemoveAll("").
+		helper.ProcUtil.MessageLog.Debug("No local files to delete")
+		return errors
+	}
+	if err := helper.DeleteTarFile(); err != nil {
+		errors = append(errors, err)
+	}
+	// Delete the directory Untar actually wrote to. If the folder
+	// inside the tar file had a different name than the tar file,
+	// also delete the directory we expected, in case an earlier
+	// attempt left anything there.
+	untarredDirs := []string{helper.UntarredDir()}
+	if untarredDirs[0] != helper.UnpackDir() {
+		untarredDirs = append(untarredDirs, helper.UnpackDir())
+	}
+	for _, untarredDir := range untarredDirs {
+		err := os.RemoveAll(untarredDir)
 		if err != nil {
+			helper.ProcUtil.MessageLog.Error("Error deleting dir %s: %s\n", untarredDir, err.Error())
 			errors = append(errors, err)
 		}
 	}
-	// The untarred dir name is the same as the tar file, minus
-	// the .tar extension. This is guaranteed by bag.Untar.
-	re := regexp.MustCompile("\\.tar$")
-	untarredDir := re.ReplaceAllString(helper.Result.FetchResult.LocalFile, "")
-	err := os.RemoveAll(untarredDir)
-	if err != nil {
-		helper.ProcUtil.MessageLog.Error("Error deleting dir %s: %s\n", untarredDir, err.Error())
-		errors = append(errors, err)
-	}
 	return errors
 }
 
-// This fetches a file from S3 and stores it locally.
+// This fetches a file from S3 and stores it locally. If StreamsUntar,
+// this untars the file as it comes in instead.
 func (helper *IngestHelper) FetchTarFile() {
-	helper.Result.Stage = "Fetch"
-	tarFilePath := filepath.Join(helper.ProcUtil.Config.TarDirectory, helper.Result.S3File.Key.Key)
-	helper.Result.FetchResult = helper.ProcUtil.S3Client.FetchToFile(helper.Result.S3File.BucketName,
-		helper.Result.S3File.Key, tarFilePath)
+	helper.Result.EnterStage(StageFetch, &helper.ProcUtil.Config)
+	tarFilePath := filepath.Join(helper.ProcUtil.Config.DownloadDir(), helper.Result.S3File.Key.Key)
+	checker := NewMissingKeyChecker(helper.ProcUtil.S3Client)
+	if helper.StreamsUntar() {
+		helper.Result.FetchResult = checker.FetchWith(helper.Result.S3File.BucketName,
+			helper.Result.S3File.Key, func() (*FetchResult) {
+				return helper.streamTarFile(tarFilePath)
+			})
+	} else {
+		helper.Result.FetchResult = checker.Fetch(helper.Result.S3File.BucketName,
+			helper.Result.S3File.Key, tarFilePath)
+	}
 	helper.Result.Retry = helper.Result.FetchResult.Retry
+	helper.Result.Cancelled = helper.Result.FetchResult.MissingKey == MissingKeyReplaced
 	if helper.Result.FetchResult.ErrorMessage != "" {
 		// Copy all errors up to the top level
 		helper.Result.ErrorMessage = helper.Result.FetchResult.ErrorMessage
+	} else {
+		helper.Result.CompleteStage(StageFetch)
+	}
+}
+
+// Untars the bag into the extract directory as it comes in from S3,
+// setting Result.TarResult. This has to happen during the fetch,
+// rather than in ProcessBagFile, because S3 drops connections that
+// go too long without a read. Errors reading from S3 go into the
+// FetchResult, and can be retried. Problems with the bag itself go
+// into the TarResult, for ProcessBagFile to report.
+func (helper *IngestHelper) streamTarFile(tarFilePath string) (*FetchResult) {
+	s3File := helper.Result.S3File
+	fetchResult := &FetchResult{
+		BucketName: s3File.BucketName,
+		Key:        s3File.Key.Key,
+		LocalFile:  tarFilePath,
+		RemoteMd5:  strings.Replace(s3File.Key.ETag, "\"", "", -1),
+		Warning:    fmt.Sprintf("Skipping md5 check on %s: this was a multi-part upload", s3File.Key.Key),
+		Retry:      true,
+		Streamed:   true,
+	}
+	readCloser, err := helper.ProcUtil.S3Client.GetReader(s3File.BucketName, s3File.Key.Key)
+	if err != nil {
+		fetchResult.ErrorMessage = fmt.Sprintf("Error retrieving file %s/%s: %v",
+			s3File.BucketName, s3File.Key.Key, err)
+		fetchResult.Retry = !IsNoSuchKey(err.Error())
+		return fetchResult
+	}
+	defer readCloser.Close()
+	stream := &streamReader{reader: readCloser}
+	helper.Result.TarResult = UntarStream(stream, s3File.Key.Key, helper.ProcUtil.Config.ExtractDir(),
+		OwnerOf(s3File.BucketName), s3File.BagName(), true, helper.ProcUtil.Config.DigestSettings())
+	if stream.err == nil && helper.Result.TarResult.ErrorMessage == "" {
+		// Read the end of the tar file, which the tar reader
+		// skips, so we can tell whether we got all of it.
+		_, stream.err = io.Copy(ioutil.Discard, stream)
+	}
+	if stream.err != nil {
+		fetchResult.ErrorMessage = fmt.Sprintf("Error streaming file from receiving bucket: %v",
+			stream.err)
+	} else if helper.Result.TarResult.ErrorMessage == "" && stream.bytesRead != s3File.Key.Size {
+		fetchResult.ErrorMessage = fmt.Sprintf("While streaming from receiving bucket, "+
+			"read only %d of %d bytes for %s", stream.bytesRead, s3File.Key.Size, s3File.Key.Key)
+	}
+	return fetchResult
+}
+
+// streamReader counts the bytes read from a stream and keeps the
+// first error other than io.EOF, so streamTarFile can tell a broken
+// connection from a broken bag.
+type streamReader struct {
+	reader    io.Reader
+	bytesRead int64
+	err       error
+}
+
+func (stream *streamReader) Read(p []byte) (int, error) {
+	n, err := stream.reader.Read(p)
+	stream.bytesRead += int64(n)
+	if err != nil && err != io.EOF && stream.err == nil {
+		stream.err = err
 	}
+	return n, err
 }
 
 func (helper *IngestHelper) SaveGenericFiles() (error) {
 	result := helper.Result
-	result.Stage = "Store"
+	result.EnterStage(StageStore, &helper.ProcUtil.Config)
 	// See what Fedora knows about this object's files.
 	// If none are new/changed, there's no need to save.
 	err := helper.MergeFedoraRecord()
@@ -265,13 +574,21 @@ func (helper *IngestHelper) SaveGenericFiles() (error) {
 		helper.Result.ErrorMessage += fmt.Sprintf("%v ", err)
 		return err
 	}
-	if result.TarResult.AnyFilesNeedSaving() == false {
+	if result.ReingestNoOp || result.TarResult.AnyFilesNeedSaving() == false {
 		helper.ProcUtil.MessageLog.Info("Nothing to save to S3 for %s: " +
 			"files have not changed since they were last ingested",
 			result.S3File.Key.Key)
+		result.CompleteStage(StageStore)
 		return nil
 	}
 
+	instDomain := OwnerOf(result.S3File.BucketName)
+	helper.keyWrapper, err = helper.ProcUtil.Config.KeyWrapperFor(instDomain)
+	if err != nil {
+		helper.Result.ErrorMessage += fmt.Sprintf("%v ", err)
+		return err
+	}
+
 	helper.ProcUtil.MessageLog.Info("Storing %s", result.S3File.Key.Key)
 
 	// Copy each generic file to S3
@@ -282,11 +599,34 @@ func (helper *IngestHelper) SaveGenericFiles() (error) {
 				"changed since it was last saved.", file.Identifier)
 			continue
 		}
+		if file.RenamedFrom != "" {
+			helper.ProcUtil.MessageLog.Info("Not saving %s to S3, because it was renamed " +
+				"from %s, whose copy is at %s.", file.Identifier, file.RenamedFrom, file.StorageURL)
+			continue
+		}
 		_, err := helper.SaveFile(file)
 		if err != nil {
 			continue
 		}
 	}
+
+	// Make sure what we stored is what the depositor sent.
+	if result.BagReadResult != nil {
+		for _, mismatch := range result.BagReadResult.StoredChecksumMismatches(result.TarResult.Files) {
+			helper.Result.ErrorMessage += fmt.Sprintf("Stored file %s has %s %s, "+
+				"but the bag manifest says %s. ", mismatch.Path, mismatch.Algorithm,
+				mismatch.Actual, mismatch.Expected)
+		}
+	}
+
+	// Make sure we didn't lose track of any files along the way.
+	if err := result.CheckStoredFiles(); err != nil {
+		helper.ProcUtil.MessageLog.Error("%s: %v", result.S3File.Key.Key, err)
+		result.FailFileCount(err)
+	}
+	if result.ErrorMessage == "" {
+		result.CompleteStage(StageStore)
+	}
 	return nil
 }
 
@@ -302,6 +642,34 @@ func (helper *IngestHelper) SaveFile(file *File) (string, error) {
 		return "", err
 	}
 
+	// If we encrypt this institution's files, generate the data
+	// key now, so that retries below produce the same ciphertext.
+	var dataKey []byte
+	var encryptionInfo *EncryptionInfo
+	if helper.keyWrapper != nil {
+		dataKey, encryptionInfo, err = NewDataKey(helper.keyWrapper)
+		if err != nil {
+			helper.ProcUtil.MessageLog.Error("Cannot encrypt %s: %v", file.Path, err)
+			helper.Result.ErrorMessage += fmt.Sprintf("%v ", err)
+			return "", err
+		}
+		for key, value := range encryptionInfo.S3Metadata() {
+			options.Meta[key] = value
+		}
+		// S3 would compare this with the md5 of the ciphertext.
+		options.ContentMD5 = ""
+		// An upload left from an earlier attempt was encrypted with
+		// a different data key, and its metadata describes that key,
+		// so we can't resume it.
+		if file.UploadId != "" {
+			helper.ProcUtil.MessageLog.Info("Aborting upload %s of %s: it was encrypted "+
+				"with an earlier data key", file.UploadId, file.Path)
+			helper.ProcUtil.S3Client.AbortMultipartUpload(
+				helper.ProcUtil.Config.PreservationBucket, file.Uuid, file.UploadId)
+			file.UploadId = ""
+		}
+	}
+
 	// Open the local file for reading
 	reader, absPath, err := helper.GetFileReader(file)
 	if err != nil {
@@ -326,7 +694,12 @@ func (helper *IngestHelper) SaveFile(file *File) (string, error) {
 			err = detailedError
 			break
 		}
-		url, err = helper.CopyToPreservationBucket(file, reader, options)
+		if encryptionInfo != nil {
+			url, err = helper.CopyEncryptedToPreservationBucket(file, reader, options,
+				dataKey, encryptionInfo)
+		} else {
+			url, err = helper.CopyToPreservationBucket(file, reader, options)
+		}
 		if err == nil {
 			break
 		}
@@ -342,12 +715,13 @@ func (helper *IngestHelper) SaveFile(file *File) (string, error) {
 		return "", err
 	} else {
 		file.StorageURL = url
-		file.StoredAt = time.Now()
+		file.StoredAt = NowUTC()
 		// We send the md5 checksum with the file to S3.
 		// If S3 calculates a different checksum, it returns an error.
 		// Since there was no error, we know S3 calculated the same checksum
 		// that we calculated.
 		file.StorageMd5 = file.Md5
+		file.Encryption = encryptionInfo
 
 		helper.ProcUtil.MessageLog.Debug("Successfully sent %s (UUID %s)"+
 			"to long-term storage bucket.", file.Path, file.Uuid)
@@ -371,15 +745,112 @@ func (helper *IngestHelper) CopyToPreservationBucket(file *File, reader *os.File
 		// Multi-part put for files >= 5GB
 		helper.ProcUtil.MessageLog.Debug("File %s is %d bytes. Using multi-part put.\n",
 			file.Path, file.Size)
-		return helper.ProcUtil.S3Client.SaveLargeFileToS3(
+		return helper.ProcUtil.S3Client.SaveResumableLargeFileToS3(
 			helper.ProcUtil.Config.PreservationBucket,
 			file.Uuid,
 			file.MimeType,
 			reader,
 			file.Size,
 			*options,
-			S3_CHUNK_SIZE)
+			S3_CHUNK_SIZE,
+			&file.UploadId)
+	}
+}
+
+// Encrypts the file as it copies it to the preservation bucket, and
+// returns the S3 URL of the encrypted copy. The plaintext checksums we
+// calculate while encrypting must match the file's Md5 and Sha256,
+// so we know the checksums we record in Fedora describe exactly what
+// we encrypted. S3 needs a seekable reader for multi-part puts, so
+// large files are encrypted to a temp file next to the original,
+// and that is uploaded.
+func (helper *IngestHelper) CopyEncryptedToPreservationBucket(file *File, reader *os.File, options *s3.Options, dataKey []byte, info *EncryptionInfo) (string, error) {
+	encReader, err := NewEncryptingReader(reader, dataKey, info.ChunkSize)
+	if err != nil {
+		return "", err
+	}
+	encryptedSize := EncryptedSize(file.Size, info.ChunkSize)
+	bucketName := helper.ProcUtil.Config.PreservationBucket
+	url := ""
+	if encryptedSize < S3_LARGE_FILE {
+		url, err = helper.ProcUtil.S3Client.SaveToS3(bucketName, file.Uuid, file.MimeType,
+			encReader, encryptedSize, *options)
+	} else {
+		helper.ProcUtil.MessageLog.Debug("Encrypted file %s is %d bytes. Using multi-part put.\n",
+			file.Path, encryptedSize)
+		url, err = helper.saveLargeEncryptedFile(file, reader.Name() + ".encrypted",
+			encReader, encryptedSize, options)
+	}
+	if err != nil {
+		return "", err
+	}
+	if encReader.PlaintextMd5() != file.Md5 || encReader.PlaintextSha256() != file.Sha256 {
+		helper.ProcUtil.S3Client.Delete(bucketName, file.Uuid)
+		return "", fmt.Errorf("Checksums of the plaintext we encrypted (md5 %s, sha256 %s) "+
+			"do not match the checksums calculated during validation (md5 %s, sha256 %s)",
+			encReader.PlaintextMd5(), encReader.PlaintextSha256(), file.Md5, file.Sha256)
 	}
+	info.EncryptedSize = encryptedSize
+	info.EncryptedSha256 = encReader.CiphertextSha256()
+	return url, nil
+}
+
+func (helper *IngestHelper) saveLargeEncryptedFile(file *File, tempPath string, encReader *EncryptingReader, encryptedSize int64, options *s3.Options) (string, error) {
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return "", fmt.Errorf("Cannot create temp file for encryption: %v", err)
+	}
+	defer os.Remove(tempPath)
+	defer tempFile.Close()
+	if _, err = io.Copy(tempFile, encReader); err != nil {
+		return "", fmt.Errorf("Error encrypting %s to %s: %v", file.Path, tempPath, err)
+	}
+	return helper.ProcUtil.S3Client.SaveResumableLargeFileToS3(
+		helper.ProcUtil.Config.PreservationBucket,
+		file.Uuid,
+		file.MimeType,
+		tempFile,
+		encryptedSize,
+		*options,
+		S3_CHUNK_SIZE,
+		&file.UploadId)
+}
+
+// Returns how long to wait before retrying a bag that we couldn't
+// register in Fluctus. The delay doubles with each attempt, from
+// one minute up to an hour.
+func RegistrationRetryDelay(attempts uint16) (time.Duration) {
+	delay := time.Minute
+	for i := uint16(1); i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// ConfirmProcessedItem makes sure Fluctus has a ProcessedItem
+// record for this bag, with Stage Fetch and Status Started, and
+// saves the record's id in the result. Call this before doing any
+// work on the bag, so depositors can see every bag we're working on.
+// If Fluctus can't register the bag, this logs the error, requeues
+// the message with backoff, and returns false. The caller should
+// then drop the bag without touching S3.
+func (helper *IngestHelper) ConfirmProcessedItem() (bool) {
+	ingestStatus := helper.Result.IngestStatus(helper.ProcUtil.MessageLog)
+	ingestStatus.Stage = StageFetch
+	ingestStatus.Status = StatusStarted
+	record, err := helper.ProcUtil.FluctusClient.RegisterProcessedItem(ingestStatus)
+	if err != nil {
+		delay := RegistrationRetryDelay(helper.Result.NsqMessage.Attempts())
+		helper.ProcUtil.MessageLog.Error("Cannot register %s in Fluctus. "+
+			"Will retry in %s. Error: %v", helper.Result.S3File.Key.Key, delay, err)
+		helper.Result.NsqMessage.Requeue(delay)
+		return false
+	}
+	helper.Result.ProcessedItemId = record.Id
+	return true
 }
 
 func (helper *IngestHelper) UpdateFluctusStatus(stage StageType, status StatusType) {
@@ -3,18 +3,22 @@
 package bagman_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/nsqio/go-nsq"
 	"github.com/crowdmob/goamz/s3"
+	"github.com/op/go-logging"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var skipMessagePrinted bool = false
@@ -69,11 +73,16 @@ func getProcessUtil() (*bagman.ProcessUtil) {
 }
 
 func getIngestHelper() (*bagman.IngestHelper) {
+	return bagman.NewIngestHelper(getProcessUtil(), getNsqMessage(1), getS3File())
+}
+
+func getNsqMessage(attempts uint16) (bagman.Message) {
 	msgId := nsq.MessageID{'1', '0','1', '0','1', '0','1', '0','1',
 		'0','1', '0','1', '0','1', '0',}
 	body := []byte{'h', 'e', 'l', 'l', 'o'}
 	nsqMessage := nsq.NewMessage(msgId, body)
-	return bagman.NewIngestHelper(getProcessUtil(), nsqMessage, getS3File())
+	nsqMessage.Attempts = attempts
+	return bagman.NewNsqMessage(nsqMessage)
 }
 
 func getConfig() (bagman.Config) {
@@ -180,7 +189,7 @@ func TestFailedAndNoMoreRetries(t *testing.T) {
 	helper := getIngestHelper()
 
 	// No error message in result and we're on the first attempt.
-	helper.Result.NsqMessage.Attempts = 1
+	helper.Result.NsqMessage = getNsqMessage(1)
 	if helper.FailedAndNoMoreRetries() == true {
 		t.Error("helper.FailedAndNoMoreRetries() should have returned false")
 	}
@@ -193,7 +202,7 @@ func TestFailedAndNoMoreRetries(t *testing.T) {
 	}
 
 	// We're above the retry threshold, but no error, so we should be OK.
-	helper.Result.NsqMessage.Attempts = helper.ProcUtil.Config.StoreWorker.MaxAttempts * 2
+	helper.Result.NsqMessage = getNsqMessage(helper.ProcUtil.Config.StoreWorker.MaxAttempts * 2)
 	helper.Result.ErrorMessage = ""
 	if helper.FailedAndNoMoreRetries() == true {
 		t.Error("helper.FailedAndNoMoreRetries() should have returned false")
@@ -302,6 +311,9 @@ func TestFullProcess(t *testing.T) {
 			t.Errorf("File '%s' from bag '%s' is missing StorageMd5", file.Path, helper.Result.S3File.Key.Key)
 		}
 	}
+	// Record and cleanup happen in apt_record, which this doesn't run.
+	bagman.AssertStagesCompleted(t, helper.Result, bagman.StageFetch,
+		bagman.StageUnpack, bagman.StageValidate, bagman.StageStore)
 
 	helper.LogResult()
 	if helper.Result.ErrorMessage != "" {
@@ -355,3 +367,365 @@ func verifyBagReadResult(t *testing.T, bagReadResult *bagman.BagReadResult) {
 	verifyResult(t, "Tag Count", "7", strconv.FormatInt(int64(len(bagReadResult.Tags)), 10))
 	verifyResult(t, "Checksum Error Count", "0", strconv.FormatInt(int64(len(bagReadResult.ChecksumErrors)), 10))
 }
+
+// Returns an IngestHelper whose message log writes to a temp
+// directory at DEBUG level, along with the path to the log file.
+// Caller should delete the log directory.
+func getCleanupTestHelper(t *testing.T) (*bagman.IngestHelper, string) {
+	logDir, err := ioutil.TempDir("", "cleanup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConfig := bagman.Config{
+		LogDirectory: logDir,
+		LogLevel:     logging.DEBUG,
+	}
+	procUtil := &bagman.ProcessUtil{
+		MessageLog: bagman.InitLogger(testConfig),
+	}
+	helper := &bagman.IngestHelper{
+		ProcUtil: procUtil,
+		Result: &bagman.ProcessResult{
+			S3File:      getS3File(),
+			FetchResult: &bagman.FetchResult{},
+		},
+	}
+	logFile := filepath.Join(logDir, filepath.Base(os.Args[0])+".log")
+	return helper, logFile
+}
+
+// Make sure the log file has no warnings or errors in it.
+func assertNoWarnings(t *testing.T, logFile string) {
+	data, _ := ioutil.ReadFile(logFile)
+	for _, level := range []string{"[WARNING]", "[ERROR]", "[CRITICAL]"} {
+		if strings.Contains(string(data), level) {
+			t.Errorf("Log file contains unexpected %s message:\n%s", level, string(data))
+		}
+	}
+}
+
+func TestDeleteTarFileWithEmptyPath(t *testing.T) {
+	helper, logFile := getCleanupTestHelper(t)
+	defer os.RemoveAll(filepath.Dir(logFile))
+	if err := helper.DeleteTarFile(); err != nil {
+		t.Errorf("DeleteTarFile with empty LocalFile returned error: %v", err)
+	}
+	errors := helper.DeleteLocalFiles()
+	if len(errors) > 0 {
+		t.Errorf("DeleteLocalFiles with empty LocalFile returned errors: %v", errors)
+	}
+	assertNoWarnings(t, logFile)
+}
+
+func TestDeleteTarFileAlreadyDeleted(t *testing.T) {
+	helper, logFile := getCleanupTestHelper(t)
+	defer os.RemoveAll(filepath.Dir(logFile))
+	helper.Result.FetchResult.LocalFile = filepath.Join(filepath.Dir(logFile),
+		"already_deleted.tar")
+	if err := helper.DeleteTarFile(); err != nil {
+		t.Errorf("DeleteTarFile on missing file returned error: %v", err)
+	}
+	errors := helper.DeleteLocalFiles()
+	if len(errors) > 0 {
+		t.Errorf("DeleteLocalFiles on missing file returned errors: %v", errors)
+	}
+	assertNoWarnings(t, logFile)
+}
+
+func TestBagTooLarge(t *testing.T) {
+	helper := getIngestHelper()
+	defer deleteTestLogs(helper.ProcUtil.Config)
+	helper.Result.S3File.Key.Size = 1001
+
+	// Zero means no limit.
+	helper.ProcUtil.Config.MaxBagSize = 0
+	if helper.BagTooLarge() {
+		t.Error("BagTooLarge should be false when MaxBagSize is zero")
+	}
+	helper.ProcUtil.Config.MaxBagSize = 1001
+	if helper.BagTooLarge() {
+		t.Error("BagTooLarge should be false when bag size equals MaxBagSize")
+	}
+	if helper.Result.ErrorMessage != "" || helper.Result.Retry == false {
+		t.Error("BagTooLarge should not change the result of a bag within the limit")
+	}
+
+	helper.ProcUtil.Config.MaxBagSize = 1000
+	if !helper.BagTooLarge() {
+		t.Error("BagTooLarge should be true when bag size exceeds MaxBagSize")
+	}
+	if !strings.HasPrefix(helper.Result.ErrorMessage, "bag too large") {
+		t.Errorf("Unexpected error message: %s", helper.Result.ErrorMessage)
+	}
+	if helper.Result.Retry {
+		t.Error("Bags that are too large should not be retried")
+	}
+}
+
+func TestRegistrationRetryDelay(t *testing.T) {
+	expected := map[uint16]time.Duration{
+		0:  time.Minute,
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		7:  time.Hour,
+		50: time.Hour,
+	}
+	for attempts, delay := range expected {
+		if actual := bagman.RegistrationRetryDelay(attempts); actual != delay {
+			t.Errorf("Attempt %d: expected delay %s, got %s", attempts, delay, actual)
+		}
+	}
+}
+
+func TestConfirmProcessedItem(t *testing.T) {
+	fluctusDown := true
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fluctusDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		posts++
+		data, _ := ioutil.ReadAll(r.Body)
+		status := &bagman.ProcessStatus{}
+		json.Unmarshal(data, status)
+		if status.Stage != bagman.StageFetch || status.Status != bagman.StatusStarted {
+			t.Errorf("Expected Fetch/Started, got %s/%s", status.Stage, status.Status)
+		}
+		status.Id = 42
+		data, _ = json.Marshal(status)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	}))
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("ingesthelper_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	procUtil := &bagman.ProcessUtil{
+		FluctusClient: fluctusClient,
+		MessageLog:    bagman.DiscardLogger("ingesthelper_test"),
+	}
+
+	// If Fluctus is down, the bag goes back in the queue
+	// before we do anything else.
+	message := bagman.NewInMemoryMessage([]byte("test"))
+	helper := bagman.NewIngestHelper(procUtil, message, getS3File())
+	if helper.ConfirmProcessedItem() {
+		t.Errorf("ConfirmProcessedItem should fail when Fluctus is down")
+	}
+	if !message.Requeued() || message.RequeueDelay() != time.Minute {
+		t.Errorf("Message should be requeued for 1m, got requeued=%t delay=%s",
+			message.Requeued(), message.RequeueDelay())
+	}
+	if helper.Result.ProcessedItemId != 0 {
+		t.Errorf("ProcessedItemId should not be set")
+	}
+
+	// When Fluctus comes back, the record is created and
+	// its id travels with the result.
+	fluctusDown = false
+	message = bagman.NewInMemoryMessage([]byte("test"))
+	helper = bagman.NewIngestHelper(procUtil, message, getS3File())
+	if !helper.ConfirmProcessedItem() {
+		t.Fatalf("ConfirmProcessedItem should succeed")
+	}
+	if message.Requeued() || posts != 1 {
+		t.Errorf("Expected one POST and no requeue, got %d POSTs", posts)
+	}
+	if helper.Result.ProcessedItemId != 42 {
+		t.Errorf("Expected ProcessedItemId 42, got %d", helper.Result.ProcessedItemId)
+	}
+	status := helper.Result.IngestStatus(procUtil.MessageLog)
+	if status.Id != 42 {
+		t.Errorf("IngestStatus should use the registered id, got %d", status.Id)
+	}
+}
+
+func TestReserveBagSpace(t *testing.T) {
+	downloadDir, _ := ioutil.TempDir("", "download")
+	extractDir, _ := ioutil.TempDir("", "extract")
+	defer os.RemoveAll(downloadDir)
+	defer os.RemoveAll(extractDir)
+	logger := bagman.DiscardLogger("ingesthelper_test")
+	downloadVolume, err := bagman.NewVolume(downloadDir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractVolume, _ := bagman.NewVolume(extractDir, logger)
+	procUtil := &bagman.ProcessUtil{
+		Config:        bagman.Config{DownloadDirectory: downloadDir, ExtractDirectory: extractDir},
+		MessageLog:    logger,
+		Volume:        downloadVolume,
+		ExtractVolume: extractVolume,
+	}
+	helper := bagman.NewIngestHelper(procUtil, bagman.NewInMemoryMessage([]byte("test")), getS3File())
+	if err = helper.ReserveBagSpace(1000); err != nil {
+		t.Fatal(err)
+	}
+	if downloadVolume.ClaimedSpace() != 1000 || extractVolume.ClaimedSpace() != 1000 {
+		t.Errorf("Expected 1000 bytes on each volume, got %d and %d",
+			downloadVolume.ClaimedSpace(), extractVolume.ClaimedSpace())
+	}
+
+	// Deleting the tar file frees the download space, but
+	// the untarred files still need theirs.
+	tarFilePath := filepath.Join(downloadDir, helper.Result.S3File.Key.Key)
+	ioutil.WriteFile(tarFilePath, []byte("tar"), 0644)
+	helper.Result.FetchResult = &bagman.FetchResult{LocalFile: tarFilePath}
+	if err = helper.DeleteTarFile(); err != nil {
+		t.Fatal(err)
+	}
+	if downloadVolume.ClaimedSpace() != 0 || extractVolume.ClaimedSpace() != 1000 {
+		t.Errorf("After deleting the tar file, expected 0 and 1000 bytes, got %d and %d",
+			downloadVolume.ClaimedSpace(), extractVolume.ClaimedSpace())
+	}
+	if helper.UnpackDir() != filepath.Join(extractDir, "ncsu.1840.16-2928") {
+		t.Errorf("Bag should unpack under the extract directory, not %s", helper.UnpackDir())
+	}
+	helper.ReleaseVolume()
+	if extractVolume.ClaimedSpace() != 0 {
+		t.Errorf("ReleaseVolume should free the extract space")
+	}
+
+	// If the extract volume is full, nothing is reserved.
+	if err = helper.ReserveBagSpace(extractVolume.AvailableSpace() + 1); err == nil {
+		t.Errorf("ReserveBagSpace should fail when the extract volume is full")
+	}
+	if downloadVolume.ClaimedSpace() != 0 || extractVolume.ClaimedSpace() != 0 {
+		t.Errorf("Failed reservation should not hold any space")
+	}
+
+	// Without a separate extract volume, both reservations
+	// go to the same one, as before.
+	procUtil.ExtractVolume = nil
+	helper.ReserveBagSpace(1000)
+	if downloadVolume.ClaimedSpace() != 2000 {
+		t.Errorf("Expected 2000 bytes on the shared volume, got %d", downloadVolume.ClaimedSpace())
+	}
+	helper.ReleaseVolume()
+	if downloadVolume.ClaimedSpace() != 0 {
+		t.Errorf("ReleaseVolume should free the shared volume")
+	}
+}
+
+// Streamed bags need space only for their untarred files, and have
+// no tar file to delete.
+func TestReserveBagSpaceStreamed(t *testing.T) {
+	downloadDir, _ := ioutil.TempDir("", "download")
+	extractDir, _ := ioutil.TempDir("", "extract")
+	defer os.RemoveAll(downloadDir)
+	defer os.RemoveAll(extractDir)
+	logger := bagman.DiscardLogger("ingesthelper_test")
+	downloadVolume, err := bagman.NewVolume(downloadDir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractVolume, _ := bagman.NewVolume(extractDir, logger)
+	procUtil := &bagman.ProcessUtil{
+		Config:        bagman.Config{DownloadDirectory: downloadDir, ExtractDirectory: extractDir},
+		MessageLog:    logger,
+		Volume:        downloadVolume,
+		ExtractVolume: extractVolume,
+	}
+	s3File := getS3File()
+	helper := bagman.NewIngestHelper(procUtil, bagman.NewInMemoryMessage([]byte("test")), s3File)
+	if helper.StreamsUntar() {
+		t.Errorf("Bags should not be streamed unless StreamUntar is on")
+	}
+	procUtil.Config.StreamUntar = true
+	if helper.StreamsUntar() {
+		t.Errorf("Bags with a single-part ETag should be downloaded, so we can check their md5")
+	}
+	s3File.Key.ETag = "\"b4f8f3072f73598fc5b65bf416b6019a-12\""
+	if !helper.StreamsUntar() {
+		t.Errorf("Multi-part uploads should be streamed when StreamUntar is on")
+	}
+	if err = helper.ReserveBagSpace(1000); err != nil {
+		t.Fatal(err)
+	}
+	if downloadVolume.ClaimedSpace() != 0 || extractVolume.ClaimedSpace() != 1000 {
+		t.Errorf("Expected 0 and 1000 bytes for a streamed bag, got %d and %d",
+			downloadVolume.ClaimedSpace(), extractVolume.ClaimedSpace())
+	}
+
+	// A file where the tar file would have been is not ours to delete.
+	tarFilePath := filepath.Join(downloadDir, s3File.Key.Key)
+	ioutil.WriteFile(tarFilePath, []byte("tar"), 0644)
+	helper.Result.FetchResult = &bagman.FetchResult{LocalFile: tarFilePath, Streamed: true}
+	if err = helper.DeleteTarFile(); err != nil {
+		t.Fatal(err)
+	}
+	if !bagman.FileExists(tarFilePath) {
+		t.Errorf("DeleteTarFile should not delete anything for a streamed bag")
+	}
+	helper.ReleaseVolume()
+	if extractVolume.ClaimedSpace() != 0 {
+		t.Errorf("ReleaseVolume should free the extract space")
+	}
+}
+
+// Bags whose internal folder is named differently from the tar file
+// untar somewhere other than UnpackDir. Cleanup has to follow
+// TarResult.OutputDir, or those files leak.
+func TestDeleteLocalFilesUsesOutputDir(t *testing.T) {
+	extractDir, _ := ioutil.TempDir("", "extract")
+	defer os.RemoveAll(extractDir)
+	procUtil := &bagman.ProcessUtil{
+		Config:     bagman.Config{TarDirectory: extractDir},
+		MessageLog: bagman.DiscardLogger("ingesthelper_test"),
+	}
+	helper := bagman.NewIngestHelper(procUtil, bagman.NewInMemoryMessage([]byte("test")), getS3File())
+	tarFilePath := filepath.Join(extractDir, helper.Result.S3File.Key.Key)
+	ioutil.WriteFile(tarFilePath, []byte("tar"), 0644)
+	helper.Result.FetchResult = &bagman.FetchResult{LocalFile: tarFilePath}
+
+	// Before untarring, we can only guess.
+	if helper.UntarredDir() != helper.UnpackDir() {
+		t.Errorf("Without a TarResult, UntarredDir should be UnpackDir, got %s", helper.UntarredDir())
+	}
+
+	outputDir := filepath.Join(extractDir, "not.the.tar.name")
+	os.MkdirAll(filepath.Join(outputDir, "data"), 0755)
+	ioutil.WriteFile(filepath.Join(outputDir, "data", "file.txt"), []byte("data"), 0644)
+	os.MkdirAll(helper.UnpackDir(), 0755)
+	helper.Result.TarResult = &bagman.TarResult{OutputDir: outputDir}
+	if helper.UntarredDir() != outputDir {
+		t.Errorf("UntarredDir should be %s, got %s", outputDir, helper.UntarredDir())
+	}
+
+	reader, _, err := helper.GetFileReader(&bagman.File{Path: "data/file.txt"})
+	if err != nil {
+		t.Errorf("GetFileReader should read from OutputDir: %v", err)
+	} else {
+		reader.Close()
+	}
+
+	errors := helper.DeleteLocalFiles()
+	if len(errors) > 0 {
+		t.Fatalf("DeleteLocalFiles returned errors: %v", errors)
+	}
+	for _, dir := range []string{outputDir, helper.UnpackDir()} {
+		if bagman.FileExists(dir) {
+			t.Errorf("DeleteLocalFiles should have deleted %s", dir)
+		}
+	}
+	if !bagman.FileExists(extractDir) {
+		t.Errorf("DeleteLocalFiles should not delete the extract directory")
+	}
+
+	// An OutputDir outside the extract directory, or the extract
+	// directory itself, is never deleted.
+	for _, badDir := range []string{extractDir, os.TempDir(), "/"} {
+		helper.Result.TarResult.OutputDir = badDir
+		if helper.UntarredDir() != helper.UnpackDir() {
+			t.Errorf("UntarredDir should ignore OutputDir %s, got %s", badDir, helper.UntarredDir())
+		}
+	}
+}
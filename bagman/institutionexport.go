@@ -0,0 +1,374 @@
+package bagman
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The number of ProcessedItem records to request per page
+// when exporting an institution.
+const DefaultExportPageSize = 100
+
+// InstitutionExportClient is the part of the FluctusClient that
+// InstitutionExporter needs. It's an interface so exports can be
+// tested without Fluctus.
+type InstitutionExportClient interface {
+	ProcessStatusSearchPage(ps *ProcessStatus, retrySpecified, reviewedSpecified bool, offset, limit int) ([]*ProcessStatus, error)
+	IntellectualObjectGetForRestore(identifier string) (*IntellectualObject, error)
+	GenericFileGet(genericFileIdentifier string, includeRelations bool) (*GenericFile, error)
+}
+
+// PreservationKey says where one file of an exported object is
+// stored in the preservation bucket.
+type PreservationKey struct {
+	Identifier string `json:"identifier"`
+	URI        string `json:"uri"`
+	Size       int64  `json:"size"`
+}
+
+// ExportedObject is the content of an object's export file: the
+// object with all of its files, checksums and events, and the
+// preservation keys of its files.
+type ExportedObject struct {
+	Object           *IntellectualObject `json:"object"`
+	PreservationKeys []*PreservationKey  `json:"preservation_keys"`
+}
+
+// ExportFailure is an object that could not be exported.
+type ExportFailure struct {
+	ObjectIdentifier string `json:"object_identifier"`
+	Message          string `json:"message"`
+}
+
+// ExportMarker is written next to each object's export file when
+// the export is complete. Md5 is the digest of the export file, so
+// a resumed export can tell a complete file from a partial one.
+type ExportMarker struct {
+	ObjectIdentifier string    `json:"object_identifier"`
+	Md5              string    `json:"md5"`
+	FileCount        int       `json:"file_count"`
+	ByteCount        int64     `json:"byte_count"`
+	ExportedAt       time.Time `json:"exported_at"`
+}
+
+// InstitutionExportSummary is the content of summary.json.
+// ExportedCount includes objects that an earlier run exported,
+// which are also counted in ResumedCount. FileCount and TotalBytes
+// cover all exported objects.
+type InstitutionExportSummary struct {
+	Institution        string           `json:"institution"`
+	StartedAt          time.Time        `json:"started_at"`
+	FinishedAt         time.Time        `json:"finished_at"`
+	ProcessedItemCount int              `json:"processed_item_count"`
+	ObjectCount        int              `json:"object_count"`
+	ExportedCount      int              `json:"exported_count"`
+	ResumedCount       int              `json:"resumed_count"`
+	FailedCount        int              `json:"failed_count"`
+	FileCount          int              `json:"file_count"`
+	TotalBytes         int64            `json:"total_bytes"`
+	Failures           []*ExportFailure `json:"failures"`
+}
+
+// Add adds the counts from an object's export marker.
+func (summary *InstitutionExportSummary) Add(marker *ExportMarker, resumed bool) {
+	summary.ExportedCount++
+	if resumed {
+		summary.ResumedCount++
+	}
+	summary.FileCount += marker.FileCount
+	summary.TotalBytes += marker.ByteCount
+}
+
+// AddFailure notes an object that could not be exported.
+func (summary *InstitutionExportSummary) AddFailure(objectIdentifier string, err error) {
+	summary.FailedCount++
+	summary.Failures = append(summary.Failures, &ExportFailure{
+		ObjectIdentifier: objectIdentifier,
+		Message:          err.Error(),
+	})
+}
+
+/*
+InstitutionExporter writes everything Fluctus knows about an
+institution's holdings to a directory, for an institution that is
+leaving APTrust. The layout is:
+
+	summary.json            InstitutionExportSummary
+	processed_items.json    All of the institution's ProcessedItems
+	objects/<id>.json       ExportedObject for each object
+	objects/<id>.done       ExportMarker for each exported object
+
+where <id> is the object identifier, query-escaped so the slash
+becomes %2F. Objects are those named in the ProcessedItems.
+
+Exports are resumable. An object whose marker matches its export
+file is not exported again. Objects that fail are listed in the
+summary, and are retried on the next run. Throttle is the pause
+before each request to Fluctus.
+*/
+type InstitutionExporter struct {
+	Client      InstitutionExportClient
+	Institution string
+	OutputDir   string
+	PageSize    int
+	Throttle    time.Duration
+	logger      *logging.Logger
+}
+
+// Returns a new InstitutionExporter with the default page size
+// and no throttle.
+func NewInstitutionExporter(client InstitutionExportClient, institution, outputDir string, logger *logging.Logger) (*InstitutionExporter) {
+	return &InstitutionExporter{
+		Client:      client,
+		Institution: institution,
+		OutputDir:   outputDir,
+		PageSize:    DefaultExportPageSize,
+		logger:      logger,
+	}
+}
+
+// ObjectFilePath returns the path of the export file for an object.
+func (exporter *InstitutionExporter) ObjectFilePath(objectIdentifier string) (string) {
+	return filepath.Join(exporter.OutputDir, "objects", url.QueryEscape(objectIdentifier) + ".json")
+}
+
+// MarkerFilePath returns the path of the completion marker for an object.
+func (exporter *InstitutionExporter) MarkerFilePath(objectIdentifier string) (string) {
+	return filepath.Join(exporter.OutputDir, "objects", url.QueryEscape(objectIdentifier) + ".done")
+}
+
+// Run exports the institution and writes summary.json. It returns
+// an error only if it can't get the ProcessedItems or can't write
+// to OutputDir. Objects that fail are listed in the summary.
+func (exporter *InstitutionExporter) Run() (*InstitutionExportSummary, error) {
+	summary := &InstitutionExportSummary{
+		Institution: exporter.Institution,
+		StartedAt:   NowUTC(),
+		Failures:    make([]*ExportFailure, 0),
+	}
+	if err := os.MkdirAll(filepath.Join(exporter.OutputDir, "objects"), 0755); err != nil {
+		return nil, err
+	}
+	items, err := exporter.ProcessedItems()
+	if err != nil {
+		return nil, err
+	}
+	summary.ProcessedItemCount = len(items)
+	if err = writeJsonFile(filepath.Join(exporter.OutputDir, "processed_items.json"), items); err != nil {
+		return nil, err
+	}
+
+	identifiers := ExportObjectIdentifiers(exporter.Institution, items)
+	summary.ObjectCount = len(identifiers)
+	for i, identifier := range identifiers {
+		if marker := exporter.CompletedExport(identifier); marker != nil {
+			summary.Add(marker, true)
+			continue
+		}
+		marker, err := exporter.ExportObject(identifier)
+		if err != nil {
+			exporter.logger.Warning("Cannot export %s: %v", identifier, err)
+			summary.AddFailure(identifier, err)
+			continue
+		}
+		summary.Add(marker, false)
+		if (i + 1) % 100 == 0 {
+			exporter.logger.Info("Exported %d of %d objects for %s",
+				i + 1, len(identifiers), exporter.Institution)
+		}
+	}
+
+	summary.FinishedAt = NowUTC()
+	if err = writeJsonFile(filepath.Join(exporter.OutputDir, "summary.json"), summary); err != nil {
+		return nil, err
+	}
+	exporter.logger.Info("Exported %d of %d objects for %s (%d resumed, %d failed), "+
+		"%d files, %d bytes", summary.ExportedCount, summary.ObjectCount,
+		exporter.Institution, summary.ResumedCount, summary.FailedCount,
+		summary.FileCount, summary.TotalBytes)
+	return summary, nil
+}
+
+// ProcessedItems returns all of the institution's ProcessedItem
+// records, one page at a time.
+func (exporter *InstitutionExporter) ProcessedItems() ([]*ProcessStatus, error) {
+	pageSize := exporter.PageSize
+	if pageSize < 1 {
+		pageSize = DefaultExportPageSize
+	}
+	search := &ProcessStatus{Institution: exporter.Institution}
+	items := make([]*ProcessStatus, 0)
+	for {
+		exporter.throttle()
+		page, err := exporter.Client.ProcessStatusSearchPage(search, false, false, len(items), pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get processed items for %s starting at %d: %v",
+				exporter.Institution, len(items), err)
+		}
+		items = append(items, page...)
+		if len(page) < pageSize {
+			return items, nil
+		}
+	}
+}
+
+// ExportObject writes the export file and marker for one object,
+// and returns the marker.
+func (exporter *InstitutionExporter) ExportObject(objectIdentifier string) (*ExportMarker, error) {
+	exporter.throttle()
+	obj, err := exporter.Client.IntellectualObjectGetForRestore(objectIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("IntellectualObject %s not found", objectIdentifier)
+	}
+
+	// The restore call returns only file summaries, so we get
+	// each file's checksums and events separately.
+	exported := &ExportedObject{
+		Object:           obj,
+		PreservationKeys: make([]*PreservationKey, 0, len(obj.GenericFiles)),
+	}
+	marker := &ExportMarker{ObjectIdentifier: objectIdentifier}
+	for i, summary := range obj.GenericFiles {
+		exporter.throttle()
+		gf, err := exporter.Client.GenericFileGet(summary.Identifier, true)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get generic file %s: %v", summary.Identifier, err)
+		}
+		if gf == nil {
+			return nil, fmt.Errorf("Generic file %s not found", summary.Identifier)
+		}
+		obj.GenericFiles[i] = gf
+		exported.PreservationKeys = append(exported.PreservationKeys, &PreservationKey{
+			Identifier: gf.Identifier,
+			URI:        gf.URI,
+			Size:       gf.Size,
+		})
+		marker.FileCount++
+		marker.ByteCount += gf.Size
+	}
+
+	data, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(exporter.ObjectFilePath(objectIdentifier), data); err != nil {
+		return nil, err
+	}
+	marker.Md5 = fmt.Sprintf("%x", md5.Sum(data))
+	marker.ExportedAt = NowUTC()
+	if err = writeJsonFile(exporter.MarkerFilePath(objectIdentifier), marker); err != nil {
+		return nil, err
+	}
+	return marker, nil
+}
+
+// CompletedExport returns the marker of an object that an earlier
+// run exported, or nil if the object has no marker or its export
+// file doesn't match the marker.
+func (exporter *InstitutionExporter) CompletedExport(objectIdentifier string) (*ExportMarker) {
+	markerData, err := ioutil.ReadFile(exporter.MarkerFilePath(objectIdentifier))
+	if err != nil {
+		return nil
+	}
+	marker := &ExportMarker{}
+	if err = json.Unmarshal(markerData, marker); err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(exporter.ObjectFilePath(objectIdentifier))
+	if err != nil || fmt.Sprintf("%x", md5.Sum(data)) != marker.Md5 {
+		return nil
+	}
+	return marker
+}
+
+// Tar writes the export directory to the tar file at tarPath.
+// Files in the archive are under a directory with the name of
+// the institution.
+func (exporter *InstitutionExporter) Tar(tarPath string) (error) {
+	tarFile, err := os.Create(tarPath)
+	if err != nil {
+		return fmt.Errorf("Error creating tar file: %v", err)
+	}
+	defer tarFile.Close()
+	tarWriter := tar.NewWriter(tarFile)
+	err = filepath.Walk(exporter.OutputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(exporter.OutputDir, path)
+		if err != nil {
+			return err
+		}
+		return AddToArchive(tarWriter, path, filepath.Join(exporter.Institution, relPath))
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+func (exporter *InstitutionExporter) throttle() {
+	if exporter.Throttle > 0 {
+		time.Sleep(exporter.Throttle)
+	}
+}
+
+// ExportObjectIdentifiers returns the sorted, unique identifiers of
+// the objects named in items. Ingest records that don't have an
+// object identifier are named after the bag, e.g. "test.edu/bag1"
+// for "bag1.b01.of02.tar".
+func ExportObjectIdentifiers(institution string, items []*ProcessStatus) ([]string) {
+	seen := make(map[string]bool)
+	identifiers := make([]string, 0)
+	for _, item := range items {
+		identifier := item.ObjectIdentifier
+		if identifier == "" && item.Action == ActionIngest {
+			bagName, err := CleanBagName(item.Name)
+			if err != nil {
+				continue
+			}
+			identifier = fmt.Sprintf("%s/%s", institution, bagName)
+		}
+		if identifier == "" || seen[identifier] || !strings.HasPrefix(identifier, institution + "/") {
+			continue
+		}
+		seen[identifier] = true
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	return identifiers
+}
+
+func writeJsonFile(path string, value interface{}) (error) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Writes data to a temp file and renames it, so an interrupted
+// export never leaves a partial file at path.
+func writeFileAtomic(path string, data []byte) (error) {
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("Cannot write %s: %v", tempPath, err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("Cannot rename %s to %s: %v", tempPath, path, err)
+	}
+	return nil
+}
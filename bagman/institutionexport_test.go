@@ -0,0 +1,309 @@
+package bagman_test
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+type fakeExportClient struct {
+	items      []*bagman.ProcessStatus
+	objects    map[string]*bagman.IntellectualObject
+	files      map[string]*bagman.GenericFile
+	pages      int
+	objectGets int
+}
+
+func (client *fakeExportClient) ProcessStatusSearchPage(ps *bagman.ProcessStatus, retrySpecified, reviewedSpecified bool, offset, limit int) ([]*bagman.ProcessStatus, error) {
+	client.pages++
+	if offset >= len(client.items) {
+		return []*bagman.ProcessStatus{}, nil
+	}
+	end := offset + limit
+	if end > len(client.items) {
+		end = len(client.items)
+	}
+	return client.items[offset:end], nil
+}
+
+func (client *fakeExportClient) IntellectualObjectGetForRestore(identifier string) (*bagman.IntellectualObject, error) {
+	client.objectGets++
+	obj := client.objects[identifier]
+	if obj == nil {
+		return nil, fmt.Errorf("IntellectualObject %s not found", identifier)
+	}
+	// Return summaries, like Fluctus does.
+	summary := &bagman.IntellectualObject{Identifier: obj.Identifier, Events: obj.Events}
+	for _, gf := range obj.GenericFiles {
+		summary.GenericFiles = append(summary.GenericFiles, &bagman.GenericFile{
+			Identifier: gf.Identifier, URI: gf.URI, Size: gf.Size})
+	}
+	return summary, nil
+}
+
+func (client *fakeExportClient) GenericFileGet(identifier string, includeRelations bool) (*bagman.GenericFile, error) {
+	gf := client.files[identifier]
+	if gf == nil {
+		return nil, fmt.Errorf("Fluctus returned status code 500")
+	}
+	return gf, nil
+}
+
+// Adds an object with numFiles files of 100 bytes each. If
+// broken is true, GenericFileGet fails for its files.
+func (client *fakeExportClient) addObject(identifier string, numFiles int, broken bool) {
+	obj := &bagman.IntellectualObject{
+		Identifier: identifier,
+		Events: []*bagman.PremisEvent{
+			{Identifier: identifier + "/ingest", EventType: "ingest", Outcome: "Success"},
+		},
+	}
+	for i := 0; i < numFiles; i++ {
+		gf := &bagman.GenericFile{
+			Identifier: fmt.Sprintf("%s/data/file%d.txt", identifier, i),
+			URI:        fmt.Sprintf("https://s3.amazonaws.com/aptrust.test.preservation/%s-%d", identifier, i),
+			Size:       100,
+			ChecksumAttributes: []*bagman.ChecksumAttribute{
+				{Algorithm: "md5", Digest: "1234"},
+			},
+			Events: []*bagman.PremisEvent{{EventType: "fixity_check", Outcome: "Success"}},
+		}
+		obj.GenericFiles = append(obj.GenericFiles, gf)
+		if !broken {
+			client.files[gf.Identifier] = gf
+		}
+	}
+	client.objects[identifier] = obj
+	client.items = append(client.items, &bagman.ProcessStatus{
+		ObjectIdentifier: identifier,
+		Institution:      "test.edu",
+		Action:           bagman.ActionIngest,
+	})
+}
+
+func newFakeExportClient() (*fakeExportClient) {
+	client := &fakeExportClient{
+		items:   make([]*bagman.ProcessStatus, 0),
+		objects: make(map[string]*bagman.IntellectualObject),
+		files:   make(map[string]*bagman.GenericFile),
+	}
+	client.addObject("test.edu/bag1", 2, false)
+	client.addObject("test.edu/bag2", 3, false)
+	client.addObject("test.edu/broken", 1, true)
+	// Records without an object identifier are named after the bag.
+	client.items = append(client.items,
+		&bagman.ProcessStatus{Name: "bag2.b01.of02.tar", Action: bagman.ActionIngest},
+		&bagman.ProcessStatus{ObjectIdentifier: "test.edu/bag1", Action: bagman.ActionRestore})
+	return client
+}
+
+func newTestExporter(t *testing.T, client *fakeExportClient) (*bagman.InstitutionExporter) {
+	dir, err := ioutil.TempDir("", "institution_export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := bagman.NewInstitutionExporter(client, "test.edu", dir,
+		bagman.DiscardLogger("institutionexport_test"))
+	exporter.PageSize = 2
+	return exporter
+}
+
+func TestExportObjectIdentifiers(t *testing.T) {
+	items := []*bagman.ProcessStatus{
+		{ObjectIdentifier: "test.edu/b"},
+		{Name: "a.b001.of002.tar", Action: bagman.ActionIngest},
+		{Name: "a.b002.of002.tar", Action: bagman.ActionIngest},
+		{ObjectIdentifier: "test.edu/b", Action: bagman.ActionRestore},
+		{Name: "not_a_tar.zip", Action: bagman.ActionIngest},
+		{ObjectIdentifier: "other.edu/c"},
+	}
+	identifiers := bagman.ExportObjectIdentifiers("test.edu", items)
+	if len(identifiers) != 2 || identifiers[0] != "test.edu/a" || identifiers[1] != "test.edu/b" {
+		t.Errorf("Expected test.edu/a and test.edu/b, got %v", identifiers)
+	}
+}
+
+func TestInstitutionExporterLayout(t *testing.T) {
+	client := newFakeExportClient()
+	exporter := newTestExporter(t, client)
+	defer os.RemoveAll(exporter.OutputDir)
+	summary, err := exporter.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Five items in pages of two.
+	if client.pages != 3 || summary.ProcessedItemCount != 5 {
+		t.Errorf("Expected 5 items in 3 pages, got %d items in %d pages",
+			summary.ProcessedItemCount, client.pages)
+	}
+	if summary.ObjectCount != 3 || summary.ExportedCount != 2 || summary.FailedCount != 1 {
+		t.Errorf("Expected 2 of 3 objects exported and 1 failed, got %+v", summary)
+	}
+	if summary.FileCount != 5 || summary.TotalBytes != 500 {
+		t.Errorf("Expected 5 files and 500 bytes, got %d and %d", summary.FileCount, summary.TotalBytes)
+	}
+	if len(summary.Failures) != 1 || summary.Failures[0].ObjectIdentifier != "test.edu/broken" {
+		t.Errorf("test.edu/broken should be listed as failed")
+	}
+
+	// The summary on disk matches the one returned.
+	saved := &bagman.InstitutionExportSummary{}
+	data, err := ioutil.ReadFile(filepath.Join(exporter.OutputDir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, saved); err != nil || saved.TotalBytes != 500 {
+		t.Errorf("summary.json doesn't match: %s", data)
+	}
+	items := make([]*bagman.ProcessStatus, 0)
+	data, _ = ioutil.ReadFile(filepath.Join(exporter.OutputDir, "processed_items.json"))
+	if err = json.Unmarshal(data, &items); err != nil || len(items) != 5 {
+		t.Errorf("processed_items.json should have 5 items")
+	}
+
+	objectPath := exporter.ObjectFilePath("test.edu/bag2")
+	if objectPath != filepath.Join(exporter.OutputDir, "objects", "test.edu%2Fbag2.json") {
+		t.Errorf("Wrong object file path %s", objectPath)
+	}
+	exported := &bagman.ExportedObject{}
+	data, _ = ioutil.ReadFile(objectPath)
+	if err = json.Unmarshal(data, exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Object.Events) != 1 || len(exported.Object.GenericFiles) != 3 ||
+		len(exported.Object.GenericFiles[0].ChecksumAttributes) != 1 ||
+		len(exported.Object.GenericFiles[0].Events) != 1 {
+		t.Errorf("Export should include the object's files, checksums and events")
+	}
+	if len(exported.PreservationKeys) != 3 ||
+		exported.PreservationKeys[2].URI != "https://s3.amazonaws.com/aptrust.test.preservation/test.edu/bag2-2" {
+		t.Errorf("Wrong preservation keys")
+	}
+	if _, err = os.Stat(exporter.MarkerFilePath("test.edu/broken")); !os.IsNotExist(err) {
+		t.Errorf("Failed object should not have a completion marker")
+	}
+}
+
+func TestInstitutionExporterResume(t *testing.T) {
+	client := newFakeExportClient()
+	exporter := newTestExporter(t, client)
+	defer os.RemoveAll(exporter.OutputDir)
+	if _, err := exporter.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if exporter.CompletedExport("test.edu/bag1") == nil {
+		t.Fatalf("test.edu/bag1 should be marked complete")
+	}
+
+	// Simulate a partial write of bag2, and fix the broken object.
+	ioutil.WriteFile(exporter.ObjectFilePath("test.edu/bag2"), []byte(`{"object":`), 0644)
+	if exporter.CompletedExport("test.edu/bag2") != nil {
+		t.Errorf("Export file that doesn't match its marker should not be complete")
+	}
+	for _, gf := range client.objects["test.edu/broken"].GenericFiles {
+		client.files[gf.Identifier] = gf
+	}
+
+	client.objectGets = 0
+	summary, err := exporter.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.objectGets != 2 {
+		t.Errorf("Expected to export only bag2 and broken again, got %d object requests", client.objectGets)
+	}
+	if summary.ExportedCount != 3 || summary.ResumedCount != 1 || summary.FailedCount != 0 {
+		t.Errorf("Expected 3 exported with 1 resumed, got %+v", summary)
+	}
+	if summary.FileCount != 6 || summary.TotalBytes != 600 {
+		t.Errorf("Resumed objects should count toward totals, got %d files, %d bytes",
+			summary.FileCount, summary.TotalBytes)
+	}
+}
+
+func TestInstitutionExporterTar(t *testing.T) {
+	client := newFakeExportClient()
+	exporter := newTestExporter(t, client)
+	defer os.RemoveAll(exporter.OutputDir)
+	if _, err := exporter.Run(); err != nil {
+		t.Fatal(err)
+	}
+	tarPath := exporter.OutputDir + ".tar"
+	defer os.Remove(tarPath)
+	if err := exporter.Tar(tarPath); err != nil {
+		t.Fatal(err)
+	}
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	names := make([]string, 0)
+	reader := tar.NewReader(tarFile)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"test.edu/objects/test.edu%2Fbag1.done",
+		"test.edu/objects/test.edu%2Fbag1.json",
+		"test.edu/objects/test.edu%2Fbag2.done",
+		"test.edu/objects/test.edu%2Fbag2.json",
+		"test.edu/processed_items.json",
+		"test.edu/summary.json",
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], names[i])
+		}
+	}
+}
+
+// A synthetic run with 10,000 objects, to check paging and totals
+// at the size of our largest institutions.
+func TestInstitutionExporterLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping 10k object export in short mode")
+	}
+	client := &fakeExportClient{
+		items:   make([]*bagman.ProcessStatus, 0),
+		objects: make(map[string]*bagman.IntellectualObject),
+		files:   make(map[string]*bagman.GenericFile),
+	}
+	for i := 0; i < 10000; i++ {
+		client.addObject(fmt.Sprintf("test.edu/bag%05d", i), 1, i % 1000 == 0)
+	}
+	exporter := newTestExporter(t, client)
+	exporter.PageSize = bagman.DefaultExportPageSize
+	defer os.RemoveAll(exporter.OutputDir)
+	summary, err := exporter.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.pages != 101 {
+		t.Errorf("Expected 101 pages of items, got %d", client.pages)
+	}
+	if summary.ObjectCount != 10000 || summary.ExportedCount != 9990 || summary.FailedCount != 10 {
+		t.Errorf("Expected 9990 of 10000 exported and 10 failed, got %d, %d, %d",
+			summary.ObjectCount, summary.ExportedCount, summary.FailedCount)
+	}
+	if summary.TotalBytes != 999000 {
+		t.Errorf("Expected 999000 bytes, got %d", summary.TotalBytes)
+	}
+}
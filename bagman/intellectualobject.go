@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/satori/go.uuid"
 	"strings"
-	"time"
 )
 
 /*
@@ -23,7 +22,7 @@ Identifier is the object's unique identifier. (Whose assigned
 this id? APTrust or the owner?)
 
 Access indicate who can access the object. Valid values are
-consortial, institution and restricted.
+consortia, institution and restricted. See NormalizeAccess.
 */
 type IntellectualObject struct {
 	Id            string         `json:"id"`
@@ -58,16 +57,76 @@ func (obj *IntellectualObject) TotalFileSize() (int64) {
 	return total
 }
 
+// Space we allow for a bag's tag files: bagit.txt, bag-info.txt,
+// aptrust-info.txt and the DPN tag files.
+const TAG_FILE_ALLOWANCE = 64 * 1024
+
+// Per-file overhead in a tar archive: a 512-byte header, plus
+// up to 511 bytes of padding after the file's contents.
+const TAR_FILE_OVERHEAD = 1024
+
+// The tar end-of-archive marker, plus padding to a full record.
+const TAR_ARCHIVE_OVERHEAD = 10240
+
+// The file system block size. Each file in the untarred bag takes
+// up to one block more on disk than its size.
+const FILE_BLOCK_SIZE = 4096
+
+// EstimatedStagingBytes returns the disk space we need to build a
+// bag of this object in a staging area and tar it: room for the
+// untarred bag, with its manifests and tag files, and the tar file.
+// The estimate assumes md5 and sha256 manifests, so it's a little
+// high for bags that have only one.
+func (obj *IntellectualObject) EstimatedStagingBytes() (int64) {
+	manifestBytes := int64(0)
+	for _, genericFile := range obj.GenericFiles {
+		filePath, err := genericFile.OriginalPath()
+		if err != nil {
+			filePath = genericFile.Identifier
+		}
+		// "<32 hex digits>  <path>\n" and "<64 hex digits>  <path>\n"
+		manifestBytes += int64(32 + 64 + 2*(len(filePath) + 3))
+	}
+	// Payload files, two manifests and the tag files.
+	numFiles := int64(len(obj.GenericFiles) + 2)
+	bagBytes := obj.TotalFileSize() + manifestBytes + TAG_FILE_ALLOWANCE
+	untarredBytes := bagBytes + (numFiles * FILE_BLOCK_SIZE)
+	tarBytes := bagBytes + (numFiles * TAR_FILE_OVERHEAD) + TAR_ARCHIVE_OVERHEAD
+	return untarredBytes + tarBytes
+}
+
 // AccessValid returns true or false to indicate whether the
 // structure's Access property contains a valid value.
 func (obj *IntellectualObject) AccessValid() bool {
-	lcAccess := strings.ToLower(obj.Access)
-	for _, value := range AccessRights {
-		if value == lcAccess {
-			return true
-		}
+	_, _, err := NormalizeAccess(obj.Access)
+	return err == nil
+}
+
+// APTrustInfoTags returns the tags for the aptrust-info.txt file
+// of a restored bag: Title, Access and, if there is one, Description.
+// Access is the canonical value from NormalizeAccess, the same value
+// ingest records, so the restored bag can be ingested again.
+func (obj *IntellectualObject) APTrustInfoTags() ([]Tag, error) {
+	access, _, err := NormalizeAccess(obj.Access)
+	if err != nil {
+		return nil, err
 	}
-	return false
+	tags := []Tag{
+		Tag{Label: "Title", Value: obj.Title},
+		Tag{Label: "Access", Value: access},
+	}
+	if obj.Description != "" {
+		tags = append(tags, Tag{Label: "Description", Value: obj.Description})
+	}
+	return tags, nil
+}
+
+// MergeEvents drops from obj.Events the events that are already in
+// existing, which should be the events Fluctus has for this object.
+// Events match if they have the same type and outcome detail. See
+// GenericFile.MergeEvents for the files' events.
+func (obj *IntellectualObject) MergeEvents(existing []*PremisEvent) {
+	obj.Events = mergeEvents(obj.Identifier, obj.Events, existing)
 }
 
 // SerializeForCreate serializes a fluctus intellectual object
@@ -125,13 +184,13 @@ func (obj *IntellectualObject) CreateIngestEvent() (*PremisEvent) {
 	return &PremisEvent{
 		Identifier:         eventId.String(),
 		EventType:          "ingest",
-		DateTime:           time.Now(),
+		DateTime:           NowUTC(),
 		Detail:             "Copied all files to perservation bucket",
 		Outcome:            "Success",
 		OutcomeDetail:      fmt.Sprintf("%d files copied", len(obj.GenericFiles)),
 		Object:             "goamz S3 client",
 		Agent:              "https://github.com/crowdmob/goamz",
-		OutcomeInformation: "Multipart put using md5 checksum",
+		OutcomeInformation: VersionedOutcome("Multipart put using md5 checksum"),
 	}
 }
 
@@ -140,13 +199,13 @@ func (obj *IntellectualObject) CreateIdEvent() (*PremisEvent) {
 	return &PremisEvent{
 		Identifier:         eventId.String(),
 		EventType:          "identifier_assignment",
-		DateTime:           time.Now(),
+		DateTime:           NowUTC(),
 		Detail:             "Assigned bag identifier",
 		Outcome:            "Success",
 		OutcomeDetail:      obj.Identifier,
 		Object:             "APTrust bagman",
 		Agent:              "https://github.com/APTrust/bagman",
-		OutcomeInformation: "Institution domain + tar file name",
+		OutcomeInformation: VersionedOutcome("Institution domain + tar file name"),
 	}
 }
 
@@ -155,13 +214,13 @@ func (obj *IntellectualObject) CreateRightsEvent() (*PremisEvent) {
 	return &PremisEvent{
 		Identifier:         eventId.String(),
 		EventType:          "access_assignment",
-		DateTime:           time.Now(),
+		DateTime:           NowUTC(),
 		Detail:             "Assigned bag access rights",
 		Outcome:            "Success",
 		OutcomeDetail:      obj.Access,
 		Object:             "APTrust bagman",
 		Agent:              "https://github.com/APTrust/bagman",
-		OutcomeInformation: "Set access to " + obj.Access,
+		OutcomeInformation: VersionedOutcome("Set access to " + obj.Access),
 	}
 }
 
@@ -160,3 +160,60 @@ func TestOriginalBagName(t *testing.T) {
 		t.Errorf("OriginalBagName() expected 'ncsu.1840.16-2928', got '%s'", obj.OriginalBagName())
 	}
 }
+
+func TestEstimatedStagingBytes(t *testing.T) {
+	obj, err := bagman.LoadIntelObjFixture(filepath.Join("testdata", "intel_obj.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two payload files of 686 bytes, with 282 bytes of manifest
+	// entries, in an untarred bag and a tar file.
+	bagBytes := int64(686 + 282 + bagman.TAG_FILE_ALLOWANCE)
+	expected := (bagBytes + 4 * bagman.FILE_BLOCK_SIZE) +
+		(bagBytes + 4 * bagman.TAR_FILE_OVERHEAD + bagman.TAR_ARCHIVE_OVERHEAD)
+	estimate := obj.EstimatedStagingBytes()
+	if estimate != expected {
+		t.Errorf("EstimatedStagingBytes() returned %d, expected %d", estimate, expected)
+	}
+	if estimate <= obj.TotalFileSize() * 2 {
+		t.Errorf("Estimate %d should exceed twice the payload size", estimate)
+	}
+
+	// Overhead grows with the number of files, not just their size.
+	obj.GenericFiles = append(obj.GenericFiles, &bagman.GenericFile{
+		Identifier: "uc.edu/cin.675812/data/empty.txt",
+	})
+	if obj.EstimatedStagingBytes() <= estimate {
+		t.Errorf("Adding an empty file should increase the estimate")
+	}
+}
+
+func TestIntellectualObjectMergeEvents(t *testing.T) {
+	obj, err := bagman.LoadIntelObjFixture(filepath.Join("testdata", "intel_obj.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := []*bagman.PremisEvent{obj.CreateIngestEvent(), obj.CreateIdEvent()}
+	rightsEvent := obj.CreateRightsEvent()
+	obj.Events = []*bagman.PremisEvent{obj.CreateIngestEvent(), obj.CreateIdEvent(), rightsEvent}
+	obj.MergeEvents(existing)
+	if len(obj.Events) != 1 || obj.Events[0] != rightsEvent {
+		t.Fatalf("Expected only the access_assignment event after merge, got %d events",
+			len(obj.Events))
+	}
+
+	// Merging the same events again should not bring any back.
+	obj.Events = append(existing, obj.Events...)
+	obj.MergeEvents(append(existing, rightsEvent))
+	if len(obj.Events) != 0 {
+		t.Errorf("Expected no events after merging duplicates, got %d", len(obj.Events))
+	}
+
+	// A different outcome is a different event.
+	obj.Access = "restricted"
+	obj.Events = []*bagman.PremisEvent{obj.CreateRightsEvent()}
+	obj.MergeEvents([]*bagman.PremisEvent{rightsEvent})
+	if len(obj.Events) != 1 {
+		t.Errorf("Merge dropped an event with a new outcome detail")
+	}
+}
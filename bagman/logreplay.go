@@ -0,0 +1,558 @@
+package bagman
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ReplayStatus describes what happened when we tried to replay
+// one registration or PremisEvent from the JSON log.
+type ReplayStatus string
+
+const (
+	ReplaySucceeded ReplayStatus = "Replayed"
+	ReplayDuplicate              = "Duplicate"
+	ReplayFailed                 = "Failed"
+	ReplayDryRun                 = "WouldReplay"
+)
+
+// ResultLogEntry is one ProcessResult read from a JSON log, or
+// from a file in a per-bag results directory, such as the
+// ingest_failures directory written by apt_trouble.
+type ResultLogEntry struct {
+	// The path of the log or results file.
+	Source     string
+	// The byte offset in Source where this entry starts.
+	Offset     int64
+	// The byte offset in Source where the next entry starts.
+	NextOffset int64
+	Result     *ProcessResult
+}
+
+/*
+ScanResultLog reads the JSON log at path, starting at byte offset,
+and calls handle for each ProcessResult it finds. The JSON log has
+one ProcessResult per line. Blank lines are ignored. Lines that
+aren't valid JSON are logged as warnings and skipped, and the
+number of lines skipped is returned as malformed.
+
+A last line with no trailing newline is probably still being
+written, so ScanResultLog stops without reading it.
+
+If handle returns an error, ScanResultLog stops and returns
+that error.
+*/
+func ScanResultLog(path string, offset int64, logger *logging.Logger, handle func(*ResultLogEntry) error) (malformed int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot open JSON log '%s': %v", path, err)
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, 0); err != nil {
+		return 0, fmt.Errorf("Cannot seek to offset %d in JSON log '%s': %v",
+			offset, path, err)
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				logger.Warning("Stopping before incomplete last line at offset %d in %s",
+					offset, path)
+			}
+			return malformed, nil
+		} else if readErr != nil {
+			return malformed, fmt.Errorf("Error reading JSON log '%s' at offset %d: %v",
+				path, offset, readErr)
+		}
+		entry := &ResultLogEntry{
+			Source:     path,
+			Offset:     offset,
+			NextOffset: offset + int64(len(line)),
+		}
+		offset = entry.NextOffset
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err = json.Unmarshal(line, &entry.Result); err != nil || entry.Result == nil {
+			logger.Warning("Skipping malformed JSON at offset %d in %s: %v",
+				entry.Offset, path, err)
+			malformed++
+			continue
+		}
+		if err = handle(entry); err != nil {
+			return malformed, err
+		}
+	}
+}
+
+// Returns true if the result's FedoraResult shows that some
+// of its metadata could not be recorded in Fluctus.
+func NeedsReplay(result *ProcessResult) (bool) {
+	return result.FedoraResult != nil && !result.FedoraResult.AllRecordsSucceeded()
+}
+
+/*
+ReplayFilter limits a replay to bags from one institution, or
+bags uploaded within a range of dates. The date is the bag's
+LastModified date in the receiving bucket, since the JSON log
+does not record when the bag was processed. Zero values match
+everything.
+*/
+type ReplayFilter struct {
+	// Match bags uploaded on or after this time.
+	Since       time.Time
+	// Match bags uploaded before this time.
+	Until       time.Time
+	// Match bags from this institution, e.g. "ncsu.edu".
+	Institution string
+}
+
+// Returns true if the result's bag matches the filter.
+func (filter *ReplayFilter) Matches(result *ProcessResult) (bool) {
+	if filter == nil {
+		return true
+	}
+	if result.S3File == nil {
+		return filter.Institution == "" && filter.Since.IsZero() && filter.Until.IsZero()
+	}
+	if filter.Institution != "" && OwnerOf(result.S3File.BucketName) != filter.Institution {
+		return false
+	}
+	if filter.Since.IsZero() && filter.Until.IsZero() {
+		return true
+	}
+	bagDate, err := ParseS3Time(result.S3File.Key.LastModified)
+	if err != nil {
+		return false
+	}
+	if !filter.Since.IsZero() && bagDate.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !bagDate.Before(filter.Until) {
+		return false
+	}
+	return true
+}
+
+/*
+ReplayCheckpoint records how far a replay got through each log
+or results file, so an interrupted replay can pick up where it
+left off. The checkpoint file is JSON, mapping each source path
+to the offset of the first entry that has not been replayed.
+*/
+type ReplayCheckpoint struct {
+	path    string
+	Offsets map[string]int64
+}
+
+// Loads the checkpoint file at path. If the file doesn't exist,
+// this returns an empty checkpoint that will be saved to path.
+func LoadReplayCheckpoint(path string) (*ReplayCheckpoint, error) {
+	checkpoint := &ReplayCheckpoint{
+		path:    path,
+		Offsets: make(map[string]int64),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Cannot read checkpoint file '%s': %v", path, err)
+	}
+	if err = json.Unmarshal(data, &checkpoint.Offsets); err != nil {
+		return nil, fmt.Errorf("Checkpoint file '%s' is not valid JSON: %v", path, err)
+	}
+	return checkpoint, nil
+}
+
+// Returns the offset at which to resume reading source.
+func (checkpoint *ReplayCheckpoint) Offset(source string) (int64) {
+	return checkpoint.Offsets[source]
+}
+
+// Records that everything in source before offset has been
+// replayed, and saves the checkpoint file. The file is written
+// to a temp file first and then renamed, so an interrupted
+// save can't leave a truncated checkpoint.
+func (checkpoint *ReplayCheckpoint) Save(source string, offset int64) (error) {
+	checkpoint.Offsets[source] = offset
+	data, err := json.MarshalIndent(checkpoint.Offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := checkpoint.path + ".tmp"
+	if err = ioutil.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("Cannot write checkpoint file '%s': %v", tempFile, err)
+	}
+	return os.Rename(tempFile, checkpoint.path)
+}
+
+// ReplayItem describes one registration or PremisEvent the
+// replayer tried to send to Fluctus.
+type ReplayItem struct {
+	BagName          string
+	ObjectIdentifier string
+	// "GenericFile" or "PremisEvent", as in MetadataRecord.
+	Type             string
+	// "file_registered", or the PremisEvent type.
+	Action           string
+	// The file path, or the IntellectualObject identifier.
+	EventObject      string
+	Status           ReplayStatus
+	ErrorMessage     string
+}
+
+// ReplaySummary describes everything a replay did.
+type ReplaySummary struct {
+	// The number of ProcessResults read from the logs.
+	ResultsScanned   int
+	// The number of results that had failed records and
+	// matched the filter.
+	ResultsReplayed  int
+	// The number of log entries skipped because they
+	// weren't valid JSON.
+	MalformedEntries int
+	Items            []*ReplayItem
+}
+
+func NewReplaySummary() (*ReplaySummary) {
+	return &ReplaySummary{
+		Items: make([]*ReplayItem, 0),
+	}
+}
+
+// Returns the number of items with the specified status.
+func (summary *ReplaySummary) Count(status ReplayStatus) (int) {
+	count := 0
+	for _, item := range summary.Items {
+		if item.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns a plain-text report of the replay. Items that still
+// failed are listed individually.
+func (summary *ReplaySummary) String() (string) {
+	text := fmt.Sprintf("Scanned %d results, replayed %d, skipped %d malformed entries.\n",
+		summary.ResultsScanned, summary.ResultsReplayed, summary.MalformedEntries)
+	text += fmt.Sprintf("Replayed: %d\nAlready in Fluctus: %d\nWould replay (dry run): %d\n" +
+		"Still failing: %d\n", summary.Count(ReplaySucceeded), summary.Count(ReplayDuplicate),
+		summary.Count(ReplayDryRun), summary.Count(ReplayFailed))
+	for _, item := range summary.Items {
+		if item.Status == ReplayFailed {
+			text += fmt.Sprintf("  FAILED %s %s %s (%s): %s\n", item.Type, item.Action,
+				item.EventObject, item.BagName, item.ErrorMessage)
+		}
+	}
+	return text
+}
+
+/*
+EventReplayer re-sends GenericFile registrations and PremisEvents
+that failed during the record step, using the FedoraResults in
+the JSON log or in a directory of per-bag results.
+
+Before sending anything, the replayer asks Fluctus what it already
+has, and skips any file or event that is already there, so running
+a replay twice, or replaying a bag that a later attempt recorded
+successfully, does not create duplicates. An event is a duplicate
+if the object or file already has an event of the same type with
+the same outcome detail. A file is a duplicate if Fluctus already
+has it with the same URI.
+
+When a file registration is replayed, the file's events are
+replayed too, because the record step saves a file and its events
+in a single call. The replayer does not re-register
+IntellectualObjects. Use apt_retry to re-run the whole record step
+for bags whose objects were never registered.
+
+Replayed events are stamped with the time of the replay, not the
+time of the original ingest.
+*/
+type EventReplayer struct {
+	FluctusClient *FluctusClient
+	Logger        *logging.Logger
+	// Which results to replay. Nil matches everything.
+	Filter        *ReplayFilter
+	// If true, the replayer only reads from Fluctus, and reports
+	// what it would have sent.
+	DryRun        bool
+	// If not nil, the replayer skips entries before the checkpoint
+	// offsets, and updates the checkpoint as it goes. Dry runs
+	// don't update the checkpoint.
+	Checkpoint    *ReplayCheckpoint
+}
+
+func NewEventReplayer(client *FluctusClient, logger *logging.Logger) (*EventReplayer) {
+	return &EventReplayer{
+		FluctusClient: client,
+		Logger:        logger,
+	}
+}
+
+// ReplayLog replays the failed records in the JSON log at path,
+// adding what it did to summary.
+func (replayer *EventReplayer) ReplayLog(path string, summary *ReplaySummary) (error) {
+	offset := replayer.checkpointOffset(path)
+	malformed, err := ScanResultLog(path, offset, replayer.Logger,
+		func(entry *ResultLogEntry) error {
+			return replayer.replayEntry(entry, summary)
+		})
+	summary.MalformedEntries += malformed
+	return err
+}
+
+// ReplayDirectory replays the failed records in each JSON file
+// in dir, where each file holds a single ProcessResult.
+func (replayer *EventReplayer) ReplayDirectory(dir string, summary *ReplaySummary) (error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Cannot read results file '%s': %v", path, err)
+		}
+		if replayer.checkpointOffset(path) >= int64(len(data)) {
+			continue
+		}
+		entry := &ResultLogEntry{
+			Source:     path,
+			NextOffset: int64(len(data)),
+		}
+		if err = json.Unmarshal(data, &entry.Result); err != nil || entry.Result == nil {
+			replayer.Logger.Warning("Skipping malformed JSON in %s: %v", path, err)
+			summary.MalformedEntries++
+			continue
+		}
+		if err = replayer.replayEntry(entry, summary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (replayer *EventReplayer) checkpointOffset(source string) (int64) {
+	if replayer.Checkpoint == nil {
+		return 0
+	}
+	return replayer.Checkpoint.Offset(source)
+}
+
+func (replayer *EventReplayer) replayEntry(entry *ResultLogEntry, summary *ReplaySummary) (error) {
+	summary.ResultsScanned++
+	if !NeedsReplay(entry.Result) || !replayer.Filter.Matches(entry.Result) {
+		return nil
+	}
+	summary.ResultsReplayed++
+	summary.Items = append(summary.Items, replayer.ReplayResult(entry.Result)...)
+	if replayer.Checkpoint != nil && !replayer.DryRun {
+		return replayer.Checkpoint.Save(entry.Source, entry.NextOffset)
+	}
+	return nil
+}
+
+// ReplayResult replays the failed records in a single result,
+// and returns a ReplayItem for each registration or event it
+// tried to send.
+func (replayer *EventReplayer) ReplayResult(result *ProcessResult) ([]*ReplayItem) {
+	fedoraResult := result.FedoraResult
+	items := make([]*ReplayItem, 0)
+	newItem := func(recordType, action, eventObject string) (*ReplayItem) {
+		item := &ReplayItem{
+			ObjectIdentifier: fedoraResult.ObjectIdentifier,
+			Type:             recordType,
+			Action:           action,
+			EventObject:      eventObject,
+		}
+		if result.S3File != nil {
+			item.BagName = result.S3File.Key.Key
+		}
+		items = append(items, item)
+		return item
+	}
+
+	// Sort out what needs replaying. Files to register come
+	// first, then their events. Object events come before
+	// file events.
+	replayObjectEvents := false
+	registerFiles := make([]string, 0)
+	fileEvents := make(map[string]map[string]bool)
+	eventPaths := make([]string, 0)
+	for _, record := range fedoraResult.FailedRecords() {
+		switch {
+		case record.Type == "IntellectualObject":
+			item := newItem(record.Type, record.Action, record.EventObject)
+			item.Status = ReplayFailed
+			item.ErrorMessage = "Replay does not register IntellectualObjects. " +
+				"Use apt_retry to re-run the record step for this bag."
+		case record.Type == "GenericFile":
+			registerFiles = append(registerFiles, record.EventObject)
+		case record.EventObject == fedoraResult.ObjectIdentifier:
+			replayObjectEvents = true
+		default:
+			if fileEvents[record.EventObject] == nil {
+				fileEvents[record.EventObject] = make(map[string]bool)
+				eventPaths = append(eventPaths, record.EventObject)
+			}
+			fileEvents[record.EventObject][record.Action] = true
+		}
+	}
+
+	if replayObjectEvents {
+		replayer.replayObjectEvents(result, newItem)
+	}
+	for _, path := range registerFiles {
+		replayer.replayFile(result, path, nil, newItem)
+	}
+	for _, path := range eventPaths {
+		replayer.replayFile(result, path, fileEvents[path], newItem)
+	}
+	return items
+}
+
+// Replays the object's ingest and identifier_assignment events,
+// unless the log shows they were already saved.
+func (replayer *EventReplayer) replayObjectEvents(result *ProcessResult, newItem func(string, string, string) (*ReplayItem)) {
+	objId := result.FedoraResult.ObjectIdentifier
+	events := make([]*PremisEvent, 0)
+	obj, err := result.IntellectualObject()
+	if err == nil {
+		for _, event := range []*PremisEvent{obj.CreateIngestEvent(), obj.CreateIdEvent()} {
+			if !result.FedoraResult.RecordSucceeded("PremisEvent", event.EventType, objId) {
+				events = append(events, event)
+			}
+		}
+	} else {
+		err = fmt.Errorf("Cannot rebuild IntellectualObject from log: %v", err)
+	}
+	var existingObj *IntellectualObject
+	if err == nil {
+		existingObj, err = replayer.FluctusClient.IntellectualObjectGet(objId, true)
+		if err == nil && existingObj == nil {
+			err = fmt.Errorf("IntellectualObject %s is not in Fluctus", objId)
+		}
+	}
+	if err != nil {
+		item := newItem("PremisEvent", "ingest", objId)
+		item.Status = ReplayFailed
+		item.ErrorMessage = err.Error()
+		return
+	}
+	for _, event := range events {
+		item := newItem("PremisEvent", event.EventType, objId)
+		replayer.replayEvent(item, objId, "IntellectualObject", event, existingObj.Events)
+	}
+}
+
+// Replays the events of the GenericFile at path whose types are
+// in eventTypes. If eventTypes is nil, this registers the file,
+// then replays all of its events.
+func (replayer *EventReplayer) replayFile(result *ProcessResult, path string, eventTypes map[string]bool, newItem func(string, string, string) (*ReplayItem)) {
+	var gf *GenericFile
+	var err error
+	file := result.TarResult.GetFileByPath(path)
+	if file == nil {
+		err = fmt.Errorf("File %s is not in the bag's TarResult", path)
+	} else {
+		gf, err = file.ToGenericFile()
+	}
+	var existingFile *GenericFile
+	if err == nil {
+		existingFile, err = replayer.FluctusClient.GenericFileGet(gf.Identifier, true)
+	}
+	if err == nil && existingFile == nil && eventTypes != nil {
+		err = fmt.Errorf("GenericFile %s is not in Fluctus", gf.Identifier)
+	}
+	if err != nil {
+		failedItems := make([]*ReplayItem, 0)
+		if eventTypes == nil {
+			failedItems = append(failedItems, newItem("GenericFile", "file_registered", path))
+		}
+		for _, eventType := range sortedKeys(eventTypes) {
+			failedItems = append(failedItems, newItem("PremisEvent", eventType, path))
+		}
+		for _, item := range failedItems {
+			item.Status = ReplayFailed
+			item.ErrorMessage = err.Error()
+		}
+		return
+	}
+
+	existingEvents := make([]*PremisEvent, 0)
+	if existingFile != nil {
+		existingEvents = existingFile.Events
+	}
+	if eventTypes == nil {
+		item := newItem("GenericFile", "file_registered", path)
+		if existingFile != nil && existingFile.URI == gf.URI {
+			item.Status = ReplayDuplicate
+		} else if replayer.DryRun {
+			item.Status = ReplayDryRun
+		} else if _, err = replayer.FluctusClient.GenericFileSave(result.FedoraResult.ObjectIdentifier, gf); err != nil {
+			item.Status = ReplayFailed
+			item.ErrorMessage = err.Error()
+			return
+		} else {
+			item.Status = ReplaySucceeded
+		}
+	}
+	for _, event := range gf.Events {
+		if eventTypes != nil && !eventTypes[event.EventType] {
+			continue
+		}
+		if eventTypes == nil && result.FedoraResult.RecordSucceeded("PremisEvent", event.EventType, path) {
+			continue
+		}
+		item := newItem("PremisEvent", event.EventType, path)
+		replayer.replayEvent(item, gf.Identifier, "GenericFile", event, existingEvents)
+	}
+}
+
+// Sends event to Fluctus, unless it duplicates one of existingEvents,
+// and records the outcome on item.
+func (replayer *EventReplayer) replayEvent(item *ReplayItem, objId, objType string, event *PremisEvent, existingEvents []*PremisEvent) {
+	for _, existing := range existingEvents {
+		if existing != nil && existing.EventType == event.EventType &&
+			existing.OutcomeDetail == event.OutcomeDetail {
+			item.Status = ReplayDuplicate
+			return
+		}
+	}
+	if replayer.DryRun {
+		item.Status = ReplayDryRun
+		return
+	}
+	_, err := replayer.FluctusClient.PremisEventSave(objId, objType, event)
+	if err != nil {
+		item.Status = ReplayFailed
+		item.ErrorMessage = err.Error()
+		replayer.Logger.Error("Replay of %s event for %s failed: %v",
+			event.EventType, objId, err)
+		return
+	}
+	item.Status = ReplaySucceeded
+	replayer.Logger.Info("Replayed %s event for %s", event.EventType, objId)
+}
+
+func sortedKeys(set map[string]bool) ([]string) {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
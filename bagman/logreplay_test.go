@@ -0,0 +1,306 @@
+package bagman_test
+
+import (
+	"encoding/json"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a copy of result_good.json with the specified bag name,
+// bucket and FedoraResult records. Each record is a slice of
+// type, action, event object and error message.
+func replayTestResult(t *testing.T, bagName, bucket string, records [][]string) (*bagman.ProcessResult) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.S3File.Key.Key = bagName
+	result.S3File.BucketName = bucket
+	if records != nil {
+		result.FedoraResult = bagman.NewFedoraResult("ncsu.edu/" + bagName,
+			result.TarResult.FilePaths())
+		for _, record := range records {
+			err = result.FedoraResult.AddRecord(record[0], record[1], record[2], record[3])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return result
+}
+
+// Returns every record apt_record saves for a new object, all
+// of them successful.
+func allReplayTestRecords(t *testing.T, bagName string) ([][]string) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objIdentifier := "ncsu.edu/" + bagName
+	records := [][]string{{"IntellectualObject", "object_registered", objIdentifier, ""}}
+	for _, eventType := range bagman.GeneratedPremisEvents.ObjectEventList() {
+		records = append(records, []string{"PremisEvent", eventType, objIdentifier, ""})
+	}
+	for _, filePath := range result.TarResult.FilePaths() {
+		records = append(records, []string{"GenericFile", "file_registered", filePath, ""})
+	}
+	return records
+}
+
+// Writes a synthetic JSON log and returns its path. The log has
+// a result with failed records, a result where everything
+// succeeded, a result with no FedoraResult, a malformed line and
+// a blank line, and ends with a line that is still being written.
+func writeReplayTestLog(t *testing.T, dir string) (string) {
+	results := []*bagman.ProcessResult{
+		replayTestResult(t, "failed.tar", "aptrust.receiving.ncsu.edu", [][]string{
+			{"IntellectualObject", "object_registered", "ncsu.edu/failed", ""},
+			{"PremisEvent", "ingest", "ncsu.edu/failed", "Fluctus returned 502"},
+			{"GenericFile", "file_registered", "data/metadata.xml", "Fluctus returned 502"},
+			{"PremisEvent", "fixity_generation", "data/object.properties", "Fluctus returned 502"},
+		}),
+		replayTestResult(t, "succeeded.tar", "aptrust.receiving.ncsu.edu",
+			allReplayTestRecords(t, "succeeded.tar")),
+		replayTestResult(t, "prepared.tar", "aptrust.receiving.ncsu.edu", nil),
+	}
+	jsonLines := make([]string, len(results))
+	for i, result := range results {
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonLines[i] = string(data)
+	}
+	lines := []string{
+		jsonLines[0],
+		`{"S3File": {"BucketName": "trunc`,
+		"",
+		jsonLines[1],
+		jsonLines[2],
+		`{"S3File": {"Buck`,
+	}
+	path := filepath.Join(dir, "apt_record.json")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScanResultLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeReplayTestLog(t, dir)
+	logger := bagman.DiscardLogger("logreplay_test")
+
+	entries := make([]*bagman.ResultLogEntry, 0)
+	malformed, err := bagman.ScanResultLog(path, 0, logger, func(entry *bagman.ResultLogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if malformed != 1 {
+		t.Errorf("Expected 1 malformed line, got %d", malformed)
+	}
+	expectedNames := []string{"failed.tar", "succeeded.tar", "prepared.tar"}
+	if len(entries) != len(expectedNames) {
+		t.Fatalf("Expected %d entries, got %d", len(expectedNames), len(entries))
+	}
+	for i, name := range expectedNames {
+		if entries[i].Result.S3File.Key.Key != name {
+			t.Errorf("Entry %d is %s, expected %s", i, entries[i].Result.S3File.Key.Key, name)
+		}
+		if entries[i].Source != path {
+			t.Errorf("Entry %d has source %s, expected %s", i, entries[i].Source, path)
+		}
+	}
+	if entries[0].Offset != 0 || entries[1].Offset <= entries[0].NextOffset {
+		t.Errorf("Offsets should skip the malformed and blank lines: %d-%d, %d",
+			entries[0].Offset, entries[0].NextOffset, entries[1].Offset)
+	}
+
+	// Resuming from an offset picks up at the next entry.
+	resumed := make([]*bagman.ResultLogEntry, 0)
+	malformed, err = bagman.ScanResultLog(path, entries[1].NextOffset, logger,
+		func(entry *bagman.ResultLogEntry) error {
+			resumed = append(resumed, entry)
+			return nil
+		})
+	if err != nil || malformed != 0 {
+		t.Errorf("Resumed scan returned error %v and %d malformed lines", err, malformed)
+	}
+	if len(resumed) != 1 || resumed[0].Result.S3File.Key.Key != "prepared.tar" ||
+		resumed[0].Offset != entries[2].Offset {
+		t.Errorf("Resumed scan should return only prepared.tar")
+	}
+
+	if _, err = bagman.ScanResultLog(filepath.Join(dir, "missing.json"), 0, logger,
+		func(*bagman.ResultLogEntry) error { return nil }); err == nil {
+		t.Errorf("ScanResultLog should return an error for a missing log")
+	}
+}
+
+func TestNeedsReplayAndFailedRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeReplayTestLog(t, dir)
+	needsReplay := make(map[string]bool)
+	failed := make(map[string][]*bagman.MetadataRecord)
+	_, err = bagman.ScanResultLog(path, 0, bagman.DiscardLogger("logreplay_test"),
+		func(entry *bagman.ResultLogEntry) error {
+			name := entry.Result.S3File.Key.Key
+			needsReplay[name] = bagman.NeedsReplay(entry.Result)
+			if entry.Result.FedoraResult != nil {
+				failed[name] = entry.Result.FedoraResult.FailedRecords()
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !needsReplay["failed.tar"] || needsReplay["succeeded.tar"] || needsReplay["prepared.tar"] {
+		t.Errorf("Only failed.tar should need replay: %v", needsReplay)
+	}
+	if len(failed["succeeded.tar"]) != 0 {
+		t.Errorf("succeeded.tar should have no failed records")
+	}
+	expected := []string{
+		"PremisEvent ingest ncsu.edu/failed",
+		"GenericFile file_registered data/metadata.xml",
+		"PremisEvent fixity_generation data/object.properties",
+	}
+	if len(failed["failed.tar"]) != len(expected) {
+		t.Fatalf("Expected %d failed records, got %d", len(expected), len(failed["failed.tar"]))
+	}
+	for i, record := range failed["failed.tar"] {
+		actual := strings.Join([]string{record.Type, record.Action, record.EventObject}, " ")
+		if actual != expected[i] || record.ErrorMessage != "Fluctus returned 502" {
+			t.Errorf("Failed record %d is '%s' (%s), expected '%s'",
+				i, actual, record.ErrorMessage, expected[i])
+		}
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	result := replayTestResult(t, "failed.tar", "aptrust.receiving.ncsu.edu", nil)
+	bagDate, _ := time.Parse(bagman.S3DateFormat, result.S3File.Key.LastModified)
+	matches := []*bagman.ReplayFilter{
+		nil,
+		&bagman.ReplayFilter{},
+		&bagman.ReplayFilter{Institution: "ncsu.edu"},
+		&bagman.ReplayFilter{Since: bagDate},
+		&bagman.ReplayFilter{Since: bagDate.Add(-time.Hour), Until: bagDate.Add(time.Hour)},
+	}
+	for i, filter := range matches {
+		if !filter.Matches(result) {
+			t.Errorf("Filter %d should match: %+v", i, filter)
+		}
+	}
+	misses := []*bagman.ReplayFilter{
+		&bagman.ReplayFilter{Institution: "unc.edu"},
+		&bagman.ReplayFilter{Since: bagDate.Add(time.Second)},
+		&bagman.ReplayFilter{Until: bagDate},
+		&bagman.ReplayFilter{Institution: "unc.edu", Since: bagDate.Add(-time.Hour)},
+	}
+	for i, filter := range misses {
+		if filter.Matches(result) {
+			t.Errorf("Filter %d should not match: %+v", i, filter)
+		}
+	}
+}
+
+func TestReplayCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	checkpoint, err := bagman.LoadReplayCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Offset("/mnt/apt/logs/apt_record.json") != 0 {
+		t.Errorf("New checkpoint should start at offset zero")
+	}
+	if err = checkpoint.Save("/mnt/apt/logs/apt_record.json", 8192); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := bagman.LoadReplayCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Offset("/mnt/apt/logs/apt_record.json") != 8192 {
+		t.Errorf("Reloaded checkpoint has offset %d, expected 8192",
+			reloaded.Offset("/mnt/apt/logs/apt_record.json"))
+	}
+	ioutil.WriteFile(path, []byte("{not json"), 0644)
+	if _, err = bagman.LoadReplayCheckpoint(path); err == nil {
+		t.Errorf("LoadReplayCheckpoint should reject a corrupt checkpoint file")
+	}
+}
+
+// Object registrations aren't replayed, so this runs without Fluctus.
+func TestReplayLogWithCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	result := replayTestResult(t, "unregistered.tar", "aptrust.receiving.ncsu.edu", [][]string{
+		{"IntellectualObject", "object_registered", "ncsu.edu/unregistered", "Fluctus returned 502"},
+	})
+	data, _ := json.Marshal(result)
+	logPath := filepath.Join(dir, "apt_record.json")
+	ioutil.WriteFile(logPath, append(data, '\n'), 0644)
+
+	checkpoint, _ := bagman.LoadReplayCheckpoint(filepath.Join(dir, "checkpoint.json"))
+	replayer := bagman.NewEventReplayer(nil, bagman.DiscardLogger("logreplay_test"))
+	replayer.Checkpoint = checkpoint
+	summary := bagman.NewReplaySummary()
+	if err = replayer.ReplayLog(logPath, summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.ResultsScanned != 1 || summary.ResultsReplayed != 1 {
+		t.Errorf("Expected 1 result scanned and replayed, got %d and %d",
+			summary.ResultsScanned, summary.ResultsReplayed)
+	}
+	if len(summary.Items) != 1 || summary.Count(bagman.ReplayFailed) != 1 {
+		t.Fatalf("Object registration should be reported as still failing")
+	}
+	if !strings.Contains(summary.String(), "FAILED IntellectualObject object_registered " +
+		"ncsu.edu/unregistered (unregistered.tar)") {
+		t.Errorf("Summary does not list the failed item:\n%s", summary.String())
+	}
+	if checkpoint.Offset(logPath) != int64(len(data) + 1) {
+		t.Errorf("Checkpoint offset is %d, expected %d", checkpoint.Offset(logPath), len(data) + 1)
+	}
+
+	// The second run starts at the checkpoint, and finds nothing.
+	summary = bagman.NewReplaySummary()
+	replayer.ReplayLog(logPath, summary)
+	if summary.ResultsScanned != 0 {
+		t.Errorf("Second run should resume after the checkpoint")
+	}
+
+	// Filtered-out results are scanned but not replayed.
+	replayer.Checkpoint = nil
+	replayer.Filter = &bagman.ReplayFilter{Institution: "unc.edu"}
+	summary = bagman.NewReplaySummary()
+	replayer.ReplayLog(logPath, summary)
+	if summary.ResultsScanned != 1 || summary.ResultsReplayed != 0 {
+		t.Errorf("Filtered result should not be replayed")
+	}
+}
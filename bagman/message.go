@@ -0,0 +1,209 @@
+package bagman
+
+import (
+	"fmt"
+	"github.com/nsqio/go-nsq"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message is the part of an NSQ message that our workers use.
+// Workers take a Message instead of an *nsq.Message so they can
+// run either under an NSQ consumer or under the SyncDriver, which
+// needs no nsqd or nsqlookupd.
+type Message interface {
+	// ID uniquely identifies the message. Workers use this
+	// to keep track of items that are already in process.
+	ID() nsq.MessageID
+
+	// Body is the JSON payload of the message.
+	Body() []byte
+
+	// Attempts is the number of times this message has been
+	// delivered, including the current attempt.
+	Attempts() uint16
+
+	// Touch tells the queue we're still working on this item.
+	Touch()
+
+	// ExtendTimeout tells the queue we're starting a step that
+	// may take up to timeout to complete.
+	ExtendTimeout(timeout time.Duration)
+
+	// Finish tells the queue we're done with this item.
+	Finish()
+
+	// Requeue tells the queue to deliver this item again
+	// after the specified delay.
+	Requeue(delay time.Duration)
+}
+
+// nsqMessage adapts an *nsq.Message to the Message interface.
+type nsqMessage struct {
+	message *nsq.Message
+}
+
+// NewNsqMessage wraps an NSQ message so it can be passed to
+// a worker's ProcessMessage method.
+func NewNsqMessage(message *nsq.Message) (Message) {
+	return &nsqMessage{message: message}
+}
+
+func (msg *nsqMessage) ID() (nsq.MessageID) {
+	return msg.message.ID
+}
+
+func (msg *nsqMessage) Body() ([]byte) {
+	return msg.message.Body
+}
+
+func (msg *nsqMessage) Attempts() (uint16) {
+	return msg.message.Attempts
+}
+
+func (msg *nsqMessage) Touch() {
+	msg.message.Touch()
+}
+
+// nsqd has no way to set the timeout of a single message. A touch
+// resets the message's timer to the msg_timeout of the consumer's
+// connection, which CreateIngestNsqConsumer sets to at least the
+// longest StageMsgTimeout, so that's the best we can do here.
+func (msg *nsqMessage) ExtendTimeout(timeout time.Duration) {
+	msg.message.Touch()
+}
+
+func (msg *nsqMessage) Finish() {
+	msg.message.Finish()
+}
+
+func (msg *nsqMessage) Requeue(delay time.Duration) {
+	msg.message.Requeue(delay)
+}
+
+// Used to give each InMemoryMessage a unique ID.
+var inMemoryMessageCount uint64
+
+// InMemoryMessage is a Message that does not come from NSQ.
+// The SyncDriver uses it to feed items through a worker's
+// pipeline and to find out when the worker is done with them.
+type InMemoryMessage struct {
+	id           nsq.MessageID
+	body         []byte
+	attempts     uint16
+	touches      int
+	timeout      time.Duration
+	finished     bool
+	requeued     bool
+	requeueDelay time.Duration
+	done         chan struct{}
+	mutex        sync.Mutex
+}
+
+// NewInMemoryMessage returns a message with the specified body,
+// on its first delivery attempt.
+func NewInMemoryMessage(body []byte) (*InMemoryMessage) {
+	message := &InMemoryMessage{
+		body:     body,
+		attempts: 1,
+		done:     make(chan struct{}),
+	}
+	// Like NSQ message IDs, these are 16 hex characters.
+	idString := fmt.Sprintf("%016x", atomic.AddUint64(&inMemoryMessageCount, 1))
+	copy(message.id[:], idString)
+	return message
+}
+
+func (message *InMemoryMessage) ID() (nsq.MessageID) {
+	return message.id
+}
+
+func (message *InMemoryMessage) Body() ([]byte) {
+	return message.body
+}
+
+func (message *InMemoryMessage) Attempts() (uint16) {
+	return message.attempts
+}
+
+func (message *InMemoryMessage) Touch() {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	message.touches++
+}
+
+// ExtendTimeout counts as a touch, and records the timeout,
+// which tests can check with RequestedTimeout.
+func (message *InMemoryMessage) ExtendTimeout(timeout time.Duration) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	message.touches++
+	message.timeout = timeout
+}
+
+// Finish marks the message as finished. Like NSQ, this ignores
+// any response after the first Finish or Requeue.
+func (message *InMemoryMessage) Finish() {
+	message.respond(false, 0)
+}
+
+// Requeue marks the message as requeued. The SyncDriver does not
+// redeliver requeued messages. It reports them to the caller.
+func (message *InMemoryMessage) Requeue(delay time.Duration) {
+	message.respond(true, delay)
+}
+
+func (message *InMemoryMessage) respond(requeue bool, delay time.Duration) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	if message.finished || message.requeued {
+		return
+	}
+	message.finished = !requeue
+	message.requeued = requeue
+	message.requeueDelay = delay
+	close(message.done)
+}
+
+// Done returns a channel that is closed when the message
+// is finished or requeued.
+func (message *InMemoryMessage) Done() (<-chan struct{}) {
+	return message.done
+}
+
+// Returns true if the worker called Finish on this message.
+func (message *InMemoryMessage) Finished() (bool) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	return message.finished
+}
+
+// Returns true if the worker called Requeue on this message.
+func (message *InMemoryMessage) Requeued() (bool) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	return message.requeued
+}
+
+// Returns the delay the worker passed to Requeue.
+func (message *InMemoryMessage) RequeueDelay() (time.Duration) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	return message.requeueDelay
+}
+
+// Returns the number of times the worker called Touch.
+func (message *InMemoryMessage) Touches() (int) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	return message.touches
+}
+
+// Returns the timeout from the most recent call to ExtendTimeout,
+// or zero if the worker never called it.
+func (message *InMemoryMessage) RequestedTimeout() (time.Duration) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	return message.timeout
+}
@@ -0,0 +1,161 @@
+package bagman
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DurationBuckets are the upper bounds of the buckets in each
+// operation's duration histogram. Operations that take longer
+// than the last bucket are counted in one extra overflow bucket.
+var DurationBuckets = []time.Duration{
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+}
+
+// OperationStats contains counters for a single type of
+// operation, such as an S3 GET or PUT.
+type OperationStats struct {
+	// The number of times the operation was attempted.
+	Count             int64
+
+	// The number of attempts that returned an error.
+	Errors            int64
+
+	// The total number of bytes transferred.
+	Bytes             int64
+
+	// The total time spent on this operation.
+	TotalDuration     time.Duration
+
+	// DurationHistogram[i] is the number of operations that took
+	// less than or equal to DurationBuckets[i] and more than
+	// DurationBuckets[i-1]. The last element counts operations
+	// slower than the last of the DurationBuckets.
+	DurationHistogram []int64
+}
+
+// MetricsRegistry collects OperationStats, keyed by operation
+// name. It's safe to use across go routines.
+type MetricsRegistry struct {
+	stats map[string]*OperationStats
+	mutex *sync.RWMutex
+}
+
+// Metrics is the registry shared by all of the clients in a
+// process. The S3 client records its stats here under the names
+// "s3.get", "s3.put", "s3.head", "s3.delete" and "s3.list".
+var Metrics = NewMetricsRegistry()
+
+// Creates a new, empty MetricsRegistry.
+func NewMetricsRegistry() (*MetricsRegistry) {
+	return &MetricsRegistry{
+		stats: make(map[string]*OperationStats),
+		mutex: &sync.RWMutex{},
+	}
+}
+
+// Returns the stats for the named operation, creating them if
+// necessary. Caller must hold the write lock.
+func (registry *MetricsRegistry) statsFor(operation string) (*OperationStats) {
+	stats, exists := registry.stats[operation]
+	if !exists {
+		stats = &OperationStats{
+			DurationHistogram: make([]int64, len(DurationBuckets)+1),
+		}
+		registry.stats[operation] = stats
+	}
+	return stats
+}
+
+// Record records one attempt at the named operation, which took
+// the specified duration and transferred the specified number of
+// bytes. Param err is the error the operation returned, if any.
+func (registry *MetricsRegistry) Record(operation string, duration time.Duration, bytes int64, err error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	stats := registry.statsFor(operation)
+	stats.Count++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.Bytes += bytes
+	stats.TotalDuration += duration
+	bucket := len(DurationBuckets)
+	for i, upperBound := range DurationBuckets {
+		if duration <= upperBound {
+			bucket = i
+			break
+		}
+	}
+	stats.DurationHistogram[bucket]++
+}
+
+// AddBytes adds to the byte count of the named operation without
+// counting a new attempt. This is for streaming operations, where
+// we don't know how many bytes we'll transfer until the caller is
+// done reading.
+func (registry *MetricsRegistry) AddBytes(operation string, bytes int64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.statsFor(operation).Bytes += bytes
+}
+
+// Get returns a copy of the stats for the named operation.
+// The copy will be empty if the operation has not been recorded.
+func (registry *MetricsRegistry) Get(operation string) (OperationStats) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	stats, exists := registry.stats[operation]
+	if !exists {
+		return OperationStats{
+			DurationHistogram: make([]int64, len(DurationBuckets)+1),
+		}
+	}
+	return copyStats(stats)
+}
+
+// Snapshot returns a copy of all of the stats in the registry,
+// suitable for serializing to JSON for a status report.
+func (registry *MetricsRegistry) Snapshot() (map[string]OperationStats) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	snapshot := make(map[string]OperationStats, len(registry.stats))
+	for operation, stats := range registry.stats {
+		snapshot[operation] = copyStats(stats)
+	}
+	return snapshot
+}
+
+// String returns a human-readable summary of the stats, such as
+// "12 calls, 1 errors, 1.4 GB in 3m 12s". The exact byte count
+// follows in parentheses, for anyone grepping the logs.
+func (stats OperationStats) String() (string) {
+	return fmt.Sprintf("%d calls, %d errors, %s (%d bytes) in %s",
+		stats.Count, stats.Errors, FormatBytes(stats.Bytes), stats.Bytes,
+		FormatDuration(stats.TotalDuration))
+}
+
+// Operations returns the names of all recorded operations, sorted.
+func (registry *MetricsRegistry) Operations() ([]string) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	operations := make([]string, 0, len(registry.stats))
+	for operation := range registry.stats {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+func copyStats(stats *OperationStats) (OperationStats) {
+	statsCopy := *stats
+	statsCopy.DurationHistogram = make([]int64, len(stats.DurationHistogram))
+	copy(statsCopy.DurationHistogram, stats.DurationHistogram)
+	return statsCopy
+}
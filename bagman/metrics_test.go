@@ -0,0 +1,70 @@
+package bagman_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"testing"
+	"time"
+)
+
+func TestMetricsRegistryRecord(t *testing.T) {
+	registry := bagman.NewMetricsRegistry()
+	registry.Record("s3.get", 50*time.Millisecond, 100, nil)
+	registry.Record("s3.get", 2*time.Second, 200, nil)
+	registry.Record("s3.get", 2*time.Hour, 0, fmt.Errorf("Oops"))
+	registry.AddBytes("s3.get", 50)
+
+	stats := registry.Get("s3.get")
+	if stats.Count != 3 {
+		t.Errorf("Expected Count 3, got %d", stats.Count)
+	}
+	if stats.Errors != 1 {
+		t.Errorf("Expected Errors 1, got %d", stats.Errors)
+	}
+	if stats.Bytes != 350 {
+		t.Errorf("Expected Bytes 350, got %d", stats.Bytes)
+	}
+	expectedDuration := 2*time.Hour + 2*time.Second + 50*time.Millisecond
+	if stats.TotalDuration != expectedDuration {
+		t.Errorf("Expected TotalDuration %s, got %s", expectedDuration, stats.TotalDuration)
+	}
+	expectedHistogram := []int64{1, 0, 1, 0, 0, 1}
+	for i, count := range expectedHistogram {
+		if stats.DurationHistogram[i] != count {
+			t.Errorf("Histogram bucket %d: expected %d, got %d",
+				i, count, stats.DurationHistogram[i])
+		}
+	}
+}
+
+func TestMetricsRegistrySnapshot(t *testing.T) {
+	registry := bagman.NewMetricsRegistry()
+	registry.Record("s3.put", time.Second, 10, nil)
+	registry.Record("s3.list", time.Second, 0, nil)
+	snapshot := registry.Snapshot()
+	if len(snapshot) != 2 {
+		t.Errorf("Expected 2 operations in snapshot, got %d", len(snapshot))
+	}
+	// Changes to the registry should not affect the snapshot.
+	registry.Record("s3.put", time.Second, 10, nil)
+	if snapshot["s3.put"].Count != 1 {
+		t.Errorf("Snapshot changed after registry was updated")
+	}
+	if registry.Get("s3.delete").Count != 0 {
+		t.Errorf("Unrecorded operation should have zero count")
+	}
+}
+
+func TestOperationStatsString(t *testing.T) {
+	registry := bagman.NewMetricsRegistry()
+	registry.Record("s3.put", 3*time.Minute, 1503238553, nil)
+	registry.Record("s3.get", 12*time.Second, 0, fmt.Errorf("Oops"))
+	expected := "1 calls, 0 errors, 1.4 GB (1503238553 bytes) in 3m 0s"
+	if registry.Get("s3.put").String() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, registry.Get("s3.put").String())
+	}
+	operations := registry.Operations()
+	if len(operations) != 2 || operations[0] != "s3.get" || operations[1] != "s3.put" {
+		t.Errorf("Operations should be sorted, got %v", operations)
+	}
+}
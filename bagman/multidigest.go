@@ -0,0 +1,149 @@
+package bagman
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// DigestAlgorithm names a digest MultiDigestWriter can calculate.
+type DigestAlgorithm string
+
+const (
+	DigestMd5    DigestAlgorithm = "md5"
+	DigestSha256                 = "sha256"
+	DigestSha512                 = "sha512"
+)
+
+// Buffer size MultiDigestWriter.Copy uses if it's not given one.
+// BenchmarkMultiDigestWriter shows hashing throughput is about the
+// same from 4KB to 1MB, since the hashes, not the copying, take the
+// time. 64KB means fewer reads from disk and S3 than io.Copy's 32KB,
+// without a big allocation for every small file in a bag.
+const DEFAULT_DIGEST_BUFFER_SIZE = 64 * 1024
+
+// DigestSettings says how the unpack stage calculates checksums.
+// The zero value hashes each file as it comes out of the tar file,
+// using a buffer of DEFAULT_DIGEST_BUFFER_SIZE. Config.DigestSettings
+// returns the settings for a process.
+type DigestSettings struct {
+	// BufferSize is the size of the buffer MultiDigestWriter.Copy
+	// reads into. Zero means DEFAULT_DIGEST_BUFFER_SIZE.
+	BufferSize int
+	// Workers is the number of files to hash at once. At zero or
+	// one, each file is hashed as it comes out of the tar file.
+	// Above one, files are written first, and then hashed by a
+	// DigestPool of this many workers. That reads each file twice,
+	// but on a machine with many cores, it's faster for bags with
+	// many files.
+	Workers    int
+}
+
+/*
+MultiDigestWriter calculates any combination of md5, sha256 and
+sha512 digests in a single pass over the data. Write data to it like
+any io.Writer, or use Copy to read from a source, write to a
+destination, and hash everything in between. Then call Sum to get
+each digest as a hex-encoded string.
+
+MultiDigestWriter is not safe for concurrent use. To hash several
+files at once, use one writer per file, as DigestPool does.
+*/
+type MultiDigestWriter struct {
+	algorithms   []DigestAlgorithm
+	hashes       map[DigestAlgorithm]hash.Hash
+	writer       io.Writer
+	bytesWritten int64
+	bufferSize   int
+}
+
+// Returns a new hash for the algorithm, or an error if we don't
+// support that algorithm.
+func newDigestHash(algorithm DigestAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case DigestMd5:
+		return md5.New(), nil
+	case DigestSha256:
+		return sha256.New(), nil
+	case DigestSha512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("Unsupported digest algorithm '%s'. "+
+		"Use md5, sha256 or sha512.", algorithm)
+}
+
+// Returns a MultiDigestWriter that calculates the listed digests.
+// Copy reads into a buffer of bufferSize bytes, or of
+// DEFAULT_DIGEST_BUFFER_SIZE if bufferSize is zero. With no
+// algorithms, the writer calculates nothing, and Copy is just a
+// buffered copy. Returns an error if any algorithm is not supported.
+func NewMultiDigestWriter(bufferSize int, algorithms ...DigestAlgorithm) (*MultiDigestWriter, error) {
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_DIGEST_BUFFER_SIZE
+	}
+	digester := &MultiDigestWriter{
+		algorithms: make([]DigestAlgorithm, 0, len(algorithms)),
+		hashes:     make(map[DigestAlgorithm]hash.Hash, len(algorithms)),
+		bufferSize: bufferSize,
+	}
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		if digester.hashes[algorithm] != nil {
+			continue
+		}
+		digestHash, err := newDigestHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		digester.algorithms = append(digester.algorithms, algorithm)
+		digester.hashes[algorithm] = digestHash
+		writers = append(writers, digestHash)
+	}
+	digester.writer = io.MultiWriter(writers...)
+	return digester, nil
+}
+
+// Write adds p to each digest. It never returns an error.
+func (digester *MultiDigestWriter) Write(p []byte) (int, error) {
+	n, err := digester.writer.Write(p)
+	digester.bytesWritten += int64(n)
+	return n, err
+}
+
+// Copy reads src until EOF, writing everything to dst, if dst is
+// not nil, and to the digests. It returns the number of bytes
+// copied and the first error, if any, from reading or writing.
+func (digester *MultiDigestWriter) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	var writer io.Writer = digester
+	if dst != nil {
+		writer = io.MultiWriter(dst, digester)
+	}
+	// Hide src's WriteTo, if it has one, so io.CopyBuffer uses
+	// our buffer instead of choosing its own.
+	reader := struct{ io.Reader }{src}
+	return io.CopyBuffer(writer, reader, make([]byte, digester.bufferSize))
+}
+
+// Returns the number of bytes hashed so far.
+func (digester *MultiDigestWriter) BytesWritten() (int64) {
+	return digester.bytesWritten
+}
+
+// Returns the algorithms this writer calculates, in the order they
+// were given to NewMultiDigestWriter.
+func (digester *MultiDigestWriter) Algorithms() ([]DigestAlgorithm) {
+	return digester.algorithms
+}
+
+// Sum returns the hex-encoded digest of everything written so far,
+// or an empty string if this writer doesn't calculate that digest.
+func (digester *MultiDigestWriter) Sum(algorithm DigestAlgorithm) (string) {
+	digestHash := digester.hashes[algorithm]
+	if digestHash == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", digestHash.Sum(nil))
+}
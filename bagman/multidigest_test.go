@@ -0,0 +1,260 @@
+package bagman_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Golden digests of fixture files, from md5sum, sha256sum and
+// sha512sum. Refactoring how we hash must never change these.
+type goldenDigest struct {
+	path   string
+	size   int64
+	md5    string
+	sha256 string
+	sha512 string
+}
+
+var goldenDigests = []goldenDigest{
+	{
+		path:   sampleGood,
+		size:   23552,
+		md5:    "05e68e69767c772d36bd8a2baf693428",
+		sha256: "24f4ea194115efa3e8a9bd229cbfa7ac23ded35917af6bd2ec24ffcb1a067f55",
+		sha512: "28c929a4f101199028f97640fb7c44fb7d111650e496db0bf2166e579d0984cd" +
+			"a38d169d3b1da65b461e0cdb6408800574ec08aa504ac0c5d6f32b0994c21e9e",
+	},
+	{
+		path:   filepath.Join(testDataPath, "example.edu.multi_mb_test_bag.tar"),
+		size:   16383488,
+		md5:    "b46f7f8588c10a3242612b4f19395d65",
+		sha256: "8317d60d76ca9674c08c00882e8f7180ce96db3fcb4ce1276fed9d3499d255ca",
+		sha512: "e63a20548a1f213621f12ad4a4d3b5a4e1bc515399203ab66f14f90d85f5c4c8" +
+			"8d6d59e0295d5a9a20c95a9fc939e656c20bd5032b04a3f2d0f660e204c793de",
+	},
+}
+
+// Golden digests of payload files in the sample_good bag.
+var goldenPayloadDigests = map[string][2]string{
+	"data/datastream-DC": {"44d85cf4810d6c6fe87750117633e461",
+		"248fac506a5c46b3c760312b99827b6fb5df4698d6cf9a9cdc4c54746728ab99"},
+	"data/datastream-MARC": {"93e381dfa9ad0086dbe3b92e0324bae6",
+		"8e3634d207017f3cfc8c97545b758c9bcd8a7f772448d60e196663ac4b62456a"},
+}
+
+func TestMultiDigestWriterGolden(t *testing.T) {
+	for _, golden := range goldenDigests {
+		// Odd buffer sizes make sure nothing depends on block boundaries.
+		for _, bufferSize := range []int{0, 7, 4093, 64 * 1024, 1 << 20} {
+			if bufferSize < 4096 && golden.size > 1 << 20 {
+				continue // Too slow to be worth it.
+			}
+			digester, err := bagman.NewMultiDigestWriter(bufferSize, bagman.DigestMd5,
+				bagman.DigestSha256, bagman.DigestSha512)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(golden.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copied := &bytes.Buffer{}
+			bytesCopied, err := digester.Copy(copied, file)
+			file.Close()
+			if err != nil {
+				t.Fatalf("Copy(%s) returned error: %v", golden.path, err)
+			}
+			if bytesCopied != golden.size || digester.BytesWritten() != golden.size ||
+				int64(copied.Len()) != golden.size {
+				t.Errorf("%s, buffer %d: copied %d bytes, hashed %d, wrote %d; expected %d",
+					golden.path, bufferSize, bytesCopied, digester.BytesWritten(),
+					copied.Len(), golden.size)
+			}
+			if digester.Sum(bagman.DigestMd5) != golden.md5 ||
+				digester.Sum(bagman.DigestSha256) != golden.sha256 ||
+				digester.Sum(bagman.DigestSha512) != golden.sha512 {
+				t.Errorf("%s, buffer %d: wrong digests md5 %s, sha256 %s, sha512 %s",
+					golden.path, bufferSize, digester.Sum(bagman.DigestMd5),
+					digester.Sum(bagman.DigestSha256), digester.Sum(bagman.DigestSha512))
+			}
+		}
+	}
+}
+
+// Any subset of algorithms gives the same digests as all of them.
+func TestMultiDigestWriterSubsets(t *testing.T) {
+	golden := goldenDigests[0]
+	data, err := ioutil.ReadFile(golden.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[bagman.DigestAlgorithm]string{
+		bagman.DigestMd5:    golden.md5,
+		bagman.DigestSha256: golden.sha256,
+		bagman.DigestSha512: golden.sha512,
+	}
+	for algorithm, sum := range expected {
+		digester, err := bagman.NewMultiDigestWriter(0, algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digester.Write(data[:100])
+		digester.Write(data[100:])
+		if digester.Sum(algorithm) != sum {
+			t.Errorf("%s alone is %s, expected %s", algorithm, digester.Sum(algorithm), sum)
+		}
+		for other := range expected {
+			if other != algorithm && digester.Sum(other) != "" {
+				t.Errorf("Writer for %s should not calculate %s", algorithm, other)
+			}
+		}
+	}
+
+	// No algorithms at all is just a copy.
+	digester, err := bagman.NewMultiDigestWriter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := &bytes.Buffer{}
+	if n, err := digester.Copy(copied, bytes.NewReader(data)); err != nil || n != golden.size ||
+		!bytes.Equal(copied.Bytes(), data) {
+		t.Errorf("Copy with no digests copied %d bytes (%v)", n, err)
+	}
+}
+
+func TestNewMultiDigestWriterErrors(t *testing.T) {
+	if _, err := bagman.NewMultiDigestWriter(0, bagman.DigestMd5, "sha1"); err == nil {
+		t.Errorf("NewMultiDigestWriter should reject sha1")
+	}
+	digester, err := bagman.NewMultiDigestWriter(0, bagman.DigestSha256, bagman.DigestSha256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digester.Algorithms()) != 1 {
+		t.Errorf("Repeated algorithms should be hashed once, got %v", digester.Algorithms())
+	}
+}
+
+// The call sites that now share MultiDigestWriter still produce the
+// same digests.
+func TestCalculateDigestsGolden(t *testing.T) {
+	for _, golden := range goldenDigests {
+		bagman.ChecksumCache.Invalidate(golden.path)
+		digest, err := bagman.CalculateDigests(golden.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest.Md5Digest != golden.md5 || digest.Sha256Digest != golden.sha256 ||
+			digest.Size != golden.size {
+			t.Errorf("CalculateDigests(%s) returned %+v", golden.path, digest)
+		}
+	}
+}
+
+// Hashing in a pool after untarring gives the same digests as
+// hashing each file as it's untarred, and both cache them.
+func TestUntarDigestWorkers(t *testing.T) {
+	results := make([]*bagman.TarResult, 0, 2)
+	for _, workers := range []int{1, 4} {
+		digestSettings := bagman.DigestSettings{BufferSize: 4093, Workers: workers}
+		outputDir, err := ioutil.TempDir("", "untar_digest_workers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(outputDir)
+		result := bagman.UntarTo(sampleGood, outputDir, "example.edu",
+			filepath.Base(sampleGood), true, digestSettings)
+		if result.ErrorMessage != "" {
+			t.Fatalf("Error untarring with %d digest workers: %s", workers, result.ErrorMessage)
+		}
+		for _, file := range result.Files {
+			cached := bagman.ChecksumCache.Lookup(filepath.Join(result.OutputDir, file.Path))
+			if cached == nil || cached.Md5Digest != file.Md5 || cached.Sha256Digest != file.Sha256 {
+				t.Errorf("With %d digest workers, cached digests of %s are %v", workers,
+					file.Path, cached)
+			}
+		}
+		results = append(results, result)
+	}
+	serial, pooled := results[0], results[1]
+	if len(serial.Files) == 0 || len(pooled.Files) != len(serial.Files) {
+		t.Fatalf("Serial untar has %d files, pooled has %d", len(serial.Files), len(pooled.Files))
+	}
+	for i, file := range serial.Files {
+		pooledFile := pooled.Files[i]
+		if pooledFile.Md5 != file.Md5 || pooledFile.Sha256 != file.Sha256 ||
+			pooledFile.MimeType != file.MimeType || pooledFile.Sha256Generated.IsZero() {
+			t.Errorf("Pooled %s (md5 %s, sha256 %s) does not match serial (md5 %s, sha256 %s)",
+				file.Path, pooledFile.Md5, pooledFile.Sha256, file.Md5, file.Sha256)
+		}
+		if golden, ok := goldenPayloadDigests[file.Path]; ok {
+			if file.Md5 != golden[0] || file.Sha256 != golden[1] {
+				t.Errorf("%s has md5 %s and sha256 %s, expected %s and %s",
+					file.Path, file.Md5, file.Sha256, golden[0], golden[1])
+			}
+		}
+	}
+}
+
+// Run with -race. Every worker has its own MultiDigestWriter, and
+// the pool's results must match hashing the files one at a time.
+func TestDigestPoolManyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest_pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	random := rand.New(rand.NewSource(1435))
+	paths := make([]string, 200)
+	expected := make([][2]string, len(paths))
+	for i := range paths {
+		data := make([]byte, random.Intn(64 * 1024))
+		random.Read(data)
+		paths[i] = filepath.Join(dir, fmt.Sprintf("file_%03d", i))
+		if err := ioutil.WriteFile(paths[i], data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		digester, _ := bagman.NewMultiDigestWriter(0, bagman.DigestMd5, bagman.DigestSha256)
+		digester.Write(data)
+		expected[i] = [2]string{digester.Sum(bagman.DigestMd5), digester.Sum(bagman.DigestSha256)}
+	}
+	digests, errors := bagman.NewDigestPool(16, 0).CalculateDigests(paths)
+	if len(errors) != 0 {
+		t.Fatalf("Pool returned errors: %v", errors)
+	}
+	for i, digest := range digests {
+		if digest.Md5Digest != expected[i][0] || digest.Sha256Digest != expected[i][1] {
+			t.Errorf("Pool digests of %s are %s and %s, expected %s and %s", paths[i],
+				digest.Md5Digest, digest.Sha256Digest, expected[i][0], expected[i][1])
+		}
+	}
+}
+
+// Measures hashing throughput at several buffer sizes. We use this
+// to choose DEFAULT_DIGEST_BUFFER_SIZE. Run it with
+// go test -bench MultiDigestWriter -run XXX ./bagman/
+func BenchmarkMultiDigestWriter(b *testing.B) {
+	data := make([]byte, 16 << 20)
+	rand.New(rand.NewSource(1)).Read(data)
+	algorithmSets := map[string][]bagman.DigestAlgorithm{
+		"md5+sha256": {bagman.DigestMd5, bagman.DigestSha256},
+		"sha512":     {bagman.DigestSha512},
+	}
+	for name, algorithms := range algorithmSets {
+		for _, bufferSize := range []int{4 << 10, 32 << 10, 64 << 10, 256 << 10, 1 << 20} {
+			b.Run(fmt.Sprintf("%s/%dKB", name, bufferSize >> 10), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					digester, _ := bagman.NewMultiDigestWriter(bufferSize, algorithms...)
+					digester.Copy(ioutil.Discard, bytes.NewReader(data))
+				}
+			})
+		}
+	}
+}
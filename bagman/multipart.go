@@ -0,0 +1,382 @@
+package bagman
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MultipartUpload describes a multipart upload that has been
+// started but not completed or aborted. S3 keeps the parts of
+// these uploads, and charges for them, until someone aborts them.
+type MultipartUpload struct {
+	Bucket    string
+	Key       string
+	UploadId  string
+	Initiated time.Time
+}
+
+// MultipartClient lists and cleans up multipart uploads.
+// S3Client implements this. Tests use a fake.
+type MultipartClient interface {
+	ListMultipartUploads(bucketName, prefix string) ([]*MultipartUpload, error)
+	ListParts(bucketName, key, uploadId string) ([]s3.Part, error)
+	AbortMultipartUpload(bucketName, key, uploadId string) (error)
+}
+
+// The XML S3 returns for ListMultipartUploads.
+type listMultipartUploadsResult struct {
+	IsTruncated        bool
+	NextKeyMarker      string
+	NextUploadIdMarker string
+	Upload             []struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+}
+
+// ListMultipartUploads returns the incomplete multipart uploads in
+// the bucket whose keys start with prefix. goamz's ListMulti doesn't
+// tell us when each upload started, which we need to tell stale
+// uploads from ones in progress, so this makes the request itself.
+func (client *S3Client) ListMultipartUploads(bucketName, prefix string) (uploads []*MultipartUpload, err error) {
+	uploads = make([]*MultipartUpload, 0)
+	keyMarker, uploadIdMarker := "", ""
+	for {
+		var result *listMultipartUploadsResult
+		err = client.runOperation("list", client.S3.Bucket(bucketName), func(bucket *s3.Bucket) (int64, error) {
+			var listErr error
+			result, listErr = listMultipartUploads(bucket, prefix,
+				keyMarker, uploadIdMarker)
+			return 0, listErr
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, upload := range result.Upload {
+			initiated, err := time.Parse(time.RFC3339Nano, upload.Initiated)
+			if err != nil {
+				return nil, fmt.Errorf("Upload %s of %s has invalid start time '%s'",
+					upload.UploadId, upload.Key, upload.Initiated)
+			}
+			uploads = append(uploads, &MultipartUpload{
+				Bucket:    bucketName,
+				Key:       upload.Key,
+				UploadId:  upload.UploadId,
+				Initiated: initiated.UTC(),
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		keyMarker, uploadIdMarker = result.NextKeyMarker, result.NextUploadIdMarker
+	}
+	return uploads, nil
+}
+
+// Sends one signed ListMultipartUploads request.
+func listMultipartUploads(bucket *s3.Bucket, prefix, keyMarker, uploadIdMarker string) (*listMultipartUploadsResult, error) {
+	bucketName := bucket.Name
+	endpoint := bucket.Region.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	params := url.Values{}
+	if prefix != "" {
+		params.Set("prefix", prefix)
+	}
+	if keyMarker != "" {
+		params.Set("key-marker", keyMarker)
+		params.Set("upload-id-marker", uploadIdMarker)
+	}
+	requestUrl := fmt.Sprintf("%s/%s/?uploads", endpoint, bucketName)
+	if len(params) > 0 {
+		requestUrl += "&" + params.Encode()
+	}
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Signature version 2. "uploads" is the only sub-resource.
+	date := time.Now().UTC().Format(http.TimeFormat)
+	mac := hmac.New(sha1.New, []byte(bucket.Auth.SecretKey))
+	mac.Write([]byte(fmt.Sprintf("GET\n\n\n%s\n/%s/?uploads", date, bucketName)))
+	req.Header.Set("Date", date)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS %s:%s", bucket.Auth.AccessKey,
+		base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+
+	httpClient := http.DefaultClient
+	if bucket.HTTPClient != nil {
+		httpClient = bucket.HTTPClient()
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("S3 returned status %d listing multipart uploads in %s: %s",
+			resp.StatusCode, bucketName, string(body))
+	}
+	result := &listMultipartUploadsResult{}
+	if err = xml.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("Cannot parse multipart upload list from S3: %v", err)
+	}
+	return result, nil
+}
+
+// ListParts returns the parts S3 has received for the upload.
+func (client *S3Client) ListParts(bucketName, key, uploadId string) (parts []s3.Part, err error) {
+	err = client.runOperation("list", client.S3.Bucket(bucketName), func(bucket *s3.Bucket) (int64, error) {
+		multi := &s3.Multi{Bucket: bucket, Key: key, UploadId: uploadId}
+		var listErr error
+		parts, listErr = multi.ListParts()
+		return 0, listErr
+	})
+	return parts, err
+}
+
+// AbortMultipartUpload aborts the upload, and S3 deletes its parts.
+func (client *S3Client) AbortMultipartUpload(bucketName, key, uploadId string) (error) {
+	return client.runOperation("delete", client.S3.Bucket(bucketName), func(bucket *s3.Bucket) (int64, error) {
+		multi := &s3.Multi{Bucket: bucket, Key: key, UploadId: uploadId}
+		return 0, multi.Abort()
+	})
+}
+
+// Returns true if err says the upload no longer exists.
+func isNoSuchUpload(err error) (bool) {
+	return err != nil && strings.Contains(err.Error(), "NoSuchUpload")
+}
+
+// StaleUpload is a multipart upload old enough to abort.
+type StaleUpload struct {
+	Upload *MultipartUpload
+	Age    time.Duration
+	// The total size of the parts S3 has stored for this upload.
+	Bytes  int64
+	// Aborted is true once the upload has been aborted.
+	Aborted bool
+}
+
+// MultipartCleanup finds multipart uploads that have been open
+// longer than MaxAge, which usually means the worker that started
+// them died, and aborts them so S3 stops charging for their parts.
+type MultipartCleanup struct {
+	Client MultipartClient
+	Logger *logging.Logger
+	// Uploads started more than MaxAge ago are stale. This should
+	// be much longer than it takes to store the largest bag.
+	MaxAge time.Duration
+	// If true, report stale uploads without aborting them.
+	DryRun bool
+	// If zero, the cleanup uses the current time.
+	Now    time.Time
+}
+
+// MultipartCleanupSummary describes what a cleanup found and did.
+type MultipartCleanupSummary struct {
+	Bucket         string
+	// The number of incomplete uploads in the bucket.
+	Uploads        int
+	Stale          []*StaleUpload
+	// ReclaimedBytes is the size of the parts of the uploads
+	// that were aborted. In a dry run, it's what would be reclaimed.
+	ReclaimedBytes int64
+	DryRun         bool
+	Errors         []error
+}
+
+func (summary *MultipartCleanupSummary) String() (string) {
+	verb := "aborted"
+	if summary.DryRun {
+		verb = "would abort"
+	}
+	aborted := 0
+	for _, stale := range summary.Stale {
+		if stale.Aborted || summary.DryRun {
+			aborted++
+		}
+	}
+	text := fmt.Sprintf("%s: %d incomplete uploads, %d stale, %s %d, reclaiming %s (%d bytes)",
+		summary.Bucket, summary.Uploads, len(summary.Stale), verb, aborted,
+		FormatBytes(summary.ReclaimedBytes), summary.ReclaimedBytes)
+	for _, err := range summary.Errors {
+		text += fmt.Sprintf("\n  Error: %v", err)
+	}
+	return text
+}
+
+// FindStaleUploads returns the uploads in the bucket that are older
+// than MaxAge, oldest first, with the size of their stored parts.
+func (cleanup *MultipartCleanup) FindStaleUploads(bucketName, prefix string) ([]*StaleUpload, error) {
+	uploads, err := cleanup.Client.ListMultipartUploads(bucketName, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return cleanup.staleUploads(bucketName, uploads)
+}
+
+func (cleanup *MultipartCleanup) staleUploads(bucketName string, uploads []*MultipartUpload) ([]*StaleUpload, error) {
+	now := cleanup.Now
+	if now.IsZero() {
+		now = NowUTC()
+	}
+	stale := make([]*StaleUpload, 0)
+	for _, upload := range uploads {
+		age := now.Sub(upload.Initiated)
+		if age <= cleanup.MaxAge {
+			continue
+		}
+		parts, err := cleanup.Client.ListParts(bucketName, upload.Key, upload.UploadId)
+		if err != nil && !isNoSuchUpload(err) {
+			return nil, err
+		}
+		staleUpload := &StaleUpload{Upload: upload, Age: age}
+		for _, part := range parts {
+			staleUpload.Bytes += part.Size
+		}
+		stale = append(stale, staleUpload)
+	}
+	sort.Sort(staleUploadsByAge(stale))
+	return stale, nil
+}
+
+// Run finds the stale uploads in the bucket and, unless this is a
+// dry run, aborts them. An error aborting one upload does not stop
+// the cleanup.
+func (cleanup *MultipartCleanup) Run(bucketName, prefix string) (*MultipartCleanupSummary) {
+	summary := &MultipartCleanupSummary{
+		Bucket: bucketName,
+		Stale:  make([]*StaleUpload, 0),
+		DryRun: cleanup.DryRun,
+		Errors: make([]error, 0),
+	}
+	uploads, err := cleanup.Client.ListMultipartUploads(bucketName, prefix)
+	if err != nil {
+		summary.Errors = append(summary.Errors, err)
+		return summary
+	}
+	summary.Uploads = len(uploads)
+	summary.Stale, err = cleanup.staleUploads(bucketName, uploads)
+	if err != nil {
+		summary.Errors = append(summary.Errors, err)
+		return summary
+	}
+	for _, stale := range summary.Stale {
+		upload := stale.Upload
+		if cleanup.DryRun {
+			cleanup.log("Would abort upload %s of %s, started %s ago (%s)", upload.UploadId,
+				upload.Key, FormatDuration(stale.Age), FormatBytes(stale.Bytes))
+			summary.ReclaimedBytes += stale.Bytes
+			continue
+		}
+		err = cleanup.Client.AbortMultipartUpload(bucketName, upload.Key, upload.UploadId)
+		if err != nil && !isNoSuchUpload(err) {
+			summary.Errors = append(summary.Errors, fmt.Errorf(
+				"Cannot abort upload %s of %s: %v", upload.UploadId, upload.Key, err))
+			continue
+		}
+		stale.Aborted = true
+		summary.ReclaimedBytes += stale.Bytes
+		cleanup.log("Aborted upload %s of %s, started %s ago (%s)", upload.UploadId,
+			upload.Key, FormatDuration(stale.Age), FormatBytes(stale.Bytes))
+	}
+	return summary
+}
+
+func (cleanup *MultipartCleanup) log(format string, args ...interface{}) {
+	if cleanup.Logger != nil {
+		cleanup.Logger.Info(format, args...)
+	}
+}
+
+type staleUploadsByAge []*StaleUpload
+
+func (s staleUploadsByAge) Len() int           { return len(s) }
+func (s staleUploadsByAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s staleUploadsByAge) Less(i, j int) bool { return s[i].Age > s[j].Age }
+
+// PlanMultipartResume decides how much of an interrupted upload we
+// can keep. Param existing is what S3 has for the upload, from
+// ListParts. Param partMd5 returns the md5 of our local copy of the
+// part that starts at offset and is size bytes long.
+//
+// We keep parts 1..n-1 if each has the size we'd send and an ETag
+// that matches the md5 of our local data, and return them with n,
+// the number of the first part to upload. S3 replaces a part when
+// we upload the same part number again, so later parts that don't
+// match are simply overwritten.
+func PlanMultipartResume(existing []s3.Part, byteCount, chunkSize int64, partMd5 func(offset, size int64) (string, error)) (keep []s3.Part, nextPart int, err error) {
+	byNumber := make(map[int]s3.Part, len(existing))
+	for _, part := range existing {
+		byNumber[part.N] = part
+	}
+	keep = make([]s3.Part, 0)
+	totalParts := multipartCount(byteCount, chunkSize)
+	for n := 1; n <= totalParts; n++ {
+		part, uploaded := byNumber[n]
+		offset, size := multipartRange(n, byteCount, chunkSize)
+		if !uploaded || part.Size != size {
+			return keep, n, nil
+		}
+		localMd5, err := partMd5(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if strings.Trim(part.ETag, "\"") != localMd5 {
+			return keep, n, nil
+		}
+		keep = append(keep, part)
+	}
+	return keep, totalParts + 1, nil
+}
+
+// Returns the number of parts in a multipart upload of byteCount
+// bytes. Even an empty file has one part.
+func multipartCount(byteCount, chunkSize int64) (int) {
+	if byteCount == 0 {
+		return 1
+	}
+	return int((byteCount + chunkSize - 1) / chunkSize)
+}
+
+// Returns the offset and size of part n (starting at 1).
+func multipartRange(n int, byteCount, chunkSize int64) (offset, size int64) {
+	offset = int64(n - 1) * chunkSize
+	size = chunkSize
+	if offset + size > byteCount {
+		size = byteCount - offset
+	}
+	return offset, size
+}
+
+// Returns a function that calculates the md5 of a range of reader.
+func readerPartMd5(reader io.ReaderAt) (func(offset, size int64) (string, error)) {
+	return func(offset, size int64) (string, error) {
+		hash := md5.New()
+		_, err := io.Copy(hash, io.NewSectionReader(reader, offset, size))
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+}
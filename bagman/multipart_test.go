@@ -0,0 +1,232 @@
+package bagman_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/s3"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake MultipartClient that keeps uploads and parts in memory.
+type fakeMultipartClient struct {
+	uploads   []*bagman.MultipartUpload
+	parts     map[string][]s3.Part
+	aborted   []string
+	abortErrs map[string]error
+}
+
+func (client *fakeMultipartClient) ListMultipartUploads(bucketName, prefix string) ([]*bagman.MultipartUpload, error) {
+	uploads := make([]*bagman.MultipartUpload, 0)
+	for _, upload := range client.uploads {
+		if strings.HasPrefix(upload.Key, prefix) {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+func (client *fakeMultipartClient) ListParts(bucketName, key, uploadId string) ([]s3.Part, error) {
+	return client.parts[uploadId], nil
+}
+
+func (client *fakeMultipartClient) AbortMultipartUpload(bucketName, key, uploadId string) (error) {
+	if err := client.abortErrs[uploadId]; err != nil {
+		return err
+	}
+	client.aborted = append(client.aborted, uploadId)
+	return nil
+}
+
+var cleanupNow = time.Date(2014, 9, 10, 12, 0, 0, 0, time.UTC)
+
+func fakeUploads() (*fakeMultipartClient) {
+	return &fakeMultipartClient{
+		uploads: []*bagman.MultipartUpload{
+			{Bucket: "preservation", Key: "uuid-1", UploadId: "fresh",
+				Initiated: cleanupNow.Add(-2 * time.Hour)},
+			{Bucket: "preservation", Key: "uuid-2", UploadId: "week",
+				Initiated: cleanupNow.Add(-8 * 24 * time.Hour)},
+			{Bucket: "preservation", Key: "uuid-3", UploadId: "month",
+				Initiated: cleanupNow.Add(-30 * 24 * time.Hour)},
+		},
+		parts: map[string][]s3.Part{
+			"fresh": {{N: 1, Size: 1000}},
+			"week":  {{N: 1, Size: 5 * 1024 * 1024}, {N: 2, Size: 1024 * 1024}},
+			"month": {{N: 1, Size: 2048}},
+		},
+		aborted:   make([]string, 0),
+		abortErrs: make(map[string]error),
+	}
+}
+
+func TestFindStaleUploads(t *testing.T) {
+	cleanup := &bagman.MultipartCleanup{
+		Client: fakeUploads(),
+		MaxAge: 7 * 24 * time.Hour,
+		Now:    cleanupNow,
+	}
+	stale, err := cleanup.FindStaleUploads("preservation", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 {
+		t.Fatalf("Expected 2 stale uploads, got %d", len(stale))
+	}
+	// Oldest first
+	if stale[0].Upload.UploadId != "month" || stale[1].Upload.UploadId != "week" {
+		t.Errorf("Stale uploads are out of order: %s, %s",
+			stale[0].Upload.UploadId, stale[1].Upload.UploadId)
+	}
+	if stale[1].Bytes != 6 * 1024 * 1024 {
+		t.Errorf("Expected 6291456 bytes, got %d", stale[1].Bytes)
+	}
+	if stale[1].Age != 8 * 24 * time.Hour {
+		t.Errorf("Expected age of 8 days, got %s", stale[1].Age)
+	}
+	stale, err = cleanup.FindStaleUploads("preservation", "uuid-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].Upload.Key != "uuid-2" {
+		t.Errorf("Prefix uuid-2 should match only one stale upload")
+	}
+}
+
+func TestMultipartCleanupDryRun(t *testing.T) {
+	client := fakeUploads()
+	cleanup := &bagman.MultipartCleanup{
+		Client: client,
+		MaxAge: 7 * 24 * time.Hour,
+		DryRun: true,
+		Now:    cleanupNow,
+	}
+	summary := cleanup.Run("preservation", "")
+	if len(client.aborted) != 0 {
+		t.Errorf("Dry run aborted %d uploads", len(client.aborted))
+	}
+	if summary.Uploads != 3 || len(summary.Stale) != 2 {
+		t.Errorf("Expected 3 uploads, 2 stale; got %d, %d", summary.Uploads, len(summary.Stale))
+	}
+	if summary.ReclaimedBytes != 6 * 1024 * 1024 + 2048 {
+		t.Errorf("Expected 6293504 reclaimable bytes, got %d", summary.ReclaimedBytes)
+	}
+	expected := "preservation: 3 incomplete uploads, 2 stale, would abort 2, reclaiming 6.0 MB (6293504 bytes)"
+	if summary.String() != expected {
+		t.Errorf("Expected summary '%s', got '%s'", expected, summary.String())
+	}
+}
+
+func TestMultipartCleanupRun(t *testing.T) {
+	client := fakeUploads()
+	client.abortErrs["month"] = fmt.Errorf("Access Denied")
+	cleanup := &bagman.MultipartCleanup{
+		Client: client,
+		MaxAge: 7 * 24 * time.Hour,
+		Now:    cleanupNow,
+	}
+	summary := cleanup.Run("preservation", "")
+	if len(client.aborted) != 1 || client.aborted[0] != "week" {
+		t.Errorf("Expected to abort only 'week', aborted %v", client.aborted)
+	}
+	if summary.Stale[0].Aborted || !summary.Stale[1].Aborted {
+		t.Errorf("Aborted flags are wrong")
+	}
+	if summary.ReclaimedBytes != 6 * 1024 * 1024 {
+		t.Errorf("Expected 6291456 reclaimed bytes, got %d", summary.ReclaimedBytes)
+	}
+	if len(summary.Errors) != 1 || !strings.Contains(summary.Errors[0].Error(), "Access Denied") {
+		t.Errorf("Expected one abort error, got %v", summary.Errors)
+	}
+	if !strings.Contains(summary.String(), "aborted 1, reclaiming 6.0 MB") ||
+		!strings.Contains(summary.String(), "Error: Cannot abort upload month of uuid-3") {
+		t.Errorf("Unexpected summary: %s", summary.String())
+	}
+}
+
+// Returns parts as S3 would report them after uploading data in
+// chunks of chunkSize.
+func uploadedParts(data []byte, chunkSize int) ([]s3.Part) {
+	parts := make([]s3.Part, 0)
+	for n := 1; (n - 1) * chunkSize < len(data); n++ {
+		end := n * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[(n - 1) * chunkSize:end])
+		parts = append(parts, s3.Part{
+			N:    n,
+			ETag: "\"" + hex.EncodeToString(sum[:]) + "\"",
+			Size: int64(end - (n - 1) * chunkSize),
+		})
+	}
+	return parts
+}
+
+func localMd5(data []byte) (func(offset, size int64) (string, error)) {
+	return func(offset, size int64) (string, error) {
+		sum := md5.Sum(data[offset:offset + size])
+		return hex.EncodeToString(sum[:]), nil
+	}
+}
+
+func TestPlanMultipartResume(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 5))
+	parts := uploadedParts(data, 10)
+
+	keep, next, err := bagman.PlanMultipartResume([]s3.Part{}, 50, 10, localMd5(data))
+	if err != nil || len(keep) != 0 || next != 1 {
+		t.Errorf("No parts: expected 0 kept, next 1; got %d, %d, %v", len(keep), next, err)
+	}
+
+	keep, next, err = bagman.PlanMultipartResume(parts, 50, 10, localMd5(data))
+	if err != nil || len(keep) != 5 || next != 6 {
+		t.Errorf("All parts: expected 5 kept, next 6; got %d, %d, %v", len(keep), next, err)
+	}
+
+	// S3 may list parts in any order, and may be missing some.
+	shuffled := []s3.Part{parts[2], parts[0], parts[1], parts[4]}
+	keep, next, err = bagman.PlanMultipartResume(shuffled, 50, 10, localMd5(data))
+	if err != nil || len(keep) != 3 || next != 4 {
+		t.Errorf("Missing part 4: expected 3 kept, next 4; got %d, %d, %v", len(keep), next, err)
+	}
+	for i, part := range keep {
+		if part.N != i + 1 {
+			t.Errorf("Kept part %d has number %d", i, part.N)
+		}
+	}
+
+	// Part 2 was cut short.
+	short := append([]s3.Part{}, parts...)
+	short[1].Size = 7
+	keep, next, err = bagman.PlanMultipartResume(short, 50, 10, localMd5(data))
+	if err != nil || len(keep) != 1 || next != 2 {
+		t.Errorf("Short part: expected 1 kept, next 2; got %d, %d, %v", len(keep), next, err)
+	}
+
+	// Part 3 has different content.
+	changed := []byte(string(data))
+	changed[25] = 'x'
+	keep, next, err = bagman.PlanMultipartResume(parts, 50, 10, localMd5(changed))
+	if err != nil || len(keep) != 2 || next != 3 {
+		t.Errorf("Changed part: expected 2 kept, next 3; got %d, %d, %v", len(keep), next, err)
+	}
+
+	// The last part is smaller than the chunk size.
+	odd := data[:45]
+	keep, next, err = bagman.PlanMultipartResume(uploadedParts(odd, 10), 45, 10, localMd5(odd))
+	if err != nil || len(keep) != 5 || next != 6 {
+		t.Errorf("Short last part: expected 5 kept, next 6; got %d, %d, %v", len(keep), next, err)
+	}
+
+	// Errors reading local data are returned.
+	_, _, err = bagman.PlanMultipartResume(parts, 50, 10, func(offset, size int64) (string, error) {
+		return "", fmt.Errorf("Disk on fire")
+	})
+	if err == nil {
+		t.Errorf("PlanMultipartResume should return the md5 error")
+	}
+}
@@ -0,0 +1,157 @@
+package bagman
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Notification is a message for one or more people, such as the
+// daily activity digest we send to depositors.
+type Notification struct {
+	Recipients  []string                  `json:"recipients"`
+	Subject     string                    `json:"subject"`
+	Body        string                    `json:"body"`
+	Attachments []*NotificationAttachment `json:"attachments"`
+}
+
+// NotificationAttachment is a file that goes with a Notification.
+// Data is base64-encoded when a webhook notification is sent as JSON.
+type NotificationAttachment struct {
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// Notifier delivers notifications. SMTPNotifier sends them as email,
+// and WebhookNotifier posts them to a URL.
+type Notifier interface {
+	Notify(notification *Notification) (error)
+}
+
+// SMTPNotifier sends notifications as email through an SMTP server.
+type SMTPNotifier struct {
+	// Server is the SMTP server's host and port, e.g. "localhost:25".
+	Server string
+	// From is the sender's email address.
+	From   string
+	// Auth is nil if the server doesn't require authentication.
+	Auth   smtp.Auth
+}
+
+// Notify emails the notification to its recipients.
+func (notifier *SMTPNotifier) Notify(notification *Notification) (error) {
+	if len(notification.Recipients) == 0 {
+		return fmt.Errorf("Notification '%s' has no recipients", notification.Subject)
+	}
+	message, err := notification.EmailMessage(notifier.From, time.Now())
+	if err != nil {
+		return err
+	}
+	err = smtp.SendMail(notifier.Server, notifier.Auth, notifier.From,
+		notification.Recipients, message)
+	if err != nil {
+		return fmt.Errorf("Cannot send '%s' through %s: %v",
+			notification.Subject, notifier.Server, err)
+	}
+	return nil
+}
+
+// EmailMessage returns the notification as an email message from
+// sender, with headers. The body is plain text. If there are
+// attachments, the message is multipart/mixed.
+func (notification *Notification) EmailMessage(from string, date time.Time) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "From: %s\r\n", from)
+	fmt.Fprintf(buffer, "To: %s\r\n", strings.Join(notification.Recipients, ", "))
+	fmt.Fprintf(buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", notification.Subject))
+	fmt.Fprintf(buffer, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(buffer, "MIME-Version: 1.0\r\n")
+	if len(notification.Attachments) == 0 {
+		fmt.Fprintf(buffer, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		buffer.WriteString(crlfLines(notification.Body))
+		return buffer.Bytes(), nil
+	}
+
+	writer := multipart.NewWriter(buffer)
+	fmt.Fprintf(buffer, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(part, crlfLines(notification.Body))
+	for _, attachment := range notification.Attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err = writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=\"%s\"", attachment.FileName)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			io.WriteString(part, encoded[:76]+"\r\n")
+			encoded = encoded[76:]
+		}
+		io.WriteString(part, encoded+"\r\n")
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Email lines end in CRLF.
+func crlfLines(text string) (string) {
+	return strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// WebhookNotifier posts notifications as JSON to a URL, such as a
+// chat service's incoming webhook or a mail relay.
+type WebhookNotifier struct {
+	URL    string
+	// Client is the HTTP client to post with. If it's nil,
+	// Notify uses http.DefaultClient.
+	Client *http.Client
+}
+
+// Notify posts the notification as JSON. It returns an error if
+// the server does not respond with a 2xx status.
+func (notifier *WebhookNotifier) Notify(notification *Notification) (error) {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	client := notifier.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Post(notifier.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Cannot post '%s' to webhook: %v", notification.Subject, err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned status %d for '%s': %s",
+			response.StatusCode, notification.Subject, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package bagman_test
+
+import (
+	"encoding/json"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNotification() (*bagman.Notification) {
+	return &bagman.Notification{
+		Recipients: []string{"a@unc.edu", "b@unc.edu"},
+		Subject:    "APTrust activity for unc.edu",
+		Body:       "Line one\nLine two\n",
+		Attachments: []*bagman.NotificationAttachment{
+			{FileName: "digest.json", ContentType: "application/json",
+				Data: []byte(strings.Repeat(`{"institution": "unc.edu"}`, 10))},
+		},
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	notification := testNotification()
+	date := time.Date(2016, 6, 2, 6, 0, 0, 0, time.UTC)
+	data, err := notification.EmailMessage("help@aptrust.org", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("Email message doesn't parse: %v", err)
+	}
+	if message.Header.Get("To") != "a@unc.edu, b@unc.edu" ||
+		message.Header.Get("Subject") != notification.Subject {
+		t.Errorf("Email has wrong headers: %v", message.Header)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Expected multipart/mixed, got %s", mediaType)
+	}
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(part)
+	if string(body) != "Line one\r\nLine two\r\n" {
+		t.Errorf("Email body should have CRLF line endings: %q", body)
+	}
+	part, err = reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != "digest.json" {
+		t.Errorf("Wrong attachment name %s", part.FileName())
+	}
+
+	notification.Attachments = nil
+	data, err = notification.EmailMessage("help@aptrust.org", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Content-Type: text/plain; charset=utf-8\r\n\r\nLine one\r\n") {
+		t.Errorf("Email without attachments should be plain text:\n%s", data)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received *bagman.Notification
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = &bagman.Notification{}
+		json.NewDecoder(r.Body).Decode(received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	notifier := &bagman.WebhookNotifier{URL: server.URL}
+	notification := testNotification()
+	if err := notifier.Notify(notification); err != nil {
+		t.Fatalf("Notify returned error %v", err)
+	}
+	if received == nil || received.Subject != notification.Subject ||
+		len(received.Attachments) != 1 ||
+		string(received.Attachments[0].Data) != string(notification.Attachments[0].Data) {
+		t.Errorf("Webhook received the wrong notification: %+v", received)
+	}
+
+	status = http.StatusInternalServerError
+	if err := notifier.Notify(notification); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Notify should return an error with the status: %v", err)
+	}
+}
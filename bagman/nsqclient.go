@@ -6,15 +6,72 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 )
 
+// CompactMarshaler is implemented by results that have a smaller
+// JSON form for queues that don't need the whole result.
+// ProcessResult implements it.
+type CompactMarshaler interface {
+	MarshalCompact() ([]byte, error)
+}
+
+// Queue receives the items workers send on to other topics.
+// ProcessUtil.Enqueue sends to ProcessUtil.Queue when it's set,
+// so callers that run workers without NSQ decide what happens
+// after each stage.
+type Queue interface {
+	Enqueue(topic string, object interface{}) error
+}
+
+// MemoryQueue is a Queue that keeps items in memory, by topic,
+// instead of sending them to nsqd. It's safe for concurrent use.
+type MemoryQueue struct {
+	items map[string][]interface{}
+	mutex sync.Mutex
+}
+
+// Returns an empty MemoryQueue.
+func NewMemoryQueue() (*MemoryQueue) {
+	return &MemoryQueue{items: make(map[string][]interface{})}
+}
+
+func (queue *MemoryQueue) Enqueue(topic string, object interface{}) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.items[topic] = append(queue.items[topic], object)
+	return nil
+}
+
+// Returns the items sent to topic, in the order they were sent.
+func (queue *MemoryQueue) Items(topic string) ([]interface{}) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return append([]interface{}{}, queue.items[topic]...)
+}
+
 // Sends the JSON of a result object to the specified queue.
 func Enqueue(nsqdHttpAddress, topic string, object interface{}) error {
-	url := fmt.Sprintf("%s/put?topic=%s", nsqdHttpAddress, topic)
 	json, err := json.Marshal(object)
 	if err != nil {
 		return fmt.Errorf("Error marshalling data to JSON for file: %v", err)
 	}
+	return enqueueJson(nsqdHttpAddress, topic, json)
+}
+
+// Sends the compact JSON of a result object to the specified
+// queue. Use this instead of Enqueue when the worker reading the
+// queue only needs enough to start processing the item again.
+func EnqueueCompact(nsqdHttpAddress, topic string, object CompactMarshaler) error {
+	json, err := object.MarshalCompact()
+	if err != nil {
+		return fmt.Errorf("Error marshalling compact data to JSON for file: %v", err)
+	}
+	return enqueueJson(nsqdHttpAddress, topic, json)
+}
+
+func enqueueJson(nsqdHttpAddress, topic string, json []byte) error {
+	url := fmt.Sprintf("%s/put?topic=%s", nsqdHttpAddress, topic)
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(json))
 
 	if err != nil {
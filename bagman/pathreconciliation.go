@@ -0,0 +1,146 @@
+package bagman
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"sort"
+	"strings"
+)
+
+// PathReconciliation describes the result of comparing the payload
+// files we extracted from a tar file against the payload files
+// listed in the bag's manifest.
+type PathReconciliation struct {
+	// Payload files that were in the tar file but not in the
+	// manifest. These are the paths exactly as they appeared
+	// in the tar file.
+	NotInManifest  []string
+
+	// Files listed in the manifest that were not in the tar
+	// file. These are the paths exactly as they appeared in
+	// the manifest.
+	NotInTar       []string
+
+	// Descriptions of the normalizations we had to apply to
+	// match paths on one side with paths on the other.
+	Normalizations []string
+}
+
+// NormalizeBagPath converts a path from a tar header or a manifest
+// into the form we use to compare the two. It converts backslashes
+// to forward slashes, removes any leading "./", and converts the
+// path to Unicode normalization form C, so that "é" as a single
+// code point matches "e" followed by a combining accent.
+//
+// Returns the normalized path and a list of the normalizations that
+// actually changed it. The list is empty if the path was already
+// in normal form.
+func NormalizeBagPath(bagPath string) (normalized string, applied []string) {
+	applied = make([]string, 0)
+	normalized = bagPath
+	if strings.Contains(normalized, "\\") {
+		normalized = strings.Replace(normalized, "\\", "/", -1)
+		applied = append(applied, "backslashes converted to forward slashes")
+	}
+	if strings.HasPrefix(normalized, "./") {
+		for strings.HasPrefix(normalized, "./") {
+			normalized = normalized[2:]
+		}
+		applied = append(applied, "leading ./ removed")
+	}
+	if !norm.NFC.IsNormalString(normalized) {
+		normalized = norm.NFC.String(normalized)
+		applied = append(applied, "converted to unicode NFC")
+	}
+	return normalized, applied
+}
+
+// ReconcilePaths compares the payload paths from a tar file against
+// the paths listed in a bag's manifest, after normalizing both with
+// NormalizeBagPath. It returns the paths that appear on only one side,
+// along with a description of each normalization it applied.
+func ReconcilePaths(tarPaths, manifestPaths []string) (*PathReconciliation) {
+	reconciliation := &PathReconciliation{
+		NotInManifest:  make([]string, 0),
+		NotInTar:       make([]string, 0),
+		Normalizations: make([]string, 0),
+	}
+	normalizedTarPaths := reconciliation.normalizeAll("tar", tarPaths)
+	normalizedManifestPaths := reconciliation.normalizeAll("manifest", manifestPaths)
+	for normalized, original := range normalizedTarPaths {
+		if _, inManifest := normalizedManifestPaths[normalized]; !inManifest {
+			reconciliation.NotInManifest = append(reconciliation.NotInManifest, original)
+		}
+	}
+	for normalized, original := range normalizedManifestPaths {
+		if _, inTar := normalizedTarPaths[normalized]; !inTar {
+			reconciliation.NotInTar = append(reconciliation.NotInTar, original)
+		}
+	}
+	sort.Strings(reconciliation.NotInManifest)
+	sort.Strings(reconciliation.NotInTar)
+	return reconciliation
+}
+
+// Normalizes all of the paths from one source ("tar" or "manifest"),
+// recording the normalizations applied. Returns a map of normalized
+// path to original path.
+func (reconciliation *PathReconciliation) normalizeAll(source string, paths []string) (map[string]string) {
+	normalizedPaths := make(map[string]string, len(paths))
+	for _, original := range paths {
+		normalized, applied := NormalizeBagPath(original)
+		if len(applied) > 0 {
+			reconciliation.Normalizations = append(reconciliation.Normalizations,
+				fmt.Sprintf("Normalized %s path '%s' to '%s' (%s)",
+					source, original, normalized, strings.Join(applied, ", ")))
+		}
+		if _, exists := normalizedPaths[normalized]; !exists {
+			normalizedPaths[normalized] = original
+		}
+	}
+	return normalizedPaths
+}
+
+// Returns true if any files appear in the tar file but not the
+// manifest, or vice versa.
+func (reconciliation *PathReconciliation) HasErrors() (bool) {
+	return len(reconciliation.NotInManifest) > 0 || len(reconciliation.NotInTar) > 0
+}
+
+// Returns a description of the unmatched files, or an empty
+// string if everything matched.
+func (reconciliation *PathReconciliation) ErrorMessage() (string) {
+	message := ""
+	if len(reconciliation.NotInManifest) > 0 {
+		message += fmt.Sprintf("The following files are in the tar file but "+
+			"not in the manifest: %s. ", strings.Join(reconciliation.NotInManifest, ", "))
+	}
+	if len(reconciliation.NotInTar) > 0 {
+		message += fmt.Sprintf("The following files are in the manifest but "+
+			"not in the tar file: %s. ", strings.Join(reconciliation.NotInTar, ", "))
+	}
+	return strings.TrimSpace(message)
+}
+
+// ReconcileTarAndManifest checks that every payload file we unpacked
+// from the tar file is listed in the bag's manifest, and that every
+// file in the manifest was in the tar file. Call this after ReadBag.
+// Normalizations are recorded in tarResult.Warnings. If any files
+// don't match, this returns an error listing them.
+func ReconcileTarAndManifest(tarResult *TarResult, bagReadResult *BagReadResult) (error) {
+	payloadPaths := make([]string, 0, len(tarResult.Files))
+	for _, filePath := range tarResult.FilePaths() {
+		// Tag files are not in the payload manifest.
+		normalized, _ := NormalizeBagPath(filePath)
+		if IsPayloadPath(normalized) {
+			payloadPaths = append(payloadPaths, filePath)
+		}
+	}
+	reconciliation := ReconcilePaths(payloadPaths, bagReadResult.ManifestPaths())
+	tarResult.Warnings = append(tarResult.Warnings, reconciliation.Normalizations...)
+	if reconciliation.HasErrors() {
+		return errors.New(reconciliation.ErrorMessage())
+	}
+	return nil
+}
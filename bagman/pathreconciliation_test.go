@@ -0,0 +1,115 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+)
+
+// "café.txt" with é as a single code point, and as "e" followed
+// by a combining acute accent.
+const composedName = "data/café.txt"
+const decomposedName = "data/café.txt"
+
+func TestNormalizeBagPath(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+		applied  int
+	}{
+		{"data/file1.txt", "data/file1.txt", 0},
+		{"data\\subdir\\file1.txt", "data/subdir/file1.txt", 1},
+		{"./data/file1.txt", "data/file1.txt", 1},
+		{"././data/file1.txt", "data/file1.txt", 1},
+		{".\\data\\file1.txt", "data/file1.txt", 2},
+		{composedName, composedName, 0},
+		{decomposedName, composedName, 1},
+	}
+	for _, testCase := range testCases {
+		normalized, applied := bagman.NormalizeBagPath(testCase.input)
+		if normalized != testCase.expected {
+			t.Errorf("NormalizeBagPath(%q): expected %q, got %q",
+				testCase.input, testCase.expected, normalized)
+		}
+		if len(applied) != testCase.applied {
+			t.Errorf("NormalizeBagPath(%q): expected %d normalizations, got %v",
+				testCase.input, testCase.applied, applied)
+		}
+	}
+}
+
+func TestReconcilePathsAllMatch(t *testing.T) {
+	tarPaths := []string{"data/file1.txt", "data/subdir/file2.txt", composedName}
+	manifestPaths := []string{"./data/file1.txt", "data\\subdir\\file2.txt", decomposedName}
+	reconciliation := bagman.ReconcilePaths(tarPaths, manifestPaths)
+	if reconciliation.HasErrors() {
+		t.Errorf("Expected all paths to match, but got: %s", reconciliation.ErrorMessage())
+	}
+	if len(reconciliation.Normalizations) != 3 {
+		t.Errorf("Expected 3 normalizations, got %v", reconciliation.Normalizations)
+	}
+	for _, note := range reconciliation.Normalizations {
+		if !strings.HasPrefix(note, "Normalized manifest path") {
+			t.Errorf("Unexpected normalization note: %s", note)
+		}
+	}
+}
+
+func TestReconcilePathsMismatch(t *testing.T) {
+	tarPaths := []string{"data/file1.txt", "data/not_in_manifest.txt"}
+	manifestPaths := []string{"data\\file1.txt", "data\\not_in_tar.txt"}
+	reconciliation := bagman.ReconcilePaths(tarPaths, manifestPaths)
+	if !reconciliation.HasErrors() {
+		t.Errorf("Expected unmatched paths")
+		return
+	}
+	if len(reconciliation.NotInManifest) != 1 ||
+		reconciliation.NotInManifest[0] != "data/not_in_manifest.txt" {
+		t.Errorf("NotInManifest should be [data/not_in_manifest.txt], got %v",
+			reconciliation.NotInManifest)
+	}
+	// Unmatched manifest paths are reported as they appear
+	// in the manifest, not in normalized form.
+	if len(reconciliation.NotInTar) != 1 ||
+		reconciliation.NotInTar[0] != "data\\not_in_tar.txt" {
+		t.Errorf("NotInTar should be [data\\not_in_tar.txt], got %v",
+			reconciliation.NotInTar)
+	}
+	message := reconciliation.ErrorMessage()
+	if !strings.Contains(message, "data/not_in_manifest.txt") ||
+		!strings.Contains(message, "data\\not_in_tar.txt") {
+		t.Errorf("Error message is missing unmatched paths: %s", message)
+	}
+}
+
+func TestReconcileTarAndManifest(t *testing.T) {
+	tarResult := &bagman.TarResult{
+		Warnings: make([]string, 0),
+		Files: []*bagman.File{
+			&bagman.File{Path: "aptrust-info.txt"},
+			&bagman.File{Path: "data/file1.txt"},
+			&bagman.File{Path: decomposedName},
+		},
+	}
+	bagReadResult := &bagman.BagReadResult{
+		ManifestFiles: map[string]string{
+			"data/file1.txt": "8d777f385d3dfec8815d20f7496026dc",
+			composedName:     "c4ca4238a0b923820dcc509a6f75849b",
+		},
+	}
+	err := bagman.ReconcileTarAndManifest(tarResult, bagReadResult)
+	if err != nil {
+		t.Errorf("ReconcileTarAndManifest returned unexpected error: %v", err)
+	}
+	if len(tarResult.Warnings) != 1 ||
+		!strings.Contains(tarResult.Warnings[0], "unicode NFC") {
+		t.Errorf("Expected NFC normalization in TarResult.Warnings, got %v",
+			tarResult.Warnings)
+	}
+
+	delete(bagReadResult.ManifestFiles, composedName)
+	err = bagman.ReconcileTarAndManifest(tarResult, bagReadResult)
+	if err == nil || !strings.Contains(err.Error(), decomposedName) {
+		t.Errorf("Expected error naming %s, got %v", decomposedName, err)
+	}
+}
@@ -0,0 +1,103 @@
+package bagman
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ParsePayloadOxum parses the value of the Payload-Oxum tag from
+// bag-info.txt. The BagIt spec says the value should be in the
+// format "OctetCount.StreamCount", where OctetCount is the total
+// number of bytes in the payload and StreamCount is the number of
+// payload files. For example, "279164409.1198". Returns an error
+// if the value is empty or malformed.
+func ParsePayloadOxum(value string) (byteCount int64, fileCount int64, err error) {
+	cleanValue := strings.TrimSpace(value)
+	parts := strings.Split(cleanValue, ".")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Payload-Oxum '%s' is not in the format "+
+			"OctetCount.StreamCount", value)
+	}
+	byteCount, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || byteCount < 0 {
+		return 0, 0, fmt.Errorf("Payload-Oxum '%s' has an invalid byte count", value)
+	}
+	fileCount, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || fileCount < 0 {
+		return 0, 0, fmt.Errorf("Payload-Oxum '%s' has an invalid file count", value)
+	}
+	return byteCount, fileCount, nil
+}
+
+// PayloadByteAndFileCount walks the data directory of the bag at
+// bagPath and returns the total number of bytes and the number of
+// files in the payload. This does not read any file contents, so
+// it's cheap even for very large bags.
+func PayloadByteAndFileCount(bagPath string) (byteCount int64, fileCount int64, err error) {
+	dataDir := filepath.Join(bagPath, "data")
+	err = filepath.Walk(dataDir, func(filePath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.Mode().IsRegular() {
+			byteCount += f.Size()
+			fileCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Cannot count payload files in '%s': %v", dataDir, err)
+	}
+	return byteCount, fileCount, nil
+}
+
+// CheckPayloadOxum compares the Payload-Oxum value from the bag's
+// bag-info.txt file against the actual number of bytes and files in
+// the bag's data directory. We do this before running checksums,
+// so that we don't spend hours checksumming a very large bag only
+// to find out at the end that it's missing a file.
+//
+// Param oxum is the raw value of the Payload-Oxum tag. If it's empty
+// or malformed, this skips the check and returns a warning. If the
+// payload does not match the oxum, this returns an error describing
+// what we expected and what we found.
+func CheckPayloadOxum(bagPath, oxum string) (warning string, err error) {
+	if strings.TrimSpace(oxum) == "" {
+		return "Bag has no Payload-Oxum in bag-info.txt. Skipping payload " +
+			"byte and file count check.", nil
+	}
+	expectedBytes, expectedFiles, err := ParsePayloadOxum(oxum)
+	if err != nil {
+		return fmt.Sprintf("%s. Skipping payload byte and file count check.",
+			err.Error()), nil
+	}
+	actualBytes, actualFiles, err := PayloadByteAndFileCount(bagPath)
+	if err != nil {
+		return "", err
+	}
+	if actualBytes != expectedBytes || actualFiles != expectedFiles {
+		return "", fmt.Errorf("Payload does not match Payload-Oxum: "+
+			"expected %s files / %s bytes; found %s / %s",
+			formatWithCommas(expectedFiles), formatWithCommas(expectedBytes),
+			formatWithCommas(actualFiles), formatWithCommas(actualBytes))
+	}
+	return "", nil
+}
+
+// Formats an integer with commas separating the thousands,
+// so 87123456789 becomes "87,123,456,789".
+func formatWithCommas(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign = "-"
+		digits = digits[1:]
+	}
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return sign + digits
+}
@@ -0,0 +1,121 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates a bag directory with a data dir containing files
+// of the specified sizes, and a bag-info.txt file containing
+// the specified Payload-Oxum. If oxum is empty, the bag-info
+// file will have no Payload-Oxum tag. Caller should delete the
+// returned directory when done.
+func makeOxumFixture(t *testing.T, oxum string, fileSizes ...int) string {
+	bagPath, err := ioutil.TempDir("", "oxum_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := filepath.Join(bagPath, "data", "subdir")
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, size := range fileSizes {
+		fileName := filepath.Join(dataDir, string('a'+rune(i))+".txt")
+		err := ioutil.WriteFile(fileName, []byte(strings.Repeat("x", size)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bagInfo := "Source-Organization: example.edu\n"
+	if oxum != "" {
+		bagInfo += "Payload-Oxum: " + oxum + "\n"
+	}
+	err = ioutil.WriteFile(filepath.Join(bagPath, "bag-info.txt"), []byte(bagInfo), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bagPath
+}
+
+func TestParsePayloadOxum(t *testing.T) {
+	byteCount, fileCount, err := bagman.ParsePayloadOxum(" 279164409.1198 ")
+	if err != nil {
+		t.Error(err)
+	}
+	if byteCount != 279164409 {
+		t.Errorf("Expected byte count 279164409, got %d", byteCount)
+	}
+	if fileCount != 1198 {
+		t.Errorf("Expected file count 1198, got %d", fileCount)
+	}
+	for _, badValue := range []string{"", "1234", "12.34.56", "abc.12", "12.abc", "-1.2", "1.-2", "."} {
+		_, _, err = bagman.ParsePayloadOxum(badValue)
+		if err == nil {
+			t.Errorf("ParsePayloadOxum should have rejected '%s'", badValue)
+		}
+	}
+}
+
+func TestPayloadByteAndFileCount(t *testing.T) {
+	bagPath := makeOxumFixture(t, "", 10, 20, 30)
+	defer os.RemoveAll(bagPath)
+	byteCount, fileCount, err := bagman.PayloadByteAndFileCount(bagPath)
+	if err != nil {
+		t.Error(err)
+	}
+	if byteCount != 60 {
+		t.Errorf("Expected 60 bytes, got %d", byteCount)
+	}
+	if fileCount != 3 {
+		t.Errorf("Expected 3 files, got %d", fileCount)
+	}
+}
+
+func TestCheckPayloadOxumMatching(t *testing.T) {
+	bagPath := makeOxumFixture(t, "60.3", 10, 20, 30)
+	defer os.RemoveAll(bagPath)
+	warning, err := bagman.CheckPayloadOxum(bagPath, "60.3")
+	if err != nil {
+		t.Errorf("CheckPayloadOxum returned unexpected error: %v", err)
+	}
+	if warning != "" {
+		t.Errorf("CheckPayloadOxum returned unexpected warning: %s", warning)
+	}
+}
+
+func TestCheckPayloadOxumMismatch(t *testing.T) {
+	bagPath := makeOxumFixture(t, "87123456789.10234", 10, 20, 30)
+	defer os.RemoveAll(bagPath)
+	_, err := bagman.CheckPayloadOxum(bagPath, "87123456789.10234")
+	if err == nil {
+		t.Errorf("CheckPayloadOxum should have returned an error")
+		return
+	}
+	expected := "expected 10,234 files / 87,123,456,789 bytes; found 3 / 60"
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("Error message '%s' does not contain '%s'", err.Error(), expected)
+	}
+}
+
+func TestCheckPayloadOxumAbsentOrMalformed(t *testing.T) {
+	bagPath := makeOxumFixture(t, "", 10)
+	defer os.RemoveAll(bagPath)
+	warning, err := bagman.CheckPayloadOxum(bagPath, "")
+	if err != nil {
+		t.Errorf("Missing oxum should not cause an error, but got %v", err)
+	}
+	if !strings.Contains(warning, "no Payload-Oxum") {
+		t.Errorf("Expected missing oxum warning, got '%s'", warning)
+	}
+	warning, err = bagman.CheckPayloadOxum(bagPath, "ten.one")
+	if err != nil {
+		t.Errorf("Malformed oxum should not cause an error, but got %v", err)
+	}
+	if !strings.Contains(warning, "Skipping payload") {
+		t.Errorf("Expected malformed oxum warning, got '%s'", warning)
+	}
+}
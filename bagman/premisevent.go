@@ -1,6 +1,7 @@
 package bagman
 
 import (
+	"encoding/json"
 	"strings"
 	"time"
 )
@@ -59,3 +60,43 @@ func (premisEvent *PremisEvent) EventTypeValid() bool {
 	}
 	return false
 }
+
+// MarshalJSON writes DateTime in UTC, so Fluctus always gets the
+// same string for the same moment.
+func (premisEvent *PremisEvent) MarshalJSON() ([]byte, error) {
+	type premisEventJson PremisEvent // without this method
+	event := premisEventJson(*premisEvent)
+	event.DateTime = event.DateTime.UTC()
+	return json.Marshal(event)
+}
+
+// Returns the events in events that don't match any event in
+// existing, and don't repeat an earlier event in events. Events
+// match if they have the same target, type and outcome detail.
+// Param target is the identifier of the object or file both lists
+// of events belong to.
+func mergeEvents(target string, events, existing []*PremisEvent) ([]*PremisEvent) {
+	seen := make(map[string]bool, len(existing) + len(events))
+	for _, event := range existing {
+		if event != nil {
+			seen[premisEventKey(target, event)] = true
+		}
+	}
+	merged := make([]*PremisEvent, 0, len(events))
+	for _, event := range events {
+		if event == nil {
+			continue
+		}
+		key := premisEventKey(target, event)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, event)
+	}
+	return merged
+}
+
+func premisEventKey(target string, event *PremisEvent) (string) {
+	return strings.Join([]string{target, strings.ToLower(event.EventType), event.OutcomeDetail}, "\x00")
+}
@@ -0,0 +1,126 @@
+package bagman
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FileEventNames lists the PREMIS events we can generate for each
+// GenericFile at ingest, in the order we generate them. These are
+// config names, not event types: identifier_assignment is the
+// friendly institution.edu/bag/path identifier (and the rename
+// event, when a file replaces an earlier version), while
+// identifier_assignment_url is the storage URL. Both have the
+// event type identifier_assignment.
+var FileEventNames = []string{
+	"fixity_check",
+	"ingest",
+	"fixity_generation",
+	"identifier_assignment",
+	"identifier_assignment_url",
+}
+
+// ObjectEventNames lists the PREMIS events we can generate for
+// each IntellectualObject at ingest.
+var ObjectEventNames = []string{
+	"ingest",
+	"identifier_assignment",
+}
+
+// StrictFileEvents and StrictObjectEvents are the events APTrust
+// production needs. PremisEventConfig.Validate rejects configs
+// that leave any of these out when Strict is on.
+var StrictFileEvents = []string{"ingest", "fixity_generation", "identifier_assignment"}
+var StrictObjectEvents = []string{"ingest", "identifier_assignment"}
+
+// PremisEventConfig describes which PREMIS events ingest generates.
+// Smaller deployments may not want every event. The storage URL
+// identifier_assignment, for example, doubles the number of
+// identifier events in Fedora.
+type PremisEventConfig struct {
+	// FileEvents lists the events to generate for each file,
+	// from FileEventNames. If this is empty, we generate all
+	// of them.
+	FileEvents   []string
+
+	// ObjectEvents lists the events to generate for each object,
+	// from ObjectEventNames. If this is empty, we generate all
+	// of them.
+	ObjectEvents []string
+
+	// Strict means FileEvents and ObjectEvents must include
+	// StrictFileEvents and StrictObjectEvents. This should be
+	// true for APTrust's own deployments.
+	Strict       bool
+}
+
+// GeneratedPremisEvents is the event config for everything in a
+// process. File.PremisEvents and apt_record consult it. The
+// default generates every event. NewProcessUtil replaces it with
+// the PremisEvents section of the config.
+var GeneratedPremisEvents = &PremisEventConfig{}
+
+// Validate returns an error if the config lists events we don't
+// know how to generate, or if Strict is on and the config leaves
+// out an event APTrust production requires.
+func (eventConfig *PremisEventConfig) Validate() (error) {
+	errors := make([]string, 0)
+	for _, name := range eventConfig.FileEvents {
+		if !stringInList(name, FileEventNames) {
+			errors = append(errors, fmt.Sprintf("'%s' is not a valid file event. "+
+				"Valid file events are %s.", name, strings.Join(FileEventNames, ", ")))
+		}
+	}
+	for _, name := range eventConfig.ObjectEvents {
+		if !stringInList(name, ObjectEventNames) {
+			errors = append(errors, fmt.Sprintf("'%s' is not a valid object event. "+
+				"Valid object events are %s.", name, strings.Join(ObjectEventNames, ", ")))
+		}
+	}
+	if eventConfig.Strict {
+		for _, name := range StrictFileEvents {
+			if !eventConfig.GeneratesFileEvent(name) {
+				errors = append(errors, fmt.Sprintf(
+					"File event '%s' cannot be disabled in strict mode.", name))
+			}
+		}
+		for _, name := range StrictObjectEvents {
+			if !eventConfig.GeneratesObjectEvent(name) {
+				errors = append(errors, fmt.Sprintf(
+					"Object event '%s' cannot be disabled in strict mode.", name))
+			}
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("Invalid PremisEvents config: %s", strings.Join(errors, " "))
+	}
+	return nil
+}
+
+// FileEventList returns the names of the file events we generate.
+// A nil config generates all of them.
+func (eventConfig *PremisEventConfig) FileEventList() ([]string) {
+	if eventConfig == nil || len(eventConfig.FileEvents) == 0 {
+		return FileEventNames
+	}
+	return eventConfig.FileEvents
+}
+
+// ObjectEventList returns the names of the object events we
+// generate. A nil config generates all of them.
+func (eventConfig *PremisEventConfig) ObjectEventList() ([]string) {
+	if eventConfig == nil || len(eventConfig.ObjectEvents) == 0 {
+		return ObjectEventNames
+	}
+	return eventConfig.ObjectEvents
+}
+
+// Returns true if we generate the named file event.
+func (eventConfig *PremisEventConfig) GeneratesFileEvent(name string) (bool) {
+	return stringInList(name, eventConfig.FileEventList())
+}
+
+// Returns true if we generate the named object event.
+func (eventConfig *PremisEventConfig) GeneratesObjectEvent(name string) (bool) {
+	return stringInList(name, eventConfig.ObjectEventList())
+}
@@ -3,7 +3,6 @@ package bagman
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/nsqio/go-nsq"
 	"github.com/op/go-logging"
 	"os"
 	"strings"
@@ -20,16 +19,46 @@ untarred, checksums were bad, or data files were missing.
 If processing succeeded, Retry is irrelevant.
 */
 type ProcessResult struct {
-	NsqMessage    *nsq.Message `json:"-"` // Don't serialize
-	S3File        *S3File
-	ErrorMessage  string
-	FetchResult   *FetchResult
-	TarResult     *TarResult
-	BagReadResult *BagReadResult
-	FedoraResult  *FedoraResult
-	BagDeletedAt  time.Time
-	Stage         StageType
-	Retry         bool
+	NsqMessage        Message      `json:"-"` // Don't serialize
+	S3File            *S3File
+	ErrorMessage      string
+	FetchResult       *FetchResult
+	TarResult         *TarResult
+	BagReadResult     *BagReadResult
+	FedoraResult      *FedoraResult
+	BagDeletedAt      time.Time
+	Stage             StageType
+	Retry             bool
+	// The stack trace of a panic that interrupted processing,
+	// so it shows up in the JSON log. Empty if there was none.
+	PanicStack        string       `json:",omitempty"`
+	// The number and total size of the files unpacked from the
+	// bag that we're going to store, not counting skipped junk
+	// files. The store and record stages check that they account
+	// for all of them. See RecordUnpackedFiles.
+	UnpackedFileCount int          `json:",omitempty"`
+	UnpackedByteCount int64        `json:",omitempty"`
+	// The stages this bag has made it through, in order. Each
+	// stage is added when it finishes without error. It travels
+	// with the result from worker to worker, so integration tests
+	// can check that a bag went through the whole pipeline. See
+	// AssertAllStagesCompleted.
+	StagesCompleted   []StageType  `json:",omitempty"`
+	// ReingestNoOp is true if this bag is a re-upload of an object
+	// we already have, and none of its files changed. The store and
+	// record stages skip such bags, so they don't get new copies or
+	// spurious events. See DetectReingestNoOp.
+	ReingestNoOp      bool         `json:",omitempty"`
+	// The id of this bag's ProcessedItem record in Fluctus. The
+	// prepare worker registers the record before it fetches the
+	// bag, and all later status updates go to this record. See
+	// IngestHelper.ConfirmProcessedItem.
+	ProcessedItemId   int          `json:",omitempty"`
+	// Cancelled is true if we stopped working on this bag because
+	// the depositor replaced it with a new upload before we could
+	// fetch it. The new upload has its own work item. ErrorMessage
+	// says what happened.
+	Cancelled         bool         `json:",omitempty"`
 }
 
 // IntellectualObject returns an instance of IntellectualObject
@@ -41,15 +70,11 @@ func (result *ProcessResult) IntellectualObject() (obj *IntellectualObject, err
 	if accessRights == "" {
 		accessRights = result.BagReadResult.TagValue("Rights")
 	}
-	// Fluctus wants access to be all lower-case
-	accessRights = strings.ToLower(accessRights)
-	// We probably should not do this correction, but we
-	// need to get through test runs with the bad data
-	// out partners submitted.
-	if accessRights == "consortial" {
-		accessRights = "consortia"
-	} else if accessRights == "institutional" {
-		accessRights = "institution"
+	// Fluctus wants the canonical, lower-case value. Validation
+	// has already rejected bags with unknown values.
+	accessRights, _, err = NormalizeAccess(accessRights)
+	if err != nil {
+		return nil, err
 	}
 	institution := &Institution{
 		BriefName: OwnerOf(result.S3File.BucketName),
@@ -62,21 +87,81 @@ func (result *ProcessResult) IntellectualObject() (obj *IntellectualObject, err
 	if err != nil {
 		return nil, err
 	}
+	// Title belongs in aptrust-info.txt, but some partners
+	// put it only in bag-info.txt.
+	title := result.BagReadResult.TagValueFromFile("Title", "aptrust-info.txt")
+	if title == "" {
+		title = result.BagReadResult.TagValueFromFile("Title", "bag-info.txt")
+	}
+	if title == "" {
+		// Results saved before tags recorded their source file.
+		title = result.BagReadResult.TagValue("Title")
+	}
 	obj = &IntellectualObject{
 		InstitutionId: institution.BriefName,
-		Title:         result.BagReadResult.TagValue("Title"),
+		Title:         title,
 		Description:   result.BagReadResult.TagValue("Internal-Sender-Description"),
 		Identifier:    identifier,
 		Access:        accessRights,
 		GenericFiles:  files,
 	}
-	altId := result.BagReadResult.TagValue("Internal-Sender-Identifier")
-	if altId != "" {
-		obj.AltIdentifier = []string { altId }
+	altIds := result.BagReadResult.AltIdentifiers()
+	if len(altIds) > 0 {
+		obj.AltIdentifier = altIds
 	}
 	return obj, nil
 }
 
+// RecordPanic records a panic in one of the processing stages
+// as an error. The panic may have been caused by a bug or by bad
+// data, but we can't tell which, so we let the item be retried
+// until it reaches the worker's maximum number of attempts.
+func (result *ProcessResult) RecordPanic(stagePanic *StagePanic) {
+	result.ErrorMessage += stagePanic.Error()
+	result.PanicStack = stagePanic.Stack
+	result.Retry = true
+}
+
+// EnterStage sets the result's Stage. If config.StageMsgTimeout has
+// a timeout for that stage, this asks NSQ to give us that long to
+// finish the stage before redelivering the message.
+func (result *ProcessResult) EnterStage(stage StageType, config *Config) {
+	result.Stage = stage
+	timeout := config.StageMsgTimeout[stage]
+	if timeout > 0 && result.NsqMessage != nil {
+		result.NsqMessage.ExtendTimeout(timeout)
+	}
+}
+
+// CompleteStage records that the bag finished stage without error.
+// Call it at the end of each stage. Completing a stage twice, as
+// when an item is retried, records it once.
+func (result *ProcessResult) CompleteStage(stage StageType) {
+	if !result.StageCompleted(stage) {
+		result.StagesCompleted = append(result.StagesCompleted, stage)
+	}
+}
+
+// StageCompleted returns true if the bag finished stage without error.
+func (result *ProcessResult) StageCompleted(stage StageType) (bool) {
+	for _, completed := range result.StagesCompleted {
+		if completed == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectReingestNoOp sets ReingestNoOp if every file in the bag
+// already exists and is unchanged. Call it after
+// TarResult.MergeExistingFiles. Returns the new value of ReingestNoOp.
+func (result *ProcessResult) DetectReingestNoOp() (bool) {
+	result.ReingestNoOp = result.TarResult != nil &&
+		len(result.TarResult.Files) > 0 &&
+		!result.TarResult.AnyFilesNeedSaving()
+	return result.ReingestNoOp
+}
+
 // GenericFiles returns a list of GenericFile objects that were found
 // in the bag.
 func (result *ProcessResult) GenericFiles() (files []*GenericFile, err error) {
@@ -99,10 +184,11 @@ func (result *ProcessResult) GenericFiles() (files []*GenericFile, err error) {
 // TODO: Refactor. We should have to pass in a logger. <Sigh>
 func (result *ProcessResult) IngestStatus(logger *logging.Logger) (status *ProcessStatus) {
 	status = &ProcessStatus{}
-	status.Date = time.Now().UTC()
+	status.Id = result.ProcessedItemId
+	status.Date = NowUTC()
 	status.Action = ActionIngest
 	status.Name = result.S3File.Key.Key
-	bagDate, _ := time.Parse(S3DateFormat, result.S3File.Key.LastModified)
+	bagDate, _ := ParseS3Time(result.S3File.Key.LastModified)
 	status.BagDate = bagDate
 	status.Bucket = result.S3File.BucketName
 	// Strip the quotes off the ETag
@@ -124,8 +210,18 @@ func (result *ProcessResult) IngestStatus(logger *logging.Logger) (status *Proce
 			// Fluctus.
 			status.Status = StatusFailed
 		}
+		if result.Cancelled {
+			status.Status = StatusCancelled
+			status.Retry = false
+		}
 	} else {
 		status.Note = "No problems"
+		if result.ReingestNoOp {
+			status.Note = "No files changed since the last ingest, so nothing was stored or recorded"
+		} else if result.TarResult != nil && result.TarResult.UnchangedFileCount > 0 {
+			status.Note = fmt.Sprintf("No problems. Skipped %d file(s) unchanged since the last ingest",
+				result.TarResult.UnchangedFileCount)
+		}
 		if result.Stage == "Cleanup" {
 			status.Status = StatusSuccess
 		}
@@ -134,9 +230,16 @@ func (result *ProcessResult) IngestStatus(logger *logging.Logger) (status *Proce
 		status.Retry = false
 	}
 	status.Institution = OwnerOf(result.S3File.BucketName)
-	status.Outcome = string(status.Status)
+	status.InstitutionName = InstitutionNameLookup(status.Institution)
+	status.Outcome = OutcomeForStatus(status.Status)
+	if status.Status == StatusFailed && result.TarResult != nil &&
+		result.TarResult.AnyFilesCopiedToPreservation() &&
+		!result.TarResult.AllFilesCopiedToPreservation() {
+		status.Outcome = OutcomePartialSuccess
+		status.OutcomeDetails = "Some files were copied to preservation storage, and some were not."
+	}
 
-	jsonBytes, err := json.Marshal(result)
+	jsonBytes, err := versionedState(result)
 	if err != nil {
 		// This should never happen, but if it does,
 		// log it and put a visible note in the Web UI,
@@ -157,3 +260,57 @@ func (result *ProcessResult) IngestStatus(logger *logging.Logger) (status *Proce
 
 	return status
 }
+
+// CompactProcessResult is the part of a ProcessResult we need to
+// process a bag again. It leaves out the fetch, tar, bag read and
+// Fedora results, which can run to megabytes for bags with many
+// files, so it makes a much smaller NSQ message.
+type CompactProcessResult struct {
+	S3File       *S3File
+	Stage        StageType
+	Retry        bool
+	ErrorMessage string    `json:",omitempty"`
+	// The number of times the result's message had been delivered
+	// when we compacted it. Zero if the result had no message.
+	Attempts     uint16    `json:",omitempty"`
+}
+
+// MarshalCompact returns the JSON of this result's CompactProcessResult.
+// Use UnmarshalCompact to read it.
+func (result *ProcessResult) MarshalCompact() ([]byte, error) {
+	compact := &CompactProcessResult{
+		S3File: result.S3File,
+		Stage: result.Stage,
+		Retry: result.Retry,
+		ErrorMessage: result.ErrorMessage,
+	}
+	if result.NsqMessage != nil {
+		compact.Attempts = result.NsqMessage.Attempts()
+	}
+	return json.Marshal(compact)
+}
+
+// UnmarshalCompact reads the JSON that MarshalCompact produces.
+// It returns an error if the JSON does not identify an S3 file.
+func UnmarshalCompact(data []byte) (*CompactProcessResult, error) {
+	compact := &CompactProcessResult{}
+	if err := json.Unmarshal(data, compact); err != nil {
+		return nil, fmt.Errorf("Cannot parse compact result: %v", err)
+	}
+	if compact.S3File == nil || compact.S3File.BucketName == "" || compact.S3File.Key.Key == "" {
+		return nil, fmt.Errorf("Compact result does not identify an S3 file")
+	}
+	return compact, nil
+}
+
+// ProcessResult returns a ProcessResult with the compact result's
+// fields. Its other results are nil, so a worker has to fetch
+// the bag again to process it.
+func (compact *CompactProcessResult) ProcessResult() (*ProcessResult) {
+	return &ProcessResult{
+		S3File: compact.S3File,
+		Stage: compact.Stage,
+		Retry: compact.Retry,
+		ErrorMessage: compact.ErrorMessage,
+	}
+}
@@ -1,10 +1,15 @@
 package bagman_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/crowdmob/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -64,6 +69,27 @@ func TestIngestStatus(t *testing.T) {
 	assertCorrectSummary(t, failedCleanup, bagman.StatusFailed)
 }
 
+func TestIngestStatusInstitutionName(t *testing.T) {
+	defaultLookup := bagman.InstitutionNameLookup
+	defer func() { bagman.InstitutionNameLookup = defaultLookup }()
+	bagman.InstitutionNameLookup = func(identifier string) (string) {
+		if identifier == "unc.edu" {
+			return "University of North Carolina"
+		}
+		return identifier
+	}
+	result := getResult("Fetch", true)
+	status := result.IngestStatus(bagman.DiscardLogger("processresult_test"))
+	if status.Institution != "unc.edu" {
+		t.Errorf("ProcessStatus.Institution: Expected unc.edu, got %s",
+			status.Institution)
+	}
+	if status.InstitutionName != "University of North Carolina" {
+		t.Errorf("ProcessStatus.InstitutionName: Expected University of North Carolina, got %s",
+			status.InstitutionName)
+	}
+}
+
 func assertCorrectSummary(t *testing.T, result *bagman.ProcessResult, expectedStatus bagman.StatusType) {
 	discardLogger := bagman.DiscardLogger("processresult_test")
 	status := result.IngestStatus(discardLogger)
@@ -104,6 +130,12 @@ func assertCorrectSummary(t *testing.T, result *bagman.ProcessResult, expectedSt
 			bagman.OwnerOf(result.S3File.BucketName),
 			status.Institution)
 	}
+	// The default lookup returns the identifier unchanged.
+	if status.InstitutionName != status.Institution {
+		t.Errorf("ProcessStatus.InstitutionName: Expected %s, got %s",
+			status.Institution,
+			status.InstitutionName)
+	}
 	if result.ErrorMessage == "" && status.Note != "No problems" {
 		t.Errorf("ProcessStatus.Note should be '%s', but it's '%s'.",
 			"No problems", status.Note)
@@ -122,6 +154,41 @@ func assertCorrectSummary(t *testing.T, result *bagman.ProcessResult, expectedSt
 			status.Status)
 		t.Errorf("This failure may be due to a temporary demo setting that considers Validation the final step.")
 	}
+	if status.Outcome != bagman.OutcomeForStatus(status.Status) {
+		t.Errorf("ProcessStatus.Outcome: Expected %s, got %s",
+			bagman.OutcomeForStatus(status.Status),
+			status.Outcome)
+	}
+}
+
+func TestIngestStatusPartialSuccess(t *testing.T) {
+	result := getResult("Store", false)
+	result.TarResult = &bagman.TarResult{
+		Files: []*bagman.File{
+			&bagman.File{NeedsSave: true, StorageURL: "https://s3.amazonaws.com/preservation/1"},
+			&bagman.File{NeedsSave: true},
+		},
+	}
+	status := result.IngestStatus(bagman.DiscardLogger("processresult_test"))
+	if status.Outcome != bagman.OutcomePartialSuccess {
+		t.Errorf("ProcessStatus.Outcome: Expected PartialSuccess, got %s", status.Outcome)
+	}
+	if status.OutcomeDetails == "" {
+		t.Errorf("ProcessStatus.OutcomeDetails should explain partial success")
+	}
+}
+
+func TestIngestStatusCancelled(t *testing.T) {
+	result := getResult("Fetch", false)
+	result.Retry = true
+	result.Cancelled = true
+	status := result.IngestStatus(bagman.DiscardLogger("processresult_test"))
+	if status.Status != bagman.StatusCancelled || status.Outcome != bagman.OutcomeCancelled {
+		t.Errorf("Expected Cancelled status and outcome, got %s and %s", status.Status, status.Outcome)
+	}
+	if status.Retry {
+		t.Errorf("Cancelled items should not be retried")
+	}
 }
 
 func TestIntellectualObject(t *testing.T) {
@@ -175,6 +242,69 @@ func TestIntellectualObject(t *testing.T) {
 	}
 }
 
+func TestIntellectualObjectTitleFallback(t *testing.T) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.BagReadResult.Tags = []bagman.Tag{
+		bagman.Tag{Label: "Title", Value: "Bag Info Title", SourceFile: "bag-info.txt"},
+		bagman.Tag{Label: "Access", Value: "Consortia", SourceFile: "aptrust-info.txt"},
+	}
+	obj, err := result.IntellectualObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Title != "Bag Info Title" {
+		t.Errorf("Title should fall back to bag-info.txt, got '%s'", obj.Title)
+	}
+
+	// aptrust-info.txt wins if both files have a title.
+	result.BagReadResult.Tags = append(result.BagReadResult.Tags,
+		bagman.Tag{Label: "Title", Value: "APTrust Title", SourceFile: "aptrust-info.txt"})
+	obj, err = result.IntellectualObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Title != "APTrust Title" {
+		t.Errorf("Title should come from aptrust-info.txt, got '%s'", obj.Title)
+	}
+}
+
+// Alternate identifiers come from every recognized tag in
+// bag-info.txt, not just the first Internal-Sender-Identifier.
+func TestIntellectualObjectAltIdentifiers(t *testing.T) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, _, err := bagman.ReadTagFile(filepath.Join(testDataPath, "tagfiles", "bag-info-alt-ids.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.BagReadResult.Tags = append(tags,
+		bagman.Tag{Label: "Title", Value: "Jefferson Letters", SourceFile: "aptrust-info.txt"},
+		bagman.Tag{Label: "Access", Value: "Consortia", SourceFile: "aptrust-info.txt"})
+	obj, err := result.IntellectualObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"uva-internal-id-0001", "doi:10.18130/V3QK5Z", "uva-catalog-b1234567"}
+	if !reflect.DeepEqual(obj.AltIdentifier, expected) {
+		t.Errorf("Expected AltIdentifier %v, got %v", expected, obj.AltIdentifier)
+	}
+
+	// No recognized tags, no alt identifiers.
+	result.BagReadResult.Tags = tags[0:4]
+	obj, err = result.IntellectualObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.AltIdentifier != nil {
+		t.Errorf("Expected no AltIdentifier, got %v", obj.AltIdentifier)
+	}
+}
+
 func TestGenericFiles(t *testing.T) {
 	filepath := filepath.Join("testdata", "result_good.json")
 	result, err := bagman.LoadResult(filepath)
@@ -386,3 +516,217 @@ func TestProcessResultPremisEvents(t *testing.T) {
 		}
 	}
 }
+
+func TestEnterStageRequestsStageTimeout(t *testing.T) {
+	requestedConfig := "test"
+	config := bagman.LoadRequestedConfig(&requestedConfig)
+	stages := []bagman.StageType{
+		bagman.StageFetch,
+		bagman.StageUnpack,
+		bagman.StageValidate,
+		bagman.StageStore,
+		bagman.StageRecord,
+		bagman.StageCleanup,
+	}
+	for _, stage := range stages {
+		expected, ok := config.StageMsgTimeout[stage]
+		if !ok || expected == 0 {
+			t.Errorf("Test config has no StageMsgTimeout for %s", stage)
+			continue
+		}
+		message := bagman.NewInMemoryMessage([]byte("test"))
+		result := baseResult()
+		result.NsqMessage = message
+		result.EnterStage(stage, &config)
+		if result.Stage != stage {
+			t.Errorf("EnterStage set Stage to %s, expected %s", result.Stage, stage)
+		}
+		if message.RequestedTimeout() != expected {
+			t.Errorf("Stage %s requested timeout %s, expected %s",
+				stage, message.RequestedTimeout(), expected)
+		}
+	}
+
+	// Stages with no configured timeout leave the message alone.
+	message := bagman.NewInMemoryMessage([]byte("test"))
+	result := baseResult()
+	result.NsqMessage = message
+	result.EnterStage(bagman.StageReceive, &config)
+	if message.RequestedTimeout() != 0 || message.Touches() != 0 {
+		t.Errorf("Stage with no timeout should not touch the message")
+	}
+}
+
+func TestStageTimeoutsUnmarshal(t *testing.T) {
+	config := bagman.Config{}
+	err := json.Unmarshal([]byte(`{"StageMsgTimeout": {"Fetch": "90m", "Record": "45s"}}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StageMsgTimeout[bagman.StageFetch] != 90 * time.Minute ||
+		config.StageMsgTimeout[bagman.StageRecord] != 45 * time.Second {
+		t.Errorf("Unexpected timeouts %v", config.StageMsgTimeout)
+	}
+	if config.StageMsgTimeout.Max() != 90 * time.Minute {
+		t.Errorf("Max should be 90m, got %s", config.StageMsgTimeout.Max())
+	}
+	err = json.Unmarshal([]byte(`{"StageMsgTimeout": {"Fetch": "ninety minutes"}}`), &config)
+	if err == nil || !strings.Contains(err.Error(), "StageMsgTimeout[Fetch]") {
+		t.Errorf("Expected an error naming the bad setting, got %v", err)
+	}
+}
+
+func TestMarshalCompact(t *testing.T) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Stage = bagman.StageStore
+	result.Retry = true
+	result.ErrorMessage = "Error copying file to S3"
+	result.NsqMessage = bagman.NewInMemoryMessage([]byte(""))
+
+	full, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactJson, err := result.MarshalCompact()
+	if err != nil {
+		t.Fatalf("MarshalCompact returned error %v", err)
+	}
+	if len(compactJson)*10 > len(full) {
+		t.Errorf("Compact JSON is %d bytes; expected less than a tenth of %d",
+			len(compactJson), len(full))
+	}
+
+	compact, err := bagman.UnmarshalCompact(compactJson)
+	if err != nil {
+		t.Fatalf("UnmarshalCompact returned error %v", err)
+	}
+	if compact.Attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d", compact.Attempts)
+	}
+	restored := compact.ProcessResult()
+	if !reflect.DeepEqual(restored.S3File, result.S3File) {
+		t.Errorf("S3File did not round trip: %+v", restored.S3File)
+	}
+	if restored.Stage != bagman.StageStore || !restored.Retry ||
+		restored.ErrorMessage != result.ErrorMessage {
+		t.Errorf("Stage, retry or error did not round trip: %s, %t, %s",
+			restored.Stage, restored.Retry, restored.ErrorMessage)
+	}
+	if restored.TarResult != nil || restored.BagReadResult != nil || restored.FetchResult != nil {
+		t.Errorf("Compact result should not carry the tar, bag read or fetch results")
+	}
+
+	for _, bad := range []string{`not json`, `{"Stage": "Fetch"}`, `{"S3File": {"BucketName": ""}}`} {
+		if _, err := bagman.UnmarshalCompact([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalCompact should reject %s", bad)
+		}
+	}
+}
+
+func TestEnqueueCompact(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+	result := baseResult()
+	result.TarResult = &bagman.TarResult{OutputDir: "/mnt/apt/data/sample"}
+	if err := bagman.EnqueueCompact(server.URL, "prepare_topic", result); err != nil {
+		t.Fatalf("EnqueueCompact returned error %v", err)
+	}
+	compact, err := bagman.UnmarshalCompact(body)
+	if err != nil {
+		t.Fatalf("Queued message is not a compact result: %v", err)
+	}
+	if compact.S3File.Key.Key != "sample.tar" || strings.Contains(string(body), "OutputDir") {
+		t.Errorf("Queued the wrong message: %s", string(body))
+	}
+}
+
+// Returns a Fluctus test server that has the object in
+// result_good.json, with files whose md5s are in md5s.
+func existingObjectServer(t *testing.T, result *bagman.ProcessResult, md5s []string) (*httptest.Server) {
+	obj := &bagman.IntellectualObject{Identifier: "ncsu.edu/ncsu.1840.16-2928"}
+	for i, file := range result.TarResult.Files {
+		obj.GenericFiles = append(obj.GenericFiles, &bagman.GenericFile{
+			Identifier: file.Identifier,
+			URI:        file.StorageURL,
+			ChecksumAttributes: []*bagman.ChecksumAttribute{
+				{Algorithm: "md5", DateTime: time.Now(), Digest: md5s[i]},
+			},
+		})
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+}
+
+func TestReingestNoOp(t *testing.T) {
+	filepath := filepath.Join("testdata", "result_good.json")
+	result, err := bagman.LoadResult(filepath)
+	if err != nil {
+		t.Fatalf("Error loading test data file '%s': %v", filepath, err)
+	}
+	md5s := make([]string, len(result.TarResult.Files))
+	for i, file := range result.TarResult.Files {
+		md5s[i] = file.Md5
+	}
+	server := existingObjectServer(t, result, md5s)
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("processresult_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The helper has no S3 client, so this fails if
+	// the store stage tries to store anything.
+	helper := &bagman.IngestHelper{
+		ProcUtil: &bagman.ProcessUtil{
+			FluctusClient: fluctusClient,
+			MessageLog:    bagman.DiscardLogger("processresult_test"),
+		},
+		Result: result,
+	}
+	if err = helper.SaveGenericFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if !result.ReingestNoOp {
+		t.Errorf("ReingestNoOp should be set when no files changed")
+	}
+	if !result.StageCompleted(bagman.StageStore) {
+		t.Errorf("Skipped store stage should be completed")
+	}
+	status := result.IngestStatus(bagman.DiscardLogger("processresult_test"))
+	if !strings.Contains(status.Note, "nothing was stored or recorded") {
+		t.Errorf("ProcessStatus note should say nothing changed, got '%s'", status.Note)
+	}
+
+	// One changed file means there's work to do.
+	result, _ = bagman.LoadResult(filepath)
+	md5s[2] = "00000000000000000000000000000000"
+	changedServer := existingObjectServer(t, result, md5s)
+	defer changedServer.Close()
+	helper.ProcUtil.FluctusClient, _ = bagman.NewFluctusClient(changedServer.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("processresult_test"))
+	helper.Result = result
+	if err = helper.MergeFedoraRecord(); err != nil {
+		t.Fatal(err)
+	}
+	if result.ReingestNoOp {
+		t.Errorf("ReingestNoOp should not be set when a file changed")
+	}
+
+	// A new object is not a reingest.
+	result, _ = bagman.LoadResult(filepath)
+	if result.DetectReingestNoOp() {
+		t.Errorf("ReingestNoOp should not be set for files that aren't in Fluctus")
+	}
+}
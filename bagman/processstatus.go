@@ -2,8 +2,10 @@ package bagman
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/op/go-logging"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -28,6 +30,12 @@ import (
 //
 // Status may have one of the following values: Pending,
 // Success, Failed.
+//
+// Outcome is one of the Outcome enumerations in common.go, and is
+// empty until processing completes. OutcomeDetails explains the
+// outcome in prose. Records that Fluctus created before we limited
+// Outcome to those values have Outcome "Legacy" and the original
+// value in LegacyOutcome. Set Outcome with SetOutcome.
 type ProcessStatus struct {
 	Id                     int        `json:"id"`
 	ObjectIdentifier       string     `json:"object_identifier"`
@@ -37,13 +45,16 @@ type ProcessStatus struct {
 	ETag                   string     `json:"etag"`
 	BagDate                time.Time  `json:"bag_date"`
 	Institution            string     `json:"institution"`
+	InstitutionName        string     `json:"institution_name"`
 	User                   string     `json:"user"`
 	Date                   time.Time  `json:"date"`
 	Note                   string     `json:"note"`
 	Action                 ActionType `json:"action"`
 	Stage                  StageType  `json:"stage"`
 	Status                 StatusType `json:"status"`
-	Outcome                string     `json:"outcome"`
+	Outcome                OutcomeType `json:"outcome"`
+	OutcomeDetails         string     `json:"outcome_details"`
+	LegacyOutcome          string     `json:"legacy_outcome,omitempty"`
 	Retry                  bool       `json:"retry"`
 	Reviewed               bool       `json:"reviewed"`
 	State                  string     `json:"state"`
@@ -52,23 +63,76 @@ type ProcessStatus struct {
 	NeedsAdminReview       bool       `json:"needs_admin_review"`
 }
 
+// InstitutionNameLookup returns the human-readable name of the
+// institution with the specified identifier (domain name), such
+// as "University of North Carolina" for "unc.edu". IngestStatus
+// uses it to fill in ProcessStatus.InstitutionName. The default
+// returns the identifier unchanged. Processes that know the names
+// of institutions can replace it.
+var InstitutionNameLookup = func(identifier string) (string) {
+	return identifier
+}
+
+// UnmarshalJSON puts outcomes that aren't in the Outcome enumerations
+// into the Legacy bucket, so we can still read old records from
+// Fluctus. It also converts BagDate and Date to UTC, since Fluctus
+// may return them with a zone offset.
+func (status *ProcessStatus) UnmarshalJSON(data []byte) (error) {
+	type processStatus ProcessStatus // without this method
+	err := json.Unmarshal(data, (*processStatus)(status))
+	if err != nil {
+		return err
+	}
+	if !status.Outcome.IsValid() {
+		status.LegacyOutcome = string(status.Outcome)
+		status.Outcome = OutcomeLegacy
+	}
+	status.BagDate = status.BagDate.UTC()
+	status.Date = status.Date.UTC()
+	return nil
+}
+
+// SetOutcome sets the Outcome and OutcomeDetails. It returns an
+// error and leaves the status unchanged if outcome is not one of
+// the Outcome enumerations. Our code does not set legacy outcomes.
+func (status *ProcessStatus) SetOutcome(outcome OutcomeType, details string) (error) {
+	if !outcome.IsValid() || outcome == OutcomeLegacy {
+		return fmt.Errorf("Invalid outcome '%s'", outcome)
+	}
+	status.Outcome = outcome
+	status.OutcomeDetails = details
+	return nil
+}
+
 // Convert ProcessStatus to JSON, omitting id, which Rails won't permit.
-// For internal use, json.Marshal() works fine.
+// For internal use, json.Marshal() works fine. Returns an error if
+// Outcome is not valid. Legacy outcomes go back to Fluctus unchanged.
+// Dates are always sent as RFC3339 in UTC.
 func (status *ProcessStatus) SerializeForFluctus() ([]byte, error) {
+	if !status.Outcome.IsValid() {
+		return nil, fmt.Errorf("ProcessStatus for %s has invalid outcome '%s'",
+			status.Name, status.Outcome)
+	}
+	outcome := string(status.Outcome)
+	if status.Outcome == OutcomeLegacy && status.LegacyOutcome != "" {
+		outcome = status.LegacyOutcome
+	}
 	return json.Marshal(map[string]interface{}{
 		"name":                    status.Name,
 		"bucket":                  status.Bucket,
 		"etag":                    status.ETag,
-		"bag_date":                status.BagDate,
+		"bag_date":                status.BagDate.UTC(),
 		"institution":             status.Institution,
+		"institution_name":        status.InstitutionName,
 		"object_identifier":       status.ObjectIdentifier,
 		"generic_file_identifier": status.GenericFileIdentifier,
-		"date":                    status.Date,
+		"date":                    status.Date.UTC(),
 		"note":                    status.Note,
 		"action":                  status.Action,
 		"stage":                   status.Stage,
 		"status":                  status.Status,
-		"outcome":                 status.Outcome,
+		"outcome":                 outcome,
+		"outcome_details":         status.OutcomeDetails,
 		"retry":                   status.Retry,
 		"reviewed":                status.Reviewed,
 		"state":                   status.State,
@@ -78,6 +142,49 @@ func (status *ProcessStatus) SerializeForFluctus() ([]byte, error) {
 	})
 }
 
+// SameProgressAs returns true if status and other have the same
+// stage, status and note. Since admins and the stale bag sweep change
+// the outcome, retry and review flags without changing the stage,
+// those must match too, as must the node and pid of the worker
+// that holds the item.
+func (status *ProcessStatus) SameProgressAs(other *ProcessStatus) (bool) {
+	return status.Diff(other) == ""
+}
+
+// Diff describes how other differs from status in the fields that
+// SameProgressAs compares, e.g. "Stage: Fetch -> Store; Retry: true
+// -> false". It returns an empty string if they're the same.
+func (status *ProcessStatus) Diff(other *ProcessStatus) (string) {
+	diffs := make([]string, 0)
+	if status.Stage != other.Stage {
+		diffs = append(diffs, fmt.Sprintf("Stage: %s -> %s", status.Stage, other.Stage))
+	}
+	if status.Status != other.Status {
+		diffs = append(diffs, fmt.Sprintf("Status: %s -> %s", status.Status, other.Status))
+	}
+	if status.Note != other.Note {
+		diffs = append(diffs, fmt.Sprintf("Note: %q -> %q", status.Note, other.Note))
+	}
+	if status.Retry != other.Retry {
+		diffs = append(diffs, fmt.Sprintf("Retry: %t -> %t", status.Retry, other.Retry))
+	}
+	if status.Outcome != other.Outcome {
+		diffs = append(diffs, fmt.Sprintf("Outcome: %s -> %s", status.Outcome, other.Outcome))
+	}
+	if status.Reviewed != other.Reviewed {
+		diffs = append(diffs, fmt.Sprintf("Reviewed: %t -> %t", status.Reviewed, other.Reviewed))
+	}
+	if status.NeedsAdminReview != other.NeedsAdminReview {
+		diffs = append(diffs, fmt.Sprintf("NeedsAdminReview: %t -> %t",
+			status.NeedsAdminReview, other.NeedsAdminReview))
+	}
+	if status.Node != other.Node || status.Pid != other.Pid {
+		diffs = append(diffs, fmt.Sprintf("Worker: %s/%d -> %s/%d",
+			status.Node, status.Pid, other.Node, other.Pid))
+	}
+	return strings.Join(diffs, "; ")
+}
+
 // Returns true if an object's files have been stored in S3 preservation bucket.
 func (status *ProcessStatus) HasBeenStored() (bool) {
 	if status.Action == ActionIngest {
@@ -139,7 +246,7 @@ func HasPendingIngestRequest(statusRecords []*ProcessStatus) (bool) {
 
 // Set state, node and pid on ProcessStatus.
 func (status *ProcessStatus) SetNodePidState(object interface{}, logger *logging.Logger) {
-	jsonBytes, err := json.Marshal(object)
+	jsonBytes, err := versionedState(object)
 	jsonData := ""
 	if err != nil {
 		if logger != nil {
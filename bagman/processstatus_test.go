@@ -1,8 +1,10 @@
 package bagman_test
 
 import (
+	"encoding/json"
 	"github.com/APTrust/bagman/bagman"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,12 +21,14 @@ func ProcessStatusSample() (*bagman.ProcessStatus) {
 		ETag: "12345",
 		BagDate: bagDate,
 		Institution: "ncsu.edu",
+		InstitutionName: "North Carolina State University",
 		Date: ingestDate,
 		Note: "so many!",
 		Action: "Ingest",
 		Stage: "Store",
 		Status: "Success",
-		Outcome: "happy day!",
+		Outcome: bagman.OutcomeSuccess,
+		OutcomeDetails: "happy day!",
 		Retry: true,
 		Reviewed: false,
 		Node: "",
@@ -40,7 +44,7 @@ func TestProcessStatusSerializeForFluctus(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	expected := "{\"action\":\"Ingest\",\"bag_date\":\"2014-07-02T12:00:00Z\",\"bucket\":\"aptrust.receiving.ncsu.edu\",\"date\":\"2014-09-10T12:00:00Z\",\"etag\":\"12345\",\"generic_file_identifier\":\"ncsu.edu/some_object/data/doc.pdf\",\"institution\":\"ncsu.edu\",\"name\":\"Sample Document\",\"needs_admin_review\":false,\"node\":\"\",\"note\":\"so many!\",\"object_identifier\":\"ncsu.edu/some_object\",\"outcome\":\"happy day!\",\"pid\":0,\"retry\":true,\"reviewed\":false,\"stage\":\"Store\",\"state\":\"\",\"status\":\"Success\"}"
+	expected := "{\"action\":\"Ingest\",\"bag_date\":\"2014-07-02T12:00:00Z\",\"bucket\":\"aptrust.receiving.ncsu.edu\",\"date\":\"2014-09-10T12:00:00Z\",\"etag\":\"12345\",\"generic_file_identifier\":\"ncsu.edu/some_object/data/doc.pdf\",\"institution\":\"ncsu.edu\",\"institution_name\":\"North Carolina State University\",\"name\":\"Sample Document\",\"needs_admin_review\":false,\"node\":\"\",\"note\":\"so many!\",\"object_identifier\":\"ncsu.edu/some_object\",\"outcome\":\"Success\",\"outcome_details\":\"happy day!\",\"pid\":0,\"retry\":true,\"reviewed\":false,\"stage\":\"Store\",\"state\":\"\",\"status\":\"Success\"}"
 
 	actual := string(bytes)
 	if actual != expected {
@@ -260,8 +264,106 @@ func TestSetNodePidState(t *testing.T) {
 	if ps.Pid != os.Getpid() {
 		t.Error("Expected Pid %d, got %d", os.Getpid(), ps.Pid)
 	}
-	expectedState := "{\"key\":\"value\"}"
+	expectedState := "{\"bagman_version\":\"bagman dev\",\"key\":\"value\"}"
 	if ps.State != expectedState {
 		t.Error("Expected State '%s', got '%s'", expectedState, ps.State)
 	}
 }
+
+func TestProcessStatusSetOutcome(t *testing.T) {
+	ps := ProcessStatusSample()
+	err := ps.SetOutcome(bagman.OutcomeSkipped, "Bag is too large")
+	if err != nil {
+		t.Errorf("SetOutcome returned unexpected error: %v", err)
+	}
+	if ps.Outcome != bagman.OutcomeSkipped || ps.OutcomeDetails != "Bag is too large" {
+		t.Errorf("SetOutcome did not set outcome: %s / %s", ps.Outcome, ps.OutcomeDetails)
+	}
+	for _, outcome := range []bagman.OutcomeType{"happy day!", bagman.OutcomeLegacy} {
+		err = ps.SetOutcome(outcome, "nope")
+		if err == nil {
+			t.Errorf("SetOutcome should reject outcome '%s'", outcome)
+		}
+		if ps.Outcome != bagman.OutcomeSkipped || ps.OutcomeDetails != "Bag is too large" {
+			t.Errorf("Rejected outcome '%s' should not change status", outcome)
+		}
+	}
+}
+
+func TestProcessStatusSerializeRejectsInvalidOutcome(t *testing.T) {
+	ps := ProcessStatusSample()
+	ps.Outcome = "O-diddly Kay!"
+	_, err := ps.SerializeForFluctus()
+	if err == nil {
+		t.Errorf("SerializeForFluctus should reject invalid outcome")
+	}
+}
+
+func TestProcessStatusLegacyOutcome(t *testing.T) {
+	data := []byte(`{"id": 12, "status": "Failed", "outcome": "la de da"}`)
+	ps := &bagman.ProcessStatus{}
+	err := json.Unmarshal(data, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.Id != 12 || ps.Status != bagman.StatusFailed {
+		t.Errorf("Unmarshal lost fields: %+v", ps)
+	}
+	if ps.Outcome != bagman.OutcomeLegacy || ps.LegacyOutcome != "la de da" {
+		t.Errorf("Expected legacy outcome 'la de da', got %s / %s",
+			ps.Outcome, ps.LegacyOutcome)
+	}
+	// Legacy values go back to Fluctus as they came.
+	bytes, err := ps.SerializeForFluctus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bytes), `"outcome":"la de da"`) {
+		t.Errorf("Legacy outcome was not preserved: %s", string(bytes))
+	}
+
+	// Valid outcomes are not legacy.
+	ps = &bagman.ProcessStatus{}
+	json.Unmarshal([]byte(`{"outcome": "PartialSuccess"}`), ps)
+	if ps.Outcome != bagman.OutcomePartialSuccess || ps.LegacyOutcome != "" {
+		t.Errorf("Expected PartialSuccess, got %s / %s", ps.Outcome, ps.LegacyOutcome)
+	}
+}
+
+func TestOutcomeForStatus(t *testing.T) {
+	expected := map[bagman.StatusType]bagman.OutcomeType{
+		bagman.StatusStarted:   "",
+		bagman.StatusPending:   "",
+		bagman.StatusSuccess:   bagman.OutcomeSuccess,
+		bagman.StatusFailed:    bagman.OutcomeFailure,
+		bagman.StatusCancelled: bagman.OutcomeCancelled,
+	}
+	for status, outcome := range expected {
+		if bagman.OutcomeForStatus(status) != outcome {
+			t.Errorf("OutcomeForStatus(%s) should be '%s', got '%s'",
+				status, outcome, bagman.OutcomeForStatus(status))
+		}
+	}
+}
+
+func TestProcessStatusDiff(t *testing.T) {
+	remote := &bagman.ProcessStatus{Stage: bagman.StageFetch, Status: bagman.StatusStarted,
+		Note: "Fetching", Retry: true, Node: "10.0.0.1", Pid: 100}
+	local := *remote
+	if diff := remote.Diff(&local); diff != "" || !remote.SameProgressAs(&local) {
+		t.Errorf("Identical statuses should have no diff, got %s", diff)
+	}
+	local.Stage = bagman.StageStore
+	local.Note = "Storing"
+	local.Retry = false
+	expected := `Stage: Fetch -> Store; Note: "Fetching" -> "Storing"; Retry: true -> false`
+	if diff := remote.Diff(&local); diff != expected {
+		t.Errorf("Expected diff %s, got %s", expected, diff)
+	}
+	local = *remote
+	local.Pid = 200
+	if diff := remote.Diff(&local); diff != "Worker: 10.0.0.1/100 -> 10.0.0.1/200" ||
+		remote.SameProgressAs(&local) {
+		t.Errorf("A different worker should show in the diff, got %s", diff)
+	}
+}
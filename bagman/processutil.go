@@ -8,7 +8,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
+	"path"
+	"sync"
 	"sync/atomic"
 )
 
@@ -24,11 +25,20 @@ type ProcessUtil struct {
 	JsonLog         *log.Logger
 	MessageLog      *logging.Logger
 	Volume          *Volume
+	// ExtractVolume tracks space in Config.ExtractDir(). It's the
+	// same as Volume, which tracks Config.DownloadDir(), unless
+	// the two directories differ.
+	ExtractVolume   *Volume
 	S3Client        *S3Client
 	FluctusClient   *FluctusClient
+	// Queue, if set, receives the items workers send on to other
+	// topics, instead of nsqd. See Enqueue.
+	Queue           Queue
 	syncMap         *SynchronizedMap
 	succeeded       int64
 	failed          int64
+	throughput      *ThroughputTracker
+	throughputMutex sync.Mutex
 }
 
 /*
@@ -55,6 +65,8 @@ func NewProcessUtil(requestedConfig *string, serviceGroup string) (procUtil *Pro
 	procUtil.ConfigName = *requestedConfig
 	procUtil.Config = LoadRequestedConfig(requestedConfig)
 	procUtil.initLogging()
+	procUtil.MessageLog.Info("Running %s", VersionString())
+	procUtil.initPremisEvents()
 	procUtil.initVolume(serviceGroup)
 	procUtil.initS3Client()
 	procUtil.initFluctusClient()
@@ -62,27 +74,65 @@ func NewProcessUtil(requestedConfig *string, serviceGroup string) (procUtil *Pro
 	return procUtil
 }
 
+// Enqueue sends object to the specified topic: to Queue, if it's
+// set, or else to nsqd at Config.NsqdHttpAddress.
+func (procUtil *ProcessUtil) Enqueue(topic string, object interface{}) error {
+	if procUtil.Queue != nil {
+		return procUtil.Queue.Enqueue(topic, object)
+	}
+	return Enqueue(procUtil.Config.NsqdHttpAddress, topic, object)
+}
+
 // Initializes the loggers.
 func (procUtil *ProcessUtil) initLogging() {
 	procUtil.MessageLog = InitLogger(procUtil.Config)
 	procUtil.JsonLog = InitJsonLogger(procUtil.Config)
 }
 
+// Makes the PremisEvents section of the config the event config
+// for this process. Exits if the section is invalid.
+func (procUtil *ProcessUtil) initPremisEvents() {
+	err := procUtil.Config.PremisEvents.Validate()
+	if err != nil {
+		message := fmt.Sprintf("Exiting. %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		procUtil.MessageLog.Fatal(message)
+	}
+	GeneratedPremisEvents = &procUtil.Config.PremisEvents
+}
+
 // Sets up a new Volume object to track estimated disk usage.
 func (procUtil *ProcessUtil) initVolume(serviceGroup string) {
 	// Assume services are for APTrust, unless DPN is specified.
 	// This is a late hack, as we wait for Exchange to replace Bagman.
-	dir := procUtil.Config.TarDirectory
+	dir := procUtil.Config.DownloadDir()
 	if serviceGroup == "dpn" {
 		dir = procUtil.Config.DPNStagingDirectory
 	}
+	procUtil.Volume = procUtil.newVolumeOrDie(dir)
+	procUtil.ExtractVolume = procUtil.Volume
+	if serviceGroup != "dpn" && procUtil.Config.ExtractDir() != dir {
+		procUtil.ExtractVolume = procUtil.newVolumeOrDie(procUtil.Config.ExtractDir())
+	}
+}
+
+func (procUtil *ProcessUtil) newVolumeOrDie(dir string) (*Volume) {
 	volume, err := NewVolume(dir, procUtil.MessageLog)
 	if err != nil {
-		message := fmt.Sprintf("Exiting. Cannot init Volume object: %v", err)
+		message := fmt.Sprintf("Exiting. Cannot init Volume object for %s: %v", dir, err)
 		fmt.Fprintln(os.Stderr, message)
 		procUtil.MessageLog.Fatal(message)
 	}
-	procUtil.Volume = volume
+	return volume
+}
+
+// Returns the Volume that tracks space in Config.ExtractDir().
+// This is Volume if ExtractVolume was not set.
+func (procUtil *ProcessUtil) ExtractDirVolume() (*Volume) {
+	if procUtil.ExtractVolume != nil {
+		return procUtil.ExtractVolume
+	}
+	return procUtil.Volume
 }
 
 // Initializes a reusable S3 client.
@@ -93,6 +143,13 @@ func (procUtil *ProcessUtil) initS3Client() {
 		fmt.Fprintln(os.Stderr, message)
 		procUtil.MessageLog.Fatal(message)
 	}
+	s3Client.DigestBufferSize = procUtil.Config.DigestBufferSize
+	err = s3Client.Configure(procUtil.Config.S3Client)
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Invalid S3Client config: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		procUtil.MessageLog.Fatal(message)
+	}
 	procUtil.S3Client = s3Client
 }
 
@@ -109,6 +166,20 @@ func (procUtil *ProcessUtil) initFluctusClient() {
 		fmt.Fprintln(os.Stderr, message)
 		procUtil.MessageLog.Fatal(message)
 	}
+	dnsRetryBackoff, err := procUtil.Config.FluctusDNSRetryBackoffDuration()
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Invalid Fluctus config: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		procUtil.MessageLog.Fatal(message)
+	}
+	fluctusClient.SetDNSRetry(procUtil.Config.FluctusDNSRetries, dnsRetryBackoff)
+	breakerCooldown, err := procUtil.Config.FluctusBreakerCooldownDuration()
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Invalid Fluctus config: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		procUtil.MessageLog.Fatal(message)
+	}
+	fluctusClient.SetCircuitBreaker(procUtil.Config.FluctusBreakerThreshold, breakerCooldown)
 	procUtil.FluctusClient = fluctusClient
 }
 
@@ -193,10 +264,43 @@ func (procUtil *ProcessUtil) MessageIdString(messageId nsq.MessageID) (string) {
 	return string(messageIdBytes)
 }
 
-// Logs info about the number of items that have succeeded and failed.
+// Logs info about the number of items that have succeeded and failed,
+// and the version of bagman that processed them, followed by one
+// line for each operation in Metrics. The first line doesn't change
+// format, since log scrapers depend on it.
 func (procUtil *ProcessUtil) LogStats() {
-	procUtil.MessageLog.Info("**STATS** Succeeded: %d, Failed: %d",
-		procUtil.Succeeded(), procUtil.Failed())
+	procUtil.MessageLog.Info("**STATS** Succeeded: %d, Failed: %d, Version: %s",
+		procUtil.Succeeded(), procUtil.Failed(), VersionString())
+	for _, operation := range Metrics.Operations() {
+		procUtil.MessageLog.Info("**STATS** %s: %s", operation, Metrics.Get(operation))
+	}
+	if procUtil.FluctusClient != nil {
+		procUtil.MessageLog.Info("**STATS** fluctus.breaker: %s",
+			procUtil.FluctusClient.BreakerStatus())
+	}
+}
+
+// RecordThroughput adds a bag that just finished to this process's
+// ThroughputTracker, saves the tracker in the log directory, where
+// apt_estimate reads it, and returns the current throughput. The
+// tracker is loaded from the log directory the first time, so the
+// window survives restarts.
+func (procUtil *ProcessUtil) RecordThroughput(sample ThroughputSample) (*Throughput, error) {
+	procUtil.throughputMutex.Lock()
+	defer procUtil.throughputMutex.Unlock()
+	filePath := ThroughputFile(procUtil.Config, path.Base(os.Args[0]))
+	if procUtil.throughput == nil {
+		window, err := procUtil.Config.ThroughputWindowDuration()
+		if err != nil {
+			return nil, err
+		}
+		procUtil.throughput, err = LoadThroughputTracker(filePath, window)
+		if err != nil {
+			return nil, err
+		}
+	}
+	procUtil.throughput.Add(sample)
+	return procUtil.throughput.Measure(sample.Finished), procUtil.throughput.Save(filePath)
 }
 
 
@@ -216,10 +320,9 @@ func (procUtil *ProcessUtil) BagAlreadyInProgress(s3File *S3File, currentMessage
 		return true
 	}
 
-	re := regexp.MustCompile("\\.tar$")
-	bagDir := re.ReplaceAllString(s3File.Key.Key, "")
-	tarFilePath := filepath.Join(procUtil.Config.TarDirectory, s3File.Key.Key)
-	unpackDir := filepath.Join(procUtil.Config.TarDirectory, bagDir)
+	bagDir := TrimTarExtension(s3File.Key.Key)
+	tarFilePath := filepath.Join(procUtil.Config.DownloadDir(), s3File.Key.Key)
+	unpackDir := filepath.Join(procUtil.Config.ExtractDir(), bagDir)
 
 	// Bag is in process if we have its files on disk.
 	return FileExists(unpackDir) || FileExists(tarFilePath)
@@ -72,6 +72,25 @@ func TestIncrementSucceededAndFailed(t *testing.T) {
 	}
 }
 
+func TestProcessUtilEnqueue(t *testing.T) {
+	procUtil := bagman.NewProcessUtil(&testConfig, "aptrust")
+	defer deleteTestLogs(procUtil.Config)
+	queue := bagman.NewMemoryQueue()
+	procUtil.Queue = queue
+	for _, item := range []string{"one", "two"} {
+		if err := procUtil.Enqueue("store_topic", item); err != nil {
+			t.Errorf("Enqueue returned error: %v", err)
+		}
+	}
+	items := queue.Items("store_topic")
+	if len(items) != 2 || items[0] != "one" || items[1] != "two" {
+		t.Errorf("Expected [one two] in store_topic, got %v", items)
+	}
+	if len(queue.Items("record_topic")) != 0 {
+		t.Errorf("Nothing should be in record_topic")
+	}
+}
+
 func TestMessageIdString(t *testing.T) {
 	procUtil := bagman.NewProcessUtil(&testConfig, "aptrust")
 	defer deleteTestLogs(procUtil.Config)
@@ -0,0 +1,241 @@
+package bagman
+
+import (
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deleted files are moved to keys that start with this prefix
+// in the bucket they were deleted from.
+const QUARANTINE_PREFIX = "quarantine/"
+
+// How long deleted files stay in quarantine if the config
+// does not say otherwise.
+const DEFAULT_DELETE_RETENTION = 30 * 24 * time.Hour
+
+// Format of the deletion timestamp in quarantine keys. This is
+// fixed-width and contains no slashes, so the timestamp always
+// starts after the last slash, and everything between
+// QUARANTINE_PREFIX and that slash is the original key.
+const quarantineTimeFormat = "20060102T150405.000000000Z"
+
+// QuarantineStorage is the part of the S3Client that Quarantine
+// needs. It's an interface so the quarantine logic can be tested
+// without S3.
+type QuarantineStorage interface {
+	Copy(sourceBucket, sourceKey, destBucket, destKey string) error
+	Delete(bucketName, key string) error
+	ListPrefix(bucketName, prefix string) ([]s3.Key, error)
+}
+
+// Quarantine implements soft delete for a single bucket. Deleting
+// a file moves it to a quarantine key in the same bucket, where it
+// can be restored until the retention period expires. After that,
+// Purge removes it for good.
+type Quarantine struct {
+	// Storage does the copying, deleting and listing.
+	Storage   QuarantineStorage
+
+	// Bucket is the bucket we delete files from.
+	Bucket    string
+
+	// Retention is how long deleted files stay in quarantine.
+	Retention time.Duration
+}
+
+// NewQuarantine returns a Quarantine for the specified bucket.
+// If retention is zero, this uses DEFAULT_DELETE_RETENTION.
+func NewQuarantine(storage QuarantineStorage, bucket string, retention time.Duration) (*Quarantine) {
+	if retention <= 0 {
+		retention = DEFAULT_DELETE_RETENTION
+	}
+	return &Quarantine{
+		Storage:   storage,
+		Bucket:    bucket,
+		Retention: retention,
+	}
+}
+
+// QuarantineKey returns the key under which originalKey is stored
+// when it is deleted at deletedAt. For example, the key "1234-5678"
+// deleted at noon UTC on June 1, 2015 is quarantined as
+// "quarantine/1234-5678/20150601T120000.000000000Z". All of the
+// quarantined copies of a key share the prefix returned by
+// quarantinePrefix, so we can find them without listing the whole
+// quarantine.
+func QuarantineKey(originalKey string, deletedAt time.Time) (string) {
+	return quarantinePrefix(originalKey) + deletedAt.UTC().Format(quarantineTimeFormat)
+}
+
+// Returns the prefix of all quarantine keys for originalKey.
+func quarantinePrefix(originalKey string) (string) {
+	return QUARANTINE_PREFIX + originalKey + "/"
+}
+
+// ParseQuarantineKey returns the original key and deletion time
+// encoded in a key returned by QuarantineKey.
+func ParseQuarantineKey(quarantineKey string) (originalKey string, deletedAt time.Time, err error) {
+	if !strings.HasPrefix(quarantineKey, QUARANTINE_PREFIX) {
+		return "", time.Time{}, fmt.Errorf("'%s' is not a quarantine key: "+
+			"it does not start with '%s'", quarantineKey, QUARANTINE_PREFIX)
+	}
+	rest := strings.TrimPrefix(quarantineKey, QUARANTINE_PREFIX)
+	slash := strings.LastIndex(rest, "/")
+	if slash < 1 {
+		return "", time.Time{}, fmt.Errorf("Quarantine key '%s' is missing the original key",
+			quarantineKey)
+	}
+	deletedAt, err = time.Parse(quarantineTimeFormat, rest[slash+1:])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Quarantine key '%s' has an invalid "+
+			"deletion timestamp: %v", quarantineKey, err)
+	}
+	return rest[:slash], deletedAt, nil
+}
+
+// Move moves key to quarantine, recording deletedAt as the time of
+// deletion, and returns the quarantine key. The copy happens before
+// the delete, so an error never leaves us without a copy of the file.
+func (quarantine *Quarantine) Move(key string, deletedAt time.Time) (string, error) {
+	quarantineKey := QuarantineKey(key, deletedAt)
+	err := quarantine.Storage.Copy(quarantine.Bucket, key, quarantine.Bucket, quarantineKey)
+	if err != nil {
+		return "", fmt.Errorf("Cannot copy %s/%s to quarantine: %v",
+			quarantine.Bucket, key, err)
+	}
+	err = quarantine.Storage.Delete(quarantine.Bucket, key)
+	if err != nil {
+		return quarantineKey, fmt.Errorf("Copied %s/%s to quarantine, "+
+			"but could not delete the original: %v", quarantine.Bucket, key, err)
+	}
+	return quarantineKey, nil
+}
+
+// Returns the time at which the retention period for the file at
+// quarantineKey ends. After this, the file can no longer be undeleted.
+func (quarantine *Quarantine) Expires(quarantineKey string) (time.Time, error) {
+	_, deletedAt, err := ParseQuarantineKey(quarantineKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return deletedAt.Add(quarantine.Retention), nil
+}
+
+// Undelete moves the file at quarantineKey back to its original key,
+// and returns the original key. This returns an error without moving
+// anything if the retention period has expired, even if the file has
+// not been purged yet.
+func (quarantine *Quarantine) Undelete(quarantineKey string) (string, error) {
+	originalKey, _, err := ParseQuarantineKey(quarantineKey)
+	if err != nil {
+		return "", err
+	}
+	expires, _ := quarantine.Expires(quarantineKey)
+	if !time.Now().Before(expires) {
+		return "", fmt.Errorf("Cannot undelete %s/%s: retention period of %s "+
+			"expired at %s", quarantine.Bucket, originalKey, quarantine.Retention,
+			expires.Format(time.RFC3339))
+	}
+	err = quarantine.Storage.Copy(quarantine.Bucket, quarantineKey, quarantine.Bucket, originalKey)
+	if err != nil {
+		return "", fmt.Errorf("Cannot copy %s/%s out of quarantine: %v",
+			quarantine.Bucket, quarantineKey, err)
+	}
+	err = quarantine.Storage.Delete(quarantine.Bucket, quarantineKey)
+	if err != nil {
+		return originalKey, fmt.Errorf("Restored %s/%s, but could not delete "+
+			"quarantined copy %s: %v", quarantine.Bucket, originalKey, quarantineKey, err)
+	}
+	return originalKey, nil
+}
+
+// Find returns the quarantine keys of all quarantined copies of
+// originalKey, oldest first. This lists only the keys under
+// originalKey's quarantine prefix, not the whole quarantine.
+func (quarantine *Quarantine) Find(originalKey string) ([]string, error) {
+	keys, err := quarantine.Storage.ListPrefix(quarantine.Bucket, quarantinePrefix(originalKey))
+	if err != nil {
+		return nil, err
+	}
+	found := make([]string, 0)
+	for _, key := range keys {
+		keyName, _, err := ParseQuarantineKey(key.Key)
+		if err == nil && keyName == originalKey {
+			found = append(found, key.Key)
+		}
+	}
+	// The fixed-width timestamp makes these sort by deletion time.
+	sort.Strings(found)
+	return found, nil
+}
+
+// Purge permanently deletes quarantined files whose retention period
+// has expired, and returns the quarantine keys it deleted. Keys under
+// QUARANTINE_PREFIX that are not valid quarantine keys are left alone.
+// If some deletes fail, Purge keeps going and returns an error that
+// lists the failures.
+func (quarantine *Quarantine) Purge() (purged []string, err error) {
+	keys, err := quarantine.Storage.ListPrefix(quarantine.Bucket, QUARANTINE_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	purged = make([]string, 0)
+	failures := make([]string, 0)
+	now := time.Now()
+	for _, key := range keys {
+		expires, err := quarantine.Expires(key.Key)
+		if err != nil || now.Before(expires) {
+			continue
+		}
+		err = quarantine.Storage.Delete(quarantine.Bucket, key.Key)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", key.Key, err))
+			continue
+		}
+		purged = append(purged, key.Key)
+	}
+	if len(failures) > 0 {
+		return purged, fmt.Errorf("Could not purge %d files from %s: %s",
+			len(failures), quarantine.Bucket, strings.Join(failures, "; "))
+	}
+	return purged, nil
+}
+
+// UndeleteGenericFile restores the most recently quarantined copy of
+// genericFile in each of the quarantines, and then marks the file
+// active in Fluctus. It checks all of the quarantines before moving
+// anything, so it refuses to undelete the file at all if any copy is
+// missing or past its retention period.
+func UndeleteGenericFile(fluctusClient *FluctusClient, genericFile *GenericFile, quarantines ...*Quarantine) (error) {
+	fileName, err := genericFile.PreservationStorageFileName()
+	if err != nil {
+		return err
+	}
+	quarantineKeys := make([]string, len(quarantines))
+	for i, quarantine := range quarantines {
+		keys, err := quarantine.Find(fileName)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("GenericFile %s (%s) is not in quarantine in %s",
+				genericFile.Identifier, fileName, quarantine.Bucket)
+		}
+		quarantineKeys[i] = keys[len(keys)-1]
+		expires, _ := quarantine.Expires(quarantineKeys[i])
+		if !time.Now().Before(expires) {
+			return fmt.Errorf("Cannot undelete GenericFile %s: retention period "+
+				"expired at %s", genericFile.Identifier, expires.Format(time.RFC3339))
+		}
+	}
+	for i, quarantine := range quarantines {
+		_, err = quarantine.Undelete(quarantineKeys[i])
+		if err != nil {
+			return err
+		}
+	}
+	return fluctusClient.GenericFileSetState(genericFile.Identifier, StateActive)
+}
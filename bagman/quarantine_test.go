@@ -0,0 +1,281 @@
+package bagman_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQuarantineStorage is an in-memory QuarantineStorage.
+type fakeQuarantineStorage struct {
+	mutex    sync.Mutex
+	objects  map[string]string
+	prefixes []string
+}
+
+func newFakeQuarantineStorage() (*fakeQuarantineStorage) {
+	return &fakeQuarantineStorage{objects: make(map[string]string)}
+}
+
+func (fake *fakeQuarantineStorage) Copy(sourceBucket, sourceKey, destBucket, destKey string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	data, ok := fake.objects[sourceBucket+"/"+sourceKey]
+	if !ok {
+		return fmt.Errorf("The specified key does not exist.")
+	}
+	fake.objects[destBucket+"/"+destKey] = data
+	return nil
+}
+
+func (fake *fakeQuarantineStorage) Delete(bucketName, key string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	delete(fake.objects, bucketName+"/"+key)
+	return nil
+}
+
+func (fake *fakeQuarantineStorage) ListPrefix(bucketName, prefix string) ([]s3.Key, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.prefixes = append(fake.prefixes, prefix)
+	names := make([]string, 0)
+	for path := range fake.objects {
+		if strings.HasPrefix(path, bucketName+"/"+prefix) {
+			names = append(names, strings.TrimPrefix(path, bucketName+"/"))
+		}
+	}
+	sort.Strings(names)
+	keys := make([]s3.Key, len(names))
+	for i, name := range names {
+		keys[i] = s3.Key{Key: name}
+	}
+	return keys, nil
+}
+
+func (fake *fakeQuarantineStorage) get(bucketName, key string) (string, bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	data, ok := fake.objects[bucketName+"/"+key]
+	return data, ok
+}
+
+const quarantineBucket = "aptrust.test.preservation"
+const quarantineFileKey = "9a8bf6f2-50ef-4cf4-a0c1-b0e6ff6c3b2d"
+
+func TestQuarantineKey(t *testing.T) {
+	deletedAt := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := bagman.QuarantineKey("data/sub/file.txt", deletedAt)
+	expected := "quarantine/data/sub/file.txt/20150601T120000.000000000Z"
+	if key != expected {
+		t.Errorf("QuarantineKey returned '%s', expected '%s'", key, expected)
+	}
+	originalKey, parsedTime, err := bagman.ParseQuarantineKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if originalKey != "data/sub/file.txt" {
+		t.Errorf("Original key is '%s', expected 'data/sub/file.txt'", originalKey)
+	}
+	if !parsedTime.Equal(deletedAt) {
+		t.Errorf("Deletion time is %s, expected %s", parsedTime, deletedAt)
+	}
+
+	// Deletion time should survive with nanosecond precision,
+	// and non-UTC times should be converted.
+	est := time.FixedZone("EST", -5*60*60)
+	deletedAt = time.Date(2015, 6, 1, 7, 0, 0, 1234, est)
+	_, parsedTime, _ = bagman.ParseQuarantineKey(bagman.QuarantineKey("x", deletedAt))
+	if !parsedTime.Equal(deletedAt) {
+		t.Errorf("Deletion time is %s, expected %s", parsedTime, deletedAt)
+	}
+
+	badKeys := []string{
+		"9a8bf6f2-50ef-4cf4-a0c1-b0e6ff6c3b2d",
+		"quarantine/20150601T120000.000000000Z",
+		"quarantine//20150601T120000.000000000Z",
+		"quarantine/9a8bf6f2/",
+		"quarantine/9a8bf6f2/June-1-2015",
+	}
+	for _, badKey := range badKeys {
+		if _, _, err := bagman.ParseQuarantineKey(badKey); err == nil {
+			t.Errorf("ParseQuarantineKey should have rejected '%s'", badKey)
+		}
+	}
+}
+
+func TestQuarantineMoveAndUndelete(t *testing.T) {
+	storage := newFakeQuarantineStorage()
+	storage.objects[quarantineBucket+"/"+quarantineFileKey] = "file data"
+	quarantine := bagman.NewQuarantine(storage, quarantineBucket, time.Hour)
+
+	deletedAt := time.Now().UTC()
+	quarantineKey, err := quarantine.Move(quarantineFileKey, deletedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quarantineKey != bagman.QuarantineKey(quarantineFileKey, deletedAt) {
+		t.Errorf("Move returned wrong quarantine key '%s'", quarantineKey)
+	}
+	if _, ok := storage.get(quarantineBucket, quarantineFileKey); ok {
+		t.Errorf("Move did not delete the original file")
+	}
+	if data, _ := storage.get(quarantineBucket, quarantineKey); data != "file data" {
+		t.Errorf("Move did not copy the file to quarantine")
+	}
+	found, err := quarantine.Find(quarantineFileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0] != quarantineKey {
+		t.Errorf("Find returned %v, expected [%s]", found, quarantineKey)
+	}
+	expectedPrefix := "quarantine/" + quarantineFileKey + "/"
+	if len(storage.prefixes) != 1 || storage.prefixes[0] != expectedPrefix {
+		t.Errorf("Find listed %v, expected only %s", storage.prefixes, expectedPrefix)
+	}
+
+	originalKey, err := quarantine.Undelete(quarantineKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if originalKey != quarantineFileKey {
+		t.Errorf("Undelete returned '%s', expected '%s'", originalKey, quarantineFileKey)
+	}
+	if data, _ := storage.get(quarantineBucket, quarantineFileKey); data != "file data" {
+		t.Errorf("Undelete did not restore the original file")
+	}
+	if _, ok := storage.get(quarantineBucket, quarantineKey); ok {
+		t.Errorf("Undelete did not remove the quarantined copy")
+	}
+
+	_, err = quarantine.Move("does-not-exist", deletedAt)
+	if err == nil {
+		t.Errorf("Move should have failed for a missing file")
+	}
+}
+
+func TestQuarantineUndeleteRefusesExpired(t *testing.T) {
+	storage := newFakeQuarantineStorage()
+	quarantine := bagman.NewQuarantine(storage, quarantineBucket, time.Hour)
+	quarantineKey := bagman.QuarantineKey(quarantineFileKey, time.Now().Add(-61*time.Minute))
+	storage.objects[quarantineBucket+"/"+quarantineKey] = "file data"
+
+	_, err := quarantine.Undelete(quarantineKey)
+	if err == nil || !strings.Contains(err.Error(), "retention period of 1h0m0s expired") {
+		t.Errorf("Undelete should have refused expired file, got %v", err)
+	}
+	if _, ok := storage.get(quarantineBucket, quarantineFileKey); ok {
+		t.Errorf("Undelete restored a file whose retention period expired")
+	}
+	if _, ok := storage.get(quarantineBucket, quarantineKey); !ok {
+		t.Errorf("Undelete removed the quarantined copy of an expired file")
+	}
+}
+
+func TestQuarantinePurge(t *testing.T) {
+	storage := newFakeQuarantineStorage()
+	quarantine := bagman.NewQuarantine(storage, quarantineBucket, 24*time.Hour)
+	now := time.Now()
+	expiredKey := bagman.QuarantineKey("expired", now.Add(-25*time.Hour))
+	currentKey := bagman.QuarantineKey("current", now.Add(-23*time.Hour))
+	storage.objects[quarantineBucket+"/"+expiredKey] = "old"
+	storage.objects[quarantineBucket+"/"+currentKey] = "new"
+	storage.objects[quarantineBucket+"/quarantine/not-a-quarantine-key"] = "?"
+	storage.objects[quarantineBucket+"/"+quarantineFileKey] = "active"
+
+	purged, err := quarantine.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0] != expiredKey {
+		t.Errorf("Purge returned %v, expected [%s]", purged, expiredKey)
+	}
+	if _, ok := storage.get(quarantineBucket, expiredKey); ok {
+		t.Errorf("Purge did not delete expired file")
+	}
+	for _, key := range []string{currentKey, "quarantine/not-a-quarantine-key", quarantineFileKey} {
+		if _, ok := storage.get(quarantineBucket, key); !ok {
+			t.Errorf("Purge should not have deleted %s", key)
+		}
+	}
+}
+
+// Fluctus server that records the states set on GenericFiles.
+func newFakeFluctusFileStates(states map[string]string, mutex *sync.Mutex) (*httptest.Server) {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || !strings.HasPrefix(r.URL.Path, "/api/v1/files/") {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		params := make(map[string]string)
+		json.Unmarshal(data, &params)
+		mutex.Lock()
+		states[strings.TrimPrefix(r.URL.Path, "/api/v1/files/")] = params["state"]
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func TestUndeleteGenericFile(t *testing.T) {
+	states := make(map[string]string)
+	mutex := &sync.Mutex{}
+	server := newFakeFluctusFileStates(states, mutex)
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("quarantine_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genericFile := &bagman.GenericFile{
+		Identifier: "test.edu/bag/data/file.txt",
+		URI:        "https://s3.amazonaws.com/aptrust.test.preservation/" + quarantineFileKey,
+	}
+	storage := newFakeQuarantineStorage()
+	virginia := bagman.NewQuarantine(storage, quarantineBucket, time.Hour)
+	oregon := bagman.NewQuarantine(storage, quarantineBucket+".oregon", time.Hour)
+
+	// The Oregon copy is past its retention period, so
+	// nothing should be undeleted.
+	currentKey := bagman.QuarantineKey(quarantineFileKey, time.Now().Add(-time.Minute))
+	expiredKey := bagman.QuarantineKey(quarantineFileKey, time.Now().Add(-2*time.Hour))
+	storage.objects[virginia.Bucket+"/"+currentKey] = "file data"
+	storage.objects[oregon.Bucket+"/"+expiredKey] = "file data"
+	err = bagman.UndeleteGenericFile(fluctusClient, genericFile, virginia, oregon)
+	if err == nil || !strings.Contains(err.Error(), "retention period expired") {
+		t.Errorf("UndeleteGenericFile should have refused expired file, got %v", err)
+	}
+	if _, ok := storage.get(virginia.Bucket, quarantineFileKey); ok {
+		t.Errorf("UndeleteGenericFile restored the Virginia copy when Oregon had expired")
+	}
+	if len(states) != 0 {
+		t.Errorf("UndeleteGenericFile should not have updated Fluctus")
+	}
+
+	// With a current copy in Oregon, the file should be
+	// restored in both buckets and reactivated in Fluctus.
+	oregonKey := bagman.QuarantineKey(quarantineFileKey, time.Now().Add(-time.Second))
+	storage.objects[oregon.Bucket+"/"+oregonKey] = "file data"
+	err = bagman.UndeleteGenericFile(fluctusClient, genericFile, virginia, oregon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range []string{virginia.Bucket, oregon.Bucket} {
+		if _, ok := storage.get(bucket, quarantineFileKey); !ok {
+			t.Errorf("UndeleteGenericFile did not restore file in %s", bucket)
+		}
+	}
+	if states[genericFile.Identifier] != bagman.StateActive {
+		t.Errorf("UndeleteGenericFile did not mark file active in Fluctus: %v", states)
+	}
+}
@@ -0,0 +1,165 @@
+package bagman
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// How much RangeReader fetches per request, if the caller
+// doesn't say.
+const DEFAULT_RANGE_CHUNK_SIZE = 64 * 1024
+
+/*
+RangeReader reads a remote file through HTTP range requests, one
+chunk at a time. It implements io.Seeker, and seeking costs nothing
+until the next Read, so a reader that skips most of the file, such
+as a tar.Reader skipping file bodies, downloads only the parts it
+reads. Use it with a presigned S3 URL to read part of an S3 object
+without fetching the whole thing.
+
+RangeReader is not safe for concurrent use.
+*/
+type RangeReader struct {
+	// Requests is the number of range requests made so far.
+	Requests     int
+	// BytesFetched is the number of bytes downloaded so far.
+	BytesFetched int64
+
+	url          string
+	client       *http.Client
+	chunkSize    int64
+	offset       int64
+	// size is -1 until a response tells us the file size.
+	size         int64
+	buffer       []byte
+	bufferStart  int64
+}
+
+// NewRangeReader returns a RangeReader for url. If client is nil,
+// it uses http.DefaultClient. If chunkSize is less than 1, it uses
+// DEFAULT_RANGE_CHUNK_SIZE.
+func NewRangeReader(client *http.Client, url string, chunkSize int64) (*RangeReader) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if chunkSize < 1 {
+		chunkSize = DEFAULT_RANGE_CHUNK_SIZE
+	}
+	return &RangeReader{
+		url: url,
+		client: client,
+		chunkSize: chunkSize,
+		size: -1,
+	}
+}
+
+// Size returns the size of the remote file, or -1 if we haven't
+// fetched anything yet.
+func (reader *RangeReader) Size() (int64) {
+	return reader.size
+}
+
+// Read reads from the current offset, fetching the chunk that
+// starts there if it's not already buffered.
+func (reader *RangeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if reader.size >= 0 && reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+	bufferEnd := reader.bufferStart + int64(len(reader.buffer))
+	if reader.offset < reader.bufferStart || reader.offset >= bufferEnd {
+		if err := reader.fetch(); err != nil {
+			return 0, err
+		}
+		if len(reader.buffer) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, reader.buffer[reader.offset-reader.bufferStart:])
+	reader.offset += int64(n)
+	return n, nil
+}
+
+// Seek sets the offset for the next Read. It does not make a
+// request. Seeking relative to the end works only after the first
+// Read, when we know the file's size.
+func (reader *RangeReader) Seek(offset int64, whence int) (int64, error) {
+	newOffset := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		newOffset += reader.offset
+	case io.SeekEnd:
+		if reader.size < 0 {
+			return 0, fmt.Errorf("Cannot seek from the end of %s before its size is known",
+				reader.url)
+		}
+		newOffset += reader.size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return 0, fmt.Errorf("Cannot seek to negative offset %d", newOffset)
+	}
+	reader.offset = newOffset
+	return newOffset, nil
+}
+
+// Fetches the chunk that starts at the current offset into
+// the buffer. At the end of the file, the buffer is empty.
+func (reader *RangeReader) fetch() (error) {
+	request, err := http.NewRequest("GET", reader.url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d",
+		reader.offset, reader.offset+reader.chunkSize-1))
+	response, err := reader.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	reader.Requests++
+	reader.bufferStart = reader.offset
+	reader.buffer = nil
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// We're at or past the end of the file.
+		ioutil.ReadAll(response.Body)
+		return nil
+	case http.StatusOK:
+		return fmt.Errorf("Server at %s ignored the range request; "+
+			"it would have sent the whole file", request.URL.Host)
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Range request for %s returned status %d: %s",
+			request.URL.Path, response.StatusCode, string(body))
+	}
+	if size, ok := contentRangeSize(response.Header.Get("Content-Range")); ok {
+		reader.size = size
+	}
+	reader.buffer, err = ioutil.ReadAll(io.LimitReader(response.Body, reader.chunkSize))
+	reader.BytesFetched += int64(len(reader.buffer))
+	return err
+}
+
+// Returns the total size from a Content-Range header such as
+// "bytes 0-511/10240". Returns false if the size is missing or "*".
+func contentRangeSize(contentRange string) (int64, bool) {
+	slash := strings.LastIndex(contentRange, "/")
+	if slash < 0 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,136 @@
+package bagman_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/APTrust/bagman/bagman"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Serves data with support for range requests, like S3.
+func rangeServer(data []byte) (*httptest.Server) {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "bag.tar", time.Now(), bytes.NewReader(data))
+	}))
+}
+
+func loadFixtureTar(t *testing.T, name string) ([]byte) {
+	data, err := ioutil.ReadFile(filepath.Join(getPath("testdata"), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRangeReader(t *testing.T) {
+	data := loadFixtureTar(t, "example.edu.sample_good.tar")
+	server := rangeServer(data)
+	defer server.Close()
+
+	// Reading it all, in chunks, gets the whole file.
+	reader := bagman.NewRangeReader(nil, server.URL, 4096)
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll returned error %v", err)
+	}
+	if !bytes.Equal(contents, data) {
+		t.Errorf("RangeReader returned %d bytes that don't match the %d byte file",
+			len(contents), len(data))
+	}
+	if reader.Size() != int64(len(data)) || reader.BytesFetched != int64(len(data)) {
+		t.Errorf("Expected size and bytes fetched %d, got %d and %d", len(data),
+			reader.Size(), reader.BytesFetched)
+	}
+	if reader.Requests != (len(data)+4095)/4096 {
+		t.Errorf("Expected %d requests, got %d", (len(data)+4095)/4096, reader.Requests)
+	}
+
+	// Seeking doesn't fetch anything until the next read.
+	reader = bagman.NewRangeReader(nil, server.URL, 512)
+	if _, err = reader.Seek(10240, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if reader.Requests != 0 {
+		t.Errorf("Seek should not make a request")
+	}
+	if _, err = reader.Seek(0, io.SeekEnd); err == nil {
+		t.Errorf("Seeking from the end should fail before the size is known")
+	}
+	buffer := make([]byte, 100)
+	if _, err = io.ReadFull(reader, buffer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer, data[10240:10340]) || reader.BytesFetched != 512 {
+		t.Errorf("Read after seek returned the wrong bytes, or fetched %d bytes", reader.BytesFetched)
+	}
+	position, err := reader.Seek(-10, io.SeekEnd)
+	if err != nil || position != int64(len(data)-10) {
+		t.Errorf("Seek from end returned %d, %v", position, err)
+	}
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(rest, data[len(data)-10:]) {
+		t.Errorf("Read at end returned %d bytes, %v", len(rest), err)
+	}
+
+	// Reading past the end is EOF.
+	reader = bagman.NewRangeReader(nil, server.URL, 512)
+	reader.Seek(int64(len(data)+100), io.SeekStart)
+	if n, err := reader.Read(buffer); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF past the end, got %d, %v", n, err)
+	}
+}
+
+func TestRangeReaderSkipsTarBodies(t *testing.T) {
+	// A bag with a 4 MB payload file.
+	tarData := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(tarData)
+	payload := make([]byte, 4*1024*1024)
+	for _, file := range []struct{ name string; data []byte }{
+		{"bag/bagit.txt", []byte("BagIt-Version: 0.97\n")},
+		{"bag/data/big.bin", payload},
+		{"bag/manifest-md5.txt", []byte("b5cfa9d6c8febd618f91ac2843d50a1c data/big.bin\n")},
+	} {
+		tarWriter.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data))})
+		tarWriter.Write(file.data)
+	}
+	tarWriter.Close()
+	server := rangeServer(tarData.Bytes())
+	defer server.Close()
+
+	reader := bagman.NewRangeReader(nil, server.URL, 4096)
+	tarReader := tar.NewReader(reader)
+	names := make([]string, 0)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 3 || names[2] != "bag/manifest-md5.txt" {
+		t.Errorf("Tar reader found the wrong entries: %v", names)
+	}
+	if reader.BytesFetched > 64*1024 {
+		t.Errorf("Reading tar headers fetched %d bytes; it should skip the payload",
+			reader.BytesFetched)
+	}
+}
+
+func TestRangeReaderRequiresRangeSupport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("The whole file, whether you like it or not"))
+	}))
+	defer server.Close()
+	reader := bagman.NewRangeReader(nil, server.URL, 8)
+	if _, err := reader.Read(make([]byte, 8)); err == nil {
+		t.Errorf("RangeReader should fail when the server ignores range requests")
+	}
+}
@@ -0,0 +1,75 @@
+package bagman
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"runtime/debug"
+)
+
+// StagePanic describes a panic recovered from one of the stages
+// of a worker's pipeline.
+type StagePanic struct {
+	// The name of the stage that panicked, such as "prepare.fetch".
+	Stage string
+
+	// The value passed to panic().
+	Value interface{}
+
+	// The stack trace of the go routine that panicked.
+	Stack string
+}
+
+func (stagePanic *StagePanic) Error() (string) {
+	return fmt.Sprintf("Panic in stage %s: %v", stagePanic.Stage, stagePanic.Value)
+}
+
+// Returns true if err is a StagePanic.
+func IsStagePanic(err error) (bool) {
+	_, isPanic := err.(*StagePanic)
+	return isPanic
+}
+
+/*
+RecoverStage keeps a panic in one stage of a worker's pipeline from
+killing the whole worker process. Each stage runs as a go routine
+that reads items from a channel. Defer a call to RecoverStage at the
+top of that go routine:
+
+	func (worker *Worker) doFetch() {
+		var helper *bagman.IngestHelper
+		defer bagman.RecoverStage("fetch", worker.ProcUtil.MessageLog,
+			func(stagePanic *bagman.StagePanic) {
+				worker.recoverItem(helper, stagePanic, worker.ResultsChannel)
+				go worker.doFetch()
+			})
+		for helper = range worker.FetchChannel {
+			...
+		}
+	}
+
+If the go routine panics, RecoverStage logs the panic with its stack
+trace, counts it in Metrics under "panics" and "panics.<stage>", and
+calls onPanic. The onPanic function should record the error on the
+item that was in process, release any disk space reserved for it,
+send it on to the channel that will requeue or finish its NSQ
+message, and then restart the stage's go routine.
+
+If the go routine did not panic, RecoverStage does nothing.
+*/
+func RecoverStage(stage string, logger *logging.Logger, onPanic func(*StagePanic)) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	stagePanic := &StagePanic{
+		Stage: stage,
+		Value: value,
+		Stack: string(debug.Stack()),
+	}
+	Metrics.Record("panics", 0, 0, stagePanic)
+	Metrics.Record("panics." + stage, 0, 0, stagePanic)
+	if logger != nil {
+		logger.Error("%s\n%s", stagePanic.Error(), stagePanic.Stack)
+	}
+	onPanic(stagePanic)
+}
@@ -0,0 +1,144 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// panickyWorker is a two-stage pipeline, like the ones in the
+// workers package. Its work stage panics on any bag named
+// "panic.tar", and its results stage requeues or finishes the
+// NSQ message.
+type panickyWorker struct {
+	workChannel    chan *bagman.IngestHelper
+	resultsChannel chan *bagman.IngestHelper
+}
+
+func newPanickyWorker() (*panickyWorker) {
+	worker := &panickyWorker{
+		workChannel:    make(chan *bagman.IngestHelper, 1),
+		resultsChannel: make(chan *bagman.IngestHelper, 1),
+	}
+	go worker.doWork()
+	go worker.doResults()
+	return worker
+}
+
+func (worker *panickyWorker) doWork() {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("test.work", bagman.DiscardLogger("recover_test"),
+		func(stagePanic *bagman.StagePanic) {
+			helper.Result.RecordPanic(stagePanic)
+			helper.ReleaseVolume()
+			worker.resultsChannel <- helper
+			go worker.doWork()
+		})
+	for helper = range worker.workChannel {
+		helper.ReserveVolume(1000)
+		if helper.Result.S3File.Key.Key == "panic.tar" {
+			var fedoraResult *bagman.FedoraResult
+			fedoraResult.AllRecordsSucceeded()
+		}
+		helper.ReleaseVolume()
+		worker.resultsChannel <- helper
+	}
+}
+
+func (worker *panickyWorker) doResults() {
+	for helper := range worker.resultsChannel {
+		if helper.Result.ErrorMessage != "" && helper.Result.Retry {
+			helper.Result.NsqMessage.Requeue(5 * time.Minute)
+		} else {
+			helper.Result.NsqMessage.Finish()
+		}
+	}
+}
+
+func runPanickyWorker(t *testing.T, worker *panickyWorker, procUtil *bagman.ProcessUtil, key string) (*bagman.InMemoryMessage, *bagman.IngestHelper) {
+	message := bagman.NewInMemoryMessage([]byte(key))
+	s3File := &bagman.S3File{BucketName: "aptrust.receiving.test.edu"}
+	s3File.Key.Key = key
+	helper := bagman.NewIngestHelper(procUtil, message, s3File)
+	// Bags may have come through earlier stages without errors.
+	helper.Result.Retry = false
+	worker.workChannel <- helper
+	select {
+	case <-message.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Worker did not finish or requeue %s", key)
+	}
+	return message, helper
+}
+
+func TestRecoverStage(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	volume, err := bagman.NewVolume(filename, bagman.DiscardLogger("recover_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	procUtil := &bagman.ProcessUtil{Volume: volume}
+	panicsBefore := bagman.Metrics.Get("panics").Count
+	stagePanicsBefore := bagman.Metrics.Get("panics.test.work").Count
+	worker := newPanickyWorker()
+
+	message, helper := runPanickyWorker(t, worker, procUtil, "panic.tar")
+	if !message.Requeued() {
+		t.Errorf("Message for a bag that panicked should be requeued")
+	}
+	if !strings.Contains(helper.Result.ErrorMessage, "Panic in stage test.work") {
+		t.Errorf("Unexpected ErrorMessage '%s'", helper.Result.ErrorMessage)
+	}
+	if !strings.Contains(helper.Result.PanicStack, "recover_test.go") {
+		t.Errorf("PanicStack should include the panicking function:\n%s",
+			helper.Result.PanicStack)
+	}
+	if volume.ClaimedSpace() != 0 {
+		t.Errorf("Bag that panicked still has %d bytes reserved", volume.ClaimedSpace())
+	}
+	if bagman.Metrics.Get("panics").Count != panicsBefore+1 {
+		t.Errorf("Panic was not counted in metrics")
+	}
+	if bagman.Metrics.Get("panics.test.work").Count != stagePanicsBefore+1 {
+		t.Errorf("Panic was not counted in stage metrics")
+	}
+
+	// The work stage should still be running.
+	message, helper = runPanickyWorker(t, worker, procUtil, "ok.tar")
+	if !message.Finished() {
+		t.Errorf("Message for a good bag should be finished")
+	}
+	if helper.Result.ErrorMessage != "" || helper.Result.PanicStack != "" {
+		t.Errorf("Good bag should have no error, got '%s'", helper.Result.ErrorMessage)
+	}
+	if bagman.Metrics.Get("panics").Count != panicsBefore+1 {
+		t.Errorf("Good bag should not be counted as a panic")
+	}
+}
+
+func TestRecoverStageWithoutPanic(t *testing.T) {
+	called := false
+	func() {
+		defer bagman.RecoverStage("test.no_panic", nil, func(*bagman.StagePanic) {
+			called = true
+		})
+	}()
+	if called {
+		t.Errorf("RecoverStage should not call onPanic when there is no panic")
+	}
+}
+
+func TestIsStagePanic(t *testing.T) {
+	stagePanic := &bagman.StagePanic{Stage: "fetch", Value: "oops"}
+	if !bagman.IsStagePanic(stagePanic) {
+		t.Errorf("IsStagePanic should be true for a StagePanic")
+	}
+	if stagePanic.Error() != "Panic in stage fetch: oops" {
+		t.Errorf("Unexpected error message '%s'", stagePanic.Error())
+	}
+	if bagman.IsStagePanic(&bagman.DecryptionError{Chunk: 0}) {
+		t.Errorf("IsStagePanic should be false for other errors")
+	}
+}
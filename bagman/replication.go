@@ -0,0 +1,240 @@
+package bagman
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files stored longer than this without a replication copy show
+// up in the replication lag report, if the config does not say
+// otherwise.
+const DEFAULT_REPLICATION_LAG_THRESHOLD = 24 * time.Hour
+
+// How long the replicator waits before retrying a failed copy the
+// first time. The delay doubles with each attempt, up to
+// MAX_REPLICATION_RETRY_DELAY.
+const REPLICATION_RETRY_DELAY = 5 * time.Minute
+
+// The longest the replicator waits between attempts to copy a file.
+const MAX_REPLICATION_RETRY_DELAY = 4 * time.Hour
+
+// ReplicationStorage is the part of the S3Client that ReplicaCopier
+// needs. It's an interface so the copy and verification logic can
+// be tested without S3.
+type ReplicationStorage interface {
+	Head(bucketName, key string) (*http.Response, error)
+	GetReader(bucketName, key string) (io.ReadCloser, error)
+	Copy(sourceBucket, sourceKey, destBucket, destKey string) error
+	SaveToS3(bucketName, fileName, contentType string, reader io.Reader, byteCount int64, options s3.Options) (string, error)
+}
+
+// ReplicaCopier copies preservation files to the replication bucket,
+// which is in another region, and verifies the copies.
+type ReplicaCopier struct {
+	// Source reads from the preservation bucket.
+	Source       ReplicationStorage
+	SourceBucket string
+
+	// Dest writes to the replication bucket.
+	Dest         ReplicationStorage
+	DestBucket   string
+
+	// SameAccount means both buckets belong to the same AWS account,
+	// so Dest can copy files from the preservation bucket without
+	// downloading them.
+	SameAccount  bool
+}
+
+// Copy copies key from the preservation bucket to the same key in
+// the replication bucket and returns the URL of the copy. Param size
+// is the number of bytes stored in the preservation bucket, which
+// for encrypted files is the size of the ciphertext. Param options
+// carries the metadata for streamed copies. Server-side copies keep
+// the metadata of the original.
+//
+// Files larger than S3_LARGE_FILE can't go through a single PUT or
+// PUT COPY. The caller has to download those and send them with
+// S3Client.SaveLargeFileToS3.
+func (copier *ReplicaCopier) Copy(key, contentType string, size int64, options s3.Options) (string, error) {
+	if size > S3_LARGE_FILE {
+		return "", fmt.Errorf("Cannot copy %s directly: it's %d bytes, and the limit is %d",
+			key, size, S3_LARGE_FILE)
+	}
+	if copier.SameAccount {
+		err := copier.Dest.Copy(copier.SourceBucket, key, copier.DestBucket, key)
+		if err != nil {
+			return "", fmt.Errorf("Error copying %s from %s to %s: %v",
+				key, copier.SourceBucket, copier.DestBucket, err)
+		}
+		return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", copier.DestBucket, key), nil
+	}
+	reader, err := copier.Source.GetReader(copier.SourceBucket, key)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read %s from %s: %v", key, copier.SourceBucket, err)
+	}
+	defer reader.Close()
+	return copier.Dest.SaveToS3(copier.DestBucket, key, contentType, reader, size, options)
+}
+
+// Verify checks that the replication copy of key has size bytes and
+// the same md5 digest as the preservation copy. S3 calculates the
+// ETags of both copies, so when they're comparable, this doesn't
+// have to read either file. Multipart uploads have ETags that
+// depend on the part size, so if the ETags don't match and either
+// is from a multipart upload, this reads both files to compare
+// their digests.
+func (copier *ReplicaCopier) Verify(key string, size int64) (error) {
+	sourceSize, sourceETag, err := headSizeAndETag(copier.Source, copier.SourceBucket, key)
+	if err != nil {
+		return err
+	}
+	destSize, destETag, err := headSizeAndETag(copier.Dest, copier.DestBucket, key)
+	if err != nil {
+		return err
+	}
+	if sourceSize != size {
+		return fmt.Errorf("%s/%s is %d bytes, expected %d",
+			copier.SourceBucket, key, sourceSize, size)
+	}
+	if destSize != size {
+		return fmt.Errorf("Replication copy %s/%s is %d bytes, expected %d",
+			copier.DestBucket, key, destSize, size)
+	}
+	if sourceETag == destETag {
+		return nil
+	}
+	if !isMultipartETag(sourceETag) && !isMultipartETag(destETag) {
+		return fmt.Errorf("Replication copy %s/%s has md5 %s, but %s/%s has md5 %s",
+			copier.DestBucket, key, destETag, copier.SourceBucket, key, sourceETag)
+	}
+	sourceMd5, err := streamMd5(copier.Source, copier.SourceBucket, key)
+	if err != nil {
+		return err
+	}
+	destMd5, err := streamMd5(copier.Dest, copier.DestBucket, key)
+	if err != nil {
+		return err
+	}
+	if sourceMd5 != destMd5 {
+		return fmt.Errorf("Replication copy %s/%s has md5 %s, but %s/%s has md5 %s",
+			copier.DestBucket, key, destMd5, copier.SourceBucket, key, sourceMd5)
+	}
+	return nil
+}
+
+// Returns the size and ETag of bucketName/key, without quotes.
+func headSizeAndETag(storage ReplicationStorage, bucketName, key string) (int64, string, error) {
+	resp, err := storage.Head(bucketName, key)
+	if err != nil {
+		return 0, "", fmt.Errorf("Head request for %s/%s returned error: %v",
+			bucketName, key, err)
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	if resp.StatusCode != 200 {
+		return 0, "", fmt.Errorf("Head request for %s/%s returned HTTP Status Code %d",
+			bucketName, key, resp.StatusCode)
+	}
+	return resp.ContentLength, strings.Trim(resp.Header.Get("ETag"), "\""), nil
+}
+
+// The ETag of a multipart upload is the md5 of its parts' md5s,
+// followed by a dash and the number of parts.
+func isMultipartETag(etag string) (bool) {
+	return strings.Contains(etag, "-")
+}
+
+// Reads bucketName/key and returns its md5 digest.
+func streamMd5(storage ReplicationStorage, bucketName, key string) (string, error) {
+	reader, err := storage.GetReader(bucketName, key)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read %s/%s: %v", bucketName, key, err)
+	}
+	defer reader.Close()
+	md5Hash := md5.New()
+	if _, err = io.Copy(md5Hash, reader); err != nil {
+		return "", fmt.Errorf("Error reading %s/%s: %v", bucketName, key, err)
+	}
+	return fmt.Sprintf("%x", md5Hash.Sum(nil)), nil
+}
+
+// ReplicationRetryDelay returns how long to wait before the next
+// attempt to replicate a file, after attempts failed attempts.
+func ReplicationRetryDelay(attempts uint16) (time.Duration) {
+	delay := REPLICATION_RETRY_DELAY
+	for i := uint16(1); i < attempts && delay < MAX_REPLICATION_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_REPLICATION_RETRY_DELAY {
+		delay = MAX_REPLICATION_RETRY_DELAY
+	}
+	return delay
+}
+
+// LaggingFile is a file that has been in preservation storage
+// longer than the lag threshold, with no replication copy.
+type LaggingFile struct {
+	Identifier string        `json:"identifier"`
+	URI        string        `json:"uri"`
+	Size       int64         `json:"size"`
+	StoredAt   time.Time     `json:"stored_at"`
+	Lag        time.Duration `json:"lag"`
+}
+
+// ReplicationLagReport lists the files that have gone too long
+// without a replication copy, oldest first.
+type ReplicationLagReport struct {
+	GeneratedAt time.Time      `json:"generated_at"`
+	Threshold   time.Duration  `json:"threshold"`
+	Files       []*LaggingFile `json:"files"`
+	TotalBytes  int64          `json:"total_bytes"`
+}
+
+// NewReplicationLagReport returns a report of the files that were
+// stored more than threshold before now and have not been
+// replicated. Deleted files are left out.
+func NewReplicationLagReport(files []*GenericFile, threshold time.Duration, now time.Time) (*ReplicationLagReport) {
+	report := &ReplicationLagReport{
+		GeneratedAt: now.UTC(),
+		Threshold:   threshold,
+		Files:       make([]*LaggingFile, 0),
+	}
+	for _, gf := range files {
+		if gf.IsReplicated() || gf.State == StateDeleted {
+			continue
+		}
+		storedAt := gf.StoredAt()
+		lag := now.Sub(storedAt)
+		if lag <= threshold {
+			continue
+		}
+		report.Files = append(report.Files, &LaggingFile{
+			Identifier: gf.Identifier,
+			URI:        gf.URI,
+			Size:       gf.Size,
+			StoredAt:   storedAt.UTC(),
+			Lag:        lag,
+		})
+		report.TotalBytes += gf.Size
+	}
+	sort.Sort(laggingFilesByLag(report.Files))
+	return report
+}
+
+type laggingFilesByLag []*LaggingFile
+
+func (s laggingFilesByLag) Len() int      { return len(s) }
+func (s laggingFilesByLag) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s laggingFilesByLag) Less(i, j int) bool {
+	if s[i].Lag != s[j].Lag {
+		return s[i].Lag > s[j].Lag
+	}
+	return s[i].Identifier < s[j].Identifier
+}
@@ -0,0 +1,264 @@
+package bagman_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/s3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRegion is an in-memory S3 region. Regions in the same fake
+// account can copy objects from each other without downloading them.
+type fakeRegion struct {
+	objects  map[string][]byte
+	etags    map[string]string
+	metadata map[string]map[string][]string
+	account  []*fakeRegion
+	reads    int
+	copies   int
+	puts     int
+}
+
+func newFakeRegions() (*fakeRegion, *fakeRegion) {
+	east := &fakeRegion{
+		objects:  make(map[string][]byte),
+		etags:    make(map[string]string),
+		metadata: make(map[string]map[string][]string),
+	}
+	west := &fakeRegion{
+		objects:  make(map[string][]byte),
+		etags:    make(map[string]string),
+		metadata: make(map[string]map[string][]string),
+	}
+	east.account = []*fakeRegion{east, west}
+	west.account = []*fakeRegion{east, west}
+	return east, west
+}
+
+func (region *fakeRegion) put(bucket, key string, data []byte) {
+	region.objects[bucket+"/"+key] = data
+	region.etags[bucket+"/"+key] = fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func (region *fakeRegion) Head(bucketName, key string) (*http.Response, error) {
+	data, exists := region.objects[bucketName+"/"+key]
+	if !exists {
+		return &http.Response{StatusCode: 404, Header: http.Header{}}, nil
+	}
+	header := http.Header{}
+	header.Set("ETag", "\""+region.etags[bucketName+"/"+key]+"\"")
+	return &http.Response{StatusCode: 200, Header: header, ContentLength: int64(len(data))}, nil
+}
+
+func (region *fakeRegion) GetReader(bucketName, key string) (io.ReadCloser, error) {
+	data, exists := region.objects[bucketName+"/"+key]
+	if !exists {
+		return nil, fmt.Errorf("The specified key does not exist.")
+	}
+	region.reads++
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (region *fakeRegion) Copy(sourceBucket, sourceKey, destBucket, destKey string) error {
+	for _, other := range region.account {
+		if data, exists := other.objects[sourceBucket+"/"+sourceKey]; exists {
+			region.copies++
+			region.objects[destBucket+"/"+destKey] = data
+			region.etags[destBucket+"/"+destKey] = other.etags[sourceBucket+"/"+sourceKey]
+			return nil
+		}
+	}
+	return fmt.Errorf("The specified key does not exist.")
+}
+
+func (region *fakeRegion) SaveToS3(bucketName, fileName, contentType string, reader io.Reader, byteCount int64, options s3.Options) (string, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) != byteCount {
+		return "", fmt.Errorf("Expected %d bytes, got %d", byteCount, len(data))
+	}
+	region.puts++
+	region.put(bucketName, fileName, data)
+	region.metadata[bucketName+"/"+fileName] = options.Meta
+	return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", bucketName, fileName), nil
+}
+
+const replicationKey = "9a8bf6f2-50ef-4cf4-a0c1-b0e6ff6c3b2d"
+
+var replicationData = []byte("Pretend this is a preservation file")
+
+func replicaCopier(sameAccount bool) (*bagman.ReplicaCopier, *fakeRegion, *fakeRegion) {
+	east, west := newFakeRegions()
+	east.put("preservation", replicationKey, replicationData)
+	copier := &bagman.ReplicaCopier{
+		Source:       east,
+		SourceBucket: "preservation",
+		Dest:         west,
+		DestBucket:   "preservation.oregon",
+		SameAccount:  sameAccount,
+	}
+	return copier, east, west
+}
+
+func TestReplicaCopierServerSideCopy(t *testing.T) {
+	copier, east, west := replicaCopier(true)
+	url, err := copier.Copy(replicationKey, "text/plain", int64(len(replicationData)), s3.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://s3.amazonaws.com/preservation.oregon/"+replicationKey {
+		t.Errorf("Unexpected replication URL %s", url)
+	}
+	if west.copies != 1 || west.puts != 0 || east.reads != 0 {
+		t.Errorf("Same-account copy should happen within S3: %d copies, %d puts, %d reads",
+			west.copies, west.puts, east.reads)
+	}
+	if err = copier.Verify(replicationKey, int64(len(replicationData))); err != nil {
+		t.Errorf("Verify failed on good copy: %v", err)
+	}
+}
+
+func TestReplicaCopierStreamedCopy(t *testing.T) {
+	copier, east, west := replicaCopier(false)
+	options := s3.Options{Meta: map[string][]string{"institution": []string{"uc.edu"}}}
+	url, err := copier.Copy(replicationKey, "text/plain", int64(len(replicationData)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://s3.amazonaws.com/preservation.oregon/"+replicationKey {
+		t.Errorf("Unexpected replication URL %s", url)
+	}
+	if west.copies != 0 || west.puts != 1 || east.reads != 1 {
+		t.Errorf("Cross-account copy should stream: %d copies, %d puts, %d reads",
+			west.copies, west.puts, east.reads)
+	}
+	if west.metadata["preservation.oregon/"+replicationKey]["institution"][0] != "uc.edu" {
+		t.Errorf("Streamed copy lost its metadata")
+	}
+	if err = copier.Verify(replicationKey, int64(len(replicationData))); err != nil {
+		t.Errorf("Verify failed on good copy: %v", err)
+	}
+}
+
+func TestReplicaCopierRejectsLargeFiles(t *testing.T) {
+	copier, _, _ := replicaCopier(true)
+	_, err := copier.Copy(replicationKey, "text/plain", bagman.S3_LARGE_FILE+1, s3.Options{})
+	if err == nil {
+		t.Errorf("Copy should reject files larger than S3_LARGE_FILE")
+	}
+}
+
+func TestReplicaCopierVerify(t *testing.T) {
+	size := int64(len(replicationData))
+	corrupt := bytes.ToUpper(replicationData)
+	testCases := []struct {
+		description string
+		setup       func(east, west *fakeRegion)
+		size        int64
+		errContains string
+	}{
+		{"good copy", func(east, west *fakeRegion) {
+			west.put("preservation.oregon", replicationKey, replicationData)
+		}, size, ""},
+		{"missing copy", func(east, west *fakeRegion) {}, size, "404"},
+		{"truncated copy", func(east, west *fakeRegion) {
+			west.put("preservation.oregon", replicationKey, replicationData[1:])
+		}, size, "Replication copy"},
+		{"wrong expected size", func(east, west *fakeRegion) {
+			west.put("preservation.oregon", replicationKey, replicationData)
+		}, size + 1, "expected"},
+		{"corrupt copy", func(east, west *fakeRegion) {
+			west.put("preservation.oregon", replicationKey, corrupt)
+		}, size, "has md5"},
+		{"multipart copy", func(east, west *fakeRegion) {
+			west.put("preservation.oregon", replicationKey, replicationData)
+			west.etags["preservation.oregon/"+replicationKey] = "0123456789abcdef-3"
+		}, size, ""},
+		{"corrupt multipart copy", func(east, west *fakeRegion) {
+			west.put("preservation.oregon", replicationKey, corrupt)
+			west.etags["preservation.oregon/"+replicationKey] = "0123456789abcdef-3"
+		}, size, "has md5"},
+	}
+	for _, testCase := range testCases {
+		copier, east, west := replicaCopier(false)
+		testCase.setup(east, west)
+		err := copier.Verify(replicationKey, testCase.size)
+		if testCase.errContains == "" && err != nil {
+			t.Errorf("%s: Verify returned error: %v", testCase.description, err)
+		} else if testCase.errContains != "" && (err == nil || !strings.Contains(err.Error(), testCase.errContains)) {
+			t.Errorf("%s: expected error containing '%s', got %v", testCase.description,
+				testCase.errContains, err)
+		}
+	}
+}
+
+func TestReplicationRetryDelay(t *testing.T) {
+	expected := map[uint16]time.Duration{
+		0:  5 * time.Minute,
+		1:  5 * time.Minute,
+		2:  10 * time.Minute,
+		3:  20 * time.Minute,
+		6:  160 * time.Minute,
+		7:  bagman.MAX_REPLICATION_RETRY_DELAY,
+		50: bagman.MAX_REPLICATION_RETRY_DELAY,
+	}
+	for attempts, delay := range expected {
+		if bagman.ReplicationRetryDelay(attempts) != delay {
+			t.Errorf("After %d attempts, expected delay %s, got %s", attempts,
+				delay, bagman.ReplicationRetryDelay(attempts))
+		}
+	}
+}
+
+func storedFile(identifier string, storedAt time.Time, size int64) (*bagman.GenericFile) {
+	return &bagman.GenericFile{
+		Identifier: identifier,
+		Size:       size,
+		State:      bagman.StateActive,
+		Events: []*bagman.PremisEvent{
+			&bagman.PremisEvent{EventType: "ingest", DateTime: storedAt},
+		},
+	}
+}
+
+func TestReplicationLagReport(t *testing.T) {
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)
+	replicated := storedFile("test.edu/bag/data/replicated.txt", now.Add(-72*time.Hour), 100)
+	replicated.ReplicationURL = "https://s3.amazonaws.com/preservation.oregon/1234"
+	deleted := storedFile("test.edu/bag/data/deleted.txt", now.Add(-72*time.Hour), 100)
+	deleted.State = bagman.StateDeleted
+	files := []*bagman.GenericFile{
+		storedFile("test.edu/bag/data/recent.txt", now.Add(-1*time.Hour), 100),
+		storedFile("test.edu/bag/data/lagging.txt", now.Add(-30*time.Hour), 200),
+		storedFile("test.edu/bag/data/oldest.txt", now.Add(-96*time.Hour), 300),
+		replicated,
+		deleted,
+	}
+	report := bagman.NewReplicationLagReport(files, 24*time.Hour, now)
+	if len(report.Files) != 2 {
+		t.Fatalf("Expected 2 lagging files, got %d", len(report.Files))
+	}
+	if report.Files[0].Identifier != "test.edu/bag/data/oldest.txt" ||
+		report.Files[1].Identifier != "test.edu/bag/data/lagging.txt" {
+		t.Errorf("Lagging files should be listed oldest first: %s, %s",
+			report.Files[0].Identifier, report.Files[1].Identifier)
+	}
+	if report.Files[0].Lag != 96*time.Hour {
+		t.Errorf("Expected lag of 96h, got %s", report.Files[0].Lag)
+	}
+	if report.TotalBytes != 500 {
+		t.Errorf("Expected 500 lagging bytes, got %d", report.TotalBytes)
+	}
+	if !report.GeneratedAt.Equal(now) || report.Threshold != 24*time.Hour {
+		t.Errorf("Report has wrong time or threshold")
+	}
+}
@@ -7,12 +7,14 @@ package bagman
 
 import (
 	"archive/tar"
+	"crypto/sha256"
 	"fmt"
 	"github.com/APTrust/bagins"
-	"github.com/nsqio/go-nsq"
 	"github.com/crowdmob/goamz/aws"
 	"github.com/crowdmob/goamz/s3"
 	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -115,6 +117,14 @@ type BagRestorer struct {
 	// which runs on test.aptrust.org. Note that
 	// customRestoreBucket overrides this.
 	restoreToTestBuckets  bool
+	// keyWrapper unwraps the data keys of encrypted files.
+	// It must have the institution's private key. If this is
+	// nil, we can't restore objects with encrypted files.
+	keyWrapper            KeyWrapper
+	// eventHistory is the object with its events and its files'
+	// events. If it's not nil, each bag we restore includes the
+	// event history of its files in EventHistoryTagFile.
+	eventHistory          *IntellectualObject
 }
 
 // Creates a new bag restorer from the intellectual object.
@@ -177,6 +187,20 @@ func (restorer *BagRestorer) GetBagPadding() (int64) {
 	return restorer.bagPadding
 }
 
+// Sets the KeyWrapper that unwraps the data keys for encrypted
+// files. This is required if any of the object's files are encrypted.
+func (restorer *BagRestorer) SetKeyWrapper(keyWrapper KeyWrapper) {
+	restorer.keyWrapper = keyWrapper
+}
+
+// Sets the object whose event history restored bags should include.
+// Param obj must include its events and its files' events, as
+// FluctusClient.IntellectualObjectGet returns when includeRelations
+// is true. If obj is nil, restored bags don't include event history.
+func (restorer *BagRestorer) SetEventHistory(obj *IntellectualObject) {
+	restorer.eventHistory = obj
+}
+
 func (restorer *BagRestorer) SetCustomRestoreBucket (bucketName string) {
 	restorer.customRestoreBucket = bucketName
 }
@@ -296,6 +320,13 @@ func (restorer *BagRestorer) buildBag(setNumber, numberOfBagParts int) (*bagins.
 	 	return nil, err
 	}
 
+	if restorer.eventHistory != nil {
+		err = restorer.writeEventHistoryTagFile(bag, bagName, setNumber)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create %s: %v", EventHistoryTagFile, err)
+		}
+	}
+
 	// Add the fetched files to the bag.
 	for _, fileName := range filesFetched {
 		pathWithinBag := restorer.PathWithinBag(fileName, bagName)
@@ -360,10 +391,12 @@ func (restorer *BagRestorer) writeAPTrustTagFile(bag *bagins.Bag) (error) {
 	if err != nil {
 		return err
 	}
-	tagFile.Data.AddField(*bagins.NewTagField("Title", restorer.IntellectualObject.Title))
-	tagFile.Data.AddField(*bagins.NewTagField("Access", restorer.IntellectualObject.Access))
-	if restorer.IntellectualObject.Description != "" {
-		tagFile.Data.AddField(*bagins.NewTagField("Description", restorer.IntellectualObject.Description))
+	tags, err := restorer.IntellectualObject.APTrustInfoTags()
+	if err != nil {
+		return fmt.Errorf("Cannot restore %s: %v", restorer.IntellectualObject.Identifier, err)
+	}
+	for _, tag := range tags {
+		tagFile.Data.AddField(*bagins.NewTagField(tag.Label, tag.Value))
 	}
 	return nil
 }
@@ -386,7 +419,7 @@ func (restorer *BagRestorer) writeBagInfoTagFile(bag *bagins.Bag, setNumber, num
 	tagFile.Data.AddField(*bagins.NewTagField(
 		"Source-Organization", instName))
 	tagFile.Data.AddField(*bagins.NewTagField(
-		"Bagging-Date", time.Now().UTC().Format(time.RFC3339)))
+		"Bagging-Date", FormatUTC(time.Now())))
 	tagFile.Data.AddField(*bagins.NewTagField(
 		"Bag-Count", bagCount))
 	tagFile.Data.AddField(*bagins.NewTagField(
@@ -395,9 +428,60 @@ func (restorer *BagRestorer) writeBagInfoTagFile(bag *bagins.Bag, setNumber, num
 		"Internal-Sender-Description", restorer.IntellectualObject.Description))
 	tagFile.Data.AddField(*bagins.NewTagField(
 		"Internal-Sender-Identifier", bagNameWithoutInst))
+	if restorer.eventHistory != nil {
+		tagFile.Data.AddField(*bagins.NewTagField(
+			EventHistoryTag, EventHistoryTagFile))
+	}
+	return nil
+}
+
+// Writes the event history of the object and the files in this bag
+// to EventHistoryTagFile, and adds it to the tag manifest. If we're
+// restoring the original bag-info.txt, this notes the event history
+// there too.
+func (restorer *BagRestorer) writeEventHistoryTagFile(bag *bagins.Bag, bagName string, setNumber int) (error) {
+	restorer.debug(fmt.Sprintf("Creating %s", EventHistoryTagFile))
+	entries := EventHistory(restorer.eventHistory, restorer.fileSets[setNumber].Files)
+	data, err := RenderEventHistory(entries)
+	if err != nil {
+		return err
+	}
+	filePath := filepath.Join(restorer.workingDir, bagName, EventHistoryTagFile)
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filePath, data, 0644); err != nil {
+		return err
+	}
+	if err = bag.AddCustomTagfile(filePath, EventHistoryTagFile, true); err != nil {
+		return err
+	}
+	bagInfoPath := filepath.Join(restorer.workingDir, bagName, "bag-info.txt")
+	if restorer.foundBagInfo && FileExists(bagInfoPath) {
+		return appendTag(bagInfoPath, EventHistoryTag, EventHistoryTagFile)
+	}
 	return nil
 }
 
+// Appends a tag to the end of the tag file at filePath.
+func appendTag(filePath, label, value string) (error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	tag := fmt.Sprintf("%s: %s\n", label, value)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		tag = "\n" + tag
+	}
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(tag)
+	return err
+}
+
 // Fetches all of the data files for a bag.
 func (restorer *BagRestorer) fetchAllFiles(setNumber int) ([]string, error) {
 	fileSet := restorer.fileSets[setNumber]
@@ -444,17 +528,72 @@ func (restorer *BagRestorer) fetchFile(genericFile *GenericFile, setNumber int)
 	// transient. For fatal errors, Retry will be set to false. We'll break
 	// out of this loop if 1) fetch succeeded (no error) or 2) fetch failed
 	// on a fatal error (Retry == false).
+	fetchPath := localPath
+	if genericFile.IsEncrypted() {
+		if restorer.keyWrapper == nil {
+			return &FetchResult{
+				Key:          genericFile.URI,
+				ErrorMessage: "File is encrypted, and no key is configured to decrypt it",
+				Retry:        false,
+			}
+		}
+		fetchPath = localPath + ".encrypted"
+	}
 	var fetchResult *FetchResult
 	for i := 0; i < 5; i++ {
-		fetchResult = restorer.s3Client.FetchURLToFile(genericFile.URI, localPath)
+		fetchResult = restorer.s3Client.FetchURLToFile(genericFile.URI, fetchPath)
 		if (fetchResult.ErrorMessage == "" ||
 			(fetchResult.ErrorMessage != "" && fetchResult.Retry == false)) {
                        break
 		}
 	}
+	if genericFile.IsEncrypted() && fetchResult.ErrorMessage == "" {
+		err := restorer.decryptFile(genericFile, fetchPath, localPath)
+		os.Remove(fetchPath)
+		if err != nil {
+			fetchResult.ErrorMessage = err.Error()
+			fetchResult.Retry = false
+		}
+		fetchResult.LocalFile = localPath
+	}
        return fetchResult
 }
 
+// Decrypts the encrypted file at encryptedPath into plainPath, and
+// checks that the plaintext matches the sha256 digest in Fedora.
+func (restorer *BagRestorer) decryptFile(genericFile *GenericFile, encryptedPath, plainPath string) (error) {
+	restorer.debug(fmt.Sprintf("Decrypting %s", genericFile.Identifier))
+	dataKey, err := genericFile.Encryption.UnwrapDataKey(restorer.keyWrapper)
+	if err != nil {
+		return fmt.Errorf("Cannot unwrap data key for %s: %v", genericFile.Identifier, err)
+	}
+	src, err := os.Open(encryptedPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(plainPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	shaHash := sha256.New()
+	_, err = DecryptStream(io.MultiWriter(dst, shaHash), src, dataKey,
+		genericFile.Encryption.ChunkSize)
+	if err != nil {
+		os.Remove(plainPath)
+		return fmt.Errorf("Cannot decrypt %s: %v", genericFile.Identifier, err)
+	}
+	checksum := genericFile.GetChecksum("sha256")
+	digest := fmt.Sprintf("%x", shaHash.Sum(nil))
+	if checksum != nil && checksum.Digest != digest {
+		os.Remove(plainPath)
+		return fmt.Errorf("Decrypted %s has sha256 digest %s, but Fedora says it should be %s",
+			genericFile.Identifier, digest, checksum.Digest)
+	}
+	return nil
+}
+
 // Deletes a single bag created by Restore()
 func (restorer *BagRestorer) cleanup(setNumber int) {
 	bagDir := filepath.Join(restorer.workingDir, restorer.bagName(setNumber))
@@ -533,6 +672,17 @@ func (restorer *BagRestorer) TarBag(setNumber int) (string, error) {
 		}
 	}
 
+	if restorer.eventHistory != nil {
+		filePath := filepath.Join(bagPath, EventHistoryTagFile)
+		pathWithinArchive := filepath.Join(bagNameWithoutInstPrefix, EventHistoryTagFile)
+		err = AddToArchive(tarWriter, filePath, pathWithinArchive)
+		if err != nil {
+			tarFile.Close()
+			os.Remove(tarFilePath)
+			return "", err
+		}
+	}
+
 	// Add all the generic files
 	for _, gf := range restorer.fileSets[setNumber].Files {
 		gfPath, _ := gf.OriginalPath()
@@ -615,11 +765,11 @@ func (restorer *BagRestorer) CopyToS3(setNumber int) (string, error) {
 
 // Restores a bag (including multi-part bags), publishes them to the
 // restoration bucket, and returns the URLs to access them.
-// Param message is an NSQ message and may be nil. In production, we
+// Param message may be nil. In production, we
 // want this param, because we need to remind NSQ frequently that
 // we're still working on the message. Otherwise, NSQ thinks the
 // message timed out.
-func (restorer *BagRestorer) RestoreAndPublish(message *nsq.Message) (urls []string, err error) {
+func (restorer *BagRestorer) RestoreAndPublish(message Message) (urls []string, err error) {
 	// Make sure we clean up, no matter what happens.
 	defer restorer.Cleanup()
 	restorer.touch(message)
@@ -657,8 +807,32 @@ func (restorer *BagRestorer) RestoreAndPublish(message *nsq.Message) (urls []str
 	return urls, nil
 }
 
+// PresignedDownloadNote returns a note for the ProcessStatus of a
+// restoration, with a time-limited download link for each of the
+// restored bags. Param urls should be the URLs returned by
+// RestoreAndPublish. The restoration buckets are private, so
+// depositors need these links to get their bags.
+func PresignedDownloadNote(client *S3Client, urls []string, expires time.Duration) (string, error) {
+	if len(urls) == 0 {
+		return "", fmt.Errorf("No restored bag URLs to presign")
+	}
+	signedUrls := make([]string, len(urls))
+	for i, s3Url := range urls {
+		if !strings.HasPrefix(s3Url, S3UriPrefix) || strings.Count(s3Url, "/") < 4 {
+			return "", fmt.Errorf("'%s' is not a valid S3 URL", s3Url)
+		}
+		bucketName, key := BucketNameAndKey(s3Url)
+		signedUrl, err := client.PresignGet(bucketName, key, expires)
+		if err != nil {
+			return "", err
+		}
+		signedUrls[i] = signedUrl
+	}
+	return restoreDownloadNote(time.Now().Add(expires), signedUrls...), nil
+}
+
 // Try to avoid problem with NSQ timeouts.
-func (restorer *BagRestorer) touch(message *nsq.Message) {
+func (restorer *BagRestorer) touch(message Message) {
 	if message != nil {
 		message.Touch()
 	}
@@ -11,7 +11,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 
@@ -530,3 +532,37 @@ func cleanupRestorationBucket (s3Client *bagman.S3Client) {
 	s3Client.Delete("aptrust.test.restore", "cin.675812.b0001.of0002.tar")
 	s3Client.Delete("aptrust.test.restore", "cin.675812.b0002.of0002.tar")
 }
+
+func TestPresignedDownloadNote(t *testing.T) {
+	s3Client, err := bagman.NewS3ClientExplicitAuth(aws.USEast, "Ax-S-Kee", "SeekritKee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{
+		"https://s3.amazonaws.com/aptrust.restore.test.edu/cin.675812.b0001.of0002.tar",
+		"https://s3.amazonaws.com/aptrust.restore.test.edu/cin.675812.b0002.of0002.tar",
+	}
+	note, err := bagman.PresignedDownloadNote(s3Client, urls, bagman.RESTORED_BAG_URL_LIFETIME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(bagman.RESTORED_BAG_URL_LIFETIME)
+	if !strings.HasPrefix(note, "Restored bag is available for download until") {
+		t.Errorf("Unexpected note: %s", note)
+	}
+	words := strings.Fields(note)
+	signedUrls := words[len(words)-2:]
+	for i, signedUrl := range signedUrls {
+		bucketName, key := bagman.BucketNameAndKey(urls[i])
+		checkPresignedUrl(t, signedUrl, bucketName, key, "Ax-S-Kee", "SeekritKee", expiration)
+	}
+
+	_, err = bagman.PresignedDownloadNote(s3Client, nil, time.Hour)
+	if err == nil {
+		t.Errorf("PresignedDownloadNote should fail with no URLs")
+	}
+	_, err = bagman.PresignedDownloadNote(s3Client, []string{"https://example.com/bag.tar"}, time.Hour)
+	if err == nil {
+		t.Errorf("PresignedDownloadNote should reject non-S3 URLs")
+	}
+}
@@ -0,0 +1,135 @@
+package bagman
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RestoreResult describes the result of reassembling the files
+// of a restored IntellectualObject into a single tarred bag
+// for the depositor.
+type RestoreResult struct {
+	// The identifier of the IntellectualObject we restored.
+	ObjectIdentifier string
+
+	// The name of the bag, which is also the name of the
+	// top-level folder inside the tar file.
+	BagName          string
+
+	// The path to the tar file we created.
+	TarFilePath      string
+
+	// The paths of the files we added to the tar file,
+	// relative to the top-level folder. For example,
+	// "data/images/photo_01.jpg".
+	FilesAdded       []string
+
+	// The original paths of GenericFiles we could not find
+	// in the source directory.
+	MissingFiles     []string
+
+	// A description of any error that occurred.
+	ErrorMessage     string
+}
+
+// ReassembleBag lays out the files of an IntellectualObject according
+// to their original paths in the bag, and tars them into destTarPath,
+// using the object's original bag name as the top-level folder.
+// This is used to put multipart bags back together for the depositor.
+//
+// Param srcDir is the directory containing the object's restored
+// files. Each file may be at srcDir/<original path> (e.g.
+// srcDir/data/images/photo_01.jpg), or it may be at srcDir/<uuid>,
+// where uuid is the file's name in the preservation bucket.
+//
+// If any files are missing from srcDir, this returns an error,
+// lists the missing files in RestoreResult.MissingFiles, and
+// does not leave a partial tar file behind.
+func ReassembleBag(obj *IntellectualObject, srcDir, destTarPath string) (*RestoreResult, error) {
+	if obj == nil {
+		return nil, fmt.Errorf("IntellectualObject cannot be nil")
+	}
+	result := &RestoreResult{
+		ObjectIdentifier: obj.Identifier,
+		BagName:          obj.OriginalBagName(),
+		TarFilePath:      destTarPath,
+		FilesAdded:       make([]string, 0),
+		MissingFiles:     make([]string, 0),
+	}
+
+	// Map original paths to source files, so we can add them
+	// to the tar file in a predictable order.
+	sourceFiles := make(map[string]string, len(obj.GenericFiles))
+	originalPaths := make([]string, 0, len(obj.GenericFiles))
+	for _, gf := range obj.GenericFiles {
+		origPath, err := gf.OriginalPath()
+		if err != nil {
+			result.ErrorMessage = err.Error()
+			return result, err
+		}
+		srcPath := findRestoredFile(gf, srcDir, origPath)
+		if srcPath == "" {
+			result.MissingFiles = append(result.MissingFiles, origPath)
+			continue
+		}
+		sourceFiles[origPath] = srcPath
+		originalPaths = append(originalPaths, origPath)
+	}
+	if len(result.MissingFiles) > 0 {
+		result.ErrorMessage = fmt.Sprintf("Cannot reassemble bag %s. "+
+			"The following files are missing from %s: %s",
+			result.BagName, srcDir, strings.Join(result.MissingFiles, ", "))
+		return result, errors.New(result.ErrorMessage)
+	}
+	sort.Strings(originalPaths)
+
+	tarFile, err := os.Create(destTarPath)
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("Error creating tar file: %v", err)
+		return result, errors.New(result.ErrorMessage)
+	}
+	tarWriter := tar.NewWriter(tarFile)
+	for _, origPath := range originalPaths {
+		// Tar files always use forward slashes.
+		pathWithinArchive := result.BagName + "/" + origPath
+		err = AddToArchive(tarWriter, sourceFiles[origPath], pathWithinArchive)
+		if err != nil {
+			tarFile.Close()
+			os.Remove(destTarPath)
+			result.ErrorMessage = err.Error()
+			return result, err
+		}
+		result.FilesAdded = append(result.FilesAdded, origPath)
+	}
+	if err = tarWriter.Close(); err == nil {
+		err = tarFile.Close()
+	} else {
+		tarFile.Close()
+	}
+	if err != nil {
+		os.Remove(destTarPath)
+		result.ErrorMessage = err.Error()
+		return result, err
+	}
+	return result, nil
+}
+
+// Returns the path to the restored copy of the GenericFile in
+// srcDir, or an empty string if we can't find it.
+func findRestoredFile(gf *GenericFile, srcDir, origPath string) string {
+	candidates := []string{filepath.Join(srcDir, filepath.FromSlash(origPath))}
+	if uuid, err := gf.PreservationStorageFileName(); err == nil && uuid != "" {
+		candidates = append(candidates, filepath.Join(srcDir, uuid))
+	}
+	for _, candidate := range candidates {
+		if fileInfo, err := os.Stat(candidate); err == nil && fileInfo.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
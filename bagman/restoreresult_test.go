@@ -0,0 +1,123 @@
+package bagman_test
+
+import (
+	"archive/tar"
+	"github.com/APTrust/bagman/bagman"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Builds an IntellectualObject whose files came from a multipart
+// bag, and writes the restored files into a temp directory. Some
+// files are written under their original paths, and one is written
+// under its preservation storage UUID. Caller should delete the
+// returned directory.
+func makeReassemblyFixture(t *testing.T) (*bagman.IntellectualObject, string) {
+	srcDir, err := ioutil.TempDir("", "reassemble_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objId := "test.edu/test.edu.multipart_bag"
+	storage := "https://s3.amazonaws.com/aptrust.test.preservation/"
+	obj := &bagman.IntellectualObject{
+		Identifier: objId,
+		GenericFiles: []*bagman.GenericFile{
+			&bagman.GenericFile{Identifier: objId + "/aptrust-info.txt",
+				URI: storage + "11111111-1111-1111-1111-111111111111"},
+			&bagman.GenericFile{Identifier: objId + "/data/file1.txt",
+				URI: storage + "22222222-2222-2222-2222-222222222222"},
+			&bagman.GenericFile{Identifier: objId + "/data/subdir/file2.txt",
+				URI: storage + "33333333-3333-3333-3333-333333333333"},
+		},
+	}
+	files := map[string]string{
+		"aptrust-info.txt":                     "Title: Multipart Bag\n",
+		"data/file1.txt":                       "This came from part one",
+		"33333333-3333-3333-3333-333333333333": "This came from part two",
+	}
+	for relPath, contents := range files {
+		absPath := filepath.Join(srcDir, relPath)
+		os.MkdirAll(filepath.Dir(absPath), 0755)
+		if err := ioutil.WriteFile(absPath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return obj, srcDir
+}
+
+func TestReassembleBag(t *testing.T) {
+	obj, srcDir := makeReassemblyFixture(t)
+	defer os.RemoveAll(srcDir)
+	tarPath := filepath.Join(srcDir, "test.edu.multipart_bag.tar")
+
+	result, err := bagman.ReassembleBag(obj, srcDir, tarPath)
+	if err != nil {
+		t.Errorf("ReassembleBag returned error: %v", err)
+		return
+	}
+	if result.BagName != "test.edu.multipart_bag" {
+		t.Errorf("Expected bag name 'test.edu.multipart_bag', got '%s'", result.BagName)
+	}
+	if len(result.FilesAdded) != 3 {
+		t.Errorf("Expected 3 files added, got %d", len(result.FilesAdded))
+	}
+
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		t.Errorf("Cannot open tar file: %v", err)
+		return
+	}
+	defer tarFile.Close()
+	tarReader := tar.NewReader(tarFile)
+	entries := make([]string, 0)
+	contents := make(map[string]string)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("Error reading tar file: %v", err)
+			return
+		}
+		entries = append(entries, header.Name)
+		data, _ := ioutil.ReadAll(tarReader)
+		contents[header.Name] = string(data)
+	}
+	sort.Strings(entries)
+	expected := []string{
+		"test.edu.multipart_bag/aptrust-info.txt",
+		"test.edu.multipart_bag/data/file1.txt",
+		"test.edu.multipart_bag/data/subdir/file2.txt",
+	}
+	if strings.Join(entries, ",") != strings.Join(expected, ",") {
+		t.Errorf("Tar file contains %v, expected %v", entries, expected)
+	}
+	if contents["test.edu.multipart_bag/data/subdir/file2.txt"] != "This came from part two" {
+		t.Errorf("File restored from UUID has wrong contents")
+	}
+}
+
+func TestReassembleBagMissingFile(t *testing.T) {
+	obj, srcDir := makeReassemblyFixture(t)
+	defer os.RemoveAll(srcDir)
+	os.Remove(filepath.Join(srcDir, "data", "file1.txt"))
+	tarPath := filepath.Join(srcDir, "test.edu.multipart_bag.tar")
+
+	result, err := bagman.ReassembleBag(obj, srcDir, tarPath)
+	if err == nil {
+		t.Errorf("ReassembleBag should have returned an error for missing file")
+	}
+	if result == nil || len(result.MissingFiles) != 1 ||
+		result.MissingFiles[0] != "data/file1.txt" {
+		t.Errorf("RestoreResult should list data/file1.txt as missing")
+	}
+	if bagman.FileExists(tarPath) {
+		t.Errorf("ReassembleBag should not leave a partial tar file behind")
+	}
+}
@@ -0,0 +1,170 @@
+package bagman
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChecksumMismatch describes a file whose digest does not match
+// the digest we expected, such as the one registered in Fluctus
+// or listed in the bag's manifest.
+type ChecksumMismatch struct {
+	// The path of the file within the bag, e.g. "data/file1.txt".
+	Path      string
+	// The digest algorithm. Empty means sha256.
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+// RestoreVerification describes the result of checking the payload
+// of a restored bag against the checksums registered in Fluctus.
+type RestoreVerification struct {
+	// The path to the restored tar file.
+	TarFilePath  string
+
+	// Paths of files whose sha256 digests matched.
+	Verified     []string
+
+	// Files whose sha256 digests did not match.
+	Mismatches   []*ChecksumMismatch
+
+	// Paths of expected files that were not in the tar file.
+	Missing      []string
+
+	// Paths of files that have no sha256 digest in Fluctus,
+	// so we could not verify them.
+	Unverifiable []string
+}
+
+// Returns true if every expected file was in the restored bag
+// and matched its registered sha256 digest.
+func (verification *RestoreVerification) Succeeded() (bool) {
+	return len(verification.Mismatches) == 0 &&
+		len(verification.Missing) == 0 &&
+		len(verification.Unverifiable) == 0
+}
+
+// Returns a description of the files that failed verification,
+// or an empty string if verification succeeded.
+func (verification *RestoreVerification) ErrorMessage() (string) {
+	messages := make([]string, 0)
+	for _, mismatch := range verification.Mismatches {
+		messages = append(messages, fmt.Sprintf("%s has sha256 %s, expected %s",
+			mismatch.Path, mismatch.Actual, mismatch.Expected))
+	}
+	if len(verification.Missing) > 0 {
+		messages = append(messages, fmt.Sprintf("Missing from restored bag: %s",
+			strings.Join(verification.Missing, ", ")))
+	}
+	if len(verification.Unverifiable) > 0 {
+		messages = append(messages, fmt.Sprintf("No sha256 on record for: %s",
+			strings.Join(verification.Unverifiable, ", ")))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// VerifyRestoredBag untars the restored bag at tarPath into a
+// temp directory, recalculates the sha256 digest of each expected
+// GenericFile, and compares it to the sha256 digest registered in
+// Fluctus. Do this before handing a restored bag to the depositor.
+//
+// Checksum mismatches and missing files are reported in the
+// RestoreVerification. The error return is for problems that
+// prevent verification, such as an unreadable tar file.
+func VerifyRestoredBag(tarPath string, expected []*GenericFile) (*RestoreVerification, error) {
+	verification := &RestoreVerification{
+		TarFilePath:  tarPath,
+		Verified:     make([]string, 0),
+		Mismatches:   make([]*ChecksumMismatch, 0),
+		Missing:      make([]string, 0),
+		Unverifiable: make([]string, 0),
+	}
+	tempDir, err := ioutil.TempDir("", "verify_restore")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create temp dir to verify restored bag: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	err = untarPayload(tarPath, tempDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, gf := range expected {
+		origPath, err := gf.OriginalPath()
+		if err != nil {
+			return nil, err
+		}
+		checksum := gf.GetChecksum("sha256")
+		if checksum == nil || checksum.Digest == "" {
+			verification.Unverifiable = append(verification.Unverifiable, origPath)
+			continue
+		}
+		localPath := filepath.Join(tempDir, filepath.FromSlash(origPath))
+		if !FileExists(localPath) {
+			verification.Missing = append(verification.Missing, origPath)
+			continue
+		}
+		fileDigest, err := CalculateDigests(localPath)
+		if err != nil {
+			return nil, err
+		}
+		if fileDigest.Sha256Digest == strings.ToLower(checksum.Digest) {
+			verification.Verified = append(verification.Verified, origPath)
+		} else {
+			verification.Mismatches = append(verification.Mismatches, &ChecksumMismatch{
+				Path:     origPath,
+				Expected: checksum.Digest,
+				Actual:   fileDigest.Sha256Digest,
+			})
+		}
+	}
+	return verification, nil
+}
+
+// Extracts the files in the tar file at tarPath into destDir,
+// stripping the top-level bag directory, so that data/file1.txt
+// in bag my_bag ends up at destDir/data/file1.txt.
+func untarPayload(tarPath, destDir string) (error) {
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("Cannot open restored bag '%s': %v", tarPath, err)
+	}
+	defer tarFile.Close()
+	tarReader := tar.NewReader(tarFile)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading restored bag '%s': %v", tarPath, err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		pathParts := strings.SplitN(header.Name, "/", 2)
+		if len(pathParts) < 2 {
+			return fmt.Errorf("File %s in restored bag should be in format dir/filename",
+				header.Name)
+		}
+		relPath := filepath.Clean(filepath.FromSlash(pathParts[1]))
+		if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) ||
+			filepath.IsAbs(relPath) {
+			return fmt.Errorf("File %s in restored bag points outside the bag", header.Name)
+		}
+		outputPath := filepath.Join(destDir, relPath)
+		if err = os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return fmt.Errorf("Cannot create directory for '%s': %v", outputPath, err)
+		}
+		if err = saveFile(outputPath, tarReader); err != nil {
+			return fmt.Errorf("Error extracting '%s' from restored bag: %v",
+				header.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package bagman_test
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Builds a restored bag from the reassembly fixture, and adds the
+// sha256 digest of each file's original contents to its GenericFile.
+// Returns the object, the path to the restored tar file, and the
+// source directory, which the caller should delete.
+func makeVerificationFixture(t *testing.T) (*bagman.IntellectualObject, string, string) {
+	obj, srcDir := makeReassemblyFixture(t)
+	originalContents := map[string]string{
+		"aptrust-info.txt":      "Title: Multipart Bag\n",
+		"data/file1.txt":        "This came from part one",
+		"data/subdir/file2.txt": "This came from part two",
+	}
+	for _, gf := range obj.GenericFiles {
+		origPath, _ := gf.OriginalPath()
+		digest := fmt.Sprintf("%x", sha256.Sum256([]byte(originalContents[origPath])))
+		gf.ChecksumAttributes = []*bagman.ChecksumAttribute{
+			&bagman.ChecksumAttribute{
+				Algorithm: "sha256",
+				DateTime:  time.Now(),
+				Digest:    digest,
+			},
+		}
+	}
+	tarPath := filepath.Join(srcDir, "test.edu.multipart_bag.tar")
+	if _, err := bagman.ReassembleBag(obj, srcDir, tarPath); err != nil {
+		os.RemoveAll(srcDir)
+		t.Fatal(err)
+	}
+	return obj, tarPath, srcDir
+}
+
+func TestVerifyRestoredBag(t *testing.T) {
+	obj, tarPath, srcDir := makeVerificationFixture(t)
+	defer os.RemoveAll(srcDir)
+	verification, err := bagman.VerifyRestoredBag(tarPath, obj.GenericFiles)
+	if err != nil {
+		t.Errorf("VerifyRestoredBag returned error: %v", err)
+		return
+	}
+	if !verification.Succeeded() {
+		t.Errorf("Verification should have succeeded: %s", verification.ErrorMessage())
+	}
+	if len(verification.Verified) != 3 {
+		t.Errorf("Expected 3 verified files, got %d", len(verification.Verified))
+	}
+}
+
+func TestVerifyRestoredBagCorruptFile(t *testing.T) {
+	obj, srcDir := makeReassemblyFixture(t)
+	defer os.RemoveAll(srcDir)
+	objWithChecksums, _, fixtureDir := makeVerificationFixture(t)
+	defer os.RemoveAll(fixtureDir)
+	obj.GenericFiles = objWithChecksums.GenericFiles
+
+	// Corrupt one of the files before tarring it up.
+	corruptPath := filepath.Join(srcDir, "data", "file1.txt")
+	err := ioutil.WriteFile(corruptPath, []byte("This came from part 1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarPath := filepath.Join(srcDir, "test.edu.multipart_bag.tar")
+	if _, err = bagman.ReassembleBag(obj, srcDir, tarPath); err != nil {
+		t.Fatal(err)
+	}
+
+	verification, err := bagman.VerifyRestoredBag(tarPath, obj.GenericFiles)
+	if err != nil {
+		t.Errorf("VerifyRestoredBag returned error: %v", err)
+		return
+	}
+	if verification.Succeeded() {
+		t.Errorf("Verification should have failed for corrupt file")
+	}
+	if len(verification.Mismatches) != 1 || verification.Mismatches[0].Path != "data/file1.txt" {
+		t.Errorf("Expected one mismatch for data/file1.txt, got %v", verification.Mismatches)
+	}
+	if len(verification.Verified) != 2 {
+		t.Errorf("Expected 2 verified files, got %d", len(verification.Verified))
+	}
+}
+
+// Writes a tar file with the named files, each containing its
+// own name, and returns its path.
+func writeVerificationTar(t *testing.T, dir string, names ...string) (string) {
+	tarPath := filepath.Join(dir, "test.edu.dotted_bag.tar")
+	tarFile, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	tarWriter := tar.NewWriter(tarFile)
+	for _, name := range names {
+		tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(name))})
+		tarWriter.Write([]byte(name))
+	}
+	if err = tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarPath
+}
+
+// Names that merely start with two dots are fine. Paths that
+// climb out of the bag are not.
+func TestVerifyRestoredBagDotDotPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify_dotdot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := "test.edu.dotted_bag/data/..notes.txt"
+	gf := &bagman.GenericFile{
+		Identifier: "test.edu/test.edu.dotted_bag/data/..notes.txt",
+		ChecksumAttributes: []*bagman.ChecksumAttribute{
+			&bagman.ChecksumAttribute{
+				Algorithm: "sha256",
+				DateTime:  time.Now(),
+				Digest:    fmt.Sprintf("%x", sha256.Sum256([]byte(name))),
+			},
+		},
+	}
+	tarPath := writeVerificationTar(t, dir, name)
+	verification, err := bagman.VerifyRestoredBag(tarPath, []*bagman.GenericFile{gf})
+	if err != nil {
+		t.Fatalf("VerifyRestoredBag rejected %s: %v", name, err)
+	}
+	if !verification.Succeeded() {
+		t.Errorf("Verification of %s should have succeeded: %s", name, verification.ErrorMessage())
+	}
+
+	tarPath = writeVerificationTar(t, dir, "test.edu.dotted_bag/../escaped.txt")
+	if _, err = bagman.VerifyRestoredBag(tarPath, nil); err == nil {
+		t.Errorf("VerifyRestoredBag should reject a path outside the bag")
+	}
+}
@@ -0,0 +1,50 @@
+package bagman
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RollbackStorage is the part of the S3Client that
+// RollbackStoredFiles needs. It's an interface so rollback
+// can be tested without S3.
+type RollbackStorage interface {
+	Delete(bucketName, key string) error
+}
+
+// RollbackStoredFiles deletes the files that a failed ingest stored
+// in the preservation bucket, so they aren't left there orphaned when
+// recording fails permanently. It deletes only the keys from
+// TarResult.StoredKeys, so it never touches copies stored by earlier
+// ingests. It tries to delete every key, even if some deletions fail,
+// and returns a CleanupResult describing each one. The error is non-nil
+// if any deletion failed.
+func RollbackStoredFiles(storage RollbackStorage, result *ProcessResult) (*CleanupResult, error) {
+	if result.TarResult == nil {
+		return nil, fmt.Errorf("Cannot roll back: result has no TarResult")
+	}
+	cleanupResult := &CleanupResult{
+		Files: result.TarResult.StoredKeys(),
+	}
+	if result.S3File != nil {
+		cleanupResult.BagName = result.S3File.Key.Key
+		cleanupResult.ETag = strings.Replace(result.S3File.Key.ETag, "\"", "", 2)
+		cleanupResult.BagDate, _ = ParseS3Time(result.S3File.Key.LastModified)
+		cleanupResult.ObjectIdentifier, _ = result.S3File.ObjectName()
+	}
+	failed := 0
+	for _, file := range cleanupResult.Files {
+		err := storage.Delete(file.BucketName, file.Key)
+		if err != nil {
+			file.ErrorMessage = err.Error()
+			failed++
+			continue
+		}
+		file.DeletedAt = NowUTC()
+	}
+	if failed > 0 {
+		return cleanupResult, fmt.Errorf("Could not delete %d of %d files stored for %s",
+			failed, len(cleanupResult.Files), cleanupResult.BagName)
+	}
+	return cleanupResult, nil
+}
@@ -0,0 +1,70 @@
+package bagman_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"path/filepath"
+	"testing"
+)
+
+type fakeRollbackStorage struct {
+	deleted []string
+	failKey string
+}
+
+func (storage *fakeRollbackStorage) Delete(bucketName, key string) error {
+	if key == storage.failKey {
+		return fmt.Errorf("Access denied")
+	}
+	storage.deleted = append(storage.deleted, bucketName + "/" + key)
+	return nil
+}
+
+func TestRollbackStoredFiles(t *testing.T) {
+	filepath := filepath.Join("testdata", "result_partial_store.json")
+	result, err := bagman.LoadResult(filepath)
+	if err != nil {
+		t.Fatalf("Error loading test data file '%s': %v", filepath, err)
+	}
+	storage := &fakeRollbackStorage{}
+	cleanupResult, err := bagman.RollbackStoredFiles(storage, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the two files this ingest stored are deleted.
+	expected := []string{
+		"aptrust.test.preservation/b21fdb34-1f79-4101-62c5-56918f4782fc",
+		"aptrust.test.preservation/cba60bd7-1d46-4d53-705f-2298e173bbf9",
+	}
+	if len(storage.deleted) != len(expected) {
+		t.Fatalf("Expected %d deletions, got %v", len(expected), storage.deleted)
+	}
+	for i := range expected {
+		if storage.deleted[i] != expected[i] {
+			t.Errorf("Expected to delete %s, deleted %s", expected[i], storage.deleted[i])
+		}
+	}
+	if cleanupResult.BagName != result.S3File.Key.Key || cleanupResult.ObjectIdentifier == "" {
+		t.Errorf("CleanupResult should describe the bag: %+v", cleanupResult)
+	}
+	if !cleanupResult.Succeeded() {
+		t.Errorf("CleanupResult should have succeeded")
+	}
+
+	// A failed deletion is recorded on its file, and the
+	// rest are still deleted.
+	storage = &fakeRollbackStorage{failKey: "b21fdb34-1f79-4101-62c5-56918f4782fc"}
+	cleanupResult, err = bagman.RollbackStoredFiles(storage, result)
+	if err == nil {
+		t.Errorf("RollbackStoredFiles should return an error when a deletion fails")
+	}
+	if len(storage.deleted) != 1 || len(cleanupResult.Files) != 2 {
+		t.Fatalf("Expected 1 deletion of 2 files, got %v", storage.deleted)
+	}
+	if cleanupResult.Files[0].Succeeded() || cleanupResult.Files[0].ErrorMessage != "Access denied" {
+		t.Errorf("First file should have failed with 'Access denied': %+v", cleanupResult.Files[0])
+	}
+	if !cleanupResult.Files[1].Succeeded() {
+		t.Errorf("Second file should have been deleted")
+	}
+}
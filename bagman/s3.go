@@ -1,9 +1,7 @@
 package bagman
 
 import (
-	"crypto/md5"
 	"crypto/sha256"
-	"hash"
 	"fmt"
 	"github.com/crowdmob/goamz/aws"
 	"github.com/crowdmob/goamz/s3"
@@ -12,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Constants
@@ -24,10 +23,55 @@ const (
 
 	// Chunk size for multipart puts to S3: ~500 MB
 	S3_CHUNK_SIZE = int64(500000000)
+
+	// How long restored bags remain available in the depositor's
+	// restoration bucket. The bucket's lifecycle rule does the actual
+	// deletion. We record the expiration date in the object metadata
+	// so depositors know how long they have to download the bag.
+	RESTORED_BAG_LIFETIME = 14 * 24 * time.Hour
+
+	// How long the presigned download links for restored bags
+	// remain valid. goamz signs these URLs with signature version
+	// 2, which has no limit on expiration, but signature version 4
+	// allows at most seven days, and regions opened since 2014
+	// accept only version 4. We use the version 4 limit now, so
+	// moving the bucket or the signing code doesn't shorten links
+	// depositors have come to expect. Depositors who need longer
+	// can ask for a new link before RESTORED_BAG_LIFETIME is up.
+	RESTORED_BAG_URL_LIFETIME = 7 * 24 * time.Hour
 )
 
 type S3Client struct {
 	S3 *s3.S3
+	// The maximum time a single S3 operation may take.
+	// Zero means no limit. See S3ClientConfig.OperationTimeout.
+	operationTimeout time.Duration
+	// The transport Configure set up. Operations with a timeout
+	// send their requests through this, so they can be cancelled.
+	transport        http.RoundTripper
+	// The size of the buffer FetchToFile reads into while it
+	// calculates the md5 digest. Zero means
+	// DEFAULT_DIGEST_BUFFER_SIZE. See Config.DigestBufferSize.
+	DigestBufferSize int
+}
+
+// S3TimeoutError is returned when an S3 operation takes longer
+// than the client's operation timeout. The fetch and store stages
+// retry it like any other network error, and ClassifyError reports
+// it as FailureS3Timeout.
+type S3TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+func (err *S3TimeoutError) Error() string {
+	return fmt.Sprintf("S3 %s operation timed out after %s", err.Operation, err.Timeout)
+}
+
+// Returns true if err is an S3TimeoutError.
+func IsS3Timeout(err error) (bool) {
+	_, isTimeout := err.(*S3TimeoutError)
+	return isTimeout
 }
 
 // Returns an S3Client for the specified region, using
@@ -55,6 +99,172 @@ func NewS3ClientExplicitAuth(region aws.Region, accessKey, secretKey string) (*S
 	return &S3Client{S3: s3Client}, nil
 }
 
+// Returns an S3Client for the specified region, using AWS credentials
+// from the environment and the connection pool and timeout settings
+// in s3Config.
+func NewS3ClientWithConfig(region aws.Region, s3Config S3ClientConfig) (*S3Client, error) {
+	client, err := NewS3Client(region)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Configure(s3Config)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Configure applies the connection pool and timeout settings
+// in s3Config to the client's underlying HTTP transport.
+func (client *S3Client) Configure(s3Config S3ClientConfig) (error) {
+	transport, err := s3Config.NewTransport()
+	if err != nil {
+		return err
+	}
+	dialTimeout, err := s3Config.DialTimeoutDuration()
+	if err != nil {
+		return err
+	}
+	operationTimeout, err := s3Config.OperationTimeoutDuration()
+	if err != nil {
+		return err
+	}
+	// Share one http.Client, so connections are actually pooled.
+	httpClient := &http.Client{Transport: transport}
+	client.S3.HTTPClient = func() *http.Client { return httpClient }
+	client.S3.ConnectTimeout = dialTimeout
+	client.operationTimeout = operationTimeout
+	client.transport = transport
+	return nil
+}
+
+// Runs an S3 operation on bucket, recording its stats in Metrics
+// under "s3.<operation>". If the client has an operation timeout,
+// and fn does not return in time, this cancels the operation's
+// requests, waits for fn to return, and returns an S3TimeoutError.
+// Cancelling also stops any response body that's still coming in,
+// but fn may have returned a body just as the time ran out, so
+// callers that get one must close it on error.
+// Param fn should use the bucket it's given, which is a copy of
+// bucket whose requests can be cancelled, and it should return the
+// number of bytes transferred.
+func (client *S3Client) runOperation(operation string, bucket *s3.Bucket, fn func(*s3.Bucket) (int64, error)) (error) {
+	start := time.Now()
+	metricName := "s3." + operation
+	if client.operationTimeout <= 0 {
+		bytes, err := fn(bucket)
+		Metrics.Record(metricName, time.Since(start), bytes, err)
+		return err
+	}
+	type opResult struct {
+		bytes int64
+		err   error
+	}
+	cancel := make(chan struct{})
+	done := make(chan opResult, 1)
+	go func() {
+		bytes, err := fn(client.cancelableBucket(bucket, cancel))
+		done <- opResult{bytes, err}
+	}()
+	select {
+	case result := <-done:
+		Metrics.Record(metricName, time.Since(start), result.bytes, result.err)
+		return result.err
+	case <-time.After(client.operationTimeout):
+		close(cancel)
+		<-done
+		err := &S3TimeoutError{Operation: operation, Timeout: client.operationTimeout}
+		Metrics.Record(metricName, time.Since(start), 0, err)
+		return err
+	}
+}
+
+// Returns a copy of bucket whose requests are cancelled when
+// cancel is closed.
+func (client *S3Client) cancelableBucket(bucket *s3.Bucket, cancel chan struct{}) (*s3.Bucket) {
+	transport := client.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpClient := &http.Client{
+		Transport: &cancelableTransport{transport: transport, cancel: cancel},
+	}
+	s3Copy := *bucket.S3
+	s3Copy.HTTPClient = func() *http.Client { return httpClient }
+	return s3Copy.Bucket(bucket.Name)
+}
+
+// cancelableTransport sends requests through transport, and
+// cancels them when cancel is closed.
+type cancelableTransport struct {
+	transport http.RoundTripper
+	cancel    chan struct{}
+}
+
+func (cancelable *cancelableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not change the request they're given.
+	reqCopy := *req
+	reqCopy.Cancel = cancelable.cancel
+	return cancelable.transport.RoundTrip(&reqCopy)
+}
+
+// Returns a reader for bucket/key. Bytes read from the reader
+// are added to the s3.get metrics.
+func (client *S3Client) getReader(bucket *s3.Bucket, key string) (io.ReadCloser, error) {
+	var readCloser io.ReadCloser
+	err := client.runOperation("get", bucket, func(bucket *s3.Bucket) (int64, error) {
+		var getErr error
+		readCloser, getErr = bucket.GetReader(key)
+		return 0, getErr
+	})
+	if err != nil {
+		if readCloser != nil {
+			readCloser.Close()
+		}
+		return nil, err
+	}
+	return &countingReadCloser{ReadCloser: readCloser, metricName: "s3.get"}, nil
+}
+
+// Lists the contents of a bucket, recording s3.list metrics.
+func (client *S3Client) list(bucket *s3.Bucket, prefix, delim, marker string, max int) (listResp *s3.ListResp, err error) {
+	err = client.runOperation("list", bucket, func(bucket *s3.Bucket) (int64, error) {
+		var listErr error
+		listResp, listErr = bucket.List(prefix, delim, marker, max)
+		return 0, listErr
+	})
+	return listResp, err
+}
+
+// Performs a HEAD request, recording s3.head metrics.
+func (client *S3Client) head(bucket *s3.Bucket, key string) (resp *http.Response, err error) {
+	err = client.runOperation("head", bucket, func(bucket *s3.Bucket) (int64, error) {
+		var headErr error
+		resp, headErr = bucket.Head(key, nil)
+		return 0, headErr
+	})
+	if err != nil && resp != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, err
+}
+
+// countingReadCloser adds the number of bytes read to the
+// named metric.
+type countingReadCloser struct {
+	io.ReadCloser
+	metricName string
+}
+
+func (reader *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	if n > 0 {
+		Metrics.AddBytes(reader.metricName, int64(n))
+	}
+	return n, err
+}
+
 // Returns a list of keys in the specified bucket.
 // If limit is zero, this will return all the keys in the bucket;
 // otherwise, it will return only the number of keys specifed.
@@ -70,7 +280,7 @@ func (client *S3Client) ListBucket(bucketName string, limit int) (keys []s3.Key,
 	if limit == 0 {
 		actualLimit = 1000
 	}
-	bucketList, err := bucket.List("", "/", "", actualLimit)
+	bucketList, err := client.list(bucket, "", "/", "", actualLimit)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +290,7 @@ func (client *S3Client) ListBucket(bucketName string, limit int) (keys []s3.Key,
 	}
 	for limit == 0 {
 		lastKey := contents[len(contents)-1].Key
-		bucketList, err := bucket.List("", "/", lastKey, actualLimit)
+		bucketList, err := client.list(bucket, "", "/", lastKey, actualLimit)
 		if err != nil {
 			return nil, err
 		}
@@ -105,6 +315,23 @@ func (client *S3Client) ListBucket(bucketName string, limit int) (keys []s3.Key,
 // checksum, but also some information about what went wrong
 // and whether the operation should be retried.
 func (client *S3Client) FetchAndCalculateSha256(fixityResult *FixityResult, localPath string) (error) {
+	return client.fetchAndCalculateSha256(fixityResult, localPath, nil)
+}
+
+// FetchDecryptAndCalculateSha256 is like FetchAndCalculateSha256,
+// but it decrypts the encrypted GenericFile as it streams from S3,
+// and calculates the sha256 digest of the plaintext. dataKey is
+// the file's unwrapped data key. If the file fails authenticated
+// decryption, this sets fixityResult.DecryptionFailed, and does not
+// set Retry, since the stored file is corrupt.
+func (client *S3Client) FetchDecryptAndCalculateSha256(fixityResult *FixityResult, dataKey []byte) (error) {
+	if dataKey == nil {
+		return fmt.Errorf("Param dataKey cannot be nil")
+	}
+	return client.fetchAndCalculateSha256(fixityResult, "", dataKey)
+}
+
+func (client *S3Client) fetchAndCalculateSha256(fixityResult *FixityResult, localPath string, dataKey []byte) (error) {
 	if fixityResult == nil {
 		return fmt.Errorf("Param fixityResult cannot be nil")
 	}
@@ -127,7 +354,7 @@ func (client *S3Client) FetchAndCalculateSha256(fixityResult *FixityResult, loca
 	// 249GB into the download. That sets us back a few hours.
 	var readCloser io.ReadCloser = nil
 	for attemptNumber := 0; attemptNumber < 5; attemptNumber++ {
-		readCloser, err = bucket.GetReader(key)
+		readCloser, err = client.getReader(bucket, key)
 		if err == nil {
 			break  // we got a reader, so move on
 		}
@@ -176,7 +403,23 @@ func (client *S3Client) FetchAndCalculateSha256(fixityResult *FixityResult, loca
 	}
 
 
-	_, err = io.Copy(multiWriter, readCloser)
+	if dataKey != nil {
+		if fixityResult.GenericFile.Encryption == nil {
+			fixityResult.Retry = false
+			return fmt.Errorf("Cannot decrypt GenericFile %s: it is not encrypted",
+				fixityResult.GenericFile.Identifier)
+		}
+		_, err = DecryptStream(multiWriter, readCloser, dataKey,
+			fixityResult.GenericFile.Encryption.ChunkSize)
+		if IsDecryptionError(err) {
+			fixityResult.ErrorMessage = err.Error()
+			fixityResult.DecryptionFailed = true
+			fixityResult.Retry = false
+			return err
+		}
+	} else {
+		_, err = io.Copy(multiWriter, readCloser)
+	}
 	if err != nil {
 		fixityResult.ErrorMessage = fmt.Sprintf(
 			"Error calculating SHA256 checksum from S3 data stream: %v", err)
@@ -219,7 +462,7 @@ func (client *S3Client) FetchToFile(bucketName string, key s3.Key, path string)
 	var readCloser io.ReadCloser = nil
 	var err error = nil
 	for attemptNumber := 0; attemptNumber < 5; attemptNumber++ {
-		readCloser, err = bucket.GetReader(key.Key)
+		readCloser, err = client.getReader(bucket, key.Key)
 		if err == nil {
 			break
 		}
@@ -260,18 +503,20 @@ func (client *S3Client) FetchToFile(bucketName string, key s3.Key, path string)
 	// for files >5GB, since it eats up too much CPU and we're
 	// going to validate the md5 checksums of its individual
 	// generic files later.
-	var md5Hash hash.Hash = nil
-	var multiWriter io.Writer = nil
-	if strings.Contains(result.RemoteMd5, "-") {
-		multiWriter = io.MultiWriter(outputFile)
-	} else {
-		md5Hash = md5.New()
-		multiWriter = io.MultiWriter(outputFile, md5Hash)
+	verifyMd5 := !strings.Contains(result.RemoteMd5, "-")
+	algorithms := make([]DigestAlgorithm, 0, 1)
+	if verifyMd5 {
+		algorithms = append(algorithms, DigestMd5)
+	}
+	digester, err := NewMultiDigestWriter(client.DigestBufferSize, algorithms...)
+	if err != nil {
+		result.ErrorMessage = err.Error()
+		return result
 	}
 
 	bytesWritten := int64(0)
 	for attemptNumber := 0; attemptNumber < 5; attemptNumber++ {
-		bytesWritten, err = io.Copy(multiWriter, readCloser)
+		bytesWritten, err = digester.Copy(outputFile, readCloser)
 		if err == nil {
 			break
 		}
@@ -290,12 +535,12 @@ func (client *S3Client) FetchToFile(bucketName string, key s3.Key, path string)
 	// ETag for S3 multi-part upload is not an accurate md5 sum.
 	// If the ETag ends with a dash and some number, it's a
 	// multi-part upload.
-	if md5Hash == nil {
+	if !verifyMd5 {
 		result.Warning = fmt.Sprintf("Skipping md5 check on %s: this was a multi-part upload", key.Key)
 		result.Md5Verified = false
 		result.Md5Verifiable = false
 	} else {
-		result.LocalMd5 = fmt.Sprintf("%x", md5Hash.Sum(nil))
+		result.LocalMd5 = digester.Sum(DigestMd5)
 		result.Md5Verifiable = true
 		result.Md5Verified = true
 		if result.LocalMd5 != result.RemoteMd5 {
@@ -338,7 +583,7 @@ func (client *S3Client) FetchToFileWithoutChecksum(bucketName, key, localPath st
 	var readCloser io.ReadCloser = nil
 	var err error = nil
 	for attemptNumber := 0; attemptNumber < 5; attemptNumber++ {
-		readCloser, err = bucket.GetReader(key)
+		readCloser, err = client.getReader(bucket, key)
 		if err == nil {
 			break
 		}
@@ -432,8 +677,14 @@ func (client *S3Client) MakeOptions(md5sum string, metadata map[string][]string)
 // files md5 sum is the same on S3 as here.
 func (client *S3Client) SaveToS3(bucketName, fileName, contentType string, reader io.Reader, byteCount int64, options s3.Options) (url string, err error) {
 	bucket := client.S3.Bucket(bucketName)
-	putErr := bucket.PutReader(fileName, reader, byteCount,
-		contentType, s3.Private, options)
+	putErr := client.runOperation("put", bucket, func(bucket *s3.Bucket) (int64, error) {
+		err := bucket.PutReader(fileName, reader, byteCount,
+			contentType, s3.Private, options)
+		if err != nil {
+			return 0, err
+		}
+		return byteCount, nil
+	})
 	if putErr != nil {
 		err = fmt.Errorf("Error saving file '%s' to bucket '%s': %v",
 			fileName, bucketName, putErr)
@@ -448,7 +699,7 @@ func (client *S3Client) SaveToS3(bucketName, fileName, contentType string, reade
 // date, size and other useful info.
 func (client *S3Client) GetKey(bucketName, fileName string) (*s3.Key, error) {
 	bucket := client.S3.Bucket(bucketName)
-	listResp, err := bucket.List(fileName, "", "", 1)
+	listResp, err := client.list(bucket, fileName, "", "", 1)
 	if err != nil {
 		err = fmt.Errorf("Error checking key '%s' in bucket '%s': '%v'",
 			fileName, bucketName, err)
@@ -465,7 +716,111 @@ func (client *S3Client) GetKey(bucketName, fileName string) (*s3.Key, error) {
 // Deletes an item from S3
 func (client *S3Client) Delete(bucketName, fileName string) error {
 	bucket := client.S3.Bucket(bucketName)
-	return bucket.Del(fileName)
+	return client.runOperation("delete", bucket, func(bucket *s3.Bucket) (int64, error) {
+		return 0, bucket.Del(fileName)
+	})
+}
+
+// Copies sourceBucket/sourceKey to destBucket/destKey within S3,
+// without downloading the object. S3 will not copy objects of
+// S3_LARGE_FILE bytes or more in a single request, so those are
+// copied in parts with copyLarge.
+func (client *S3Client) Copy(sourceBucket, sourceKey, destBucket, destKey string) error {
+	bucket := client.S3.Bucket(destBucket)
+	source := fmt.Sprintf("%s/%s", sourceBucket, sourceKey)
+	resp, err := client.Head(sourceBucket, sourceKey)
+	if err != nil {
+		return fmt.Errorf("Cannot get size of %s: %v", source, err)
+	}
+	if resp.ContentLength >= S3_LARGE_FILE {
+		return client.copyLarge(bucket, destKey, source, resp.ContentLength, resp.Header)
+	}
+	return client.runOperation("copy", bucket, func(bucket *s3.Bucket) (int64, error) {
+		_, err := bucket.PutCopy(destKey, s3.Private, s3.CopyOptions{}, source)
+		return 0, err
+	})
+}
+
+// Copies source, which is size bytes long, to destKey in bucket by
+// copying S3_CHUNK_SIZE byte ranges into the parts of a multipart
+// upload. Unlike PutCopy, a multipart upload does not copy the
+// original's content type and metadata, so we send the ones in
+// header, which is from a HEAD request on the source. Like
+// SaveLargeFileToS3, this is not subject to the operation timeout.
+func (client *S3Client) copyLarge(bucket *s3.Bucket, destKey, source string, size int64, header http.Header) (err error) {
+	start := time.Now()
+	defer func() {
+		Metrics.Record("s3.copy", time.Since(start), 0, err)
+	}()
+	options := s3.Options{Meta: make(map[string][]string)}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			key := strings.ToLower(strings.TrimPrefix(name, "X-Amz-Meta-"))
+			options.Meta[key] = values
+		}
+	}
+	multipartCopy, err := bucket.InitMulti(destKey, header.Get("Content-Type"), s3.Private, options)
+	if err != nil {
+		return err
+	}
+	parts := make([]s3.Part, 0, size/S3_CHUNK_SIZE+1)
+	for offset := int64(0); offset < size; offset += S3_CHUNK_SIZE {
+		last := offset + S3_CHUNK_SIZE - 1
+		if last >= size {
+			last = size - 1
+		}
+		copyOptions := s3.CopyOptions{
+			CopySourceOptions: fmt.Sprintf("bytes=%d-%d", offset, last),
+		}
+		_, part, err := multipartCopy.PutPartCopy(len(parts)+1, copyOptions, source)
+		if err != nil {
+			return client.abortCopy(multipartCopy, source, err)
+		}
+		parts = append(parts, part)
+	}
+	err = multipartCopy.Complete(parts)
+	if err != nil {
+		return client.abortCopy(multipartCopy, source, err)
+	}
+	return nil
+}
+
+// Aborts a failed multipart copy, so we're not charged for the parts
+// that were copied, and returns the error that made the copy fail.
+func (client *S3Client) abortCopy(multipartCopy *s3.Multi, source string, err error) (error) {
+	abortErr := multipartCopy.Abort()
+	if abortErr != nil {
+		return fmt.Errorf("Multipart copy of %s failed with error %v "+
+			"and abort failed with error %v. "+
+			"YOU WILL BE CHARGED FOR THESE FILE PARTS UNTIL YOU DELETE THEM! "+
+			"Use multi.ListMulti in the S3 package to list orphaned parts.",
+			source, err, abortErr)
+	}
+	return fmt.Errorf("Multipart copy of %s failed: %v", source, err)
+}
+
+// Returns all of the keys in bucketName that start with prefix.
+// This may issue multiple list requests if there are more than
+// 1000 matching keys.
+func (client *S3Client) ListPrefix(bucketName, prefix string) (keys []s3.Key, err error) {
+	bucket := client.S3.Bucket(bucketName)
+	keys = make([]s3.Key, 0)
+	marker := ""
+	for {
+		listResp, err := client.list(bucket, prefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		if listResp == nil || len(listResp.Contents) == 0 {
+			break
+		}
+		keys = append(keys, listResp.Contents...)
+		if !listResp.IsTruncated {
+			break
+		}
+		marker = listResp.Contents[len(listResp.Contents)-1].Key
+	}
+	return keys, nil
 }
 
 // Sends a large file (>= 5GB) to S3 in 200MB chunks. This operation
@@ -475,6 +830,16 @@ func (client *S3Client) SaveLargeFileToS3(bucketName, fileName, contentType stri
 	reader s3.ReaderAtSeeker, byteCount int64, options s3.Options, chunkSize int64) (url string, err error) {
 
 	bucket := client.S3.Bucket(bucketName)
+	// Multipart uploads can take hours, so the operation timeout
+	// does not apply here. We do still record the stats.
+	start := time.Now()
+	defer func() {
+		bytes := int64(0)
+		if err == nil {
+			bytes = byteCount
+		}
+		Metrics.Record("s3.put", time.Since(start), bytes, err)
+	}()
 	multipartPut, err := bucket.InitMulti(fileName, contentType, s3.Private, options)
 	if err != nil {
 		return "", err
@@ -506,9 +871,20 @@ func (client *S3Client) SaveLargeFileToS3(bucketName, fileName, contentType stri
 		return "", err
 	}
 
-	resp, err := bucket.Head(fileName, nil)
+	err = client.verifyMultipartMetadata(bucket, fileName, options)
 	if err != nil {
-		return "", fmt.Errorf("Files were uploaded to S3, but attempt to "+
+		return "", err
+	}
+	url = fmt.Sprintf("https://s3.amazonaws.com/%s/%s", bucketName, fileName)
+	return url, nil
+}
+
+// Checks that the metadata we sent with a multipart upload made it
+// to S3. S3 does not return an error if it doesn't.
+func (client *S3Client) verifyMultipartMetadata(bucket *s3.Bucket, fileName string, options s3.Options) (error) {
+	resp, err := client.head(bucket, fileName)
+	if err != nil {
+		return fmt.Errorf("Files were uploaded to S3, but attempt to "+
 			"confirm metadata returned this error: %v", err)
 	}
 
@@ -530,24 +906,162 @@ func (client *S3Client) SaveLargeFileToS3(bucketName, fileName, contentType stri
 		notVerified += "md5"
 	}
 	if len(notVerified) > 0 {
-		return "", fmt.Errorf("Multi-part upload succeeded, but S3 does not return "+
+		return fmt.Errorf("Multi-part upload succeeded, but S3 does not return "+
 			"the following metadata: %s", notVerified)
 	}
+	return nil
+}
+
+// SaveResumableLargeFileToS3 sends a large file to S3 in chunks, like
+// SaveLargeFileToS3, except that a failed upload is left open so it
+// can be resumed. Param uploadId holds the id of the upload: if it's
+// set when this is called, this continues that upload, keeping the
+// parts S3 already has if their sizes and md5 checksums match our
+// local data. This sets uploadId when it starts an upload, and
+// clears it when the upload is complete. Uploads that are never
+// resumed are cleaned up by MultipartCleanup.
+func (client *S3Client) SaveResumableLargeFileToS3(bucketName, fileName, contentType string,
+	reader s3.ReaderAtSeeker, byteCount int64, options s3.Options, chunkSize int64, uploadId *string) (url string, err error) {
+
+	bucket := client.S3.Bucket(bucketName)
+	start := time.Now()
+	defer func() {
+		bytes := int64(0)
+		if err == nil {
+			bytes = byteCount
+		}
+		Metrics.Record("s3.put", time.Since(start), bytes, err)
+	}()
+
+	partMd5 := readerPartMd5(reader)
+	parts := make([]s3.Part, 0)
+	nextPart := 1
+	if *uploadId != "" {
+		existing, err := client.ListParts(bucketName, fileName, *uploadId)
+		if isNoSuchUpload(err) {
+			// Aborted or completed since we started it.
+			*uploadId = ""
+		} else if err != nil {
+			return "", err
+		} else {
+			parts, nextPart, err = PlanMultipartResume(existing, byteCount, chunkSize, partMd5)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	var multipartPut *s3.Multi
+	if *uploadId != "" {
+		multipartPut = &s3.Multi{Bucket: bucket, Key: fileName, UploadId: *uploadId}
+	} else {
+		multipartPut, err = bucket.InitMulti(fileName, contentType, s3.Private, options)
+		if err != nil {
+			return "", err
+		}
+		*uploadId = multipartPut.UploadId
+	}
+
+	// Send the remaining parts, checking each one's ETag against
+	// the md5 of what we sent.
+	for n := nextPart; n <= multipartCount(byteCount, chunkSize); n++ {
+		offset, size := multipartRange(n, byteCount, chunkSize)
+		localMd5, err := partMd5(offset, size)
+		if err != nil {
+			return "", err
+		}
+		part, err := multipartPut.PutPart(n, io.NewSectionReader(reader, offset, size))
+		if err != nil {
+			return "", fmt.Errorf("Error uploading part %d of %s (upload %s): %v",
+				n, fileName, *uploadId, err)
+		}
+		if strings.Trim(part.ETag, "\"") != localMd5 {
+			return "", fmt.Errorf("S3 returned ETag %s for part %d of %s, expected md5 %s",
+				part.ETag, n, fileName, localMd5)
+		}
+		parts = append(parts, part)
+	}
 
+	// This command tells S3 to stitch all the parts into a single file.
+	err = multipartPut.Complete(parts)
+	if err != nil {
+		return "", fmt.Errorf("Multipart put of %s (upload %s) failed in 'complete' "+
+			"stage: %v", fileName, *uploadId, err)
+	}
+	*uploadId = ""
+	err = client.verifyMultipartMetadata(bucket, fileName, options)
+	if err != nil {
+		return "", err
+	}
 	url = fmt.Sprintf("https://s3.amazonaws.com/%s/%s", bucketName, fileName)
 	return url, nil
 }
 
+// UploadRestoredBag uploads the restored tar file at tarPath to the
+// institution's restoration bucket, and returns the URL from which
+// the depositor can download it. This always uses a multipart upload,
+// since restored bags can be very large. The object metadata includes
+// the institution, bag name, and the date after which the bucket's
+// lifecycle rule will delete the bag (see RESTORED_BAG_LIFETIME).
+func (client *S3Client) UploadRestoredBag(institution, tarPath string) (url string, err error) {
+	if institution == "" {
+		return "", fmt.Errorf("Param institution cannot be empty")
+	}
+	fileInfo, err := os.Stat(tarPath)
+	if err != nil {
+		return "", fmt.Errorf("Cannot upload restored bag: %v", err)
+	}
+	reader, err := os.Open(tarPath)
+	if err != nil {
+		return "", fmt.Errorf("Cannot upload restored bag: %v", err)
+	}
+	defer reader.Close()
+
+	bucketName := RestorationBucketFor(institution)
+	keyName := filepath.Base(tarPath)
+	restoredAt := NowUTC()
+	metadata := map[string][]string{
+		"institution": []string{institution},
+		"bag":         []string{strings.TrimSuffix(keyName, ".tar")},
+		"restored-at": []string{restoredAt.Format(time.RFC3339)},
+		"expires-at":  []string{restoredAt.Add(RESTORED_BAG_LIFETIME).Format(time.RFC3339)},
+	}
+	options := client.MakeOptions("", metadata)
+	return client.SaveLargeFileToS3(bucketName, keyName, "application/x-tar",
+		reader, fileInfo.Size(), options, S3_CHUNK_SIZE)
+}
+
 // Returns true/false indicating whether a bucket exists.
 func (client *S3Client) Exists(bucketName, key string) (bool, error) {
 	bucket := client.S3.Bucket(bucketName)
-	return bucket.Exists(key)
+	exists := false
+	err := client.runOperation("head", bucket, func(bucket *s3.Bucket) (int64, error) {
+		var existsErr error
+		exists, existsErr = bucket.Exists(key)
+		return 0, existsErr
+	})
+	return exists, err
 }
 
 // Returns a reader that lets you read data from bucket/key.
 func (client *S3Client) GetReader(bucketName, key string) (io.ReadCloser, error) {
 	bucket := client.S3.Bucket(bucketName)
-	return bucket.GetReader(key)
+	return client.getReader(bucket, key)
+}
+
+// Returns a presigned URL that allows anyone who has it to GET
+// bucketName/key until the URL expires. The URL carries the access
+// key id, the expiration time and a signature version 2 signature
+// as query params, so the object itself can remain private.
+func (client *S3Client) PresignGet(bucketName, key string, expires time.Duration) (string, error) {
+	if expires <= 0 {
+		return "", fmt.Errorf("Presigned URL expiration must be greater than zero")
+	}
+	if client.S3.Auth.AccessKey == "" || client.S3.Auth.SecretKey == "" {
+		return "", fmt.Errorf("Cannot presign URL for %s/%s without AWS credentials",
+			bucketName, key)
+	}
+	bucket := client.S3.Bucket(bucketName)
+	return bucket.SignedURL(key, time.Now().Add(expires)), nil
 }
 
 // Performs a HEAD request on an S3 object and returns the response.
@@ -555,7 +1069,7 @@ func (client *S3Client) GetReader(bucketName, key string) (io.ReadCloser, error)
 // that don't exist, and the body will be an XML error message.
 func (client *S3Client) Head(bucketName, key string) (*http.Response, error) {
 	bucket := client.S3.Bucket(bucketName)
-	return bucket.Head(key, nil)
+	return client.head(bucket, key)
 }
 
 func metadataMatches(metadata map[string][]string, key string, s3headers map[string][]string, headerName string) bool {
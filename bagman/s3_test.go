@@ -1,7 +1,9 @@
 package bagman_test
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
@@ -9,8 +11,13 @@ import (
 	"github.com/crowdmob/goamz/s3"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -611,3 +618,248 @@ func TestHead(t *testing.T) {
 		httpResp.Body.Close()
 	}
 }
+
+func TestS3ClientConfigure(t *testing.T) {
+	client, err := bagman.NewS3ClientExplicitAuth(aws.USEast, "Ax-S-Kee", "SeekritKee")
+	if err != nil {
+		t.Errorf("Cannot create S3 client: %v\n", err)
+		return
+	}
+	err = client.Configure(bagman.S3ClientConfig{
+		MaxIdleConnsPerHost: 8,
+		DialTimeout:         "7s",
+	})
+	if err != nil {
+		t.Errorf("Configure returned error: %v", err)
+		return
+	}
+	if client.S3.ConnectTimeout != 7*time.Second {
+		t.Errorf("ConnectTimeout: expected 7s, got %s", client.S3.ConnectTimeout)
+	}
+	if client.S3.HTTPClient == nil {
+		t.Errorf("Configure did not set the HTTP client")
+		return
+	}
+	transport, ok := client.S3.HTTPClient().Transport.(*http.Transport)
+	if !ok || transport.MaxIdleConnsPerHost != 8 {
+		t.Errorf("HTTP client transport does not have MaxIdleConnsPerHost = 8")
+	}
+	err = client.Configure(bagman.S3ClientConfig{OperationTimeout: "soon"})
+	if err == nil {
+		t.Errorf("Configure should have rejected invalid OperationTimeout")
+	}
+}
+
+// Make sure an S3 call to a server that never responds returns
+// an S3TimeoutError instead of hanging, that the request itself is
+// cancelled, and that it's counted in the metrics.
+func TestS3OperationTimeout(t *testing.T) {
+	unblock := make(chan bool)
+	cancelled := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-w.(http.CloseNotifier).CloseNotify():
+			cancelled <- true
+		case <-unblock:
+		}
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	region := aws.Region{Name: "test", S3Endpoint: server.URL}
+	client, err := bagman.NewS3ClientExplicitAuth(region, "Ax-S-Kee", "SeekritKee")
+	if err != nil {
+		t.Errorf("Cannot create S3 client: %v\n", err)
+		return
+	}
+	err = client.Configure(bagman.S3ClientConfig{OperationTimeout: "100ms"})
+	if err != nil {
+		t.Errorf("Configure returned error: %v", err)
+		return
+	}
+	errorsBefore := bagman.Metrics.Get("s3.head").Errors
+	start := time.Now()
+	_, err = client.Head(testBucket, "slow_file.txt")
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Head took %s, which exceeds the operation timeout", time.Since(start))
+	}
+	if !bagman.IsS3Timeout(err) {
+		t.Errorf("Expected S3TimeoutError, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Head timed out, but did not cancel its request")
+	}
+	errorsAfter := bagman.Metrics.Get("s3.head").Errors
+	if errorsAfter != errorsBefore+1 {
+		t.Errorf("Expected s3.head error count to be %d, got %d",
+			errorsBefore+1, errorsAfter)
+	}
+}
+
+// fakeS3 is just enough of an S3 server to accept a multipart
+// upload and answer a HEAD request for the uploaded object.
+type fakeS3 struct {
+	buckets  []string
+	keys     []string
+	metadata http.Header
+	bytes    int
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(pathParts) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bucket, key := pathParts[0], pathParts[1]
+	query := r.URL.Query()
+	_, isInit := query["uploads"]
+	switch {
+	case r.Method == "POST" && isInit:
+		fake.buckets = append(fake.buckets, bucket)
+		fake.keys = append(fake.keys, key)
+		fake.metadata = http.Header{}
+		for name, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				fake.metadata[name] = values
+			}
+		}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket>"+
+			"<Key>%s</Key><UploadId>upload1</UploadId></InitiateMultipartUploadResult>",
+			bucket, key)
+	case r.Method == "GET" && query.Get("uploadId") != "":
+		fmt.Fprintf(w, "<ListPartsResult><Bucket>%s</Bucket><Key>%s</Key>"+
+			"<UploadId>upload1</UploadId><IsTruncated>false</IsTruncated></ListPartsResult>",
+			bucket, key)
+	case r.Method == "PUT" && query.Get("partNumber") != "":
+		data, _ := ioutil.ReadAll(r.Body)
+		fake.bytes += len(data)
+		w.Header().Set("ETag", fmt.Sprintf("\"%x\"", md5.Sum(data)))
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket>"+
+			"<Key>%s</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>",
+			bucket, key)
+	case r.Method == "HEAD":
+		for name, values := range fake.metadata {
+			w.Header()[name] = values
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestUploadRestoredBag(t *testing.T) {
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	region := aws.Region{Name: "test", S3Endpoint: server.URL}
+	client, err := bagman.NewS3ClientExplicitAuth(region, "Ax-S-Kee", "SeekritKee")
+	if err != nil {
+		t.Errorf("Cannot create S3 client: %v\n", err)
+		return
+	}
+
+	tempDir, err := ioutil.TempDir("", "upload_restored_bag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	tarPath := filepath.Join(tempDir, "test.edu.my_bag.tar")
+	if err = ioutil.WriteFile(tarPath, []byte("Pretend this is a tar file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	url, err := client.UploadRestoredBag("test.edu", tarPath)
+	if err != nil {
+		t.Errorf("UploadRestoredBag returned error: %v", err)
+		return
+	}
+	expectedURL := "https://s3.amazonaws.com/aptrust.restore.test.edu/test.edu.my_bag.tar"
+	if url != expectedURL {
+		t.Errorf("Expected URL %s, got %s", expectedURL, url)
+	}
+	if len(fake.buckets) != 1 || fake.buckets[0] != "aptrust.restore.test.edu" {
+		t.Errorf("Expected upload to aptrust.restore.test.edu, got %v", fake.buckets)
+	}
+	if fake.bytes != len("Pretend this is a tar file") {
+		t.Errorf("Expected %d bytes uploaded, got %d",
+			len("Pretend this is a tar file"), fake.bytes)
+	}
+	if fake.metadata.Get("X-Amz-Meta-Institution") != "test.edu" {
+		t.Errorf("Upload is missing institution metadata")
+	}
+	if fake.metadata.Get("X-Amz-Meta-Expires-At") == "" {
+		t.Errorf("Upload is missing expiration metadata")
+	}
+
+	_, err = client.UploadRestoredBag("", tarPath)
+	if err == nil {
+		t.Errorf("UploadRestoredBag should require institution")
+	}
+}
+
+// Checks that signedUrl is a well-formed presigned GET URL for
+// bucketName/key that expires at about expectedExpiration, and
+// that its signature is correct for secretKey.
+func checkPresignedUrl(t *testing.T, signedUrl, bucketName, key, accessKey, secretKey string, expectedExpiration time.Time) {
+	parsedUrl, err := url.Parse(signedUrl)
+	if err != nil {
+		t.Errorf("Presigned URL '%s' is not valid: %v", signedUrl, err)
+		return
+	}
+	if parsedUrl.Scheme != "https" || parsedUrl.Host != "s3.amazonaws.com" {
+		t.Errorf("Presigned URL '%s' should point to https://s3.amazonaws.com", signedUrl)
+	}
+	if parsedUrl.Path != fmt.Sprintf("/%s/%s", bucketName, key) {
+		t.Errorf("Presigned URL has path '%s', expected '/%s/%s'",
+			parsedUrl.Path, bucketName, key)
+	}
+	query := parsedUrl.Query()
+	if query.Get("AWSAccessKeyId") != accessKey {
+		t.Errorf("Presigned URL has AWSAccessKeyId '%s', expected '%s'",
+			query.Get("AWSAccessKeyId"), accessKey)
+	}
+	expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64)
+	if err != nil {
+		t.Errorf("Presigned URL has invalid Expires param '%s'", query.Get("Expires"))
+		return
+	}
+	if diff := expires - expectedExpiration.Unix(); diff < -5 || diff > 5 {
+		t.Errorf("Presigned URL expires at %s, expected about %s",
+			time.Unix(expires, 0).UTC(), expectedExpiration.UTC())
+	}
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	fmt.Fprintf(mac, "GET\n\n\n%d\n/%s/%s", expires, bucketName, key)
+	expectedSignature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if query.Get("Signature") != expectedSignature {
+		t.Errorf("Presigned URL has Signature '%s', expected '%s'",
+			query.Get("Signature"), expectedSignature)
+	}
+}
+
+func TestPresignGet(t *testing.T) {
+	s3Client, err := bagman.NewS3ClientExplicitAuth(aws.USEast, "Ax-S-Kee", "SeekritKee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketName := "aptrust.restore.test.edu"
+	key := "sample_good.b0001.of0002.tar"
+	signedUrl, err := s3Client.PresignGet(bucketName, key, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPresignedUrl(t, signedUrl, bucketName, key, "Ax-S-Kee", "SeekritKee",
+		time.Now().Add(2*time.Hour))
+
+	_, err = s3Client.PresignGet(bucketName, key, 0)
+	if err == nil {
+		t.Errorf("PresignGet should reject zero expiration")
+	}
+	noAuthClient, _ := bagman.NewS3ClientExplicitAuth(aws.USEast, "", "")
+	_, err = noAuthClient.PresignGet(bucketName, key, time.Hour)
+	if err == nil {
+		t.Errorf("PresignGet should fail without credentials")
+	}
+}
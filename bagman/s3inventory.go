@@ -0,0 +1,504 @@
+package bagman
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An inventory older than this is too stale to audit against,
+// if the config does not say otherwise. S3 delivers inventories
+// daily, so this allows for one late or missed delivery.
+const DEFAULT_INVENTORY_MAX_AGE = 48 * time.Hour
+
+/*
+StorageKey describes one object in an S3 bucket. It's the common
+currency of StorageKeySources, whether the keys came from a live
+LIST of the bucket or from an S3 Inventory report.
+
+ETag has no surrounding quotes. Size is zero and LastModified is
+the zero time if the source doesn't include them.
+*/
+type StorageKey struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// StorageKeyIterator returns the keys in a bucket, one at a time.
+// Next returns ErrStopIteration when there are no more keys. Call
+// Close when you're done, even if you stop early.
+type StorageKeyIterator interface {
+	Next() (*StorageKey, error)
+	Close() (error)
+}
+
+// StorageKeySource lists the keys in a bucket. Audits that need
+// every key in the preservation bucket take a StorageKeySource, so
+// they can run against a live LIST (LiveKeySource) or against the
+// much cheaper daily S3 Inventory report (InventoryKeySource).
+type StorageKeySource interface {
+	Keys() (StorageKeyIterator, error)
+	// Description says where the keys come from, for reports.
+	Description() (string)
+}
+
+// InventoryFileReader is the part of the S3Client that reading
+// S3 Inventory reports needs. LocalInventoryReader reads reports
+// that have been copied to local disk.
+type InventoryFileReader interface {
+	GetReader(bucketName, key string) (io.ReadCloser, error)
+}
+
+// LocalInventoryReader reads inventory reports that have been
+// copied to local disk, e.g. with "aws s3 sync". Keys are relative
+// to Dir, and the bucket name is ignored.
+type LocalInventoryReader struct {
+	Dir string
+}
+
+func (reader *LocalInventoryReader) GetReader(bucketName, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(reader.Dir, filepath.FromSlash(key)))
+}
+
+// ----------------------------------------------------------------------
+// Live listing
+// ----------------------------------------------------------------------
+
+// LiveKeySource lists the keys in Bucket with LIST calls. This is
+// always current, but on the preservation bucket it takes hours and
+// costs real money.
+type LiveKeySource struct {
+	Lister BucketLister
+	Bucket string
+}
+
+// Keys lists the entire bucket and returns an iterator over the keys.
+func (source *LiveKeySource) Keys() (StorageKeyIterator, error) {
+	s3Keys, err := source.Lister.ListBucket(source.Bucket, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list bucket %s: %v", source.Bucket, err)
+	}
+	keys := make([]*StorageKey, len(s3Keys))
+	for i, s3Key := range s3Keys {
+		lastModified, _ := time.Parse(time.RFC3339Nano, s3Key.LastModified)
+		keys[i] = &StorageKey{
+			Key:          s3Key.Key,
+			Size:         s3Key.Size,
+			ETag:         strings.Trim(s3Key.ETag, "\""),
+			LastModified: lastModified,
+		}
+	}
+	return &sliceKeyIterator{keys: keys}, nil
+}
+
+func (source *LiveKeySource) Description() (string) {
+	return fmt.Sprintf("live listing of %s", source.Bucket)
+}
+
+// sliceKeyIterator iterates over keys already in memory.
+type sliceKeyIterator struct {
+	keys  []*StorageKey
+	index int
+}
+
+func (iter *sliceKeyIterator) Next() (*StorageKey, error) {
+	if iter.index >= len(iter.keys) {
+		return nil, ErrStopIteration
+	}
+	key := iter.keys[iter.index]
+	iter.index++
+	return key, nil
+}
+
+func (iter *sliceKeyIterator) Close() (error) {
+	return nil
+}
+
+// ----------------------------------------------------------------------
+// S3 Inventory
+// ----------------------------------------------------------------------
+
+/*
+InventoryManifest is the manifest.json that S3 Inventory writes
+with each report. It lists the report's data files and the columns
+in them. See
+http://docs.aws.amazon.com/AmazonS3/latest/dev/storage-inventory.html
+
+CreationTimestamp is milliseconds since the epoch, as a string.
+FileSchema is a comma-separated list of column names. Bucket and
+Key are always present. AWS adds optional columns over time, and
+which ones appear depends on how the inventory is configured, so
+the parser finds the columns it needs by name and ignores the rest.
+*/
+type InventoryManifest struct {
+	SourceBucket      string              `json:"sourceBucket"`
+	DestinationBucket string              `json:"destinationBucket"`
+	Version           string              `json:"version"`
+	CreationTimestamp string              `json:"creationTimestamp"`
+	FileFormat        string              `json:"fileFormat"`
+	FileSchema        string              `json:"fileSchema"`
+	Files             []InventoryDataFile `json:"files"`
+}
+
+// InventoryDataFile is one gzipped data file of an inventory report.
+// Key is relative to the manifest's destination bucket.
+type InventoryDataFile struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	MD5checksum string `json:"MD5checksum"`
+}
+
+// ParseInventoryManifest parses an S3 Inventory manifest.json.
+// Only CSV inventories are supported.
+func ParseInventoryManifest(reader io.Reader) (*InventoryManifest, error) {
+	manifest := &InventoryManifest{}
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("Cannot parse inventory manifest: %v", err)
+	}
+	if !strings.EqualFold(manifest.FileFormat, "CSV") {
+		return nil, fmt.Errorf("Inventory format '%s' is not supported. "+
+			"Configure the inventory to deliver CSV.", manifest.FileFormat)
+	}
+	if _, ok := manifest.columnIndexes()["Key"]; !ok {
+		return nil, fmt.Errorf("Inventory schema '%s' has no Key column", manifest.FileSchema)
+	}
+	if _, err := manifest.CreatedAt(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// LoadInventoryManifest reads and parses the manifest at
+// manifestKey in bucketName.
+func LoadInventoryManifest(files InventoryFileReader, bucketName, manifestKey string) (*InventoryManifest, error) {
+	reader, err := files.GetReader(bucketName, manifestKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read inventory manifest %s/%s: %v",
+			bucketName, manifestKey, err)
+	}
+	defer reader.Close()
+	return ParseInventoryManifest(reader)
+}
+
+// CreatedAt returns the time S3 created the inventory report.
+func (manifest *InventoryManifest) CreatedAt() (time.Time, error) {
+	millis, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid inventory creationTimestamp '%s'",
+			manifest.CreationTimestamp)
+	}
+	return time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond)).UTC(), nil
+}
+
+// DestinationBucketName returns the name of the bucket that holds
+// the report's data files. The manifest gives it as an ARN.
+func (manifest *InventoryManifest) DestinationBucketName() (string) {
+	return strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::")
+}
+
+// Columns returns the column names from FileSchema, in order.
+func (manifest *InventoryManifest) Columns() ([]string) {
+	columns := strings.Split(manifest.FileSchema, ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	return columns
+}
+
+// Returns a map of column name to position in each CSV record.
+func (manifest *InventoryManifest) columnIndexes() (map[string]int) {
+	indexes := make(map[string]int)
+	for i, column := range manifest.Columns() {
+		indexes[column] = i
+	}
+	return indexes
+}
+
+// CheckFreshness returns an error if the report was created more
+// than maxAge before now. Auditing against a stale inventory would
+// report objects stored since then as orphans or missing.
+func (manifest *InventoryManifest) CheckFreshness(maxAge time.Duration, now time.Time) (error) {
+	createdAt, err := manifest.CreatedAt()
+	if err != nil {
+		return err
+	}
+	age := now.Sub(createdAt)
+	if age > maxAge {
+		return fmt.Errorf("Inventory of %s was created at %s, %s ago, which is "+
+			"older than the maximum age of %s. Refusing to audit against stale data.",
+			manifest.SourceBucket, FormatUTC(createdAt), age-age%time.Minute, maxAge)
+	}
+	return nil
+}
+
+/*
+InventoryKeySource returns the keys from an S3 Inventory report,
+reading the report's gzipped CSV data files from Files one at a
+time, so the report never has to fit in memory.
+
+Keys refuses to run if the report is older than MaxAge. If MaxAge
+is zero, it uses DEFAULT_INVENTORY_MAX_AGE.
+*/
+type InventoryKeySource struct {
+	Manifest *InventoryManifest
+	Files    InventoryFileReader
+	MaxAge   time.Duration
+	// Now returns the current time. Tests set this.
+	// If it's nil, we use time.Now.
+	Now      func() (time.Time)
+}
+
+// NewInventoryKeySource loads the manifest at manifestKey in
+// bucketName and returns a source for its keys.
+func NewInventoryKeySource(files InventoryFileReader, bucketName, manifestKey string, maxAge time.Duration) (*InventoryKeySource, error) {
+	manifest, err := LoadInventoryManifest(files, bucketName, manifestKey)
+	if err != nil {
+		return nil, err
+	}
+	return &InventoryKeySource{
+		Manifest: manifest,
+		Files:    files,
+		MaxAge:   maxAge,
+	}, nil
+}
+
+// Keys checks that the inventory is fresh enough, and returns an
+// iterator over its keys.
+func (source *InventoryKeySource) Keys() (StorageKeyIterator, error) {
+	maxAge := source.MaxAge
+	if maxAge == 0 {
+		maxAge = DEFAULT_INVENTORY_MAX_AGE
+	}
+	now := time.Now()
+	if source.Now != nil {
+		now = source.Now()
+	}
+	if err := source.Manifest.CheckFreshness(maxAge, now); err != nil {
+		return nil, err
+	}
+	return NewInventoryIterator(source.Manifest, source.Files), nil
+}
+
+func (source *InventoryKeySource) Description() (string) {
+	createdAt, _ := source.Manifest.CreatedAt()
+	return fmt.Sprintf("inventory of %s created %s", source.Manifest.SourceBucket,
+		FormatUTC(createdAt))
+}
+
+/*
+InventoryIterator streams the records of an inventory report's
+data files as StorageKeys. It opens each data file only when it
+has finished the one before.
+
+Keys are URL-decoded, since S3 Inventory URL-encodes them in CSV
+reports. If the inventory includes object versions, delete markers
+and versions that aren't the latest are skipped.
+*/
+type InventoryIterator struct {
+	manifest  *InventoryManifest
+	files     InventoryFileReader
+	columns   map[string]int
+	fileIndex int
+	current   io.ReadCloser
+	gzReader  *gzip.Reader
+	csvReader *csv.Reader
+	record    int
+}
+
+// NewInventoryIterator returns an iterator over the keys in the
+// manifest's data files.
+func NewInventoryIterator(manifest *InventoryManifest, files InventoryFileReader) (*InventoryIterator) {
+	return &InventoryIterator{
+		manifest: manifest,
+		files:    files,
+		columns:  manifest.columnIndexes(),
+	}
+}
+
+// Next returns the next key in the report, or ErrStopIteration
+// after the last key in the last data file.
+func (iter *InventoryIterator) Next() (*StorageKey, error) {
+	for {
+		if iter.csvReader == nil {
+			if iter.fileIndex >= len(iter.manifest.Files) {
+				return nil, ErrStopIteration
+			}
+			if err := iter.openDataFile(iter.manifest.Files[iter.fileIndex]); err != nil {
+				return nil, err
+			}
+		}
+		fields, err := iter.csvReader.Read()
+		if err == io.EOF {
+			iter.closeDataFile()
+			iter.fileIndex++
+			continue
+		}
+		dataFile := iter.manifest.Files[iter.fileIndex].Key
+		if err != nil {
+			return nil, fmt.Errorf("Error reading inventory data file %s: %v", dataFile, err)
+		}
+		iter.record++
+		if iter.value(fields, "IsDeleteMarker") == "true" ||
+			iter.value(fields, "IsLatest") == "false" {
+			continue
+		}
+		key, err := iter.storageKey(fields)
+		if err != nil {
+			return nil, fmt.Errorf("In inventory data file %s, record %d: %v",
+				dataFile, iter.record, err)
+		}
+		return key, nil
+	}
+}
+
+// Close closes the data file currently being read.
+func (iter *InventoryIterator) Close() (error) {
+	return iter.closeDataFile()
+}
+
+func (iter *InventoryIterator) openDataFile(dataFile InventoryDataFile) (error) {
+	reader, err := iter.files.GetReader(iter.manifest.DestinationBucketName(), dataFile.Key)
+	if err != nil {
+		return fmt.Errorf("Cannot open inventory data file %s: %v", dataFile.Key, err)
+	}
+	gzReader, err := gzip.NewReader(reader)
+	if err != nil {
+		reader.Close()
+		return fmt.Errorf("Inventory data file %s is not gzipped: %v", dataFile.Key, err)
+	}
+	iter.current = reader
+	iter.gzReader = gzReader
+	iter.csvReader = csv.NewReader(gzReader)
+	// Records have as many fields as the schema has columns,
+	// but don't fail the whole audit on a ragged record.
+	iter.csvReader.FieldsPerRecord = -1
+	iter.record = 0
+	return nil
+}
+
+func (iter *InventoryIterator) closeDataFile() (error) {
+	var err error
+	if iter.gzReader != nil {
+		iter.gzReader.Close()
+	}
+	if iter.current != nil {
+		err = iter.current.Close()
+	}
+	iter.current = nil
+	iter.gzReader = nil
+	iter.csvReader = nil
+	return err
+}
+
+// Returns the value of the named column, or an empty string if the
+// inventory doesn't have that column.
+func (iter *InventoryIterator) value(fields []string, column string) (string) {
+	index, ok := iter.columns[column]
+	if !ok || index >= len(fields) {
+		return ""
+	}
+	return fields[index]
+}
+
+func (iter *InventoryIterator) storageKey(fields []string) (*StorageKey, error) {
+	key, err := url.QueryUnescape(iter.value(fields, "Key"))
+	if err != nil || key == "" {
+		return nil, fmt.Errorf("Invalid key '%s'", iter.value(fields, "Key"))
+	}
+	storageKey := &StorageKey{
+		Key:  key,
+		ETag: strings.Trim(iter.value(fields, "ETag"), "\""),
+	}
+	if size := iter.value(fields, "Size"); size != "" {
+		storageKey.Size, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid size '%s' for key %s", size, key)
+		}
+	}
+	if lastModified := iter.value(fields, "LastModifiedDate"); lastModified != "" {
+		storageKey.LastModified, err = time.Parse(time.RFC3339Nano, lastModified)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid LastModifiedDate '%s' for key %s",
+				lastModified, key)
+		}
+	}
+	return storageKey, nil
+}
+
+// ----------------------------------------------------------------------
+// Audit
+// ----------------------------------------------------------------------
+
+/*
+StorageComparison is the result of comparing the keys in a bucket
+with the keys we expect to be there.
+
+Orphans are keys in the bucket we don't know about. Missing are
+keys we expect that aren't in the bucket. SizeMismatches are keys
+in both places whose sizes differ. All three are sorted.
+*/
+type StorageComparison struct {
+	Source         string
+	KeysChecked    int
+	Orphans        []string
+	Missing        []string
+	SizeMismatches []string
+}
+
+// CompareStorageKeys reads every key from source and compares it
+// with expected, a map of key to size. A size of -1 in expected
+// means the size is unknown and isn't checked, and neither are
+// sizes from sources that don't report them.
+func CompareStorageKeys(source StorageKeySource, expected map[string]int64) (*StorageComparison, error) {
+	iter, err := source.Keys()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	comparison := &StorageComparison{
+		Source:         source.Description(),
+		Orphans:        make([]string, 0),
+		Missing:        make([]string, 0),
+		SizeMismatches: make([]string, 0),
+	}
+	found := make(map[string]bool, len(expected))
+	for {
+		key, err := iter.Next()
+		if err == ErrStopIteration {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		comparison.KeysChecked++
+		expectedSize, ok := expected[key.Key]
+		if !ok {
+			comparison.Orphans = append(comparison.Orphans, key.Key)
+			continue
+		}
+		found[key.Key] = true
+		if expectedSize >= 0 && key.Size > 0 && key.Size != expectedSize {
+			comparison.SizeMismatches = append(comparison.SizeMismatches, key.Key)
+		}
+	}
+	for key := range expected {
+		if !found[key] {
+			comparison.Missing = append(comparison.Missing, key)
+		}
+	}
+	sort.Strings(comparison.Orphans)
+	sort.Strings(comparison.Missing)
+	sort.Strings(comparison.SizeMismatches)
+	return comparison, nil
+}
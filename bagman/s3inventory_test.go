@@ -0,0 +1,225 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/s3"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixture inventories were created at this time.
+var inventoryCreatedAt = time.Date(2016, 4, 6, 0, 0, 0, 0, time.UTC)
+
+func inventoryReader(t *testing.T) (*bagman.LocalInventoryReader) {
+	bagmanHome, err := bagman.BagmanHome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &bagman.LocalInventoryReader{Dir: filepath.Join(bagmanHome, "testdata", "s3inventory")}
+}
+
+func loadInventorySource(t *testing.T, manifestName string) (*bagman.InventoryKeySource) {
+	source, err := bagman.NewInventoryKeySource(inventoryReader(t),
+		"aptrust.preservation.inventory", manifestName, time.Hour)
+	if err != nil {
+		t.Fatalf("NewInventoryKeySource(%s) returned error: %v", manifestName, err)
+	}
+	source.Now = func() (time.Time) { return inventoryCreatedAt.Add(time.Minute) }
+	return source
+}
+
+func allKeys(t *testing.T, source bagman.StorageKeySource) ([]*bagman.StorageKey) {
+	iter, err := source.Keys()
+	if err != nil {
+		t.Fatalf("Keys() returned error: %v", err)
+	}
+	defer iter.Close()
+	keys := make([]*bagman.StorageKey, 0)
+	for {
+		key, err := iter.Next()
+		if err == bagman.ErrStopIteration {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() returned error: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestParseInventoryManifest(t *testing.T) {
+	manifest, err := bagman.LoadInventoryManifest(inventoryReader(t),
+		"aptrust.preservation.inventory", "manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SourceBucket != "aptrust.preservation.storage" {
+		t.Errorf("Expected source bucket aptrust.preservation.storage, got %s", manifest.SourceBucket)
+	}
+	if manifest.DestinationBucketName() != "aptrust.preservation.inventory" {
+		t.Errorf("Expected destination aptrust.preservation.inventory, got %s",
+			manifest.DestinationBucketName())
+	}
+	createdAt, err := manifest.CreatedAt()
+	if err != nil || !createdAt.Equal(inventoryCreatedAt) {
+		t.Errorf("Expected creation time %s, got %s (%v)", inventoryCreatedAt, createdAt, err)
+	}
+	if len(manifest.Files) != 2 {
+		t.Errorf("Expected 2 data files, got %d", len(manifest.Files))
+	}
+	columns := manifest.Columns()
+	if len(columns) != 9 || columns[1] != "Key" || columns[8] != "EncryptionStatus" {
+		t.Errorf("Columns() returned %v", columns)
+	}
+
+	_, err = bagman.LoadInventoryManifest(inventoryReader(t),
+		"aptrust.preservation.inventory", "manifest_orc.json")
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("ORC inventories should be rejected, got %v", err)
+	}
+	badManifests := []string{
+		`not json`,
+		`{"fileFormat": "CSV", "fileSchema": "Bucket, Size", "creationTimestamp": "1459900800000"}`,
+		`{"fileFormat": "CSV", "fileSchema": "Bucket, Key", "creationTimestamp": "yesterday"}`,
+	}
+	for _, manifestJson := range badManifests {
+		if _, err := bagman.ParseInventoryManifest(strings.NewReader(manifestJson)); err == nil {
+			t.Errorf("ParseInventoryManifest should reject %s", manifestJson)
+		}
+	}
+}
+
+func TestInventoryIterator(t *testing.T) {
+	keys := allKeys(t, loadInventorySource(t, "manifest.json"))
+	// Keys come from both data files, in order.
+	expected := []string{
+		"0b5ca4c3-1b3c-4c0d-9e67-1b7e7d0b7a01",
+		"1f2e3d4c-5b6a-4978-8695-a4b3c2d1e0f9",
+		"test.edu/bag/data/file with space.txt",
+		"7a6b5c4d-3e2f-4a1b-9c8d-7e6f5a4b3c2d",
+		"orphan.txt",
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), len(keys))
+	}
+	for i, key := range keys {
+		if key.Key != expected[i] {
+			t.Errorf("Key %d: expected '%s', got '%s'", i, expected[i], key.Key)
+		}
+	}
+	if keys[1].Size != 1024 || keys[1].ETag != "b4f8f3072f73598fc5b65bf416b6019a" {
+		t.Errorf("Wrong size or etag: %d, %s", keys[1].Size, keys[1].ETag)
+	}
+	if !keys[1].LastModified.Equal(time.Date(2016, 4, 2, 8, 30, 15, 0, time.UTC)) {
+		t.Errorf("Wrong LastModified: %s", keys[1].LastModified)
+	}
+	if keys[3].Size != 5368709120 {
+		t.Errorf("Expected size 5368709120, got %d", keys[3].Size)
+	}
+}
+
+// Versioned inventories have different optional columns, and no
+// ETag or LastModifiedDate. Old versions and delete markers are
+// not in the bucket as far as our audits are concerned.
+func TestInventoryIteratorOptionalColumns(t *testing.T) {
+	keys := allKeys(t, loadInventorySource(t, "manifest_versions.json"))
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(keys))
+	}
+	if keys[0].Key != "current.txt" || keys[0].Size != 10 {
+		t.Errorf("Expected the latest version of current.txt, got %s (%d bytes)",
+			keys[0].Key, keys[0].Size)
+	}
+	if keys[1].Key != "only.txt" || keys[1].ETag != "" || !keys[1].LastModified.IsZero() {
+		t.Errorf("Unexpected key %v", keys[1])
+	}
+}
+
+func TestInventoryFreshness(t *testing.T) {
+	source := loadInventorySource(t, "manifest.json")
+	source.Now = func() (time.Time) { return inventoryCreatedAt.Add(2 * time.Hour) }
+	_, err := source.Keys()
+	if err == nil || !strings.Contains(err.Error(), "Refusing to audit") {
+		t.Errorf("Keys() should refuse a stale inventory, got %v", err)
+	}
+	if _, err = bagman.CompareStorageKeys(source, map[string]int64{}); err == nil {
+		t.Errorf("CompareStorageKeys() should refuse a stale inventory")
+	}
+
+	// Zero MaxAge means the default.
+	source.MaxAge = 0
+	source.Now = func() (time.Time) { return inventoryCreatedAt.Add(47 * time.Hour) }
+	if _, err = source.Keys(); err != nil {
+		t.Errorf("Inventory should be fresh enough with the default max age: %v", err)
+	}
+	source.Now = func() (time.Time) { return inventoryCreatedAt.Add(49 * time.Hour) }
+	if _, err = source.Keys(); err == nil {
+		t.Errorf("Inventory should be stale with the default max age")
+	}
+
+	config := bagman.Config{}
+	if maxAge, _ := config.InventoryMaxAgeDuration(); maxAge != bagman.DEFAULT_INVENTORY_MAX_AGE {
+		t.Errorf("Expected default max age, got %s", maxAge)
+	}
+	config.InventoryMaxAge = "12h"
+	if maxAge, _ := config.InventoryMaxAgeDuration(); maxAge != 12*time.Hour {
+		t.Errorf("Expected 12h, got %s", maxAge)
+	}
+}
+
+// The same comparison runs against a live listing or an inventory.
+func TestCompareStorageKeys(t *testing.T) {
+	expected := map[string]int64{
+		"0b5ca4c3-1b3c-4c0d-9e67-1b7e7d0b7a01":  4096,
+		"1f2e3d4c-5b6a-4978-8695-a4b3c2d1e0f9":  2048,
+		"test.edu/bag/data/file with space.txt": -1,
+		"7a6b5c4d-3e2f-4a1b-9c8d-7e6f5a4b3c2d":  5368709120,
+		"missing.txt":                           10,
+	}
+	lister := &fakeBucketLister{keys: map[string][]s3.Key{
+		"aptrust.preservation.storage": []s3.Key{
+			s3.Key{Key: "0b5ca4c3-1b3c-4c0d-9e67-1b7e7d0b7a01", Size: 4096, ETag: "\"8d777f385d3dfec8815d20f7496026dc\""},
+			s3.Key{Key: "1f2e3d4c-5b6a-4978-8695-a4b3c2d1e0f9", Size: 1024},
+			s3.Key{Key: "test.edu/bag/data/file with space.txt", Size: 17},
+			s3.Key{Key: "7a6b5c4d-3e2f-4a1b-9c8d-7e6f5a4b3c2d", Size: 5368709120},
+			s3.Key{Key: "orphan.txt", Size: 3},
+		},
+	}}
+	sources := []bagman.StorageKeySource{
+		&bagman.LiveKeySource{Lister: lister, Bucket: "aptrust.preservation.storage"},
+		loadInventorySource(t, "manifest.json"),
+	}
+	for _, source := range sources {
+		comparison, err := bagman.CompareStorageKeys(source, expected)
+		if err != nil {
+			t.Errorf("CompareStorageKeys(%s) returned error: %v", source.Description(), err)
+			continue
+		}
+		if comparison.KeysChecked != 5 {
+			t.Errorf("%s: expected 5 keys checked, got %d", comparison.Source, comparison.KeysChecked)
+		}
+		if len(comparison.Orphans) != 1 || comparison.Orphans[0] != "orphan.txt" {
+			t.Errorf("%s: expected orphan.txt to be the only orphan, got %v",
+				comparison.Source, comparison.Orphans)
+		}
+		if len(comparison.Missing) != 1 || comparison.Missing[0] != "missing.txt" {
+			t.Errorf("%s: expected missing.txt to be the only missing key, got %v",
+				comparison.Source, comparison.Missing)
+		}
+		if len(comparison.SizeMismatches) != 1 ||
+			comparison.SizeMismatches[0] != "1f2e3d4c-5b6a-4978-8695-a4b3c2d1e0f9" {
+			t.Errorf("%s: expected one size mismatch, got %v",
+				comparison.Source, comparison.SizeMismatches)
+		}
+	}
+
+	// Listing errors come back as errors, not as an empty bucket
+	// full of missing keys.
+	badSource := &bagman.LiveKeySource{Lister: lister, Bucket: "no.such.bucket"}
+	if _, err := bagman.CompareStorageKeys(badSource, expected); err == nil {
+		t.Errorf("CompareStorageKeys() should return the listing error")
+	}
+}
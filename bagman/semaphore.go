@@ -0,0 +1,36 @@
+package bagman
+
+/*
+Semaphore limits the number of go routines that can do something
+at the same time. apt_record uses one to limit the number of items
+it records in Fluctus at once, independently of the number of
+go routines it runs.
+*/
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// Creates a new Semaphore that lets up to size go routines in at
+// once. If size is less than one, the semaphore lets in one.
+func NewSemaphore(size int) (*Semaphore) {
+	if size < 1 {
+		size = 1
+	}
+	return &Semaphore{slots: make(chan struct{}, size)}
+}
+
+// Returns the maximum number of go routines the semaphore lets in.
+func (semaphore *Semaphore) Size() (int) {
+	return cap(semaphore.slots)
+}
+
+// Acquire blocks until there's a free slot, and then takes it.
+// Call Release when you're done.
+func (semaphore *Semaphore) Acquire() {
+	semaphore.slots <- struct{}{}
+}
+
+// Release frees the slot taken by Acquire.
+func (semaphore *Semaphore) Release() {
+	<-semaphore.slots
+}
@@ -0,0 +1,78 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFluctusClient stands in for Fluctus, and keeps track of
+// how many records are being saved at once.
+type countingFluctusClient struct {
+	current int32
+	max     int32
+	total   int32
+}
+
+func (client *countingFluctusClient) Record() {
+	current := atomic.AddInt32(&client.current, 1)
+	for {
+		max := atomic.LoadInt32(&client.max)
+		if current <= max || atomic.CompareAndSwapInt32(&client.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	atomic.AddInt32(&client.total, 1)
+	atomic.AddInt32(&client.current, -1)
+}
+
+func TestSemaphoreLimitsConcurrentRecords(t *testing.T) {
+	for _, limit := range []int{1, 3} {
+		semaphore := bagman.NewSemaphore(limit)
+		client := &countingFluctusClient{}
+		waitGroup := sync.WaitGroup{}
+		// More workers than the limit, as in apt_record.
+		for i := 0; i < 12; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				semaphore.Acquire()
+				defer semaphore.Release()
+				client.Record()
+			}()
+		}
+		waitGroup.Wait()
+		if client.max > int32(limit) {
+			t.Errorf("Limit is %d, but %d records were saved at once", limit, client.max)
+		}
+		if limit > 1 && client.max < 2 {
+			t.Errorf("Limit is %d, but records were saved one at a time", limit)
+		}
+		if client.total != 12 {
+			t.Errorf("Expected 12 records, got %d", client.total)
+		}
+	}
+}
+
+func TestNewSemaphoreSize(t *testing.T) {
+	if size := bagman.NewSemaphore(4).Size(); size != 4 {
+		t.Errorf("Expected size 4, got %d", size)
+	}
+	if size := bagman.NewSemaphore(0).Size(); size != 1 {
+		t.Errorf("Semaphore with size 0 should let one in, got %d", size)
+	}
+}
+
+func TestFluctusConnectionLimit(t *testing.T) {
+	workerConfig := &bagman.WorkerConfig{Workers: 8}
+	if limit := workerConfig.FluctusConnectionLimit(); limit != 8 {
+		t.Errorf("Limit should default to Workers, got %d", limit)
+	}
+	workerConfig.FluctusConnections = 2
+	if limit := workerConfig.FluctusConnectionLimit(); limit != 2 {
+		t.Errorf("Expected limit 2, got %d", limit)
+	}
+}
@@ -0,0 +1,42 @@
+package bagman
+
+// IngestStages are the stages a bag goes through during ingest,
+// in order.
+var IngestStages = []StageType{
+	StageFetch,
+	StageUnpack,
+	StageValidate,
+	StageStore,
+	StageRecord,
+	StageCleanup,
+}
+
+// TestErrorReporter is the part of *testing.T that the stage
+// assertions need. It's an interface so bagman doesn't have to
+// import the testing package.
+type TestErrorReporter interface {
+	Errorf(format string, args ...interface{})
+}
+
+// AssertAllStagesCompleted reports an error through t for each of
+// the IngestStages that result did not complete. Integration tests
+// call it with *testing.T after processing a bag end-to-end.
+func AssertAllStagesCompleted(t TestErrorReporter, result *ProcessResult) {
+	AssertStagesCompleted(t, result, IngestStages...)
+}
+
+// AssertStagesCompleted reports an error through t for each of
+// stages that result did not complete. Use it for tests that run
+// only part of the pipeline.
+func AssertStagesCompleted(t TestErrorReporter, result *ProcessResult, stages ...StageType) {
+	bagName := ""
+	if result.S3File != nil {
+		bagName = result.S3File.Key.Key
+	}
+	for _, stage := range stages {
+		if !result.StageCompleted(stage) {
+			t.Errorf("Bag %s did not complete stage %s. Completed stages: %v",
+				bagName, stage, result.StagesCompleted)
+		}
+	}
+}
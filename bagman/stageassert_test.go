@@ -0,0 +1,50 @@
+package bagman_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+)
+
+type fakeErrorReporter struct {
+	errors []string
+}
+
+func (reporter *fakeErrorReporter) Errorf(format string, args ...interface{}) {
+	reporter.errors = append(reporter.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertAllStagesCompleted(t *testing.T) {
+	result := &bagman.ProcessResult{S3File: getS3File()}
+	for _, stage := range bagman.IngestStages {
+		result.CompleteStage(stage)
+	}
+	// Completing a stage again doesn't add it twice.
+	result.CompleteStage(bagman.StageFetch)
+	if len(result.StagesCompleted) != 6 {
+		t.Errorf("Expected 6 completed stages, got %v", result.StagesCompleted)
+	}
+	reporter := &fakeErrorReporter{}
+	bagman.AssertAllStagesCompleted(reporter, result)
+	if len(reporter.errors) != 0 {
+		t.Errorf("Expected no errors, got %v", reporter.errors)
+	}
+
+	result.StagesCompleted = []bagman.StageType{bagman.StageFetch, bagman.StageUnpack,
+		bagman.StageValidate, bagman.StageStore}
+	bagman.AssertAllStagesCompleted(reporter, result)
+	if len(reporter.errors) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", reporter.errors)
+	}
+	if !strings.Contains(reporter.errors[0], "did not complete stage Record") ||
+		!strings.Contains(reporter.errors[1], "did not complete stage Cleanup") {
+		t.Errorf("Errors should name the missing stages: %v", reporter.errors)
+	}
+
+	reporter = &fakeErrorReporter{}
+	bagman.AssertStagesCompleted(reporter, result, bagman.StageFetch, bagman.StageStore)
+	if len(reporter.errors) != 0 {
+		t.Errorf("Expected no errors for the stages completed, got %v", reporter.errors)
+	}
+}
@@ -0,0 +1,232 @@
+package bagman
+
+import (
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bags that sit in a receiving bucket longer than this without a
+// ProcessedItem are considered stale, if the config does not say
+// otherwise.
+const DEFAULT_STALE_BAG_THRESHOLD = 72 * time.Hour
+
+// BucketLister is the part of the S3Client that StaleBagSweep needs.
+type BucketLister interface {
+	ListBucket(bucketName string, limit int) ([]s3.Key, error)
+}
+
+// ProcessStatusClient is the part of the FluctusClient that
+// StaleBagSweep needs.
+type ProcessStatusClient interface {
+	GetBagStatus(etag, name string, bagDate time.Time) (*ProcessStatus, error)
+	UpdateProcessedItem(status *ProcessStatus) error
+}
+
+/*
+StaleBagSweep finds bags that have been sitting in receiving buckets
+longer than Threshold. This catches bags uploaded while the bucket
+reader was down, which would otherwise sit there unnoticed.
+
+For each stale bag with no ProcessedItem in Fluctus, the sweep
+queues the bag for ingest, and then creates a Pending ProcessedItem
+noting the late pickup. Stale bags whose ProcessedItem failed with
+Retry=false are not queued, only reported in the summary. Stale bags
+with any other ProcessedItem are already on their way through the
+system, and are ignored.
+*/
+type StaleBagSweep struct {
+	// S3 lists the receiving buckets.
+	S3        BucketLister
+
+	// Fluctus looks up and creates ProcessedItems.
+	Fluctus   ProcessStatusClient
+
+	// Queue sends stale bags to the ingest queue.
+	Queue     func(s3Files []*S3File) error
+
+	// Threshold is how long a bag can sit in a receiving bucket
+	// before it's considered stale.
+	Threshold time.Duration
+
+	// Now is the time the sweep measures bag ages against.
+	// If zero, the sweep uses the current time.
+	Now       time.Time
+}
+
+// StaleBagSummary describes the stale bags in one institution's
+// receiving bucket. It's meant to be logged or sent to whoever
+// needs to hear about late pickups.
+type StaleBagSummary struct {
+	Institution string        `json:"institution"`
+	Bucket      string        `json:"bucket"`
+
+	// Stale is the number of bags older than the threshold that
+	// were queued or reported.
+	Stale       int           `json:"stale"`
+
+	// Queued is the number of stale bags with no ProcessedItem,
+	// which the sweep queued for ingest.
+	Queued      int           `json:"queued"`
+
+	// FailedKeys are the stale bags whose ProcessedItems say
+	// they failed and should not be retried.
+	FailedKeys  []string      `json:"failed_keys"`
+
+	// OldestKey and OldestAge describe the oldest stale bag.
+	OldestKey   string        `json:"oldest_key"`
+	OldestAge   time.Duration `json:"oldest_age"`
+}
+
+func (summary *StaleBagSummary) String() (string) {
+	return fmt.Sprintf("%s: %d stale bags in %s (%d queued, %d failed without retry); "+
+		"oldest is %s at %s", summary.Institution, summary.Stale, summary.Bucket,
+		summary.Queued, len(summary.FailedKeys), summary.OldestKey, FormatDuration(summary.OldestAge))
+}
+
+func (summary *StaleBagSummary) addStaleKey(key string, age time.Duration) {
+	summary.Stale++
+	if age > summary.OldestAge {
+		summary.OldestKey = key
+		summary.OldestAge = age
+	}
+}
+
+// staleBag is a stale bag the sweep will queue, along with the
+// ProcessedItem it creates once the bag is queued.
+type staleBag struct {
+	s3File  *S3File
+	status  *ProcessStatus
+	summary *StaleBagSummary
+	age     time.Duration
+}
+
+// Run sweeps the specified receiving buckets. It returns a summary
+// for each bucket that has stale bags, sorted by institution, and a
+// list of the errors it encountered. An error with one bucket or bag
+// does not stop the sweep.
+func (sweep *StaleBagSweep) Run(buckets []string) (summaries []*StaleBagSummary, errors []error) {
+	now := sweep.Now
+	if now.IsZero() {
+		now = NowUTC()
+	}
+	summaries = make([]*StaleBagSummary, 0)
+	errors = make([]error, 0)
+	toQueue := make([]*staleBag, 0)
+	bucketSummaries := make([]*StaleBagSummary, 0, len(buckets))
+	for _, bucketName := range buckets {
+		keys, err := sweep.S3.ListBucket(bucketName, 0)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("Cannot list bucket %s: %v", bucketName, err))
+			continue
+		}
+		summary := &StaleBagSummary{
+			Institution: OwnerOf(bucketName),
+			Bucket:      bucketName,
+			FailedKeys:  make([]string, 0),
+		}
+		for _, key := range keys {
+			s3File := &S3File{BucketName: bucketName, Key: key}
+			bag, err := sweep.checkKey(s3File, now, summary)
+			if err != nil {
+				errors = append(errors, err)
+			} else if bag != nil {
+				toQueue = append(toQueue, bag)
+			}
+		}
+		bucketSummaries = append(bucketSummaries, summary)
+	}
+	errors = append(errors, sweep.queue(toQueue)...)
+	for _, summary := range bucketSummaries {
+		if summary.Stale > 0 {
+			summaries = append(summaries, summary)
+		}
+	}
+	sort.Sort(staleBagSummariesByInstitution(summaries))
+	return summaries, errors
+}
+
+// Checks whether s3File is stale. If it is, and it has a failed
+// ProcessedItem, this records it in the summary. If it has no
+// ProcessedItem, this returns a staleBag describing the ProcessedItem
+// to create when the bag is queued.
+func (sweep *StaleBagSweep) checkKey(s3File *S3File, now time.Time, summary *StaleBagSummary) (*staleBag, error) {
+	bagDate, err := ParseS3Time(s3File.Key.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse S3File mod date '%s' for %s/%s: %v",
+			s3File.Key.LastModified, s3File.BucketName, s3File.Key.Key, err)
+	}
+	age := now.Sub(bagDate)
+	if age < sweep.Threshold {
+		return nil, nil
+	}
+	etag := strings.Replace(s3File.Key.ETag, "\"", "", 2)
+	status, err := sweep.Fluctus.GetBagStatus(etag, s3File.Key.Key, bagDate)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get Fluctus bag status for %s/%s: %v",
+			s3File.BucketName, s3File.Key.Key, err)
+	}
+	if status != nil {
+		if status.Status == StatusFailed && status.Retry == false {
+			summary.addStaleKey(s3File.Key.Key, age)
+			summary.FailedKeys = append(summary.FailedKeys, s3File.Key.Key)
+		}
+		return nil, nil
+	}
+	status = &ProcessStatus{
+		Action:      ActionIngest,
+		Name:        s3File.Key.Key,
+		BagDate:     bagDate,
+		Bucket:      s3File.BucketName,
+		ETag:        etag,
+		Stage:       StageReceive,
+		Status:      StatusPending,
+		Institution: summary.Institution,
+		Retry:       true,
+		Note: fmt.Sprintf("Late pickup: item sat in receiving bucket for %s "+
+			"before it was queued for processing.", age.Round(time.Minute)),
+	}
+	return &staleBag{s3File: s3File, status: status, summary: summary, age: age}, nil
+}
+
+// Queues the stale bags for ingest, then creates their Pending
+// ProcessedItems. If the bags can't be queued, we create no
+// ProcessedItems, so the next sweep will find and queue the bags
+// again. Returns the errors it encountered.
+func (sweep *StaleBagSweep) queue(bags []*staleBag) (errors []error) {
+	errors = make([]error, 0)
+	if len(bags) == 0 {
+		return errors
+	}
+	s3Files := make([]*S3File, len(bags))
+	for i, bag := range bags {
+		s3Files[i] = bag.s3File
+	}
+	if err := sweep.Queue(s3Files); err != nil {
+		for _, bag := range bags {
+			bag.summary.addStaleKey(bag.s3File.Key.Key, bag.age)
+		}
+		return append(errors, fmt.Errorf("Cannot queue %d stale bags: %v", len(bags), err))
+	}
+	for _, bag := range bags {
+		bag.summary.addStaleKey(bag.s3File.Key.Key, bag.age)
+		bag.summary.Queued++
+		bag.status.Date = NowUTC()
+		err := sweep.Fluctus.UpdateProcessedItem(bag.status)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("Cannot create Fluctus ProcessedItem for "+
+				"stale bag %s/%s: %v", bag.s3File.BucketName, bag.s3File.Key.Key, err))
+		}
+	}
+	return errors
+}
+
+type staleBagSummariesByInstitution []*StaleBagSummary
+
+func (s staleBagSummariesByInstitution) Len() int      { return len(s) }
+func (s staleBagSummariesByInstitution) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s staleBagSummariesByInstitution) Less(i, j int) bool {
+	return s[i].Institution < s[j].Institution
+}
@@ -0,0 +1,193 @@
+package bagman_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/s3"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBucketLister returns canned keys for each bucket.
+type fakeBucketLister struct {
+	keys map[string][]s3.Key
+}
+
+func (fake *fakeBucketLister) ListBucket(bucketName string, limit int) ([]s3.Key, error) {
+	keys, ok := fake.keys[bucketName]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchBucket: %s", bucketName)
+	}
+	return keys, nil
+}
+
+// fakeStatusClient returns canned ProcessStatus records by
+// bag name, and records the ones the sweep creates.
+type fakeStatusClient struct {
+	statuses map[string]*bagman.ProcessStatus
+	created  []*bagman.ProcessStatus
+}
+
+func (fake *fakeStatusClient) GetBagStatus(etag, name string, bagDate time.Time) (*bagman.ProcessStatus, error) {
+	if name == "lookup_fails.tar" {
+		return nil, fmt.Errorf("Fluctus returned 500")
+	}
+	return fake.statuses[name], nil
+}
+
+func (fake *fakeStatusClient) UpdateProcessedItem(status *bagman.ProcessStatus) error {
+	fake.created = append(fake.created, status)
+	return nil
+}
+
+func staleTestKey(name string, lastModified time.Time) (s3.Key) {
+	return s3.Key{
+		Key:          name,
+		LastModified: lastModified.UTC().Format(bagman.S3DateFormat),
+		ETag:         "\"0123456789abcdef\"",
+	}
+}
+
+func TestStaleBagSweep(t *testing.T) {
+	now := time.Date(2015, 6, 22, 12, 0, 0, 0, time.UTC)
+	threeWeeksAgo := now.Add(-21 * 24 * time.Hour)
+	fourDaysAgo := now.Add(-4 * 24 * time.Hour)
+	lister := &fakeBucketLister{keys: map[string][]s3.Key{
+		"aptrust.receiving.virginia.edu": []s3.Key{
+			staleTestKey("new.tar", now.Add(-time.Hour)),
+			staleTestKey("just_under.tar", now.Add(-72*time.Hour+time.Minute)),
+			staleTestKey("forgotten.tar", threeWeeksAgo),
+			staleTestKey("also_forgotten.tar", fourDaysAgo),
+			staleTestKey("in_progress.tar", threeWeeksAgo),
+			staleTestKey("failed.tar", fourDaysAgo),
+			staleTestKey("failed_will_retry.tar", fourDaysAgo),
+			staleTestKey("lookup_fails.tar", fourDaysAgo),
+		},
+		"aptrust.receiving.ncsu.edu": []s3.Key{
+			staleTestKey("ncsu_bag.tar", fourDaysAgo),
+		},
+		"aptrust.receiving.unc.edu": []s3.Key{
+			staleTestKey("unc_bag.tar", now.Add(-time.Hour)),
+		},
+	}}
+	statusClient := &fakeStatusClient{statuses: map[string]*bagman.ProcessStatus{
+		"in_progress.tar":       &bagman.ProcessStatus{Status: bagman.StatusStarted, Retry: true},
+		"failed.tar":            &bagman.ProcessStatus{Status: bagman.StatusFailed, Retry: false},
+		"failed_will_retry.tar": &bagman.ProcessStatus{Status: bagman.StatusFailed, Retry: true},
+	}}
+	queued := make([]string, 0)
+	sweep := &bagman.StaleBagSweep{
+		S3:        lister,
+		Fluctus:   statusClient,
+		Threshold: 72 * time.Hour,
+		Now:       now,
+		Queue: func(s3Files []*bagman.S3File) error {
+			for _, s3File := range s3Files {
+				queued = append(queued, s3File.Key.Key)
+			}
+			return nil
+		},
+	}
+	buckets := []string{"aptrust.receiving.virginia.edu", "aptrust.receiving.unc.edu",
+		"aptrust.receiving.ncsu.edu", "aptrust.receiving.missing.edu"}
+	summaries, errors := sweep.Run(buckets)
+
+	// Only bags past the threshold with no ProcessedItem are queued.
+	expectedQueued := "forgotten.tar,also_forgotten.tar,ncsu_bag.tar"
+	if strings.Join(queued, ",") != expectedQueued {
+		t.Errorf("Queued %v, expected %s", queued, expectedQueued)
+	}
+	if len(statusClient.created) != 3 {
+		t.Fatalf("Sweep created %d ProcessedItems, expected 3", len(statusClient.created))
+	}
+	status := statusClient.created[0]
+	if status.Name != "forgotten.tar" || status.Status != bagman.StatusPending ||
+		status.Stage != bagman.StageReceive || !status.Retry ||
+		status.ETag != "0123456789abcdef" || !status.BagDate.Equal(threeWeeksAgo) ||
+		status.Institution != "virginia.edu" || status.Date.IsZero() {
+		t.Errorf("Unexpected ProcessedItem for stale bag: %+v", status)
+	}
+	if !strings.Contains(status.Note, "Late pickup") || !strings.Contains(status.Note, "504h0m0s") {
+		t.Errorf("ProcessedItem note should describe the late pickup: %s", status.Note)
+	}
+
+	// The missing bucket and the failed lookup are reported,
+	// and don't stop the sweep.
+	if len(errors) != 2 {
+		t.Errorf("Expected 2 errors, got %v", errors)
+	}
+
+	// UNC has no stale bags, so it has no summary.
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 summaries, got %d", len(summaries))
+	}
+	ncsu, virginia := summaries[0], summaries[1]
+	if ncsu.Institution != "ncsu.edu" || ncsu.Stale != 1 || ncsu.Queued != 1 ||
+		ncsu.OldestKey != "ncsu_bag.tar" || ncsu.OldestAge != 96*time.Hour {
+		t.Errorf("Unexpected NCSU summary: %s", ncsu)
+	}
+	if virginia.Institution != "virginia.edu" || virginia.Stale != 3 || virginia.Queued != 2 {
+		t.Errorf("Unexpected Virginia summary: %s", virginia)
+	}
+	if len(virginia.FailedKeys) != 1 || virginia.FailedKeys[0] != "failed.tar" {
+		t.Errorf("Virginia should report failed.tar as failed, got %v", virginia.FailedKeys)
+	}
+	if virginia.OldestKey != "forgotten.tar" || virginia.OldestAge != 21*24*time.Hour {
+		t.Errorf("Virginia's oldest stale bag should be forgotten.tar at 504h, got %s at %s",
+			virginia.OldestKey, virginia.OldestAge)
+	}
+	expected := "virginia.edu: 3 stale bags in aptrust.receiving.virginia.edu " +
+		"(2 queued, 1 failed without retry); oldest is forgotten.tar at 21d 0h"
+	if virginia.String() != expected {
+		t.Errorf("Summary string is '%s', expected '%s'", virginia.String(), expected)
+	}
+}
+
+func TestStaleBagSweepQueueError(t *testing.T) {
+	now := bagman.NowUTC()
+	lister := &fakeBucketLister{keys: map[string][]s3.Key{
+		"aptrust.receiving.virginia.edu": []s3.Key{
+			staleTestKey("forgotten.tar", now.Add(-100*time.Hour)),
+		},
+	}}
+	statusClient := &fakeStatusClient{}
+	sweep := &bagman.StaleBagSweep{
+		S3:        lister,
+		Fluctus:   statusClient,
+		Threshold: 72 * time.Hour,
+		Queue: func(s3Files []*bagman.S3File) error {
+			return fmt.Errorf("nsqd returned status code 500 on last mput")
+		},
+	}
+	summaries, errors := sweep.Run([]string{"aptrust.receiving.virginia.edu"})
+	if len(errors) != 1 || !strings.Contains(errors[0].Error(), "Cannot queue 1 stale bags") {
+		t.Errorf("Sweep should report the queue error, got %v", errors)
+	}
+	// The next sweep has to find the bag again, so it must not
+	// have a ProcessedItem saying it's pending.
+	if len(statusClient.created) != 0 {
+		t.Errorf("Sweep created %d ProcessedItems for bags it could not queue",
+			len(statusClient.created))
+	}
+	if len(summaries) != 1 || summaries[0].Stale != 1 || summaries[0].Queued != 0 {
+		t.Errorf("Summary should report 1 stale bag and none queued, got %v", summaries)
+	}
+}
+
+func TestStaleBagThresholdDuration(t *testing.T) {
+	config := bagman.Config{}
+	threshold, err := config.StaleBagThresholdDuration()
+	if err != nil || threshold != bagman.DEFAULT_STALE_BAG_THRESHOLD {
+		t.Errorf("Expected default threshold, got %s, %v", threshold, err)
+	}
+	config.StaleBagThreshold = "24h"
+	threshold, err = config.StaleBagThresholdDuration()
+	if err != nil || threshold != 24*time.Hour {
+		t.Errorf("Expected 24h, got %s, %v", threshold, err)
+	}
+	config.StaleBagThreshold = "three days"
+	if _, err = config.StaleBagThresholdDuration(); err == nil {
+		t.Errorf("StaleBagThresholdDuration should reject 'three days'")
+	}
+}
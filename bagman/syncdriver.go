@@ -0,0 +1,72 @@
+package bagman
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MessageProcessor is implemented by workers that can process
+// a Message. A worker's HandleMessage method wraps the incoming
+// nsq.Message and passes it to ProcessMessage. The SyncDriver
+// passes an InMemoryMessage instead.
+type MessageProcessor interface {
+	ProcessMessage(message Message) error
+}
+
+// SyncDriver feeds work items through a worker's channel pipeline
+// without NSQ, and blocks until the worker finishes or requeues
+// each item. Use this for integration tests and for small
+// deployments that don't want to run nsqd.
+type SyncDriver struct {
+	// How long to wait for the worker to finish or requeue an
+	// item. Zero means wait forever.
+	Timeout time.Duration
+}
+
+// NewSyncDriver returns a SyncDriver that waits up to timeout
+// for each item.
+func NewSyncDriver(timeout time.Duration) (*SyncDriver) {
+	return &SyncDriver{Timeout: timeout}
+}
+
+// Process serializes item to JSON, the way it would be queued in
+// NSQ, and passes it to the processor in an InMemoryMessage. It
+// returns once the processor finishes or requeues the message.
+// Check message.Requeued() to see whether the item should be
+// tried again.
+func (driver *SyncDriver) Process(processor MessageProcessor, item interface{}) (*InMemoryMessage, error) {
+	body, err := json.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize item to JSON: %v", err)
+	}
+	return driver.Run(body, processor.ProcessMessage)
+}
+
+// Run creates an InMemoryMessage with the specified body and passes
+// it to start, which should put the item into a worker's pipeline.
+// Run blocks until the worker finishes or requeues the message, or
+// until the driver's timeout expires. If start returns an error
+// without responding to the message, Run returns that error.
+func (driver *SyncDriver) Run(body []byte, start func(Message) error) (*InMemoryMessage, error) {
+	message := NewInMemoryMessage(body)
+	err := start(message)
+	if err != nil {
+		select {
+		case <-message.Done():
+		default:
+			return message, err
+		}
+	}
+	if driver.Timeout <= 0 {
+		<-message.Done()
+		return message, err
+	}
+	select {
+	case <-message.Done():
+		return message, err
+	case <-time.After(driver.Timeout):
+		return message, fmt.Errorf("Timed out after %s waiting for worker to "+
+			"finish or requeue message", driver.Timeout)
+	}
+}
@@ -0,0 +1,305 @@
+package bagman_test
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/crowdmob/goamz/aws"
+	"github.com/crowdmob/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIngestWorker is a cut-down version of the BagPreparer in
+// workers/bagpreparer.go. It fetches a bag from S3, unpacks and
+// validates it, and tells Fluctus what happened.
+type testIngestWorker struct {
+	procUtil       *bagman.ProcessUtil
+	fetchChannel   chan *bagman.IngestHelper
+	unpackChannel  chan *bagman.IngestHelper
+	resultsChannel chan *bagman.IngestHelper
+	lastResult     *bagman.ProcessResult
+}
+
+func newTestIngestWorker(procUtil *bagman.ProcessUtil) (*testIngestWorker) {
+	worker := &testIngestWorker{
+		procUtil:       procUtil,
+		fetchChannel:   make(chan *bagman.IngestHelper, 1),
+		unpackChannel:  make(chan *bagman.IngestHelper, 1),
+		resultsChannel: make(chan *bagman.IngestHelper, 1),
+	}
+	go worker.fetch()
+	go worker.unpack()
+	go worker.record()
+	return worker
+}
+
+func (worker *testIngestWorker) ProcessMessage(message bagman.Message) error {
+	var s3File bagman.S3File
+	err := json.Unmarshal(message.Body(), &s3File)
+	if err != nil {
+		message.Finish()
+		return err
+	}
+	worker.fetchChannel <- bagman.NewIngestHelper(worker.procUtil, message, &s3File)
+	return nil
+}
+
+func (worker *testIngestWorker) fetch() {
+	for helper := range worker.fetchChannel {
+		helper.Result.NsqMessage.Touch()
+		if helper.BagTooLarge() {
+			worker.resultsChannel <- helper
+			continue
+		}
+		helper.FetchTarFile()
+		if helper.Result.ErrorMessage != "" {
+			worker.resultsChannel <- helper
+		} else {
+			worker.unpackChannel <- helper
+		}
+	}
+}
+
+func (worker *testIngestWorker) unpack() {
+	for helper := range worker.unpackChannel {
+		helper.Result.NsqMessage.Touch()
+		helper.ProcessBagFile()
+		worker.resultsChannel <- helper
+	}
+}
+
+func (worker *testIngestWorker) record() {
+	for helper := range worker.resultsChannel {
+		status := helper.Result.IngestStatus(worker.procUtil.MessageLog)
+		helper.UpdateFluctusStatus(status.Stage, status.Status)
+		helper.DeleteLocalFiles()
+		worker.lastResult = helper.Result
+		if helper.Result.ErrorMessage != "" && helper.Result.Retry {
+			helper.Result.NsqMessage.Requeue(5 * time.Minute)
+		} else {
+			helper.Result.NsqMessage.Finish()
+		}
+	}
+}
+
+// fakeFluctus records the ProcessedItems posted to it.
+// It has no record of any bag, so status lookups return 404.
+type fakeFluctus struct {
+	mutex    sync.Mutex
+	statuses []*bagman.ProcessStatus
+}
+
+func (fake *fakeFluctus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v1/itemresults/"):
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == "POST" && r.URL.Path == "/api/v1/itemresults":
+		data, _ := ioutil.ReadAll(r.Body)
+		status := &bagman.ProcessStatus{}
+		if err := json.Unmarshal(data, status); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fake.mutex.Lock()
+		fake.statuses = append(fake.statuses, status)
+		fake.mutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// Serves the sample_good bag from the receiving bucket, and returns
+// the server and the S3 key describing the bag.
+func newFakeReceivingBucket(t *testing.T, bucketName, key string) (*httptest.Server, s3.Key) {
+	tarData, err := ioutil.ReadFile(sampleGood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == fmt.Sprintf("/%s/%s", bucketName, key) {
+			w.Write(tarData)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	return server, s3.Key{
+		Key:          key,
+		LastModified: "2014-11-04T19:57:28.000Z",
+		Size:         int64(len(tarData)),
+		ETag:         fmt.Sprintf("\"%x\"", md5.Sum(tarData)),
+	}
+}
+
+func TestSyncDriverRunsBagThroughPipeline(t *testing.T) {
+	bucketName := "aptrust.receiving.example.edu"
+	key := "example.edu.sample_good.tar"
+	s3Server, s3Key := newFakeReceivingBucket(t, bucketName, key)
+	defer s3Server.Close()
+	fluctus := &fakeFluctus{}
+	fluctusServer := httptest.NewServer(fluctus)
+	defer fluctusServer.Close()
+
+	procUtil := getProcessUtil()
+	defer deleteTestLogs(procUtil.Config)
+	region := aws.Region{Name: "test", S3Endpoint: s3Server.URL}
+	s3Client, err := bagman.NewS3ClientExplicitAuth(region, "Ax-S-Kee", "SeekritKee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	procUtil.S3Client = s3Client
+	procUtil.FluctusClient, err = bagman.NewFluctusClient(fluctusServer.URL,
+		"v1", "user@example.edu", "SeekritKee", procUtil.MessageLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3File := &bagman.S3File{
+		BucketName: bucketName,
+		Key:        s3Key,
+	}
+	worker := newTestIngestWorker(procUtil)
+	driver := bagman.NewSyncDriver(30 * time.Second)
+	message, err := driver.Process(worker, s3File)
+	if err != nil {
+		t.Fatalf("SyncDriver returned error: %v", err)
+	}
+	if !message.Finished() {
+		t.Errorf("Worker should have finished the message, but requeued it. Error: %s",
+			worker.lastResult.ErrorMessage)
+	}
+	// Two touches from the worker, plus one for each stage with a
+	// StageMsgTimeout in the test config: Fetch, Unpack and Validate.
+	if message.Touches() != 5 {
+		t.Errorf("Expected 5 touches, got %d", message.Touches())
+	}
+	if message.RequestedTimeout() != procUtil.Config.StageMsgTimeout[bagman.StageValidate] {
+		t.Errorf("Last requested timeout should be Validate's, got %s",
+			message.RequestedTimeout())
+	}
+	if worker.lastResult.ErrorMessage != "" {
+		t.Errorf("Unexpected error processing bag: %s", worker.lastResult.ErrorMessage)
+	}
+	if worker.lastResult.BagReadResult == nil ||
+		len(worker.lastResult.BagReadResult.ManifestFiles) == 0 {
+		t.Errorf("Bag should have been read and validated")
+	}
+	if len(fluctus.statuses) != 1 {
+		t.Errorf("Expected 1 ProcessedItem in Fluctus, got %d", len(fluctus.statuses))
+	} else if fluctus.statuses[0].Name != key {
+		t.Errorf("Fluctus ProcessedItem is for %s, expected %s",
+			fluctus.statuses[0].Name, key)
+	}
+	if bagman.FileExists(worker.lastResult.FetchResult.LocalFile) {
+		t.Errorf("Worker did not delete %s", worker.lastResult.FetchResult.LocalFile)
+	}
+}
+
+func TestSyncDriverSkipsBagOverMaxBagSize(t *testing.T) {
+	var s3Requests int32
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s3Requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s3Server.Close()
+	fluctus := &fakeFluctus{}
+	fluctusServer := httptest.NewServer(fluctus)
+	defer fluctusServer.Close()
+
+	procUtil := getProcessUtil()
+	defer deleteTestLogs(procUtil.Config)
+	procUtil.Config.MaxBagSize = 1000
+	region := aws.Region{Name: "test", S3Endpoint: s3Server.URL}
+	s3Client, err := bagman.NewS3ClientExplicitAuth(region, "Ax-S-Kee", "SeekritKee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	procUtil.S3Client = s3Client
+	procUtil.FluctusClient, err = bagman.NewFluctusClient(fluctusServer.URL,
+		"v1", "user@example.edu", "SeekritKee", procUtil.MessageLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3File := &bagman.S3File{
+		BucketName: "aptrust.receiving.example.edu",
+		Key: s3.Key{
+			Key:          "example.edu.too_big.tar",
+			LastModified: "2014-11-04T19:57:28.000Z",
+			Size:         1001,
+		},
+	}
+	worker := newTestIngestWorker(procUtil)
+	message, err := bagman.NewSyncDriver(10 * time.Second).Process(worker, s3File)
+	if err != nil {
+		t.Fatalf("SyncDriver returned error: %v", err)
+	}
+	if !message.Finished() {
+		t.Errorf("Worker should have finished the message instead of requeueing it")
+	}
+	if !strings.HasPrefix(worker.lastResult.ErrorMessage, "bag too large") {
+		t.Errorf("Unexpected error message: %s", worker.lastResult.ErrorMessage)
+	}
+	if worker.lastResult.Retry {
+		t.Errorf("Bag that is too large should not be retried")
+	}
+	if worker.lastResult.FetchResult != nil {
+		t.Errorf("Worker should not have tried to fetch the bag")
+	}
+	if atomic.LoadInt32(&s3Requests) != 0 {
+		t.Errorf("Worker made %d requests to S3, expected none", s3Requests)
+	}
+	if len(fluctus.statuses) != 1 || fluctus.statuses[0].Status != bagman.StatusFailed {
+		t.Errorf("Fluctus should have a failed ProcessedItem for the bag")
+	}
+}
+
+func TestSyncDriverRequeue(t *testing.T) {
+	driver := bagman.NewSyncDriver(5 * time.Second)
+	message, err := driver.Run([]byte("{}"), func(message bagman.Message) error {
+		go func() {
+			message.Touch()
+			message.Requeue(time.Minute)
+			// Responses after the first are ignored, as in NSQ.
+			message.Finish()
+		}()
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Run returned error: %v", err)
+	}
+	if !message.Requeued() || message.Finished() {
+		t.Errorf("Message should be requeued and not finished")
+	}
+	if message.RequeueDelay() != time.Minute {
+		t.Errorf("Expected requeue delay of 1m, got %s", message.RequeueDelay())
+	}
+}
+
+func TestSyncDriverErrorsAndTimeout(t *testing.T) {
+	driver := bagman.NewSyncDriver(50 * time.Millisecond)
+	_, err := driver.Run(nil, func(message bagman.Message) error {
+		return fmt.Errorf("Bad message")
+	})
+	if err == nil || err.Error() != "Bad message" {
+		t.Errorf("Run should return the error from start, got %v", err)
+	}
+	message, err := driver.Run(nil, func(message bagman.Message) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Errorf("Run should have timed out, got %v", err)
+	}
+	if message.Finished() || message.Requeued() {
+		t.Errorf("Message should be neither finished nor requeued")
+	}
+}
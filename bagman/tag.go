@@ -4,6 +4,10 @@ package bagman
 // TagField struct, but its properties are public and can
 // be easily serialized to / deserialized from JSON.
 type Tag struct {
-	Label string
-	Value string
+	Label      string
+	Value      string
+	// SourceFile is the name of the tag file the tag came
+	// from, e.g. "bag-info.txt". It's empty for tags in
+	// results that were saved before we started recording it.
+	SourceFile string
 }
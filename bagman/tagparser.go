@@ -0,0 +1,90 @@
+package bagman
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The UTF-8 byte order mark some Windows editors put at the
+// start of text files.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// ReadTagFile parses the tag file at filePath. Tags get the base
+// name of the file as their SourceFile. See ParseTagFile.
+func ReadTagFile(filePath string) (tags []Tag, warnings []string, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return ParseTagFile(file, filepath.Base(filePath))
+}
+
+// ParseTagFile parses a BagIt tag file, such as bag-info.txt, from
+// reader. It strips a leading byte order mark and accepts CRLF and CR
+// line endings as well as LF. A line that starts with a space or tab
+// continues the value on the line before it, as in RFC 2822 headers.
+// Continuation lines are unfolded by removing the line break only, so
+// whitespace inside a value is preserved, but leading and trailing
+// whitespace is trimmed from the value.
+//
+// Lines that aren't tags and labels that appear more than once are
+// reported in warnings. Repeated labels are legal in bag-info.txt, so
+// every occurrence is returned in tags, in the order they appear.
+func ParseTagFile(reader io.Reader, sourceFile string) (tags []Tag, warnings []string, err error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = bytes.TrimPrefix(data, utf8BOM)
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	text = strings.Replace(text, "\r", "\n", -1)
+
+	tags = make([]Tag, 0)
+	warnings = make([]string, 0)
+	seen := make(map[string]bool)
+	var current *Tag
+	for lineNumber, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if current == nil {
+				warnings = append(warnings, fmt.Sprintf(
+					"Line %d of %s is indented but does not follow a tag", lineNumber+1, sourceFile))
+				continue
+			}
+			current.Value += line
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 1 {
+			warnings = append(warnings, fmt.Sprintf(
+				"Line %d of %s is not a tag: %s", lineNumber+1, sourceFile, line))
+			current = nil
+			continue
+		}
+		tags = append(tags, Tag{
+			Label:      strings.TrimSpace(line[:colon]),
+			Value:      line[colon+1:],
+			SourceFile: sourceFile,
+		})
+		current = &tags[len(tags)-1]
+	}
+
+	for i := range tags {
+		tags[i].Value = strings.TrimSpace(tags[i].Value)
+		lcLabel := strings.ToLower(tags[i].Label)
+		if seen[lcLabel] {
+			warnings = append(warnings, fmt.Sprintf(
+				"Tag %s appears more than once in %s", tags[i].Label, sourceFile))
+		}
+		seen[lcLabel] = true
+	}
+	return tags, warnings, nil
+}
@@ -0,0 +1,106 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var tagFileDir = filepath.Join(testDataPath, "tagfiles")
+
+const foldedDescription = "A collection of letters written by  Thomas Jefferson " +
+	"to his overseers at Monticello,\twith   notes by the archivist."
+
+func TestReadTagFile(t *testing.T) {
+	testCases := []struct {
+		file     string
+		expected []bagman.Tag
+		warnings int
+	}{
+		{"bag-info-simple.txt", []bagman.Tag{
+			{"Source-Organization", "virginia.edu", "bag-info-simple.txt"},
+			{"Bagging-Date", "2014-04-14T11:55:26.17-0400", "bag-info-simple.txt"},
+			{"Bag-Count", "1 of 1", "bag-info-simple.txt"},
+			{"Bag-Group-Identifier", "Charley Horse", "bag-info-simple.txt"},
+			{"Internal-Sender-Description", "Bag of goodies", "bag-info-simple.txt"},
+			{"Internal-Sender-Identifier", "uva-internal-id-0001", "bag-info-simple.txt"},
+		}, 0},
+		{"bag-info-folded.txt", []bagman.Tag{
+			{"Source-Organization", "virginia.edu", "bag-info-folded.txt"},
+			{"Internal-Sender-Description", foldedDescription, "bag-info-folded.txt"},
+			{"Internal-Sender-Identifier", "uva-internal-id-0001", "bag-info-folded.txt"},
+		}, 0},
+		{"aptrust-info-bom-crlf.txt", []bagman.Tag{
+			{"Title", "Notes from the Field", "aptrust-info-bom-crlf.txt"},
+			{"Access", "Consortia", "aptrust-info-bom-crlf.txt"},
+		}, 0},
+		{"bag-info-cr.txt", []bagman.Tag{
+			{"Source-Organization", "virginia.edu", "bag-info-cr.txt"},
+			{"Contact-Name", "Jane Doe", "bag-info-cr.txt"},
+		}, 0},
+		// One line that isn't a tag, and two repeats of Contact-Name.
+		{"bag-info-duplicates.txt", []bagman.Tag{
+			{"Contact-Name", "Jane Doe", "bag-info-duplicates.txt"},
+			{"Contact-Name", "John Doe", "bag-info-duplicates.txt"},
+			{"contact-name", "Jim Doe", "bag-info-duplicates.txt"},
+		}, 3},
+	}
+	for _, testCase := range testCases {
+		tags, warnings, err := bagman.ReadTagFile(filepath.Join(tagFileDir, testCase.file))
+		if err != nil {
+			t.Errorf("%s: %v", testCase.file, err)
+			continue
+		}
+		if len(tags) != len(testCase.expected) {
+			t.Errorf("%s: expected %d tags, got %d: %v", testCase.file,
+				len(testCase.expected), len(tags), tags)
+			continue
+		}
+		for i, tag := range tags {
+			if tag != testCase.expected[i] {
+				t.Errorf("%s: expected tag %v, got %v", testCase.file, testCase.expected[i], tag)
+			}
+		}
+		if len(warnings) != testCase.warnings {
+			t.Errorf("%s: expected %d warnings, got %v", testCase.file, testCase.warnings, warnings)
+		}
+	}
+}
+
+func TestParseTagFileContinuationWithoutTag(t *testing.T) {
+	tags, warnings, err := bagman.ParseTagFile(
+		strings.NewReader("  orphan\nTitle: Something\n"), "aptrust-info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Value != "Something" {
+		t.Errorf("Expected only the Title tag, got %v", tags)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "Line 1 of aptrust-info.txt") {
+		t.Errorf("Expected a warning about line 1, got %v", warnings)
+	}
+}
+
+// Regression test: bagins dropped everything after the first line
+// of a folded value, so long descriptions were truncated in Fluctus.
+func TestIntellectualObjectFoldedDescription(t *testing.T) {
+	result, err := bagman.LoadResult(filepath.Join("testdata", "result_good.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, _, err := bagman.ReadTagFile(filepath.Join(tagFileDir, "bag-info-folded.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.BagReadResult.Tags = append(tags,
+		bagman.Tag{Label: "Title", Value: "Jefferson Letters", SourceFile: "aptrust-info.txt"},
+		bagman.Tag{Label: "Access", Value: "Consortia", SourceFile: "aptrust-info.txt"})
+	obj, err := result.IntellectualObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Description != foldedDescription {
+		t.Errorf("Expected description '%s', got '%s'", foldedDescription, obj.Description)
+	}
+}
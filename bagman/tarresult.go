@@ -1,5 +1,11 @@
 package bagman
 
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
 // TarResult contains information about the attempt to untar
 // a bag.
 type TarResult struct {
@@ -9,6 +15,26 @@ type TarResult struct {
 	Warnings      []string
 	FilesUnpacked []string
 	Files         []*File
+	// The paths of junk files that were removed from Files,
+	// so they would not be stored.
+	SkippedFiles  []string      `json:",omitempty"`
+	// The number of files that were already in Fedora and have not
+	// changed since the last ingest, so they were not stored again.
+	// MergeExistingFiles sets this. See SkippedUnchangedFiles.
+	UnchangedFileCount int      `json:",omitempty"`
+	// The names of the entries at the root of the tar file, sorted.
+	// Directories end with a slash. A well-formed bag has exactly
+	// one, its top-level directory. See HasSingleTopLevelDir.
+	TopLevelEntries []string    `json:",omitempty"`
+}
+
+// HasSingleTopLevelDir returns true if everything in the tar file
+// was inside a single top-level directory, as the APTrust spec
+// requires. Returns false if there were files at the root of the
+// tar file, more than one top-level directory, or nothing at all.
+func (result *TarResult) HasSingleTopLevelDir() (bool) {
+	return len(result.TopLevelEntries) == 1 &&
+		strings.HasSuffix(result.TopLevelEntries[0], "/")
 }
 
 // Returns true if any of the untarred files are new or updated.
@@ -32,6 +58,71 @@ func (result *TarResult) FilePaths() []string {
 	return paths
 }
 
+// HasAllRequiredFiles returns the paths in required, usually the
+// paths in the payload manifests, that are not among the files
+// unpacked from the tar file. Paths are normalized before comparing
+// (see NormalizeBagPath), so a manifest entry "./data/file.txt"
+// matches data/file.txt. Missing paths are returned as they appear
+// in required, sorted. The list is empty if nothing is missing.
+func (result *TarResult) HasAllRequiredFiles(required []string) (missing []string) {
+	unpacked := make(map[string]bool, len(result.Files))
+	for _, filePath := range result.FilePaths() {
+		normalized, _ := NormalizeBagPath(filePath)
+		unpacked[normalized] = true
+	}
+	missing = make([]string, 0)
+	for _, filePath := range required {
+		normalized, _ := NormalizeBagPath(filePath)
+		if !unpacked[normalized] {
+			missing = append(missing, filePath)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// ZeroByteFiles returns the paths of payload files that are empty.
+// These are valid in BagIt, but they usually mean something went
+// wrong when the depositor built or uploaded the bag.
+func (result *TarResult) ZeroByteFiles() []string {
+	paths := make([]string, 0)
+	for _, file := range result.Files {
+		if file.Size == 0 && IsPayloadPath(file.Path) {
+			paths = append(paths, file.Path)
+		}
+	}
+	return paths
+}
+
+// JunkFiles returns the paths of payload files that match any of
+// the patterns. See IsJunkFile.
+func (result *TarResult) JunkFiles(patterns []string) []string {
+	paths := make([]string, 0)
+	for _, file := range result.Files {
+		if IsPayloadPath(file.Path) && IsJunkFile(file.Path, patterns) {
+			paths = append(paths, file.Path)
+		}
+	}
+	return paths
+}
+
+// RemoveFiles removes the files with the specified paths from
+// result.Files, so they won't be stored or recorded. It does not
+// delete them from disk.
+func (result *TarResult) RemoveFiles(paths []string) {
+	remove := make(map[string]bool, len(paths))
+	for _, filePath := range paths {
+		remove[filePath] = true
+	}
+	files := make([]*File, 0, len(result.Files))
+	for _, file := range result.Files {
+		if !remove[file.Path] {
+			files = append(files, file)
+		}
+	}
+	result.Files = files
+}
+
 // Returns the File with the specified path, if it exists.
 func (result *TarResult) GetFileByPath(filePath string) (*File) {
 	for index, file := range result.Files {
@@ -46,29 +137,137 @@ func (result *TarResult) GetFileByPath(filePath string) (*File) {
 // MergeExistingFiles merges data from generic files that
 // already exist in Fedora. This is necessary when an existing
 // bag is reprocessed or re-uploaded.
+//
+// Files are matched by path first. Then files that are new to the
+// object are matched by content with existing files whose paths are
+// no longer in the bag, since those were renamed. See
+// MatchRenamedFiles.
 func (result *TarResult) MergeExistingFiles(genericFiles []*GenericFile) {
+	vanished := make([]*GenericFile, 0)
 	for _, genericFile := range genericFiles {
 		origPath, _ := genericFile.OriginalPath()
 		file := result.GetFileByPath(origPath)
-		if file != nil {
-			file.ExistingFile = true
-			// Files have the same path and name. If the checksum
-			// has not changed, there is no reason to re-upload
-			// this file to the preservation bucket, nor is there
-			// any reason to create new ingest events in Fedora.
-			existingMd5 := genericFile.GetChecksum("md5")
-			if file.Md5 == existingMd5.Digest {
-				file.NeedsSave = false
-				file.StorageURL = genericFile.URI
-				file.StorageMd5 = existingMd5.Digest
-				ingestEvents := genericFile.FindEventsByType("ingest")
-				if len(ingestEvents) > 0 {
-					lastIngest := ingestEvents[len(ingestEvents) - 1]
-					file.StoredAt = lastIngest.DateTime
-				}
-			}
+		if file == nil {
+			vanished = append(vanished, genericFile)
+			continue
+		}
+		file.ExistingFile = true
+		// Files have the same path and name. If the checksum
+		// has not changed, there is no reason to re-upload
+		// this file to the preservation bucket, nor is there
+		// any reason to create new ingest events in Fedora.
+		existingMd5 := genericFile.GetChecksum("md5")
+		if file.Md5 == existingMd5.Digest {
+			file.NeedsSave = false
+			file.StorageURL = genericFile.URI
+			file.StorageMd5 = existingMd5.Digest
+			file.StoredAt = lastIngestTime(genericFile)
+		}
+	}
+	result.MatchRenamedFiles(vanished)
+	result.UnchangedFileCount = len(result.SkippedUnchangedFiles())
+}
+
+// SkippedUnchangedFiles returns the paths of files that were
+// already in Fedora and have not changed since the last ingest.
+// These are not stored or recorded again. This is accurate only
+// after MergeExistingFiles.
+func (result *TarResult) SkippedUnchangedFiles() ([]string) {
+	paths := make([]string, 0)
+	for _, file := range result.Files {
+		if file.ExistingFile && !file.NeedsSave {
+			paths = append(paths, file.Path)
+		}
+	}
+	return paths
+}
+
+/*
+MatchRenamedFiles finds files that the depositor renamed between
+versions of a bag. Param vanished should be the existing generic
+files whose paths are not in this bag. A file that is new to the
+object, and whose sha256 matches an active file in vanished, is
+a renamed copy of that file. It reuses the existing preservation
+copy instead of being uploaded again, and its RenamedFrom is set
+to the identifier of the file it replaces.
+
+Each existing file matches at most one new file. When several
+files have the same content, new files sorted by path are paired
+with existing files sorted by identifier, and any left over are
+treated as new files or deleted files as usual. This returns the
+renamed files.
+*/
+func (result *TarResult) MatchRenamedFiles(vanished []*GenericFile) ([]*File) {
+	candidates := make(map[string][]*GenericFile)
+	for _, genericFile := range vanished {
+		if genericFile.State != "" && genericFile.State != StateActive || genericFile.URI == "" {
+			continue
+		}
+		sha256 := genericFile.GetChecksum("sha256")
+		if sha256 == nil || sha256.Digest == "" {
+			continue
+		}
+		digest := strings.ToLower(sha256.Digest)
+		candidates[digest] = append(candidates[digest], genericFile)
+	}
+	newFiles := make(map[string][]*File)
+	for _, file := range result.Files {
+		digest := strings.ToLower(file.Sha256)
+		if file.ExistingFile || digest == "" || len(candidates[digest]) == 0 {
+			continue
 		}
+		newFiles[digest] = append(newFiles[digest], file)
 	}
+	renamed := make([]*File, 0)
+	for digest, files := range newFiles {
+		existing := candidates[digest]
+		sort.Sort(filesByPath(files))
+		sort.Sort(genericFilesByIdentifier(existing))
+		for i := 0; i < len(files) && i < len(existing); i++ {
+			files[i].ReuseStorage(existing[i])
+			renamed = append(renamed, files[i])
+		}
+	}
+	sort.Sort(filesByPath(renamed))
+	return renamed
+}
+
+// Returns the time of the file's last ingest event, or
+// an empty time if it has none.
+func lastIngestTime(genericFile *GenericFile) (time.Time) {
+	ingestEvents := genericFile.FindEventsByType("ingest")
+	if len(ingestEvents) > 0 {
+		return ingestEvents[len(ingestEvents) - 1].DateTime
+	}
+	return time.Time{}
+}
+
+type filesByPath []*File
+
+func (files filesByPath) Len() int {
+	return len(files)
+}
+
+func (files filesByPath) Swap(i, j int) {
+	files[i], files[j] = files[j], files[i]
+}
+
+func (files filesByPath) Less(i, j int) bool {
+	return files[i].Path < files[j].Path
+}
+
+type genericFilesByIdentifier []*GenericFile
+
+func (files genericFilesByIdentifier) Len() int {
+	return len(files)
+}
+
+func (files genericFilesByIdentifier) Swap(i, j int) {
+	files[i], files[j] = files[j], files[i]
+}
+
+func (files genericFilesByIdentifier) Less(i, j int) bool {
+	return files[i].Identifier < files[j].Identifier
 }
 
 // Returns true if any generic files were successfully copied
@@ -82,6 +281,29 @@ func (result *TarResult) AnyFilesCopiedToPreservation() bool {
 	return false
 }
 
+// StoredKeys returns the bucket and key of every file this ingest
+// copied to the preservation bucket, so a rollback of a failed
+// ingest can delete exactly what it stored. It leaves out files
+// that didn't need saving and renamed files: their StorageURL points
+// to the copy a previous ingest stored, which we must keep. It also
+// leaves out StorageURLs that aren't S3 URLs.
+func (result *TarResult) StoredKeys() ([]*CleanupFile) {
+	keys := make([]*CleanupFile, 0)
+	for _, file := range result.Files {
+		if file.StorageURL == "" || !file.NeedsSave || file.RenamedFrom != "" ||
+			!strings.HasPrefix(file.StorageURL, S3UriPrefix) ||
+			strings.Count(file.StorageURL, "/") < 4 {
+			continue
+		}
+		bucketName, key := BucketNameAndKey(file.StorageURL)
+		keys = append(keys, &CleanupFile{
+			BucketName: bucketName,
+			Key:        key,
+		})
+	}
+	return keys
+}
+
 // Returns true if all generic files were successfully copied
 // to S3 long term storage.
 func (result *TarResult) AllFilesCopiedToPreservation() bool {
@@ -128,6 +128,37 @@ func TestAnyFilesCopiedToPreservation(t *testing.T) {
 	}
 }
 
+func TestStoredKeys(t *testing.T) {
+	filepath := filepath.Join("testdata", "result_partial_store.json")
+	result, err := bagman.LoadResult(filepath)
+	if err != nil {
+		t.Fatalf("Error loading test data file '%s': %v", filepath, err)
+	}
+	// The third file wasn't stored, and the fourth was stored by
+	// an earlier ingest.
+	keys := result.TarResult.StoredKeys()
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 stored keys, got %d", len(keys))
+	}
+	for i, expectedKey := range []string{
+		"b21fdb34-1f79-4101-62c5-56918f4782fc",
+		"cba60bd7-1d46-4d53-705f-2298e173bbf9",
+	} {
+		if keys[i].BucketName != "aptrust.test.preservation" || keys[i].Key != expectedKey {
+			t.Errorf("Expected aptrust.test.preservation/%s, got %s/%s",
+				expectedKey, keys[i].BucketName, keys[i].Key)
+		}
+		if keys[i].Succeeded() {
+			t.Errorf("Stored key should not be marked deleted")
+		}
+	}
+
+	result.TarResult.Files[0].StorageURL = "file:///mnt/apt_data/metadata.xml"
+	if keys = result.TarResult.StoredKeys(); len(keys) != 1 {
+		t.Errorf("StoredKeys should skip URLs that aren't S3 URLs, got %d keys", len(keys))
+	}
+}
+
 func TestAllFilesCopiedToPreservation(t *testing.T) {
 	filepath := filepath.Join("testdata", "result_good.json")
 	result, err := bagman.LoadResult(filepath)
@@ -191,3 +222,205 @@ func TestMergeExistingFiles(t *testing.T) {
 	}
 
 }
+
+func buildVanishedFile(identifier, sha256, state string) (*bagman.GenericFile) {
+	return &bagman.GenericFile{
+		Identifier: identifier,
+		URI:        "https://s3.amazonaws.com/aptrust.test.preservation/uuid-" + identifier[len(identifier)-1:],
+		State:      state,
+		ChecksumAttributes: []*bagman.ChecksumAttribute{
+			{Algorithm: "md5", DateTime: time.Now(), Digest: "OldMd5Digest"},
+			{Algorithm: "sha256", DateTime: time.Now(), Digest: sha256},
+		},
+		Events: []*bagman.PremisEvent{
+			{EventType: "ingest", DateTime: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)},
+		},
+	}
+}
+
+func TestMergeExistingFilesRenamed(t *testing.T) {
+	filepath := filepath.Join("testdata", "result_good.json")
+	result, err := bagman.LoadResult(filepath)
+	if err != nil {
+		t.Fatalf("Error loading test data file '%s': %v", filepath, err)
+	}
+	genericFiles := buildGenericFiles()
+	// data/ORIGINAL/1 was renamed from data/old/1.
+	genericFiles = append(genericFiles, buildVanishedFile(
+		"ncsu.edu/ncsu.1840.16-2928/data/old/1",
+		"1E03F27BD4056B9082EA645517D3C419CB488AC316B392B344EDA73EA3010169", bagman.StateActive))
+	// Same content as data/object.properties, which matches by path.
+	genericFiles = append(genericFiles, buildVanishedFile(
+		"ncsu.edu/ncsu.1840.16-2928/data/old/2",
+		"54536211e3ad308e8509091a1db393cbcc7fadd4a9b7f434bec8097d149a2039", bagman.StateActive))
+	// Same content as data/ORIGINAL/1-metadata.xml, but deleted.
+	genericFiles = append(genericFiles, buildVanishedFile(
+		"ncsu.edu/ncsu.1840.16-2928/data/old/3",
+		"60eca5faef45a627d0c1e916026ed6cf91ffe911b5f9b136a3dcc7d99e291519", bagman.StateDeleted))
+	result.TarResult.MergeExistingFiles(genericFiles)
+
+	files := result.TarResult.Files
+	if files[1].RenamedFrom != "" || files[1].NeedsSave {
+		t.Errorf("Path match should take precedence over content match")
+	}
+	if files[3].RenamedFrom != "" {
+		t.Errorf("Deleted file should not be matched by content")
+	}
+	file := files[2]
+	if file.RenamedFrom != "ncsu.edu/ncsu.1840.16-2928/data/old/1" {
+		t.Fatalf("Expected data/ORIGINAL/1 to be renamed from data/old/1, got '%s'", file.RenamedFrom)
+	}
+	if file.ExistingFile || !file.NeedsSave {
+		t.Errorf("Renamed file should be a new file that needs saving")
+	}
+	if file.StorageURL != "https://s3.amazonaws.com/aptrust.test.preservation/uuid-1" ||
+		file.Uuid != "uuid-1" || file.StorageMd5 != "OldMd5Digest" ||
+		!file.StoredAt.Equal(time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Renamed file should reuse the existing preservation copy: %+v", file)
+	}
+	for _, cleanupFile := range result.TarResult.StoredKeys() {
+		if cleanupFile.Key == "uuid-1" {
+			t.Errorf("StoredKeys should not include the preservation copy of a renamed file")
+		}
+	}
+
+	events := file.PremisEvents()
+	renameEvent := events[len(events) - 1]
+	if len(events) != 6 || renameEvent.EventType != "identifier_assignment" ||
+		renameEvent.OutcomeDetail != "ncsu.edu/ncsu.1840.16-2928/data/old/1 -> " + file.Identifier {
+		t.Errorf("Renamed file should have an event recording the old and new identifiers")
+	}
+	if len(files[3].PremisEvents()) != 5 {
+		t.Errorf("File that was not renamed should not have a rename event")
+	}
+}
+
+func TestMatchRenamedFilesDuplicateContent(t *testing.T) {
+	sha256 := "1e03f27bd4056b9082ea645517d3c419cb488ac316b392b344eda73ea3010169"
+	result := &bagman.TarResult{}
+	for _, path := range []string{"data/c", "data/a", "data/b"} {
+		file := bagman.NewFile()
+		file.Path = path
+		file.Identifier = "test.edu/bag/" + path
+		file.Sha256 = sha256
+		result.Files = append(result.Files, file)
+	}
+	vanished := []*bagman.GenericFile{
+		buildVanishedFile("test.edu/bag/data/old/2", sha256, bagman.StateActive),
+		buildVanishedFile("test.edu/bag/data/old/1", sha256, ""),
+	}
+	renamed := result.MatchRenamedFiles(vanished)
+	if len(renamed) != 2 {
+		t.Fatalf("Expected 2 renamed files, got %d", len(renamed))
+	}
+	// Pairing is by sorted path and identifier, regardless of input order.
+	expected := map[string]string{
+		"data/a": "test.edu/bag/data/old/1",
+		"data/b": "test.edu/bag/data/old/2",
+		"data/c": "",
+	}
+	for _, file := range result.Files {
+		if file.RenamedFrom != expected[file.Path] {
+			t.Errorf("Expected %s to be renamed from '%s', got '%s'",
+				file.Path, expected[file.Path], file.RenamedFrom)
+		}
+	}
+	if result.Files[0].StorageURL != "" {
+		t.Errorf("Unmatched duplicate should be stored as a new file")
+	}
+}
+
+func TestHasAllRequiredFiles(t *testing.T) {
+	filepath := filepath.Join("testdata", "result_good.json")
+	result, err := bagman.LoadResult(filepath)
+	if err != nil {
+		t.Fatalf("Error loading test data file '%s': %v", filepath, err)
+	}
+	required := result.TarResult.FilePaths()
+	if missing := result.TarResult.HasAllRequiredFiles(required); len(missing) != 0 {
+		t.Errorf("Nothing should be missing, got %v", missing)
+	}
+
+	// Drop data/ORIGINAL/1 from the tar result, as if the depositor
+	// left it out of the tar file.
+	result.TarResult.RemoveFiles([]string{"data/ORIGINAL/1"})
+	missing := result.TarResult.HasAllRequiredFiles(required)
+	if len(missing) != 1 || missing[0] != "data/ORIGINAL/1" {
+		t.Errorf("Expected data/ORIGINAL/1 to be missing, got %v", missing)
+	}
+
+	// Manifest paths in a different form still match.
+	missing = result.TarResult.HasAllRequiredFiles([]string{"./data/metadata.xml",
+		"data\\ORIGINAL\\1", "data/ORIGINAL/1-metadata.xml"})
+	if len(missing) != 1 || missing[0] != "data\\ORIGINAL\\1" {
+		t.Errorf("Expected only the removed file to be missing, got %v", missing)
+	}
+}
+
+func TestZeroByteFiles(t *testing.T) {
+	result := &bagman.TarResult{
+		Files: []*bagman.File{
+			&bagman.File{Path: "bagit.txt", Size: 0},
+			&bagman.File{Path: "data/empty.txt", Size: 0},
+			&bagman.File{Path: "data/image.jpg", Size: 48213},
+			&bagman.File{Path: "data/subdir/placeholder", Size: 0},
+			&bagman.File{Path: "data/one_byte.txt", Size: 1},
+		},
+	}
+	zeroByteFiles := result.ZeroByteFiles()
+	if len(zeroByteFiles) != 2 ||
+		zeroByteFiles[0] != "data/empty.txt" ||
+		zeroByteFiles[1] != "data/subdir/placeholder" {
+		t.Errorf("Expected the two empty payload files, got %v", zeroByteFiles)
+	}
+	result.Files = result.Files[2:3]
+	if len(result.ZeroByteFiles()) != 0 {
+		t.Errorf("ZeroByteFiles should be empty when all payload files have data")
+	}
+}
+
+func TestJunkFilesAndRemoveFiles(t *testing.T) {
+	result := &bagman.TarResult{
+		Files: []*bagman.File{
+			&bagman.File{Path: "data/.DS_Store"},
+			&bagman.File{Path: "data/image.jpg"},
+			&bagman.File{Path: "data/__MACOSX/image.jpg"},
+			&bagman.File{Path: "custom_tags/.DS_Store"},
+		},
+	}
+	junkFiles := result.JunkFiles(bagman.DefaultJunkFilePatterns)
+	if len(junkFiles) != 2 || junkFiles[0] != "data/.DS_Store" ||
+		junkFiles[1] != "data/__MACOSX/image.jpg" {
+		t.Errorf("Expected the two junk payload files, got %v", junkFiles)
+	}
+	result.RemoveFiles(junkFiles)
+	if len(result.Files) != 2 || result.Files[0].Path != "data/image.jpg" ||
+		result.Files[1].Path != "custom_tags/.DS_Store" {
+		t.Errorf("RemoveFiles left %v", result.FilePaths())
+	}
+}
+
+func TestSkippedUnchangedFiles(t *testing.T) {
+	filepath := filepath.Join("testdata", "result_good.json")
+	result, err := bagman.LoadResult(filepath)
+	if err != nil {
+		t.Fatalf("Error loading test data file '%s': %v", filepath, err)
+	}
+	if len(result.TarResult.SkippedUnchangedFiles()) != 0 {
+		t.Errorf("Nothing should be skipped before merging existing files")
+	}
+	result.TarResult.MergeExistingFiles(buildGenericFiles())
+
+	// metadata.xml changed, and the ORIGINAL files are new.
+	skipped := result.TarResult.SkippedUnchangedFiles()
+	if len(skipped) != 1 || skipped[0] != "data/object.properties" {
+		t.Errorf("Expected only data/object.properties to be skipped, got %v", skipped)
+	}
+	if result.TarResult.UnchangedFileCount != 1 {
+		t.Errorf("Expected UnchangedFileCount 1, got %d", result.TarResult.UnchangedFileCount)
+	}
+	status := result.IngestStatus(bagman.DiscardLogger("tarresult_test"))
+	if status.Note != "No problems. Skipped 1 file(s) unchanged since the last ingest" {
+		t.Errorf("Wrong ProcessStatus note: %s", status.Note)
+	}
+}
@@ -0,0 +1,259 @@
+package bagman
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How far back we track throughput if Config.ThroughputWindow
+// is not set.
+const DEFAULT_THROUGHPUT_WINDOW = 24 * time.Hour
+
+// ThroughputInterval is the length of the intervals into which we
+// divide the throughput window to see how much the rate varies.
+const ThroughputInterval = time.Hour
+
+// ThroughputSample records one bag that finished ingest.
+type ThroughputSample struct {
+	Finished    time.Time `json:"finished"`
+	Bytes       int64     `json:"bytes"`
+	Institution string    `json:"institution"`
+}
+
+// ThroughputTracker keeps the bags a worker finished within a
+// sliding window, so we can tell partners roughly how long their
+// backlog will take. The record worker saves its tracker to the
+// log directory after each bag, and apt_estimate reads it from
+// there. It's safe to use across go routines.
+type ThroughputTracker struct {
+	// Window is how far back we keep samples.
+	Window  time.Duration
+	// Started is when this worker started tracking. Throughput is
+	// measured from Started or the start of the window, whichever
+	// is later, so a worker that just started doesn't look slow.
+	Started time.Time
+	samples []ThroughputSample
+	mutex   *sync.Mutex
+}
+
+// The JSON format of a saved ThroughputTracker.
+type savedThroughput struct {
+	Window  string             `json:"window"`
+	Started time.Time          `json:"started"`
+	Samples []ThroughputSample `json:"samples"`
+}
+
+// NewThroughputTracker returns an empty tracker that keeps samples
+// for the specified window, starting now.
+func NewThroughputTracker(window time.Duration) (*ThroughputTracker) {
+	return &ThroughputTracker{
+		Window:  window,
+		Started: NowUTC(),
+		samples: make([]ThroughputSample, 0),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// LoadThroughputTracker loads a tracker saved at filePath, dropping
+// samples older than window. If the file doesn't exist, this returns
+// a new, empty tracker.
+func LoadThroughputTracker(filePath string, window time.Duration) (*ThroughputTracker, error) {
+	tracker := NewThroughputTracker(window)
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return tracker, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := &savedThroughput{}
+	if err = json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("Cannot parse throughput file %s: %v", filePath, err)
+	}
+	if !saved.Started.IsZero() {
+		tracker.Started = saved.Started.UTC()
+	}
+	if saved.Samples != nil {
+		tracker.samples = saved.Samples
+	}
+	tracker.prune(NowUTC())
+	return tracker, nil
+}
+
+// Add adds a sample and drops samples that have left the window.
+func (tracker *ThroughputTracker) Add(sample ThroughputSample) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.samples = append(tracker.samples, sample)
+	tracker.prune(sample.Finished)
+}
+
+// Samples returns a copy of the samples in the window ending now.
+func (tracker *ThroughputTracker) Samples(now time.Time) ([]ThroughputSample) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	samples := make([]ThroughputSample, 0, len(tracker.samples))
+	for _, sample := range tracker.samples {
+		if !sample.Finished.Before(now.Add(-tracker.Window)) && !sample.Finished.After(now) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// Measure returns the throughput over the window ending now.
+func (tracker *ThroughputTracker) Measure(now time.Time) (*Throughput) {
+	return MeasureThroughput(tracker.Samples(now), tracker.Started, tracker.Window, now)
+}
+
+// Save writes the tracker to filePath as JSON. It writes to a temp
+// file first, so a reader never sees a partial file.
+func (tracker *ThroughputTracker) Save(filePath string) (error) {
+	tracker.mutex.Lock()
+	saved := &savedThroughput{
+		Window:  tracker.Window.String(),
+		Started: tracker.Started,
+		Samples: tracker.samples,
+	}
+	data, err := json.Marshal(saved)
+	tracker.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	tempFile := filePath + ".tmp"
+	if err = ioutil.WriteFile(tempFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, filePath)
+}
+
+// Drops samples older than the window ending at now.
+// Caller must hold the lock.
+func (tracker *ThroughputTracker) prune(now time.Time) {
+	cutoff := now.Add(-tracker.Window)
+	kept := tracker.samples[:0]
+	for _, sample := range tracker.samples {
+		if !sample.Finished.Before(cutoff) {
+			kept = append(kept, sample)
+		}
+	}
+	tracker.samples = kept
+}
+
+// ThroughputFile returns the path to which the named process
+// saves its ThroughputTracker.
+func ThroughputFile(config Config, processName string) (string) {
+	return filepath.Join(config.AbsLogDirectory(), processName+".throughput.json")
+}
+
+// Throughput describes how fast bags finished over a window.
+type Throughput struct {
+	// The number of bags and bytes finished in the window.
+	Bags         int
+	Bytes        int64
+	// Span is the part of the window we have data for.
+	Span         time.Duration
+	BagsPerHour  float64
+	BytesPerHour float64
+	// IntervalRates are the bags per hour in each whole hour of
+	// Span, oldest first. An interval in which no bags
+	// finished is probably one with no work to do, rather than one
+	// in which we were slow, so the estimator ignores those.
+	IntervalRates []float64
+	// Workers is the number of workers whose samples this includes.
+	Workers      int
+}
+
+// MeasureThroughput calculates throughput from the samples that
+// finished within window before now. Param started is when the
+// samples started being collected.
+func MeasureThroughput(samples []ThroughputSample, started time.Time, window time.Duration, now time.Time) (*Throughput) {
+	from := now.Add(-window)
+	if started.After(from) {
+		from = started
+	}
+	throughput := &Throughput{
+		Span:          now.Sub(from),
+		IntervalRates: make([]float64, 0),
+		Workers:       1,
+	}
+	if throughput.Span <= 0 {
+		throughput.Span = 0
+		return throughput
+	}
+	// Rates are for whole intervals ending at now. A partial interval
+	// at the start of Span would make a bag or two look like a rush.
+	intervals := int(throughput.Span / ThroughputInterval)
+	counts := make([]int, intervals)
+	for _, sample := range samples {
+		if sample.Finished.Before(from) || sample.Finished.After(now) {
+			continue
+		}
+		throughput.Bags++
+		throughput.Bytes += sample.Bytes
+		index := intervals - 1 - int(now.Sub(sample.Finished) / ThroughputInterval)
+		if index >= 0 {
+			counts[index]++
+		}
+	}
+	hours := throughput.Span.Hours()
+	throughput.BagsPerHour = float64(throughput.Bags) / hours
+	throughput.BytesPerHour = float64(throughput.Bytes) / hours
+	for _, count := range counts {
+		throughput.IntervalRates = append(throughput.IntervalRates,
+			float64(count) / ThroughputInterval.Hours())
+	}
+	return throughput
+}
+
+// CombineThroughput adds up the throughput of several workers
+// measured over the same window. Interval rates are added from
+// the newest interval back, since every window ends at the same
+// time.
+func CombineThroughput(throughputs []*Throughput) (*Throughput) {
+	combined := &Throughput{IntervalRates: make([]float64, 0)}
+	for _, throughput := range throughputs {
+		combined.Bags += throughput.Bags
+		combined.Bytes += throughput.Bytes
+		combined.BagsPerHour += throughput.BagsPerHour
+		combined.BytesPerHour += throughput.BytesPerHour
+		combined.Workers += throughput.Workers
+		if throughput.Span > combined.Span {
+			combined.Span = throughput.Span
+		}
+		for len(combined.IntervalRates) < len(throughput.IntervalRates) {
+			combined.IntervalRates = append([]float64{0}, combined.IntervalRates...)
+		}
+		offset := len(combined.IntervalRates) - len(throughput.IntervalRates)
+		for i, rate := range throughput.IntervalRates {
+			combined.IntervalRates[offset+i] += rate
+		}
+	}
+	return combined
+}
+
+// BusyRates returns the interval rates in which at least one bag
+// finished, sorted slowest first.
+func (throughput *Throughput) BusyRates() ([]float64) {
+	rates := make([]float64, 0, len(throughput.IntervalRates))
+	for _, rate := range throughput.IntervalRates {
+		if rate > 0 {
+			rates = append(rates, rate)
+		}
+	}
+	sort.Float64s(rates)
+	return rates
+}
+
+// String returns a summary such as "12.5 bags/hour, 3.4 GB/hour
+// (300 bags in 1d 0h, 2 workers)".
+func (throughput *Throughput) String() (string) {
+	return fmt.Sprintf("%.1f bags/hour, %s/hour (%d bags in %s, %d workers)",
+		throughput.BagsPerHour, FormatBytes(int64(throughput.BytesPerHour)),
+		throughput.Bags, FormatDuration(throughput.Span), throughput.Workers)
+}
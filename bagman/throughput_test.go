@@ -0,0 +1,169 @@
+package bagman_test
+
+import (
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var throughputNow = time.Date(2016, 4, 12, 12, 0, 0, 0, time.UTC)
+
+// Returns count samples of bytes each, spread evenly over the hour
+// that ends hoursAgo hours before throughputNow.
+func hourOfSamples(hoursAgo, count int, bytes int64) ([]bagman.ThroughputSample) {
+	samples := make([]bagman.ThroughputSample, count)
+	end := throughputNow.Add(-time.Duration(hoursAgo) * time.Hour)
+	for i := range samples {
+		samples[i] = bagman.ThroughputSample{
+			Finished:    end.Add(-time.Duration(i) * time.Hour / time.Duration(count)),
+			Bytes:       bytes,
+			Institution: "unc.edu",
+		}
+	}
+	return samples
+}
+
+func floatsEqual(a, b float64) (bool) {
+	return math.Abs(a - b) < 0.0001
+}
+
+func TestMeasureThroughput(t *testing.T) {
+	samples := hourOfSamples(0, 10, 1000)
+	samples = append(samples, hourOfSamples(2, 4, 1000)...)
+	// Outside the window
+	samples = append(samples, hourOfSamples(5, 50, 1000)...)
+	started := throughputNow.Add(-48 * time.Hour)
+	throughput := bagman.MeasureThroughput(samples, started, 4 * time.Hour, throughputNow)
+	if throughput.Bags != 14 || throughput.Bytes != 14000 {
+		t.Errorf("Expected 14 bags, 14000 bytes; got %d, %d", throughput.Bags, throughput.Bytes)
+	}
+	if throughput.Span != 4 * time.Hour {
+		t.Errorf("Expected span of 4h, got %s", throughput.Span)
+	}
+	if !floatsEqual(throughput.BagsPerHour, 3.5) || !floatsEqual(throughput.BytesPerHour, 3500) {
+		t.Errorf("Expected 3.5 bags/hour, 3500 bytes/hour; got %f, %f",
+			throughput.BagsPerHour, throughput.BytesPerHour)
+	}
+	expected := []float64{0, 4, 0, 10}
+	if len(throughput.IntervalRates) != len(expected) {
+		t.Fatalf("Expected %d interval rates, got %v", len(expected), throughput.IntervalRates)
+	}
+	for i := range expected {
+		if !floatsEqual(throughput.IntervalRates[i], expected[i]) {
+			t.Errorf("Expected interval rates %v, got %v", expected, throughput.IntervalRates)
+			break
+		}
+	}
+	busy := throughput.BusyRates()
+	if len(busy) != 2 || busy[0] != 4 || busy[1] != 10 {
+		t.Errorf("Expected busy rates [4 10], got %v", busy)
+	}
+}
+
+func TestMeasureThroughputRecentStart(t *testing.T) {
+	// A worker that started 90 minutes ago is measured over 90
+	// minutes, with one whole interval.
+	started := throughputNow.Add(-90 * time.Minute)
+	samples := hourOfSamples(0, 6, 10)
+	samples = append(samples, bagman.ThroughputSample{Finished: started.Add(time.Minute)})
+	throughput := bagman.MeasureThroughput(samples, started, 24 * time.Hour, throughputNow)
+	if throughput.Span != 90 * time.Minute || throughput.Bags != 7 {
+		t.Errorf("Expected 7 bags in 90m, got %d in %s", throughput.Bags, throughput.Span)
+	}
+	if len(throughput.IntervalRates) != 1 || throughput.IntervalRates[0] != 6 {
+		t.Errorf("Expected one interval at 6 bags/hour, got %v", throughput.IntervalRates)
+	}
+}
+
+func TestMeasureThroughputEmpty(t *testing.T) {
+	throughput := bagman.MeasureThroughput(nil, time.Time{}, 24 * time.Hour, throughputNow)
+	if throughput.Bags != 0 || throughput.BagsPerHour != 0 || len(throughput.BusyRates()) != 0 {
+		t.Errorf("Empty window should have no throughput, got %s", throughput)
+	}
+	if len(throughput.IntervalRates) != 24 {
+		t.Errorf("Expected 24 empty intervals, got %d", len(throughput.IntervalRates))
+	}
+}
+
+func TestCombineThroughput(t *testing.T) {
+	started := throughputNow.Add(-48 * time.Hour)
+	first := bagman.MeasureThroughput(hourOfSamples(0, 6, 100), started, 3 * time.Hour, throughputNow)
+	second := bagman.MeasureThroughput(hourOfSamples(1, 3, 200),
+		throughputNow.Add(-2 * time.Hour), 3 * time.Hour, throughputNow)
+	combined := bagman.CombineThroughput([]*bagman.Throughput{first, second})
+	if combined.Workers != 2 || combined.Bags != 9 || combined.Bytes != 1200 {
+		t.Errorf("Expected 2 workers, 9 bags, 1200 bytes; got %d, %d, %d",
+			combined.Workers, combined.Bags, combined.Bytes)
+	}
+	if !floatsEqual(combined.BagsPerHour, 2 + 1.5) {
+		t.Errorf("Expected 3.5 bags/hour, got %f", combined.BagsPerHour)
+	}
+	// The second worker has only the last two intervals.
+	expected := []float64{0, 3, 6}
+	for i := range expected {
+		if len(combined.IntervalRates) != 3 || !floatsEqual(combined.IntervalRates[i], expected[i]) {
+			t.Errorf("Expected interval rates %v, got %v", expected, combined.IntervalRates)
+			break
+		}
+	}
+}
+
+func TestThroughputTrackerSlidingWindow(t *testing.T) {
+	tracker := bagman.NewThroughputTracker(2 * time.Hour)
+	tracker.Started = throughputNow.Add(-5 * time.Hour)
+	for _, sample := range hourOfSamples(4, 3, 1) {
+		tracker.Add(sample)
+	}
+	for _, sample := range hourOfSamples(0, 2, 1) {
+		tracker.Add(sample)
+	}
+	// Adding recent samples pushes the old ones out of the window.
+	if samples := tracker.Samples(throughputNow); len(samples) != 2 {
+		t.Errorf("Expected 2 samples in the window, got %d", len(samples))
+	}
+	throughput := tracker.Measure(throughputNow)
+	if throughput.Bags != 2 || throughput.Span != 2 * time.Hour {
+		t.Errorf("Expected 2 bags in 2h, got %d in %s", throughput.Bags, throughput.Span)
+	}
+}
+
+func TestThroughputTrackerSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throughput_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "apt_record.throughput.json")
+
+	tracker, err := bagman.LoadThroughputTracker(filePath, time.Hour)
+	if err != nil || len(tracker.Samples(bagman.NowUTC())) != 0 {
+		t.Fatalf("Missing file should give an empty tracker, got error %v", err)
+	}
+	started := bagman.NowUTC().Add(-3 * time.Hour)
+	tracker.Started = started
+	tracker.Add(bagman.ThroughputSample{Finished: bagman.NowUTC().Add(-2 * time.Hour)})
+	tracker.Add(bagman.ThroughputSample{Finished: bagman.NowUTC(), Bytes: 512, Institution: "unc.edu"})
+	if err = tracker.Save(filePath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := bagman.LoadThroughputTracker(filePath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Started.Equal(started) {
+		t.Errorf("Started should be %v after loading, got %v", started, loaded.Started)
+	}
+	samples := loaded.Samples(bagman.NowUTC())
+	if len(samples) != 1 || samples[0].Bytes != 512 || samples[0].Institution != "unc.edu" {
+		t.Errorf("Expected the one sample in the window, got %v", samples)
+	}
+
+	ioutil.WriteFile(filePath, []byte("not json"), 0644)
+	if _, err = bagman.LoadThroughputTracker(filePath, time.Hour); err == nil {
+		t.Errorf("LoadThroughputTracker should reject a corrupt file")
+	}
+}
@@ -0,0 +1,57 @@
+package bagman
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Layouts Fluctus has used for timestamps. Rails normally sends
+// RFC3339 with an offset, but some older records have no zone at
+// all. Those were always written in UTC.
+var fluctusTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// NowUTC returns the current time in UTC. Use this, rather than
+// time.Now(), for any timestamp we store or send to Fluctus or DPN,
+// so that the same moment always serializes the same way.
+func NowUTC() (time.Time) {
+	return time.Now().UTC()
+}
+
+// ParseS3Time parses a LastModified value from an S3 bucket
+// listing and returns it in UTC. It also accepts the RFC1123
+// format S3 uses in the Last-Modified header.
+func ParseS3Time(value string) (time.Time, error) {
+	parsed, err := time.Parse(S3DateFormat, value)
+	if err != nil {
+		parsed, err = time.Parse(time.RFC1123, value)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Cannot parse S3 timestamp '%s'", value)
+	}
+	return parsed.UTC(), nil
+}
+
+// ParseFluctusTime parses a timestamp from Fluctus and returns it
+// in UTC. Values without a zone are assumed to be UTC.
+func ParseFluctusTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range fluctusTimeLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Cannot parse Fluctus timestamp '%s'", value)
+}
+
+// FormatUTC returns the timestamp as an RFC3339 string in UTC.
+// This is the format we send to Fluctus and DPN.
+func FormatUTC(t time.Time) (string) {
+	return t.UTC().Format(time.RFC3339)
+}
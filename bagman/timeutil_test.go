@@ -0,0 +1,240 @@
+package bagman_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var eastern = time.FixedZone("EST", -5 * 60 * 60)
+
+func TestNowUTC(t *testing.T) {
+	if bagman.NowUTC().Location() != time.UTC {
+		t.Errorf("NowUTC returned a time in %s", bagman.NowUTC().Location())
+	}
+}
+
+func TestParseS3Time(t *testing.T) {
+	expected := time.Date(2014, 5, 28, 16, 22, 24, 16000000, time.UTC)
+	parsed, err := bagman.ParseS3Time("2014-05-28T16:22:24.016Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != expected {
+		t.Errorf("Expected %v, got %v", expected, parsed)
+	}
+	parsed, err = bagman.ParseS3Time("Wed, 28 May 2014 16:22:24 GMT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(expected.Truncate(time.Second)) || parsed.Location() != time.UTC {
+		t.Errorf("Expected %v, got %v", expected.Truncate(time.Second), parsed)
+	}
+	if _, err = bagman.ParseS3Time("yesterday"); err == nil {
+		t.Errorf("ParseS3Time should reject 'yesterday'")
+	}
+}
+
+func TestParseFluctusTime(t *testing.T) {
+	expected := time.Date(2014, 7, 2, 12, 0, 0, 0, time.UTC)
+	for _, value := range []string{
+		"2014-07-02T12:00:00Z",
+		"2014-07-02T07:00:00-05:00",
+		"2014-07-02T08:00:00.000-04:00",
+		"2014-07-02T12:00:00",
+		"2014-07-02 12:00:00",
+	} {
+		parsed, err := bagman.ParseFluctusTime(value)
+		if err != nil {
+			t.Errorf("Error parsing '%s': %v", value, err)
+			continue
+		}
+		if parsed != expected {
+			t.Errorf("'%s' parsed as %v, expected %v", value, parsed, expected)
+		}
+	}
+	if _, err := bagman.ParseFluctusTime("07/02/2014"); err == nil {
+		t.Errorf("ParseFluctusTime should reject '07/02/2014'")
+	}
+}
+
+// A status built in a non-UTC zone should come back from Fluctus
+// equal to the original, and in UTC.
+func TestProcessStatusRoundTripUTC(t *testing.T) {
+	status := ProcessStatusSample()
+	status.BagDate = time.Date(2014, 7, 2, 7, 0, 0, 16000000, eastern)
+	status.Date = time.Date(2014, 9, 10, 8, 30, 0, 0, eastern)
+	data, err := status.SerializeForFluctus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"bag_date":"2014-07-02T12:00:00.016Z"`) ||
+		!strings.Contains(string(data), `"date":"2014-09-10T13:30:00Z"`) {
+		t.Errorf("SerializeForFluctus should write dates in UTC: %s", string(data))
+	}
+	parsed := &bagman.ProcessStatus{}
+	if err = json.Unmarshal(data, parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.BagDate != status.BagDate.UTC() || parsed.Date != status.Date.UTC() {
+		t.Errorf("Round trip changed dates: %v, %v -> %v, %v",
+			status.BagDate, status.Date, parsed.BagDate, parsed.Date)
+	}
+
+	// Fluctus may echo dates back with an offset.
+	echoed := strings.Replace(string(data), "2014-07-02T12:00:00.016Z",
+		"2014-07-02T08:00:00.016-04:00", 1)
+	if err = json.Unmarshal([]byte(echoed), parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.BagDate != status.BagDate.UTC() {
+		t.Errorf("Echoed BagDate %v should equal %v", parsed.BagDate, status.BagDate.UTC())
+	}
+}
+
+func TestPremisEventAndChecksumMarshalUTC(t *testing.T) {
+	localTime := time.Date(2014, 7, 2, 7, 0, 0, 0, eastern)
+	event := &bagman.PremisEvent{EventType: "ingest", DateTime: localTime}
+	checksum := &bagman.ChecksumAttribute{Algorithm: "md5", DateTime: localTime}
+	gf := &bagman.GenericFile{
+		Identifier:         "ncsu.edu/object/data/file.txt",
+		Created:            localTime,
+		Modified:           localTime,
+		ChecksumAttributes: []*bagman.ChecksumAttribute{checksum},
+		Events:             []*bagman.PremisEvent{event},
+	}
+	gfJson, err := gf.SerializeForFluctus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulkJson, err := json.Marshal(bagman.GenericFilesToBulkSaveMaps([]*bagman.GenericFile{gf}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{gfJson, bulkJson} {
+		if strings.Contains(string(data), "-05:00") ||
+			!strings.Contains(string(data), "2014-07-02T12:00:00Z") {
+			t.Errorf("Timestamps should be in UTC: %s", string(data))
+		}
+	}
+	if event.DateTime != localTime {
+		t.Errorf("Marshaling should not change the event")
+	}
+}
+
+// Fake Fluctus that keys ProcessedItems on the UTC string of the
+// bag date, as Rails does, and echoes stored dates with an offset.
+type itemResultServer struct {
+	records []map[string]interface{}
+	posts   int
+	puts    int
+}
+
+func (server *itemResultServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.EscapedPath(), "/")
+	// /api/v1/itemresults/etag/name/date
+	if r.Method == "GET" && len(parts) == 7 {
+		bagDate, _ := url.QueryUnescape(parts[6])
+		for _, record := range server.records {
+			if record["etag"] == parts[4] && record["name"] == parts[5] &&
+				record["bag_date_key"] == bagDate {
+				server.writeRecord(w, 200, record)
+				return
+			}
+		}
+		w.WriteHeader(404)
+		return
+	}
+	// /api/v1/itemresults/id
+	if r.Method == "GET" && len(parts) == 5 {
+		var id int
+		fmt.Sscanf(parts[4], "%d", &id)
+		if id < 1 || id > len(server.records) {
+			w.WriteHeader(404)
+			return
+		}
+		server.writeRecord(w, 200, server.records[id - 1])
+		return
+	}
+	record := make(map[string]interface{})
+	data, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(data, &record)
+	bagDate, _ := bagman.ParseFluctusTime(record["bag_date"].(string))
+	record["bag_date_key"] = bagDate.Format(time.RFC3339)
+	if r.Method == "POST" {
+		server.posts += 1
+		record["id"] = len(server.records) + 1
+		server.records = append(server.records, record)
+		server.writeRecord(w, 201, record)
+	} else {
+		server.puts += 1
+		var id int
+		fmt.Sscanf(parts[4], "%d", &id)
+		record["id"] = id
+		server.records[id - 1] = record
+		server.writeRecord(w, 200, record)
+	}
+}
+
+func (server *itemResultServer) writeRecord(w http.ResponseWriter, status int, record map[string]interface{}) {
+	echo := make(map[string]interface{})
+	for key, value := range record {
+		echo[key] = value
+	}
+	bagDate, _ := bagman.ParseFluctusTime(record["bag_date"].(string))
+	echo["bag_date"] = bagDate.In(eastern).Format(time.RFC3339Nano)
+	data, _ := json.Marshal(echo)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Regression test: a BagDate in a non-UTC zone used to produce a
+// lookup string Fluctus didn't match, so each update created a new
+// ProcessedItem for the same bag.
+func TestGetBagStatusMatchesNonUTCBagDate(t *testing.T) {
+	fakeFluctus := &itemResultServer{records: make([]map[string]interface{}, 0)}
+	server := httptest.NewServer(fakeFluctus)
+	defer server.Close()
+	fluctusClient, err := bagman.NewFluctusClient(server.URL, "v1",
+		"user@example.edu", "SeekritKee", bagman.DiscardLogger("timeutil_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := ProcessStatusSample()
+	status.Id = 0
+	status.Name = "sample_bag.tar"
+	status.BagDate = time.Date(2014, 7, 2, 7, 0, 0, 0, eastern)
+	if err = fluctusClient.SendProcessedItem(status); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteStatus, err := fluctusClient.GetBagStatus(status.ETag, status.Name, status.BagDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remoteStatus == nil {
+		t.Fatalf("GetBagStatus did not find the bag it just saved")
+	}
+	if remoteStatus.BagDate != status.BagDate.UTC() {
+		t.Errorf("Remote BagDate %v should equal %v", remoteStatus.BagDate, status.BagDate.UTC())
+	}
+
+	// Update using the echoed status, whose BagDate came back with
+	// an offset. This should update, not create, the record.
+	remoteStatus.Id = 0
+	remoteStatus.Stage = bagman.StageRecord
+	if err = fluctusClient.SendProcessedItem(remoteStatus); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeFluctus.records) != 1 || fakeFluctus.posts != 1 || fakeFluctus.puts != 1 {
+		t.Errorf("Expected 1 ProcessedItem from 1 POST and 1 PUT, got %d records, %d posts, %d puts",
+			len(fakeFluctus.records), fakeFluctus.posts, fakeFluctus.puts)
+	}
+}
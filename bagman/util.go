@@ -3,8 +3,6 @@ package bagman
 import (
 	"archive/tar"
 	"bytes"
-	"crypto/md5"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -18,6 +16,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var reManifest *regexp.Regexp = regexp.MustCompile("^manifest-[A-Za-z0-9]+\\.txt$")
@@ -45,16 +44,26 @@ func RestorationBucketFor(institution string) (bucketName string) {
 }
 
 // Given the name of a tar file, returns the clean bag name. That's
-// the tar file name minus the tar extension and any ".bagN.ofN" suffix.
+// the tar file name minus the .tar, .tar.gz or .tgz extension and
+// any ".bagN.ofN" suffix.
+// Returns a *BagNameError if the name is malformed. See ParseBagName.
 func CleanBagName(bagName string) (string, error) {
-	if len(bagName) < 5 {
-		return "", fmt.Errorf("'%s' is not a valid tar file name", bagName)
+	info, err := ParseBagName(bagName)
+	if err != nil {
+		return "", err
+	}
+	return info.CleanName, nil
+}
+
+// CleanBagNameWithExtension is like CleanBagName, for bags packaged
+// as something other than tar files. Param ext is the extension to
+// strip, e.g. ".zip" or ".tar.gz". See ParseBagNameWithExtension.
+func CleanBagNameWithExtension(bagName, ext string) (string, error) {
+	info, err := ParseBagNameWithExtension(bagName, ext)
+	if err != nil {
+		return "", err
 	}
-	// Strip the .tar suffix
-	nameWithoutTar := bagName[0:len(bagName)-4]
-	// Now get rid of the .b001.of200 suffix if this is a multi-part bag.
-	cleanName := MultipartSuffix.ReplaceAll([]byte(nameWithoutTar), []byte(""))
-	return string(cleanName), nil
+	return info.CleanName, nil
 }
 
 
@@ -116,6 +125,20 @@ func LoadResult(filename string) (result *ProcessResult, err error) {
 	return result, nil
 }
 
+// Loads a cleanup result from the specified path relative to
+// BAGMAN_HOME, as LoadResult does for ProcessResults.
+func LoadCleanupResult(filename string) (result *CleanupResult, err error) {
+	data, err := LoadRelativeFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 // Loads an IntellectualObject fixture (a JSON file) from
 // the testdata directory for testing.
 func LoadIntelObjFixture(filename string) (*IntellectualObject, error) {
@@ -225,6 +248,65 @@ func Min(x, y int) int {
 	}
 }
 
+// Units for FormatBytes, in powers of 1024.
+var byteUnits = []string{"KB", "MB", "GB", "TB", "PB", "EB"}
+
+// FormatBytes returns a human-readable byte count, such as "512 B"
+// or "1.4 GB". Units are powers of 1024. This is for logs and
+// reports that people read. Anything a program will parse should
+// get the raw number.
+func FormatBytes(n int64) (string) {
+	if n < 0 {
+		return "-" + FormatBytes(-n)
+	}
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	unit := ""
+	for _, unit = range byteUnits {
+		value = value / 1024
+		if value < 1023.95 {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// FormatDuration returns a human-readable duration. Durations under
+// a second are shown in milliseconds, durations under a minute in
+// seconds to one decimal place, and anything longer in the two
+// largest whole units, such as "3m 12s", "2h 5m" or "4d 1h".
+func FormatDuration(d time.Duration) (string) {
+	if d < 0 {
+		return "-" + FormatDuration(-d)
+	}
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d / time.Millisecond)
+	}
+	if d < time.Minute {
+		return fmt.Sprintf("%.1fs", d.Truncate(100 * time.Millisecond).Seconds())
+	}
+	seconds := int64((d + time.Second / 2) / time.Second)
+	units := []struct {
+		name    string
+		seconds int64
+	}{
+		{"d", 24 * 60 * 60},
+		{"h", 60 * 60},
+		{"m", 60},
+		{"s", 1},
+	}
+	for i, unit := range units[:len(units) - 1] {
+		if seconds >= unit.seconds {
+			next := units[i + 1]
+			return fmt.Sprintf("%d%s %d%s", seconds / unit.seconds, unit.name,
+				(seconds % unit.seconds) / next.seconds, next.name)
+		}
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
 // Returns a base64-encoded md5 digest. The is the format S3 wants.
 func Base64EncodeMd5(md5Digest string) (string, error) {
 	// We'll get error if md5 contains non-hex characters. Catch
@@ -278,6 +360,31 @@ func QueueToNSQ(url string, data []interface{}) (error) {
 	return nil
 }
 
+// QueueByAction sends each ProcessStatus to the NSQ topic for its
+// Action, as described by config.TopicForAction. Statuses for the
+// same topic go in a single mput, in their original order.
+func QueueByAction(config *Config, statuses []*ProcessStatus) (error) {
+	topics := make([]string, 0)
+	batches := make(map[string][]interface{})
+	for _, status := range statuses {
+		topic, err := config.TopicForAction(status.Action)
+		if err != nil {
+			return fmt.Errorf("Cannot queue %s/%s: %v", status.Institution, status.Name, err)
+		}
+		if _, ok := batches[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		batches[topic] = append(batches[topic], status)
+	}
+	for _, topic := range topics {
+		url := fmt.Sprintf("%s/mput?topic=%s", config.NsqdHttpAddress, topic)
+		if err := QueueToNSQ(url, batches[topic]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Expands the tilde in a directory path to the current
 // user's home directory. For example, on Linux, ~/data
 // would expand to something like /home/josie/data
@@ -315,7 +422,11 @@ func BucketNameAndKey(uri string) (string, string) {
 	return parts[0], parts[1]
 }
 
-// Adds a file to a tar archive.
+// Adds a file to a tar archive. The entry keeps the file's
+// modification time, truncated to the second, since tar headers
+// don't store fractions of a second. Tarring the same files twice
+// produces identical archives, so we get the same digest each time
+// we package a DPN bag.
 func AddToArchive(tarWriter *tar.Writer, filePath, pathWithinArchive string) (error) {
 	finfo, err := os.Stat(filePath)
 	if err != nil {
@@ -325,7 +436,7 @@ func AddToArchive(tarWriter *tar.Writer, filePath, pathWithinArchive string) (er
 		Name: pathWithinArchive,
 		Size: finfo.Size(),
 		Mode: int64(finfo.Mode().Perm()),
-		ModTime: finfo.ModTime(),
+		ModTime: finfo.ModTime().Truncate(time.Second),
 	}
 
 	// This call adds the owner and group info to the tar file header.
@@ -373,6 +484,42 @@ func RecursiveFileList(dir string) ([]string, error) {
 	return files, err
 }
 
+// RecursiveFileListExcluding returns a list of all files in path
+// dir and its subfolders, skipping files whose names match any of
+// the glob patterns in excludePatterns. Patterns are matched against
+// the file name only, not the full path, so ".DS_Store" and "._*"
+// skip those files in every subfolder. It does not return directories.
+func RecursiveFileListExcluding(dir string, excludePatterns []string) ([]string, error) {
+	for _, pattern := range excludePatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid exclude pattern '%s': %v", pattern, err)
+		}
+	}
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(filePath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || FileNameMatchesAny(f.Name(), excludePatterns) {
+			return nil
+		}
+		files = append(files, filePath)
+		return nil
+	})
+	return files, err
+}
+
+// FileNameMatchesAny returns true if fileName matches any of the
+// glob patterns. Invalid patterns never match.
+func FileNameMatchesAny(fileName string, patterns []string) (bool) {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, fileName); matched {
+			return true
+		}
+	}
+	return false
+}
+
 type FileDigest struct {
 	PathToFile     string
 	Md5Digest      string
@@ -382,11 +529,24 @@ type FileDigest struct {
 
 // Returns a FileDigest structure with the md5 and sha256 digests
 // of the specified file as hex-enconded strings, along with the
-// file's size.
+// file's size. If ChecksumCache has the digests of the file, and
+// the file hasn't changed since they were cached, this returns
+// the cached digests without reading the file. Otherwise, it
+// stores the digests it calculates in ChecksumCache.
 func CalculateDigests(pathToFile string) (*FileDigest, error) {
-	md5Hash := md5.New()
-	shaHash := sha256.New()
-	multiWriter := io.MultiWriter(md5Hash, shaHash)
+	return calculateDigests(pathToFile, DEFAULT_DIGEST_BUFFER_SIZE)
+}
+
+// calculateDigests is CalculateDigests, reading into a buffer of
+// bufferSize bytes.
+func calculateDigests(pathToFile string, bufferSize int) (*FileDigest, error) {
+	if cached := ChecksumCache.Lookup(pathToFile); cached != nil {
+		return cached, nil
+	}
+	digester, err := NewMultiDigestWriter(bufferSize, DigestMd5, DigestSha256)
+	if err != nil {
+		return nil, err
+	}
 	reader, err := os.Open(pathToFile)
 	defer reader.Close()
 
@@ -400,7 +560,7 @@ func CalculateDigests(pathToFile string) (*FileDigest, error) {
 		return nil, detailedError
 	}
 	// Calculate md5 and sha256 checksums in one read
-	bytesWritten, err := io.Copy(multiWriter, reader)
+	bytesWritten, err := digester.Copy(nil, reader)
 	if err != nil {
 		detailedError := fmt.Errorf("Error running md5 checksum on file '%s': %v",
 			pathToFile, err)
@@ -414,10 +574,11 @@ func CalculateDigests(pathToFile string) (*FileDigest, error) {
 	}
 	fileDigest := &FileDigest{
 		PathToFile: pathToFile,
-		Md5Digest: fmt.Sprintf("%x", md5Hash.Sum(nil)),
-		Sha256Digest: fmt.Sprintf("%x", shaHash.Sum(nil)),
+		Md5Digest: digester.Sum(DigestMd5),
+		Sha256Digest: digester.Sum(DigestSha256),
 		Size: fileInfo.Size(),
 	}
+	ChecksumCache.Store(pathToFile, fileDigest)
 	return fileDigest, nil
 }
 
@@ -467,6 +628,27 @@ func GetInstitutionFromBagIdentifier(bagIdentifier string) (string, error) {
 	return "", fmt.Errorf(errMessage)
 }
 
+// IsPayloadPath returns true if filePath, the path of a file within
+// a bag, is in the payload (data) directory.
+func IsPayloadPath(filePath string) (bool) {
+	return strings.HasPrefix(filePath, "data/")
+}
+
+// IsManifestPath returns true if filePath is a payload manifest or
+// tag manifest, such as "manifest-md5.txt" or "tagmanifest-sha256.txt".
+// Manifests are always in the top-level directory of the bag.
+func IsManifestPath(filePath string) (bool) {
+	return reManifest.MatchString(filePath) || reTagManifest.MatchString(filePath)
+}
+
+// IsTagPath returns true if filePath is a tag file, such as bagit.txt,
+// bag-info.txt or custom_tags/notes.txt. BagIt considers manifests to
+// be tag files too, but this doesn't, since we rebuild manifests
+// rather than preserve them. See HasSavableName.
+func IsTagPath(filePath string) (bool) {
+	return filePath != "" && !IsPayloadPath(filePath) && !IsManifestPath(filePath)
+}
+
 // Returns true if the file name indicates this is something we should
 // save to long-term storage. As of late March, 2016, we save everything
 // in the bag except bagit.txt, manifest-<algo>.txt and
@@ -498,6 +680,21 @@ func HasSavableName(filename string) (bool) {
 		reManifest.MatchString(filename))
 }
 
+// IsJunkFile returns true if the file name, or the name of any
+// directory in filePath, matches one of the patterns. Patterns use
+// filepath.Match syntax, so "__MACOSX" matches data/__MACOSX/img.jpg
+// and "*.tmp" matches data/docs/report.tmp.
+func IsJunkFile(filePath string, patterns []string) (bool) {
+	for _, name := range strings.Split(filePath, "/") {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Returns true if the filename follows APTrust's file naming requiremens.
 // May contain upper or lower case letters, numbers, dots, underscores
 // and dashes. (A–Z a–z 0–9 . _ -)
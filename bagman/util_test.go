@@ -2,13 +2,17 @@ package bagman_test
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBagmanHome(t *testing.T) {
@@ -132,12 +136,107 @@ func TestCleanBagName(t *testing.T) {
 	}
 }
 
+func TestCleanBagNameWithExtension(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ext      string
+		expected string
+	}{
+		{"some.file.tar", ".tar", "some.file"},
+		{"some.file.zip", ".zip", "some.file"},
+		{"inst.edu/some.file.b001.of002.zip", ".zip", "inst.edu/some.file"},
+		{"some.file.tar.gz", ".tar.gz", "some.file"},
+		{"some.file.b2.of3.tar.gz", ".tar.gz", "some.file"},
+	}
+	for _, tc := range testCases {
+		actual, err := bagman.CleanBagNameWithExtension(tc.name, tc.ext)
+		if err != nil {
+			t.Errorf("CleanBagNameWithExtension(%q, %q) returned error: %v", tc.name, tc.ext, err)
+		} else if actual != tc.expected {
+			t.Errorf("CleanBagNameWithExtension(%q, %q) returned %q, expected %q",
+				tc.name, tc.ext, actual, tc.expected)
+		}
+	}
+
+	badCases := []struct {
+		name string
+		ext  string
+	}{
+		{"some.file.tar", ".zip"},
+		{"some.file.tar.gz", ".tar"},
+		{"some.file.zip.zip", ".zip"},
+		{".tar.gz", ".tar.gz"},
+		{"some.file.zip", "zip"},
+		{"some.file.zip", ""},
+	}
+	for _, tc := range badCases {
+		if _, err := bagman.CleanBagNameWithExtension(tc.name, tc.ext); err == nil {
+			t.Errorf("CleanBagNameWithExtension(%q, %q) should have failed", tc.name, tc.ext)
+		}
+	}
+}
+
 func TestMin(t *testing.T) {
 	if bagman.Min(10, 12) != 10 {
 		t.Error("Min() thinks 12 is less than 10")
 	}
 }
 
+func TestFormatBytes(t *testing.T) {
+	testCases := []struct {
+		bytes    int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1, "1 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{1048575, "1.0 MB"},
+		{5 * 1024 * 1024, "5.0 MB"},
+		{1503238553, "1.4 GB"},
+		{250 * 1024 * 1024 * 1024, "250.0 GB"},
+		{3 * 1024 * 1024 * 1024 * 1024, "3.0 TB"},
+		{1 << 50, "1.0 PB"},
+		{1<<63 - 1, "8.0 EB"},
+		{-2048, "-2.0 KB"},
+	}
+	for _, testCase := range testCases {
+		actual := bagman.FormatBytes(testCase.bytes)
+		if actual != testCase.expected {
+			t.Errorf("FormatBytes(%d) returned '%s', expected '%s'",
+				testCase.bytes, actual, testCase.expected)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	testCases := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{0, "0ms"},
+		{999 * time.Microsecond, "0ms"},
+		{450 * time.Millisecond, "450ms"},
+		{time.Second, "1.0s"},
+		{12345 * time.Millisecond, "12.3s"},
+		{59999 * time.Millisecond, "59.9s"},
+		{time.Minute, "1m 0s"},
+		{3*time.Minute + 12*time.Second, "3m 12s"},
+		{2*time.Hour + 5*time.Minute + 59*time.Second, "2h 5m"},
+		{24 * time.Hour, "1d 0h"},
+		{97*time.Hour + 30*time.Minute, "4d 1h"},
+		{-90 * time.Second, "-1m 30s"},
+	}
+	for _, testCase := range testCases {
+		actual := bagman.FormatDuration(testCase.duration)
+		if actual != testCase.expected {
+			t.Errorf("FormatDuration(%v) returned '%s', expected '%s'",
+				testCase.duration, actual, testCase.expected)
+		}
+	}
+}
+
 func TestBase64EncodeMd5(t *testing.T) {
 	digest := "4d66f1ec9491addded54d17b96df8c96"
 	expectedResult := "TWbx7JSRrd3tVNF7lt+Mlg=="
@@ -255,6 +354,100 @@ func TestAddToArchive(t *testing.T) {
 	}
 }
 
+// Tars the files in dir, in the order RecursiveFileList returns
+// them, and returns the tar file's contents.
+func tarDirectory(t *testing.T, dir string) ([]byte) {
+	tarFile, err := ioutil.TempFile("", "util_test.tar")
+	if err != nil {
+		t.Fatalf("Error creating temp file for tar archive: %v", err)
+	}
+	defer os.Remove(tarFile.Name())
+	tarWriter := tar.NewWriter(tarFile)
+	files, err := bagman.RecursiveFileList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filePath := range files {
+		pathWithinArchive, _ := filepath.Rel(filepath.Dir(dir), filePath)
+		if err = bagman.AddToArchive(tarWriter, filePath, pathWithinArchive); err != nil {
+			t.Fatalf("Error adding %s to tar file: %v", filePath, err)
+		}
+	}
+	if err = tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tarFile.Close()
+	data, err := ioutil.ReadFile(tarFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAddToArchiveIsReproducible(t *testing.T) {
+	// Copy the fixture bag, so we can set its modification times.
+	tempDir, err := ioutil.TempDir("", "util_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	bagDir := filepath.Join(tempDir, "example.edu.sample_good")
+	fixtureDir := getPath("testdata/example.edu.sample_good")
+	files, err := bagman.RecursiveFileList(fixtureDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2016, 4, 1, 12, 30, 15, 250000000, time.UTC)
+	setModTimes := func(nanos int) {
+		for _, filePath := range files {
+			relPath, _ := filepath.Rel(fixtureDir, filePath)
+			copyPath := filepath.Join(bagDir, relPath)
+			mtime := modTime.Add(time.Duration(nanos))
+			if err := os.Chtimes(copyPath, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, filePath := range files {
+		relPath, _ := filepath.Rel(fixtureDir, filePath)
+		copyPath := filepath.Join(bagDir, relPath)
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.MkdirAll(filepath.Dir(copyPath), 0755)
+		if err = ioutil.WriteFile(copyPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Same second, different fractions of a second.
+	setModTimes(0)
+	first := tarDirectory(t, bagDir)
+	setModTimes(500000000)
+	second := tarDirectory(t, bagDir)
+	if !bytes.Equal(first, second) {
+		t.Errorf("Tarring the same files twice produced different archives")
+	}
+
+	tarReader := tar.NewReader(bytes.NewReader(first))
+	entries := 0
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			break
+		}
+		entries++
+		if !header.ModTime.Equal(modTime.Truncate(time.Second)) {
+			t.Errorf("%s has ModTime %v, expected %v", header.Name,
+				header.ModTime, modTime.Truncate(time.Second))
+		}
+	}
+	if entries != len(files) {
+		t.Errorf("Expected %d tar entries, got %d", len(files), entries)
+	}
+}
+
 func getPath(filename string) (string) {
 	bagmanHome, _ := bagman.BagmanHome()
 	return filepath.Join(bagmanHome, filename)
@@ -290,6 +483,62 @@ func TestRecursiveFileList(t *testing.T) {
 	}
 }
 
+func TestRecursiveFileListExcluding(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "util_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileNames := []string{
+		"bagit.txt",
+		".DS_Store",
+		filepath.Join("data", "photo.jpg"),
+		filepath.Join("data", ".DS_Store"),
+		filepath.Join("data", "._photo.jpg"),
+		filepath.Join("data", "Thumbs.db"),
+	}
+	for _, name := range fileNames {
+		filePath := filepath.Join(tempDir, name)
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err := ioutil.WriteFile(filePath, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := bagman.RecursiveFileListExcluding(tempDir,
+		[]string{".DS_Store", "._*", "Thumbs.db"})
+	if err != nil {
+		t.Fatalf("RecursiveFileListExcluding() returned error: %v", err)
+	}
+	expected := []string{
+		filepath.Join(tempDir, "bagit.txt"),
+		filepath.Join(tempDir, "data", "photo.jpg"),
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files, got %d: %v", len(expected), len(files), files)
+	}
+	for i := range expected {
+		if files[i] != expected[i] {
+			t.Errorf("Expected file '%s', got '%s'", expected[i], files[i])
+		}
+	}
+
+	// No patterns means nothing is excluded.
+	files, err = bagman.RecursiveFileListExcluding(tempDir, nil)
+	if err != nil {
+		t.Fatalf("RecursiveFileListExcluding() returned error: %v", err)
+	}
+	if len(files) != len(fileNames) {
+		t.Errorf("Expected %d files, got %d", len(fileNames), len(files))
+	}
+
+	// Bad patterns are an error, not a silent no-op.
+	_, err = bagman.RecursiveFileListExcluding(tempDir, []string{"[.DS_Store"})
+	if err == nil {
+		t.Errorf("RecursiveFileListExcluding() should have rejected a bad pattern")
+	}
+}
+
 func TestCalculateDigests(t *testing.T) {
 	bagmanHome, _ := bagman.BagmanHome()
 	absPath := filepath.Join(bagmanHome, "testdata", "result_good.json")
@@ -393,6 +642,28 @@ func TestSavableName(t *testing.T) {
 	}
 }
 
+func TestIsJunkFile(t *testing.T) {
+	patterns := []string{".DS_Store", "Thumbs.db", "__MACOSX", "*.tmp"}
+	for filePath, expected := range map[string]bool{
+		"data/.DS_Store":               true,
+		"data/photos/Thumbs.db":        true,
+		"data/__MACOSX/photo.jpg":      true,
+		"data/__MACOSX/sub/photo.jpg":  true,
+		"data/docs/draft.tmp":          true,
+		"data/photo.jpg":               false,
+		"data/DS_Store.txt":            false,
+		"data/thumbs.db.backup":        false,
+		"data/MACOSX/photo.jpg":        false,
+	} {
+		if bagman.IsJunkFile(filePath, patterns) != expected {
+			t.Errorf("IsJunkFile(%s) should be %t", filePath, expected)
+		}
+	}
+	if bagman.IsJunkFile("data/.DS_Store", []string{}) {
+		t.Errorf("Nothing is junk with no patterns")
+	}
+}
+
 func TestIsValidFileName(t *testing.T) {
 	if !bagman.IsValidFileName("data/this/is/just/great.txt") {
 		t.Errorf("Name should be valid")
@@ -435,3 +706,48 @@ func TestNamePartIsValid(t *testing.T) {
 		t.Errorf("Name should NOT be valid")
 	}
 }
+
+func TestQueueByAction(t *testing.T) {
+	received := make(map[string][]string)
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		topic := r.URL.Query().Get("topic")
+		received[topic] = append(received[topic], strings.Split(string(body), "\n")...)
+	}))
+	defer nsqd.Close()
+
+	config := &bagman.Config{
+		NsqdHttpAddress: nsqd.URL,
+		ActionTopics: map[bagman.ActionType]string{
+			bagman.ActionIngest:  "ingest_topic",
+			bagman.ActionRestore: "restore_topic",
+		},
+	}
+	statuses := []*bagman.ProcessStatus{
+		&bagman.ProcessStatus{Name: "bag1.tar", Action: bagman.ActionIngest},
+		&bagman.ProcessStatus{Name: "bag2.tar", Action: bagman.ActionRestore},
+		&bagman.ProcessStatus{Name: "bag3.tar", Action: bagman.ActionIngest},
+	}
+	if err := bagman.QueueByAction(config, statuses); err != nil {
+		t.Fatalf("QueueByAction() returned error: %v", err)
+	}
+	if len(received["restore_topic"]) != 1 ||
+		!strings.Contains(received["restore_topic"][0], "bag2.tar") {
+		t.Errorf("Expected the restore to go to restore_topic, got %v", received["restore_topic"])
+	}
+	if len(received["ingest_topic"]) != 2 ||
+		!strings.Contains(received["ingest_topic"][0], "bag1.tar") ||
+		!strings.Contains(received["ingest_topic"][1], "bag3.tar") {
+		t.Errorf("Expected both ingests, in order, in ingest_topic, got %v", received["ingest_topic"])
+	}
+
+	// Nothing goes out if any item has nowhere to go.
+	received = make(map[string][]string)
+	statuses = append(statuses, &bagman.ProcessStatus{Name: "bag4.tar", Action: bagman.ActionDelete})
+	if err := bagman.QueueByAction(config, statuses); err == nil {
+		t.Errorf("QueueByAction() should return an error for an unrouted action")
+	}
+	if len(received) != 0 {
+		t.Errorf("QueueByAction() should not queue anything when routing fails, sent %v", received)
+	}
+}
@@ -0,0 +1,163 @@
+package bagman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tag files every APTrust bag must include.
+var requiredTagFiles = []string{"bagit.txt", "aptrust-info.txt", "manifest-md5.txt"}
+
+/*
+Report describes what was wrong with a bag that failed ingest,
+in terms a depositor can act on. It's built from a ProcessResult
+by ProcessResult.ValidationReport. Report serializes to JSON,
+and Report.String() produces a plain-text version suitable for
+the body of a "your bag failed" email.
+
+The lists in the report are empty, not nil, when there is nothing
+to report, so the JSON always has the same shape.
+*/
+type Report struct {
+	// The name of the bag, as it appeared in the receiving bucket.
+	BagName         string
+	// The stage in which processing stopped.
+	Stage           StageType
+	// The full error message from processing.
+	ErrorMessage    string
+	// Will we try to process this bag again? If so, the problem
+	// was probably on our end, and the depositor doesn't need to
+	// do anything.
+	Retry           bool
+	// Checksums that did not match the manifest.
+	ChecksumErrors  []string
+	// Files listed in the payload manifest that are not in the bag.
+	MissingFiles    []string
+	// Payload files in the bag that are not in the manifest.
+	ExtraFiles      []string
+	// Required tag files that are not in the bag.
+	MissingTagFiles []string
+	// Required tags that are missing or empty.
+	MissingTags     []string
+	// Problems that did not cause the bag to fail.
+	Warnings        []string
+}
+
+// ValidationReport returns a Report describing the problems with
+// this result's bag. Parts of the report may be empty if processing
+// stopped before the bag was unpacked and read.
+func (result *ProcessResult) ValidationReport() (*Report) {
+	report := &Report{
+		Stage:           result.Stage,
+		ErrorMessage:    strings.TrimSpace(result.ErrorMessage),
+		Retry:           result.Retry,
+		ChecksumErrors:  make([]string, 0),
+		MissingFiles:    make([]string, 0),
+		ExtraFiles:      make([]string, 0),
+		MissingTagFiles: make([]string, 0),
+		MissingTags:     make([]string, 0),
+		Warnings:        make([]string, 0),
+	}
+	if result.S3File != nil {
+		report.BagName = result.S3File.Key.Key
+	}
+	if result.FetchResult != nil && result.FetchResult.Warning != "" {
+		report.Warnings = append(report.Warnings, result.FetchResult.Warning)
+	}
+	if result.TarResult != nil {
+		report.Warnings = append(report.Warnings, result.TarResult.Warnings...)
+	}
+	bagReadResult := result.BagReadResult
+	if bagReadResult == nil {
+		return report
+	}
+	report.Warnings = append(report.Warnings, bagReadResult.Warnings...)
+	for _, err := range bagReadResult.ChecksumErrors {
+		report.ChecksumErrors = append(report.ChecksumErrors, err.Error())
+	}
+	if len(bagReadResult.Files) == 0 {
+		// We couldn't read the bag, so we can't say what's
+		// missing. The error message will explain why.
+		return report
+	}
+
+	inBag := make(map[string]bool, len(bagReadResult.Files))
+	for _, fileName := range bagReadResult.Files {
+		inBag[fileName] = true
+	}
+	for _, tagFile := range requiredTagFiles {
+		if !inBag[tagFile] {
+			report.MissingTagFiles = append(report.MissingTagFiles, tagFile)
+		}
+	}
+	// Without a manifest, every payload file would look extra.
+	// The missing manifest is already in MissingTagFiles.
+	manifestPaths := bagReadResult.ManifestPaths()
+	if len(manifestPaths) > 0 {
+		inManifest := make(map[string]bool, len(manifestPaths))
+		for _, fileName := range manifestPaths {
+			inManifest[fileName] = true
+			if !inBag[fileName] {
+				report.MissingFiles = append(report.MissingFiles, fileName)
+			}
+		}
+		for _, fileName := range bagReadResult.Files {
+			if IsPayloadPath(fileName) && !inManifest[fileName] {
+				report.ExtraFiles = append(report.ExtraFiles, fileName)
+			}
+		}
+		sort.Strings(report.ExtraFiles)
+	}
+	if bagReadResult.TagValue("Title") == "" {
+		report.MissingTags = append(report.MissingTags, "Title")
+	}
+	if bagReadResult.TagValue("Access") == "" && bagReadResult.TagValue("Rights") == "" {
+		report.MissingTags = append(report.MissingTags, "Access")
+	}
+	return report
+}
+
+// Returns true if the report lists any specific problems with
+// the bag, beyond the general error message.
+func (report *Report) HasProblems() (bool) {
+	return len(report.ChecksumErrors) > 0 ||
+		len(report.MissingFiles) > 0 ||
+		len(report.ExtraFiles) > 0 ||
+		len(report.MissingTagFiles) > 0 ||
+		len(report.MissingTags) > 0
+}
+
+// String returns a plain-text version of the report, suitable
+// for an email to the depositor.
+func (report *Report) String() (string) {
+	text := fmt.Sprintf("Validation report for bag %s\n", report.BagName)
+	text += fmt.Sprintf("Processing stopped at stage: %s\n", report.Stage)
+	if report.Retry {
+		text += "This looks like a problem on our end. We will try " +
+			"to process the bag again.\n"
+	}
+	if report.ErrorMessage != "" {
+		text += fmt.Sprintf("\nError: %s\n", report.ErrorMessage)
+	}
+	text += reportSection("Checksums that did not match the manifest", report.ChecksumErrors)
+	text += reportSection("Files in the manifest but not in the bag", report.MissingFiles)
+	text += reportSection("Files in the bag but not in the manifest", report.ExtraFiles)
+	text += reportSection("Missing tag files", report.MissingTagFiles)
+	text += reportSection("Missing or empty tags", report.MissingTags)
+	text += reportSection("Warnings", report.Warnings)
+	return text
+}
+
+// Returns a titled, bulleted list of items for Report.String,
+// or an empty string if there are no items.
+func reportSection(title string, items []string) (string) {
+	if len(items) == 0 {
+		return ""
+	}
+	section := fmt.Sprintf("\n%s:\n", title)
+	for _, item := range items {
+		section += fmt.Sprintf("  - %s\n", item)
+	}
+	return section
+}
@@ -0,0 +1,120 @@
+package bagman_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadValidationFailure(t *testing.T) (*bagman.ProcessResult) {
+	filepath := filepath.Join("testdata", "validation_failure.json")
+	result, err := bagman.LoadResult(filepath)
+	if err != nil {
+		t.Fatalf("Error loading test data file '%s': %v", filepath, err)
+	}
+	// ChecksumErrors don't survive the trip through JSON,
+	// so put back the one described in the ErrorMessage.
+	result.BagReadResult.ChecksumErrors = []error{
+		fmt.Errorf("data/datastream-DC: md5 checksum 284d3d2b5c9ab1bc4b8a4b6a1a2e1ec9 " +
+			"did not match manifest value 44d85cf4810d6c6fe87750117633e461"),
+	}
+	return result
+}
+
+func TestValidationReport(t *testing.T) {
+	report := loadValidationFailure(t).ValidationReport()
+	if report.BagName != "example.edu.sample_broken.tar" {
+		t.Errorf("BagName is '%s'", report.BagName)
+	}
+	if report.Stage != bagman.StageValidate {
+		t.Errorf("Stage is '%s', expected '%s'", report.Stage, bagman.StageValidate)
+	}
+	if report.Retry {
+		t.Errorf("Retry should be false")
+	}
+	if !strings.HasPrefix(report.ErrorMessage, "Bag is missing aptrust-info.txt file.") {
+		t.Errorf("Unexpected ErrorMessage '%s'", report.ErrorMessage)
+	}
+	expected := map[string][]string{
+		"ChecksumErrors": []string{"data/datastream-DC: md5 checksum 284d3d2b5c9ab1bc4b8a4b6a1a2e1ec9 " +
+			"did not match manifest value 44d85cf4810d6c6fe87750117633e461"},
+		"MissingFiles": []string{"data/datastream-RELS-EXT"},
+		"ExtraFiles": []string{"data/notes.txt"},
+		"MissingTagFiles": []string{"aptrust-info.txt"},
+		"MissingTags": []string{"Title", "Access"},
+		"Warnings": []string{"Bag has no Payload-Oxum in bag-info.txt. Skipping payload " +
+			"byte and file count check."},
+	}
+	actual := map[string][]string{
+		"ChecksumErrors": report.ChecksumErrors,
+		"MissingFiles": report.MissingFiles,
+		"ExtraFiles": report.ExtraFiles,
+		"MissingTagFiles": report.MissingTagFiles,
+		"MissingTags": report.MissingTags,
+		"Warnings": report.Warnings,
+	}
+	for field, value := range expected {
+		if !reflect.DeepEqual(actual[field], value) {
+			t.Errorf("%s is %v, expected %v", field, actual[field], value)
+		}
+	}
+	if !report.HasProblems() {
+		t.Errorf("HasProblems should be true")
+	}
+
+	// Report should serialize and come back intact.
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &bagman.Report{}
+	if err = json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, report) {
+		t.Errorf("Report did not survive JSON round trip:\n%+v\n%+v", decoded, report)
+	}
+}
+
+func TestValidationReportString(t *testing.T) {
+	text := loadValidationFailure(t).ValidationReport().String()
+	expected := []string{
+		"Validation report for bag example.edu.sample_broken.tar\n",
+		"Processing stopped at stage: Validate\n",
+		"\nChecksums that did not match the manifest:\n  - data/datastream-DC: md5 checksum",
+		"\nFiles in the manifest but not in the bag:\n  - data/datastream-RELS-EXT\n",
+		"\nFiles in the bag but not in the manifest:\n  - data/notes.txt\n",
+		"\nMissing tag files:\n  - aptrust-info.txt\n",
+		"\nMissing or empty tags:\n  - Title\n  - Access\n",
+		"\nWarnings:\n  - Bag has no Payload-Oxum",
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(text, fragment) {
+			t.Errorf("Report text is missing '%s':\n%s", fragment, text)
+		}
+	}
+	if strings.Contains(text, "try to process the bag again") {
+		t.Errorf("Report should not say the bag will be retried")
+	}
+}
+
+func TestValidationReportWithoutBagReadResult(t *testing.T) {
+	result := loadValidationFailure(t)
+	result.BagReadResult = nil
+	result.Stage = bagman.StageFetch
+	result.Retry = true
+	report := result.ValidationReport()
+	if report.HasProblems() {
+		t.Errorf("Report without a BagReadResult should not list problems: %+v", report)
+	}
+	if report.MissingFiles == nil || report.MissingTags == nil {
+		t.Errorf("Report lists should be empty, not nil")
+	}
+	if !strings.Contains(report.String(), "We will try to process the bag again.") {
+		t.Errorf("Report should say the bag will be retried:\n%s", report.String())
+	}
+}
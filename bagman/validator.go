@@ -94,14 +94,20 @@ func (validator *Validator) IsValid() (bool) {
 		}
 		return false
 	}
+	if validator.TarResult != nil {
+		err := ReconcileTarAndManifest(validator.TarResult, validator.BagReadResult)
+		if err != nil {
+			validator.ErrorMessage = err.Error()
+			return false
+		}
+	}
 	return true
 }
 
 // Returns the path to the directory that holds the untarred
 // contents of the bag.
 func (validator *Validator) UntarredDir() (string) {
-	re := regexp.MustCompile("\\.tar$")
-	return re.ReplaceAllString(validator.PathToFile, "")
+	return TrimTarExtension(validator.PathToFile)
 }
 
 // Get the instution name from the file/bag name, or returns a descriptive
@@ -137,10 +143,10 @@ func (validator *Validator) IsValidMultipartName() (bool) {
 
 // Returns the name of the tar file that the user wants to validate.
 // If this is a directory, returns the name of the directory with a
-// .tar suffix.
+// .tar suffix. Gzipped tar files keep their .tar.gz or .tgz suffix.
 func (validator *Validator) TarFileName() (string) {
 	base := filepath.Base(validator.PathToFile)
-	if !strings.HasSuffix(base, ".tar") {
+	if TarExtension(base) == "" {
 		base += ".tar"
 	}
 	return base
@@ -165,7 +171,7 @@ func (validator *Validator) FileType() (int, error) {
 		return VAL_TYPE_DIR, nil
 	}
 	base := filepath.Base(validator.PathToFile)
-	if strings.HasSuffix(base, ".tar") {
+	if TarExtension(base) != "" {
 		return VAL_TYPE_TAR, nil
 	}
 	return VAL_TYPE_ERR, fmt.Errorf(
@@ -0,0 +1,62 @@
+package bagman
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+Version and GitCommit identify the build that produced a binary.
+They are empty in the source and set at build time with -ldflags.
+scripts/build.sh does this for all of our binaries:
+
+go build -ldflags "-X github.com/APTrust/bagman/bagman.Version=v1.4.2 \
+    -X github.com/APTrust/bagman/bagman.GitCommit=abc123" ...
+
+Binaries built without these flags, including test binaries,
+report their version as "dev".
+*/
+var Version = ""
+var GitCommit = ""
+
+// VersionString returns the version of bagman that this binary was
+// built from, e.g. "bagman v1.4.2 (abc123)". If Version was not set
+// at build time, this returns "bagman dev", followed by the commit if
+// that was set.
+func VersionString() (string) {
+	version := Version
+	if version == "" {
+		version = "dev"
+	}
+	if GitCommit == "" {
+		return fmt.Sprintf("bagman %s", version)
+	}
+	return fmt.Sprintf("bagman %s (%s)", version, GitCommit)
+}
+
+// VersionedOutcome appends VersionString() to the outcome information
+// of a PremisEvent, so we can tell which build generated the event.
+// For example, "Fixity matches" becomes "Fixity matches; bagman v1.4.2
+// (abc123)". All code that creates PremisEvents should use this.
+func VersionedOutcome(outcomeInformation string) (string) {
+	if outcomeInformation == "" {
+		return VersionString()
+	}
+	return fmt.Sprintf("%s; %s", outcomeInformation, VersionString())
+}
+
+// Returns object serialized to JSON for the State field of a
+// ProcessStatus. If object serializes to a JSON object, this adds
+// a "bagman_version" key with the value of VersionString().
+func versionedState(object interface{}) ([]byte, error) {
+	jsonBytes, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if json.Unmarshal(jsonBytes, &fields) != nil {
+		return jsonBytes, nil
+	}
+	fields["bagman_version"], _ = json.Marshal(VersionString())
+	return json.Marshal(fields)
+}
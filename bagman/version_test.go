@@ -0,0 +1,85 @@
+package bagman_test
+
+import (
+	"encoding/json"
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+	"testing"
+)
+
+// Sets the build version for the duration of a test.
+// Call the returned function to restore the original.
+func setVersion(version, commit string) (func()) {
+	oldVersion, oldCommit := bagman.Version, bagman.GitCommit
+	bagman.Version, bagman.GitCommit = version, commit
+	return func() {
+		bagman.Version, bagman.GitCommit = oldVersion, oldCommit
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	defer setVersion("", "")()
+	if bagman.VersionString() != "bagman dev" {
+		t.Errorf("Unset version should be 'bagman dev', got '%s'", bagman.VersionString())
+	}
+	bagman.GitCommit = "abc123"
+	if bagman.VersionString() != "bagman dev (abc123)" {
+		t.Errorf("Expected 'bagman dev (abc123)', got '%s'", bagman.VersionString())
+	}
+	bagman.Version = "v1.4.2"
+	if bagman.VersionString() != "bagman v1.4.2 (abc123)" {
+		t.Errorf("Expected 'bagman v1.4.2 (abc123)', got '%s'", bagman.VersionString())
+	}
+	if bagman.VersionedOutcome("") != "bagman v1.4.2 (abc123)" {
+		t.Errorf("Unexpected outcome '%s'", bagman.VersionedOutcome(""))
+	}
+	if bagman.VersionedOutcome("Fixity matches") != "Fixity matches; bagman v1.4.2 (abc123)" {
+		t.Errorf("Unexpected outcome '%s'", bagman.VersionedOutcome("Fixity matches"))
+	}
+}
+
+func TestPremisEventsIncludeVersion(t *testing.T) {
+	defer setVersion("v1.4.2", "abc123")()
+	file, err := loadGenericFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := file.PremisEvents()
+	replicationEvent, err := file.ReplicationEvent("https://s3.amazonaws.com/bucket/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = append(events, replicationEvent)
+	obj := &bagman.IntellectualObject{Identifier: "test.edu/bag", Access: "consortia"}
+	events = append(events, obj.CreateIngestEvent(), obj.CreateIdEvent(), obj.CreateRightsEvent())
+	fixityResult := bagman.NewFixityResult(getGenericFile())
+	fixityResult.Sha256 = "xxx-xxx-xxx"
+	fixityEvent, err := fixityResult.BuildPremisEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = append(events, fixityEvent)
+	for _, event := range events {
+		if !strings.HasSuffix(event.OutcomeInformation, "bagman v1.4.2 (abc123)") {
+			t.Errorf("%s event outcome information '%s' does not include version",
+				event.EventType, event.OutcomeInformation)
+		}
+	}
+}
+
+func TestProcessStatusStateIncludesVersion(t *testing.T) {
+	defer setVersion("v1.4.2", "abc123")()
+	status := ProcessStatusSample()
+	status.SetNodePidState(&bagman.ProcessResult{Stage: bagman.StageFetch},
+		bagman.DiscardLogger("version_test"))
+	state := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(status.State), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state["bagman_version"] != "bagman v1.4.2 (abc123)" {
+		t.Errorf("State has bagman_version '%v'", state["bagman_version"])
+	}
+	if state["Stage"] != string(bagman.StageFetch) {
+		t.Errorf("State lost the rest of the object: %s", status.State)
+	}
+}
@@ -93,24 +93,46 @@ func (volume *Volume) AvailableSpace() (numBytes uint64) {
 		available = currentlyAvailable
 	}
 	volume.mutex.Lock()
-	numBytes = available - volume.claimed
+	// Other processes may fill the disk after we claim space,
+	// so claimed can exceed what's free.
+	if volume.claimed < available {
+		numBytes = available - volume.claimed
+	}
 	volume.mutex.Unlock()
 	volume.messageLog.Debug("Storage volume has %d bytes available",
 		numBytes)
 	return numBytes
 }
 
+// InsufficientSpaceError is returned by Volume.Reserve when the
+// volume doesn't have room for the requested number of bytes.
+type InsufficientSpaceError struct {
+	Requested uint64
+	Available uint64
+}
+
+func (err *InsufficientSpaceError) Error() (string) {
+	return fmt.Sprintf("Requested %d bytes (%s) on volume, but only %d (%s) are available",
+		err.Requested, FormatBytes(int64(err.Requested)),
+		err.Available, FormatBytes(int64(err.Available)))
+}
+
+// Returns true if err is an InsufficientSpaceError.
+func IsInsufficientSpace(err error) (bool) {
+	_, isInsufficient := err.(*InsufficientSpaceError)
+	return isInsufficient
+}
+
 // Reserve requests that a number of bytes on disk be reserved for an
 // upcoming operation, such as downloading and untarring a file.
 // Reserving space does not have any effect on the file system. It
 // simply allows the Volume struct to maintain some internal bookkeeping.
-// Reserve will return an error if there is not enough free disk space to
-// accomodate the requested number of bytes.
+// Reserve will return an *InsufficientSpaceError if there is not enough
+// free disk space to accomodate the requested number of bytes.
 func (volume *Volume) Reserve(numBytes uint64) (err error) {
 	available := volume.AvailableSpace()
 	if numBytes >= available {
-		err = fmt.Errorf("Requested %d bytes on volume, "+
-			"but only %d are available", numBytes, available)
+		err = &InsufficientSpaceError{Requested: numBytes, Available: available}
 	} else {
 		volume.mutex.Lock()
 		volume.claimed += numBytes
@@ -1,8 +1,10 @@
 package bagman_test
 
 import (
+	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -96,3 +98,32 @@ func TestVolume(t *testing.T) {
 	}
 
 }
+
+func TestReserveInsufficientSpace(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	volume, err := bagman.NewVolume(filename, bagman.DiscardLogger("volume_test"))
+	if err != nil {
+		t.Fatalf("Cannot get file system's available space: %v\n", err)
+	}
+	requested := volume.AvailableSpace() * 4
+	err = volume.Reserve(requested)
+	if !bagman.IsInsufficientSpace(err) {
+		t.Fatalf("Reserve should have returned an InsufficientSpaceError, got %v", err)
+	}
+	spaceError := err.(*bagman.InsufficientSpaceError)
+	if spaceError.Requested != requested {
+		t.Errorf("Requested: expected %d, got %d", requested, spaceError.Requested)
+	}
+	if spaceError.Available == 0 || spaceError.Available >= requested {
+		t.Errorf("Available should be between 0 and %d, got %d", requested, spaceError.Available)
+	}
+	if !strings.HasPrefix(err.Error(), fmt.Sprintf("Requested %d bytes", requested)) {
+		t.Errorf("Unexpected error message: %s", err.Error())
+	}
+	if volume.ClaimedSpace() != 0 {
+		t.Errorf("Failed reservation should not claim space")
+	}
+	if bagman.IsInsufficientSpace(fmt.Errorf("Some other error")) {
+		t.Errorf("IsInsufficientSpace should be false for other errors")
+	}
+}
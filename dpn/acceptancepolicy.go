@@ -0,0 +1,359 @@
+package dpn
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptancepolicy.go decides whether we have room to start copying
+// a replication transfer. Transfers we don't have room for stay
+// pending, and we try them again later.
+
+// How long we wait before reconsidering a deferred transfer, if
+// ReplicationPolicy.DeferFor is not set.
+const DEFAULT_DEFER_FOR = 1 * time.Hour
+
+// STAGING_SPACE_FACTOR is how much staging space we need per byte
+// of bag: enough for the tar file and its untarred contents, plus
+// a little slack.
+const STAGING_SPACE_FACTOR = 2.1
+
+// ReplicationPolicy limits the replication transfers we accept from
+// other nodes, so a burst from one node can't fill the staging volume
+// and starve APTrust ingest. A zero value means no limit.
+type ReplicationPolicy struct {
+	// MaxBagSize is the largest bag, in bytes, we'll replicate.
+	MaxBagSize            uint64
+	// MaxTransfersPerNode is the most transfers from any one node
+	// we'll have in flight at once.
+	MaxTransfersPerNode   int
+	// MaxStagedBytesPerNode is the most bytes of bags from any one
+	// node we'll have in flight at once.
+	MaxStagedBytesPerNode uint64
+	// StagingBudget is the most bytes of bags from all nodes we'll
+	// have in flight at once. Regardless of the budget, we never
+	// accept a transfer the staging volume doesn't have room for.
+	StagingBudget         uint64
+	// DeferFor is how long to wait before trying a deferred
+	// transfer again, e.g. "30m". If it's empty, we use
+	// DEFAULT_DEFER_FOR.
+	DeferFor              string
+}
+
+// Returns DeferFor as a time.Duration, or DEFAULT_DEFER_FOR if
+// DeferFor is empty or the policy is nil.
+func (policy *ReplicationPolicy) DeferDuration() (time.Duration, error) {
+	if policy == nil || policy.DeferFor == "" {
+		return DEFAULT_DEFER_FOR, nil
+	}
+	deferFor, err := time.ParseDuration(policy.DeferFor)
+	if err != nil || deferFor <= 0 {
+		return 0, fmt.Errorf("Invalid ReplicationPolicy.DeferFor '%s' in DPN config",
+			policy.DeferFor)
+	}
+	return deferFor, nil
+}
+
+// InFlightReplication is a replication transfer we've accepted and
+// have not finished storing.
+type InFlightReplication struct {
+	ReplicationId string
+	FromNode      string
+	BagId         string
+	// Bytes is the size of the bag.
+	Bytes         uint64
+	// Staged is true once the bag has been copied to the staging
+	// directory. After that, the replication is in flight until
+	// the validator or storer removes the bag from staging.
+	Staged        bool
+	// The staging space reserved for the bag, and the volume it's
+	// reserved on. The tracker releases it when the replication
+	// leaves the tracker.
+	volume        *bagman.Volume
+	reserved      uint64
+}
+
+// AcceptanceDecision says whether to start copying a transfer, and
+// if not, why not.
+type AcceptanceDecision struct {
+	Accept bool
+	Reason string
+}
+
+// StagingSpaceNeeded returns the number of bytes of staging space
+// we need to copy and unpack a bag of bagSize bytes.
+func StagingSpaceNeeded(bagSize uint64) (uint64) {
+	return uint64(float64(bagSize) * STAGING_SPACE_FACTOR)
+}
+
+// EvaluateTransfer decides whether we can accept candidate, given
+// the replications already in flight and the bytes available on the
+// staging volume, which should account for space other processes
+// have reserved. A nil policy accepts any transfer the staging volume
+// has room for. A transfer that's already in flight is always
+// accepted, since NSQ may deliver the same transfer more than once.
+func EvaluateTransfer(policy *ReplicationPolicy, inFlight []*InFlightReplication, candidate *InFlightReplication, availableSpace uint64) (*AcceptanceDecision) {
+	if policy == nil {
+		policy = &ReplicationPolicy{}
+	}
+	nodeTransfers := 0
+	var nodeBytes, totalBytes uint64
+	for _, replication := range inFlight {
+		if replication.ReplicationId == candidate.ReplicationId {
+			return &AcceptanceDecision{Accept: true}
+		}
+		totalBytes += replication.Bytes
+		if replication.FromNode == candidate.FromNode {
+			nodeTransfers++
+			nodeBytes += replication.Bytes
+		}
+	}
+	if policy.MaxBagSize > 0 && candidate.Bytes > policy.MaxBagSize {
+		return deferTransfer(fmt.Sprintf("bag is %d bytes, and the limit is %d",
+			candidate.Bytes, policy.MaxBagSize))
+	}
+	if policy.MaxTransfersPerNode > 0 && nodeTransfers >= policy.MaxTransfersPerNode {
+		return deferTransfer(fmt.Sprintf("%d transfers from %s are already in flight, "+
+			"and the limit is %d", nodeTransfers, candidate.FromNode,
+			policy.MaxTransfersPerNode))
+	}
+	if policy.MaxStagedBytesPerNode > 0 && nodeBytes+candidate.Bytes > policy.MaxStagedBytesPerNode {
+		return deferTransfer(fmt.Sprintf("%d bytes from %s are already in flight, "+
+			"and %d more would exceed the limit of %d", nodeBytes,
+			candidate.FromNode, candidate.Bytes, policy.MaxStagedBytesPerNode))
+	}
+	if policy.StagingBudget > 0 && totalBytes+candidate.Bytes > policy.StagingBudget {
+		return deferTransfer(fmt.Sprintf("%d bytes are already in flight, and %d more "+
+			"would exceed the staging budget of %d", totalBytes, candidate.Bytes,
+			policy.StagingBudget))
+	}
+	if needed := StagingSpaceNeeded(candidate.Bytes); needed > availableSpace {
+		return deferTransfer(fmt.Sprintf("bag needs %d bytes of staging space, and "+
+			"only %d are available", needed, availableSpace))
+	}
+	return &AcceptanceDecision{Accept: true}
+}
+
+func deferTransfer(reason string) (*AcceptanceDecision) {
+	return &AcceptanceDecision{Accept: false, Reason: reason}
+}
+
+// InFlightTracker keeps track of the replications a copier has
+// accepted and not yet finished. It's safe to use across go routines.
+type InFlightTracker struct {
+	stagingDir   string
+	replications map[string]*InFlightReplication
+	deferrals    int
+	mutex        *sync.Mutex
+}
+
+// NewInFlightTracker returns an empty tracker for replications
+// staged in stagingDir.
+func NewInFlightTracker(stagingDir string) (*InFlightTracker) {
+	return &InFlightTracker{
+		stagingDir:   stagingDir,
+		replications: make(map[string]*InFlightReplication),
+		mutex:        &sync.Mutex{},
+	}
+}
+
+// RebuildInFlightTracker rebuilds the tracker after a restart. A
+// replication is in flight if our local registry has a requested or
+// received transfer of the bag to our node and the bag is still in
+// the staging directory.
+func RebuildInFlightTracker(client *DPNRestClient, stagingDir string) (*InFlightTracker, error) {
+	tracker := NewInFlightTracker(stagingDir)
+	staged, err := stagedBagSizes(stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(staged) == 0 {
+		return tracker, nil
+	}
+	for _, status := range []string{"requested", "received"} {
+		for pageNumber := 1; ; pageNumber++ {
+			params := url.Values{}
+			params.Set("to_node", client.Node)
+			params.Set("status", status)
+			params.Set("page", fmt.Sprintf("%d", pageNumber))
+			result, err := client.DPNReplicationListGet(&params)
+			if err != nil {
+				return nil, fmt.Errorf("Can't rebuild in-flight replications: %v", err)
+			}
+			for _, xfer := range result.Results {
+				size, isStaged := staged[xfer.BagId]
+				if !isStaged || xfer.ToNode != client.Node {
+					continue
+				}
+				// The bag's registered size is more accurate than
+				// the size of a file that may be partially copied.
+				if bag, err := client.DPNBagGet(xfer.BagId); err == nil && bag.Size > size {
+					size = bag.Size
+				}
+				tracker.replications[xfer.ReplicationId] = &InFlightReplication{
+					ReplicationId: xfer.ReplicationId,
+					FromNode:      xfer.FromNode,
+					BagId:         xfer.BagId,
+					Bytes:         size,
+					Staged:        true,
+				}
+			}
+			if result.Next == nil || *result.Next == "" {
+				break
+			}
+		}
+	}
+	return tracker, nil
+}
+
+// Returns a map of bag UUID to the size of the bag's tar file, or
+// zero if we have only the untarred bag, for each bag in stagingDir.
+func stagedBagSizes(stagingDir string) (map[string]uint64, error) {
+	sizes := make(map[string]uint64)
+	entries, err := ioutil.ReadDir(stagingDir)
+	if os.IsNotExist(err) {
+		return sizes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		bagId := strings.TrimSuffix(entry.Name(), ".tar")
+		if !entry.IsDir() {
+			sizes[bagId] = uint64(entry.Size())
+		} else if _, exists := sizes[bagId]; !exists {
+			sizes[bagId] = 0
+		}
+	}
+	return sizes, nil
+}
+
+// Evaluate decides whether to accept candidate under policy and, if
+// it's accepted, adds it to the tracker. Evaluating and adding under
+// one lock keeps two workers from both taking the last slot.
+func (tracker *InFlightTracker) Evaluate(policy *ReplicationPolicy, candidate *InFlightReplication, availableSpace uint64) (*AcceptanceDecision) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.prune()
+	decision := EvaluateTransfer(policy, tracker.list(), candidate, availableSpace)
+	if decision.Accept {
+		if _, exists := tracker.replications[candidate.ReplicationId]; !exists {
+			tracker.replications[candidate.ReplicationId] = candidate
+		}
+	} else {
+		tracker.deferrals++
+	}
+	return decision
+}
+
+// MarkStaged records that the replication's bag is in the staging
+// directory.
+func (tracker *InFlightTracker) MarkStaged(replicationId string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if replication, exists := tracker.replications[replicationId]; exists {
+		replication.Staged = true
+	}
+}
+
+// Reserve reserves numBytes of staging space on volume for the
+// replication, which must already be in the tracker. The tracker
+// releases the space when the replication leaves it, through Remove
+// or because its bag has left the staging directory. A replication
+// that already has space reserved doesn't reserve it again.
+// Returns an *InsufficientSpaceError if there isn't enough room.
+func (tracker *InFlightTracker) Reserve(replicationId string, volume *bagman.Volume, numBytes uint64) (error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	replication, exists := tracker.replications[replicationId]
+	if !exists {
+		return fmt.Errorf("Cannot reserve space for replication %s: it's not in flight",
+			replicationId)
+	}
+	if replication.reserved > 0 {
+		return nil
+	}
+	err := volume.Reserve(numBytes)
+	if err == nil {
+		replication.volume = volume
+		replication.reserved = numBytes
+	}
+	return err
+}
+
+// Remove stops tracking the replication, e.g. because its copy
+// failed, and releases its staging space.
+func (tracker *InFlightTracker) Remove(replicationId string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if replication, exists := tracker.replications[replicationId]; exists {
+		tracker.delete(replication)
+	}
+}
+
+// Stops tracking the replication, and releases its staging space.
+// Caller must hold the lock.
+func (tracker *InFlightTracker) delete(replication *InFlightReplication) {
+	if replication.reserved > 0 {
+		replication.volume.Release(replication.reserved)
+		replication.reserved = 0
+	}
+	delete(tracker.replications, replication.ReplicationId)
+}
+
+// InFlight returns the replications in flight, sorted by
+// ReplicationId.
+func (tracker *InFlightTracker) InFlight() ([]*InFlightReplication) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.prune()
+	return tracker.list()
+}
+
+// Deferrals returns the number of transfers the tracker has deferred.
+func (tracker *InFlightTracker) Deferrals() (int) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.deferrals
+}
+
+// Returns the tracked replications, sorted by ReplicationId.
+// Caller must hold the lock.
+func (tracker *InFlightTracker) list() ([]*InFlightReplication) {
+	replications := make([]*InFlightReplication, 0, len(tracker.replications))
+	for _, replication := range tracker.replications {
+		replications = append(replications, replication)
+	}
+	sort.Sort(replicationsById(replications))
+	return replications
+}
+
+// Drops staged replications whose bags have left the staging
+// directory. The validator, storer and cleanup processes remove
+// bags from staging, and they don't tell us when they do.
+// Caller must hold the lock.
+func (tracker *InFlightTracker) prune() {
+	for _, replication := range tracker.replications {
+		if !replication.Staged {
+			continue
+		}
+		tarFile := filepath.Join(tracker.stagingDir, replication.BagId+".tar")
+		untarred := filepath.Join(tracker.stagingDir, replication.BagId)
+		if !bagman.FileExists(tarFile) && !bagman.FileExists(untarred) {
+			tracker.delete(replication)
+		}
+	}
+}
+
+type replicationsById []*InFlightReplication
+
+func (s replicationsById) Len() int           { return len(s) }
+func (s replicationsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s replicationsById) Less(i, j int) bool { return s[i].ReplicationId < s[j].ReplicationId }
@@ -0,0 +1,243 @@
+package dpn_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const GB = uint64(1024 * 1024 * 1024)
+
+func replication(id, fromNode string, bytes uint64) (*dpn.InFlightReplication) {
+	return &dpn.InFlightReplication{
+		ReplicationId: id,
+		FromNode:      fromNode,
+		BagId:         "bag-" + id,
+		Bytes:         bytes,
+	}
+}
+
+func TestEvaluateTransfer(t *testing.T) {
+	policy := &dpn.ReplicationPolicy{
+		MaxBagSize:            100 * GB,
+		MaxTransfersPerNode:   2,
+		MaxStagedBytesPerNode: 50 * GB,
+		StagingBudget:         80 * GB,
+	}
+	inFlight := []*dpn.InFlightReplication{
+		replication("1", "chron", 10 * GB),
+		replication("2", "chron", 10 * GB),
+		replication("3", "hathi", 40 * GB),
+	}
+	plenty := 1000 * GB
+	testCases := []struct {
+		description    string
+		policy         *dpn.ReplicationPolicy
+		candidate      *dpn.InFlightReplication
+		availableSpace uint64
+		accept         bool
+		reason         string
+	}{
+		{"within limits", policy, replication("4", "sdr", 20 * GB), plenty, true, ""},
+		{"bag too big", policy, replication("4", "sdr", 101 * GB), plenty, false, "the limit is"},
+		{"too many from node", policy, replication("4", "chron", GB), plenty, false, "2 transfers from chron"},
+		{"too many bytes from node", policy, replication("4", "hathi", 11 * GB), plenty, false, "from hathi"},
+		{"over staging budget", policy, replication("4", "sdr", 21 * GB), plenty, false, "staging budget"},
+		{"not enough disk", policy, replication("4", "sdr", 20 * GB), 40 * GB, false, "staging space"},
+		{"already in flight", policy, replication("1", "chron", 10 * GB), 0, true, ""},
+		{"nil policy", nil, replication("4", "chron", 101 * GB), plenty, true, ""},
+		{"nil policy, not enough disk", nil, replication("4", "chron", 101 * GB), 100 * GB, false, "staging space"},
+	}
+	for _, testCase := range testCases {
+		decision := dpn.EvaluateTransfer(testCase.policy, inFlight,
+			testCase.candidate, testCase.availableSpace)
+		if decision.Accept != testCase.accept {
+			t.Errorf("%s: expected Accept %t, got %t (%s)", testCase.description,
+				testCase.accept, decision.Accept, decision.Reason)
+		}
+		if !strings.Contains(decision.Reason, testCase.reason) {
+			t.Errorf("%s: reason '%s' should contain '%s'", testCase.description,
+				decision.Reason, testCase.reason)
+		}
+	}
+}
+
+func TestDeferDuration(t *testing.T) {
+	var policy *dpn.ReplicationPolicy
+	if deferFor, _ := policy.DeferDuration(); deferFor != dpn.DEFAULT_DEFER_FOR {
+		t.Errorf("Nil policy should defer for %s, got %s", dpn.DEFAULT_DEFER_FOR, deferFor)
+	}
+	policy = &dpn.ReplicationPolicy{DeferFor: "30m"}
+	if deferFor, _ := policy.DeferDuration(); deferFor != 30 * time.Minute {
+		t.Errorf("Expected 30m, got %s", deferFor)
+	}
+	policy.DeferFor = "later"
+	if _, err := policy.DeferDuration(); err == nil {
+		t.Errorf("DeferDuration should reject 'later'")
+	}
+}
+
+func TestInFlightTracker(t *testing.T) {
+	stagingDir, err := ioutil.TempDir("", "dpn_staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stagingDir)
+	tracker := dpn.NewInFlightTracker(stagingDir)
+	policy := &dpn.ReplicationPolicy{MaxTransfersPerNode: 1}
+
+	first := replication("1", "chron", GB)
+	if decision := tracker.Evaluate(policy, first, 10 * GB); !decision.Accept {
+		t.Fatalf("First transfer should be accepted: %s", decision.Reason)
+	}
+	if decision := tracker.Evaluate(policy, replication("2", "chron", GB), 10 * GB); decision.Accept {
+		t.Errorf("Second transfer from chron should be deferred")
+	}
+	if tracker.Deferrals() != 1 {
+		t.Errorf("Expected 1 deferral, got %d", tracker.Deferrals())
+	}
+
+	// Once the bag is staged, it's in flight until it leaves staging.
+	tarFile := filepath.Join(stagingDir, first.BagId+".tar")
+	if err = ioutil.WriteFile(tarFile, []byte("bag"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracker.MarkStaged(first.ReplicationId)
+	if len(tracker.InFlight()) != 1 {
+		t.Errorf("Staged bag should still be in flight")
+	}
+	os.Remove(tarFile)
+	if len(tracker.InFlight()) != 0 {
+		t.Errorf("Bag removed from staging should no longer be in flight")
+	}
+	if decision := tracker.Evaluate(policy, replication("2", "chron", GB), 10 * GB); !decision.Accept {
+		t.Errorf("Transfer from chron should be accepted now: %s", decision.Reason)
+	}
+	tracker.Remove("2")
+	if len(tracker.InFlight()) != 0 {
+		t.Errorf("Removed replication should no longer be in flight")
+	}
+}
+
+// The tracker holds each replication's staging space until the
+// replication leaves the tracker.
+func TestInFlightTrackerReserve(t *testing.T) {
+	stagingDir, err := ioutil.TempDir("", "dpn_staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stagingDir)
+	volume, err := bagman.NewVolume(stagingDir, bagman.DiscardLogger("acceptancepolicy_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := dpn.NewInFlightTracker(stagingDir)
+	if err = tracker.Reserve("1", volume, 1000); err == nil {
+		t.Errorf("Reserve should fail for a replication that's not in flight")
+	}
+
+	first, second := replication("1", "chron", GB), replication("2", "hathi", GB)
+	tracker.Evaluate(nil, first, 10 * GB)
+	tracker.Evaluate(nil, second, 10 * GB)
+	for _, id := range []string{"1", "1", "2"} {
+		if err = tracker.Reserve(id, volume, 1000); err != nil {
+			t.Fatalf("Reserve(%s) returned error: %v", id, err)
+		}
+	}
+	if volume.ClaimedSpace() != 2000 {
+		t.Errorf("Expected 2000 bytes claimed, got %d", volume.ClaimedSpace())
+	}
+
+	tracker.Remove("1")
+	if volume.ClaimedSpace() != 1000 {
+		t.Errorf("Remove should release the space, but %d bytes are claimed",
+			volume.ClaimedSpace())
+	}
+
+	// A staged bag keeps its space until it leaves staging.
+	tarFile := filepath.Join(stagingDir, second.BagId+".tar")
+	if err = ioutil.WriteFile(tarFile, []byte("bag"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracker.MarkStaged("2")
+	tracker.InFlight()
+	if volume.ClaimedSpace() != 1000 {
+		t.Errorf("Staged bag should keep its space, but %d bytes are claimed",
+			volume.ClaimedSpace())
+	}
+	os.Remove(tarFile)
+	tracker.InFlight()
+	if volume.ClaimedSpace() != 0 {
+		t.Errorf("Pruning should release the space, but %d bytes are claimed",
+			volume.ClaimedSpace())
+	}
+}
+
+// Fake local registry with one requested and one received transfer
+// to our node, plus a requested transfer whose bag we haven't copied.
+func registryServer() (*httptest.Server) {
+	transfers := map[string]string{
+		"requested": `{"replication_id": "xfer-1", "from_node": "chron", "to_node": "aptrust",
+			"uuid": "bag-1", "status": "requested"},
+			{"replication_id": "xfer-3", "from_node": "chron", "to_node": "aptrust",
+			"uuid": "bag-3", "status": "requested"}`,
+		"received": `{"replication_id": "xfer-2", "from_node": "hathi", "to_node": "aptrust",
+			"uuid": "bag-2", "status": "received"}`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api-v1/replicate/" {
+			fmt.Fprintf(w, `{"count": 1, "next": null, "previous": null, "results": [%s]}`,
+				transfers[r.URL.Query().Get("status")])
+			return
+		}
+		if r.URL.Path == "/api-v1/bag/bag-1/" {
+			fmt.Fprintf(w, `{"uuid": "bag-1", "size": 5000}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+func TestRebuildInFlightTracker(t *testing.T) {
+	stagingDir, err := ioutil.TempDir("", "dpn_staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stagingDir)
+	// bag-1 is partially copied, bag-2 is untarred and bag-4
+	// is one of our own bags, packaged for ingest.
+	ioutil.WriteFile(filepath.Join(stagingDir, "bag-1.tar"), []byte("partial"), 0644)
+	os.MkdirAll(filepath.Join(stagingDir, "bag-2", "data"), 0755)
+	ioutil.WriteFile(filepath.Join(stagingDir, "bag-4.tar"), []byte("ours"), 0644)
+
+	server := registryServer()
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token", "aptrust",
+		&dpn.DPNConfig{}, bagman.DiscardLogger("acceptancepolicy_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := dpn.RebuildInFlightTracker(client, stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlight := tracker.InFlight()
+	if len(inFlight) != 2 {
+		t.Fatalf("Expected 2 replications in flight, got %d", len(inFlight))
+	}
+	if inFlight[0].ReplicationId != "xfer-1" || inFlight[0].FromNode != "chron" ||
+		inFlight[0].Bytes != 5000 || !inFlight[0].Staged {
+		t.Errorf("Bad rebuild of xfer-1: %v", inFlight[0])
+	}
+	if inFlight[1].ReplicationId != "xfer-2" || inFlight[1].FromNode != "hathi" {
+		t.Errorf("Bad rebuild of xfer-2: %v", inFlight[1])
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/satori/go.uuid"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -46,6 +47,14 @@ import (
 //
 //  errors := builder.Bag.Save()
 func NewBagBuilder(localPath string, obj *bagman.IntellectualObject, defaultMetadata *DefaultMetadata) (*BagBuilder, error) {
+	return NewBagBuilderVersion(localPath, obj, defaultMetadata, nil)
+}
+
+// NewBagBuilderVersion is like NewBagBuilder, but builds the version
+// of the bag described by version, with a new UUID and the first
+// version's UUID in dpn-info.txt. If version is nil, this builds
+// version 1.
+func NewBagBuilderVersion(localPath string, obj *bagman.IntellectualObject, defaultMetadata *DefaultMetadata, version *BagVersion) (*BagBuilder, error) {
 	uuid := uuid.NewV4().String()
 	filePath, err := filepath.Abs(localPath)
 	if err != nil {
@@ -68,9 +77,15 @@ func NewBagBuilder(localPath string, obj *bagman.IntellectualObject, defaultMeta
 		IntellectualObject: obj,
 		DefaultMetadata: defaultMetadata,
 		UUID: uuid,
+		Version: 1,
+		FirstVersionUUID: uuid,
 		BagType: BAG_TYPE_DATA,
 		Bag: bag,
 	}
+	if version != nil && version.Version > 1 {
+		builder.Version = version.Version
+		builder.FirstVersionUUID = version.FirstVersionUUID
+	}
 
 
 	err = os.MkdirAll(filepath.Join(builder.LocalPath, "dpn-tags"), 0755)
@@ -159,18 +174,11 @@ func (builder *BagBuilder) buildDPNInfo() {
 	dpnInfo.Data.AddField(*bagins.NewTagField("Ingest-Node-Contact-Email",
 		builder.DefaultMetadata.IngestNodeContactEmail))
 
-	// TODO: Not sure how to fill in the next three items.
-	// We have to wait until DPN versioning spec is written, then we
-	// need to know how to let depositors specify whether to overwrite
-	// bags or save new versions in DPN, then we need a way of knowing
-	// which DPN object this is a new version of, and which version
-	// it should be.
-	dpnInfo.Data.AddField(*bagins.NewTagField("Version-Number", "1"))
-	// Are we also using First-Version-Object-ID?
-	// Check https://wiki.duraspace.org/display/DPN/BagIt+Specification
-	// for updates.
+	// The packager decides which version this is. See NextBagVersion.
+	dpnInfo.Data.AddField(*bagins.NewTagField("Version-Number",
+		fmt.Sprintf("%d", builder.Version)))
 	dpnInfo.Data.AddField(*bagins.NewTagField("First-Version-Object-ID",
-		builder.UUID))
+		builder.FirstVersionUUID))
 	dpnInfo.Data.AddField(*bagins.NewTagField("Interpretive-Object-ID", ""))
 	dpnInfo.Data.AddField(*bagins.NewTagField("Rights-Object-ID", ""))
 
@@ -207,3 +215,32 @@ func (builder *BagBuilder) AddTagFile(tagFileName string) (*bagins.TagFile, erro
 	}
 	return tagFile, nil
 }
+
+// AddAPTrustInfo adds the APTrust bag's aptrust-info.txt, read from
+// sourcePath, to the aptrust-tags directory. Tags are copied as-is,
+// except Access and Rights, which get the canonical value from
+// bagman.NormalizeAccess. This keeps the access value in the DPN bag
+// in agreement with what we recorded at ingest.
+func (builder *BagBuilder) AddAPTrustInfo(sourcePath string) (error) {
+	tags, _, err := bagman.ReadTagFile(sourcePath)
+	if err != nil {
+		return fmt.Errorf("Cannot read %s: %v", sourcePath, err)
+	}
+	tagFile, err := builder.AddTagFile("aptrust-tags/aptrust-info.txt")
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		value := tag.Value
+		lcLabel := strings.ToLower(tag.Label)
+		if lcLabel == "access" || lcLabel == "rights" {
+			value, _, err = bagman.NormalizeAccess(tag.Value)
+			if err != nil {
+				return fmt.Errorf("In aptrust-info.txt for %s: %v",
+					builder.IntellectualObject.Identifier, err)
+			}
+		}
+		tagFile.Data.AddField(*bagins.NewTagField(tag.Label, value))
+	}
+	return nil
+}
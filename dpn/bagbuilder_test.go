@@ -178,6 +178,39 @@ func TestAPTrustBagit(t *testing.T) {
 	verifyTagField(t, tagfile, "Tag-File-Character-Encoding", "UTF-8")
 }
 
+func TestAddAPTrustInfo(t *testing.T) {
+	builder := createBagBuilder(t)
+	defer tearDown()
+	if builder == nil {
+		return
+	}
+	sourcePath := filepath.Join(testBagPath(), "source-aptrust-info.txt")
+	err := ioutil.WriteFile(sourcePath,
+		[]byte("Title: Strabo De situ orbis.\nAccess: Consortial \n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = builder.AddAPTrustInfo(sourcePath); err != nil {
+		t.Fatalf("AddAPTrustInfo() returned error: %v", err)
+	}
+	tagfile, err := builder.Bag.TagFile("aptrust-tags/aptrust-info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTagField(t, tagfile, "Title", "Strabo De situ orbis.")
+	verifyTagField(t, tagfile, "Access", "consortia")
+
+	// Unknown values are an error, not copied into the DPN bag.
+	err = ioutil.WriteFile(sourcePath,
+		[]byte("Title: Strabo De situ orbis.\nAccess: Hands Off!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = builder.AddAPTrustInfo(sourcePath); err == nil {
+		t.Errorf("AddAPTrustInfo() should have rejected access 'Hands Off!'")
+	}
+}
+
 func verifyFile(t *testing.T, filePath string) {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
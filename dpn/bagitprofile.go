@@ -0,0 +1,211 @@
+package dpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TagSpec describes the requirements for a single tag
+// in a BagIt profile.
+type TagSpec struct {
+	// Required means the tag must be present in the tag file.
+	Required bool     `json:"required"`
+
+	// Values lists the allowed values for the tag. If this
+	// is empty, any value is allowed.
+	Values   []string `json:"values"`
+}
+
+// BagItProfile describes the requirements a bag must meet, as
+// described at https://github.com/ruebot/bagit-profiles.
+// DPN bags must conform to the DPN BagIt profile.
+type BagItProfile struct {
+	// Information about the profile itself, such as
+	// Source-Organization and Version.
+	ProfileInfo          map[string]string  `json:"BagIt-Profile-Info"`
+
+	// Requirements for tags in bag-info.txt.
+	BagInfo              map[string]TagSpec `json:"Bag-Info"`
+
+	// Algorithms of required payload manifests, e.g. "sha256".
+	ManifestsRequired    []string           `json:"Manifests-Required"`
+
+	// Algorithms of required tag manifests.
+	TagManifestsRequired []string           `json:"Tag-Manifests-Required"`
+
+	// Paths of tag files that must be present, relative to
+	// the top-level directory of the bag.
+	TagFilesRequired     []string           `json:"Tag-Files-Required"`
+
+	// Whether the bag may contain a fetch.txt file.
+	AllowFetchTxt        bool               `json:"Allow-Fetch.txt"`
+
+	// Acceptable values for BagIt-Version in bagit.txt.
+	AcceptBagItVersion   []string           `json:"Accept-BagIt-Version"`
+
+	// Requirements for tags in tag files other than bag-info.txt,
+	// keyed by path of the tag file. This is not part of the BagIt
+	// profile spec, but DPN requires a number of tags in
+	// dpn-tags/dpn-info.txt, and this lets us describe them.
+	TagFileInfo          map[string]map[string]TagSpec `json:"Tag-File-Info"`
+}
+
+// LoadBagItProfile loads the BagIt profile at profileURL. If profileURL
+// starts with http:// or https://, this fetches the profile from the
+// web. Otherwise, profileURL is treated as a file path. Relative paths
+// are relative to the bagman home directory, like the config files.
+func LoadBagItProfile(profileURL string) (*BagItProfile, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(profileURL, "http://") || strings.HasPrefix(profileURL, "https://") {
+		data, err = fetchBagItProfile(profileURL)
+	} else {
+		filePath := strings.TrimPrefix(profileURL, "file://")
+		if filepath.IsAbs(filePath) {
+			data, err = ioutil.ReadFile(filePath)
+		} else {
+			data, err = bagman.LoadRelativeFile(filePath)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load BagIt profile from %s: %v", profileURL, err)
+	}
+	profile := &BagItProfile{}
+	err = json.Unmarshal(data, profile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse BagIt profile from %s: %v", profileURL, err)
+	}
+	return profile, nil
+}
+
+func fetchBagItProfile(profileURL string) ([]byte, error) {
+	resp, err := http.Get(profileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Server returned status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Validate checks the untarred bag at bagPath against the profile,
+// and returns a list of profile violations.
+func (profile *BagItProfile) Validate(bagPath string) ([]string) {
+	profileErrors := make([]string, 0)
+	for _, algorithm := range profile.ManifestsRequired {
+		fileName := fmt.Sprintf("manifest-%s.txt", algorithm)
+		if !bagman.FileExists(filepath.Join(bagPath, fileName)) {
+			profileErrors = append(profileErrors,
+				fmt.Sprintf("Required manifest %s is missing.", fileName))
+		}
+	}
+	for _, algorithm := range profile.TagManifestsRequired {
+		fileName := fmt.Sprintf("tagmanifest-%s.txt", algorithm)
+		if !bagman.FileExists(filepath.Join(bagPath, fileName)) {
+			profileErrors = append(profileErrors,
+				fmt.Sprintf("Required tag manifest %s is missing.", fileName))
+		}
+	}
+	for _, tagFile := range profile.TagFilesRequired {
+		if !bagman.FileExists(filepath.Join(bagPath, filepath.FromSlash(tagFile))) {
+			profileErrors = append(profileErrors,
+				fmt.Sprintf("Required tag file %s is missing.", tagFile))
+		}
+	}
+	if !profile.AllowFetchTxt && bagman.FileExists(filepath.Join(bagPath, "fetch.txt")) {
+		profileErrors = append(profileErrors, "Bag contains fetch.txt, which the profile does not allow.")
+	}
+	if len(profile.AcceptBagItVersion) > 0 {
+		bagitSpec := map[string]TagSpec{
+			"BagIt-Version": TagSpec{Required: true, Values: profile.AcceptBagItVersion},
+		}
+		profileErrors = append(profileErrors, checkTagFile(bagPath, "bagit.txt", bagitSpec)...)
+	}
+	if len(profile.BagInfo) > 0 {
+		profileErrors = append(profileErrors, checkTagFile(bagPath, "bag-info.txt", profile.BagInfo)...)
+	}
+	for _, tagFile := range sortedKeys(profile.TagFileInfo) {
+		profileErrors = append(profileErrors,
+			checkTagFile(bagPath, tagFile, profile.TagFileInfo[tagFile])...)
+	}
+	return profileErrors
+}
+
+// Checks the tags in a single tag file against the specs, and
+// returns a list of problems.
+func checkTagFile(bagPath, tagFile string, tagSpecs map[string]TagSpec) ([]string) {
+	profileErrors := make([]string, 0)
+	tags, err := readTagFile(filepath.Join(bagPath, filepath.FromSlash(tagFile)))
+	if err != nil {
+		return append(profileErrors, fmt.Sprintf("Cannot read tags from %s: %v", tagFile, err))
+	}
+	tagNames := make([]string, 0, len(tagSpecs))
+	for tagName := range tagSpecs {
+		tagNames = append(tagNames, tagName)
+	}
+	sort.Strings(tagNames)
+	for _, tagName := range tagNames {
+		spec := tagSpecs[tagName]
+		values, present := tags[tagName]
+		if !present {
+			if spec.Required {
+				profileErrors = append(profileErrors,
+					fmt.Sprintf("Required tag '%s' is missing from %s", tagName, tagFile))
+			}
+			continue
+		}
+		if len(spec.Values) == 0 {
+			continue
+		}
+		for _, value := range values {
+			if !stringInList(value, spec.Values) {
+				profileErrors = append(profileErrors,
+					fmt.Sprintf("Tag '%s' in %s has value '%s', which is not one of: %s",
+						tagName, tagFile, value, strings.Join(spec.Values, ", ")))
+			}
+		}
+	}
+	return profileErrors
+}
+
+// Reads a BagIt tag file and returns a map of tag labels to values.
+// A label may appear more than once.
+func readTagFile(filePath string) (map[string][]string, error) {
+	tagList, _, err := bagman.ReadTagFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string][]string)
+	for _, tag := range tagList {
+		tags[tag.Label] = append(tags[tag.Label], tag.Value)
+	}
+	return tags, nil
+}
+
+// Returns the tag file names in TagFileInfo in sorted order,
+// so profile errors come out in a predictable order.
+func sortedKeys(tagFileInfo map[string]map[string]TagSpec) ([]string) {
+	keys := make([]string, 0, len(tagFileInfo))
+	for key := range tagFileInfo {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringInList(value string, list []string) (bool) {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package dpn_test
+
+import (
+	"encoding/json"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"strings"
+	"testing"
+)
+
+const DPN_PROFILE = "dpn/dpn_bagit_profile.json"
+
+func loadDPNProfile(t *testing.T) (*dpn.BagItProfile) {
+	profile, err := dpn.LoadBagItProfile(DPN_PROFILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func TestLoadBagItProfile(t *testing.T) {
+	profile, err := dpn.LoadBagItProfile(DPN_PROFILE)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(profile.ManifestsRequired) != 1 || profile.ManifestsRequired[0] != "sha256" {
+		t.Errorf("Profile should require manifest-sha256.txt")
+	}
+	if _, ok := profile.TagFileInfo["dpn-tags/dpn-info.txt"]["DPN-Object-ID"]; !ok {
+		t.Errorf("Profile should have a spec for DPN-Object-ID")
+	}
+	_, err = dpn.LoadBagItProfile("dpn/testdata/no_such_profile.json")
+	if err == nil {
+		t.Errorf("LoadBagItProfile should have returned an error for missing file")
+	}
+}
+
+func TestValidate_GoodBagWithProfile(t *testing.T) {
+	bagPath, err := getBagPath(GOOD_BAG)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cleanup(result)
+	result.BagItProfile = loadDPNProfile(t)
+	result.ValidateBag()
+	if len(result.ProfileErrors) > 0 {
+		t.Errorf("Good bag should conform to DPN profile, but got: %s",
+			strings.Join(result.ProfileErrors, "; "))
+	}
+}
+
+func TestValidate_BagMissingTagsWithProfile(t *testing.T) {
+	bagPath, err := getBagPath(BAG_MISSING_TAGS)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	validationResult, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cleanup(validationResult)
+	validationResult.BagItProfile = loadDPNProfile(t)
+	validationResult.ValidateBag()
+	if validationResult.IsValid() {
+		t.Errorf("Bag should not be valid.")
+	}
+	expected := "Required tag 'DPN-Object-ID' is missing from dpn-tags/dpn-info.txt"
+	if !stringListContains(validationResult.ProfileErrors, expected) {
+		t.Errorf("ProfileErrors should include \"%s\", but got: %s",
+			expected, strings.Join(validationResult.ProfileErrors, "; "))
+	}
+
+	// Make sure the profile errors go back to the FromNode
+	// in the copy receipt.
+	result := dpn.NewDPNResult("")
+	result.TransferRequest = MakeXferRequest("chron", "aptrust", "00000000-0000-4000-a000-000000000004")
+	result.ValidationResult = validationResult
+	result.PrepareCopyReceipt()
+	if result.TransferRequest.BagValid == nil || *result.TransferRequest.BagValid {
+		t.Errorf("Copy receipt should have BagValid = false")
+	}
+	if !stringListContains(result.TransferRequest.ProfileErrors, expected) {
+		t.Errorf("Copy receipt should include profile error \"%s\"", expected)
+	}
+	jsonData, err := json.Marshal(result.TransferRequest)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(jsonData), "DPN-Object-ID' is missing") {
+		t.Errorf("Serialized copy receipt is missing profile errors: %s", string(jsonData))
+	}
+}
+
+func stringListContains(list []string, item string) (bool) {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
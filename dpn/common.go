@@ -3,14 +3,14 @@ package dpn
 import (
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
+	"time"
 )
 
 func SendToRecordQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
 	// Record has to record PREMIS event in Fluctus if
 	// BagIdentifier is present. It will definitely have
 	// to record information in the DPN REST API.
-	err := bagman.Enqueue(procUtil.Config.NsqdHttpAddress,
-		procUtil.Config.DPNRecordWorker.NsqTopic, result)
+	err := procUtil.Enqueue(procUtil.Config.DPNRecordWorker.NsqTopic, result)
 	if err != nil {
 		bagIdentifier := result.BagIdentifier
 		if bagIdentifier == "" {
@@ -25,8 +25,7 @@ func SendToRecordQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
 }
 
 func SendToValidationQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
-	err := bagman.Enqueue(procUtil.Config.NsqdHttpAddress,
-		procUtil.Config.DPNValidationWorker.NsqTopic, result)
+	err := procUtil.Enqueue(procUtil.Config.DPNValidationWorker.NsqTopic, result)
 	if err != nil {
 		message := fmt.Sprintf("Could not send '%s' (at %s) to validation queue: %v",
 			result.BagIdentifier, result.PackageResult.TarFilePath, err)
@@ -37,8 +36,7 @@ func SendToValidationQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
 }
 
 func SendToStorageQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
-	err := bagman.Enqueue(procUtil.Config.NsqdHttpAddress,
-		procUtil.Config.DPNStoreWorker.NsqTopic, result)
+	err := procUtil.Enqueue(procUtil.Config.DPNStoreWorker.NsqTopic, result)
 	if err != nil {
 		message := fmt.Sprintf("Could not send '%s' (at %s) to storage queue: %v",
 			result.BagIdentifier, result.PackageResult.TarFilePath, err)
@@ -50,8 +48,7 @@ func SendToStorageQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
 
 func SendToTroubleQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
 	result.ErrorMessage += " This item has been queued for administrative review."
-	err := bagman.Enqueue(procUtil.Config.NsqdHttpAddress,
-		procUtil.Config.DPNTroubleWorker.NsqTopic, result)
+	err := procUtil.Enqueue(procUtil.Config.DPNTroubleWorker.NsqTopic, result)
 	if err != nil {
 		procUtil.MessageLog.Error("Could not send '%s' to trouble queue: %v",
 			result.BagIdentifier, err)
@@ -59,3 +56,50 @@ func SendToTroubleQueue(result *DPNResult, procUtil *bagman.ProcessUtil) {
 			result.BagIdentifier, result.ErrorMessage)
 	}
 }
+
+// recoverResult records a panic in one of a DPN worker's stages as
+// an error on the result that was in process, releases the disk
+// space reserved for it, and sends it on to nextChannel, so the
+// remaining stages can tell NSQ what happened. If the last stage
+// panicked, nextChannel is nil, and we requeue the message here.
+func recoverResult(result *DPNResult, stagePanic *bagman.StagePanic, procUtil *bagman.ProcessUtil, nextChannel chan *DPNResult) {
+	if result == nil {
+		return
+	}
+	result.RecordPanic(stagePanic)
+	result.releaseVolume(procUtil.Volume)
+	if nextChannel != nil {
+		nextChannel <- result
+		return
+	}
+	bagIdentifier := result.BagIdentifier
+	if bagIdentifier == "" && result.DPNBag != nil {
+		bagIdentifier = result.DPNBag.UUID
+	}
+	procUtil.MessageLog.Info("Requeueing %s", bagIdentifier)
+	result.NsqMessage.Requeue(1 * time.Minute)
+}
+
+// How long runSynchronously waits for a worker whose MessageTimeout
+// is missing or invalid.
+const DEFAULT_RUN_TEST_TIMEOUT = 3 * time.Hour
+
+// runSynchronously attaches an in-memory message to result, calls
+// start to put the result into a worker's pipeline, and blocks until
+// the worker finishes or requeues the message, or until the worker's
+// MessageTimeout passes, which is when nsqd would give up on it. The
+// RunTest methods use this to run a single stage without NSQ. Items
+// the worker sends on to the next stage go to procUtil.Queue, so
+// callers that don't want them in nsqd should set that first.
+func runSynchronously(result *DPNResult, workerConfig bagman.WorkerConfig, start func()) (error) {
+	timeout, err := time.ParseDuration(workerConfig.MessageTimeout)
+	if err != nil || timeout <= 0 {
+		timeout = DEFAULT_RUN_TEST_TIMEOUT
+	}
+	_, err = bagman.NewSyncDriver(timeout).Run(nil, func(message bagman.Message) error {
+		result.NsqMessage = message
+		start()
+		return nil
+	})
+	return err
+}
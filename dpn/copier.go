@@ -8,7 +8,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sync"
 	"time"
 )
 
@@ -24,8 +23,7 @@ type Copier struct {
 	ProcUtil            *bagman.ProcessUtil
 	LocalClient         *DPNRestClient
 	RemoteClients       map[string]*DPNRestClient
-	// WaitGroup is for running local tests only.
-	WaitGroup           sync.WaitGroup
+	InFlight            *InFlightTracker
 }
 
 type CopyResult struct {
@@ -65,11 +63,22 @@ func NewCopier(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Copier, err
 	if err != nil {
 		return nil, err
 	}
+	if _, err = dpnConfig.ReplicationPolicy.DeferDuration(); err != nil {
+		return nil, err
+	}
+	// Count the replications we accepted before a restart
+	// against our replication policy.
+	inFlight, err := RebuildInFlightTracker(localClient, procUtil.Config.DPNStagingDirectory)
+	if err != nil {
+		return nil, err
+	}
+	procUtil.MessageLog.Info("%d replications in flight at startup", len(inFlight.InFlight()))
 	copier := &Copier {
 		DPNConfig: dpnConfig,
 		ProcUtil: procUtil,
 		LocalClient: localClient,
 		RemoteClients: remoteClients,
+		InFlight: inFlight,
 	}
 	workerBufferSize := procUtil.Config.DPNCopyWorker.Workers * 4
 	copier.LookupChannel = make(chan *DPNResult, workerBufferSize)
@@ -85,11 +94,18 @@ func NewCopier(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Copier, err
 
 func (copier *Copier) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return copier.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (copier *Copier) ProcessMessage(message bagman.Message) error {
 	dpnResult := &DPNResult{}
-	err := json.Unmarshal(message.Body, dpnResult)
+	err := json.Unmarshal(message.Body(), dpnResult)
 	if err != nil {
 		detailedError := fmt.Errorf("Could not unmarshal JSON data from nsq. " +
-			"Error is: %v    JSON is: %s", err.Error(), string(message.Body))
+			"Error is: %v    JSON is: %s", err.Error(), string(message.Body()))
 		copier.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -116,7 +132,13 @@ func (copier *Copier) HandleMessage(message *nsq.Message) error {
 // the authoritative node to avoid unnecessarily processing what might
 // be hundreds of gigs of data.
 func (copier *Copier) doLookup() {
-	for result := range copier.LookupChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_copy.lookup", copier.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			copier.recoverResult(result, stagePanic, copier.PostProcessChannel)
+			go copier.doLookup()
+		})
+	for result = range copier.LookupChannel {
 		// Get a client to talk to the FromNode
 		remoteClient := copier.RemoteClients[result.TransferRequest.FromNode]
 
@@ -146,7 +168,11 @@ func (copier *Copier) doLookup() {
 			copier.PostProcessChannel <- result
 			continue
 		}
-		// ...otherwise, proceed with processing.
+		// ...otherwise, proceed with processing, if our replication
+		// policy lets us take on this transfer now.
+		if !copier.acceptTransfer(result) {
+			continue
+		}
 		copier.CopyChannel <- result
 	}
 }
@@ -154,11 +180,20 @@ func (copier *Copier) doLookup() {
 // Copy the file from the remote node to our local staging area.
 // Calculate checksums.
 func (copier *Copier) doCopy() {
-	for result := range copier.CopyChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_copy.copy", copier.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			copier.recoverResult(result, stagePanic, copier.PostProcessChannel)
+			go copier.doCopy()
+		})
+	for result = range copier.CopyChannel {
 
-		// Make sure we have enough room on the volume
-		// to download and unpack this bag.
-		err := copier.ProcUtil.Volume.Reserve(uint64(float64(result.DPNBag.Size) * float64(2.1)))
+		// Make sure we have enough room on the volume to download
+		// and unpack this bag. The tracker holds the reservation
+		// until the bag leaves staging, which happens in another
+		// process, or the copy fails.
+		err := copier.InFlight.Reserve(result.TransferRequest.ReplicationId,
+			copier.ProcUtil.Volume, StagingSpaceNeeded(result.DPNBag.Size))
 		if err != nil {
 			// Not enough room on disk
 			msg := fmt.Sprintf(
@@ -167,13 +202,10 @@ func (copier *Copier) doCopy() {
 				result.TransferRequest.FromNode,
 				result.DPNBag.Size, err)
 			copier.ProcUtil.MessageLog.Warning(msg)
-			if result.NsqMessage != nil {
-				result.NsqMessage.Requeue(1 * time.Hour)
-			} else {
-				result.ErrorMessage = msg
-				result.CopyResult.ErrorMessage = msg
-				copier.WaitGroup.Done()
-			}
+			result.ErrorMessage = msg
+			result.CopyResult.ErrorMessage = msg
+			copier.InFlight.Remove(result.TransferRequest.ReplicationId)
+			result.NsqMessage.Requeue(1 * time.Hour)
 			continue
 		}
 
@@ -193,13 +225,9 @@ func (copier *Copier) doCopy() {
 			localPath, copier.DPNConfig.UseSSHWithRsync)
 
 		// Touch message on both sides of rsync, so NSQ doesn't time out.
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 		output, err := rsyncCommand.CombinedOutput()
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 		if err != nil {
 			result.CopyResult.ErrorMessage = fmt.Sprintf("%s: %s",
 				err.Error(), string(output))
@@ -210,9 +238,7 @@ func (copier *Copier) doCopy() {
 			// TODO: This is not necessary. We just need to calculate the checksum
 			// of the SHA-256 manifest
 			fileDigest, err := bagman.CalculateDigests(localPath)
-			if result.NsqMessage != nil {
-				result.NsqMessage.Touch()
-			}
+			result.NsqMessage.Touch()
 			if err != nil {
 				result.ErrorMessage = fmt.Sprintf("Could not calculate checksums on '%s': %v",
 					result.PackageResult.TarFilePath, err)
@@ -230,10 +256,14 @@ func (copier *Copier) doCopy() {
 func (copier *Copier) postProcess() {
 	// On success, send to validation queue.
 	// Otherwise, send to trouble queue.
-	for result := range copier.PostProcessChannel {
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_copy.post_process", copier.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			copier.recoverResult(result, stagePanic, nil)
+			go copier.postProcess()
+		})
+	for result = range copier.PostProcessChannel {
+		result.NsqMessage.Touch()
 		result.ErrorMessage = result.CopyResult.ErrorMessage
 
 		// On error, log and send to trouble queue if the error is fatal
@@ -243,6 +273,9 @@ func (copier *Copier) postProcess() {
 			if result.Retry == false {
 				SendToTroubleQueue(result, copier.ProcUtil)
 			}
+			if result.TransferRequest != nil {
+				copier.InFlight.Remove(result.TransferRequest.ReplicationId)
+			}
 			if bagman.FileExists(result.CopyResult.LocalPath) {
 				os.Remove(result.CopyResult.LocalPath)
 				copier.ProcUtil.MessageLog.Debug(
@@ -259,26 +292,63 @@ func (copier *Copier) postProcess() {
 			// We successfully copied the bag. Send it on to
 			// the validation queue.
 			copier.ProcUtil.IncrementSucceeded()
+			copier.InFlight.MarkStaged(result.TransferRequest.ReplicationId)
 			SendToValidationQueue(result, copier.ProcUtil)
 		}
 
-		if result.NsqMessage == nil {
-			// This is a test message, running outside production.
-			copier.WaitGroup.Done()
-		} else {
-			result.NsqMessage.Finish()
-		}
+		result.NsqMessage.Finish()
 		copier.ProcUtil.LogStats()
 
 	}
 }
 
+// acceptTransfer checks the transfer against our replication policy.
+// If we can't take it on now, this requeues the message so we try
+// again later. The transfer stays pending on the remote node, since
+// we'll probably be able to take it once some of the bags in flight
+// are stored.
+func (copier *Copier) acceptTransfer(result *DPNResult) (bool) {
+	candidate := &InFlightReplication{
+		ReplicationId: result.TransferRequest.ReplicationId,
+		FromNode:      result.TransferRequest.FromNode,
+		BagId:         result.TransferRequest.BagId,
+		Bytes:         result.DPNBag.Size,
+	}
+	decision := copier.InFlight.Evaluate(copier.DPNConfig.ReplicationPolicy,
+		candidate, copier.ProcUtil.Volume.AvailableSpace())
+	if decision.Accept {
+		return true
+	}
+	// NewCopier checked that the policy's DeferFor is valid.
+	deferFor, _ := copier.DPNConfig.ReplicationPolicy.DeferDuration()
+	copier.ProcUtil.MessageLog.Info("**DEFERRED** ReplicationId %s (bag %s) from %s: %s. "+
+		"Will try again in %s. Deferrals since startup: %d",
+		candidate.ReplicationId, candidate.BagId, candidate.FromNode,
+		decision.Reason, deferFor, copier.InFlight.Deferrals())
+	result.NsqMessage.Requeue(deferFor)
+	return false
+}
+
+// recoverResult records a panic as a copy error, since
+// postProcess takes the result's error message from the
+// CopyResult, and then passes the result along like the
+// other DPN workers do.
+func (copier *Copier) recoverResult(result *DPNResult, stagePanic *bagman.StagePanic, nextChannel chan *DPNResult) {
+	if result != nil && result.CopyResult != nil {
+		result.CopyResult.ErrorMessage += stagePanic.Error()
+	}
+	recoverResult(result, stagePanic, copier.ProcUtil, nextChannel)
+}
+
 func (copier *Copier) RunTest(dpnResult *DPNResult) {
-	copier.WaitGroup.Add(1)
-	copier.ProcUtil.MessageLog.Info("Putting %s into lookup channel",
-		dpnResult.BagIdentifier)
-	copier.CopyChannel <- dpnResult
-	copier.WaitGroup.Wait()
+	err := runSynchronously(dpnResult, copier.ProcUtil.Config.DPNCopyWorker, func() {
+		copier.ProcUtil.MessageLog.Info("Putting %s into lookup channel",
+			dpnResult.BagIdentifier)
+		copier.CopyChannel <- dpnResult
+	})
+	if err != nil {
+		copier.ProcUtil.MessageLog.Error("%v", err)
+	}
 }
 
 // Returns a command object for copying from the remote location to
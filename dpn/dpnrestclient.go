@@ -3,24 +3,55 @@ package dpn
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/APTrust/bagman/bagman"
 	"github.com/op/go-logging"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Don't log error messages longer than this
 const MAX_ERR_MSG_SIZE = 2048
 
+// How many times we try a request that fails with a connection
+// error or a transient server error, if DPNConfig.MaxRequestAttempts
+// is not set.
+const DEFAULT_MAX_REQUEST_ATTEMPTS = 3
+
+// How long we wait before the first retry, if DPNConfig.RetryBackoff
+// is not set. The wait doubles with each attempt, up to
+// MAX_RETRY_BACKOFF, and we add random jitter so that workers don't
+// all hit a recovering node at once.
+const DEFAULT_RETRY_BACKOFF = 2 * time.Second
+const MAX_RETRY_BACKOFF = 30 * time.Second
+
+// ErrDigestMismatch means the DPN REST service already has a digest
+// for a bag, node and algorithm, and it's not the one we calculated.
+var ErrDigestMismatch = errors.New("Existing message digest does not match")
+
+// Oldest TLS version we accept if DPNConfig.TLSMinVersion is not set.
+const DEFAULT_TLS_MIN_VERSION = tls.VersionTLS12
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 // DPNRestClient is a client for the DPN REST API.
 type DPNRestClient struct {
 	HostUrl      string
@@ -31,6 +62,10 @@ type DPNRestClient struct {
 	httpClient   *http.Client
 	transport    *http.Transport
 	logger       *logging.Logger
+	maxAttempts  int
+	retryBackoff time.Duration
+	remoteClientCache map[string]*DPNRestClient
+	remoteClientMutex sync.RWMutex
 }
 
 type NodeListResult struct {
@@ -56,6 +91,82 @@ type BagListResult struct {
 	Results     []*DPNBag                  `json:results`
 }
 
+// FixityCheckListResult is what the REST service returns when
+// we ask for a list of fixity checks.
+type FixityCheckListResult struct {
+	Count       int32                      `json:count`
+	Next        *string                    `json:next`
+	Previous    *string                    `json:previous`
+	Results     []*DPNFixityCheck          `json:results`
+}
+
+// DPNBagFilter describes the bags to return from DPNBagListGetFiltered.
+// Zero-valued fields are not sent, so an empty filter returns all bags.
+type DPNBagFilter struct {
+	// Return bags updated after this time.
+	AfterDate       time.Time
+
+	// Return bags updated before this time.
+	BeforeDate      time.Time
+
+	// Return bags whose admin node has this namespace.
+	AdminNode       string
+
+	// Return bags whose ingest node has this namespace.
+	IngestNode      string
+
+	// Return bags stored at the node with this namespace.
+	ReplicatingNode string
+
+	// Return bags of this type: "D" (Data), "R" (Rights)
+	// or "I" (Interpretive).
+	BagType         string
+
+	// Return bags with this local id. For bags APTrust ingested,
+	// that's the APTrust object identifier.
+	LocalId         string
+
+	// The number of bags per page of results.
+	PageSize        int
+
+	// The page of results to return, starting at 1.
+	Page            int
+}
+
+// ToQueryParams returns the query params the DPN REST service
+// expects for this filter.
+func (filter *DPNBagFilter) ToQueryParams() (url.Values) {
+	params := url.Values{}
+	if !filter.AfterDate.IsZero() {
+		params.Set("after", filter.AfterDate.UTC().Format(time.RFC3339Nano))
+	}
+	if !filter.BeforeDate.IsZero() {
+		params.Set("before", filter.BeforeDate.UTC().Format(time.RFC3339Nano))
+	}
+	if filter.AdminNode != "" {
+		params.Set("admin_node", filter.AdminNode)
+	}
+	if filter.IngestNode != "" {
+		params.Set("ingest_node", filter.IngestNode)
+	}
+	if filter.ReplicatingNode != "" {
+		params.Set("replicating_node", filter.ReplicatingNode)
+	}
+	if filter.BagType != "" {
+		params.Set("bag_type", filter.BagType)
+	}
+	if filter.LocalId != "" {
+		params.Set("local_id", filter.LocalId)
+	}
+	if filter.PageSize > 0 {
+		params.Set("page_size", fmt.Sprintf("%d", filter.PageSize))
+	}
+	if filter.Page > 0 {
+		params.Set("page", fmt.Sprintf("%d", filter.Page))
+	}
+	return params
+}
+
 // ReplicationListResult is what the REST service returns when
 // we ask for a list of transfer requests.
 type ReplicationListResult struct {
@@ -81,6 +192,10 @@ func NewDPNRestClient(hostUrl, apiVersion, apiKey, node string, dpnConfig *DPNCo
 	if err != nil {
 		return nil, fmt.Errorf("Can't create cookie jar for DPN REST client: %v", err)
 	}
+	tlsConfig, err := newTLSConfig(dpnConfig)
+	if err != nil {
+		return nil, err
+	}
 	transport := &http.Transport{
 		MaxIdleConnsPerHost: 8,
 		DisableKeepAlives:   false,
@@ -90,9 +205,7 @@ func NewDPNRestClient(hostUrl, apiVersion, apiKey, node string, dpnConfig *DPNCo
 		}).Dial,
 		ResponseHeaderTimeout: 10 * time.Second,
 		TLSHandshakeTimeout: 10 * time.Second,
-	}
-	if dpnConfig.AcceptInvalidSSLCerts {
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		TLSClientConfig: tlsConfig,
 	}
 	httpClient := &http.Client{
 		Jar: cookieJar,
@@ -103,6 +216,14 @@ func NewDPNRestClient(hostUrl, apiVersion, apiKey, node string, dpnConfig *DPNCo
 	for strings.HasSuffix(hostUrl, "/") {
 		hostUrl = hostUrl[:len(hostUrl)-1]
 	}
+	maxAttempts := dpnConfig.MaxRequestAttempts
+	if maxAttempts < 1 {
+		maxAttempts = DEFAULT_MAX_REQUEST_ATTEMPTS
+	}
+	retryBackoff, err := dpnConfig.RetryBackoffDuration()
+	if err != nil {
+		return nil, err
+	}
 	client := &DPNRestClient{
 		HostUrl: hostUrl,
 		APIVersion: apiVersion,
@@ -112,10 +233,73 @@ func NewDPNRestClient(hostUrl, apiVersion, apiKey, node string, dpnConfig *DPNCo
 		httpClient: httpClient,
 		transport: transport,
 		logger: logger,
+		maxAttempts: maxAttempts,
+		retryBackoff: retryBackoff,
+		remoteClientCache: make(map[string]*DPNRestClient),
 	}
 	return client, nil
 }
 
+// Builds the TLS config for the client's transport from the TLS
+// settings in dpnConfig.
+func newTLSConfig(dpnConfig *DPNConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: DEFAULT_TLS_MIN_VERSION,
+		InsecureSkipVerify: dpnConfig.AcceptInvalidSSLCerts,
+	}
+	if dpnConfig.TLSMinVersion != "" {
+		minVersion, ok := tlsVersions[dpnConfig.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid TLSMinVersion '%s' in DPN config. "+
+				"Use 1.0, 1.1, 1.2 or 1.3.", dpnConfig.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = minVersion
+	}
+	if dpnConfig.TLSCACertFile != "" {
+		certFile := dpnConfig.TLSCACertFile
+		if !filepath.IsAbs(certFile) {
+			absPath, err := bagman.RelativeToAbsPath(certFile)
+			if err != nil {
+				return nil, err
+			}
+			certFile = absPath
+		}
+		pemData, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read TLS CA cert file: %v", err)
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("TLS CA cert file %s contains no PEM certificates",
+				certFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	return tlsConfig, nil
+}
+
+// TLSConfig returns the TLS settings the client uses to connect
+// to the DPN REST service.
+func (client *DPNRestClient) TLSConfig() (*tls.Config) {
+	return client.transport.TLSClientConfig
+}
+
+// SetRetry sets the maximum number of times the client tries a
+// request that fails with a connection error or a transient
+// server error,
+// and the backoff before the first retry. Tests use this to avoid
+// waiting. A maxAttempts of 1 disables retries.
+func (client *DPNRestClient) SetRetry(maxAttempts int, backoff time.Duration) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	client.maxAttempts = maxAttempts
+	client.retryBackoff = backoff
+}
+
 
 // BuildUrl combines the host and protocol in client.HostUrl with
 // relativeUrl to create an absolute URL. For example, if client.HostUrl
@@ -178,8 +362,9 @@ func (client *DPNRestClient) DPNMemberGet(identifier string) (*DPNMember, error)
 	return obj, nil
 }
 
-// Returns the DPN Member with the specified name, or an error
-// if there is not exactly one DPN member with that name.
+// Returns the DPN Member with the specified name, or nil if there
+// is no member with that name. If more than one member has the name,
+// this logs a warning and returns the first.
 func (client *DPNRestClient) DPNMemberGetByName(name string) (*DPNMember, error) {
 	params := url.Values{}
 	params.Set("name", name)
@@ -187,11 +372,12 @@ func (client *DPNRestClient) DPNMemberGetByName(name string) (*DPNMember, error)
 	if err != nil {
 		return nil, err
 	}
-	if list.Count == 0 {
-		return nil, fmt.Errorf("Cannot find member with name '%s'", name)
+	if len(list.Results) == 0 {
+		return nil, nil
 	}
-	if list.Count > 1 {
-		return nil, fmt.Errorf("Found %d members with name '%s'", list.Count, name)
+	if len(list.Results) > 1 {
+		client.logger.Warning("Found %d members with name '%s'. Returning member %s.",
+			len(list.Results), name, list.Results[0].UUID)
 	}
 	return list.Results[0], nil
 }
@@ -397,6 +583,34 @@ func (client *DPNRestClient) DPNNodeGetLastPullDate(identifier string) (time.Tim
 	return bags.Results[0].UpdatedAt, err
 }
 
+// HealthCheck asks the DPN REST server for its status, so monitoring
+// tools and our own services can tell whether a node is up without
+// querying bags.
+func (client *DPNRestClient) HealthCheck() (*DPNHealthStatus, error) {
+	relativeUrl := fmt.Sprintf("/%s/status/", client.APIVersion)
+	objUrl := client.BuildUrl(relativeUrl, nil)
+	client.logger.Debug("Requesting status from DPN REST service: %s", objUrl)
+	request, err := client.NewJsonRequest("GET", objUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, response, err := client.doRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != 200 {
+		error := fmt.Errorf("HealthCheck expected status 200 but got %d. URL: %s", response.StatusCode, objUrl)
+		client.buildAndLogError(body, error.Error())
+		return nil, error
+	}
+	status := &DPNHealthStatus{}
+	err = json.Unmarshal(body, status)
+	if err != nil {
+		return nil, client.formatJsonError(objUrl, body, err)
+	}
+	return status, nil
+}
+
 func (client *DPNRestClient) DPNBagGet(identifier string) (*DPNBag, error) {
 	relativeUrl := fmt.Sprintf("/%s/bag/%s/", client.APIVersion, identifier)
 	objUrl := client.BuildUrl(relativeUrl, nil)
@@ -456,6 +670,16 @@ func (client *DPNRestClient) DPNBagListGet(queryParams *url.Values) (*BagListRes
 }
 
 
+// DPNBagListGetFiltered returns the bags that match filter.
+// This is a typed alternative to DPNBagListGet.
+func (client *DPNRestClient) DPNBagListGetFiltered(filter *DPNBagFilter) (*BagListResult, error) {
+	if filter == nil {
+		filter = &DPNBagFilter{}
+	}
+	params := filter.ToQueryParams()
+	return client.DPNBagListGet(&params)
+}
+
 func (client *DPNRestClient) DPNBagCreate(bag *DPNBag) (*DPNBag, error) {
 	return client.dpnBagSave(bag, "POST")
 }
@@ -505,6 +729,174 @@ func (client *DPNRestClient) dpnBagSave(bag *DPNBag, method string) (*DPNBag, er
 	return &returnedBag, nil
 }
 
+// MessageDigestGet returns the digest of the specified bag for the
+// specified algorithm, or nil if the REST service has no such digest.
+func (client *DPNRestClient) MessageDigestGet(bagUUID, algorithm string) (*DPNMessageDigest, error) {
+	relativeUrl := fmt.Sprintf("/%s/bag/%s/digest/%s/", client.APIVersion, bagUUID, algorithm)
+	objUrl := client.BuildUrl(relativeUrl, nil)
+	client.logger.Debug("Requesting message digest from DPN REST service: %s", objUrl)
+	request, err := client.NewJsonRequest("GET", objUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, response, err := client.doRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == 404 {
+		return nil, nil
+	}
+	if response.StatusCode != 200 {
+		error := fmt.Errorf("MessageDigestGet expected status 200 but got %d. URL: %s",
+			response.StatusCode, objUrl)
+		client.buildAndLogError(body, error.Error())
+		return nil, error
+	}
+	digest := &DPNMessageDigest{}
+	err = json.Unmarshal(body, digest)
+	if err != nil {
+		return nil, client.formatJsonError(objUrl, body, err)
+	}
+	return digest, nil
+}
+
+// MessageDigestCreate saves a new digest for a bag. The REST service
+// will save a duplicate if the bag already has a digest from the same
+// node with the same algorithm, so use CreateDigestIfMissing unless
+// you know it doesn't.
+func (client *DPNRestClient) MessageDigestCreate(md *DPNMessageDigest) (*DPNMessageDigest, error) {
+	relativeUrl := fmt.Sprintf("/%s/bag/%s/digest/", client.APIVersion, md.Bag)
+	objUrl := client.BuildUrl(relativeUrl, nil)
+	client.logger.Debug("POSTing message digest to DPN REST service: %s", objUrl)
+	postData, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.NewJsonRequest("POST", objUrl, bytes.NewBuffer(postData))
+	if err != nil {
+		return nil, err
+	}
+	body, response, err := client.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != 201 {
+		error := fmt.Errorf("POST to %s returned status code %d. Post data: %v",
+			objUrl, response.StatusCode, string(postData))
+		client.buildAndLogError(body, error.Error())
+		return nil, error
+	}
+	returnedDigest := &DPNMessageDigest{}
+	err = json.Unmarshal(body, returnedDigest)
+	if err != nil {
+		error := fmt.Errorf("Could not parse JSON response from  %s", objUrl)
+		client.buildAndLogError(body, error.Error())
+		return nil, error
+	}
+	return returnedDigest, nil
+}
+
+// CreateDigestIfMissing saves md, unless the bag already has a digest
+// with the same algorithm. If it does, and the values match, this
+// returns the existing digest. If the values differ, it returns
+// ErrDigestMismatch.
+func (client *DPNRestClient) CreateDigestIfMissing(md *DPNMessageDigest) (*DPNMessageDigest, error) {
+	existing, err := client.MessageDigestGet(md.Bag, md.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil || existing.Value == "" {
+		return client.MessageDigestCreate(md)
+	}
+	if existing.Value != md.Value {
+		client.logger.Error("Bag %s already has %s digest %s from %s; ours is %s",
+			md.Bag, md.Algorithm, existing.Value, existing.Node, md.Value)
+		return nil, ErrDigestMismatch
+	}
+	return existing, nil
+}
+
+// FixityCheckListGet returns the fixity checks recorded for the
+// specified bag, filtered by queryParams, which may be nil.
+func (client *DPNRestClient) FixityCheckListGet(bagUUID string, queryParams *url.Values) (*FixityCheckListResult, error) {
+	relativeUrl := fmt.Sprintf("/%s/bag/%s/fixity_check/", client.APIVersion, bagUUID)
+	objUrl := client.BuildUrl(relativeUrl, queryParams)
+	client.logger.Debug("Requesting fixity check list from DPN REST service: %s", objUrl)
+	request, err := client.NewJsonRequest("GET", objUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, response, err := client.doRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != 200 {
+		error := fmt.Errorf("FixityCheckListGet expected status 200 but got %d. URL: %s",
+			response.StatusCode, objUrl)
+		client.buildAndLogError(body, error.Error())
+		return nil, error
+	}
+	result := &FixityCheckListResult{}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return nil, client.formatJsonError(objUrl, body, err)
+	}
+	return result, nil
+}
+
+// LatestFixityCheck returns the most recent fixity check that node
+// recorded for the specified bag, or nil if it has never checked
+// the bag.
+func (client *DPNRestClient) LatestFixityCheck(bagUUID, node string) (*DPNFixityCheck, error) {
+	params := url.Values{}
+	params.Set("node", node)
+	params.Set("latest", "true")
+	result, err := client.FixityCheckListGet(bagUUID, &params)
+	if err != nil {
+		return nil, err
+	}
+	var latest *DPNFixityCheck
+	for _, check := range result.Results {
+		if check.Node == node && (latest == nil || check.FixityAt.After(latest.FixityAt)) {
+			latest = check
+		}
+	}
+	return latest, nil
+}
+
+// FixityCheckCreate records the outcome of a fixity check.
+func (client *DPNRestClient) FixityCheckCreate(check *DPNFixityCheck) (*DPNFixityCheck, error) {
+	relativeUrl := fmt.Sprintf("/%s/bag/%s/fixity_check/", client.APIVersion, check.Bag)
+	objUrl := client.BuildUrl(relativeUrl, nil)
+	client.logger.Debug("POSTing fixity check to DPN REST service: %s", objUrl)
+	postData, err := json.Marshal(check)
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.NewJsonRequest("POST", objUrl, bytes.NewBuffer(postData))
+	if err != nil {
+		return nil, err
+	}
+	body, response, err := client.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != 201 {
+		error := fmt.Errorf("POST to %s returned status code %d. Post data: %v",
+			objUrl, response.StatusCode, string(postData))
+		client.buildAndLogError(body, error.Error())
+		return nil, error
+	}
+	returnedCheck := &DPNFixityCheck{}
+	err = json.Unmarshal(body, returnedCheck)
+	if err != nil {
+		error := fmt.Errorf("Could not parse JSON response from  %s", objUrl)
+		client.buildAndLogError(body, error.Error())
+		return nil, error
+	}
+	return returnedCheck, nil
+}
+
 func (client *DPNRestClient) ReplicationTransferGet(identifier string) (*DPNReplicationTransfer, error) {
 	// /api-v1/replicate/aptrust-999999/
 	relativeUrl := fmt.Sprintf("/%s/replicate/%s/", client.APIVersion, identifier)
@@ -565,6 +957,91 @@ func (client *DPNRestClient) DPNReplicationListGet(queryParams *url.Values) (*Re
 	return result, nil
 }
 
+// ActiveReplicationTransfers returns all of the replication transfers
+// to toNode that are still in progress, from every page of results.
+// It asks the server to leave out cancelled and stored transfers, and
+// since not every node's server supports those filters, it also
+// leaves out transfers whose status says they're finished: cancelled,
+// rejected, stored or confirmed.
+func (client *DPNRestClient) ActiveReplicationTransfers(toNode string) ([]*DPNReplicationTransfer, error) {
+	active := make([]*DPNReplicationTransfer, 0)
+	for pageNumber := 1; ; pageNumber++ {
+		params := url.Values{}
+		params.Set("to_node", toNode)
+		params.Set("cancelled", "false")
+		params.Set("stored", "false")
+		params.Set("page", fmt.Sprintf("%d", pageNumber))
+		result, err := client.DPNReplicationListGet(&params)
+		if err != nil {
+			return nil, err
+		}
+		for _, xfer := range result.Results {
+			switch xfer.Status {
+			case "cancelled", "rejected", "stored", "confirmed":
+				continue
+			}
+			active = append(active, xfer)
+		}
+		if result.Next == nil || *result.Next == "" {
+			break
+		}
+	}
+	return active, nil
+}
+
+// ReplicationTransfersForBag returns all of the replication transfers
+// for the bag with the specified UUID, from every page of results.
+func (client *DPNRestClient) ReplicationTransfersForBag(bagUUID string) ([]*DPNReplicationTransfer, error) {
+	xfers := make([]*DPNReplicationTransfer, 0)
+	for pageNumber := 1; ; pageNumber++ {
+		params := url.Values{}
+		params.Set("uuid", bagUUID)
+		params.Set("page", fmt.Sprintf("%d", pageNumber))
+		result, err := client.DPNReplicationListGet(&params)
+		if err != nil {
+			return nil, err
+		}
+		xfers = append(xfers, result.Results...)
+		if result.Next == nil || *result.Next == "" {
+			break
+		}
+	}
+	return xfers, nil
+}
+
+// GetBagAndTransfers fetches the bag with the specified UUID and all
+// of its replication transfers at the same time. If either fetch
+// fails, it still returns whatever the other fetch got, and the error
+// says which fetch failed.
+func (client *DPNRestClient) GetBagAndTransfers(bagUUID string) (*DPNBag, []*DPNReplicationTransfer, error) {
+	var bag *DPNBag
+	var xfers []*DPNReplicationTransfer
+	var bagErr, xferErr error
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		bag, bagErr = client.DPNBagGet(bagUUID)
+	}()
+	go func() {
+		defer waitGroup.Done()
+		xfers, xferErr = client.ReplicationTransfersForBag(bagUUID)
+	}()
+	waitGroup.Wait()
+
+	messages := make([]string, 0)
+	if bagErr != nil {
+		messages = append(messages, fmt.Sprintf("Error getting bag %s: %v", bagUUID, bagErr))
+	}
+	if xferErr != nil {
+		messages = append(messages, fmt.Sprintf(
+			"Error getting replication transfers for bag %s: %v", bagUUID, xferErr))
+	}
+	if len(messages) > 0 {
+		return bag, xfers, errors.New(strings.Join(messages, "; "))
+	}
+	return bag, xfers, nil
+}
 
 func (client *DPNRestClient) ReplicationTransferCreate(xfer *DPNReplicationTransfer) (*DPNReplicationTransfer, error) {
 	return client.replicationTransferSave(xfer, "POST")
@@ -677,6 +1154,34 @@ func (client *DPNRestClient) DPNRestoreListGet(queryParams *url.Values) (*Restor
 	return result, nil
 }
 
+// RestoreTransferListActive returns all of the restore transfers
+// to toNode that are still in the "requested" state, from every page
+// of results. It asks the server for status=requested, and since not
+// every node's server supports that filter, it also leaves out
+// transfers with any other status.
+func (client *DPNRestClient) RestoreTransferListActive(toNode string) ([]*DPNRestoreTransfer, error) {
+	active := make([]*DPNRestoreTransfer, 0)
+	for pageNumber := 1; ; pageNumber++ {
+		params := url.Values{}
+		params.Set("to_node", toNode)
+		params.Set("status", "requested")
+		params.Set("page", fmt.Sprintf("%d", pageNumber))
+		result, err := client.DPNRestoreListGet(&params)
+		if err != nil {
+			return nil, err
+		}
+		for _, xfer := range result.Results {
+			if xfer.Status == "requested" {
+				active = append(active, xfer)
+			}
+		}
+		if result.Next == nil || *result.Next == "" {
+			break
+		}
+	}
+	return active, nil
+}
+
 func (client *DPNRestClient) RestoreTransferCreate(xfer *DPNRestoreTransfer) (*DPNRestoreTransfer, error) {
 	return client.restoreTransferSave(xfer, "POST")
 }
@@ -730,12 +1235,47 @@ func (client *DPNRestClient) restoreTransferSave(xfer *DPNRestoreTransfer, metho
 
 // Returns a DPN REST client that can talk to a remote node.
 // This function has to connect to out local DPN node to get
-// information about the remote node. It returns a new client
+// information about the remote node. It returns a client
 // that can connect to the remote node with the correct URL
 // and API key. We use this function to get a client that can
 // update a replication request or a restore request on the
 // originating node.
+//
+// The client for each node is cached, so repeated calls for the
+// same namespace return the same client and reuse its connections.
+// Call InvalidateRemoteClient if the node's URL or token changes.
 func (client *DPNRestClient) GetRemoteClient(remoteNodeNamespace string, dpnConfig *DPNConfig, logger *logging.Logger) (*DPNRestClient, error) {
+	client.remoteClientMutex.RLock()
+	remoteClient := client.remoteClientCache[remoteNodeNamespace]
+	client.remoteClientMutex.RUnlock()
+	if remoteClient != nil {
+		return remoteClient, nil
+	}
+	remoteClient, err := client.newRemoteClient(remoteNodeNamespace, dpnConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	client.remoteClientMutex.Lock()
+	defer client.remoteClientMutex.Unlock()
+	// Another goroutine may have cached a client while we were
+	// building this one. Keep theirs, so everyone shares one client.
+	if cachedClient := client.remoteClientCache[remoteNodeNamespace]; cachedClient != nil {
+		return cachedClient, nil
+	}
+	client.remoteClientCache[remoteNodeNamespace] = remoteClient
+	return remoteClient, nil
+}
+
+// InvalidateRemoteClient removes the cached client for the specified
+// node, so the next call to GetRemoteClient builds a new one.
+func (client *DPNRestClient) InvalidateRemoteClient(remoteNodeNamespace string) {
+	client.remoteClientMutex.Lock()
+	defer client.remoteClientMutex.Unlock()
+	delete(client.remoteClientCache, remoteNodeNamespace)
+}
+
+// Builds a new client for the remote node. See GetRemoteClient.
+func (client *DPNRestClient) newRemoteClient(remoteNodeNamespace string, dpnConfig *DPNConfig, logger *logging.Logger) (*DPNRestClient, error) {
 	remoteNode, err := client.DPNNodeGet(remoteNodeNamespace)
 	if err != nil {
 		detailedError := fmt.Errorf("Error retrieving node record for '%s' "+
@@ -784,22 +1324,104 @@ func readResponse(body io.ReadCloser) (data []byte, err error) {
 	return data, err
 }
 
+// Sends the request and reads the response. If the request fails
+// with a connection error or a 500, 502, 503 or 504 response, this
+// waits and tries again, up to client.maxAttempts times in all.
+// Slow nodes return these under load. Other responses are not
+// retried, since sending the same request again won't help.
+// After the last attempt, this returns whatever the server sent,
+// so callers can report the status code as usual.
 func (client *DPNRestClient) doRequest(request *http.Request) (data []byte, response *http.Response, err error) {
-	response, err = client.httpClient.Do(request)
-	if err != nil {
+	for attempt := 1; ; attempt++ {
+		response, err = client.httpClient.Do(request)
+		if err == nil {
+			data, err = readResponse(response.Body)
+		}
+		if attempt >= client.maxAttempts || !shouldRetry(response, err) {
+			break
+		}
+		delay := client.retryDelay(attempt)
+		if err != nil {
+			client.logger.Warning("%s %s failed (attempt %d of %d): %v. Retrying in %s.",
+				request.Method, request.URL, attempt, client.maxAttempts, err, delay)
+		} else {
+			client.logger.Warning(strings.Replace(fmt.Sprintf(
+				"%s %s returned status %d (attempt %d of %d). Retrying in %s.%s",
+				request.Method, request.URL, response.StatusCode, attempt,
+				client.maxAttempts, delay, bodyForLog(data)), "%", "%%", -1))
+		}
+		time.Sleep(delay)
+		if request.Body != nil {
+			if request.GetBody == nil {
+				break
+			}
+			request.Body, err = request.GetBody()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err != nil && response == nil {
 		return nil, nil, err
 	}
-	data, err = readResponse(response.Body)
+	return data, response, err
+}
+
+// Returns true if a request that produced this response and error
+// might succeed if we send it again.
+func shouldRetry(response *http.Response, err error) (bool) {
 	if err != nil {
-		return nil, response, err
+		return isConnectionError(err)
 	}
-	return data, response, err
+	switch response.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
 }
 
-func (client *DPNRestClient) buildAndLogError(body []byte, errStr string) (err error) {
+// Returns true if err means we couldn't talk to the server, or the
+// server dropped the connection, as opposed to, say, a redirect loop.
+func isConnectionError(err error) (bool) {
+	if urlError, ok := err.(*url.Error); ok {
+		err = urlError.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNetError := err.(net.Error)
+	return isNetError
+}
+
+// Returns the delay before retrying after the specified attempt:
+// retryBackoff doubled for each earlier attempt, capped at
+// MAX_RETRY_BACKOFF, plus up to 50% random jitter.
+func (client *DPNRestClient) retryDelay(attempt int) (time.Duration) {
+	delay := client.retryBackoff
+	for i := 1; i < attempt && delay < MAX_RETRY_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_BACKOFF {
+		delay = MAX_RETRY_BACKOFF
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Returns the response body formatted for a log message, or
+// an empty string if the body is too long to log.
+func bodyForLog(body []byte) (string) {
 	if len(body) < MAX_ERR_MSG_SIZE {
-		errStr += fmt.Sprintf(" Response body: %s", string(body))
+		return fmt.Sprintf(" Response body: %s", string(body))
 	}
+	return ""
+}
+
+func (client *DPNRestClient) buildAndLogError(body []byte, errStr string) (err error) {
+	errStr += bodyForLog(body)
 	err = errors.New(errStr)
 	client.logger.Error(strings.Replace(err.Error(), "%", "%%", -1))
 	return err
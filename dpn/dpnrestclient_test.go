@@ -1,15 +1,22 @@
 package dpn_test
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/APTrust/bagman/dpn"
 	"github.com/satori/go.uuid"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unicode/utf8"
@@ -1153,3 +1160,752 @@ func testHackNullDates(jsonString string, t *testing.T) {
 		t.Errorf("Got unexpected last_pull_date %s", data["last_pull_date"])
 	}
 }
+
+// Returns a client for a mock DPN server whose handler fails the
+// first failures requests with failStatus, and then echoes the
+// request body back with status 201. The returned counter tells
+// how many requests the server received.
+func getFlakyClient(t *testing.T, failures int32, failStatus int) (*dpn.DPNRestClient, *httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&requests, 1) <= failures {
+			w.WriteHeader(failStatus)
+			w.Write([]byte(`{"detail": "Try again later"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	}))
+	config := &dpn.DPNConfig{MaxRequestAttempts: 4}
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", config, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		server.Close()
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	client.SetRetry(4, time.Millisecond)
+	return client, server, &requests
+}
+
+func TestRetryAfterServerError(t *testing.T) {
+	client, server, requests := getFlakyClient(t, 2, http.StatusServiceUnavailable)
+	defer server.Close()
+	member := &dpn.DPNMember{
+		UUID:  memberIdentifier,
+		Name:  "Retry Test Member",
+		Email: "retry@example.edu",
+	}
+	savedMember, err := client.DPNMemberCreate(member)
+	if err != nil {
+		t.Fatalf("DPNMemberCreate returned error %v", err)
+	}
+	// The request body has to be sent again on each retry.
+	if savedMember.Name != member.Name {
+		t.Errorf("Name is '%s', expected '%s'", savedMember.Name, member.Name)
+	}
+	if atomic.LoadInt32(requests) != 3 {
+		t.Errorf("Server got %d requests, expected 3", *requests)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	client, server, requests := getFlakyClient(t, 100, http.StatusInternalServerError)
+	defer server.Close()
+	_, err := client.DPNMemberCreate(&dpn.DPNMember{UUID: memberIdentifier})
+	if err == nil || !strings.Contains(err.Error(), "status code 500") {
+		t.Errorf("DPNMemberCreate should have reported status 500, got %v", err)
+	}
+	if atomic.LoadInt32(requests) != 4 {
+		t.Errorf("Server got %d requests, expected 4", *requests)
+	}
+}
+
+func TestNoRetryAfterClientError(t *testing.T) {
+	client, server, requests := getFlakyClient(t, 1, http.StatusBadRequest)
+	defer server.Close()
+	_, err := client.DPNMemberCreate(&dpn.DPNMember{UUID: memberIdentifier})
+	if err == nil || !strings.Contains(err.Error(), "status code 400") {
+		t.Errorf("DPNMemberCreate should have reported status 400, got %v", err)
+	}
+	if atomic.LoadInt32(requests) != 1 {
+		t.Errorf("Server got %d requests, expected 1", *requests)
+	}
+}
+
+func TestRetryAfterConnectionError(t *testing.T) {
+	client, server, _ := getFlakyClient(t, 0, http.StatusOK)
+	server.Close()
+	start := time.Now()
+	client.SetRetry(3, 20*time.Millisecond)
+	_, err := client.DPNMemberCreate(&dpn.DPNMember{UUID: memberIdentifier})
+	if err == nil {
+		t.Errorf("DPNMemberCreate should have failed with the server down")
+	}
+	// Two retries, waiting at least 20ms and 40ms.
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Client gave up after %s; it should have retried with backoff", elapsed)
+	}
+}
+
+func TestReplicationTransferGetRetriesSlowNode(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/api-v1/replicate/"+replicationIdentifier+"/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"from_node": "aptrust", "to_node": "hathi",
+			"uuid": "` + aptrustBagIdentifier + `",
+			"replication_id": "` + replicationIdentifier + `",
+			"fixity_algorithm": "sha256", "protocol": "rsync",
+			"status": "requested",
+			"link": "dpn.hathi@devops.aptrust.org:outbound/` + aptrustBagIdentifier + `.tar",
+			"created_at": "2015-09-15T19:38:31Z",
+			"updated_at": "2015-09-15T19:38:31Z"}`))
+	}))
+	defer server.Close()
+	config := &dpn.DPNConfig{MaxRequestAttempts: 3, RetryBackoff: "2ms"}
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", config, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	xfer, err := client.ReplicationTransferGet(replicationIdentifier)
+	if err != nil {
+		t.Fatalf("ReplicationTransferGet returned error %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("Server got %d requests, expected 3", requests)
+	}
+	if xfer.FromNode != "aptrust" || xfer.ToNode != "hathi" {
+		t.Errorf("Expected transfer from aptrust to hathi, got %s to %s",
+			xfer.FromNode, xfer.ToNode)
+	}
+	if xfer.BagId != aptrustBagIdentifier {
+		t.Errorf("BagId: expected '%s', got '%s'", aptrustBagIdentifier, xfer.BagId)
+	}
+	if xfer.ReplicationId != replicationIdentifier {
+		t.Errorf("ReplicationId: expected '%s', got '%s'",
+			replicationIdentifier, xfer.ReplicationId)
+	}
+	if xfer.Status != "requested" || xfer.Protocol != "rsync" {
+		t.Errorf("Got status '%s' and protocol '%s'", xfer.Status, xfer.Protocol)
+	}
+	if xfer.CreatedAt.Format(time.RFC3339) != "2015-09-15T19:38:31Z" {
+		t.Errorf("CreatedAt: expected '2015-09-15T19:38:31Z', got '%s'",
+			xfer.CreatedAt.Format(time.RFC3339))
+	}
+}
+
+func TestNoRetryAfterNotImplemented(t *testing.T) {
+	client, server, requests := getFlakyClient(t, 1, http.StatusNotImplemented)
+	defer server.Close()
+	_, err := client.DPNMemberCreate(&dpn.DPNMember{UUID: memberIdentifier})
+	if err == nil || !strings.Contains(err.Error(), "status code 501") {
+		t.Errorf("DPNMemberCreate should have reported status 501, got %v", err)
+	}
+	if atomic.LoadInt32(requests) != 1 {
+		t.Errorf("Server got %d requests, expected 1", *requests)
+	}
+}
+
+func TestRetryBackoffDuration(t *testing.T) {
+	config := &dpn.DPNConfig{}
+	backoff, err := config.RetryBackoffDuration()
+	if err != nil || backoff != dpn.DEFAULT_RETRY_BACKOFF {
+		t.Errorf("Empty RetryBackoff should default to %s, got %s, %v",
+			dpn.DEFAULT_RETRY_BACKOFF, backoff, err)
+	}
+	config.RetryBackoff = "500ms"
+	backoff, err = config.RetryBackoffDuration()
+	if err != nil || backoff != 500*time.Millisecond {
+		t.Errorf("Expected 500ms, got %s, %v", backoff, err)
+	}
+	config.RetryBackoff = "soon"
+	if _, err = config.RetryBackoffDuration(); err == nil {
+		t.Errorf("RetryBackoffDuration should reject 'soon'")
+	}
+	_, err = dpn.NewDPNRestClient("http://localhost", "api-v1", "token",
+		"aptrust", config, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err == nil {
+		t.Errorf("NewDPNRestClient should reject an invalid RetryBackoff")
+	}
+}
+
+func TestGetRemoteClientIsCached(t *testing.T) {
+	var nodeRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// DPNNodeGet asks for the bag list to get the last pull date.
+		if r.URL.Path == "/api-v1/bag/" {
+			w.Write([]byte(`{"count": 0, "results": []}`))
+			return
+		}
+		atomic.AddInt32(&nodeRequests, 1)
+		if r.URL.Path != "/api-v1/node/chron/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"namespace": "chron", "api_root": "https://chron.example.edu"}`))
+	}))
+	defer server.Close()
+	config := &dpn.DPNConfig{
+		RestClient:       &dpn.RestClientConfig{LocalAPIRoot: "api-v1"},
+		RemoteNodeTokens: map[string]string{"chron": "chron_token"},
+	}
+	logger := bagman.DiscardLogger("dpn_rest_client_test")
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token", "aptrust", config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := client.GetRemoteClient("chron", config, logger)
+	if err != nil {
+		t.Fatalf("GetRemoteClient returned error %v", err)
+	}
+	if first.HostUrl != "https://chron.example.edu" {
+		t.Errorf("Remote client HostUrl is %s", first.HostUrl)
+	}
+	second, err := client.GetRemoteClient("chron", config, logger)
+	if err != nil {
+		t.Fatalf("GetRemoteClient returned error %v", err)
+	}
+	if first != second {
+		t.Errorf("GetRemoteClient should return the same client for the same node")
+	}
+	if atomic.LoadInt32(&nodeRequests) != 1 {
+		t.Errorf("Expected 1 node lookup, got %d", nodeRequests)
+	}
+
+	client.InvalidateRemoteClient("chron")
+	third, err := client.GetRemoteClient("chron", config, logger)
+	if err != nil {
+		t.Fatalf("GetRemoteClient returned error %v", err)
+	}
+	if third == first {
+		t.Errorf("GetRemoteClient returned the cached client after invalidation")
+	}
+	if atomic.LoadInt32(&nodeRequests) != 2 {
+		t.Errorf("Expected 2 node lookups, got %d", nodeRequests)
+	}
+
+	// Failed lookups should not be cached.
+	if _, err = client.GetRemoteClient("hathi", config, logger); err == nil {
+		t.Errorf("GetRemoteClient should have failed for unknown node")
+	}
+	if _, err = client.GetRemoteClient("hathi", config, logger); err == nil {
+		t.Errorf("GetRemoteClient should have failed for unknown node")
+	}
+	if atomic.LoadInt32(&nodeRequests) != 4 {
+		t.Errorf("Expected 4 node lookups, got %d", nodeRequests)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uuid": "` + memberIdentifier + `", "name": "TLS Member"}`))
+	}))
+	defer server.Close()
+	logger := bagman.DiscardLogger("dpn_rest_client_test")
+
+	// Default: TLS 1.2 minimum, system roots only, so the test
+	// server's self-signed cert is rejected.
+	config := &dpn.DPNConfig{}
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token", "aptrust", config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetRetry(1, 0)
+	if client.TLSConfig().MinVersion != tls.VersionTLS12 {
+		t.Errorf("Default TLS MinVersion is %x, expected TLS 1.2", client.TLSConfig().MinVersion)
+	}
+	if client.TLSConfig().InsecureSkipVerify {
+		t.Errorf("Client should verify certificates by default")
+	}
+	if _, err = client.DPNMemberGet(memberIdentifier); err == nil {
+		t.Errorf("Client should have rejected the test server's certificate")
+	}
+
+	// With the test server's cert as a custom CA, the client
+	// should verify the server and connect.
+	certDir, err := ioutil.TempDir("", "dpn_tls_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+	caFile := filepath.Join(certDir, "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err = ioutil.WriteFile(caFile, pemData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config = &dpn.DPNConfig{TLSMinVersion: "1.3", TLSCACertFile: caFile}
+	client, err = dpn.NewDPNRestClient(server.URL, "api-v1", "token", "aptrust", config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := client.TLSConfig()
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("TLS MinVersion is %x, expected TLS 1.3", tlsConfig.MinVersion)
+	}
+	if tlsConfig.RootCAs == nil || tlsConfig.InsecureSkipVerify {
+		t.Errorf("Client should verify certificates against the custom CA pool")
+	}
+	member, err := client.DPNMemberGet(memberIdentifier)
+	if err != nil {
+		t.Fatalf("DPNMemberGet with custom CA returned error %v", err)
+	}
+	if member.Name != "TLS Member" {
+		t.Errorf("Member name is '%s'", member.Name)
+	}
+
+	// Bad settings should be reported.
+	badConfigs := []*dpn.DPNConfig{
+		&dpn.DPNConfig{TLSMinVersion: "1.4"},
+		&dpn.DPNConfig{TLSCACertFile: filepath.Join(certDir, "missing.pem")},
+		&dpn.DPNConfig{TLSCACertFile: caFile + ".empty"},
+	}
+	if err = ioutil.WriteFile(caFile + ".empty", []byte("not a cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, badConfig := range badConfigs {
+		_, err = dpn.NewDPNRestClient(server.URL, "api-v1", "token", "aptrust", badConfig, logger)
+		if err == nil {
+			t.Errorf("NewDPNRestClient should have rejected config %+v", badConfig)
+		}
+	}
+}
+
+func TestDPNBagFilterToQueryParams(t *testing.T) {
+	filter := &dpn.DPNBagFilter{}
+	if len(filter.ToQueryParams()) != 0 {
+		t.Errorf("Empty filter should produce no params, got %v", filter.ToQueryParams())
+	}
+	filter = &dpn.DPNBagFilter{
+		AfterDate:  time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC),
+		BeforeDate: time.Date(2015, 7, 1, 12, 0, 0, 500, time.UTC),
+		AdminNode:  "chron",
+		IngestNode: "aptrust",
+		BagType:    "D",
+		LocalId:    "test.edu/bag",
+		PageSize:   50,
+		Page:       3,
+	}
+	expected := "admin_node=chron&after=2015-06-01T12%3A00%3A00Z" +
+		"&bag_type=D&before=2015-07-01T12%3A00%3A00.0000005Z" +
+		"&ingest_node=aptrust&local_id=test.edu%2Fbag&page=3&page_size=50"
+	if filter.ToQueryParams().Encode() != expected {
+		t.Errorf("Filter params are '%s', expected '%s'",
+			filter.ToQueryParams().Encode(), expected)
+	}
+}
+
+func TestDPNBagListGetFiltered(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api-v1/bag/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.Query()
+		w.Write([]byte(`{"count": 1, "next": null, "previous": null,
+			"results": [{"uuid": "00000000-0000-4000-a000-000000000001",
+			"ingest_node": "aptrust", "admin_node": "aptrust"}]}`))
+	}))
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token", "aptrust",
+		&dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := client.DPNBagListGetFiltered(&dpn.DPNBagFilter{IngestNode: "aptrust"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(query) != 1 || query.Get("ingest_node") != "aptrust" {
+		t.Errorf("Server got query %v, expected only ingest_node=aptrust", query)
+	}
+	if result.Count != 1 || len(result.Results) != 1 || result.Results[0].IngestNode != "aptrust" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	// A nil filter gets all bags.
+	if _, err = client.DPNBagListGetFiltered(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(query) != 0 {
+		t.Errorf("Nil filter should send no params, server got %v", query)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	up := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api-v1/status/" || !up {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"server_version": "1.4.2", "node": "tdr", "active_replications": 17}`))
+	}))
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token", "tdr",
+		&dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := client.HealthCheck()
+	if err != nil {
+		t.Fatalf("HealthCheck returned error %v", err)
+	}
+	if status.ServerVersion != "1.4.2" {
+		t.Errorf("ServerVersion is '%s', expected '1.4.2'", status.ServerVersion)
+	}
+	if status.NodeNamespace != "tdr" {
+		t.Errorf("NodeNamespace is '%s', expected 'tdr'", status.NodeNamespace)
+	}
+	if status.ActiveReplicationCount != 17 {
+		t.Errorf("ActiveReplicationCount is %d, expected 17", status.ActiveReplicationCount)
+	}
+
+	up = false
+	if _, err = client.HealthCheck(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("HealthCheck should report status 404, got %v", err)
+	}
+}
+
+func memberListServer(members string) (*httptest.Server) {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api-v1/member/" || r.URL.Query().Get("name") != "Faber College" {
+			w.Write([]byte(`{"count": 0, "next": null, "previous": null, "results": []}`))
+			return
+		}
+		w.Write([]byte(`{"count": 1, "next": null, "previous": null, "results": [` + members + `]}`))
+	}))
+}
+
+func TestDPNMemberGetByName(t *testing.T) {
+	server := memberListServer(`{"uuid": "9a000000-0000-4000-a000-000000000001",
+		"name": "Faber College", "email": "omega@faber.edu"}`)
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", &dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	member, err := client.DPNMemberGetByName("Faber College")
+	if err != nil {
+		t.Fatalf("DPNMemberGetByName returned error %v", err)
+	}
+	if member == nil || member.UUID != "9a000000-0000-4000-a000-000000000001" {
+		t.Errorf("DPNMemberGetByName returned the wrong member: %v", member)
+	}
+	member, err = client.DPNMemberGetByName("Hudson University")
+	if err != nil {
+		t.Fatalf("DPNMemberGetByName returned error %v", err)
+	}
+	if member != nil {
+		t.Errorf("DPNMemberGetByName should return nil for an unknown name, got %v", member)
+	}
+}
+
+func TestDPNMemberGetByNameReturnsFirstOfDuplicates(t *testing.T) {
+	server := memberListServer(`{"uuid": "9a000000-0000-4000-a000-000000000001",
+		"name": "Faber College"}, {"uuid": "9a000000-0000-4000-a000-000000000002",
+		"name": "Faber College"}`)
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", &dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	member, err := client.DPNMemberGetByName("Faber College")
+	if err != nil {
+		t.Fatalf("DPNMemberGetByName returned error %v", err)
+	}
+	if member == nil || member.UUID != "9a000000-0000-4000-a000-000000000001" {
+		t.Errorf("DPNMemberGetByName should return the first member, got %v", member)
+	}
+}
+
+func TestActiveReplicationTransfers(t *testing.T) {
+	var query url.Values
+	pages := map[string]string{
+		"1": `{"count": 4, "next": "page2", "previous": null, "results": [
+			{"replication_id": "r1", "from_node": "chron", "to_node": "aptrust", "status": "requested"},
+			{"replication_id": "r2", "from_node": "chron", "to_node": "aptrust", "status": "cancelled"},
+			{"replication_id": "r3", "from_node": "hathi", "to_node": "aptrust", "status": "stored"}]}`,
+		"2": `{"count": 4, "next": null, "previous": "page1", "results": [
+			{"replication_id": "r4", "from_node": "sdr", "to_node": "aptrust", "status": "received"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(pages[query.Get("page")]))
+	}))
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", &dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	xfers, err := client.ActiveReplicationTransfers("aptrust")
+	if err != nil {
+		t.Fatalf("ActiveReplicationTransfers returned error %v", err)
+	}
+	if len(xfers) != 2 || xfers[0].ReplicationId != "r1" || xfers[1].ReplicationId != "r4" {
+		t.Errorf("Expected active transfers r1 and r4, got %v", xfers)
+	}
+	if query.Get("to_node") != "aptrust" || query.Get("cancelled") != "false" ||
+		query.Get("stored") != "false" {
+		t.Errorf("ActiveReplicationTransfers sent wrong params: %v", query)
+	}
+}
+
+func TestRestoreTransferListActive(t *testing.T) {
+	var query url.Values
+	pages := map[string]string{
+		"1": `{"count": 4, "next": "page2", "previous": null, "results": [
+			{"restore_id": "r1", "from_node": "chron", "to_node": "aptrust", "status": "requested"},
+			{"restore_id": "r2", "from_node": "chron", "to_node": "aptrust", "status": "finished"},
+			{"restore_id": "r3", "from_node": "hathi", "to_node": "aptrust", "status": "cancelled"}]}`,
+		"2": `{"count": 4, "next": null, "previous": "page1", "results": [
+			{"restore_id": "r4", "from_node": "sdr", "to_node": "aptrust", "status": "requested"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		if r.URL.Path != "/api-v1/restore/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(pages[query.Get("page")]))
+	}))
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", &dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	xfers, err := client.RestoreTransferListActive("aptrust")
+	if err != nil {
+		t.Fatalf("RestoreTransferListActive returned error %v", err)
+	}
+	if len(xfers) != 2 || xfers[0].RestoreId != "r1" || xfers[1].RestoreId != "r4" {
+		t.Errorf("Expected requested transfers r1 and r4, got %v", xfers)
+	}
+	if query.Get("to_node") != "aptrust" || query.Get("status") != "requested" {
+		t.Errorf("RestoreTransferListActive sent wrong params: %v", query)
+	}
+}
+
+// Returns a client for a mock DPN server that serves a bag and its
+// replication transfers. If failBag or failXfers is true, that
+// endpoint returns 404.
+func getBagAndTransfersClient(t *testing.T, failBag, failXfers bool) (*dpn.DPNRestClient, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api-v1/bag/"+aptrustBagIdentifier+"/" && !failBag {
+			w.Write([]byte(`{"uuid": "` + aptrustBagIdentifier + `", "size": 5000}`))
+		} else if r.URL.Path == "/api-v1/replicate/" && !failXfers &&
+			r.URL.Query().Get("uuid") == aptrustBagIdentifier {
+			w.Write([]byte(`{"count": 2, "next": null, "previous": null, "results": [
+				{"replication_id": "r1", "from_node": "aptrust", "to_node": "chron",
+				 "uuid": "` + aptrustBagIdentifier + `", "status": "stored"},
+				{"replication_id": "r2", "from_node": "aptrust", "to_node": "hathi",
+				 "uuid": "` + aptrustBagIdentifier + `", "status": "requested"}]}`))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail": "Not found"}`))
+		}
+	}))
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", &dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		server.Close()
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	return client, server
+}
+
+func TestGetBagAndTransfers(t *testing.T) {
+	client, server := getBagAndTransfersClient(t, false, false)
+	bag, xfers, err := client.GetBagAndTransfers(aptrustBagIdentifier)
+	server.Close()
+	if err != nil {
+		t.Fatalf("GetBagAndTransfers returned error %v", err)
+	}
+	if bag == nil || bag.UUID != aptrustBagIdentifier || bag.Size != 5000 {
+		t.Errorf("Expected bag %s, got %+v", aptrustBagIdentifier, bag)
+	}
+	if len(xfers) != 2 || xfers[0].ReplicationId != "r1" || xfers[1].ReplicationId != "r2" {
+		t.Errorf("Expected transfers r1 and r2, got %v", xfers)
+	}
+
+	// Bag fetch fails, but we still get the transfers.
+	client, server = getBagAndTransfersClient(t, true, false)
+	bag, xfers, err = client.GetBagAndTransfers(aptrustBagIdentifier)
+	server.Close()
+	if err == nil || !strings.Contains(err.Error(), "Error getting bag") ||
+		strings.Contains(err.Error(), "replication transfers") {
+		t.Errorf("Error should name only the bag fetch: %v", err)
+	}
+	if bag != nil || len(xfers) != 2 {
+		t.Errorf("Expected no bag and 2 transfers, got %v and %d", bag, len(xfers))
+	}
+
+	// Transfer fetch fails, but we still get the bag.
+	client, server = getBagAndTransfersClient(t, false, true)
+	bag, xfers, err = client.GetBagAndTransfers(aptrustBagIdentifier)
+	server.Close()
+	if err == nil || !strings.Contains(err.Error(), "replication transfers") ||
+		strings.Contains(err.Error(), "Error getting bag") {
+		t.Errorf("Error should name only the transfer fetch: %v", err)
+	}
+	if bag == nil || xfers != nil {
+		t.Errorf("Expected the bag and no transfers, got %v and %v", bag, xfers)
+	}
+}
+
+// Returns a client for a mock DPN server that has the existing digest
+// (or none, if existing is empty) for every bag, and echoes back the
+// digests posted to it. The returned counter tells how many digests
+// were posted.
+func getDigestClient(t *testing.T, existing string) (*dpn.DPNRestClient, *httptest.Server, *int32) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bagPath := "/api-v1/bag/" + aptrustBagIdentifier + "/digest/"
+		if r.Method == "POST" && r.URL.Path == bagPath {
+			atomic.AddInt32(&posts, 1)
+			data, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write(data)
+		} else if r.Method == "GET" && r.URL.Path == bagPath+"sha256/" && existing != "" {
+			w.Write([]byte(existing))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail": "Not found"}`))
+		}
+	}))
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", &dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		server.Close()
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+	return client, server, &posts
+}
+
+func TestCreateDigestIfMissing(t *testing.T) {
+	md := &dpn.DPNMessageDigest{
+		Bag:       aptrustBagIdentifier,
+		Algorithm: "sha256",
+		Node:      "aptrust",
+		Value:     "d5d0f0ec1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5",
+	}
+
+	// No existing digest, so we create one.
+	client, server, posts := getDigestClient(t, "")
+	saved, err := client.CreateDigestIfMissing(md)
+	server.Close()
+	if err != nil {
+		t.Fatalf("CreateDigestIfMissing returned error %v", err)
+	}
+	if atomic.LoadInt32(posts) != 1 {
+		t.Errorf("Expected 1 digest to be created, got %d", *posts)
+	}
+	if saved == nil || saved.Value != md.Value || saved.Node != "aptrust" {
+		t.Errorf("Created digest is wrong: %+v", saved)
+	}
+
+	// Existing digest matches, so we return it without creating another.
+	client, server, posts = getDigestClient(t, `{"bag": "`+aptrustBagIdentifier+
+		`", "algorithm": "sha256", "node": "aptrust", "value": "`+md.Value+
+		`", "created_at": "2016-04-01T12:00:00Z"}`)
+	saved, err = client.CreateDigestIfMissing(md)
+	server.Close()
+	if err != nil {
+		t.Fatalf("CreateDigestIfMissing returned error %v", err)
+	}
+	if atomic.LoadInt32(posts) != 0 {
+		t.Errorf("Should not have created a duplicate digest")
+	}
+	if saved == nil || saved.Value != md.Value || saved.CreatedAt.IsZero() {
+		t.Errorf("Expected the existing digest, got %+v", saved)
+	}
+
+	// Existing digest doesn't match.
+	client, server, posts = getDigestClient(t, `{"bag": "`+aptrustBagIdentifier+
+		`", "algorithm": "sha256", "node": "aptrust", "value": "0123456789abcdef"}`)
+	saved, err = client.CreateDigestIfMissing(md)
+	server.Close()
+	if err != dpn.ErrDigestMismatch {
+		t.Errorf("Expected ErrDigestMismatch, got %v", err)
+	}
+	if saved != nil || atomic.LoadInt32(posts) != 0 {
+		t.Errorf("Mismatched digest should not be returned or overwritten")
+	}
+}
+
+func TestFixityCheckCreateAndLatest(t *testing.T) {
+	var posts int32
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkPath := "/api-v1/bag/" + aptrustBagIdentifier + "/fixity_check/"
+		if r.URL.Path != checkPath {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail": "Not found"}`))
+		} else if r.Method == "POST" {
+			atomic.AddInt32(&posts, 1)
+			data, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write(data)
+		} else {
+			query = r.URL.RawQuery
+			w.Write([]byte(`{"count": 3, "next": null, "previous": null, "results": [
+				{"bag": "` + aptrustBagIdentifier + `", "node": "aptrust", "success": true,
+				 "fixity_at": "2016-04-01T12:00:00Z"},
+				{"bag": "` + aptrustBagIdentifier + `", "node": "aptrust", "success": false,
+				 "fixity_at": "2016-05-01T12:00:00Z"},
+				{"bag": "` + aptrustBagIdentifier + `", "node": "chron", "success": true,
+				 "fixity_at": "2016-06-01T12:00:00Z"}]}`))
+		}
+	}))
+	defer server.Close()
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token",
+		"aptrust", &dpn.DPNConfig{}, bagman.DiscardLogger("dpn_rest_client_test"))
+	if err != nil {
+		t.Fatalf("Error constructing DPN REST client: %v", err)
+	}
+
+	check := &dpn.DPNFixityCheck{
+		FixityCheckId: uuid.NewV4().String(),
+		Bag:           aptrustBagIdentifier,
+		Node:          "aptrust",
+		Success:       true,
+		FixityAt:      time.Now().UTC(),
+	}
+	saved, err := client.FixityCheckCreate(check)
+	if err != nil {
+		t.Fatalf("FixityCheckCreate returned error %v", err)
+	}
+	if atomic.LoadInt32(&posts) != 1 || saved.FixityCheckId != check.FixityCheckId || !saved.Success {
+		t.Errorf("Fixity check was not saved correctly: %+v", saved)
+	}
+
+	latest, err := client.LatestFixityCheck(aptrustBagIdentifier, "aptrust")
+	if err != nil {
+		t.Fatalf("LatestFixityCheck returned error %v", err)
+	}
+	if !strings.Contains(query, "node=aptrust") || !strings.Contains(query, "latest=true") {
+		t.Errorf("LatestFixityCheck sent wrong query: %s", query)
+	}
+	if latest == nil || latest.Node != "aptrust" || latest.Success {
+		t.Errorf("Expected our latest (failed) check, got %+v", latest)
+	}
+
+	latest, err = client.LatestFixityCheck(aptrustBagIdentifier, "hathi")
+	if err != nil || latest != nil {
+		t.Errorf("Expected no check for hathi, got %+v, %v", latest, err)
+	}
+}
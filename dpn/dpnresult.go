@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/APTrust/bagins"
 	"github.com/APTrust/bagman/bagman"
-	"github.com/nsqio/go-nsq"
 	"github.com/op/go-logging"
 	"os"
 	"strings"
@@ -20,6 +19,7 @@ const (
 	STAGE_VALIDATE  = "Validation"
 	STAGE_STORE     = "Storage"
 	STAGE_RECORD    = "Record"
+	STAGE_FIXITY    = "Fixity Check"
 	STAGE_COMPLETE  = "Complete"
 	STAGE_CANCELLED = "Cancelled"
 
@@ -75,7 +75,7 @@ type DPNResult struct {
 
 	// The NSQ message being processed. May be nil if we're
 	// running tests.
-	NsqMessage       *nsq.Message                 `json:"-"`
+	NsqMessage       bagman.Message               `json:"-"`
 
 	// The current stage of processing for this bag.
 	Stage            string
@@ -146,6 +146,14 @@ type DPNResult struct {
 	// disk space, this will be true. For fatal problems, such as
 	// an invalid bag, this will be false.
 	Retry            bool
+
+	// The stack trace of a panic that interrupted processing.
+	// Empty if there was none.
+	PanicStack       string                         `json:",omitempty"`
+
+	// The number of bytes reserved on the worker's volume for
+	// this bag. This is private to the process that reserved it.
+	volumeReserved   uint64
 }
 
 func NewDPNResult(bagIdentifier string) (*DPNResult) {
@@ -161,6 +169,113 @@ func NewDPNResult(bagIdentifier string) (*DPNResult) {
 	}
 }
 
+// RecordPanic records a panic in one of the processing stages
+// as an error, and lets the worker retry the bag.
+func (result *DPNResult) RecordPanic(stagePanic *bagman.StagePanic) {
+	result.ErrorMessage += stagePanic.Error()
+	result.PanicStack = stagePanic.Stack
+	result.Retry = true
+}
+
+// reserveVolume reserves numBytes on volume for this bag.
+// Returns an error if there isn't enough disk space.
+func (result *DPNResult) reserveVolume(volume *bagman.Volume, numBytes uint64) (error) {
+	err := volume.Reserve(numBytes)
+	if err == nil {
+		result.volumeReserved += numBytes
+	}
+	return err
+}
+
+// releaseVolume releases whatever space this bag has reserved
+// on volume. It's safe to call this more than once.
+func (result *DPNResult) releaseVolume(volume *bagman.Volume) {
+	if result.volumeReserved > 0 {
+		volume.Release(result.volumeReserved)
+		result.volumeReserved = 0
+	}
+}
+
+// ProcessedItemMismatchError means the ProcessedItemId in a DPN
+// message points to a ProcessedItem that doesn't exist or belongs
+// to a different institution than the bag. The message is corrupt,
+// and retrying won't help.
+type ProcessedItemMismatchError struct {
+	ProcessedItemId     int
+	ExpectedInstitution string
+	Institution         string
+	NotFound            bool
+}
+
+func (err *ProcessedItemMismatchError) Error() string {
+	if err.NotFound {
+		return fmt.Sprintf("ProcessedItem %d does not exist in Fluctus; expected "+
+			"an item belonging to %s", err.ProcessedItemId, err.ExpectedInstitution)
+	}
+	return fmt.Sprintf("ProcessedItem %d belongs to institution '%s', not '%s'",
+		err.ProcessedItemId, err.Institution, err.ExpectedInstitution)
+}
+
+// Returns true if err is a ProcessedItemMismatchError.
+func IsProcessedItemMismatch(err error) (bool) {
+	_, ok := err.(*ProcessedItemMismatchError)
+	return ok
+}
+
+// ValidateProcessedItem fetches the ProcessedItem with id
+// result.ProcessedItemId from Fluctus and checks that it belongs
+// to expectedInstitution, so a corrupt NSQ message can't make us
+// update another institution's ProcessedItem. On success, the
+// result keeps the ProcessedItem for later status updates. Returns
+// a ProcessedItemMismatchError if the item doesn't exist or belongs
+// to someone else, and a plain error if Fluctus can't be reached.
+func (result *DPNResult) ValidateProcessedItem(fluctusClient *bagman.FluctusClient, expectedInstitution string) (error) {
+	status, err := fluctusClient.GetBagStatusById(result.ProcessedItemId)
+	if err == bagman.ErrProcessStatusNotFound {
+		return &ProcessedItemMismatchError{
+			ProcessedItemId: result.ProcessedItemId,
+			ExpectedInstitution: expectedInstitution,
+			NotFound: true,
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Could not get ProcessedItem with id %d from Fluctus: %v",
+			result.ProcessedItemId, err)
+	}
+	if expectedInstitution == "" || status.Institution != expectedInstitution {
+		return &ProcessedItemMismatchError{
+			ProcessedItemId: result.ProcessedItemId,
+			ExpectedInstitution: expectedInstitution,
+			Institution: status.Institution,
+		}
+	}
+	result.processStatus = status
+	return nil
+}
+
+// validateMessageProcessedItem runs ValidateProcessedItem for a
+// worker's ProcessMessage, using the institution from the bag
+// identifier. If Fluctus can't be reached, it requeues the message.
+// If the bag identifier or ProcessedItem is wrong, it finishes the
+// message, since retrying won't help. Either way, it returns an
+// error, and the worker should not process the bag.
+func validateMessageProcessedItem(result *DPNResult, procUtil *bagman.ProcessUtil, message bagman.Message) (error) {
+	institution, err := bagman.GetInstitutionFromBagIdentifier(result.BagIdentifier)
+	if err == nil {
+		err = result.ValidateProcessedItem(procUtil.FluctusClient, institution)
+	}
+	if err == nil {
+		return nil
+	}
+	procUtil.MessageLog.Error("Rejecting message for bag '%s': %v", result.BagIdentifier, err)
+	if institution == "" || IsProcessedItemMismatch(err) {
+		message.Finish()
+	} else {
+		message.Requeue(1 * time.Minute)
+	}
+	return err
+}
+
 func (result *DPNResult) OriginalBagName() (string, error) {
 	parts := strings.SplitN(result.BagIdentifier, "/", 2)
 	if len(parts) == 2 {
@@ -171,6 +286,21 @@ func (result *DPNResult) OriginalBagName() (string, error) {
 	return "", err
 }
 
+// PrepareCopyReceipt fills in the fields of the TransferRequest that
+// we send back to the FromNode after copying and validating a bag:
+// status, bag validity, fixity value and BagIt profile errors.
+func (result *DPNResult) PrepareCopyReceipt() {
+	bagValid := result.ValidationResult.IsValid()
+	result.TransferRequest.Status = "received"
+	result.TransferRequest.BagValid = &bagValid
+	// A.D. 11/23/2015:
+	// Use the tag manifest checksum instead of result.BagSha256Digest
+	// which is the digest calculated on the entire bag.
+	digest := result.ValidationResult.TagManifestChecksum
+	result.TransferRequest.FixityValue = &digest
+	result.TransferRequest.ProfileErrors = result.ValidationResult.ProfileErrors
+}
+
 func (result *DPNResult) TarFilePath() (string) {
 	// Locally ingested bags have a PackageResult...
 	if result.PackageResult != nil && result.PackageResult.TarFilePath != "" {
@@ -201,7 +331,7 @@ func (result *PackageResult) Errors() ([]string) {
 	if result.ErrorMessage != "" {
 		errors = append(errors, result.ErrorMessage)
 	}
-	if result.BagBuilder.ErrorMessage != "" {
+	if result.BagBuilder != nil && result.BagBuilder.ErrorMessage != "" {
 		errors = append(errors, result.BagBuilder.ErrorMessage)
 	}
 	for _, result := range result.DPNFetchResults {
@@ -253,15 +383,41 @@ type DPNConfig struct {
 	LogToStderr            bool
 	// Number of nodes we should replicate bags to.
 	ReplicateToNumNodes    int
+	// When an object that's already in DPN changes, the packager
+	// builds a new version of its DPN bag. Unless this is true, it
+	// won't do that until all of the previous version's replication
+	// transfers are finished.
+	AllowVersionDuringReplication bool
 	// Should we accept self-signed and otherwise invalid SSL
 	// certificates? We need to do this in testing, but it
 	// should not be allowed in production. Bools in Go default
 	// to false, so if this is not set in config, we should be
 	// safe.
 	AcceptInvalidSSLCerts  bool
+	// TLSMinVersion is the oldest TLS version we'll accept when
+	// talking to DPN REST services: "1.0", "1.1", "1.2" or "1.3".
+	// If empty, the minimum is TLS 1.2.
+	TLSMinVersion          string
+	// TLSCACertFile is a PEM file of CA certificates to trust, in
+	// addition to the system roots, when verifying the certificates
+	// of DPN REST services. Use this instead of AcceptInvalidSSLCerts
+	// for nodes with self-signed or private-CA certificates. Relative
+	// paths are relative to the bagman home directory.
+	TLSCACertFile          string
 	// When copying bags from remote nodes, should we use rsync
 	// over SSH (true) or just plain rsync (false)?
 	UseSSHWithRsync        bool
+	// BagItProfileURL is the location of the DPN BagIt profile.
+	// We validate replicated bags against this profile. This may
+	// be an http(s) URL or a path relative to the bagman home
+	// directory. If it's empty, we skip the profile check. The
+	// validator loads the profile once, when it starts.
+	BagItProfileURL        string
+	// BagExcludePatterns are glob patterns for files the packager
+	// leaves out of the bags it builds, such as OS metadata files
+	// like ".DS_Store" and "Thumbs.db". Patterns match file names,
+	// not paths. Use ".*" to leave out all dot-files.
+	BagExcludePatterns     []string
 	// Default metadata that goes into bags produced at our node.
 	DefaultMetadata        *DefaultMetadata
 	// Settings for connecting to our own REST service
@@ -285,6 +441,28 @@ type DPNConfig struct {
 	// override the node URLs we get back from our local
 	// DPN REST server.
 	RemoteNodeURLs         map[string]string
+	// MaxRequestAttempts is the number of times the DPN REST
+	// client tries a request that fails with a connection error
+	// or a 500, 502, 503 or 504 response. If this is zero, the
+	// client uses DEFAULT_MAX_REQUEST_ATTEMPTS.
+	MaxRequestAttempts     int
+	// RetryBackoff is how long the DPN REST client waits before
+	// its first retry, e.g. "2s". The wait doubles with each
+	// retry. If this is empty, the client uses DEFAULT_RETRY_BACKOFF.
+	RetryBackoff           string
+	// ReplicationPolicy limits the size and number of replication
+	// transfers we accept from other nodes. If it's nil, we accept
+	// any transfer the staging volume has room for.
+	ReplicationPolicy      *ReplicationPolicy
+	// FixityCheckInterval is how often we check the fixity of each
+	// bag we store for other nodes, e.g. "4320h". If this is empty,
+	// we use DEFAULT_FIXITY_CHECK_INTERVAL.
+	FixityCheckInterval    string
+	// FixityRunInterval is how often cron runs dpn_fixity, e.g. "24h".
+	// Each run checks its share of our bags, so the checks are spread
+	// evenly over FixityCheckInterval. If this is empty, we use
+	// DEFAULT_FIXITY_RUN_INTERVAL.
+	FixityRunInterval      string
 }
 
 func (dpnConfig *DPNConfig) TokenFormatStringFor(nodeNamespace string) (string) {
@@ -297,6 +475,47 @@ func (dpnConfig *DPNConfig) TokenFormatStringFor(nodeNamespace string) (string)
 	return tokenFormat
 }
 
+// Returns RetryBackoff as a time.Duration, or DEFAULT_RETRY_BACKOFF
+// if RetryBackoff is empty.
+func (dpnConfig *DPNConfig) RetryBackoffDuration() (time.Duration, error) {
+	if dpnConfig.RetryBackoff == "" {
+		return DEFAULT_RETRY_BACKOFF, nil
+	}
+	backoff, err := time.ParseDuration(dpnConfig.RetryBackoff)
+	if err != nil || backoff < 0 {
+		return 0, fmt.Errorf("Invalid RetryBackoff '%s' in DPN config", dpnConfig.RetryBackoff)
+	}
+	return backoff, nil
+}
+
+// Returns FixityCheckInterval as a time.Duration, or
+// DEFAULT_FIXITY_CHECK_INTERVAL if FixityCheckInterval is empty.
+func (dpnConfig *DPNConfig) FixityCheckIntervalDuration() (time.Duration, error) {
+	if dpnConfig.FixityCheckInterval == "" {
+		return DEFAULT_FIXITY_CHECK_INTERVAL, nil
+	}
+	interval, err := time.ParseDuration(dpnConfig.FixityCheckInterval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("Invalid FixityCheckInterval '%s' in DPN config",
+			dpnConfig.FixityCheckInterval)
+	}
+	return interval, nil
+}
+
+// Returns FixityRunInterval as a time.Duration, or
+// DEFAULT_FIXITY_RUN_INTERVAL if FixityRunInterval is empty.
+func (dpnConfig *DPNConfig) FixityRunIntervalDuration() (time.Duration, error) {
+	if dpnConfig.FixityRunInterval == "" {
+		return DEFAULT_FIXITY_RUN_INTERVAL, nil
+	}
+	interval, err := time.ParseDuration(dpnConfig.FixityRunInterval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("Invalid FixityRunInterval '%s' in DPN config",
+			dpnConfig.FixityRunInterval)
+	}
+	return interval, nil
+}
+
 func LoadConfig(pathToFile, requestedConfig string) (*DPNConfig, error) {
 	data, err := bagman.LoadRelativeFile(pathToFile)
 	if err != nil {
@@ -311,6 +530,14 @@ func LoadConfig(pathToFile, requestedConfig string) (*DPNConfig, error) {
 	if config == nil {
 		return nil, fmt.Errorf("DPN config '%s' does not exist", requestedConfig)
 	}
+	if config.RestClient == nil {
+		config.RestClient = &RestClientConfig{}
+	}
+	envConfig, err := LoadDPNConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	config.MergeFrom(envConfig)
 	// Load local API token from environment to keep it out of config file.
 	// Need a better solution for this.
 	if config.RestClient.LocalAuthToken == "" {
@@ -341,6 +568,52 @@ func LoadConfig(pathToFile, requestedConfig string) (*DPNConfig, error) {
     return config, nil
 }
 
+// LoadDPNConfigFromEnv returns a DPNConfig with the settings that
+// may be set in the environment, for deployments where it's easier
+// to inject environment variables than to mount a config file.
+// DPN_LOCAL_NODE sets LocalNode, DPN_REST_URL sets
+// RestClient.LocalServiceURL and DPN_API_TOKEN sets
+// RestClient.LocalAuthToken. Settings whose variables are not set
+// are empty. LoadConfig merges these over the config file.
+//
+// DPN_STAGING_DIRECTORY and DPN_HOME_DIRECTORY are not DPNConfig
+// settings. bagman.LoadRequestedConfig reads them into
+// DPNStagingDirectory and DPNHomeDirectory.
+func LoadDPNConfigFromEnv() (*DPNConfig, error) {
+	restUrl := os.Getenv("DPN_REST_URL")
+	if restUrl != "" && !bagman.LooksLikeURL(restUrl) {
+		return nil, fmt.Errorf("DPN_REST_URL '%s' is not a valid URL", restUrl)
+	}
+	config := &DPNConfig{
+		LocalNode: os.Getenv("DPN_LOCAL_NODE"),
+		RestClient: &RestClientConfig{
+			LocalServiceURL: restUrl,
+			LocalAuthToken:  os.Getenv("DPN_API_TOKEN"),
+		},
+	}
+	return config, nil
+}
+
+// MergeFrom copies the non-empty settings of LoadDPNConfigFromEnv's
+// config over this one's.
+func (dpnConfig *DPNConfig) MergeFrom(other *DPNConfig) {
+	if other.LocalNode != "" {
+		dpnConfig.LocalNode = other.LocalNode
+	}
+	if other.RestClient == nil {
+		return
+	}
+	if dpnConfig.RestClient == nil {
+		dpnConfig.RestClient = &RestClientConfig{}
+	}
+	if other.RestClient.LocalServiceURL != "" {
+		dpnConfig.RestClient.LocalServiceURL = other.RestClient.LocalServiceURL
+	}
+	if other.RestClient.LocalAuthToken != "" {
+		dpnConfig.RestClient.LocalAuthToken = other.RestClient.LocalAuthToken
+	}
+}
+
 // BagBuilder builds a DPN bag from an APTrust intellectual object.
 type BagBuilder struct {
 	// LocalPath is the full, absolute path the the untarred bag
@@ -364,6 +637,12 @@ type BagBuilder struct {
 	// do with any APTrust UUID. It's generated in the constructor.
 	UUID                   string
 
+	// Version is the DPN version number of this bag, starting at 1.
+	// FirstVersionUUID is the UUID of version 1, which for version 1
+	// is UUID. See NewBagBuilderVersion.
+	Version                uint32
+	FirstVersionUUID       string
+
 	// ErrorMessage describes what when wrong while trying to
 	// package this bag. If it's an empty string, packaging
 	// succeeded.
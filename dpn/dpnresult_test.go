@@ -1,7 +1,15 @@
 package dpn_test
 
 import (
+	"encoding/json"
+	"github.com/APTrust/bagman/bagman"
 	"github.com/APTrust/bagman/dpn"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -64,3 +72,170 @@ func TestTokenFormatStringFor(t *testing.T) {
 			customFormat, format)
 	}
 }
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	fileConfig, err := dpn.LoadConfig(CONFIG_FILE, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"DPN_LOCAL_NODE", "DPN_REST_URL", "DPN_API_TOKEN"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("DPN_LOCAL_NODE", "chron")
+	os.Setenv("DPN_REST_URL", "https://dpn.example.com")
+	os.Setenv("DPN_API_TOKEN", "env_token")
+	config, err := dpn.LoadConfig(CONFIG_FILE, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LocalNode != "chron" {
+		t.Errorf("LocalNode should come from DPN_LOCAL_NODE, got %s", config.LocalNode)
+	}
+	if config.RestClient.LocalServiceURL != "https://dpn.example.com" {
+		t.Errorf("LocalServiceURL should come from DPN_REST_URL, got %s",
+			config.RestClient.LocalServiceURL)
+	}
+	if config.RestClient.LocalAuthToken != "env_token" {
+		t.Errorf("LocalAuthToken should come from DPN_API_TOKEN, got %s",
+			config.RestClient.LocalAuthToken)
+	}
+	if config.RestClient.LocalAPIRoot != fileConfig.RestClient.LocalAPIRoot {
+		t.Errorf("Settings not in the environment should come from the file")
+	}
+
+	// Empty variables don't override the file.
+	os.Setenv("DPN_LOCAL_NODE", "")
+	config, err = dpn.LoadConfig(CONFIG_FILE, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LocalNode != fileConfig.LocalNode {
+		t.Errorf("Expected LocalNode %s from the file, got %s", fileConfig.LocalNode, config.LocalNode)
+	}
+
+	os.Setenv("DPN_REST_URL", "not a url")
+	if _, err = dpn.LoadConfig(CONFIG_FILE, "test"); err == nil {
+		t.Errorf("LoadConfig should reject an invalid DPN_REST_URL")
+	}
+}
+
+// processedItemServer is a fake Fluctus that has one ProcessedItem,
+// with id 42, belonging to institution. It counts the PUT requests
+// that would update the item.
+func processedItemServer(institution string, updates *int32) (*httptest.Server) {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, "/itemresults/42") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "PUT" {
+			atomic.AddInt32(updates, 1)
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+			return
+		}
+		status := &bagman.ProcessStatus{
+			Id: 42,
+			ObjectIdentifier: institution + "/bag",
+			Institution: institution,
+			Status: bagman.StatusPending,
+		}
+		json.NewEncoder(w).Encode(status)
+	}))
+}
+
+func TestValidateProcessedItem(t *testing.T) {
+	var updates int32
+	server := processedItemServer("test.edu", &updates)
+	defer server.Close()
+	client, err := bagman.NewFluctusClient(server.URL, "v1", "user@example.edu",
+		"SeekritKee", bagman.DiscardLogger("dpnresult_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := dpn.NewDPNResult("test.edu/bag")
+	result.ProcessedItemId = 42
+	if err = result.ValidateProcessedItem(client, "test.edu"); err != nil {
+		t.Errorf("ValidateProcessedItem() returned error: %v", err)
+	}
+
+	err = result.ValidateProcessedItem(client, "other.edu")
+	if !dpn.IsProcessedItemMismatch(err) {
+		t.Errorf("Expected ProcessedItemMismatchError, got %v", err)
+	}
+
+	result.ProcessedItemId = 43
+	err = result.ValidateProcessedItem(client, "test.edu")
+	if !dpn.IsProcessedItemMismatch(err) {
+		t.Errorf("Expected ProcessedItemMismatchError for missing item, got %v", err)
+	}
+	if updates != 0 {
+		t.Errorf("ValidateProcessedItem() should not update the ProcessedItem")
+	}
+}
+
+// A message whose ProcessedItemId belongs to another institution
+// must not update that ProcessedItem or go into the pipeline.
+func TestProcessMessageRejectsOtherInstitutionsItem(t *testing.T) {
+	var updates int32
+	server := processedItemServer("other.edu", &updates)
+	defer server.Close()
+	client, err := bagman.NewFluctusClient(server.URL, "v1", "user@example.edu",
+		"SeekritKee", bagman.DiscardLogger("dpnresult_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	procUtil := &bagman.ProcessUtil{
+		FluctusClient: client,
+		MessageLog: bagman.DiscardLogger("dpnresult_test"),
+	}
+	packager := &dpn.Packager{
+		ProcUtil: procUtil,
+		LookupChannel: make(chan *dpn.DPNResult, 1),
+	}
+	recorder := &dpn.Recorder{
+		ProcUtil: procUtil,
+		RecordChannel: make(chan *dpn.DPNResult, 1),
+	}
+	body := []byte(`{"BagIdentifier": "test.edu/bag", "ProcessedItemId": 42}`)
+
+	message := bagman.NewInMemoryMessage(body)
+	err = packager.ProcessMessage(message)
+	if !dpn.IsProcessedItemMismatch(err) {
+		t.Errorf("Packager: expected ProcessedItemMismatchError, got %v", err)
+	}
+	if !message.Finished() || message.Requeued() {
+		t.Errorf("Packager should finish, not requeue, a message with the wrong ProcessedItem")
+	}
+	if len(packager.LookupChannel) != 0 {
+		t.Errorf("Packager should not process a bag with the wrong ProcessedItem")
+	}
+
+	message = bagman.NewInMemoryMessage(body)
+	err = recorder.ProcessMessage(message)
+	if !dpn.IsProcessedItemMismatch(err) {
+		t.Errorf("Recorder: expected ProcessedItemMismatchError, got %v", err)
+	}
+	if !message.Finished() || message.Requeued() {
+		t.Errorf("Recorder should finish, not requeue, a message with the wrong ProcessedItem")
+	}
+	if len(recorder.RecordChannel) != 0 {
+		t.Errorf("Recorder should not process a bag with the wrong ProcessedItem")
+	}
+
+	if updates != 0 {
+		t.Errorf("Workers updated another institution's ProcessedItem %d time(s)", updates)
+	}
+
+	// The same message for the right institution goes through.
+	message = bagman.NewInMemoryMessage(
+		[]byte(`{"BagIdentifier": "other.edu/bag", "ProcessedItemId": 42}`))
+	if err = packager.ProcessMessage(message); err != nil {
+		t.Errorf("Packager rejected a valid message: %v", err)
+	}
+	if len(packager.LookupChannel) != 1 {
+		t.Errorf("Packager should have put the bag into the lookup channel")
+	}
+}
@@ -206,11 +206,11 @@ func (dpnSync *DPNSync) getBags(remoteClient *DPNRestClient, remoteNode *DPNNode
 	// We want to get all bags updated since the last time we pulled
 	// from this node, and only those bags for which the node we're
 	// querying is the admin node.
-	params := url.Values{}
-	params.Set("after", remoteNode.LastPullDate.Format(time.RFC3339Nano))
-	params.Set("admin_node", remoteNode.Namespace)
-	params.Set("page", fmt.Sprintf("%d", pageNumber))
-	return remoteClient.DPNBagListGet(&params)
+	return remoteClient.DPNBagListGetFiltered(&DPNBagFilter{
+		AfterDate: remoteNode.LastPullDate,
+		AdminNode: remoteNode.Namespace,
+		Page:      pageNumber,
+	})
 }
 
 func (dpnSync *DPNSync) SyncReplicationRequests(remoteNode *DPNNode) ([]*DPNReplicationTransfer, error) {
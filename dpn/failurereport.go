@@ -0,0 +1,89 @@
+package dpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"strings"
+)
+
+// FailureReport returns a report describing why this result failed.
+func (result *DPNResult) FailureReport() (*bagman.FailureReport) {
+	stageErrors := map[string][]string{}
+	pipelineErrors := make([]string, 0)
+	if result.PackageResult != nil {
+		stageErrors[STAGE_PACKAGE] = result.PackageResult.Errors()
+		pipelineErrors = append(pipelineErrors, stageErrors[STAGE_PACKAGE]...)
+	}
+	if result.CopyResult != nil {
+		stageErrors[STAGE_COPY] = []string{result.CopyResult.ErrorMessage}
+		pipelineErrors = append(pipelineErrors, result.CopyResult.ErrorMessage)
+	}
+	if result.ValidationResult != nil {
+		validationErrors := make([]string, 0)
+		validationErrors = append(validationErrors, result.ValidationResult.ErrorMessages...)
+		validationErrors = append(validationErrors, result.ValidationResult.ProfileErrors...)
+		stageErrors[STAGE_VALIDATE] = validationErrors
+		pipelineErrors = append(pipelineErrors, validationErrors...)
+	}
+	if result.RecordResult != nil {
+		stageErrors[STAGE_RECORD] = []string{result.RecordResult.ErrorMessage}
+		pipelineErrors = append(pipelineErrors, result.RecordResult.ErrorMessage)
+	}
+	messages := append([]string{}, stageErrors[result.Stage]...)
+	messages = append(messages, pipelineErrors...)
+	report := bagman.NewFailureReport(append(messages, result.ErrorMessage))
+	report.Stage = result.Stage
+	report.Retry = result.Retry
+	report.Bag = result.BagIdentifier
+	if report.Bag == "" && result.DPNBag != nil {
+		report.Bag = result.DPNBag.UUID
+	} else if report.Bag == "" && result.PackageResult != nil && result.PackageResult.BagBuilder != nil {
+		report.Bag = result.PackageResult.BagBuilder.UUID
+	}
+	if result.BagIdentifier != "" {
+		report.Institution = strings.SplitN(result.BagIdentifier, "/", 2)[0]
+	} else if result.TransferRequest != nil {
+		report.Institution = result.TransferRequest.FromNode
+	}
+	report.BagSize = result.BagSize
+	if report.BagSize == 0 && result.DPNBag != nil {
+		report.BagSize = int64(result.DPNBag.Size)
+	}
+	report.LocalPath = result.TarFilePath()
+	if report.LocalPath == "" {
+		report.LocalPath = result.LocalPath
+	}
+	report.Remediation = bagman.SuggestedAction(report.Classification, report.LocalPath)
+	return report
+}
+
+// FailureReportFromJSON returns a failure report for a message from
+// the ingest or DPN trouble queue, or for a failure report that was
+// saved as JSON.
+func FailureReportFromJSON(data []byte) (*bagman.FailureReport, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("Trouble message is not a JSON object: %v", err)
+	}
+	if _, isReport := fields["classification"]; isReport {
+		report := &bagman.FailureReport{}
+		err := json.Unmarshal(data, report)
+		return report, err
+	}
+	if _, isIngest := fields["S3File"]; isIngest {
+		result := &bagman.ProcessResult{}
+		if err := json.Unmarshal(data, result); err != nil {
+			return nil, fmt.Errorf("Cannot parse ingest result: %v", err)
+		}
+		return result.FailureReport(), nil
+	}
+	if _, isDPN := fields["BagIdentifier"]; isDPN {
+		result := &DPNResult{}
+		if err := json.Unmarshal(data, result); err != nil {
+			return nil, fmt.Errorf("Cannot parse DPN result: %v", err)
+		}
+		return result.FailureReport(), nil
+	}
+	return nil, fmt.Errorf("Trouble message is neither an ingest result nor a DPN result")
+}
@@ -0,0 +1,110 @@
+package dpn_test
+
+import (
+	"encoding/json"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"testing"
+)
+
+func TestDPNFailureReport(t *testing.T) {
+	result := dpn.NewDPNResult("test.edu/ncsu.1840.16-1004")
+	result.Stage = dpn.STAGE_VALIDATE
+	result.BagSize = 4096
+	result.Retry = false
+	result.PackageResult.TarFilePath = "/mnt/dpn/staging/ncsu.1840.16-1004.tar"
+	result.ValidationResult = &dpn.ValidationResult{
+		ErrorMessages: []string{"DPN tag Version-Number must be an integer."},
+	}
+	result.ErrorMessage = "Could not send 'test.edu/ncsu.1840.16-1004' (at " +
+		"/mnt/dpn/staging/ncsu.1840.16-1004.tar) to storage queue: No response " +
+		"from nsqd at 'http://127.0.0.1:4151/put?topic=dpn_store_topic'. Is it running?"
+	report := result.FailureReport()
+	if report.Classification != bagman.FailureInvalidBag {
+		t.Errorf("Validation errors should come first in the validation stage, got %s: %s",
+			report.Classification, report.Error)
+	}
+	if report.ErrorCount != 2 {
+		t.Errorf("Expected 2 errors, got %d", report.ErrorCount)
+	}
+	if report.Bag != "test.edu/ncsu.1840.16-1004" || report.Institution != "test.edu" {
+		t.Errorf("Report has wrong bag or institution: %s, %s", report.Bag, report.Institution)
+	}
+	if report.BagSize != 4096 || report.Retry || report.Stage != dpn.STAGE_VALIDATE {
+		t.Errorf("Report has wrong size, retry or stage: %d, %t, %s", report.BagSize,
+			report.Retry, report.Stage)
+	}
+	if report.LocalPath != "/mnt/dpn/staging/ncsu.1840.16-1004.tar" {
+		t.Errorf("Report has wrong local path: %s", report.LocalPath)
+	}
+
+	// Bags from other nodes are identified by UUID.
+	result = dpn.NewDPNResult("")
+	result.Stage = dpn.STAGE_COPY
+	result.DPNBag = &dpn.DPNBag{UUID: "4d11736c-c0ab-44b0-66c6-a947f414d4f1", Size: 8192}
+	result.TransferRequest = &dpn.DPNReplicationTransfer{FromNode: "chron"}
+	result.CopyResult.ErrorMessage = "exit status 23: rsync: link_stat \"/dpn/outbound/4d11736c.tar\" failed"
+	report = result.FailureReport()
+	if report.Classification != bagman.FailureDPNCopy {
+		t.Errorf("Expected DPNCopyError, got %s", report.Classification)
+	}
+	if report.Bag != result.DPNBag.UUID || report.Institution != "chron" || report.BagSize != 8192 {
+		t.Errorf("Report has wrong bag, node or size: %s, %s, %d", report.Bag,
+			report.Institution, report.BagSize)
+	}
+}
+
+func TestFailureReportFromJSON(t *testing.T) {
+	dpnResult := dpn.NewDPNResult("test.edu/ncsu.1840.16-1004")
+	dpnResult.RecordResult.ErrorMessage = "Can't send copy receipt to chron: Can't get REST client for that node."
+	dpnResult.Stage = dpn.STAGE_RECORD
+	dpnJson, err := json.Marshal(dpnResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := dpn.FailureReportFromJSON(dpnJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Classification != bagman.FailureDPNNode || report.Bag != "test.edu/ncsu.1840.16-1004" {
+		t.Errorf("DPN result gave wrong report: %s %s", report.Classification, report.Bag)
+	}
+
+	ingestResult := &bagman.ProcessResult{
+		S3File: &bagman.S3File{BucketName: "aptrust.receiving.ncsu.edu"},
+		Stage:  bagman.StageFetch,
+		ErrorMessage: "Error retrieving file aptrust.receiving.ncsu.edu/sample_bag.tar: " +
+			"The specified key does not exist.",
+	}
+	ingestResult.S3File.Key.Key = "sample_bag.tar"
+	ingestJson, err := json.Marshal(ingestResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = dpn.FailureReportFromJSON(ingestJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Classification != bagman.FailureMissingBag || report.Institution != "ncsu.edu" {
+		t.Errorf("Ingest result gave wrong report: %s %s", report.Classification, report.Institution)
+	}
+
+	// Saved reports come back as they were.
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedReport, err := dpn.FailureReportFromJSON(reportJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *savedReport != *report {
+		t.Errorf("Saved report did not round trip")
+	}
+
+	for _, bad := range []string{`not json`, `["a list"]`, `{"Something": "else"}`} {
+		if _, err := dpn.FailureReportFromJSON([]byte(bad)); err == nil {
+			t.Errorf("FailureReportFromJSON should reject %s", bad)
+		}
+	}
+}
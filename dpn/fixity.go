@@ -0,0 +1,371 @@
+package dpn
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/satori/go.uuid"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often we check each bag we hold for other nodes, if
+// DPNConfig.FixityCheckInterval is not set.
+const DEFAULT_FIXITY_CHECK_INTERVAL = 180 * 24 * time.Hour
+
+// How often dpn_fixity runs, if DPNConfig.FixityRunInterval
+// is not set.
+const DEFAULT_FIXITY_RUN_INTERVAL = 24 * time.Hour
+
+// FixityRegistry is the part of the DPN REST client that the
+// fixity checker uses. DPNRestClient implements it.
+type FixityRegistry interface {
+	DPNBagListGetFiltered(filter *DPNBagFilter) (*BagListResult, error)
+	LatestFixityCheck(bagUUID, node string) (*DPNFixityCheck, error)
+	MessageDigestGet(bagUUID, algorithm string) (*DPNMessageDigest, error)
+	FixityCheckCreate(check *DPNFixityCheck) (*DPNFixityCheck, error)
+}
+
+// FixityStorage reads stored bags. bagman.S3Client implements it.
+type FixityStorage interface {
+	GetReader(bucketName, key string) (io.ReadCloser, error)
+}
+
+// HeldBag is a bag we store for another node, with our most
+// recent fixity check on it.
+type HeldBag struct {
+	Bag         *DPNBag
+	// LastCheck is nil if we have never checked the bag.
+	LastCheck   *DPNFixityCheck
+}
+
+// CheckDueAt returns when the bag is due for its next fixity check:
+// interval after the last check, or after the bag was created if
+// we have never checked it.
+func (held *HeldBag) CheckDueAt(interval time.Duration) (time.Time) {
+	lastChecked := held.Bag.CreatedAt
+	if held.LastCheck != nil {
+		lastChecked = held.LastCheck.FixityAt
+	}
+	return lastChecked.Add(interval)
+}
+
+// heldBagsByDueAt sorts held bags by when their next check is due.
+type heldBagsByDueAt struct {
+	bags     []*HeldBag
+	interval time.Duration
+}
+
+func (s heldBagsByDueAt) Len() int      { return len(s.bags) }
+func (s heldBagsByDueAt) Swap(i, j int) { s.bags[i], s.bags[j] = s.bags[j], s.bags[i] }
+func (s heldBagsByDueAt) Less(i, j int) bool {
+	return s.bags[i].CheckDueAt(s.interval).Before(s.bags[j].CheckDueAt(s.interval))
+}
+
+// FixityResult describes the outcome of checking one stored bag.
+type FixityResult struct {
+	Bag              *DPNBag
+	// RegisteredDigest is the sha256 digest of the bag's tag
+	// manifest, as registered in DPN.
+	RegisteredDigest string
+	// StoredDigest is the sha256 digest of the tag manifest in
+	// our stored copy of the bag.
+	StoredDigest     string
+	// BadFiles are the files in our stored copy that are missing
+	// or don't match their manifest entries.
+	BadFiles         []string
+	CheckedAt        time.Time
+	// ErrorMessage describes why we could not check the bag.
+	// If it's set, we know nothing about the bag's fixity.
+	ErrorMessage     string
+}
+
+// Completed returns true if we were able to read the stored bag
+// and calculate its digest.
+func (result *FixityResult) Completed() (bool) {
+	return result.ErrorMessage == ""
+}
+
+// Succeeded returns true if the stored bag matches its registered
+// digest and all of its manifests.
+func (result *FixityResult) Succeeded() (bool) {
+	return result.Completed() && result.StoredDigest == result.RegisteredDigest &&
+		len(result.BadFiles) == 0
+}
+
+// TroubleResult returns a DPNResult describing a failed fixity check,
+// for the DPN trouble queue.
+func (result *FixityResult) TroubleResult() (*DPNResult) {
+	dpnResult := NewDPNResult("")
+	dpnResult.Stage = STAGE_FIXITY
+	dpnResult.DPNBag = result.Bag
+	dpnResult.BagSize = int64(result.Bag.Size)
+	dpnResult.TagManifestDigest = result.StoredDigest
+	dpnResult.Retry = false
+	dpnResult.ErrorMessage = fmt.Sprintf("Stored bag %s failed its fixity check: "+
+		"registered sha256 digest is '%s', stored copy's is '%s'.",
+		result.Bag.UUID, result.RegisteredDigest, result.StoredDigest)
+	if len(result.BadFiles) > 0 {
+		dpnResult.ErrorMessage += fmt.Sprintf(" Files that are missing or don't "+
+			"match their manifests: %s.", strings.Join(result.BadFiles, ", "))
+	}
+	return dpnResult
+}
+
+// FixityChecker checks the fixity of the bags we store for other
+// nodes, spreading the checks evenly over DPNConfig.FixityCheckInterval.
+type FixityChecker struct {
+	Registry  FixityRegistry
+	Storage   FixityStorage
+	// Bucket is where we store DPN bags, as <uuid>.tar.
+	Bucket    string
+	Node      string
+	Interval  time.Duration
+	RunEvery  time.Duration
+	// Trouble receives a DPNResult for each bag that fails
+	// its check. It may be nil.
+	Trouble   func(*DPNResult)
+	logger    *logging.Logger
+}
+
+// NewFixityChecker returns a FixityChecker for the bags that
+// dpnConfig.LocalNode stores in bucket.
+func NewFixityChecker(registry FixityRegistry, storage FixityStorage, bucket string, dpnConfig *DPNConfig, logger *logging.Logger) (*FixityChecker, error) {
+	interval, err := dpnConfig.FixityCheckIntervalDuration()
+	if err != nil {
+		return nil, err
+	}
+	runEvery, err := dpnConfig.FixityRunIntervalDuration()
+	if err != nil {
+		return nil, err
+	}
+	return &FixityChecker{
+		Registry: registry,
+		Storage: storage,
+		Bucket: bucket,
+		Node: dpnConfig.LocalNode,
+		Interval: interval,
+		RunEvery: runEvery,
+		logger: logger,
+	}, nil
+}
+
+// FindHeldBags returns the bags that list our node among their
+// replicating nodes, with our latest fixity check on each.
+func (checker *FixityChecker) FindHeldBags() ([]*HeldBag, error) {
+	held := make([]*HeldBag, 0)
+	for pageNumber := 1; ; pageNumber++ {
+		result, err := checker.Registry.DPNBagListGetFiltered(&DPNBagFilter{
+			ReplicatingNode: checker.Node,
+			Page:            pageNumber,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, bag := range result.Results {
+			if !stringInList(checker.Node, bag.ReplicatingNodes) {
+				continue
+			}
+			lastCheck, err := checker.Registry.LatestFixityCheck(bag.UUID, checker.Node)
+			if err != nil {
+				return nil, fmt.Errorf("Can't get latest fixity check for bag %s: %v",
+					bag.UUID, err)
+			}
+			held = append(held, &HeldBag{Bag: bag, LastCheck: lastCheck})
+		}
+		if result.Next == nil || *result.Next == "" {
+			break
+		}
+	}
+	return held, nil
+}
+
+// SelectBagsForFixity returns the bags to check in a run at now,
+// most overdue first. To spread the work evenly over interval, each
+// run checks at most its share of all the bags we hold, which is
+// the number of bags times runEvery / interval. Bags that are due
+// but over the quota wait for the next run.
+func SelectBagsForFixity(held []*HeldBag, interval, runEvery time.Duration, now time.Time) ([]*HeldBag) {
+	due := make([]*HeldBag, 0)
+	for _, bag := range held {
+		if !bag.CheckDueAt(interval).After(now) {
+			due = append(due, bag)
+		}
+	}
+	sort.Stable(heldBagsByDueAt{due, interval})
+	quota := len(due)
+	if interval > 0 && runEvery < interval {
+		quota = int(math.Ceil(float64(len(held)) * float64(runEvery) / float64(interval)))
+	}
+	if quota < len(due) {
+		due = due[:quota]
+	}
+	return due
+}
+
+// CheckBag streams our stored copy of bag and compares it with
+// the bag's registered digest and its own manifests.
+func (checker *FixityChecker) CheckBag(bag *DPNBag) (*FixityResult) {
+	result := &FixityResult{Bag: bag}
+	digest, err := checker.Registry.MessageDigestGet(bag.UUID, "sha256")
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("Can't get registered digest for bag %s: %v",
+			bag.UUID, err)
+		return result
+	}
+	if digest != nil && digest.Value != "" {
+		result.RegisteredDigest = digest.Value
+	} else if bag.Fixities != nil && bag.Fixities.Sha256 != "" {
+		result.RegisteredDigest = bag.Fixities.Sha256
+	} else {
+		result.ErrorMessage = fmt.Sprintf("Bag %s has no registered sha256 digest", bag.UUID)
+		return result
+	}
+	key := fmt.Sprintf("%s.tar", bag.UUID)
+	reader, err := checker.Storage.GetReader(checker.Bucket, key)
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("Can't read %s from bucket '%s': %v",
+			key, checker.Bucket, err)
+		return result
+	}
+	defer reader.Close()
+	result.StoredDigest, result.BadFiles, err = CalculateTarFixity(reader)
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("Error reading %s from bucket '%s': %v",
+			key, checker.Bucket, err)
+		return result
+	}
+	result.CheckedAt = time.Now().UTC()
+	return result
+}
+
+// Record saves the outcome of a completed check in the DPN registry,
+// and sends failures to Trouble. It does nothing with checks that
+// did not complete, so those bags are still due in the next run.
+func (checker *FixityChecker) Record(result *FixityResult) (error) {
+	if !result.Completed() {
+		return nil
+	}
+	check := &DPNFixityCheck{
+		FixityCheckId: uuid.NewV4().String(),
+		Bag: result.Bag.UUID,
+		Node: checker.Node,
+		Success: result.Succeeded(),
+		FixityAt: result.CheckedAt,
+		CreatedAt: result.CheckedAt,
+	}
+	_, err := checker.Registry.FixityCheckCreate(check)
+	if !result.Succeeded() && checker.Trouble != nil {
+		checker.Trouble(result.TroubleResult())
+	}
+	if err != nil {
+		return fmt.Errorf("Can't record fixity check for bag %s: %v", result.Bag.UUID, err)
+	}
+	return nil
+}
+
+// Run checks the bags that are due in this run, records the
+// outcomes, and returns the number of bags checked and the
+// number that failed.
+func (checker *FixityChecker) Run() (checked, failed int, err error) {
+	held, err := checker.FindHeldBags()
+	if err != nil {
+		return 0, 0, err
+	}
+	selected := SelectBagsForFixity(held, checker.Interval, checker.RunEvery, time.Now().UTC())
+	checker.logger.Info("Holding %d bags for other nodes; checking %d this run",
+		len(held), len(selected))
+	for _, heldBag := range selected {
+		result := checker.CheckBag(heldBag.Bag)
+		if !result.Completed() {
+			checker.logger.Error(result.ErrorMessage)
+			continue
+		}
+		checked++
+		if result.Succeeded() {
+			checker.logger.Info("Bag %s passed its fixity check", heldBag.Bag.UUID)
+		} else {
+			failed++
+			checker.logger.Error("Bag %s failed its fixity check: registered digest %s, "+
+				"stored digest %s, bad files %v", heldBag.Bag.UUID, result.RegisteredDigest,
+				result.StoredDigest, result.BadFiles)
+		}
+		if err := checker.Record(result); err != nil {
+			checker.logger.Error(err.Error())
+		}
+	}
+	return checked, failed, nil
+}
+
+// CalculateTarFixity reads a tarred DPN bag from reader, checks every
+// file listed in manifest-sha256.txt and tagmanifest-sha256.txt, and
+// returns the sha256 digest of tagmanifest-sha256.txt, which is the
+// bag's DPN fixity value, along with the files that are missing or
+// don't match their manifest entries. It reads the tar file once, so
+// it never holds more than the manifests in memory.
+func CalculateTarFixity(reader io.Reader) (tagManifestDigest string, badFiles []string, err error) {
+	digests := make(map[string]string)
+	manifests := make(map[string][]byte)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// Tarred bags untar to a directory named for the bag,
+		// and the manifests list paths relative to that.
+		pathInBag := header.Name
+		if slash := strings.Index(pathInBag, "/"); slash > -1 {
+			pathInBag = pathInBag[slash+1:]
+		}
+		hash := sha256.New()
+		var writer io.Writer = hash
+		var buffer *bytes.Buffer
+		if pathInBag == "manifest-sha256.txt" || pathInBag == "tagmanifest-sha256.txt" {
+			buffer = &bytes.Buffer{}
+			writer = io.MultiWriter(hash, buffer)
+		}
+		if _, err := io.Copy(writer, tarReader); err != nil {
+			return "", nil, err
+		}
+		digests[pathInBag] = fmt.Sprintf("%x", hash.Sum(nil))
+		if buffer != nil {
+			manifests[pathInBag] = buffer.Bytes()
+		}
+	}
+	badFiles = make([]string, 0)
+	for _, manifest := range []string{"manifest-sha256.txt", "tagmanifest-sha256.txt"} {
+		data, ok := manifests[manifest]
+		if !ok {
+			badFiles = append(badFiles, fmt.Sprintf("%s (missing)", manifest))
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			expected := strings.ToLower(fields[0])
+			filePath := strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+			actual, found := digests[filePath]
+			if !found {
+				badFiles = append(badFiles, fmt.Sprintf("%s (missing)", filePath))
+			} else if actual != expected {
+				badFiles = append(badFiles, filePath)
+			}
+		}
+	}
+	return digests["tagmanifest-sha256.txt"], badFiles, nil
+}
@@ -0,0 +1,244 @@
+package dpn_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sha256 of tagmanifest-sha256.txt in GOOD_BAG
+const goodBagDigest = "204db9e51fb39acbd965d14e51149c443a1febeab225a1ca3d196b12b7b021bd"
+
+// stubRegistry is a FixityRegistry that serves bags from memory
+// and remembers the fixity checks it records.
+type stubRegistry struct {
+	bags       []*dpn.DPNBag
+	lastChecks map[string]*dpn.DPNFixityCheck
+	digests    map[string]string
+	created    []*dpn.DPNFixityCheck
+}
+
+func (registry *stubRegistry) DPNBagListGetFiltered(filter *dpn.DPNBagFilter) (*dpn.BagListResult, error) {
+	// The stub ignores the filter, so the checker has to
+	// skip bags that other nodes hold.
+	return &dpn.BagListResult{Count: int32(len(registry.bags)), Results: registry.bags}, nil
+}
+
+func (registry *stubRegistry) LatestFixityCheck(bagUUID, node string) (*dpn.DPNFixityCheck, error) {
+	return registry.lastChecks[bagUUID], nil
+}
+
+func (registry *stubRegistry) MessageDigestGet(bagUUID, algorithm string) (*dpn.DPNMessageDigest, error) {
+	value, ok := registry.digests[bagUUID]
+	if !ok {
+		return nil, nil
+	}
+	return &dpn.DPNMessageDigest{Bag: bagUUID, Algorithm: algorithm, Value: value}, nil
+}
+
+func (registry *stubRegistry) FixityCheckCreate(check *dpn.DPNFixityCheck) (*dpn.DPNFixityCheck, error) {
+	registry.created = append(registry.created, check)
+	return check, nil
+}
+
+// stubStorage is a FixityStorage that reads bags from dpn/testdata.
+type stubStorage struct {
+	files map[string]string
+}
+
+func (storage *stubStorage) GetReader(bucketName, key string) (io.ReadCloser, error) {
+	fileName, ok := storage.files[key]
+	if !ok {
+		return nil, fmt.Errorf("The specified key does not exist.")
+	}
+	bagPath, err := getBagPath(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(bagPath)
+}
+
+func heldBag(uuid string, created time.Time, lastCheck *time.Time) (*dpn.HeldBag) {
+	held := &dpn.HeldBag{Bag: &dpn.DPNBag{UUID: uuid, CreatedAt: created}}
+	if lastCheck != nil {
+		held.LastCheck = &dpn.DPNFixityCheck{Bag: uuid, FixityAt: *lastCheck}
+	}
+	return held
+}
+
+func TestCalculateTarFixity(t *testing.T) {
+	bagPath, err := getBagPath(GOOD_BAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(bagPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, badFiles, err := dpn.CalculateTarFixity(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("CalculateTarFixity returned error %v", err)
+	}
+	if digest != goodBagDigest {
+		t.Errorf("Expected tag manifest digest %s, got %s", goodBagDigest, digest)
+	}
+	if len(badFiles) != 0 {
+		t.Errorf("Good bag should have no bad files, got %v", badFiles)
+	}
+
+	bagPath, err = getBagPath(BAG_MISSING_DATA_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err = os.Open(bagPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, badFiles, err = dpn.CalculateTarFixity(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("CalculateTarFixity returned error %v", err)
+	}
+	if len(badFiles) == 0 {
+		t.Errorf("Bag with a missing data file should have bad files")
+	}
+
+	if _, _, err = dpn.CalculateTarFixity(strings.NewReader("not a tar file")); err == nil {
+		t.Errorf("CalculateTarFixity should reject a file that isn't a tar file")
+	}
+}
+
+func TestSelectBagsForFixity(t *testing.T) {
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	interval := 10 * day
+	held := make([]*dpn.HeldBag, 0)
+	for i := 0; i < 16; i++ {
+		checked := now.Add(-2 * day)
+		held = append(held, heldBag(fmt.Sprintf("recent-%d", i), now.Add(-100*day), &checked))
+	}
+	checked11 := now.Add(-11 * day)
+	checked15 := now.Add(-15 * day)
+	held = append(held, heldBag("checked-11-days-ago", now.Add(-100*day), &checked11))
+	held = append(held, heldBag("never-checked", now.Add(-30*day), nil))
+	held = append(held, heldBag("checked-15-days-ago", now.Add(-100*day), &checked15))
+	held = append(held, heldBag("created-yesterday", now.Add(-1*day), nil))
+
+	// 20 bags checked every 10 days is 2 bags a day.
+	selected := dpn.SelectBagsForFixity(held, interval, day, now)
+	if len(selected) != 2 {
+		t.Fatalf("Expected 2 bags, got %d", len(selected))
+	}
+	if selected[0].Bag.UUID != "never-checked" || selected[1].Bag.UUID != "checked-15-days-ago" {
+		t.Errorf("Expected the most overdue bags first, got %s and %s",
+			selected[0].Bag.UUID, selected[1].Bag.UUID)
+	}
+
+	// With a weekly run, the quota is 14, but only 3 bags are due.
+	selected = dpn.SelectBagsForFixity(held, interval, 7*day, now)
+	if len(selected) != 3 || selected[2].Bag.UUID != "checked-11-days-ago" {
+		t.Errorf("Expected the 3 due bags, got %d", len(selected))
+	}
+
+	if len(dpn.SelectBagsForFixity(held, interval, day, now.Add(-25*day))) != 0 {
+		t.Errorf("No bags should be due 25 days ago")
+	}
+}
+
+func TestFixityCheckerRun(t *testing.T) {
+	longAgo := time.Now().UTC().Add(-365 * 24 * time.Hour)
+	yesterday := time.Now().UTC().Add(-24 * time.Hour)
+	registry := &stubRegistry{
+		bags: []*dpn.DPNBag{
+			{UUID: "good", ReplicatingNodes: []string{"tdr", "aptrust"}, CreatedAt: longAgo},
+			{UUID: "altered", ReplicatingNodes: []string{"aptrust"}, CreatedAt: longAgo, Size: 276480},
+			{UUID: "registry-digest", ReplicatingNodes: []string{"aptrust"}, CreatedAt: longAgo,
+				Fixities: &dpn.DPNFixity{Sha256: "not-the-digest"}},
+			{UUID: "not-ours", ReplicatingNodes: []string{"chron"}, CreatedAt: longAgo},
+			{UUID: "checked-yesterday", ReplicatingNodes: []string{"aptrust"}, CreatedAt: longAgo},
+			{UUID: "missing", ReplicatingNodes: []string{"aptrust"}, CreatedAt: longAgo,
+				Fixities: &dpn.DPNFixity{Sha256: goodBagDigest}},
+		},
+		lastChecks: map[string]*dpn.DPNFixityCheck{
+			"checked-yesterday": {Bag: "checked-yesterday", Node: "aptrust", FixityAt: yesterday},
+		},
+		digests: map[string]string{
+			"good":    goodBagDigest,
+			"altered": "0123456789abcdef",
+			// The message digest wins over the bag's fixities.
+			"registry-digest": goodBagDigest,
+		},
+	}
+	storage := &stubStorage{files: map[string]string{
+		"good.tar":              GOOD_BAG,
+		"altered.tar":           GOOD_BAG,
+		"registry-digest.tar":   GOOD_BAG,
+		"not-ours.tar":          GOOD_BAG,
+		"checked-yesterday.tar": GOOD_BAG,
+	}}
+	config := &dpn.DPNConfig{LocalNode: "aptrust", FixityCheckInterval: "720h", FixityRunInterval: "720h"}
+	checker, err := dpn.NewFixityChecker(registry, storage, "dpn.aptrust.org", config,
+		bagman.DiscardLogger("fixity_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trouble := make([]*dpn.DPNResult, 0)
+	checker.Trouble = func(result *dpn.DPNResult) {
+		trouble = append(trouble, result)
+	}
+
+	held, err := checker.FindHeldBags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 5 {
+		t.Errorf("Expected 5 held bags, got %d", len(held))
+	}
+
+	checked, failed, err := checker.Run()
+	if err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	// The missing bag can't be checked, so it's not recorded,
+	// and it will still be due next run.
+	if checked != 3 || failed != 1 {
+		t.Errorf("Expected 3 bags checked and 1 failed, got %d and %d", checked, failed)
+	}
+	if len(registry.created) != 3 {
+		t.Fatalf("Expected 3 fixity checks recorded, got %d", len(registry.created))
+	}
+	for _, check := range registry.created {
+		if check.Node != "aptrust" || check.FixityAt.IsZero() {
+			t.Errorf("Fixity check is missing node or time: %+v", check)
+		}
+		if check.Success != (check.Bag != "altered") {
+			t.Errorf("Fixity check for %s has wrong success value %t", check.Bag, check.Success)
+		}
+	}
+
+	if len(trouble) != 1 {
+		t.Fatalf("Expected 1 trouble result, got %d", len(trouble))
+	}
+	result := trouble[0]
+	if result.Stage != dpn.STAGE_FIXITY || result.Retry || result.DPNBag.UUID != "altered" {
+		t.Errorf("Trouble result has wrong stage, retry or bag: %s, %t, %s",
+			result.Stage, result.Retry, result.DPNBag.UUID)
+	}
+	for _, expected := range []string{"altered", "0123456789abcdef", goodBagDigest} {
+		if !strings.Contains(result.ErrorMessage, expected) {
+			t.Errorf("Trouble message should include %s: %s", expected, result.ErrorMessage)
+		}
+	}
+	report := result.FailureReport()
+	if report.Classification != bagman.FailureStorageMismatch || report.Bag != "altered" ||
+		report.BagSize != 276480 {
+		t.Errorf("Failure report has wrong classification, bag or size: %s, %s, %d",
+			report.Classification, report.Bag, report.BagSize)
+	}
+}
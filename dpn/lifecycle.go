@@ -0,0 +1,130 @@
+package dpn
+
+import (
+	"errors"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"net/url"
+	"strings"
+)
+
+// DPNLifecycleClient is the part of the DPNRestClient that
+// LifecycleSource needs. It's an interface so the lifecycle
+// entries can be tested without a DPN REST service.
+type DPNLifecycleClient interface {
+	DPNBagListGetFiltered(filter *DPNBagFilter) (*BagListResult, error)
+	ReplicationTransfersForBag(bagUUID string) ([]*DPNReplicationTransfer, error)
+	FixityCheckListGet(bagUUID string, queryParams *url.Values) (*FixityCheckListResult, error)
+}
+
+// LifecycleSource adds the DPN history of an APTrust object to
+// bagman.BagLifecycle: the DPN bags whose local id is the object
+// identifier, their replication transfers, and their fixity checks.
+type LifecycleSource struct {
+	Client DPNLifecycleClient
+}
+
+// Name returns the name that identifies this source in
+// lifecycle entries and gaps.
+func (source *LifecycleSource) Name() (string) {
+	return "dpn"
+}
+
+// LifecycleEntries returns the DPN history of the object. If it can
+// find the object's bags but can't get the transfers or fixity checks
+// of some of them, it returns what it has along with an error.
+func (source *LifecycleSource) LifecycleEntries(objectIdentifier string) ([]*bagman.LifecycleEntry, error) {
+	result, err := source.Client.DPNBagListGetFiltered(&DPNBagFilter{LocalId: objectIdentifier})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get DPN bags: %v", err)
+	}
+	entries := make([]*bagman.LifecycleEntry, 0)
+	messages := make([]string, 0)
+	for _, bag := range result.Results {
+		if bag.LocalId != "" && bag.LocalId != objectIdentifier {
+			continue
+		}
+		entries = append(entries, bagLifecycleEntry(bag))
+		xfers, err := source.Client.ReplicationTransfersForBag(bag.UUID)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf(
+				"Cannot get replication transfers for bag %s: %v", bag.UUID, err))
+		}
+		for _, xfer := range xfers {
+			entries = append(entries, replicationLifecycleEntries(xfer)...)
+		}
+		checks, err := source.Client.FixityCheckListGet(bag.UUID, nil)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf(
+				"Cannot get fixity checks for bag %s: %v", bag.UUID, err))
+		} else {
+			for _, check := range checks.Results {
+				entries = append(entries, fixityLifecycleEntry(check))
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return entries, errors.New(strings.Join(messages, "; "))
+	}
+	return entries, nil
+}
+
+func bagLifecycleEntry(bag *DPNBag) (*bagman.LifecycleEntry) {
+	summary := fmt.Sprintf("Registered in DPN by %s, version %d", bag.IngestNode, bag.Version)
+	if len(bag.ReplicatingNodes) > 0 {
+		summary = fmt.Sprintf("%s, stored at %s", summary, strings.Join(bag.ReplicatingNodes, ", "))
+	}
+	return &bagman.LifecycleEntry{
+		Time:       bag.CreatedAt,
+		Kind:       bagman.LifecycleDPN,
+		Source:     "dpn",
+		Subject:    bag.UUID,
+		Summary:    summary,
+		Identifier: bag.UUID,
+	}
+}
+
+// Returns an entry for the replication request, and another for
+// its current status if the transfer was updated after that.
+func replicationLifecycleEntries(xfer *DPNReplicationTransfer) ([]*bagman.LifecycleEntry) {
+	entries := []*bagman.LifecycleEntry{
+		&bagman.LifecycleEntry{
+			Time:       xfer.CreatedAt,
+			Kind:       bagman.LifecycleReplication,
+			Source:     "dpn",
+			Subject:    xfer.BagId,
+			Summary:    fmt.Sprintf("Replication %s requested from %s to %s",
+				xfer.ReplicationId, xfer.FromNode, xfer.ToNode),
+			Identifier: xfer.ReplicationId,
+		},
+	}
+	if xfer.UpdatedAt.After(xfer.CreatedAt) {
+		entries = append(entries, &bagman.LifecycleEntry{
+			Time:       xfer.UpdatedAt,
+			Kind:       bagman.LifecycleReplication,
+			Source:     "dpn",
+			Subject:    xfer.BagId,
+			Summary:    fmt.Sprintf("Replication %s from %s to %s is %s",
+				xfer.ReplicationId, xfer.FromNode, xfer.ToNode, xfer.Status),
+			Outcome:    xfer.Status,
+			Identifier: xfer.ReplicationId,
+		})
+	}
+	return entries
+}
+
+func fixityLifecycleEntry(check *DPNFixityCheck) (*bagman.LifecycleEntry) {
+	outcome := string(bagman.OutcomeSuccess)
+	if !check.Success {
+		outcome = bagman.OutcomeFailure
+	}
+	return &bagman.LifecycleEntry{
+		Time:       check.FixityAt,
+		Kind:       bagman.LifecycleFixity,
+		Source:     "dpn",
+		Subject:    check.Bag,
+		Summary:    fmt.Sprintf("Fixity check by %s", check.Node),
+		Outcome:    outcome,
+		Identifier: check.FixityCheckId,
+	}
+}
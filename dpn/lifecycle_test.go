@@ -0,0 +1,100 @@
+package dpn_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeDPNLifecycleClient struct {
+	bags        []*dpn.DPNBag
+	bagErr      error
+	xfers       map[string][]*dpn.DPNReplicationTransfer
+	fixityErr   error
+	localId     string
+}
+
+func (client *fakeDPNLifecycleClient) DPNBagListGetFiltered(filter *dpn.DPNBagFilter) (*dpn.BagListResult, error) {
+	client.localId = filter.LocalId
+	if client.bagErr != nil {
+		return nil, client.bagErr
+	}
+	return &dpn.BagListResult{Results: client.bags}, nil
+}
+
+func (client *fakeDPNLifecycleClient) ReplicationTransfersForBag(bagUUID string) ([]*dpn.DPNReplicationTransfer, error) {
+	return client.xfers[bagUUID], nil
+}
+
+func (client *fakeDPNLifecycleClient) FixityCheckListGet(bagUUID string, queryParams *url.Values) (*dpn.FixityCheckListResult, error) {
+	if client.fixityErr != nil {
+		return nil, client.fixityErr
+	}
+	return &dpn.FixityCheckListResult{Results: []*dpn.DPNFixityCheck{
+		{FixityCheckId: "fc-1", Bag: bagUUID, Node: "chron", Success: false,
+			FixityAt: time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}}, nil
+}
+
+func TestLifecycleSource(t *testing.T) {
+	created := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+	client := &fakeDPNLifecycleClient{
+		bags: []*dpn.DPNBag{
+			{UUID: "uuid-1", LocalId: "test.edu/bag1", IngestNode: "aptrust", Version: 1,
+				ReplicatingNodes: []string{"chron", "tdr"}, CreatedAt: created},
+			// The REST service may ignore local_id, so other
+			// objects' bags must be skipped.
+			{UUID: "uuid-2", LocalId: "test.edu/bag2", CreatedAt: created},
+		},
+		xfers: map[string][]*dpn.DPNReplicationTransfer{
+			"uuid-1": {
+				{ReplicationId: "xfer-1", BagId: "uuid-1", FromNode: "aptrust", ToNode: "chron",
+					Status: "Stored", CreatedAt: created, UpdatedAt: created.Add(48 * time.Hour)},
+				{ReplicationId: "xfer-2", BagId: "uuid-1", FromNode: "aptrust", ToNode: "tdr",
+					Status: "Requested", CreatedAt: created, UpdatedAt: created},
+			},
+		},
+	}
+	source := &dpn.LifecycleSource{Client: client}
+	entries, err := source.LifecycleEntries("test.edu/bag1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.localId != "test.edu/bag1" {
+		t.Errorf("Expected bags to be filtered by local id, got '%s'", client.localId)
+	}
+	// The bag, two requests, one status update and one fixity check.
+	if len(entries) != 5 {
+		t.Fatalf("Expected 5 entries, got %d", len(entries))
+	}
+	if entries[0].Kind != bagman.LifecycleDPN || entries[0].Subject != "uuid-1" ||
+		entries[0].Summary != "Registered in DPN by aptrust, version 1, stored at chron, tdr" {
+		t.Errorf("Wrong bag entry: %+v", entries[0])
+	}
+	if entries[2].Kind != bagman.LifecycleReplication || entries[2].Outcome != "Stored" ||
+		!entries[2].Time.Equal(created.Add(48 * time.Hour)) {
+		t.Errorf("Wrong replication status entry: %+v", entries[2])
+	}
+	if entries[4].Kind != bagman.LifecycleFixity || entries[4].Outcome != string(bagman.OutcomeFailure) {
+		t.Errorf("Wrong fixity entry: %+v", entries[4])
+	}
+
+	// If fixity checks are unavailable, we still get the rest.
+	client.fixityErr = fmt.Errorf("404")
+	entries, err = source.LifecycleEntries("test.edu/bag1")
+	if err == nil || !strings.Contains(err.Error(), "fixity checks for bag uuid-1") {
+		t.Errorf("Expected an error about fixity checks, got %v", err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Expected 4 entries without fixity checks, got %d", len(entries))
+	}
+
+	client.bagErr = fmt.Errorf("connection refused")
+	if _, err = source.LifecycleEntries("test.edu/bag1"); err == nil {
+		t.Errorf("Expected an error when bags are unavailable")
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -45,14 +44,28 @@ type Packager struct {
 	PostProcessChannel  chan *DPNResult
 	DPNConfig           *DPNConfig
 	ProcUtil            *bagman.ProcessUtil
-	// WaitGroup is for running local tests only.
-	WaitGroup           sync.WaitGroup
+	// VersionClient looks up earlier DPN versions of the objects
+	// we package. NewPackager sets it to a client for our local
+	// DPN REST service.
+	VersionClient       DPNVersionClient
 }
 
-func NewPackager(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Packager) {
+func NewPackager(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Packager, error) {
+	// Set up a DPN REST client that talks to our local DPN REST service.
+	localClient, err := NewDPNRestClient(
+		dpnConfig.RestClient.LocalServiceURL,
+		dpnConfig.RestClient.LocalAPIRoot,
+		dpnConfig.RestClient.LocalAuthToken,
+		dpnConfig.LocalNode,
+		dpnConfig,
+		procUtil.MessageLog)
+	if err != nil {
+		return nil, err
+	}
 	packager := &Packager {
 		DPNConfig: dpnConfig,
 		ProcUtil: procUtil,
+		VersionClient: localClient,
 	}
 
 	workerBufferSize := procUtil.Config.DPNPackageWorker.Workers * 4
@@ -74,20 +87,27 @@ func NewPackager(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Packager)
 	for i := 0; i <  procUtil.Config.DPNPackageWorker.NetworkConnections; i++ {
 		go packager.doFetch()
 	}
-	return packager
+	return packager, nil
 }
 
 // MessageHandler handles messages from NSQ, putting each
 // item into the pipleline.
 func (packager *Packager) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return packager.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (packager *Packager) ProcessMessage(message bagman.Message) error {
 
 	// TODO: Change this. We'll actually just have the bag identifier in the queue.
 	result := &DPNResult{}
-	err := json.Unmarshal(message.Body, result)
+	err := json.Unmarshal(message.Body(), result)
 	if err != nil {
 		detailedError := fmt.Errorf("Could not unmarshal JSON data from nsq:",
-			string(message.Body))
+			string(message.Body()))
 		packager.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -99,16 +119,10 @@ func (packager *Packager) HandleMessage(message *nsq.Message) error {
 
 	// Fluctus housekeeping
 	if result.ProcessedItemId != 0 {
-		processedItem, err := packager.ProcUtil.FluctusClient.GetBagStatusById(result.ProcessedItemId)
+		err = validateMessageProcessedItem(result, packager.ProcUtil, message)
 		if err != nil {
-			errMessage := fmt.Sprintf("Could not get ProcessedItem with id %d from Fluctus",
-				result.ProcessedItemId)
-			packager.ProcUtil.MessageLog.Error(errMessage)
-			message.Attempts += 1
-			message.Requeue(1 * time.Minute)
-			return fmt.Errorf(errMessage)
+			return err
 		}
-		result.processStatus = processedItem
 		result.processStatus.Status = bagman.StatusStarted
 		result.processStatus.SetNodePidState(result, packager.ProcUtil.MessageLog)
 		err = packager.ProcUtil.FluctusClient.UpdateProcessedItem(result.processStatus)
@@ -116,7 +130,6 @@ func (packager *Packager) HandleMessage(message *nsq.Message) error {
 			errorMessage := fmt.Sprintf("Before processing '%s', cannot send status " +
 				"back to Fluctus: %v", result.BagIdentifier, err)
 			packager.ProcUtil.MessageLog.Error(errorMessage)
-			message.Attempts += 1
 			message.Requeue(1 * time.Minute)
 			return fmt.Errorf(errorMessage)
 		}
@@ -132,12 +145,17 @@ func (packager *Packager) HandleMessage(message *nsq.Message) error {
 // Fluctus, builds a package result object, and moves the data
 // into the FetchChannel.
 //
-// We should not have to check whether this bag already exists in DPN
-// because the packager only deals with bags ingested at APTrust, and
-// the APTrust web UI won't even show the "Send to DPN" button if the
-// item is already in DPN.
+// If the object is already in DPN, because the depositor updated it
+// after it was sent, we build the next version of its DPN bag. See
+// NextBagVersion.
 func (packager *Packager) doLookup() {
-	for result := range packager.LookupChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_package.lookup", packager.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			packager.recoverResult(result, stagePanic, packager.PostProcessChannel)
+			go packager.doLookup()
+		})
+	for result = range packager.LookupChannel {
 		// Get the bag, with a list of GenericFiles
 		intelObj, err := packager.ProcUtil.FluctusClient.IntellectualObjectGet(result.BagIdentifier, true)
 		if err != nil {
@@ -158,11 +176,11 @@ func (packager *Packager) doLookup() {
 			packager.PostProcessChannel <- result
 			continue
 		}
-		err = packager.ProcUtil.Volume.Reserve(uint64(intelObj.TotalFileSize() * 2))
+		err = result.reserveVolume(packager.ProcUtil.Volume, uint64(intelObj.EstimatedStagingBytes()))
 		if err != nil {
 			// FAIL - Not enough disk space in staging area to build this bag
 			packager.ProcUtil.MessageLog.Warning("Requeueing bag %s, %d bytes - not enough disk space",
-				result.BagIdentifier, intelObj.TotalFileSize())
+				result.BagIdentifier, intelObj.EstimatedStagingBytes())
 			result.ErrorMessage += err.Error()
 			packager.ProcUtil.MessageLog.Error(result.ErrorMessage)
 			result.Retry = true
@@ -180,8 +198,24 @@ func (packager *Packager) doLookup() {
 				packager.PostProcessChannel <- result
 				continue
 			}
+			version, err := NextBagVersion(packager.VersionClient, result.BagIdentifier,
+				packager.DPNConfig.AllowVersionDuringReplication)
+			if err != nil {
+				// Lookup errors are usually transient, and pending
+				// replications finish eventually, so try again later.
+				result.ErrorMessage += err.Error()
+				packager.ProcUtil.MessageLog.Error(result.ErrorMessage)
+				result.Retry = true
+				packager.PostProcessChannel <- result
+				continue
+			}
+			if version.Version > 1 {
+				packager.ProcUtil.MessageLog.Info("Building version %d of %s. Previous version "+
+					"is %s, first version is %s", version.Version, result.BagIdentifier,
+					version.PreviousVersionUUID, version.FirstVersionUUID)
+			}
 			// Woo-hoo!
-			builder, err := NewBagBuilder(dir, intelObj, packager.DPNConfig.DefaultMetadata)
+			builder, err := NewBagBuilderVersion(dir, intelObj, packager.DPNConfig.DefaultMetadata, version)
 			if err != nil {
 				result.ErrorMessage += fmt.Sprintf("Error creating BagBuilder: %s",
 					err.Error())
@@ -201,7 +235,13 @@ func (packager *Packager) doLookup() {
 // stores them locally. Data then goes into the BuildChannel
 // so we can build the DPN bag.
 func (packager *Packager) doFetch() {
-	for result := range packager.FetchChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_package.fetch", packager.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			packager.recoverResult(result, stagePanic, packager.CleanupChannel)
+			go packager.doFetch()
+		})
+	for result = range packager.FetchChannel {
 		targetDirectory, err := packager.DPNBagDirectory(result)
 		if err != nil {
 			result.ErrorMessage += fmt.Sprintf("Cannot get abs path for bag directory: %s", err.Error())
@@ -242,12 +282,17 @@ func (packager *Packager) doFetch() {
 // quite a while, so we poke NSQ several times to let it know
 // we're still here.
 func (packager *Packager) doBuild() {
-	for result := range packager.BuildChannel {
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_package.build", packager.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			packager.recoverResult(result, stagePanic, packager.CleanupChannel)
+			go packager.doBuild()
+		})
+	for result = range packager.BuildChannel {
+		result.NsqMessage.Touch()
 
 		// Add files to bag before saving.
+		addError := ""
 		for i := range result.FetchResults.Items {
 			fetchResult := result.FetchResults.Items[i]
 			sourcePath := fetchResult.FetchResult.LocalFile
@@ -256,10 +301,18 @@ func (packager *Packager) doBuild() {
 			// we know the identifier is valid.
 			pathInBag, _ := fetchResult.GenericFile.OriginalPath()
 
-			if strings.HasPrefix(pathInBag, "data/") {
+			if fetchResult.GenericFile.IsPayloadFile() {
 				// This is in the data dir, so it's a normal payload file.
 				pathWithoutDataPrefix := strings.Replace(pathInBag, "data/", "", 1)
 				result.PackageResult.BagBuilder.Bag.AddFile(sourcePath, pathWithoutDataPrefix)
+			} else if pathInBag == "aptrust-info.txt" {
+				// Rewrite this one with the canonical access value,
+				// rather than copying whatever the depositor wrote.
+				err := result.PackageResult.BagBuilder.AddAPTrustInfo(sourcePath)
+				if err != nil {
+					addError = err.Error()
+					break
+				}
 			} else if !strings.Contains(pathInBag, "/") {
 				// This is in the root dir, so it's a top-level tag file,
 				// which the DPN spec does not specifically allow or prohibit,
@@ -275,6 +328,12 @@ func (packager *Packager) doBuild() {
 				result.PackageResult.BagBuilder.Bag.AddCustomTagfile(sourcePath, pathInBag, true)
 			}
 		}
+		if addError != "" {
+			result.ErrorMessage += fmt.Sprintf("Error adding files to bag: %s ", addError)
+			packager.ProcUtil.MessageLog.Error(result.ErrorMessage)
+			packager.CleanupChannel <- result
+			continue
+		}
 
 		errors := result.PackageResult.BagBuilder.Bag.Save()
 		if errors != nil && len(errors) > 0 {
@@ -287,9 +346,7 @@ func (packager *Packager) doBuild() {
 			packager.CleanupChannel <- result
 			continue
 		}
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 
 		packager.TarChannel <- result
 	}
@@ -298,11 +355,15 @@ func (packager *Packager) doBuild() {
 // doTar tars up the DPN bag and then sends data along to the
 // CleanupChannel.
 func (packager *Packager) doTar() {
-	for result := range packager.TarChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_package.tar", packager.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			packager.recoverResult(result, stagePanic, packager.CleanupChannel)
+			go packager.doTar()
+		})
+	for result = range packager.TarChannel {
 
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 
 		// Figure out where the files are for this bag
 		bagDir, err := packager.DPNBagDirectory(result)
@@ -313,8 +374,10 @@ func (packager *Packager) doTar() {
 			packager.CleanupChannel <- result
 			continue
 		}
-		// Get the list of all files (manifests, tag files & payload)
-		files, err := bagman.RecursiveFileList(bagDir)
+		// Get the list of all files (manifests, tag files & payload),
+		// minus OS metadata files that don't belong in the bag.
+		files, err := bagman.RecursiveFileListExcluding(bagDir,
+			packager.DPNConfig.BagExcludePatterns)
 		if err != nil {
 			result.ErrorMessage += fmt.Sprintf("Cannot get list of files in directory %s: %s",
 				bagDir, err.Error())
@@ -412,9 +475,7 @@ func (packager *Packager) doTar() {
 		}
 		result.TagManifestDigest = fileDigest.Sha256Digest
 
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 
 		packager.CleanupChannel <- result
 	}
@@ -426,7 +487,13 @@ func (packager *Packager) doTar() {
 // but the directories whose contents went into the tar file will
 // be gone. From here, data goes into the PostProcessChannel.
 func (packager *Packager) doCleanup() {
-	for result := range packager.CleanupChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_package.cleanup", packager.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			packager.recoverResult(result, stagePanic, packager.PostProcessChannel)
+			go packager.doCleanup()
+		})
+	for result = range packager.CleanupChannel {
 		if packager.shouldCleanup(result) {
 			packager.cleanup(result)
 		}
@@ -439,7 +506,13 @@ func (packager *Packager) doCleanup() {
 // NSQ that the worker is done with the job (whether successful or not),
 // and sends data to the next NSQ topic for post-processing.
 func (packager *Packager) postProcess() {
-	for result := range packager.PostProcessChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_package.post_process", packager.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			packager.recoverResult(result, stagePanic, nil)
+			go packager.postProcess()
+		})
+	for result = range packager.PostProcessChannel {
 
 		// Tell Fluctus what's up
 		if result.processStatus != nil {
@@ -447,6 +520,10 @@ func (packager *Packager) postProcess() {
 				result.PackageResult.Succeeded() == false &&
 					packager.reachedMaxAttempts(result) == true)
 			result.Retry = result.processStatus.Retry
+			if result.PackageResult.Succeeded() == false && packager.reachedMaxAttempts(result) {
+				result.processStatus.SetOutcome(bagman.OutcomeFailure,
+					"DPN packaging failed after max attempts.")
+			}
 			result.processStatus.SetNodePidState(result, packager.ProcUtil.MessageLog)
 			result.processStatus.Node = ""
 			result.processStatus.Pid = 0
@@ -464,39 +541,29 @@ func (packager *Packager) postProcess() {
 			packager.ProcUtil.IncrementSucceeded()
 			// All's well. Send this into the storage queue, so
 			// it will be uploaded to Glacier.
-			if result.NsqMessage != nil {
-				result.NsqMessage.Finish()
-				SendToStorageQueue(result, packager.ProcUtil)
-			}
+			result.NsqMessage.Finish()
+			SendToStorageQueue(result, packager.ProcUtil)
 		} else {
 			if packager.reachedMaxAttempts(result) {
 				packager.ProcUtil.MessageLog.Error(result.ErrorMessage)
 				packager.ProcUtil.IncrementFailed()
 				// Item failed after max attempts. Put in trouble queue
 				// for admin review.
-				if result.NsqMessage != nil {
-					result.NsqMessage.Finish()
-					SendToTroubleQueue(result, packager.ProcUtil)
-				}
+				result.NsqMessage.Finish()
+				SendToTroubleQueue(result, packager.ProcUtil)
 			} else {  // Failed, but we can still retry
 				packager.ProcUtil.MessageLog.Warning(
 					"Bag %s failed, but will retry. %s",
 					result.BagIdentifier, result.ErrorMessage)
-				if result.NsqMessage != nil {
-					message := fmt.Sprintf("Requeuing %s",result.BagIdentifier)
-					if result.PackageResult != nil && result.PackageResult.BagBuilder != nil {
-						message = fmt.Sprintf("%s at path %s", message,
-							result.PackageResult.BagBuilder.LocalPath)
-					}
-					packager.ProcUtil.MessageLog.Info(message)
-					result.NsqMessage.Requeue(1 * time.Minute)
+				message := fmt.Sprintf("Requeuing %s",result.BagIdentifier)
+				if result.PackageResult != nil && result.PackageResult.BagBuilder != nil {
+					message = fmt.Sprintf("%s at path %s", message,
+						result.PackageResult.BagBuilder.LocalPath)
 				}
+				packager.ProcUtil.MessageLog.Info(message)
+				result.NsqMessage.Requeue(1 * time.Minute)
 			}
 		}
-		if result.NsqMessage == nil {
-			// This is a test message, running outside production.
-			packager.WaitGroup.Done()
-		}
 
 		packager.ProcUtil.LogStats()
 	}
@@ -508,11 +575,7 @@ func (packager *Packager) postProcess() {
 //
 
 func (packager *Packager) reachedMaxAttempts(result *DPNResult) (bool) {
-	if result.NsqMessage == nil {
-		// If no NSQ message, we're running RunTest() without NSQ
-		return true
-	}
-	return result.NsqMessage.Attempts >= uint16(packager.ProcUtil.Config.DPNPackageWorker.MaxAttempts)
+	return result.NsqMessage.Attempts() >= uint16(packager.ProcUtil.Config.DPNPackageWorker.MaxAttempts)
 }
 
 // shouldCleanup tells us whether we should delete all of the files,
@@ -574,7 +637,18 @@ func (packager *Packager) cleanup(result *DPNResult) {
 	if err != nil {
 		packager.ProcUtil.MessageLog.Error("Error cleaning up %s: %v", bagDir, err)
 	}
-	packager.ProcUtil.Volume.Release(uint64(result.PackageResult.BagBuilder.IntellectualObject.TotalFileSize() * 2))
+	result.releaseVolume(packager.ProcUtil.Volume)
+}
+
+// recoverResult records a panic as a packaging error, so we
+// don't mistake a bag that panicked after tarring for one that
+// was packaged successfully, and then passes the result along
+// like the other DPN workers do.
+func (packager *Packager) recoverResult(result *DPNResult, stagePanic *bagman.StagePanic, nextChannel chan *DPNResult) {
+	if result != nil && result.PackageResult != nil {
+		result.PackageResult.ErrorMessage += stagePanic.Error()
+	}
+	recoverResult(result, stagePanic, packager.ProcUtil, nextChannel)
 }
 
 // Returns the path to the directory where we will build the DPN bag.
@@ -629,11 +703,14 @@ func (packager *Packager) FilesAlreadyFetched(result *DPNResult) (map[string]boo
 // Run: `dpn_package_devtest -config=dev`
 func (packager *Packager) RunTest(bagIdentifier string) (*DPNResult) {
 	result := NewDPNResult(bagIdentifier)
-	packager.WaitGroup.Add(1)
-	packager.ProcUtil.MessageLog.Info("Putting %s into lookup channel",
-		result.BagIdentifier)
-	packager.LookupChannel <- result
-	packager.WaitGroup.Wait()
+	err := runSynchronously(result, packager.ProcUtil.Config.DPNPackageWorker, func() {
+		packager.ProcUtil.MessageLog.Info("Putting %s into lookup channel",
+			result.BagIdentifier)
+		packager.LookupChannel <- result
+	})
+	if err != nil {
+		packager.ProcUtil.MessageLog.Error("%v", err)
+	}
 	fmt.Println("Inspect the tar file output. It's your job to delete the file manually.")
 	return result
 }
@@ -8,8 +8,6 @@ import (
 	"github.com/satori/go.uuid"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync"
 	"time"
 )
 
@@ -20,8 +18,6 @@ type Recorder struct {
 	DPNConfig           *DPNConfig
 	LocalRESTClient     *DPNRestClient
 	RemoteClients       map[string]*DPNRestClient
-	// WaitGroup is for running local tests only.
-	WaitGroup           sync.WaitGroup
 }
 
 type RecordResult struct {
@@ -92,6 +88,7 @@ func NewRecorder(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Recorder,
 		LocalRESTClient: localClient,
 		RemoteClients: remoteClients,
 	}
+	recorder.logRemoteHealth()
 	workerBufferSize := procUtil.Config.DPNRecordWorker.Workers * 10
 	recorder.RecordChannel = make(chan *DPNResult, workerBufferSize)
 	recorder.PostProcessChannel = make(chan *DPNResult, workerBufferSize)
@@ -104,13 +101,38 @@ func NewRecorder(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Recorder,
 	return recorder, nil
 }
 
+// Logs the status of each remote node's DPN REST server, so the log
+// says up front which nodes we may have trouble recording to. A node
+// that fails its health check is not fatal, since it may be back
+// before we need it.
+func (recorder *Recorder) logRemoteHealth() {
+	for namespace, client := range recorder.RemoteClients {
+		status, err := client.HealthCheck()
+		if err != nil {
+			recorder.ProcUtil.MessageLog.Warning("Health check for node %s failed: %v",
+				namespace, err)
+			continue
+		}
+		recorder.ProcUtil.MessageLog.Info("Node %s is up: server version %s, "+
+			"namespace %s, %d active replications", namespace, status.ServerVersion,
+			status.NodeNamespace, status.ActiveReplicationCount)
+	}
+}
+
 func (recorder *Recorder) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return recorder.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (recorder *Recorder) ProcessMessage(message bagman.Message) error {
 	result := &DPNResult{}
-	err := json.Unmarshal(message.Body, result)
+	err := json.Unmarshal(message.Body(), result)
 	if err != nil {
 		recorder.ProcUtil.MessageLog.Error("Could not unmarshal JSON data from nsq:",
-			string(message.Body))
+			string(message.Body()))
 		message.Finish()
 		return fmt.Errorf("Could not unmarshal JSON data from nsq")
 	}
@@ -122,15 +144,11 @@ func (recorder *Recorder) HandleMessage(message *nsq.Message) error {
 	// have result.BagIdentifier. Bags replicated from other
 	// nodes do not.
 	if result.ProcessedItemId != 0 {
-		processedItem, err := recorder.ProcUtil.FluctusClient.GetBagStatusById(result.ProcessedItemId)
+		err = validateMessageProcessedItem(result, recorder.ProcUtil, message)
 		if err != nil {
-			errMessage := fmt.Sprintf("Could not get ProcessedItem with id %d from Fluctus",
-				result.ProcessedItemId)
-			recorder.ProcUtil.MessageLog.Error(errMessage)
-			message.Attempts += 1
-			message.Requeue(1 * time.Minute)
-			return fmt.Errorf(errMessage)
+			return err
 		}
+		processedItem := result.processStatus
 		if processedItem.Status == bagman.StatusSuccess {
 			// Item was already recorded
 			info := fmt.Sprintf("Bag %s has already been recorded",
@@ -139,14 +157,12 @@ func (recorder *Recorder) HandleMessage(message *nsq.Message) error {
 			message.Finish()
 			return nil
 		}
-		result.processStatus = processedItem
 		result.processStatus.SetNodePidState(result, recorder.ProcUtil.MessageLog)
 		err = recorder.ProcUtil.FluctusClient.UpdateProcessedItem(result.processStatus)
 		if err != nil {
 			errorMessage := fmt.Sprintf("Before processing, error updating ProcessedItem " +
 				"in Fluctus for '%s': %v", result.BagIdentifier, err)
 			recorder.ProcUtil.MessageLog.Error(errorMessage)
-			message.Attempts += 1
 			message.Requeue(1 * time.Minute)
 			return fmt.Errorf(errorMessage)
 		}
@@ -161,7 +177,13 @@ func (recorder *Recorder) HandleMessage(message *nsq.Message) error {
 
 
 func (recorder *Recorder) record() {
-	for result := range recorder.RecordChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_record.record", recorder.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, recorder.ProcUtil, recorder.PostProcessChannel)
+			go recorder.record()
+		})
+	for result = range recorder.RecordChannel {
 		if result.ProcessedItemId != 0 {
 			// This bag was ingested through APTrust.
 			// Do we want to try this multiple times?
@@ -213,7 +235,13 @@ func (recorder *Recorder) record() {
 }
 
 func (recorder *Recorder) postProcess() {
-	for result := range recorder.PostProcessChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_record.post_process", recorder.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, recorder.ProcUtil, nil)
+			go recorder.postProcess()
+		})
+	for result = range recorder.PostProcessChannel {
 		if result.ErrorMessage != "" {
 			// Something went wrong
 			if result.Retry == false {
@@ -225,20 +253,17 @@ func (recorder *Recorder) postProcess() {
 				recorder.ProcUtil.MessageLog.Error(
 					"Record failure for bag %s; will requeue. ErrorMessage: %s",
 					result.DPNBag.UUID, result.ErrorMessage)
-				if result.NsqMessage != nil {
-					result.NsqMessage.Requeue(1 * time.Minute)
-				}
-			}
-			if result.NsqMessage == nil {
-				recorder.WaitGroup.Done()
 			}
 			// Tell Fluctus it didn't work
 			processedItem := result.processStatus
 			if processedItem != nil {
 				processedItem.SetNodePidState(result, recorder.ProcUtil.MessageLog)
-				processedItem.Date = time.Now()
+				processedItem.Date = bagman.NowUTC()
 				processedItem.Stage = "Record"
 				processedItem.Status = "Failed"
+				if result.Retry == false {
+					processedItem.SetOutcome(bagman.OutcomeFailure, "")
+				}
 				processedItem.Node = ""
 				processedItem.Pid = 0
 				recorder.ProcUtil.MessageLog.Debug(processedItem.Note)
@@ -250,10 +275,10 @@ func (recorder *Recorder) postProcess() {
 			}
 			// Make sure to tell the queue we're done with this,
 			// or it sits in the in-flight state forever.
-			if result.NsqMessage == nil {
-				recorder.WaitGroup.Done()
-			} else {
+			if result.Retry == false {
 				result.NsqMessage.Finish()
+			} else {
+				result.NsqMessage.Requeue(1 * time.Minute)
 			}
 			continue
 		} else {
@@ -270,24 +295,20 @@ func (recorder *Recorder) postProcess() {
 		// If no errors, and the storage result was sent,
 		// we're at the end of the line here.
 		// All processing is done.
-		if result.NsqMessage == nil {
-			recorder.WaitGroup.Done()
+		if result.TransferRequest == nil {
+			// Local bag
+			recorder.ProcUtil.MessageLog.Info(
+				"Ingest complete for bag %s from %s",
+				result.DPNBag.UUID, result.DPNBag.AdminNode)
 		} else {
-			if result.TransferRequest == nil {
-				// Local bag
+			// Replicated bag
+			if result.TransferRequest.Status == "Stored" {
 				recorder.ProcUtil.MessageLog.Info(
-					"Ingest complete for bag %s from %s",
-					result.DPNBag.UUID, result.DPNBag.AdminNode)
-			} else {
-				// Replicated bag
-				if result.TransferRequest.Status == "Stored" {
-					recorder.ProcUtil.MessageLog.Info(
-						"Replication complete for bag %s from %s",
-						result.TransferRequest.BagId, result.TransferRequest.FromNode)
-				}
+					"Replication complete for bag %s from %s",
+					result.TransferRequest.BagId, result.TransferRequest.FromNode)
 			}
-			result.NsqMessage.Finish()
 		}
+		result.NsqMessage.Finish()
 	}
 }
 
@@ -330,7 +351,7 @@ func (recorder *Recorder) registerNewDPNBag(result *DPNResult) {
 	}
 	// The DPN Rails service does not apply timestamps,
 	// so we have to do it.
-	now := time.Now().UTC()
+	now := bagman.NowUTC()
 	result.DPNBag.CreatedAt = now
 	result.DPNBag.UpdatedAt = now
 	recorder.ProcUtil.MessageLog.Debug("Creating new DPN bag %s (%s) in local registry.",
@@ -388,21 +409,28 @@ func (recorder *Recorder) ensureBagMember(result *DPNResult) {
 // bag was ingested into DPN, and another that gives the DPN identifier.
 // Bags ingested at APTrust should always have processStatus.
 func (recorder *Recorder) recordPremisEvents(result *DPNResult) {
-	now := time.Now()
+	now := bagman.NowUTC()
 	recorder.ProcUtil.MessageLog.Debug("Creating ingest PREMIS event for bag %s (%s)",
 		result.DPNBag.UUID, result.BagIdentifier)
+	detail := fmt.Sprintf("Item ingested into DPN with id %s at request of %s",
+		result.DPNBag.UUID, result.processStatus.User)
+	if result.DPNBag.Version > 1 {
+		// Re-ingested object. Say which bag this one supersedes.
+		detail = fmt.Sprintf("Item ingested into DPN with id %s as version %d "+
+			"of %s at request of %s", result.DPNBag.UUID, result.DPNBag.Version,
+			result.DPNBag.FirstVersionUUID, result.processStatus.User)
+	}
 	ingestUuid := uuid.NewV4()
 	ingestEvent := &bagman.PremisEvent{
 		Identifier:         ingestUuid.String(),
 		EventType:          "ingest",
 		DateTime:           now,
-		Detail:             fmt.Sprintf("Item ingested into DPN with id %s at request of %s",
-			result.DPNBag.UUID, result.processStatus.User),
+		Detail:             detail,
 		Outcome:            string(bagman.StatusSuccess),
 		OutcomeDetail:      result.DPNBag.UUID,
 		Object:             "Go uuid library + goamz S3 library",
 		Agent:              "https://github.com/satori/go.uuid",
-		OutcomeInformation: result.DPNBag.UUID,
+		OutcomeInformation: bagman.VersionedOutcome(result.DPNBag.UUID),
 	}
 
 	savedIngestEvent, err := recorder.ProcUtil.FluctusClient.PremisEventSave(
@@ -430,7 +458,7 @@ func (recorder *Recorder) recordPremisEvents(result *DPNResult) {
 		OutcomeDetail:      result.StorageURL,
 		Object:             "Go uuid library + APTrust DPN services",
 		Agent:              "https://github.com/satori/go.uuid",
-		OutcomeInformation: fmt.Sprintf("DPN bag stored at %s", result.StorageURL),
+		OutcomeInformation: bagman.VersionedOutcome(fmt.Sprintf("DPN bag stored at %s", result.StorageURL)),
 	}
 
 	savedIdEvent, err := recorder.ProcUtil.FluctusClient.PremisEventSave(
@@ -476,9 +504,10 @@ func (recorder *Recorder) createReplicationRequests(result *DPNResult) {
 }
 
 func (recorder *Recorder) updateProcessedItem(result *DPNResult) {
-	result.processStatus.Date = time.Now()
+	result.processStatus.Date = bagman.NowUTC()
 	result.processStatus.Stage = "Record"
 	result.processStatus.Status = "Success"
+	result.processStatus.SetOutcome(bagman.OutcomeSuccess, "")
 	result.processStatus.Note = fmt.Sprintf("DPN bag stored at %s", result.StorageURL)
 	result.processStatus.SetNodePidState(result, recorder.ProcUtil.MessageLog)
 	result.processStatus.Node = ""
@@ -506,6 +535,28 @@ func (recorder *Recorder) CreateSymLink(result *DPNResult, toNode string) (strin
 		return "", detailedError
 	}
 
+	// If we're retrying, the symlink from an earlier attempt may
+	// already be there. That's fine, as long as it points to our bag.
+	if fileInfo, err := os.Lstat(symLink); err == nil {
+		if fileInfo.Mode() & os.ModeSymlink == 0 {
+			return "", fmt.Errorf("Cannot create symlink at '%s': " +
+				"a file that is not a symlink already exists there", symLink)
+		}
+		target, err := os.Readlink(symLink)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read existing symlink at '%s': %v",
+				symLink, err)
+		}
+		if target != result.PackageResult.TarFilePath {
+			return "", fmt.Errorf("Symlink at '%s' already exists and points " +
+				"to '%s' instead of '%s'", symLink, target,
+				result.PackageResult.TarFilePath)
+		}
+		recorder.ProcUtil.MessageLog.Debug("Symlink '%s' already points to '%s'",
+			symLink, target)
+		return symLink, nil
+	}
+
 	err = os.Symlink(result.PackageResult.TarFilePath, symLink)
 	if err != nil {
 		detailedError := fmt.Errorf("Error creating symlink at '%s' pointing to '%s': %v",
@@ -516,35 +567,7 @@ func (recorder *Recorder) CreateSymLink(result *DPNResult, toNode string) (strin
 }
 
 func (recorder *Recorder) MakeReplicationTransfer(result *DPNResult, toNode string) (*DPNReplicationTransfer) {
-	// Sample rsync link:
-	// dpn.tdr@devops.aptrust.org:outbound/472218b3-95ce-4b8e-6c21-6e514cfbe43f.tar
-	hostname, _ := os.Hostname()
-	// We should get an fully qualified host name here, but we
-	// have to account for Ansible sometimes hosing our hostname
-	// with an internal name.
-	lc_hostname := strings.ToLower(hostname)
-	if lc_hostname == "dpn" || lc_hostname == "dpn-prod" {
-		hostname = "dpn.aptrust.org"
-	} else if lc_hostname == "dpn-demo" {
-		hostname = "dpn-demo.aptrust.org"
-	}
-	link := fmt.Sprintf("dpn.%s@%s:outbound/%s.tar",
-		toNode, hostname, result.DPNBag.UUID)
-	now := time.Now().UTC().Truncate(time.Second)
-	return &DPNReplicationTransfer{
-		ReplicationId: uuid.NewV4().String(),
-		FromNode: recorder.DPNConfig.LocalNode,
-		ToNode: toNode,
-		BagId: result.DPNBag.UUID,
-		FixityAlgorithm: "sha256",
-		FixityNonce: nil,
-		FixityValue: nil,
-		Status: "requested",
-		Protocol: "rsync",
-		Link: link,
-		CreatedAt: now,
-		UpdatedAt: now,
-	}
+	return NewReplicationTransfer(recorder.DPNConfig.LocalNode, toNode, result.DPNBag.UUID)
 }
 
 // Tell the remote node that we succeeded or failed in copying
@@ -586,14 +609,7 @@ func (recorder *Recorder) RecordCopyReceipt(result *DPNResult) {
 
 	// Update the transfer request and send it back to the remote node.
 	// We'll get an updated transfer request back from that node.
-	bagValid := result.ValidationResult.IsValid()
-	result.TransferRequest.Status = "received"
-	result.TransferRequest.BagValid = &bagValid
-	// A.D. 11/23/2015:
-	// Use the tag manifest checksum instead of result.BagSha256Digest
-	// which is the digest calculated on the entire bag.
-	digest := result.ValidationResult.TagManifestChecksum
-	result.TransferRequest.FixityValue = &digest
+	result.PrepareCopyReceipt()
 
 	detailedMessage := fmt.Sprintf("xfer request %s status for bag %s " +
 		"from remote node %s. " +
@@ -610,7 +626,7 @@ func (recorder *Recorder) RecordCopyReceipt(result *DPNResult) {
 
 	// Ok, our update made it through
 	result.TransferRequest = xfer
-	result.RecordResult.CopyReceiptSentAt = time.Now()
+	result.RecordResult.CopyReceiptSentAt = bagman.NowUTC()
 
 	if xfer.FixityAccept == nil || *xfer.FixityAccept == false {
 		fixityAccept := "null"
@@ -685,18 +701,21 @@ func (recorder *Recorder) RecordStorageResult(result *DPNResult) {
 
 	// Ok, our update made it through
 	result.TransferRequest = xfer
-	result.RecordResult.StorageResultSentAt = time.Now()
+	result.RecordResult.StorageResultSentAt = bagman.NowUTC()
 
 	recorder.ProcUtil.MessageLog.Debug("Remote node updated xfer request %s (bag %s), " +
 		"and set status to %s", xfer.ReplicationId, xfer.BagId, xfer.Status)
 }
 
 func (recorder *Recorder) RunTest(result *DPNResult) {
-	recorder.WaitGroup.Add(1)
-	recorder.ProcUtil.MessageLog.Info("Putting %s into record channel",
-		result.DPNBag.UUID)
-	recorder.RecordChannel <- result
-	recorder.WaitGroup.Wait()
+	err := runSynchronously(result, recorder.ProcUtil.Config.DPNRecordWorker, func() {
+		recorder.ProcUtil.MessageLog.Info("Putting %s into record channel",
+			result.DPNBag.UUID)
+		recorder.RecordChannel <- result
+	})
+	if err != nil {
+		recorder.ProcUtil.MessageLog.Error("%v", err)
+	}
 	if result.ErrorMessage != "" {
 		recorder.ProcUtil.MessageLog.Error("Failed :( %s", result.ErrorMessage)
 		recorder.ProcUtil.MessageLog.Error("Record failed.")
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/APTrust/bagman/dpn"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -117,7 +118,6 @@ func buildLocalResult(t *testing.T, recorder *dpn.Recorder) (*dpn.DPNResult) {
 		Stage: "Requested",
 		Status: "Pending",
 		Note: "Requested...",
-		Outcome: "Requested...",
 		Retry: true,
 	}
 	err := recorder.ProcUtil.FluctusClient.UpdateProcessedItem(ps)
@@ -241,3 +241,46 @@ func TestReplicatedBag(t *testing.T) {
 		t.Errorf("StorageResultSentAt was not set")
 	}
 }
+
+func TestCreateSymLinkTwice(t *testing.T) {
+	dpnHome, err := ioutil.TempDir("", "recorder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dpnHome)
+	recorder := &dpn.Recorder{
+		ProcUtil: &bagman.ProcessUtil{
+			Config:     bagman.Config{DPNHomeDirectory: dpnHome},
+			MessageLog: bagman.DiscardLogger("recorder_test"),
+		},
+	}
+	result := dpn.NewDPNResult("test.edu/test.edu.bag6")
+	result.DPNBag = &dpn.DPNBag{UUID: "6c7fc2a7-5a30-4d3b-a7a6-6b5f5b0b9f11"}
+	result.PackageResult.TarFilePath = filepath.Join(dpnHome, result.DPNBag.UUID + ".tar")
+
+	firstLink, err := recorder.CreateSymLink(result, "chron")
+	if err != nil {
+		t.Fatalf("First call to CreateSymLink failed: %v", err)
+	}
+	// A retry should find the existing link and succeed.
+	secondLink, err := recorder.CreateSymLink(result, "chron")
+	if err != nil {
+		t.Errorf("Second call to CreateSymLink failed: %v", err)
+	}
+	if secondLink != firstLink {
+		t.Errorf("Second call returned '%s', expected '%s'", secondLink, firstLink)
+	}
+
+	// A link pointing somewhere else is an error.
+	result.PackageResult.TarFilePath = filepath.Join(dpnHome, "some_other_bag.tar")
+	if _, err = recorder.CreateSymLink(result, "chron"); err == nil {
+		t.Errorf("CreateSymLink should fail when the existing link has a different target")
+	}
+
+	// So is a regular file.
+	os.Remove(firstLink)
+	ioutil.WriteFile(firstLink, []byte("not a link"), 0644)
+	if _, err = recorder.CreateSymLink(result, "chron"); err == nil {
+		t.Errorf("CreateSymLink should fail when a regular file is in the way")
+	}
+}
@@ -0,0 +1,132 @@
+package dpn
+
+import (
+	"fmt"
+	"github.com/satori/go.uuid"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// NewReplicationTransfer returns a new replication request asking
+// toNode to copy the bag with the specified UUID from fromNode.
+// The link tells the remote node where to rsync the bag from, so
+// the bag must be linked into the remote node's outbound directory
+// (see Recorder.CreateSymLink) before the node tries to copy it.
+func NewReplicationTransfer(fromNode, toNode, bagUUID string) (*DPNReplicationTransfer) {
+	// Sample rsync link:
+	// dpn.tdr@devops.aptrust.org:outbound/472218b3-95ce-4b8e-6c21-6e514cfbe43f.tar
+	hostname, _ := os.Hostname()
+	// We should get an fully qualified host name here, but we
+	// have to account for Ansible sometimes hosing our hostname
+	// with an internal name.
+	lc_hostname := strings.ToLower(hostname)
+	if lc_hostname == "dpn" || lc_hostname == "dpn-prod" {
+		hostname = "dpn.aptrust.org"
+	} else if lc_hostname == "dpn-demo" {
+		hostname = "dpn-demo.aptrust.org"
+	}
+	link := fmt.Sprintf("dpn.%s@%s:outbound/%s.tar",
+		toNode, hostname, bagUUID)
+	now := time.Now().UTC().Truncate(time.Second)
+	return &DPNReplicationTransfer{
+		ReplicationId: uuid.NewV4().String(),
+		FromNode: fromNode,
+		ToNode: toNode,
+		BagId: bagUUID,
+		FixityAlgorithm: "sha256",
+		FixityNonce: nil,
+		FixityValue: nil,
+		Status: "requested",
+		Protocol: "rsync",
+		Link: link,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// FindUnderReplicatedBags returns the bags administered by this
+// client's node that are replicated to fewer than minNodes nodes.
+// A scheduled job can pass these to CreateMissingReplicationTransfers
+// to fix bags whose replication requests failed or were never made.
+func (client *DPNRestClient) FindUnderReplicatedBags(minNodes int) ([]*DPNBag, error) {
+	underReplicated := make([]*DPNBag, 0)
+	for pageNumber := 1; ; pageNumber++ {
+		result, err := client.DPNBagListGetFiltered(&DPNBagFilter{
+			AdminNode: client.Node,
+			Page:      pageNumber,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, bag := range result.Results {
+			if bag.AdminNode == client.Node && len(bag.ReplicatingNodes) < minNodes {
+				underReplicated = append(underReplicated, bag)
+			}
+		}
+		if result.Next == nil || *result.Next == "" {
+			break
+		}
+	}
+	return underReplicated, nil
+}
+
+// CreateMissingReplicationTransfers creates enough replication
+// requests for bag to bring it up to minNodes copies, counting nodes
+// that already replicate the bag and nodes with a replication request
+// still in progress. It chooses nodes from our node's ReplicateTo
+// list, in order, and returns the requests it created. As with the
+// requests the recorder creates at ingest, the caller must make sure
+// the bag is available at each request's link.
+func (client *DPNRestClient) CreateMissingReplicationTransfers(bag *DPNBag, minNodes int) ([]*DPNReplicationTransfer, error) {
+	created := make([]*DPNReplicationTransfer, 0)
+	localNode, err := client.DPNNodeGet(client.Node)
+	if err != nil {
+		return nil, fmt.Errorf("Can't create replication requests for bag %s: "+
+			"unable to get info about our node. %v", bag.UUID, err)
+	}
+	params := url.Values{}
+	params.Set("uuid", bag.UUID)
+	params.Set("from_node", client.Node)
+	existing, err := client.DPNReplicationListGet(&params)
+	if err != nil {
+		return nil, fmt.Errorf("Can't get replication requests for bag %s: %v",
+			bag.UUID, err)
+	}
+	// Nodes that have the bag, or are working on it.
+	// We don't want to ask any of these again.
+	hasCopy := make(map[string]bool)
+	hasCopy[client.Node] = true
+	for _, namespace := range bag.ReplicatingNodes {
+		hasCopy[namespace] = true
+	}
+	for _, xfer := range existing.Results {
+		if xfer.BagId == bag.UUID && xfer.Status != "rejected" && xfer.Status != "cancelled" {
+			hasCopy[xfer.ToNode] = true
+		}
+	}
+	// hasCopy includes our own node, which doesn't count.
+	needed := minNodes - (len(hasCopy) - 1)
+	for _, toNode := range localNode.ReplicateTo {
+		if needed <= 0 {
+			break
+		}
+		if hasCopy[toNode] {
+			continue
+		}
+		xfer := NewReplicationTransfer(client.Node, toNode, bag.UUID)
+		savedXfer, err := client.ReplicationTransferCreate(xfer)
+		if err != nil {
+			return created, err
+		}
+		created = append(created, savedXfer)
+		hasCopy[toNode] = true
+		needed--
+	}
+	if needed > 0 {
+		return created, fmt.Errorf("Bag %s needs %d more replicating nodes, but there "+
+			"are no more nodes to replicate to", bag.UUID, needed)
+	}
+	return created, nil
+}
@@ -0,0 +1,201 @@
+package dpn_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagman/bagman"
+	"github.com/APTrust/bagman/dpn"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockReplicationServer is a DPN REST server with a fixed set of
+// bags administered by aptrust, and existing replication requests.
+// It records the replication requests that clients create.
+type mockReplicationServer struct {
+	mutex    sync.Mutex
+	bags     []*dpn.DPNBag
+	xfers    []*dpn.DPNReplicationTransfer
+	created  []*dpn.DPNReplicationTransfer
+	pageSize int
+}
+
+func (mock *mockReplicationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api-v1/node/aptrust/":
+		node := &dpn.DPNNode{
+			Namespace:   "aptrust",
+			ReplicateTo: []string{"chron", "hathi", "sdr", "tdr"},
+		}
+		json.NewEncoder(w).Encode(node)
+	case r.Method == "GET" && r.URL.Path == "/api-v1/bag/":
+		page := 1
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+		if r.URL.Query().Get("page") == "" {
+			// DPNNodeGet asks for one bag to get the last pull date.
+			json.NewEncoder(w).Encode(&dpn.BagListResult{Results: []*dpn.DPNBag{}})
+			return
+		}
+		start := (page - 1) * mock.pageSize
+		end := bagman.Min(start+mock.pageSize, len(mock.bags))
+		result := &dpn.BagListResult{
+			Count:   int32(len(mock.bags)),
+			Results: mock.bags[start:end],
+		}
+		if end < len(mock.bags) {
+			next := fmt.Sprintf("/api-v1/bag/?page=%d", page+1)
+			result.Next = &next
+		}
+		json.NewEncoder(w).Encode(result)
+	case r.Method == "GET" && r.URL.Path == "/api-v1/replicate/":
+		results := make([]*dpn.DPNReplicationTransfer, 0)
+		for _, xfer := range mock.xfers {
+			if xfer.BagId == r.URL.Query().Get("uuid") {
+				results = append(results, xfer)
+			}
+		}
+		json.NewEncoder(w).Encode(&dpn.ReplicationListResult{
+			Count:   int32(len(results)),
+			Results: results,
+		})
+	case r.Method == "POST" && r.URL.Path == "/api-v1/replicate/":
+		data, _ := ioutil.ReadAll(r.Body)
+		xfer := &dpn.DPNReplicationTransfer{}
+		if err := json.Unmarshal(data, xfer); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mock.created = append(mock.created, xfer)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func replicationTestBag(uuid string, replicatingNodes ...string) (*dpn.DPNBag) {
+	return &dpn.DPNBag{
+		UUID:             uuid,
+		AdminNode:        "aptrust",
+		IngestNode:       "aptrust",
+		ReplicatingNodes: replicatingNodes,
+	}
+}
+
+func getReplicationClient(t *testing.T, mock *mockReplicationServer) (*dpn.DPNRestClient, *httptest.Server) {
+	server := httptest.NewServer(mock)
+	client, err := dpn.NewDPNRestClient(server.URL, "api-v1", "token", "aptrust",
+		&dpn.DPNConfig{}, bagman.DiscardLogger("replication_test"))
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestFindUnderReplicatedBags(t *testing.T) {
+	mock := &mockReplicationServer{
+		pageSize: 2,
+		bags: []*dpn.DPNBag{
+			replicationTestBag("below-none"),
+			replicationTestBag("below-one", "chron"),
+			replicationTestBag("at-minimum", "chron", "hathi"),
+			replicationTestBag("above-minimum", "chron", "hathi", "sdr"),
+			replicationTestBag("below-last-page", "tdr"),
+		},
+	}
+	// Bags administered by other nodes aren't ours to replicate.
+	otherBag := replicationTestBag("someone-elses")
+	otherBag.AdminNode = "chron"
+	mock.bags = append(mock.bags, otherBag)
+
+	client, server := getReplicationClient(t, mock)
+	defer server.Close()
+	bags, err := client.FindUnderReplicatedBags(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids := make([]string, len(bags))
+	for i, bag := range bags {
+		uuids[i] = bag.UUID
+	}
+	expected := "below-none,below-one,below-last-page"
+	if strings.Join(uuids, ",") != expected {
+		t.Errorf("FindUnderReplicatedBags returned %v, expected %s", uuids, expected)
+	}
+}
+
+func TestCreateMissingReplicationTransfers(t *testing.T) {
+	mock := &mockReplicationServer{
+		xfers: []*dpn.DPNReplicationTransfer{
+			// hathi is working on it, so it counts toward
+			// the minimum. sdr gave up, so it doesn't.
+			&dpn.DPNReplicationTransfer{BagId: "below-one", ToNode: "hathi", Status: "received"},
+			&dpn.DPNReplicationTransfer{BagId: "below-one", ToNode: "sdr", Status: "cancelled"},
+		},
+	}
+	client, server := getReplicationClient(t, mock)
+	defer server.Close()
+
+	// Below the minimum, with nothing in progress.
+	xfers, err := client.CreateMissingReplicationTransfers(replicationTestBag("below-none"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xfers) != 2 || xfers[0].ToNode != "chron" || xfers[1].ToNode != "hathi" {
+		t.Errorf("Expected transfers to chron and hathi, got %v", xfers)
+	}
+	for _, xfer := range xfers {
+		if xfer.FromNode != "aptrust" || xfer.BagId != "below-none" ||
+			xfer.Status != "requested" || xfer.Protocol != "rsync" ||
+			!strings.HasSuffix(xfer.Link, ":outbound/below-none.tar") {
+			t.Errorf("Unexpected transfer %+v", xfer)
+		}
+	}
+
+	// Below the minimum, but hathi's transfer is in progress,
+	// and sdr's cancelled transfer should be retried.
+	mock.created = nil
+	xfers, err = client.CreateMissingReplicationTransfers(
+		replicationTestBag("below-one", "chron"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xfers) != 1 || xfers[0].ToNode != "sdr" {
+		t.Errorf("Expected one transfer to sdr, got %v", xfers)
+	}
+
+	// At and above the minimum: nothing to do.
+	mock.created = nil
+	for _, bag := range []*dpn.DPNBag{
+		replicationTestBag("at-minimum", "chron", "hathi"),
+		replicationTestBag("above-minimum", "chron", "hathi", "sdr"),
+	} {
+		xfers, err = client.CreateMissingReplicationTransfers(bag, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(xfers) != 0 {
+			t.Errorf("Bag %s is not under-replicated, but got transfers %v", bag.UUID, xfers)
+		}
+	}
+	if len(mock.created) != 0 {
+		t.Errorf("Server should not have received any new transfers")
+	}
+
+	// Not enough nodes to replicate to.
+	xfers, err = client.CreateMissingReplicationTransfers(
+		replicationTestBag("below-none", "chron", "hathi", "sdr"), 5)
+	if err == nil || !strings.Contains(err.Error(), "needs 1 more") {
+		t.Errorf("Expected an error about running out of nodes, got %v", err)
+	}
+	if len(xfers) != 1 || xfers[0].ToNode != "tdr" {
+		t.Errorf("Expected one transfer to tdr, got %v", xfers)
+	}
+}
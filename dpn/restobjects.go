@@ -10,6 +10,7 @@ https://github.com/dpn-admin/DPN-REST
 */
 
 import (
+	"encoding/json"
 	"math/rand"
 	"time"
 )
@@ -66,6 +67,18 @@ type DPNStorage struct {
 	Type                 string        `json:"type"`
 }
 
+// DPNHealthStatus is what a DPN REST server's status endpoint says
+// about itself. See DPNRestClient.HealthCheck.
+type DPNHealthStatus struct {
+	// The version of the DPN REST server software.
+	ServerVersion          string  `json:"server_version"`
+	// The namespace of the node that runs the server.
+	NodeNamespace          string  `json:"node"`
+	// How many replication transfers on the server are still
+	// in progress.
+	ActiveReplicationCount int     `json:"active_replications"`
+}
+
 // DPNFixity represents a checksum for a bag in the DPN REST
 // service.
 type DPNFixity struct {
@@ -153,6 +166,52 @@ type DPNBag struct {
 	UpdatedAt          time.Time            `json:"updated_at"`
 }
 
+// DPNMessageDigest is a digest that a node calculated for a bag,
+// as recorded in the DPN REST service. There should be only one
+// digest per bag, node and algorithm.
+type DPNMessageDigest struct {
+
+	// Bag is the UUID of the bag this digest belongs to.
+	Bag                string               `json:"bag"`
+
+	// Algorithm is the digest algorithm, usually 'sha256'.
+	Algorithm          string               `json:"algorithm"`
+
+	// Node is the namespace of the node that calculated the digest.
+	Node               string               `json:"node"`
+
+	// Value is the digest itself.
+	Value              string               `json:"value"`
+
+	// CreatedAt is when this record was created.
+	CreatedAt          time.Time            `json:"created_at"`
+}
+
+// DPNFixityCheck records the outcome of a node checking the fixity
+// of its stored copy of a bag.
+type DPNFixityCheck struct {
+
+	// FixityCheckId is a unique id for this check. It's a UUID
+	// in string format.
+	FixityCheckId      string               `json:"fixity_check_id"`
+
+	// Bag is the UUID of the bag that was checked.
+	Bag                string               `json:"bag"`
+
+	// Node is the namespace of the node that checked its copy.
+	Node               string               `json:"node"`
+
+	// Success is true if the stored copy matched the bag's
+	// registered digest.
+	Success            bool                 `json:"success"`
+
+	// FixityAt is when the node calculated the digest.
+	FixityAt           time.Time            `json:"fixity_at"`
+
+	// CreatedAt is when this record was created.
+	CreatedAt          time.Time            `json:"created_at"`
+}
+
 type DPNReplicationTransfer struct {
 
 	// FromNode is the node where the bag is coming from.
@@ -190,6 +249,12 @@ type DPNReplicationTransfer struct {
 	// so it has to be a pointer.
 	BagValid        *bool        `json:"bag_valid"`
 
+	// ProfileErrors lists the ways in which the bag does not conform
+	// to the DPN BagIt profile, as determined by the ToNode. This is
+	// not part of the DPN REST spec, and it's omitted when empty, so
+	// nodes that don't know about it will never see it for valid bags.
+	ProfileErrors   []string     `json:"profile_errors,omitempty"`
+
 	// Status is the status of the request, which can be any of:
 	//
 	// "requested"  - The FromNode has requested this transfer.
@@ -268,3 +333,48 @@ type DPNRestoreTransfer struct {
 	// UpdatedAt is the datetime when this record was last updated.
 	UpdatedAt       time.Time    `json:"updated_at"`
 }
+
+// The MarshalJSON methods below write timestamps in UTC, so the
+// DPN REST service always gets RFC3339 UTC, regardless of the
+// zone the time was created or parsed in.
+
+func (node *DPNNode) MarshalJSON() ([]byte, error) {
+	type dpnNode DPNNode // without this method
+	data := dpnNode(*node)
+	data.CreatedAt = data.CreatedAt.UTC()
+	data.UpdatedAt = data.UpdatedAt.UTC()
+	data.LastPullDate = data.LastPullDate.UTC()
+	return json.Marshal(data)
+}
+
+func (member *DPNMember) MarshalJSON() ([]byte, error) {
+	type dpnMember DPNMember // without this method
+	data := dpnMember(*member)
+	data.CreatedAt = data.CreatedAt.UTC()
+	data.UpdatedAt = data.UpdatedAt.UTC()
+	return json.Marshal(data)
+}
+
+func (bag *DPNBag) MarshalJSON() ([]byte, error) {
+	type dpnBag DPNBag // without this method
+	data := dpnBag(*bag)
+	data.CreatedAt = data.CreatedAt.UTC()
+	data.UpdatedAt = data.UpdatedAt.UTC()
+	return json.Marshal(data)
+}
+
+func (xfer *DPNReplicationTransfer) MarshalJSON() ([]byte, error) {
+	type dpnReplicationTransfer DPNReplicationTransfer // without this method
+	data := dpnReplicationTransfer(*xfer)
+	data.CreatedAt = data.CreatedAt.UTC()
+	data.UpdatedAt = data.UpdatedAt.UTC()
+	return json.Marshal(data)
+}
+
+func (xfer *DPNRestoreTransfer) MarshalJSON() ([]byte, error) {
+	type dpnRestoreTransfer DPNRestoreTransfer // without this method
+	data := dpnRestoreTransfer(*xfer)
+	data.CreatedAt = data.CreatedAt.UTC()
+	data.UpdatedAt = data.UpdatedAt.UTC()
+	return json.Marshal(data)
+}
@@ -1,8 +1,11 @@
 package dpn_test
 
 import (
+	"encoding/json"
 	"github.com/APTrust/bagman/dpn"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestChooseNodesForReplication(t *testing.T) {
@@ -52,3 +55,31 @@ func assertUnique(list []string) (bool, string) {
 	}
 	return true, ""
 }
+
+func TestRestObjectsMarshalUTC(t *testing.T) {
+	eastern := time.FixedZone("EST", -5 * 60 * 60)
+	localTime := time.Date(2015, 9, 1, 7, 0, 0, 0, eastern)
+	objects := []interface{}{
+		&dpn.DPNNode{CreatedAt: localTime, UpdatedAt: localTime, LastPullDate: localTime},
+		&dpn.DPNMember{CreatedAt: localTime, UpdatedAt: localTime},
+		&dpn.DPNBag{CreatedAt: localTime, UpdatedAt: localTime},
+		&dpn.DPNReplicationTransfer{CreatedAt: localTime, UpdatedAt: localTime},
+		&dpn.DPNRestoreTransfer{CreatedAt: localTime, UpdatedAt: localTime},
+	}
+	for _, obj := range objects {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "-05:00") ||
+			!strings.Contains(string(data), `"updated_at":"2015-09-01T12:00:00Z"`) {
+			t.Errorf("%T should marshal timestamps in UTC: %s", obj, string(data))
+		}
+	}
+	bag := &dpn.DPNBag{}
+	json.Unmarshal([]byte(`{"created_at":"2015-09-01T07:00:00-05:00"}`), bag)
+	data, _ := json.Marshal(bag)
+	if !strings.Contains(string(data), `"created_at":"2015-09-01T12:00:00Z"`) {
+		t.Errorf("DPNBag parsed with an offset should marshal in UTC: %s", string(data))
+	}
+}
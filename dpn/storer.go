@@ -8,7 +8,6 @@ import (
 	"github.com/crowdmob/goamz/s3"
 	"os"
 	"path/filepath"
-	"sync"
 	"time"
 )
 
@@ -20,8 +19,6 @@ type Storer struct {
 	ProcUtil            *bagman.ProcessUtil
 	DPNConfig           *DPNConfig
 	LocalRESTClient     *DPNRestClient
-	// WaitGroup is for running local tests only.
-	WaitGroup           sync.WaitGroup
 }
 
 func NewStorer(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Storer, error) {
@@ -60,11 +57,18 @@ func NewStorer(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Storer, err
 
 func (storer *Storer) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return storer.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (storer *Storer) ProcessMessage(message bagman.Message) error {
 	result := &DPNResult{}
-	err := json.Unmarshal(message.Body, result)
+	err := json.Unmarshal(message.Body(), result)
 	if err != nil {
 		storer.ProcUtil.MessageLog.Error("Could not unmarshal JSON data from nsq:",
-			string(message.Body))
+			string(message.Body()))
 		message.Finish()
 		return fmt.Errorf("Could not unmarshal JSON data from nsq")
 	}
@@ -89,10 +93,14 @@ func (storer *Storer) HandleMessage(message *nsq.Message) error {
 }
 
 func (storer *Storer) store() {
-	for result := range storer.StorageChannel {
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_store.store", storer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, storer.ProcUtil, storer.PostProcessChannel)
+			go storer.store()
+		})
+	for result = range storer.StorageChannel {
+		result.NsqMessage.Touch()
 
 		// By the time we get our hands on this replication request,
 		// it may be many hours old. Fetch the request again from the
@@ -196,9 +204,7 @@ func (storer *Storer) store() {
 			continue
 		}
 
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 
 		// This channel really only applies to bags we created
 		// at our own node. (Not replication requests.)
@@ -259,7 +265,13 @@ func (storer *Storer) makeReplicationRequest(result *DPNResult, whatKind string)
 }
 
 func (storer *Storer) createBagRecord() {
-	for result := range storer.BagCreateChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_store.create_bag_record", storer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, storer.ProcUtil, storer.CleanupChannel)
+			go storer.createBagRecord()
+		})
+	for result = range storer.BagCreateChannel {
 		// If result has a local identifier, it's a bag we created
 		// here at the local node (as opposed to a bag we're just
 		// replicating to fulfill a transfer request). Since we
@@ -282,12 +294,18 @@ func (storer *Storer) createBagRecord() {
 				storer.CleanupChannel <- result
 				continue
 			}
+			builder := result.PackageResult.BagBuilder
+			version, firstVersionUUID := builder.Version, builder.FirstVersionUUID
+			if version == 0 {
+				// Packaged before the packager knew about versions.
+				version, firstVersionUUID = 1, builder.UUID
+			}
 			newBag := &DPNBag{
-				UUID: result.PackageResult.BagBuilder.UUID,
+				UUID: builder.UUID,
 				LocalId: result.BagIdentifier,
 				Size: uint64(fileInfo.Size()),
-				FirstVersionUUID: result.PackageResult.BagBuilder.UUID,
-				Version: 1,
+				FirstVersionUUID: firstVersionUUID,
+				Version: version,
 				IngestNode: storer.DPNConfig.LocalNode,
 				AdminNode: storer.DPNConfig.LocalNode,
 				BagType: "D",
@@ -305,14 +323,19 @@ func (storer *Storer) createBagRecord() {
 }
 
 func (storer *Storer) cleanup() {
-	for result := range storer.CleanupChannel {
-		thisIsNotATest := (result.NsqMessage != nil)
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_store.cleanup", storer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, storer.ProcUtil, storer.PostProcessChannel)
+			go storer.cleanup()
+		})
+	for result = range storer.CleanupChannel {
 		storageSucceeded := (result.ErrorMessage == "" && result.StorageURL != "")
 		// If this bag came from another node, we can delete it after storing it.
 		// If it came from our node, we need to keep it around until it's been
 		// replicated.
 		thisBagCameFromAnotherNode := (result.ProcessedItemId == 0)
-		if storageSucceeded && thisIsNotATest && thisBagCameFromAnotherNode {
+		if storageSucceeded && thisBagCameFromAnotherNode {
 			err := os.Remove(result.TarFilePath())
 			if err != nil {
 				storer.ProcUtil.MessageLog.Warning("Error cleaning up %s: %v",
@@ -329,7 +352,13 @@ func (storer *Storer) cleanup() {
 
 
 func (storer *Storer) postProcess() {
-	for result := range storer.PostProcessChannel {
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_store.post_process", storer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, storer.ProcUtil, nil)
+			go storer.postProcess()
+		})
+	for result = range storer.PostProcessChannel {
 		bagIdentifier := result.BagIdentifier
 		if bagIdentifier == "" {
 			bagIdentifier = result.DPNBag.UUID
@@ -340,32 +369,24 @@ func (storer *Storer) postProcess() {
 				bagIdentifier, result.StorageURL)
 			storer.ProcUtil.IncrementSucceeded()
 			// Send to queue for recording in Fluctus and/or DPN REST
-			if result.NsqMessage != nil {
-				result.NsqMessage.Finish()
-				SendToRecordQueue(result, storer.ProcUtil)
-			}
+			result.NsqMessage.Finish()
+			SendToRecordQueue(result, storer.ProcUtil)
 		} else {
 			// FAILURE :(
 			storer.ProcUtil.MessageLog.Error(result.ErrorMessage)
 			storer.ProcUtil.IncrementFailed()
 			// Item failed after max attempts. Put in trouble queue
 			// for admin review.
-			if result.NsqMessage != nil {
-				if result.NsqMessage.Attempts >= uint16(storer.ProcUtil.Config.DPNStoreWorker.MaxAttempts) {
-					// No more retries
-					result.NsqMessage.Finish()
-					SendToTroubleQueue(result, storer.ProcUtil)
-				} else {
-					storer.ProcUtil.MessageLog.Info("Requeuing %s (%s)",
-						bagIdentifier, result.TarFilePath())
-					result.NsqMessage.Requeue(1 * time.Minute)
-				}
+			if result.NsqMessage.Attempts() >= uint16(storer.ProcUtil.Config.DPNStoreWorker.MaxAttempts) {
+				// No more retries
+				result.NsqMessage.Finish()
+				SendToTroubleQueue(result, storer.ProcUtil)
+			} else {
+				storer.ProcUtil.MessageLog.Info("Requeuing %s (%s)",
+					bagIdentifier, result.TarFilePath())
+				result.NsqMessage.Requeue(1 * time.Minute)
 			}
 		}
-		if result.NsqMessage == nil {
-			// This is a test message, running outside production.
-			storer.WaitGroup.Done()
-		}
 	}
 }
 
@@ -385,10 +406,13 @@ func (storer *Storer) GetS3Options(result *DPNResult) (s3.Options, error) {
 }
 
 func (storer *Storer) RunTest(result *DPNResult) {
-	storer.WaitGroup.Add(1)
-	storer.ProcUtil.MessageLog.Info("Putting %s into digest channel",
-		result.BagIdentifier)
-	storer.StorageChannel <- result
-	storer.WaitGroup.Wait()
+	err := runSynchronously(result, storer.ProcUtil.Config.DPNStoreWorker, func() {
+		storer.ProcUtil.MessageLog.Info("Putting %s into digest channel",
+			result.BagIdentifier)
+		storer.StorageChannel <- result
+	})
+	if err != nil {
+		storer.ProcUtil.MessageLog.Error("%v", err)
+	}
 	fmt.Println("Storer is done")
 }
@@ -9,7 +9,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sync"
 	"time"
 )
 
@@ -21,8 +20,6 @@ import (
 // information about every stage of the ingest process.
 type TroubleProcessor struct {
 	ProcUtil *bagman.ProcessUtil
-	// WaitGroup is for running local tests only.
-	WaitGroup           sync.WaitGroup
 }
 
 func NewTroubleProcessor(procUtil *bagman.ProcessUtil) (*TroubleProcessor) {
@@ -32,12 +29,19 @@ func NewTroubleProcessor(procUtil *bagman.ProcessUtil) (*TroubleProcessor) {
 }
 
 func (troubleProcessor *TroubleProcessor) HandleMessage(message *nsq.Message) error {
+	return troubleProcessor.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage dumps the DPNResult in the message to a JSON file.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (troubleProcessor *TroubleProcessor) ProcessMessage(message bagman.Message) error {
 	result := &DPNResult{}
-	err := json.Unmarshal(message.Body, &result)
+	err := json.Unmarshal(message.Body(), &result)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		troubleProcessor.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -88,20 +92,35 @@ func (troubleProcessor *TroubleProcessor) dumpToFile(result *DPNResult) error {
 	if err != nil {
 		panic(err)
 	}
-	if result.NsqMessage != nil {
-		result.NsqMessage.Finish()
-	} else {
-		troubleProcessor.WaitGroup.Done()
-	}
+	troubleProcessor.writeReport(result, filePath + ".report.json")
+	result.NsqMessage.Finish()
 	return nil
 }
 
+// writeReport saves a failure report next to the JSON dump, so
+// admins can see what went wrong and what to do about it without
+// reading the whole result. apt_triage summarizes these reports.
+func (troubleProcessor *TroubleProcessor) writeReport(result *DPNResult, filePath string) {
+	report := result.FailureReport()
+	troubleProcessor.ProcUtil.MessageLog.Warning("DPN bag %s failed in %s stage (%s): %s Suggested action: %s",
+		report.Bag, report.Stage, report.Classification, report.Error, report.Remediation)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filePath, data, 0644)
+	}
+	if err != nil {
+		troubleProcessor.ProcUtil.MessageLog.Error("Cannot write failure report for %s: %v",
+			report.Bag, err)
+	}
+}
+
 func (troubleProcessor *TroubleProcessor) updateProcessedItem(result *DPNResult) {
 	if result.processStatus == nil {
 		return
 	}
-	result.processStatus.Date = time.Now()
+	result.processStatus.Date = bagman.NowUTC()
 	result.processStatus.Status = "Failed"
+	result.processStatus.SetOutcome(bagman.OutcomeFailure, "")
 	result.processStatus.Note = result.ErrorMessage
 	result.processStatus.SetNodePidState(result, troubleProcessor.ProcUtil.MessageLog)
 	result.processStatus.Node = ""
@@ -115,8 +134,11 @@ func (troubleProcessor *TroubleProcessor) updateProcessedItem(result *DPNResult)
 
 
 func (troubleProcessor *TroubleProcessor) RunTest(result *DPNResult) {
-	troubleProcessor.WaitGroup.Add(1)
-	troubleProcessor.dumpToFile(result)
-	troubleProcessor.WaitGroup.Wait()
+	err := runSynchronously(result, troubleProcessor.ProcUtil.Config.DPNTroubleWorker, func() {
+		troubleProcessor.dumpToFile(result)
+	})
+	if err != nil {
+		troubleProcessor.ProcUtil.MessageLog.Error("%v", err)
+	}
 	fmt.Println("TroubleProcessor is done")
 }
@@ -1,11 +1,9 @@
 package dpn
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
+	"github.com/APTrust/bagman/bagman"
 	"github.com/op/go-logging"
-	"io"
 	"os"
 )
 
@@ -24,19 +22,27 @@ func GetRemoteClients(localClient *DPNRestClient, config *DPNConfig, logger *log
 }
 
 // Run the sha256 checksum on the bag we just copied from the remote node.
+// If we've already checksummed the file and it hasn't changed,
+// this returns the cached digest.
 func CalculateSha256Digest(filePath string) (string, error) {
+	if cached := bagman.ChecksumCache.Lookup(filePath); cached != nil {
+		return cached.Sha256Digest, nil
+	}
 	src, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer src.Close()
-	shaHash := sha256.New()
-	_, err = io.Copy(shaHash, src)
+	digester, err := bagman.NewMultiDigestWriter(bagman.DEFAULT_DIGEST_BUFFER_SIZE, bagman.DigestSha256)
+	if err != nil {
+		return "", err
+	}
+	_, err = digester.Copy(nil, src)
 	if err != nil {
 		detailedError := fmt.Errorf("Error calculating sha256 on %s: %v",
 			filePath, err)
 		return "", detailedError
 	}
-	return hex.EncodeToString(shaHash.Sum(nil)), nil
+	return digester.Sum(bagman.DigestSha256), nil
 
 }
@@ -6,12 +6,10 @@ import (
 	"fmt"
 	"github.com/APTrust/bagins"
 	"github.com/APTrust/bagman/bagman"
-	"github.com/nsqio/go-nsq"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
 )
 
@@ -84,7 +82,7 @@ type ValidationResult struct {
 	// outside of production. In production, we need to touch the
 	// message periodically to keep it from timing out, especially
 	// on very large bags.
-	NsqMessage           *nsq.Message    `json:"-"`
+	NsqMessage           bagman.Message  `json:"-"`
 
 	// TagManifestChecksum is the sha256 digest (calculated with a nonce)
 	// that we need to send back to the originating node as a receipt
@@ -92,6 +90,16 @@ type ValidationResult struct {
 	// replication requests, we don't need to even calculate this value.
 	TagManifestChecksum  string
 
+	// BagItProfile is the profile to validate the bag against.
+	// If this is nil, we skip the profile check. The Validator
+	// loads it once, from DPNConfig.BagItProfileURL.
+	BagItProfile         *BagItProfile   `json:"-"`
+
+	// ProfileErrors lists the ways in which the bag does not
+	// conform to the BagIt profile. If this list is not empty,
+	// the bag is invalid.
+	ProfileErrors        []string
+
 	// ErrorMessages contains a list of everything that's wrong with the
 	// bag. If this list is empty, the bag is valid.
 	ErrorMessages        []string
@@ -100,7 +108,7 @@ type ValidationResult struct {
 	Warnings             []string
 }
 
-func NewValidationResult(pathToFile string, nsqMessage *nsq.Message) (*ValidationResult, error) {
+func NewValidationResult(pathToFile string, message bagman.Message) (*ValidationResult, error) {
 	absPath, err := filepath.Abs(pathToFile)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot determine absolute path from '%s': %v",
@@ -113,12 +121,12 @@ func NewValidationResult(pathToFile string, nsqMessage *nsq.Message) (*Validatio
 	if strings.HasSuffix(absPath, ".tar") {
 		validator = &ValidationResult{
 			TarFilePath: absPath,
-			NsqMessage: nsqMessage,
+			NsqMessage: message,
 		}
 	} else {
 		validator = &ValidationResult{
 			UntarredPath: absPath,
-			NsqMessage: nsqMessage,
+			NsqMessage: message,
 		}
 	}
 	return validator, nil
@@ -126,7 +134,7 @@ func NewValidationResult(pathToFile string, nsqMessage *nsq.Message) (*Validatio
 
 // IsValid() returns true if the bag is valid.
 func (validator *ValidationResult) IsValid() (bool) {
-	return len(validator.ErrorMessages) == 0
+	return len(validator.ErrorMessages) == 0 && len(validator.ProfileErrors) == 0
 }
 
 // AddError adds a message to the list of validation errors.
@@ -154,9 +162,7 @@ func (validator *ValidationResult) ValidateBag()  {
 		validator.AddError("Bag name is not valid. It should be a UUID.")
 		return
 	}
-	if validator.NsqMessage != nil {
-		validator.NsqMessage.Touch()
-	}
+	validator.NsqMessage.Touch()
 	if validator.TarFilePath != "" && validator.UntarredPath == "" {
 		if validator.untar() == false {
 			return
@@ -164,8 +170,12 @@ func (validator *ValidationResult) ValidateBag()  {
 	}
 	// Untar can take a long time on large bags.
 	// Let NSQ know we're still working on it.
-	if validator.NsqMessage != nil {
-		validator.NsqMessage.Touch()
+	validator.NsqMessage.Touch()
+
+	// Check the bag's structure and tags against the DPN BagIt
+	// profile before we spend time on checksums.
+	if validator.BagItProfile != nil {
+		validator.ProfileErrors = validator.BagItProfile.Validate(validator.UntarredPath)
 	}
 
 	if validator.tagManifestPresent() == false {
@@ -191,11 +201,6 @@ func (validator *ValidationResult) ValidateBag()  {
 		validator.AddError(fmt.Sprintf("Could not list bag files: %v ", err))
 	}
 
-	dataDirPrefix := "data/"
-	if runtime.GOOS == "windows" {
-		dataDirPrefix = "data\\"
-	}
-
 	hasBagit := false
 	hasDPNInfo := false
 	hasManifest := false
@@ -207,7 +212,7 @@ func (validator *ValidationResult) ValidateBag()  {
 			hasDPNInfo = true
 		} else if fileName == "manifest-sha256.txt" {
 			hasManifest = true
-		} else if strings.HasPrefix(fileName, dataDirPrefix) {
+		} else if bagman.IsPayloadPath(filepath.ToSlash(fileName)) {
 			hasDataFiles = true
 		}
 	}
@@ -241,9 +246,7 @@ func (validator *ValidationResult) ValidateBag()  {
 
 	// Running the checksums takes a long time on
 	// large bags, so let NSQ know we're still working.
-	if validator.NsqMessage != nil {
-		validator.NsqMessage.Touch()
-	}
+	validator.NsqMessage.Touch()
 }
 
 // Extract all of the tags from tag files "bagit.txt", "bag-info.txt",
@@ -432,11 +435,9 @@ func (validator *ValidationResult) saveFile (destination string, tarReader *tar.
 
 // We had to untar the bag to validate it, but once validation
 // is done, all we need is the tarred bag, which we'll send to
-// storage. Delete the untarred dir if we're not in test mode.
-// We know we're in test mode if there's no validator.NsqMessage.
+// storage, so delete the untarred dir.
 func (validator *ValidationResult) DeleteUntarredBag () {
-	if validator.NsqMessage != nil && validator.UntarredPath != "" {
-		//fmt.Println(validator.UntarredPath)
+	if validator.UntarredPath != "" {
 		os.RemoveAll(validator.UntarredPath)
 	}
 }
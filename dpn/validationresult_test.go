@@ -36,7 +36,7 @@ func TestValidate_Good(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	result, err := dpn.NewValidationResult(bagPath, nil)
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
 	if err != nil {
 		t.Error(err)
 		return
@@ -57,7 +57,7 @@ func TestValidate_BagMissingDataFile(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	result, err := dpn.NewValidationResult(bagPath, nil)
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
 	if err != nil {
 		t.Error(err)
 		return
@@ -89,7 +89,7 @@ func TestValidate_BagMissingManifest256(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	result, err := dpn.NewValidationResult(bagPath, nil)
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
 	if err != nil {
 		t.Error(err)
 		return
@@ -115,7 +115,7 @@ func TestValidate_BagMissingTags(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	result, err := dpn.NewValidationResult(bagPath, nil)
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
 	if err != nil {
 		t.Error(err)
 		return
@@ -148,7 +148,7 @@ func TestValidate_BagMissingTagManifest(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	result, err := dpn.NewValidationResult(bagPath, nil)
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
 	if err != nil {
 		t.Error(err)
 		return
@@ -174,7 +174,7 @@ func TestValidate_BagWithBadDPNTags(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	result, err := dpn.NewValidationResult(bagPath, nil)
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
 	if err != nil {
 		t.Error(err)
 		return
@@ -219,7 +219,7 @@ func TestValidate_Digest(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	result, err := dpn.NewValidationResult(bagPath, nil)
+	result, err := dpn.NewValidationResult(bagPath, bagman.NewInMemoryMessage(nil))
 	if err != nil {
 		t.Error(err)
 		return
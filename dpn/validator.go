@@ -6,7 +6,6 @@ import (
 	"github.com/APTrust/bagman/bagman"
 	"github.com/nsqio/go-nsq"
 	"os"
-	"sync"
 )
 
 
@@ -16,8 +15,10 @@ type Validator struct {
 	ProcUtil            *bagman.ProcessUtil
 	DPNConfig           *DPNConfig
 	LocalRESTClient     *DPNRestClient
-	// WaitGroup is for running local tests only.
-	WaitGroup           sync.WaitGroup
+	// BagItProfile is the profile every bag must conform to, or
+	// nil if DPNConfig.BagItProfileURL is empty. We load it once,
+	// in NewValidator, instead of once per bag.
+	BagItProfile        *BagItProfile
 }
 
 func NewValidator(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Validator, error) {
@@ -38,6 +39,12 @@ func NewValidator(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Validato
 		LocalRESTClient: localClient,
 		DPNConfig: dpnConfig,
 	}
+	if dpnConfig.BagItProfileURL != "" {
+		validator.BagItProfile, err = LoadBagItProfile(dpnConfig.BagItProfileURL)
+		if err != nil {
+			return nil, err
+		}
+	}
 	workerBufferSize := procUtil.Config.DPNPackageWorker.Workers * 4
 	validator.ValidationChannel = make(chan *DPNResult, workerBufferSize)
 	validator.PostProcessChannel = make(chan *DPNResult, workerBufferSize)
@@ -50,11 +57,18 @@ func NewValidator(procUtil *bagman.ProcessUtil, dpnConfig *DPNConfig) (*Validato
 
 func (validator *Validator) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return validator.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (validator *Validator) ProcessMessage(message bagman.Message) error {
 	dpnResult := &DPNResult{}
-	err := json.Unmarshal(message.Body, dpnResult)
+	err := json.Unmarshal(message.Body(), dpnResult)
 	if err != nil {
 		detailedError := fmt.Errorf("Could not unmarshal JSON data from nsq:",
-			string(message.Body))
+			string(message.Body()))
 		validator.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -69,10 +83,14 @@ func (validator *Validator) HandleMessage(message *nsq.Message) error {
 }
 
 func (validator *Validator) validate() {
-	for result := range validator.ValidationChannel {
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_validate.validate", validator.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, validator.ProcUtil, validator.PostProcessChannel)
+			go validator.validate()
+		})
+	for result = range validator.ValidationChannel {
+		result.NsqMessage.Touch()
 		if result.LocalPath == "" {
 			result.ErrorMessage = "Cannot validate bag because DPNResult.LocalPath is not set. " +
 				"This should be set to the location of the tar file you want to validate."
@@ -95,14 +113,11 @@ func (validator *Validator) validate() {
 		// Touch the message on both sides of this long-running operation
 		// so the NSQ message doesn't time out. ValidateBag() will also
 		// touch the message internally.
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 		// Here's the validation.
+		result.ValidationResult.BagItProfile = validator.BagItProfile
 		result.ValidationResult.ValidateBag()
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 
 		// If the bag we're currently processing is a transfer request
 		// from another node, we'll have to calculate the sha256
@@ -139,11 +154,12 @@ func (validator *Validator) validate() {
 			for _, message := range result.ValidationResult.ErrorMessages {
 				validator.ProcUtil.MessageLog.Error(message)
 			}
+			for _, message := range result.ValidationResult.ProfileErrors {
+				validator.ProcUtil.MessageLog.Error("BagIt profile: %s", message)
+			}
 		}
 
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+		result.NsqMessage.Touch()
 
 		// Now everything goes into the post-process channel.
 		validator.PostProcessChannel <- result
@@ -151,10 +167,14 @@ func (validator *Validator) validate() {
 }
 
 func (validator *Validator) postProcess() {
-	for result := range validator.PostProcessChannel {
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
-		}
+	var result *DPNResult
+	defer bagman.RecoverStage("dpn_validate.post_process", validator.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			recoverResult(result, stagePanic, validator.ProcUtil, nil)
+			go validator.postProcess()
+		})
+	for result = range validator.PostProcessChannel {
+		result.NsqMessage.Touch()
 		if result.ErrorMessage != "" {
 			validator.ProcUtil.MessageLog.Error(result.ErrorMessage)
 			validator.ProcUtil.IncrementFailed()
@@ -176,23 +196,21 @@ func (validator *Validator) postProcess() {
 			SendToRecordQueue(result, validator.ProcUtil)
 		}
 
-		if result.NsqMessage == nil {
-			// This is a test message, running outside production.
-			validator.WaitGroup.Done()
-		} else {
-			result.NsqMessage.Finish()
-		}
+		result.NsqMessage.Finish()
 		validator.ProcUtil.LogStats()
 	}
 }
 
 
 func (validator *Validator) RunTest(result *DPNResult) {
-	validator.WaitGroup.Add(1)
-	validator.ProcUtil.MessageLog.Info("Putting %s into validation channel",
-		result.DPNBag.UUID)
-	validator.ValidationChannel <- result
-	validator.WaitGroup.Wait()
+	err := runSynchronously(result, validator.ProcUtil.Config.DPNValidationWorker, func() {
+		validator.ProcUtil.MessageLog.Info("Putting %s into validation channel",
+			result.DPNBag.UUID)
+		validator.ValidationChannel <- result
+	})
+	if err != nil {
+		validator.ProcUtil.MessageLog.Error("%v", err)
+	}
 	if result.ErrorMessage != "" {
 		validator.ProcUtil.MessageLog.Error("Failed :( %s", result.ErrorMessage)
 		return
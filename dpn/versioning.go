@@ -0,0 +1,131 @@
+package dpn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DPNVersionClient is the part of the DPNRestClient that the
+// packager needs to decide which version of a bag to build. It's
+// an interface so versioning can be tested without a DPN REST
+// service.
+type DPNVersionClient interface {
+	DPNBagListGetFiltered(filter *DPNBagFilter) (*BagListResult, error)
+	ReplicationTransfersForBag(bagUUID string) ([]*DPNReplicationTransfer, error)
+}
+
+// BagVersion describes where a new DPN bag fits in the lineage of
+// an APTrust object that's already in DPN.
+type BagVersion struct {
+	// Version is the version number of the new bag. The first
+	// version is 1.
+	Version             uint32
+
+	// FirstVersionUUID is the UUID of version 1 of the bag. It's
+	// empty for version 1 itself, which is its own first version.
+	FirstVersionUUID    string
+
+	// PreviousVersionUUID is the UUID of the latest version
+	// already in DPN, or empty for version 1.
+	PreviousVersionUUID string
+}
+
+// PendingReplicationError means we won't build a new version of a
+// bag because the previous version hasn't finished replicating.
+type PendingReplicationError struct {
+	BagUUID   string
+	Transfers []string
+}
+
+func (err *PendingReplicationError) Error() (string) {
+	return fmt.Sprintf("Cannot create a new DPN version of bag %s until its "+
+		"replication transfers are complete. Transfers in progress: %s",
+		err.BagUUID, strings.Join(err.Transfers, ", "))
+}
+
+// Returns true if err is a PendingReplicationError.
+func IsPendingReplication(err error) (bool) {
+	_, ok := err.(*PendingReplicationError)
+	return ok
+}
+
+// Returns true if the replication transfer is still in progress.
+// Stored and confirmed transfers are complete, and rejected and
+// cancelled transfers will never complete. Our own workers
+// capitalize some statuses, so case doesn't matter.
+func replicationInProgress(xfer *DPNReplicationTransfer) (bool) {
+	switch strings.ToLower(xfer.Status) {
+	case "cancelled", "rejected", "stored", "confirmed":
+		return false
+	}
+	return true
+}
+
+// LatestDPNBag returns the highest version of the DPN bag whose
+// LocalId is localId, or nil if the object isn't in DPN yet.
+func LatestDPNBag(client DPNVersionClient, localId string) (*DPNBag, error) {
+	var latest *DPNBag
+	for pageNumber := 1; ; pageNumber++ {
+		filter := &DPNBagFilter{LocalId: localId, Page: pageNumber}
+		result, err := client.DPNBagListGetFiltered(filter)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot look up DPN bags for %s: %v", localId, err)
+		}
+		for _, bag := range result.Results {
+			// Not every node's server supports the local_id filter.
+			if bag.LocalId != localId {
+				continue
+			}
+			if latest == nil || bag.Version > latest.Version {
+				latest = bag
+			}
+		}
+		if result.Next == nil || *result.Next == "" {
+			break
+		}
+	}
+	return latest, nil
+}
+
+// NextBagVersion returns the version of the DPN bag to build for the
+// APTrust object localId. If the object isn't in DPN yet, that's
+// version 1. Otherwise, it's the version after the latest one, with
+// the same first version UUID. Unless allowPendingReplication is
+// true, this returns a PendingReplicationError if the latest version
+// is still being replicated, since another node may still be copying
+// the version we're about to supersede.
+func NextBagVersion(client DPNVersionClient, localId string, allowPendingReplication bool) (*BagVersion, error) {
+	latest, err := LatestDPNBag(client, localId)
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return &BagVersion{Version: 1}, nil
+	}
+	if !allowPendingReplication {
+		xfers, err := client.ReplicationTransfersForBag(latest.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get replication transfers for DPN bag %s: %v",
+				latest.UUID, err)
+		}
+		pending := make([]string, 0)
+		for _, xfer := range xfers {
+			if replicationInProgress(xfer) {
+				pending = append(pending, fmt.Sprintf("%s to %s (%s)",
+					xfer.ReplicationId, xfer.ToNode, xfer.Status))
+			}
+		}
+		if len(pending) > 0 {
+			return nil, &PendingReplicationError{BagUUID: latest.UUID, Transfers: pending}
+		}
+	}
+	firstVersionUUID := latest.FirstVersionUUID
+	if firstVersionUUID == "" {
+		firstVersionUUID = latest.UUID
+	}
+	return &BagVersion{
+		Version:             latest.Version + 1,
+		FirstVersionUUID:    firstVersionUUID,
+		PreviousVersionUUID: latest.UUID,
+	}, nil
+}
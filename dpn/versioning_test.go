@@ -0,0 +1,172 @@
+package dpn_test
+
+import (
+	"fmt"
+	"github.com/APTrust/bagman/dpn"
+	"testing"
+)
+
+// fakeDPNVersionClient returns one page of bags per call, and the
+// transfers for each bag.
+type fakeDPNVersionClient struct {
+	pages    [][]*dpn.DPNBag
+	bagErr   error
+	xfers    map[string][]*dpn.DPNReplicationTransfer
+	xferErr  error
+	filters  []*dpn.DPNBagFilter
+}
+
+func (client *fakeDPNVersionClient) DPNBagListGetFiltered(filter *dpn.DPNBagFilter) (*dpn.BagListResult, error) {
+	client.filters = append(client.filters, filter)
+	if client.bagErr != nil {
+		return nil, client.bagErr
+	}
+	result := &dpn.BagListResult{Results: []*dpn.DPNBag{}}
+	if filter.Page <= len(client.pages) {
+		result.Results = client.pages[filter.Page - 1]
+	}
+	if filter.Page < len(client.pages) {
+		next := fmt.Sprintf("/api-v1/bag/?page=%d", filter.Page + 1)
+		result.Next = &next
+	}
+	return result, nil
+}
+
+func (client *fakeDPNVersionClient) ReplicationTransfersForBag(bagUUID string) ([]*dpn.DPNReplicationTransfer, error) {
+	if client.xferErr != nil {
+		return nil, client.xferErr
+	}
+	return client.xfers[bagUUID], nil
+}
+
+const versionedLocalId = "test.edu/ncsu.1840.16-1004"
+
+func versionedBags() ([][]*dpn.DPNBag) {
+	return [][]*dpn.DPNBag{
+		{
+			{UUID: "uuid-v1", LocalId: versionedLocalId, Version: 1, FirstVersionUUID: "uuid-v1"},
+			// Servers that ignore local_id return other objects' bags.
+			{UUID: "uuid-other", LocalId: "test.edu/other", Version: 7},
+		},
+		{
+			{UUID: "uuid-v2", LocalId: versionedLocalId, Version: 2, FirstVersionUUID: "uuid-v1"},
+		},
+	}
+}
+
+func TestNextBagVersionNewObject(t *testing.T) {
+	client := &fakeDPNVersionClient{}
+	version, err := dpn.NextBagVersion(client, versionedLocalId, false)
+	if err != nil {
+		t.Fatalf("NextBagVersion returned error: %v", err)
+	}
+	if version.Version != 1 || version.FirstVersionUUID != "" || version.PreviousVersionUUID != "" {
+		t.Errorf("Expected version 1 with no earlier versions, got %v", version)
+	}
+	if len(client.filters) != 1 || client.filters[0].LocalId != versionedLocalId {
+		t.Errorf("Expected one lookup by local id, got %v", client.filters)
+	}
+}
+
+func TestNextBagVersionChaining(t *testing.T) {
+	client := &fakeDPNVersionClient{
+		pages: versionedBags(),
+		xfers: map[string][]*dpn.DPNReplicationTransfer{
+			"uuid-v2": {
+				{ReplicationId: "xfer-1", ToNode: "chron", Status: "Stored"},
+				{ReplicationId: "xfer-2", ToNode: "tdr", Status: "confirmed"},
+				{ReplicationId: "xfer-3", ToNode: "hathi", Status: "rejected"},
+				{ReplicationId: "xfer-4", ToNode: "sdr", Status: "Cancelled"},
+			},
+		},
+	}
+	latest, err := dpn.LatestDPNBag(client, versionedLocalId)
+	if err != nil || latest == nil || latest.UUID != "uuid-v2" {
+		t.Errorf("Expected latest bag uuid-v2, got %v (%v)", latest, err)
+	}
+	if len(client.filters) != 2 {
+		t.Errorf("Expected LatestDPNBag to read 2 pages, got %d", len(client.filters))
+	}
+
+	version, err := dpn.NextBagVersion(client, versionedLocalId, false)
+	if err != nil {
+		t.Fatalf("Finished transfers should not block a new version: %v", err)
+	}
+	if version.Version != 3 || version.FirstVersionUUID != "uuid-v1" ||
+		version.PreviousVersionUUID != "uuid-v2" {
+		t.Errorf("Expected version 3 of uuid-v1 after uuid-v2, got %v", version)
+	}
+
+	// Bags from before versioning have no FirstVersionUUID, so
+	// they are their own first version.
+	client = &fakeDPNVersionClient{pages: [][]*dpn.DPNBag{
+		{{UUID: "uuid-old", LocalId: versionedLocalId, Version: 1}},
+	}}
+	version, err = dpn.NextBagVersion(client, versionedLocalId, false)
+	if err != nil || version.Version != 2 || version.FirstVersionUUID != "uuid-old" {
+		t.Errorf("Expected version 2 of uuid-old, got %v (%v)", version, err)
+	}
+}
+
+func TestNextBagVersionPendingReplication(t *testing.T) {
+	client := &fakeDPNVersionClient{
+		pages: versionedBags(),
+		xfers: map[string][]*dpn.DPNReplicationTransfer{
+			"uuid-v2": {
+				{ReplicationId: "xfer-1", ToNode: "chron", Status: "Stored"},
+				{ReplicationId: "xfer-2", ToNode: "tdr", Status: "requested"},
+			},
+		},
+	}
+	_, err := dpn.NextBagVersion(client, versionedLocalId, false)
+	if !dpn.IsPendingReplication(err) {
+		t.Fatalf("Expected PendingReplicationError, got %v", err)
+	}
+	pending := err.(*dpn.PendingReplicationError)
+	if pending.BagUUID != "uuid-v2" || len(pending.Transfers) != 1 {
+		t.Errorf("Expected one pending transfer for uuid-v2, got %v", pending)
+	}
+
+	version, err := dpn.NextBagVersion(client, versionedLocalId, true)
+	if err != nil || version.Version != 3 {
+		t.Errorf("Pending replication should be allowed when configured, got %v (%v)",
+			version, err)
+	}
+}
+
+func TestNextBagVersionLookupErrors(t *testing.T) {
+	client := &fakeDPNVersionClient{bagErr: fmt.Errorf("connection refused")}
+	if _, err := dpn.NextBagVersion(client, versionedLocalId, false); err == nil {
+		t.Errorf("NextBagVersion should return bag lookup errors")
+	}
+	client = &fakeDPNVersionClient{pages: versionedBags(), xferErr: fmt.Errorf("timeout")}
+	_, err := dpn.NextBagVersion(client, versionedLocalId, false)
+	if err == nil || dpn.IsPendingReplication(err) {
+		t.Errorf("NextBagVersion should return transfer lookup errors, got %v", err)
+	}
+}
+
+func TestNewBagBuilderVersion(t *testing.T) {
+	config := loadConfig(t, CONFIG_FILE)
+	defer tearDown()
+	version := &dpn.BagVersion{Version: 3, FirstVersionUUID: "uuid-v1",
+		PreviousVersionUUID: "uuid-v2"}
+	builder, err := dpn.NewBagBuilderVersion(testBagPath(), intelObj(t),
+		config.DefaultMetadata, version)
+	if err != nil {
+		t.Fatalf("Could not create bag builder: %v", err)
+	}
+	if builder.UUID == "uuid-v1" || builder.UUID == "uuid-v2" {
+		t.Errorf("A new version needs a new UUID")
+	}
+	if builder.Version != 3 || builder.FirstVersionUUID != "uuid-v1" {
+		t.Errorf("Expected version 3 of uuid-v1, got version %d of %s",
+			builder.Version, builder.FirstVersionUUID)
+	}
+	tagfile, err := builder.Bag.TagFile("dpn-tags/dpn-info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTagField(t, tagfile, "Version-Number", "3")
+	verifyTagField(t, tagfile, "First-Version-Object-ID", "uuid-v1")
+}
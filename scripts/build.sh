@@ -17,6 +17,15 @@
 BAGMAN_HOME=${BAGMAN_HOME-~/go/src/github.com/APTrust/bagman}
 BAGMAN_BIN=${BAGMAN_HOME}/bin
 
+# Stamp the version and git commit into every binary, so PREMIS
+# events and ProcessedItems say which build produced them. See
+# bagman/version.go. Binaries built without these flags report
+# their version as "dev".
+BAGMAN_VERSION=${BAGMAN_VERSION-$(cd "${BAGMAN_HOME}" && git describe --tags --always 2>/dev/null)}
+BAGMAN_COMMIT=$(cd "${BAGMAN_HOME}" && git rev-parse --short HEAD 2>/dev/null)
+LDFLAGS="-X github.com/APTrust/bagman/bagman.Version=${BAGMAN_VERSION} -X github.com/APTrust/bagman/bagman.GitCommit=${BAGMAN_COMMIT}"
+echo "building bagman version ${BAGMAN_VERSION} (${BAGMAN_COMMIT})"
+
 if [ ! -d ${BAGMAN_BIN} ]; then
 	mkdir ${BAGMAN_BIN}
 else
@@ -26,107 +35,155 @@ fi
 
 echo "building apt_nsq_service"
 cd "${BAGMAN_HOME}/nsq"
-go build -o ${BAGMAN_BIN}/apt_nsq_service service.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_nsq_service service.go
 
 echo "building apt_prepare"
 cd "${BAGMAN_HOME}/apps/apt_prepare"
-go build -o ${BAGMAN_BIN}/apt_prepare apt_prepare.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_prepare apt_prepare.go
+
+echo "building apt_preview"
+cd "${BAGMAN_HOME}/apps/apt_preview"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_preview apt_preview.go
 
 echo "building apt_store"
 cd "${BAGMAN_HOME}/apps/apt_store"
-go build -o ${BAGMAN_BIN}/apt_store apt_store.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_store apt_store.go
 
 echo "building apt_record"
 cd "${BAGMAN_HOME}/apps/apt_record"
-go build -o ${BAGMAN_BIN}/apt_record apt_record.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_record apt_record.go
 
 echo "building apt_replicate"
 cd "${BAGMAN_HOME}/apps/apt_replicate"
-go build -o ${BAGMAN_BIN}/apt_replicate apt_replicate.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_replicate apt_replicate.go
+
+echo "building apt_replication_lag"
+cd "${BAGMAN_HOME}/apps/apt_replication_lag"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_replication_lag apt_replication_lag.go
+
+echo "building apt_activity_digest"
+cd "${BAGMAN_HOME}/apps/apt_activity_digest"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_activity_digest apt_activity_digest.go
+
+echo "building apt_lifecycle"
+cd "${BAGMAN_HOME}/apps/apt_lifecycle"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_lifecycle apt_lifecycle.go
+
+echo "building apt_export_institution"
+cd "${BAGMAN_HOME}/apps/apt_export_institution"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_export_institution apt_export_institution.go
 
 echo "building apt_trouble"
 cd "${BAGMAN_HOME}/apps/apt_trouble"
-go build -o ${BAGMAN_BIN}/apt_trouble apt_trouble.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_trouble apt_trouble.go
+
+echo "building apt_triage"
+cd "${BAGMAN_HOME}/apps/apt_triage"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_triage apt_triage.go
 
 echo "building apt_restore"
 cd "${BAGMAN_HOME}/apps/apt_restore"
-go build -o ${BAGMAN_BIN}/apt_restore apt_restore.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_restore apt_restore.go
 
 echo "building apt_file_delete"
 cd "${BAGMAN_HOME}/apps/apt_file_delete"
-go build -o ${BAGMAN_BIN}/apt_file_delete apt_file_delete.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_file_delete apt_file_delete.go
+
+echo "building apt_undelete"
+cd "${BAGMAN_HOME}/apps/apt_undelete"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_undelete apt_undelete.go
+
+echo "building apt_purge_quarantine"
+cd "${BAGMAN_HOME}/apps/apt_purge_quarantine"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_purge_quarantine apt_purge_quarantine.go
 
 echo "building bucket_reader"
 cd "${BAGMAN_HOME}/apps/bucket_reader"
-go build -o ${BAGMAN_BIN}/bucket_reader bucket_reader.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/bucket_reader bucket_reader.go
 
 echo "building request_reader"
 cd "${BAGMAN_HOME}/apps/request_reader"
-go build -o ${BAGMAN_BIN}/request_reader request_reader.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/request_reader request_reader.go
 
 echo "building fixity_reader"
 cd "${BAGMAN_HOME}/apps/fixity_reader"
-go build -o ${BAGMAN_BIN}/fixity_reader fixity_reader.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/fixity_reader fixity_reader.go
 
 echo "building apt_retry"
 cd "${BAGMAN_HOME}/apps/apt_retry"
-go build -o ${BAGMAN_BIN}/apt_retry apt_retry.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_retry apt_retry.go
+
+echo "building apt_replay_events"
+cd "${BAGMAN_HOME}/apps/apt_replay_events"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_replay_events apt_replay_events.go
+
+echo "building apt_estimate"
+cd "${BAGMAN_HOME}/apps/apt_estimate"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_estimate apt_estimate.go
+
+echo "building apt_abort_uploads"
+cd "${BAGMAN_HOME}/apps/apt_abort_uploads"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_abort_uploads apt_abort_uploads.go
 
 echo "building apt_fixity"
 cd "${BAGMAN_HOME}/apps/apt_fixity"
-go build -o ${BAGMAN_BIN}/apt_fixity apt_fixity.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_fixity apt_fixity.go
 
 echo "building apt_failed_fixity"
 cd "${BAGMAN_HOME}/apps/apt_failed_fixity"
-go build -o ${BAGMAN_BIN}/apt_failed_fixity apt_failed_fixity.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_failed_fixity apt_failed_fixity.go
 
 echo "building apt_failed_replication"
 cd "${BAGMAN_HOME}/apps/apt_failed_replication"
-go build -o ${BAGMAN_BIN}/apt_failed_replication apt_failed_replication.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/apt_failed_replication apt_failed_replication.go
 
 echo "building requeue"
 cd "${BAGMAN_HOME}/apps/requeue"
-go build -o ${BAGMAN_BIN}/requeue requeue.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/requeue requeue.go
 
 echo "building dpn_check_requests"
 cd "${BAGMAN_HOME}/apps/dpn_check_requests"
-go build -o ${BAGMAN_BIN}/dpn_check_requests dpn_check_requests.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_check_requests dpn_check_requests.go
 
 echo "building dpn_cleanup"
 cd "${BAGMAN_HOME}/apps/dpn_cleanup"
-go build -o ${BAGMAN_BIN}/dpn_cleanup dpn_cleanup.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_cleanup dpn_cleanup.go
 
 echo "building dpn_copy"
 cd "${BAGMAN_HOME}/apps/dpn_copy"
-go build -o ${BAGMAN_BIN}/dpn_copy dpn_copy.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_copy dpn_copy.go
+
+echo "building dpn_fixity"
+cd "${BAGMAN_HOME}/apps/dpn_fixity"
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_fixity dpn_fixity.go
 
 echo "building dpn_package"
 cd "${BAGMAN_HOME}/apps/dpn_package"
-go build -o ${BAGMAN_BIN}/dpn_package dpn_package.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_package dpn_package.go
 
 echo "building dpn_record"
 cd "${BAGMAN_HOME}/apps/dpn_record"
-go build -o ${BAGMAN_BIN}/dpn_record dpn_record.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_record dpn_record.go
 
 echo "building dpn_store"
 cd "${BAGMAN_HOME}/apps/dpn_store"
-go build -o ${BAGMAN_BIN}/dpn_store dpn_store.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_store dpn_store.go
 
 echo "building dpn_sync"
 cd "${BAGMAN_HOME}/apps/dpn_sync"
-go build -o ${BAGMAN_BIN}/dpn_sync dpn_sync.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_sync dpn_sync.go
 
 echo "building dpn_trouble"
 cd "${BAGMAN_HOME}/apps/dpn_trouble"
-go build -o ${BAGMAN_BIN}/dpn_trouble dpn_trouble.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_trouble dpn_trouble.go
 
 echo "building dpn_validate"
 cd "${BAGMAN_HOME}/apps/dpn_validate"
-go build -o ${BAGMAN_BIN}/dpn_validate dpn_validate.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_validate dpn_validate.go
 
 echo "building dpn_ingest_devtest"
 cd "${BAGMAN_HOME}/apps/dpn_ingest_devtest"
-go build -o ${BAGMAN_BIN}/dpn_ingest_devtest dpn_ingest_devtest.go
+go build -ldflags "${LDFLAGS}" -o ${BAGMAN_BIN}/dpn_ingest_devtest dpn_ingest_devtest.go
 
 echo "building apt_download -tags='partners'"
 cd "${BAGMAN_HOME}/partner-apps/apt_download"
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/nsqio/go-nsq"
-	"os"
 	"strings"
 	"time"
 )
@@ -91,11 +90,18 @@ func NewBagPreparer(procUtil *bagman.ProcessUtil) (*BagPreparer) {
 // item into the pipleline.
 func (bagPreparer *BagPreparer) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return bagPreparer.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (bagPreparer *BagPreparer) ProcessMessage(message bagman.Message) error {
 	var s3File bagman.S3File
-	err := json.Unmarshal(message.Body, &s3File)
+	err := json.Unmarshal(message.Body(), &s3File)
 	if err != nil {
 		bagPreparer.ProcUtil.MessageLog.Error("Could not unmarshal JSON data from nsq:",
-			string(message.Body))
+			string(message.Body()))
 		message.Finish()
 		return nil
 	}
@@ -122,7 +128,7 @@ func (bagPreparer *BagPreparer) HandleMessage(message *nsq.Message) error {
 	// the search. We may pull back a few extra records and get a false positive
 	// on the pending delete/restore. A false positive will delay ingest, but a
 	// false negative could cause some cascading errors.
-	bagDate, _ := time.Parse(bagman.S3DateFormat, s3File.Key.LastModified)
+	bagDate, _ := bagman.ParseS3Time(s3File.Key.LastModified)
 	processStatus := &bagman.ProcessStatus {
 		ETag: strings.Replace(s3File.Key.ETag, "\"", "", -1),
 		Name: s3File.Key.Key,
@@ -149,7 +155,7 @@ func (bagPreparer *BagPreparer) HandleMessage(message *nsq.Message) error {
 	// The original process will call Finish() on the message when it's
 	// done. If we call Finish() here, NSQ will throw a "not-in-flight"
 	// error when the processor calls Finish() on the original message later.
-	currentMessageId := bagPreparer.ProcUtil.MessageIdString(message.ID)
+	currentMessageId := bagPreparer.ProcUtil.MessageIdString(message.ID())
 	if bagPreparer.ProcUtil.BagAlreadyInProgress(&s3File, currentMessageId) {
 		bagPreparer.ProcUtil.MessageLog.Info("Bag %s is already in progress under message id '%s'",
 			s3File.Key.Key, bagPreparer.ProcUtil.MessageIdFor(s3File.BagName()))
@@ -177,7 +183,7 @@ func (bagPreparer *BagPreparer) HandleMessage(message *nsq.Message) error {
 	// Note that the key we include in the syncMap includes multipart
 	// bag endings, so we can be working on ncsu.edu/obj.b1of2.tar and
 	// ncsu.edu/obj.b2of2.tar at the same time. This is what we want.
-	mapErr := bagPreparer.ProcUtil.RegisterItem(s3File.BagName(), message.ID)
+	mapErr := bagPreparer.ProcUtil.RegisterItem(s3File.BagName(), message.ID())
 	if mapErr != nil {
 		bagPreparer.ProcUtil.MessageLog.Info("Marking %s as complete because the file is already "+
 			"being processed under another message id.\n", s3File.Key.Key)
@@ -185,8 +191,14 @@ func (bagPreparer *BagPreparer) HandleMessage(message *nsq.Message) error {
 		return nil
 	}
 
-	// Create the result struct and pass it down the pipeline
+	// Create the result struct and make sure Fluctus knows about
+	// this bag before we spend any time on it. If Fluctus can't
+	// register it, ConfirmProcessedItem requeues the message.
 	helper := bagman.NewIngestHelper(bagPreparer.ProcUtil, message, &s3File)
+	if !helper.ConfirmProcessedItem() {
+		bagPreparer.unregisterItem(helper)
+		return nil
+	}
 	bagPreparer.FetchChannel <- helper
 	bagPreparer.ProcUtil.MessageLog.Debug("Put %s into fetch queue", s3File.Key.Key)
 	return nil
@@ -195,12 +207,26 @@ func (bagPreparer *BagPreparer) HandleMessage(message *nsq.Message) error {
 // -- Step 1 of 5 --
 // This runs as a go routine to fetch files from S3.
 func (bagPreparer *BagPreparer) doFetch() {
-	for helper := range bagPreparer.FetchChannel {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("prepare.fetch", bagPreparer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagPreparer.recoverItem(helper, stagePanic, bagPreparer.ResultsChannel)
+			go bagPreparer.doFetch()
+		})
+	for helper = range bagPreparer.FetchChannel {
 		result := helper.Result
 		result.NsqMessage.Touch()
 		s3Key := result.S3File.Key
-		// Disk needs filesize * 2 disk space to accomodate tar file & untarred files
-		err := bagPreparer.ProcUtil.Volume.Reserve(uint64(s3Key.Size * 2))
+		if helper.BagTooLarge() {
+			bagPreparer.ProcUtil.MessageLog.Warning("Not fetching %s: %s",
+				s3Key.Key, result.ErrorMessage)
+			bagPreparer.ResultsChannel <- helper
+			continue
+		}
+		// Disk needs room for the tar file in the download directory,
+		// and the same again for the untarred files in the extract
+		// directory. These may be on the same disk.
+		err := helper.ReserveBagSpace(uint64(s3Key.Size))
 		if err != nil {
 			// Not enough room on disk
 			bagPreparer.ProcUtil.MessageLog.Warning("Requeueing %s - not enough disk space", s3Key.Key)
@@ -208,8 +234,8 @@ func (bagPreparer *BagPreparer) doFetch() {
 			result.Retry = true
 			bagPreparer.ResultsChannel <- helper
 		} else {
+			// ConfirmProcessedItem already set Fetch/Started in Fluctus.
 			bagPreparer.ProcUtil.MessageLog.Info("Fetching %s", s3Key.Key)
-			helper.UpdateFluctusStatus(bagman.StageFetch, bagman.StatusStarted)
 			helper.FetchTarFile()
 			if result.ErrorMessage != "" {
 				// Fetch from S3 failed. Requeue.
@@ -230,7 +256,13 @@ func (bagPreparer *BagPreparer) doFetch() {
 // We calculate checksums and create generic files during the unpack
 // stage to avoid having to reprocess large streams of data several times.
 func (bagPreparer *BagPreparer) doUnpack() {
-	for helper := range bagPreparer.UnpackChannel {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("prepare.unpack", bagPreparer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagPreparer.recoverItem(helper, stagePanic, bagPreparer.ResultsChannel)
+			go bagPreparer.doUnpack()
+		})
+	for helper = range bagPreparer.UnpackChannel {
 		result := helper.Result
 		if result.ErrorMessage != "" {
 			// Unpack failed. Go to end.
@@ -263,7 +295,13 @@ func (bagPreparer *BagPreparer) doUnpack() {
 // to Fluctus saying whether the bag succeeded or failed.
 // THIS STEP ALWAYS RUNS, EVEN IF PRIOR STEPS FAILED.
 func (bagPreparer *BagPreparer) logResult() {
-	for helper := range bagPreparer.ResultsChannel {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("prepare.log_result", bagPreparer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagPreparer.recoverItem(helper, stagePanic, bagPreparer.CleanUpChannel)
+			go bagPreparer.logResult()
+		})
+	for helper = range bagPreparer.ResultsChannel {
 		result := helper.Result
 		result.NsqMessage.Touch()
 		helper.LogResult()
@@ -276,14 +314,25 @@ func (bagPreparer *BagPreparer) logResult() {
 // and untarred.
 // THIS STEP ALWAYS RUNS, EVEN IF PRIOR STEPS FAILED.
 func (bagPreparer *BagPreparer) doCleanUp() {
-	for helper := range bagPreparer.CleanUpChannel {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("prepare.cleanup", bagPreparer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagPreparer.recoverItem(helper, stagePanic, nil)
+			go bagPreparer.doCleanUp()
+		})
+	for helper = range bagPreparer.CleanUpChannel {
 		result := helper.Result
 		result.NsqMessage.Touch()
 		bagPreparer.ProcUtil.MessageLog.Debug("Cleaning up %s", result.S3File.Key.Key)
 		if (result.S3File.Key.Key != "" && result.FetchResult != nil &&
 			result.FetchResult.LocalFile != "") {
 			bagPreparer.cleanupBag(helper)
+		} else {
+			// Fetch failed before we created a local file.
+			bagPreparer.ProcUtil.MessageLog.Debug("No local tar file for %s. "+
+				"Skipping file cleanup.", result.S3File.Key.Key)
 		}
+		helper.ReleaseVolume()
 
 		// Build and send message back to NSQ, indicating whether
 		// processing succeeded.
@@ -302,17 +351,49 @@ func (bagPreparer *BagPreparer) doCleanUp() {
 			result.NsqMessage.Finish()
 		}
 
-		// We're done processing this, so remove it from the map.
-		// If it comes in again, we'll reprocess it again.
-		bagPreparer.ProcUtil.UnregisterItem(result.S3File.BagName())
-		if bagPreparer.largeFile1 == result.S3File.BagName() {
-			bagPreparer.ProcUtil.MessageLog.Info("Done with largeFile1 %s", result.S3File.Key.Key)
-			bagPreparer.largeFile1 = ""
-		} else if bagPreparer.largeFile2 == result.S3File.BagName() {
-			bagPreparer.ProcUtil.MessageLog.Info("Done with largeFile2 %s", result.S3File.Key.Key)
-			bagPreparer.largeFile2 = ""
-		}
+		bagPreparer.unregisterItem(helper)
+	}
+}
+
+// We're done processing this, so remove it from the map.
+// If it comes in again, we'll reprocess it again.
+func (bagPreparer *BagPreparer) unregisterItem(helper *bagman.IngestHelper) {
+	result := helper.Result
+	bagPreparer.ProcUtil.UnregisterItem(result.S3File.BagName())
+	if bagPreparer.largeFile1 == result.S3File.BagName() {
+		bagPreparer.ProcUtil.MessageLog.Info("Done with largeFile1 %s", result.S3File.Key.Key)
+		bagPreparer.largeFile1 = ""
+	} else if bagPreparer.largeFile2 == result.S3File.BagName() {
+		bagPreparer.ProcUtil.MessageLog.Info("Done with largeFile2 %s", result.S3File.Key.Key)
+		bagPreparer.largeFile2 = ""
+	}
+}
+
+// recoverItem records a panic in one of the stages as an error on
+// the bag that was in process, releases the disk space reserved
+// for the bag, and sends it on to nextChannel, so the remaining
+// stages can log it, clean up, and requeue the NSQ message. If the
+// cleanup stage panicked, nextChannel is nil, and we requeue the
+// message here.
+func (bagPreparer *BagPreparer) recoverItem(helper *bagman.IngestHelper, stagePanic *bagman.StagePanic, nextChannel chan *bagman.IngestHelper) {
+	if helper == nil {
+		return
+	}
+	helper.Result.RecordPanic(stagePanic)
+	helper.ReleaseVolume()
+	if nextChannel != bagPreparer.ResultsChannel {
+		// logResult won't see this bag again, so log the
+		// stack trace to the JSON log here.
+		json, _ := json.Marshal(helper.Result)
+		bagPreparer.ProcUtil.JsonLog.Println(string(json))
+	}
+	if nextChannel != nil {
+		nextChannel <- helper
+		return
 	}
+	bagPreparer.ProcUtil.MessageLog.Info("Requeueing %s", helper.Result.S3File.Key.Key)
+	helper.Result.NsqMessage.Requeue(5 * time.Minute)
+	bagPreparer.unregisterItem(helper)
 }
 
 func (bagPreparer *BagPreparer) cleanupBag(helper *bagman.IngestHelper) {
@@ -320,7 +401,7 @@ func (bagPreparer *BagPreparer) cleanupBag(helper *bagman.IngestHelper) {
 	if result.ErrorMessage == "" {
 		// Clean up the tar file, but leave the unpacked files
 		// for apt_store to send off to long-term storage.
-		err := os.Remove(result.FetchResult.LocalFile)
+		err := helper.DeleteTarFile()
 		if err != nil {
 			bagPreparer.ProcUtil.MessageLog.Error("Error deleting tar file %s: %v",
 				result.FetchResult.LocalFile, err)
@@ -336,13 +417,12 @@ func (bagPreparer *BagPreparer) cleanupBag(helper *bagman.IngestHelper) {
 			}
 		}
 	}
-	bagPreparer.ProcUtil.Volume.Release(uint64(result.S3File.Key.Size * 2))
 }
 
 
 // Puts an item into the queue for Fluctus/Fedora metadata processing.
 func (bagPreparer *BagPreparer) SendToStorageQueue(helper *bagman.IngestHelper) {
-	err := bagman.Enqueue(helper.ProcUtil.Config.NsqdHttpAddress,
+	err := helper.ProcUtil.Enqueue(
 		helper.ProcUtil.Config.StoreWorker.NsqTopic, helper.Result)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error adding '%s' to storage queue: %v ",
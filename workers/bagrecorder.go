@@ -10,23 +10,22 @@ import (
 	"github.com/nsqio/go-nsq"
 	"github.com/satori/go.uuid"
 	"os"
-	"sync"
 	"time"
 )
 
 type BagRecorder struct {
-	FedoraChannel  chan *bagman.ProcessResult
-	CleanupChannel chan *bagman.ProcessResult
-	ResultsChannel chan *bagman.ProcessResult
-	ProcUtil       *bagman.ProcessUtil
-	UsingNsq       bool
-	WaitGroup      sync.WaitGroup
+	FedoraChannel    chan *bagman.ProcessResult
+	CleanupChannel   chan *bagman.ProcessResult
+	ResultsChannel   chan *bagman.ProcessResult
+	ProcUtil         *bagman.ProcessUtil
+	fluctusSemaphore *bagman.Semaphore
 }
 
 func NewBagRecorder(procUtil *bagman.ProcessUtil) (*BagRecorder) {
 	bagRecorder := &BagRecorder {
-		ProcUtil: procUtil,
-		UsingNsq: true,
+		ProcUtil:         procUtil,
+		fluctusSemaphore: bagman.NewSemaphore(
+			procUtil.Config.RecordWorker.FluctusConnectionLimit()),
 	}
 	workerBufferSize := procUtil.Config.RecordWorker.Workers * 10
 	bagRecorder.FedoraChannel = make(chan *bagman.ProcessResult, workerBufferSize)
@@ -40,24 +39,34 @@ func NewBagRecorder(procUtil *bagman.ProcessUtil) (*BagRecorder) {
 	return bagRecorder
 }
 
+// RunWithoutNsq records result through the SyncDriver, and
+// returns when recording is complete.
 func (bagRecorder *BagRecorder) RunWithoutNsq(result *bagman.ProcessResult) {
-	bagRecorder.UsingNsq = false
-	bagRecorder.WaitGroup.Add(1) // Marked as done in doCleanup() below
-	bagRecorder.FedoraChannel <- result
-	bagRecorder.ProcUtil.MessageLog.Debug("Put %s into Fluctus channel", result.S3File.Key.Key)
-	bagRecorder.WaitGroup.Wait()
+	bagman.NewSyncDriver(0).Run(nil, func(message bagman.Message) error {
+		result.NsqMessage = message
+		bagRecorder.FedoraChannel <- result
+		bagRecorder.ProcUtil.MessageLog.Debug("Put %s into Fluctus channel", result.S3File.Key.Key)
+		return nil
+	})
 }
 
 // MessageHandler handles messages from the queue, putting each
 // item into the pipleline.
 func (bagRecorder *BagRecorder) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return bagRecorder.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (bagRecorder *BagRecorder) ProcessMessage(message bagman.Message) error {
 	var result bagman.ProcessResult
-	err := json.Unmarshal(message.Body, &result)
+	err := json.Unmarshal(message.Body(), &result)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"[ERROR] Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		bagRecorder.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -69,48 +78,75 @@ func (bagRecorder *BagRecorder) HandleMessage(message *nsq.Message) error {
 }
 
 func (bagRecorder *BagRecorder) recordInFedora() {
-	for result := range bagRecorder.FedoraChannel {
+	var result *bagman.ProcessResult
+	defer bagman.RecoverStage("record.fedora", bagRecorder.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagRecorder.recoverItem(result, stagePanic, bagRecorder.ResultsChannel)
+			go bagRecorder.recordInFedora()
+		})
+	for result = range bagRecorder.FedoraChannel {
 		bagRecorder.ProcUtil.MessageLog.Info("Recording Fedora metadata for %s",
 			result.S3File.Key.Key)
-		// result.NsqMessage will be nil when the process that uses
-		// this library does not deal with NSQ. E.g. apps/apt_retry
-		if result.NsqMessage != nil {
-			result.NsqMessage.Touch()
+		result.NsqMessage.Touch()
+		result.EnterStage(bagman.StageRecord, &bagRecorder.ProcUtil.Config)
+		bagRecorder.recordItem(result)
+		bagRecorder.ResultsChannel <- result
+	}
+}
+
+// Records result in Fluctus, waiting first until fewer than
+// RecordWorker.FluctusConnections other items are being recorded.
+func (bagRecorder *BagRecorder) recordItem(result *bagman.ProcessResult) {
+	bagRecorder.fluctusSemaphore.Acquire()
+	defer bagRecorder.fluctusSemaphore.Release()
+	bagRecorder.updateFluctusStatus(result, bagman.StageRecord, bagman.StatusStarted)
+	// Save to Fedora only if there are new or updated items in this bag.
+	// TODO: What if some items were deleted?
+	if !result.ReingestNoOp && result.TarResult.AnyFilesNeedSaving() {
+		filesToRecord := result.FilesToRecord()
+		err := bagRecorder.recordAllFedoraData(result)
+		if err != nil {
+			result.ErrorMessage += fmt.Sprintf(" %s", err.Error())
 		}
-		result.Stage = "Record"
-		bagRecorder.updateFluctusStatus(result, bagman.StageRecord, bagman.StatusStarted)
-		// Save to Fedora only if there are new or updated items in this bag.
-		// TODO: What if some items were deleted?
-		if result.TarResult.AnyFilesNeedSaving() {
-			err := bagRecorder.recordAllFedoraData(result)
-			if err != nil {
-				result.ErrorMessage += fmt.Sprintf(" %s", err.Error())
-			}
-			if result.FedoraResult.AllRecordsSucceeded() == false {
-				result.ErrorMessage += " When recording IntellectualObject, GenericFiles and " +
-					"PremisEvents, one or more calls to Fluctus failed."
-			}
-			if result.ErrorMessage == "" {
-				bagRecorder.ProcUtil.MessageLog.Info("Successfully recorded Fedora metadata for %s",
-					result.S3File.Key.Key)
-			} else {
-				// If any errors in occur while talking to Fluctus,
-				// we'll want to requeue and try again. Just leave
-				// the result.Retry flag alone, and that will happen.
-				bagRecorder.ProcUtil.MessageLog.Error(result.ErrorMessage)
+		if result.FedoraResult.AllRecordsSucceeded() == false {
+			result.ErrorMessage += " When recording IntellectualObject, GenericFiles and " +
+				"PremisEvents, one or more calls to Fluctus failed or were not made."
+		}
+		// Make sure we registered every file we meant to.
+		if err == nil {
+			if countErr := result.CheckRecordedFiles(filesToRecord); countErr != nil {
+				bagRecorder.ProcUtil.MessageLog.Error("%s: %v", result.S3File.Key.Key, countErr)
+				result.FailFileCount(countErr)
 			}
-		} else {
-			bagRecorder.ProcUtil.MessageLog.Info(
-				"Nothing to update for %s: no items changed since last ingest.",
+		}
+		if result.ErrorMessage == "" {
+			bagRecorder.ProcUtil.MessageLog.Info("Successfully recorded Fedora metadata for %s",
 				result.S3File.Key.Key)
+		} else {
+			// If any errors in occur while talking to Fluctus,
+			// we'll want to requeue and try again. Just leave
+			// the result.Retry flag alone, and that will happen.
+			bagRecorder.ProcUtil.MessageLog.Error(result.ErrorMessage)
 		}
-		bagRecorder.updateFluctusStatus(result, bagman.StageRecord, bagman.StatusPending)
-		bagRecorder.ResultsChannel <- result
+	} else {
+		bagRecorder.ProcUtil.MessageLog.Info(
+			"Nothing to update for %s: no items changed since last ingest.",
+			result.S3File.Key.Key)
 	}
+	if result.ErrorMessage == "" {
+		result.CompleteStage(bagman.StageRecord)
+	}
+	bagRecorder.updateFluctusStatus(result, bagman.StageRecord, bagman.StatusPending)
 }
 
 func (bagRecorder *BagRecorder) logResult() {
-	for result := range bagRecorder.ResultsChannel {
+	var result *bagman.ProcessResult
+	defer bagman.RecoverStage("record.log_result", bagRecorder.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagRecorder.recoverItem(result, stagePanic, bagRecorder.CleanupChannel)
+			go bagRecorder.logResult()
+		})
+	for result = range bagRecorder.ResultsChannel {
 		// Log full results to the JSON log
 		json, err := json.Marshal(result)
 		if err != nil {
@@ -134,16 +170,18 @@ func (bagRecorder *BagRecorder) logResult() {
 		// Add some stats to the message log
 		bagRecorder.ProcUtil.MessageLog.Info("**STATS** Succeeded: %d, Failed: %d",
 			bagRecorder.ProcUtil.Succeeded(), bagRecorder.ProcUtil.Failed())
+		if result.ErrorMessage == "" {
+			bagRecorder.recordThroughput(result)
+		}
 
-		if result.NsqMessage != nil &&
-			result.NsqMessage.Attempts >= uint16(bagRecorder.ProcUtil.Config.RecordWorker.MaxAttempts) &&
+		if result.NsqMessage.Attempts() >= uint16(bagRecorder.ProcUtil.Config.RecordWorker.MaxAttempts) &&
 			result.ErrorMessage != "" {
 			result.Retry = false
 			result.ErrorMessage += fmt.Sprintf(" Failure is due to a technical error "+
 				"in Fedora. Giving up after %d failed attempts. This item has been "+
 				"queued for administrative review. ",
-				result.NsqMessage.Attempts)
-			err = bagman.Enqueue(bagRecorder.ProcUtil.Config.NsqdHttpAddress,
+				result.NsqMessage.Attempts())
+			err = bagRecorder.ProcUtil.Enqueue(
 				bagRecorder.ProcUtil.Config.TroubleWorker.NsqTopic, result)
 			if err != nil {
 				bagRecorder.ProcUtil.MessageLog.Error("Could not send '%s' to trouble queue: %v",
@@ -160,17 +198,27 @@ func (bagRecorder *BagRecorder) logResult() {
 	}
 }
 
-func (bagRecorder *BagRecorder) QueueItemsForReplication(result *bagman.ProcessResult) {
-	if result.NsqMessage == nil {
-		// We're running without NSQ
-		return
+// Records the finished bag for apt_estimate, and logs our throughput.
+func (bagRecorder *BagRecorder) recordThroughput(result *bagman.ProcessResult) {
+	throughput, err := bagRecorder.ProcUtil.RecordThroughput(bagman.ThroughputSample{
+		Finished:    bagman.NowUTC(),
+		Bytes:       result.S3File.Key.Size,
+		Institution: bagman.OwnerOf(result.S3File.BucketName),
+	})
+	if err != nil {
+		bagRecorder.ProcUtil.MessageLog.Warning("Could not save throughput: %v", err)
 	}
+	if throughput != nil {
+		bagRecorder.ProcUtil.MessageLog.Info("**STATS** Throughput: %s", throughput)
+	}
+}
+
+func (bagRecorder *BagRecorder) QueueItemsForReplication(result *bagman.ProcessResult) {
 	bagRecorder.ProcUtil.MessageLog.Info("Queueing %d files for replication",
 		len(result.TarResult.Files))
 	itemsQueued := 0
 	for _, file := range result.TarResult.Files {
-		err := bagman.Enqueue(
-			bagRecorder.ProcUtil.Config.NsqdHttpAddress,
+		err := bagRecorder.ProcUtil.Enqueue(
 			bagRecorder.ProcUtil.Config.ReplicationWorker.NsqTopic,
 			file)
 		if err != nil {
@@ -219,7 +267,13 @@ func (bagRecorder *BagRecorder) updateFluctusStatus(result *bagman.ProcessResult
 }
 
 func (bagRecorder *BagRecorder) doCleanup() {
-	for result := range bagRecorder.CleanupChannel {
+	var result *bagman.ProcessResult
+	defer bagman.RecoverStage("record.cleanup", bagRecorder.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagRecorder.recoverItem(result, stagePanic, nil)
+			go bagRecorder.doCleanup()
+		})
+	for result = range bagRecorder.CleanupChannel {
 		if result.ErrorMessage == "" {
 			bagRecorder.ProcUtil.MessageLog.Info("Cleaning up %s", result.S3File.Key.Key)
 			bagRecorder.DeleteS3File(result)
@@ -232,20 +286,39 @@ func (bagRecorder *BagRecorder) doCleanup() {
 
 		// Build and send message back to NSQ, indicating whether
 		// processing succeeded.
-		if result.NsqMessage != nil {
-			if result.ErrorMessage != "" && result.Retry == true {
-				bagRecorder.ProcUtil.MessageLog.Info("Requeueing %s", result.S3File.Key.Key)
-				result.NsqMessage.Requeue(1 * time.Minute)
-			} else {
-				result.NsqMessage.Finish()
-			}
-		}
-		if bagRecorder.UsingNsq == false {
-			bagRecorder.WaitGroup.Done()
+		if result.ErrorMessage != "" && result.Retry == true {
+			bagRecorder.ProcUtil.MessageLog.Info("Requeueing %s", result.S3File.Key.Key)
+			result.NsqMessage.Requeue(1 * time.Minute)
+		} else {
+			result.NsqMessage.Finish()
 		}
 	}
 }
 
+// recoverItem records a panic in one of the stages as an error on
+// the bag that was in process, and sends it on to nextChannel, so
+// the remaining stages can log it and requeue the NSQ message. If
+// the cleanup stage panicked, nextChannel is nil, and we requeue
+// the message here.
+func (bagRecorder *BagRecorder) recoverItem(result *bagman.ProcessResult, stagePanic *bagman.StagePanic, nextChannel chan *bagman.ProcessResult) {
+	if result == nil {
+		return
+	}
+	result.RecordPanic(stagePanic)
+	if nextChannel != bagRecorder.ResultsChannel {
+		// logResult won't see this bag again, so log the
+		// stack trace to the JSON log here.
+		json, _ := json.Marshal(result)
+		bagRecorder.ProcUtil.JsonLog.Println(string(json))
+	}
+	if nextChannel != nil {
+		nextChannel <- result
+		return
+	}
+	bagRecorder.ProcUtil.MessageLog.Info("Requeueing %s", result.S3File.Key.Key)
+	result.NsqMessage.Requeue(1 * time.Minute)
+}
+
 // Send all metadata about the bag to Fluctus/Fedora. This includes
 // the IntellectualObject, the GenericFiles, and all PremisEvents
 // related to the object and the files.
@@ -256,7 +329,7 @@ func (bagRecorder *BagRecorder) recordAllFedoraData(result *bagman.ProcessResult
 	}
 	result.FedoraResult = bagman.NewFedoraResult(
 		intellectualObject.Identifier,
-		result.TarResult.FilePaths())
+		result.FilesToRecord())
 	existingObj, err := bagRecorder.ProcUtil.FluctusClient.IntellectualObjectGet(
 		intellectualObject.Identifier, true)
 	if err != nil {
@@ -303,8 +376,19 @@ func (bagRecorder *BagRecorder) fedoraCreateObject(result *bagman.ProcessResult,
 		result.FedoraResult.ErrorMessage = fmt.Sprintf(
 			"[ERROR] Error creating new IntellectualObject '%s' in Fluctus: %v",
 			intellectualObject.Identifier, err)
+		bagRecorder.addMetadataRecord(result, "IntellectualObject",
+			"object_registered", intellectualObject.Identifier, err)
 		return nil, err
 	}
+	// Fluctus created the object with its first maxGenericFiles files.
+	createdFiles := intellectualObject.GenericFiles
+	if maxGenericFiles > 0 && len(createdFiles) > maxGenericFiles {
+		createdFiles = createdFiles[0:maxGenericFiles]
+	}
+	for _, gf := range createdFiles {
+		origPath, _ := gf.OriginalPath()
+		bagRecorder.addMetadataRecord(result, "GenericFile", "file_registered", origPath, nil)
+	}
 	return newObj, nil
 }
 
@@ -320,10 +404,14 @@ func (bagRecorder *BagRecorder) fedoraUpdateObject(result *bagman.ProcessResult,
 	result.TarResult.MergeExistingFiles(existingObject.GenericFiles)
 	if result.TarResult.AnyFilesNeedSaving() {
 
-		err := bagRecorder.fedoraUpdateIntellectualObject(result, objectToSave)
+		err := bagRecorder.fedoraUpdateIntellectualObject(result, objectToSave, existingObject.Events)
 		if err != nil {
 			return err
 		}
+		existingFiles := make(map[string]*bagman.GenericFile, len(existingObject.GenericFiles))
+		for _, gf := range existingObject.GenericFiles {
+			existingFiles[gf.Identifier] = gf
+		}
 
 		// -------------------------------------------------------------
 		// New save method - up to 200 at a time
@@ -341,18 +429,50 @@ func (bagRecorder *BagRecorder) fedoraUpdateObject(result *bagman.ProcessResult,
 				bagRecorder.ProcUtil.MessageLog.Error("While saving files from bag %s " +
 					"to Fluctus, error getting batch: %v", result.S3File.Key.Key, err)
 			}
+			for _, gf := range batch {
+				if existingFile := existingFiles[gf.Identifier]; existingFile != nil {
+					gf.MergeEvents(existingFile.Events)
+				}
+			}
 			bagRecorder.ProcUtil.MessageLog.Info("Sending batch of %d generic files " +
 				"from bag %s to Fluctus", len(batch), result.S3File.Key.Key)
 			err = bagRecorder.ProcUtil.FluctusClient.GenericFileSaveBatch(objectToSave.Identifier, batch)
 			if err != nil {
 				bagRecorder.handleFedoraError(result, "Error saving generic file batch to Fedora", err)
+				// Record which files failed, so they can be replayed
+				// from the JSON log.
+				for _, gf := range batch {
+					origPath, _ := gf.OriginalPath()
+					bagRecorder.addMetadataRecord(result, "GenericFile",
+						"file_registered", origPath, err)
+				}
 			} else {
 				totalSaved += len(batch)
+				for _, gf := range batch {
+					origPath, _ := gf.OriginalPath()
+					bagRecorder.addMetadataRecord(result, "GenericFile",
+						"file_registered", origPath, nil)
+				}
 			}
 		}
 		// -------------------------------------------------------------
 		// End of new save
 		// -------------------------------------------------------------
+
+		// Renamed files replace their old records, once the new
+		// records are saved.
+		for _, file := range result.TarResult.Files {
+			if file.RenamedFrom == "" ||
+				!result.FedoraResult.RecordSucceeded("GenericFile", "file_registered", file.Path) {
+				continue
+			}
+			err := bagRecorder.ProcUtil.FluctusClient.GenericFileSetSuperseded(
+				file.RenamedFrom, file.Identifier)
+			if err != nil {
+				bagRecorder.handleFedoraError(result, fmt.Sprintf(
+					"Error marking %s as superseded by %s", file.RenamedFrom, file.Identifier), err)
+			}
+		}
 	} else {
 		bagRecorder.ProcUtil.MessageLog.Debug(
 			"Not saving object, files or events for %s: no change since last ingest",
@@ -393,14 +513,17 @@ func (bagRecorder *BagRecorder) fedoraRecordGenericFile(result *bagman.ProcessRe
 }
 
 // Creates/Updates an IntellectualObject in Fedora, and sends the
-// Ingest PremisEvent to Fedora.
-func (bagRecorder *BagRecorder) fedoraUpdateIntellectualObject(result *bagman.ProcessResult, intellectualObject *bagman.IntellectualObject) error {
+// Ingest PremisEvent to Fedora. Param existingEvents are the events
+// Fluctus already has for this object. We don't send those again.
+func (bagRecorder *BagRecorder) fedoraUpdateIntellectualObject(result *bagman.ProcessResult, intellectualObject *bagman.IntellectualObject, existingEvents []*bagman.PremisEvent) error {
 	// Create/Update the IntellectualObject
 	savedObj, err := bagRecorder.ProcUtil.FluctusClient.IntellectualObjectUpdate(intellectualObject)
 	if err != nil {
 		message := fmt.Sprintf("Error saving intellectual object '%s' to Fedora",
 			intellectualObject.Identifier)
 		bagRecorder.handleFedoraError(result, message, err)
+		bagRecorder.addMetadataRecord(result, "IntellectualObject",
+			"object_registered", intellectualObject.Identifier, err)
 		return err
 	}
 	bagRecorder.addMetadataRecord(result, "IntellectualObject",
@@ -414,45 +537,50 @@ func (bagRecorder *BagRecorder) fedoraUpdateIntellectualObject(result *bagman.Pr
 	ingestEvent := &bagman.PremisEvent{
 		Identifier:         eventId.String(),
 		EventType:          "ingest",
-		DateTime:           time.Now(),
+		DateTime:           bagman.NowUTC(),
 		Detail:             "Copied all files to perservation bucket",
 		Outcome:            bagman.StatusSuccess,
 		OutcomeDetail:      fmt.Sprintf("%d files copied", len(result.FedoraResult.GenericFilePaths)),
 		Object:             "goamz S3 client",
 		Agent:              "https://github.com/crowdmob/goamz",
-		OutcomeInformation: "Multipart put using md5 checksum",
+		OutcomeInformation: bagman.VersionedOutcome("Multipart put using md5 checksum"),
 	}
-	_, err = bagRecorder.ProcUtil.FluctusClient.PremisEventSave(intellectualObject.Identifier,
-		"IntellectualObject", ingestEvent)
-	if err != nil {
-		message := fmt.Sprintf("Error saving ingest event for intellectual "+
-			"object '%s' to Fedora", intellectualObject.Identifier)
-		bagRecorder.handleFedoraError(result, message, err)
-		return err
-	}
-	bagRecorder.addMetadataRecord(result, "PremisEvent", "ingest", intellectualObject.Identifier, err)
-
 	idEvent := &bagman.PremisEvent{
 		Identifier:         eventId.String(),
 		EventType:          "identifier_assignment",
-		DateTime:           time.Now(),
+		DateTime:           bagman.NowUTC(),
 		Detail:             "Assigned bag identifier",
 		Outcome:            bagman.StatusSuccess,
 		OutcomeDetail:      intellectualObject.Identifier,
 		Object:             "APTrust bagman",
 		Agent:              "https://github.com/APTrust/bagman",
-		OutcomeInformation: "Institution domain + tar file name",
+		OutcomeInformation: bagman.VersionedOutcome("Institution domain + tar file name"),
 	}
-	_, err = bagRecorder.ProcUtil.FluctusClient.PremisEventSave(intellectualObject.Identifier,
-		"IntellectualObject", idEvent)
-	if err != nil {
-		message := fmt.Sprintf("Error saving identifier_assignment event for "+
-			"intellectual object '%s' to Fedora", intellectualObject.Identifier)
-		bagRecorder.handleFedoraError(result, message, err)
-		return err
+
+	// Send only the object events this deployment generates.
+	// On re-ingest, don't record events Fluctus already has.
+	intellectualObject.Events = make([]*bagman.PremisEvent, 0, 2)
+	if bagman.GeneratedPremisEvents.GeneratesObjectEvent("ingest") {
+		intellectualObject.Events = append(intellectualObject.Events, ingestEvent)
+	}
+	if bagman.GeneratedPremisEvents.GeneratesObjectEvent("identifier_assignment") {
+		intellectualObject.Events = append(intellectualObject.Events, idEvent)
+	}
+	intellectualObject.MergeEvents(existingEvents)
+	for _, event := range intellectualObject.Events {
+		_, err = bagRecorder.ProcUtil.FluctusClient.PremisEventSave(intellectualObject.Identifier,
+			"IntellectualObject", event)
+		if err != nil {
+			message := fmt.Sprintf("Error saving %s event for intellectual "+
+				"object '%s' to Fedora", event.EventType, intellectualObject.Identifier)
+			bagRecorder.handleFedoraError(result, message, err)
+			bagRecorder.addMetadataRecord(result, "PremisEvent", event.EventType,
+				intellectualObject.Identifier, err)
+			return err
+		}
+		bagRecorder.addMetadataRecord(result, "PremisEvent", event.EventType,
+			intellectualObject.Identifier, err)
 	}
-	bagRecorder.addMetadataRecord(result, "PremisEvent",
-		"identifier_assignment", intellectualObject.Identifier, err)
 
 	return nil
 }
@@ -468,6 +596,11 @@ func (bagRecorder *BagRecorder) addMetadataRecord(result *bagman.ProcessResult,
 	if recError != nil {
 		bagRecorder.ProcUtil.MessageLog.Fatal(recError)
 	}
+	if len(result.FedoraResult.MetadataRecords) % 50 == 0 {
+		bagRecorder.ProcUtil.MessageLog.Info("Recorded %.1f%% of %d files from %s in Fluctus",
+			result.FedoraResult.SaveProgress(), result.FedoraResult.RequiredRecordCount(),
+			result.S3File.Key.Key)
+	}
 }
 
 func (bagRecorder *BagRecorder) handleFedoraError(result *bagman.ProcessResult, message string, err error) {
@@ -477,7 +610,7 @@ func (bagRecorder *BagRecorder) handleFedoraError(result *bagman.ProcessResult,
 
 // Delete the original tar file from the depositor's S3 receiving bucket.
 func (bagRecorder *BagRecorder) DeleteS3File(result *bagman.ProcessResult) {
-	result.Stage = bagman.StageCleanup
+	result.EnterStage(bagman.StageCleanup, &bagRecorder.ProcUtil.Config)
 	if bagRecorder.ProcUtil.Config.DeleteOnSuccess == false {
 		// Don't delete the original tar files, because config says
 		// not to. (For integration tests, we don't delete our test
@@ -485,6 +618,7 @@ func (bagRecorder *BagRecorder) DeleteS3File(result *bagman.ProcessResult) {
 		bagRecorder.ProcUtil.MessageLog.Info("Not deleting %s/%s because " +
 			"config.DeleteOnSuccess == false", result.S3File.BucketName,
 			result.S3File.Key.Key)
+		result.CompleteStage(bagman.StageCleanup)
 		return
 	}
 	err := bagRecorder.ProcUtil.S3Client.Delete(result.S3File.BucketName,
@@ -496,7 +630,8 @@ func (bagRecorder *BagRecorder) DeleteS3File(result *bagman.ProcessResult) {
 			"bucket '%s': %v ", result.S3File.Key.Key, result.S3File.BucketName)
 		bagRecorder.ProcUtil.MessageLog.Error(errMessage)
 	} else {
-		result.BagDeletedAt = time.Now().UTC()
+		result.BagDeletedAt = bagman.NowUTC()
+		result.CompleteStage(bagman.StageCleanup)
 		bagRecorder.ProcUtil.MessageLog.Info("Deleted original file '%s' from bucket '%s'",
 			result.S3File.Key.Key, result.S3File.BucketName)
 	}
@@ -39,17 +39,24 @@ func NewBagRestorer(procUtil *bagman.ProcessUtil) (*BagRestorer) {
 // item into the pipleline.
 func (bagRestorer *BagRestorer) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return bagRestorer.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (bagRestorer *BagRestorer) ProcessMessage(message bagman.Message) error {
 	object := RestoreObject{
 		NsqMessage: message,
 		Retry: true,
 	}
 
 	// Deserialize the NSQ JSON message into object.ProcessStatus
-	err := json.Unmarshal(message.Body, &object.ProcessStatus)
+	err := json.Unmarshal(message.Body(), &object.ProcessStatus)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"[ERROR] Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		bagRestorer.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -77,7 +84,7 @@ func (bagRestorer *BagRestorer) HandleMessage(message *nsq.Message) error {
 	}
 
 	// Make a note that we're working on this item
-	err = bagRestorer.ProcUtil.RegisterItem(object.Key(), message.ID)
+	err = bagRestorer.ProcUtil.RegisterItem(object.Key(), message.ID())
 	if err != nil {
 		bagRestorer.ProcUtil.MessageLog.Info("Marking %s as complete because the file is already "+
 			"being restored under another message id.", object.Key())
@@ -104,9 +111,33 @@ func (bagRestorer *BagRestorer) HandleMessage(message *nsq.Message) error {
 			return nil
 		}
 		object.BagRestorer.SetLogger(bagRestorer.ProcUtil.MessageLog)
+		keyWrapper, err := bagRestorer.ProcUtil.Config.KeyWrapperFor(intelObj.InstitutionId)
+		if err != nil {
+			object.ErrorMessage = fmt.Sprintf("Cannot restore %s: %v", object.Key(), err)
+			bagRestorer.ResultsChannel <- &object
+			return nil
+		}
+		if keyWrapper != nil {
+			object.BagRestorer.SetKeyWrapper(keyWrapper)
+		}
 		if bagRestorer.ProcUtil.Config.CustomRestoreBucket != "" {
 			object.BagRestorer.SetCustomRestoreBucket(bagRestorer.ProcUtil.Config.CustomRestoreBucket)
 		}
+		if bagRestorer.ProcUtil.Config.RestoreEventHistory {
+			// The summary files we restore from don't include
+			// events, so get the object again with its relations.
+			fullObj, err := bagRestorer.ProcUtil.FluctusClient.IntellectualObjectGet(object.Key(), true)
+			if err == nil && fullObj == nil {
+				err = fmt.Errorf("Fluctus returned nothing")
+			}
+			if err != nil {
+				object.ErrorMessage = fmt.Sprintf("Cannot retrieve event history of %s from Fluctus: %v",
+					object.Key(), err)
+				bagRestorer.ResultsChannel <- &object
+				return nil
+			}
+			object.BagRestorer.SetEventHistory(fullObj)
+		}
 	}
 
 	// Make sure we have enough disk space to build this item.
@@ -172,29 +203,28 @@ func (bagRestorer *BagRestorer) logResult() {
 func (bagRestorer *BagRestorer) doRestore() {
 	for object := range bagRestorer.RestoreChannel {
 		bagRestorer.ProcUtil.MessageLog.Info("Restoring %s", object.Key())
-		if object.NsqMessage != nil {
-			// Touch to prevent timeout. PivotalTracker #93237522
-			object.NsqMessage.Touch()
-		}
+		// Touch to prevent timeout. PivotalTracker #93237522
+		object.NsqMessage.Touch()
 		urls, err := object.BagRestorer.RestoreAndPublish(object.NsqMessage)
-		if object.NsqMessage != nil {
-			// Touch to prevent timeout. PivotalTracker #93237522
-			object.NsqMessage.Touch()
-		}
+		// Touch to prevent timeout. PivotalTracker #93237522
+		object.NsqMessage.Touch()
 		if err != nil {
 			// Something went wrong.
 			object.ErrorMessage = fmt.Sprintf("An error occurred during the restoration process: %v",
 				err)
 			object.ProcessStatus.Stage = bagman.StageRequested
 			object.ProcessStatus.Status = bagman.StatusFailed
+			object.ProcessStatus.SetOutcome(bagman.OutcomeFailure, "")
 			object.ProcessStatus.Note = object.ErrorMessage
 			object.ProcessStatus.Retry = false
 			object.ProcessStatus.NeedsAdminReview = true
 		} else {
 			// All is well.
 			object.RestorationUrls = urls
+			object.ProcessStatus.Note = bagRestorer.downloadNote(object)
 			object.ProcessStatus.Stage = bagman.StageResolve
 			object.ProcessStatus.Status = bagman.StatusSuccess
+			object.ProcessStatus.SetOutcome(bagman.OutcomeSuccess, "")
 			object.ProcessStatus.Retry = true
 			object.ProcessStatus.NeedsAdminReview = false
 		}
@@ -202,10 +232,25 @@ func (bagRestorer *BagRestorer) doRestore() {
 	}
 }
 
+// Returns the note to record in Fluctus for a successful restoration,
+// with time-limited download links for the restored bags. If we can't
+// presign the URLs, the restoration still succeeded, so we log the
+// problem and return a note without the links.
+func (bagRestorer *BagRestorer) downloadNote(object *RestoreObject) (string) {
+	note, err := bagman.PresignedDownloadNote(bagRestorer.ProcUtil.S3Client,
+		object.RestorationUrls, bagman.RESTORED_BAG_URL_LIFETIME)
+	if err != nil {
+		bagRestorer.ProcUtil.MessageLog.Error("Cannot create download links for %s: %v",
+			object.Key(), err)
+		return fmt.Sprintf("Restored bag to %s", object.RestoredBagUrls())
+	}
+	return note
+}
+
 type RestoreObject struct {
 	BagRestorer     *bagman.BagRestorer
 	ProcessStatus   *bagman.ProcessStatus
-	NsqMessage      *nsq.Message
+	NsqMessage      bagman.Message
 	ErrorMessage    string
 	Retry           bool
 	RestorationUrls []string
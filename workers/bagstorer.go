@@ -52,11 +52,18 @@ func NewBagStorer(procUtil *bagman.ProcessUtil) (*BagStorer) {
 // item into the pipleline.
 func (bagStorer *BagStorer) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return bagStorer.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (bagStorer *BagStorer) ProcessMessage(message bagman.Message) error {
 	var result bagman.ProcessResult
-	err := json.Unmarshal(message.Body, &result)
+	err := json.Unmarshal(message.Body(), &result)
 	if err != nil {
 		bagStorer.ProcUtil.MessageLog.Error("Could not unmarshal JSON data from nsq:",
-			string(message.Body))
+			string(message.Body()))
 		message.Finish()
 		return fmt.Errorf("Could not unmarshal JSON data from nsq")
 	}
@@ -95,7 +102,7 @@ func (bagStorer *BagStorer) HandleMessage(message *nsq.Message) error {
 	// Note that the key we include in the syncMap includes multipart
 	// bag endings, so we can be working on ncsu.edu/obj.b1of2.tar and
 	// ncsu.edu/obj.b2of2.tar at the same time. This is what we want.
-	mapErr := bagStorer.ProcUtil.RegisterItem(result.S3File.BagName(), message.ID)
+	mapErr := bagStorer.ProcUtil.RegisterItem(result.S3File.BagName(), message.ID())
 	if mapErr != nil {
 		bagStorer.ProcUtil.MessageLog.Info("Marking %s as complete because the file is already "+
 			"being processed under another message id.\n", result.S3File.Key.Key)
@@ -127,7 +134,13 @@ func (bagStorer *BagStorer) HandleMessage(message *nsq.Message) error {
 // an admin in these cases. The JSON log will have full information about
 // the state of all of the files.
 func (bagStorer *BagStorer) saveToStorage() {
-	for helper := range bagStorer.StorageChannel {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("store.save", bagStorer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagStorer.recoverItem(helper, stagePanic, bagStorer.ResultsChannel)
+			go bagStorer.saveToStorage()
+		})
+	for helper = range bagStorer.StorageChannel {
 		// Touch before and after sending generic files,
 		// since that process can take a long time for large bags.
 		helper.Result.NsqMessage.Touch()
@@ -164,7 +177,13 @@ func (bagStorer *BagStorer) saveToStorage() {
 // to Fluctus saying whether the bag succeeded or failed.
 // THIS STEP ALWAYS RUNS, EVEN IF PRIOR STEPS FAILED.
 func (bagStorer *BagStorer) logResult() {
-	for helper := range bagStorer.ResultsChannel {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("store.log_result", bagStorer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagStorer.recoverItem(helper, stagePanic, bagStorer.CleanUpChannel)
+			go bagStorer.logResult()
+		})
+	for helper = range bagStorer.ResultsChannel {
 		helper.LogResult()
 		bagStorer.CleanUpChannel <- helper
 	}
@@ -175,7 +194,13 @@ func (bagStorer *BagStorer) logResult() {
 // and untarred.
 // THIS STEP ALWAYS RUNS, EVEN IF PRIOR STEPS FAILED.
 func (bagStorer *BagStorer) doCleanUp() {
-	for helper := range bagStorer.CleanUpChannel {
+	var helper *bagman.IngestHelper
+	defer bagman.RecoverStage("store.cleanup", bagStorer.ProcUtil.MessageLog,
+		func(stagePanic *bagman.StagePanic) {
+			bagStorer.recoverItem(helper, stagePanic, nil)
+			go bagStorer.doCleanUp()
+		})
+	for helper = range bagStorer.CleanUpChannel {
 		result := helper.Result
 		result.NsqMessage.Touch()
 		bagStorer.ProcUtil.MessageLog.Debug("Cleaning up %s", result.S3File.Key.Key)
@@ -190,6 +215,9 @@ func (bagStorer *BagStorer) doCleanUp() {
 					bagStorer.ProcUtil.MessageLog.Error(e.Error())
 				}
 			}
+		} else {
+			bagStorer.ProcUtil.MessageLog.Debug("No local tar file for %s. "+
+				"Skipping file cleanup.", result.S3File.Key.Key)
 		}
 
 		// Build and send message back to NSQ, indicating whether
@@ -208,9 +236,34 @@ func (bagStorer *BagStorer) doCleanUp() {
 }
 
 
+// recoverItem records a panic in one of the stages as an error on
+// the bag that was in process, and sends it on to nextChannel, so
+// the remaining stages can log it, clean up, and requeue the NSQ
+// message. If the cleanup stage panicked, nextChannel is nil, and
+// we requeue the message here.
+func (bagStorer *BagStorer) recoverItem(helper *bagman.IngestHelper, stagePanic *bagman.StagePanic, nextChannel chan *bagman.IngestHelper) {
+	if helper == nil {
+		return
+	}
+	helper.Result.RecordPanic(stagePanic)
+	if nextChannel != bagStorer.ResultsChannel {
+		// logResult won't see this bag again, so log the
+		// stack trace to the JSON log here.
+		json, _ := json.Marshal(helper.Result)
+		bagStorer.ProcUtil.JsonLog.Println(string(json))
+	}
+	if nextChannel != nil {
+		nextChannel <- helper
+		return
+	}
+	bagStorer.ProcUtil.MessageLog.Info("Requeueing %s", helper.Result.S3File.Key.Key)
+	helper.Result.NsqMessage.Requeue(5 * time.Minute)
+	bagStorer.ProcUtil.UnregisterItem(helper.Result.S3File.BagName())
+}
+
 // Puts an item into the queue for Fluctus/Fedora metadata processing.
 func (bagStorer *BagStorer) SendToMetadataQueue(helper *bagman.IngestHelper) {
-	err := bagman.Enqueue(helper.ProcUtil.Config.NsqdHttpAddress,
+	err := helper.ProcUtil.Enqueue(
 		helper.ProcUtil.Config.RecordWorker.NsqTopic, helper.Result)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error adding '%s' to metadata queue: %v ",
@@ -225,7 +278,7 @@ func (bagStorer *BagStorer) SendToMetadataQueue(helper *bagman.IngestHelper) {
 
 // Puts an item into the trouble queue.
 func (bagStorer *BagStorer) SendToTroubleQueue(helper *bagman.IngestHelper) {
-	err := bagman.Enqueue(helper.ProcUtil.Config.NsqdHttpAddress,
+	err := helper.ProcUtil.Enqueue(
 		helper.ProcUtil.Config.TroubleWorker.NsqTopic, helper.Result)
 	if err != nil {
 		helper.ProcUtil.MessageLog.Error("Could not send '%s' to trouble queue: %v\n",
@@ -5,6 +5,7 @@ import (
 	"github.com/APTrust/bagman/bagman"
 	"github.com/nsqio/go-nsq"
 	"os"
+	"time"
 )
 
 // TODO: Write tests for these.
@@ -29,6 +30,24 @@ func CreateProcUtil(serviceGroup string) (procUtil *bagman.ProcessUtil) {
 
 // Creates and returns an NSQ consumer for a worker process.
 func CreateNsqConsumer(config *bagman.Config, workerConfig *bagman.WorkerConfig) (*nsq.Consumer, error) {
+	nsqConfig := newNsqConfig(workerConfig)
+	return nsq.NewConsumer(workerConfig.NsqTopic, workerConfig.NsqChannel, nsqConfig)
+}
+
+// Creates and returns an NSQ consumer for an ingest worker, one that
+// calls ProcessResult.EnterStage. A touch only resets the message's
+// timer to msg_timeout, so msg_timeout has to be long enough for the
+// longest stage in config.StageMsgTimeout.
+func CreateIngestNsqConsumer(config *bagman.Config, workerConfig *bagman.WorkerConfig) (*nsq.Consumer, error) {
+	nsqConfig := newNsqConfig(workerConfig)
+	msgTimeout, err := time.ParseDuration(workerConfig.MessageTimeout)
+	if err == nil && config.StageMsgTimeout.Max() > msgTimeout {
+		nsqConfig.Set("msg_timeout", config.StageMsgTimeout.Max())
+	}
+	return nsq.NewConsumer(workerConfig.NsqTopic, workerConfig.NsqChannel, nsqConfig)
+}
+
+func newNsqConfig(workerConfig *bagman.WorkerConfig) (*nsq.Config) {
 	nsqConfig := nsq.NewConfig()
 	nsqConfig.Set("max_in_flight", workerConfig.MaxInFlight)
 	nsqConfig.Set("heartbeat_interval", workerConfig.HeartbeatInterval)
@@ -36,7 +55,7 @@ func CreateNsqConsumer(config *bagman.Config, workerConfig *bagman.WorkerConfig)
 	nsqConfig.Set("read_timeout", workerConfig.ReadTimeout)
 	nsqConfig.Set("write_timeout", workerConfig.WriteTimeout)
 	nsqConfig.Set("msg_timeout", workerConfig.MessageTimeout)
-	return nsq.NewConsumer(workerConfig.NsqTopic, workerConfig.NsqChannel, nsqConfig)
+	return nsqConfig
 }
 
 // Initializes basic services for a reader fills the queues.
@@ -25,18 +25,26 @@ func NewFailedFixityProcessor(procUtil *bagman.ProcessUtil) (*FailedFixityProces
 }
 
 func (processor *FailedFixityProcessor) HandleMessage(message *nsq.Message) error {
+	return processor.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage dumps the FixityResult in the message to a JSON file.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (processor *FailedFixityProcessor) ProcessMessage(message bagman.Message) error {
 	var result bagman.FixityResult
-	err := json.Unmarshal(message.Body, &result)
+	err := json.Unmarshal(message.Body(), &result)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		processor.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
 	}
 	processor.dumpToFile(&result)
 	processor.ProcUtil.MessageLog.Info("Processed %s", result.GenericFile.Identifier)
+	message.Finish()
 	return nil
 }
 
@@ -25,18 +25,26 @@ func NewFailedReplicationProcessor(procUtil *bagman.ProcessUtil) (*FailedReplica
 }
 
 func (processor *FailedReplicationProcessor) HandleMessage(message *nsq.Message) error {
+	return processor.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage dumps the File in the message to a JSON file.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (processor *FailedReplicationProcessor) ProcessMessage(message bagman.Message) error {
 	var file bagman.File
-	err := json.Unmarshal(message.Body, &file)
+	err := json.Unmarshal(message.Body(), &file)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		processor.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
 	}
 	processor.dumpToFile(&file)
 	processor.ProcUtil.MessageLog.Info("Processed %s", file.Identifier)
+	message.Finish()
 	return nil
 }
 
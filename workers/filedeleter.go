@@ -1,5 +1,8 @@
 // filedelete.go deletes files from the S3 preservation bucket
-// at the request of users/admins.
+// at the request of users/admins. Deletes are soft: the file is
+// marked deleted in Fluctus and moved to quarantine, where it
+// stays until apt_purge_quarantine removes it after the retention
+// period. Until then, apt_undelete can restore it.
 
 package workers
 
@@ -17,9 +20,12 @@ import (
 type DeleteObject struct {
 	GenericFile     *bagman.GenericFile
 	ProcessStatus   *bagman.ProcessStatus   `json:"-"`
-	NsqMessage      *nsq.Message            `json:"-"`
+	NsqMessage      bagman.Message          `json:"-"`
 	ErrorMessage    string
 	Retry           bool
+	// The key under which the file was quarantined in both
+	// the preservation and replication buckets.
+	QuarantineKey   string
 }
 
 type FileDeleter struct {
@@ -29,14 +35,26 @@ type FileDeleter struct {
 	// Replication client connects to the
 	// replication bucket in Oregon.
 	S3ReplicationClient *bagman.S3Client
+	// Quarantines for the preservation and
+	// replication buckets.
+	Quarantine            *bagman.Quarantine
+	ReplicationQuarantine *bagman.Quarantine
 }
 
 
 func NewFileDeleter(procUtil *bagman.ProcessUtil) (*FileDeleter) {
 	replicationClient, _ := bagman.NewS3Client(aws.USWest2)
+	retention, err := procUtil.Config.DeletedFileRetentionDuration()
+	if err != nil {
+		procUtil.MessageLog.Fatalf("Invalid config: %v", err)
+	}
 	fileDeleter := &FileDeleter{
 		ProcUtil: procUtil,
 		S3ReplicationClient: replicationClient,
+		Quarantine: bagman.NewQuarantine(procUtil.S3Client,
+			procUtil.Config.PreservationBucket, retention),
+		ReplicationQuarantine: bagman.NewQuarantine(replicationClient,
+			procUtil.Config.ReplicationBucket, retention),
 	}
 	workerBufferSize := procUtil.Config.FileDeleteWorker.Workers * 10
 	fileDeleter.DeleteChannel = make(chan *DeleteObject, workerBufferSize)
@@ -52,14 +70,21 @@ func NewFileDeleter(procUtil *bagman.ProcessUtil) (*FileDeleter) {
 // item into the pipleline.
 func (fileDeleter *FileDeleter) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return fileDeleter.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (fileDeleter *FileDeleter) ProcessMessage(message bagman.Message) error {
 
 	// Deserialize the NSQ JSON message into object.ProcessStatus
 	processStatus := &bagman.ProcessStatus{}
-	err := json.Unmarshal(message.Body, processStatus)
+	err := json.Unmarshal(message.Body(), processStatus)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		fileDeleter.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -92,7 +117,7 @@ func (fileDeleter *FileDeleter) HandleMessage(message *nsq.Message) error {
 	}
 
 	// Make a note that we're working on this item
-	err = fileDeleter.ProcUtil.RegisterItem(processStatus.GenericFileIdentifier, message.ID)
+	err = fileDeleter.ProcUtil.RegisterItem(processStatus.GenericFileIdentifier, message.ID())
 	if err != nil {
 		fileDeleter.ProcUtil.MessageLog.Info("Marking %s as complete because the file is already "+
 			"being deleted under another message id.", processStatus.GenericFileIdentifier)
@@ -162,15 +187,21 @@ func (fileDeleter *FileDeleter) logResult() {
 		// Mark item as resolved in Fluctus & tell the queue what happened.
 		if deleteObject.ErrorMessage != "" {
 			deleteObject.ProcessStatus.Status = bagman.StatusFailed
+			deleteObject.ProcessStatus.SetOutcome(bagman.OutcomeFailure, "")
 			deleteObject.ProcessStatus.Stage = bagman.StageRequested
 			deleteObject.ProcessStatus.Note = deleteObject.ErrorMessage
 		} else {
 			deleteObject.ProcessStatus.Status = bagman.StatusSuccess
+			deleteObject.ProcessStatus.SetOutcome(bagman.OutcomeSuccess,
+				"File is in quarantine and can be undeleted until it expires.")
 			deleteObject.ProcessStatus.Stage = bagman.StageResolve
+			expires, _ := fileDeleter.Quarantine.Expires(deleteObject.QuarantineKey)
 			deleteObject.ProcessStatus.Note = fmt.Sprintf("Deleted generic file '%s' " +
-				"from '%s' at %s at the request of %s",
+				"from '%s' at %s at the request of %s. The file is in quarantine " +
+				"at '%s' and can be undeleted until %s.",
 				deleteObject.GenericFile.Identifier, deleteObject.GenericFile.URI,
-				time.Now().Format(time.RFC3339), deleteObject.ProcessStatus.User)
+				bagman.FormatUTC(time.Now()), deleteObject.ProcessStatus.User,
+				deleteObject.QuarantineKey, expires.Format(time.RFC3339))
 		}
 		// Clear Pid and Node so Fluctus knows no one is working on this.
 		deleteObject.ProcessStatus.Node = ""
@@ -210,31 +241,66 @@ func (fileDeleter *FileDeleter) doDelete() {
 			fileDeleter.ResultsChannel <- deleteObject
 			continue
 		}
-		// Delete it
-		fileDeleter.ProcUtil.MessageLog.Debug("Deleting %s from %s/%s",
+		fileDeleter.ProcUtil.MessageLog.Debug("Moving %s from %s/%s to quarantine",
 			deleteObject.ProcessStatus.GenericFileIdentifier,
 			fileDeleter.ProcUtil.Config.PreservationBucket,
 			fileName)
-		// Delete from US Standard (Virginia)
-		err = fileDeleter.ProcUtil.S3Client.Delete(fileDeleter.ProcUtil.Config.PreservationBucket, fileName)
+		deletedAt := bagman.NowUTC()
+		// Quarantine in US Standard (Virginia)
+		quarantineKey, err := fileDeleter.quarantine(fileDeleter.Quarantine,
+			fileDeleter.ProcUtil.S3Client, fileName, deletedAt)
 		if err != nil {
 			deleteObject.ErrorMessage = fmt.Sprintf(
-				"Error deleting from US Standard region (Virginia): %v", err)
+				"Error quarantining in US Standard region (Virginia): %v", err)
 		} else {
+			deleteObject.QuarantineKey = quarantineKey
 			fileDeleter.ProcUtil.MessageLog.Info(
-				"Deleted %s (%s) from Virginia bucket",
-				deleteObject.GenericFile.Identifier, fileName)
+				"Moved %s (%s) to %s in Virginia bucket",
+				deleteObject.GenericFile.Identifier, fileName, quarantineKey)
 		}
-		// Delete from US West-2 (Oregon)
-		err = fileDeleter.S3ReplicationClient.Delete(fileDeleter.ProcUtil.Config.ReplicationBucket, fileName)
+		// Quarantine in US West-2 (Oregon)
+		quarantineKey, err = fileDeleter.quarantine(fileDeleter.ReplicationQuarantine,
+			fileDeleter.S3ReplicationClient, fileName, deletedAt)
 		if err != nil {
 			deleteObject.ErrorMessage += fmt.Sprintf(
-				"Error deleting from US West-2 region (Oregon): %v", err)
+				"Error quarantining in US West-2 region (Oregon): %v", err)
 		} else {
 			fileDeleter.ProcUtil.MessageLog.Info(
-				"Deleted %s (%s) from Oregon bucket",
-				deleteObject.GenericFile.Identifier, fileName)
+				"Moved %s (%s) to %s in Oregon bucket",
+				deleteObject.GenericFile.Identifier, fileName, quarantineKey)
+		}
+		// Mark it deleted in Fluctus only after both copies are in
+		// quarantine. If either move failed, the file is still active,
+		// and the requeued delete picks up where this one left off.
+		if deleteObject.ErrorMessage == "" {
+			err = fileDeleter.ProcUtil.FluctusClient.GenericFileSetState(
+				deleteObject.GenericFile.Identifier, bagman.StateDeleted)
+			if err != nil {
+				deleteObject.ErrorMessage = fmt.Sprintf(
+					"Cannot mark GenericFile deleted in Fluctus: %v", err)
+			}
 		}
 		fileDeleter.ResultsChannel <- deleteObject
 	}
 }
+
+// Moves fileName into quarantine and returns the quarantine key.
+// If a previous attempt already moved the file, this returns the
+// existing quarantine key, so requeued deletes can pick up where
+// they left off.
+func (fileDeleter *FileDeleter) quarantine(quarantine *bagman.Quarantine, client *bagman.S3Client, fileName string, deletedAt time.Time) (string, error) {
+	exists, err := client.Exists(quarantine.Bucket, fileName)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		keys, err := quarantine.Find(fileName)
+		if err != nil {
+			return "", err
+		}
+		if len(keys) > 0 {
+			return keys[len(keys)-1], nil
+		}
+	}
+	return quarantine.Move(fileName, deletedAt)
+}
@@ -4,6 +4,15 @@ It downloads the generic files from S3 preservation storage,
 calculates the files' SHA256 checksums and writes the results back
 to Fluctus. None of the data downloaded from S3 is saved to disk;
 it's simply streamed through the SHA256 hash writer and then discarded.
+
+Encrypted files are checked according to their institution's
+EncryptionConfig.FixityMode: against the ciphertext digest recorded
+at ingest (the default), by decrypting the stream and checking the
+plaintext digest in Fedora, or not at all.
+
+If FixityCheckReplicas is set in the config, the worker also checks
+the copy of each replicated file in the replication bucket, and
+records a separate fixity event for it.
 */
 package workers
 
@@ -17,15 +26,28 @@ import (
 )
 
 type FixityChecker struct {
-	FixityChannel  chan *bagman.FixityResult
-	ResultsChannel chan *bagman.FixityResult
-	ProcUtil       *bagman.ProcessUtil
+	FixityChannel       chan *bagman.FixityResult
+	ResultsChannel      chan *bagman.FixityResult
+	ProcUtil            *bagman.ProcessUtil
+	// S3ReplicationClient reads the replication bucket. It's nil
+	// unless we're checking replicas.
+	S3ReplicationClient *bagman.S3Client
 }
 
 func NewFixityChecker(procUtil *bagman.ProcessUtil) (*FixityChecker) {
 	fixityChecker := &FixityChecker{
 		ProcUtil: procUtil,
 	}
+	if procUtil.Config.FixityCheckReplicas {
+		region, err := procUtil.Config.ReplicationAWSRegion()
+		if err != nil {
+			procUtil.MessageLog.Fatalf(err.Error())
+		}
+		fixityChecker.S3ReplicationClient, err = bagman.NewS3Client(region)
+		if err != nil {
+			procUtil.MessageLog.Fatalf("Cannot create S3 client for replication bucket: %v", err)
+		}
+	}
 	workerBufferSize := procUtil.Config.FixityWorker.Workers * 10
 	fixityChecker.FixityChannel = make(chan *bagman.FixityResult, workerBufferSize)
 	fixityChecker.ResultsChannel = make(chan *bagman.FixityResult, workerBufferSize)
@@ -42,12 +64,19 @@ func NewFixityChecker(procUtil *bagman.ProcessUtil) (*FixityChecker) {
 // item into the pipleline.
 func (fixityChecker *FixityChecker) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return fixityChecker.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (fixityChecker *FixityChecker) ProcessMessage(message bagman.Message) error {
 	var genericFile bagman.GenericFile
-	err := json.Unmarshal(message.Body, &genericFile)
+	err := json.Unmarshal(message.Body(), &genericFile)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		fixityChecker.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
@@ -76,20 +105,100 @@ func (fixityChecker *FixityChecker) checkFile() {
 	for result := range fixityChecker.FixityChannel {
 		fixityChecker.ProcUtil.MessageLog.Info("Checking %s", result.GenericFile.Identifier)
 		result.NsqMessage.Touch()
-		err := fixityChecker.ProcUtil.S3Client.FetchAndCalculateSha256(result, "")
-		// Log usage errors. These shouldn't happen.
-		if err != nil && strings.Index(err.Error(), "cannot be nil") > 0 {
-			fixityChecker.ProcUtil.MessageLog.Error(err.Error())
-		}
+		fixityChecker.calculateDigest(result, fixityChecker.ProcUtil.S3Client)
 		result.NsqMessage.Touch()
+		if fixityChecker.S3ReplicationClient != nil {
+			fixityChecker.checkReplica(result)
+			result.NsqMessage.Touch()
+		}
 		fixityChecker.ResultsChannel <- result
 	}
 }
 
+// Fetches the file in result through client and calculates its digest.
+func (fixityChecker *FixityChecker) calculateDigest(result *bagman.FixityResult, client *bagman.S3Client) {
+	var err error
+	if result.GenericFile.IsEncrypted() {
+		err = fixityChecker.checkEncryptedFile(result, client)
+	} else {
+		err = client.FetchAndCalculateSha256(result, "")
+	}
+	// Log usage errors. These shouldn't happen.
+	if err != nil && strings.Index(err.Error(), "cannot be nil") > 0 {
+		fixityChecker.ProcUtil.MessageLog.Error(err.Error())
+	}
+}
+
+// Checks the copy of the file in the replication bucket, and sets
+// result.ReplicaResult if there's a fixity event to save for it.
+// We don't retry failed replica checks, since that would mean
+// checking the preservation copy again. Files with no replica
+// show up in the replication lag report instead.
+func (fixityChecker *FixityChecker) checkReplica(result *bagman.FixityResult) {
+	replicaResult := bagman.NewReplicaFixityResult(result.GenericFile)
+	if replicaResult == nil {
+		fixityChecker.ProcUtil.MessageLog.Info("Not checking replica of %s: it has not been replicated",
+			result.GenericFile.Identifier)
+		return
+	}
+	fixityChecker.calculateDigest(replicaResult, fixityChecker.S3ReplicationClient)
+	if replicaResult.FixityMode == bagman.FIXITY_MODE_SKIP {
+		return
+	}
+	if replicaResult.GotDigestFromPreservationFile() == false && replicaResult.DecryptionFailed == false {
+		fixityChecker.ProcUtil.MessageLog.Error("Could not check replica of %s at %s: %s",
+			result.GenericFile.Identifier, replicaResult.GenericFile.URI, replicaResult.ErrorMessage)
+		return
+	}
+	result.ReplicaResult = replicaResult
+}
+
+// Checks an encrypted file according to the fixity mode for its
+// institution. In skip mode, this doesn't fetch the file at all.
+func (fixityChecker *FixityChecker) checkEncryptedFile(result *bagman.FixityResult, client *bagman.S3Client) (error) {
+	institution, _ := result.GenericFile.InstitutionId()
+	mode, err := fixityChecker.ProcUtil.Config.EncryptedFixityMode(institution)
+	if err != nil {
+		result.ErrorMessage = err.Error()
+		result.Retry = false
+		return err
+	}
+	result.FixityMode = mode
+	switch mode {
+	case bagman.FIXITY_MODE_SKIP:
+		return nil
+	case bagman.FIXITY_MODE_DECRYPT:
+		keyWrapper, err := fixityChecker.ProcUtil.Config.KeyWrapperFor(institution)
+		if err != nil {
+			result.ErrorMessage = err.Error()
+			result.Retry = false
+			return err
+		}
+		dataKey, err := result.GenericFile.Encryption.UnwrapDataKey(keyWrapper)
+		if err != nil {
+			result.ErrorMessage = fmt.Sprintf("Cannot unwrap data key for %s: %v",
+				result.GenericFile.Identifier, err)
+			result.Retry = false
+			return err
+		}
+		return client.FetchDecryptAndCalculateSha256(result, dataKey)
+	}
+	return client.FetchAndCalculateSha256(result, "")
+}
+
 func (fixityChecker *FixityChecker) logResult() {
 	for result := range fixityChecker.ResultsChannel {
-		fixityChecker.ProcUtil.MessageLog.Debug("Fedora digest = '%s' ... S3 digest = '%s'",
-			result.FedoraSha256(), result.Sha256)
+		if result.FixityMode == bagman.FIXITY_MODE_SKIP {
+			fixityChecker.ProcUtil.MessageLog.Info("Skipping fixity check on encrypted file %s: "+
+				"fixity mode for its institution is '%s'", result.GenericFile.Identifier,
+				bagman.FIXITY_MODE_SKIP)
+			result.NsqMessage.Finish()
+			fixityChecker.ProcUtil.IncrementSucceeded()
+			fixityChecker.logStats()
+			continue
+		}
+		fixityChecker.ProcUtil.MessageLog.Debug("Expected digest = '%s' ... S3 digest = '%s'",
+			result.ExpectedSha256(), result.Sha256)
 		if result.S3FileExists == false {
 			fixityChecker.ProcUtil.MessageLog.Error("GenericFile '%s' with URL '%s' does not exist in S3",
 				result.GenericFile.Identifier, result.GenericFile.URI)
@@ -98,16 +207,19 @@ func (fixityChecker *FixityChecker) logResult() {
 			fixityChecker.logStats()
 			continue
 		}
-		// Check failure cases...
-		if result.GotDigestFromPreservationFile() == false && result.Retry == true {
-			if result.NsqMessage.Attempts >= uint16(fixityChecker.ProcUtil.Config.FixityWorker.MaxAttempts) {
+		// Check failure cases. A file that failed decryption has
+		// no digest, but gets a failed fixity event below.
+		if result.GotDigestFromPreservationFile() == false && result.DecryptionFailed == false {
+			if result.Retry == false ||
+				result.NsqMessage.Attempts() >= uint16(fixityChecker.ProcUtil.Config.FixityWorker.MaxAttempts) {
 				fixityChecker.ProcUtil.MessageLog.Error(
-					"Attempt to calculate checksum for file %s at S3 URL %s has failed too many times. " +
-						"This item will not be requeued.",
+					"Attempt to calculate checksum for file %s at S3 URL %s has failed too many times, " +
+						"or cannot be retried (%s). This item will not be requeued.",
 					result.GenericFile.Identifier,
-					result.GenericFile.URI)
+					result.GenericFile.URI,
+					result.ErrorMessage)
 				// Too many failures. Send to trouble queue.
-				err := bagman.Enqueue(fixityChecker.ProcUtil.Config.NsqdHttpAddress,
+				err := fixityChecker.ProcUtil.Enqueue(
 					fixityChecker.ProcUtil.Config.FailedFixityWorker.NsqTopic, result)
 				if err != nil {
 					fixityChecker.ProcUtil.MessageLog.Error("Could not send '%s' to trouble queue: %v",
@@ -137,6 +249,11 @@ func (fixityChecker *FixityChecker) logResult() {
 			result.NsqMessage.Requeue(1 * time.Minute)
 			fixityChecker.ProcUtil.IncrementFailed()
 		} else {
+			// The replica's event is saved only once the main event
+			// is, since a failure above requeues the whole check.
+			if result.ReplicaResult != nil {
+				fixityChecker.savePremisEvent(result.ReplicaResult)
+			}
 			fixityChecker.ProcUtil.MessageLog.Info("Finished with %s", result.GenericFile.Identifier)
 			fixityChecker.ProcUtil.IncrementSucceeded()
 			result.NsqMessage.Finish()
@@ -153,8 +270,8 @@ func (fixityChecker *FixityChecker) savePremisEvent(fixityResult *bagman.FixityR
 		return false
 	}
 	if premisEvent.Outcome == "failure" {
-		fixityChecker.ProcUtil.MessageLog.Error("SHA256 CHECKSUM DOES NOT MATCH FOR GENERIC FILE %s",
-			fixityResult.GenericFile.Identifier)
+		fixityChecker.ProcUtil.MessageLog.Error("SHA256 CHECKSUM DOES NOT MATCH FOR GENERIC FILE %s (%s)",
+			fixityResult.GenericFile.Identifier, fixityResult.GenericFile.URI)
 	}
 	_, err = fixityChecker.ProcUtil.FluctusClient.PremisEventSave(
 		fixityResult.GenericFile.Identifier,
@@ -1,6 +1,7 @@
 // replicator.go copies S3 files from one bucket to another.
 // This is used to replicate files in one S3 region (Virginia)
-// to another region (Oregon).
+// to another region (Oregon). Each copy is verified against the
+// original, and its URL is recorded on the GenericFile in Fluctus.
 
 package workers
 
@@ -9,7 +10,6 @@ import (
 	"fmt"
 	"github.com/APTrust/bagman/bagman"
 	"github.com/nsqio/go-nsq"
-	"github.com/crowdmob/goamz/aws"
 	"github.com/crowdmob/goamz/s3"
 	"os"
 	"path/filepath"
@@ -18,20 +18,36 @@ import (
 
 type ReplicationObject struct {
 	File       *bagman.File
-	NsqMessage *nsq.Message
+	NsqMessage bagman.Message
+	// Copied is true if the file was already in the replication
+	// bucket when we got the message, usually because an earlier
+	// attempt copied it but failed to verify or record it.
+	Copied     bool
 }
 
 type Replicator struct {
 	ReplicationChannel  chan *ReplicationObject
 	S3ReplicationClient *bagman.S3Client
+	Copier              *bagman.ReplicaCopier
 	ProcUtil            *bagman.ProcessUtil
 }
 
 func NewReplicator(procUtil *bagman.ProcessUtil) (*Replicator) {
-	replicationClient, _ := bagman.NewS3Client(aws.USWest2)
+	region, err := procUtil.Config.ReplicationAWSRegion()
+	if err != nil {
+		procUtil.MessageLog.Fatalf(err.Error())
+	}
+	replicationClient, _ := bagman.NewS3Client(region)
 	replicator := &Replicator{
 		ProcUtil: procUtil,
 		S3ReplicationClient: replicationClient,
+		Copier: &bagman.ReplicaCopier{
+			Source:       procUtil.S3Client,
+			SourceBucket: procUtil.Config.PreservationBucket,
+			Dest:         replicationClient,
+			DestBucket:   procUtil.Config.ReplicationBucket,
+			SameAccount:  procUtil.Config.ReplicationSameAccount,
+		},
 	}
 	workerBufferSize := procUtil.Config.StoreWorker.Workers * 10
 	replicator.ReplicationChannel = make(chan *ReplicationObject, workerBufferSize)
@@ -45,11 +61,18 @@ func NewReplicator(procUtil *bagman.ProcessUtil) (*Replicator) {
 // item into the replication channel.
 func (replicator *Replicator) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
+	return replicator.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage puts the item in the message into the pipeline.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (replicator *Replicator) ProcessMessage(message bagman.Message) error {
 	var file bagman.File
-	err := json.Unmarshal(message.Body, &file)
+	err := json.Unmarshal(message.Body(), &file)
 	if err != nil {
 		replicator.ProcUtil.MessageLog.Error("Could not unmarshal JSON data from nsq:",
-			string(message.Body))
+			string(message.Body()))
 		message.Finish()
 		return fmt.Errorf("Could not unmarshal JSON data from nsq")
 	}
@@ -63,24 +86,30 @@ func (replicator *Replicator) HandleMessage(message *nsq.Message) error {
 		message.Finish()
 		return nil
 	}
-	if replicator.ReplicatedFileExists(file.Uuid) {
-		replicator.ProcUtil.MessageLog.Info("File %s already exists in replication bucket",
-			file.Identifier)
-		message.Finish()
-		return nil
-	}
 	replicationObject := &ReplicationObject{
 		NsqMessage: message,
 		File: &file,
 	}
+	if replicator.ReplicatedFileExists(file.Uuid) {
+		// Don't just finish. The earlier attempt that copied the
+		// file may have failed before verifying and recording it.
+		replicator.ProcUtil.MessageLog.Info("File %s already exists in replication bucket. "+
+			"Verifying and recording the existing copy.", file.Identifier)
+		replicationObject.Copied = true
+		replicator.ReplicationChannel <- replicationObject
+		return nil
+	}
 
+	// Only files too large to copy directly go through local disk.
 	// Unfortunately, we're probably running on a machine that's
 	// also running either ingest or restore. The Volume monitor
 	// can know how much disk space those processes are using, but
 	// not how much they have reserved. So until we have a volume
 	// monitoring service, all we can do is pad the estimate of
 	// how much space we might need.
-	err = replicator.ProcUtil.Volume.Reserve(uint64(file.Size * 2))
+	if needsLocalCopy(&file) {
+		err = replicator.ProcUtil.Volume.Reserve(uint64(file.Size * 2))
+	}
 	if err != nil {
 		// Not enough room on disk
 		replicator.ProcUtil.MessageLog.Warning("Requeueing %s (%d bytes) - not enough disk space",
@@ -118,18 +147,22 @@ func (replicator *Replicator) replicate() {
 			replicationObject.File.ReplicationError = err.Error()
 			// If we failed too many times, send this into the failure
 			// queue. Otherwise, just requeue and try again.
-			if (replicationObject.NsqMessage.Attempts >=
+			if (replicationObject.NsqMessage.Attempts() >=
 				uint16(replicator.ProcUtil.Config.ReplicationWorker.MaxAttempts)) {
 				replicator.SendToTroubleQueue(replicationObject.File)
 				replicationObject.NsqMessage.Finish()
 				replicator.ProcUtil.IncrementFailed()
 			} else {
+				// Back off, in case the replication region is
+				// having a bad day.
+				delay := bagman.ReplicationRetryDelay(replicationObject.NsqMessage.Attempts())
 				replicator.ProcUtil.MessageLog.Error(
-					"Requeuing %s (%s) because copy failed. Error: %v",
+					"Requeuing %s (%s) for %s because copy failed. Error: %v",
 					replicationObject.File.Identifier,
 					replicationObject.File.StorageURL,
+					delay,
 					err)
-				replicationObject.NsqMessage.Requeue(5 * time.Minute)
+				replicationObject.NsqMessage.Requeue(delay)
 				replicator.ProcUtil.IncrementFailed()
 			}
 		} else {
@@ -148,24 +181,87 @@ func (replicator *Replicator) replicate() {
 	}
 }
 
-// Copy the file to S3 in Oregon and save the replication
-// PremisEvent to Fluctus. Returns the S3 URL of the newly-saved file
-// or an error.
+// Copy the file to S3 in Oregon, verify the copy, record the copy's
+// URL on the GenericFile and save the replication PremisEvent to
+// Fluctus. If the file is already in the replication bucket, this
+// verifies and records the existing copy, and copies the file again
+// only if the existing copy doesn't match the original.
+// Returns the S3 URL of the replicated file or an error.
 func (replicator *Replicator) CopyAndSaveEvent(replicationObject *ReplicationObject) (string, error) {
+	file := replicationObject.File
+	if replicationObject.Copied {
+		err := replicator.Copier.Verify(file.Uuid, storedSize(file))
+		if err == nil {
+			url := fmt.Sprintf("https://s3.amazonaws.com/%s/%s",
+				replicator.ProcUtil.Config.ReplicationBucket, file.Uuid)
+			return url, replicator.RecordReplication(file, url)
+		}
+		replicator.ProcUtil.MessageLog.Warning("Existing replication copy of %s failed "+
+			"verification, so we're copying it again: %v", file.Identifier, err)
+		err = replicator.S3ReplicationClient.Delete(
+			replicator.ProcUtil.Config.ReplicationBucket, file.Uuid)
+		if err != nil {
+			return "", fmt.Errorf("Replication copy of %s failed verification, "+
+				"and could not be deleted: %v", file.Identifier, err)
+		}
+		if needsLocalCopy(file) {
+			err = replicator.ProcUtil.Volume.Reserve(uint64(file.Size * 2))
+			if err != nil {
+				return "", fmt.Errorf("Cannot copy %s again: %v", file.Identifier, err)
+			}
+		}
+	}
 	url, err := replicator.CopyFile(replicationObject)
 	if err != nil {
 		return "", err
 	}
-	event, err := replicator.SaveReplicationEvent(replicationObject.File, url)
+	replicationObject.NsqMessage.Touch()
+	err = replicator.Copier.Verify(file.Uuid, storedSize(file))
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("Replication copy of %s failed verification: %v",
+			file.Identifier, err)
+	}
+	return url, replicator.RecordReplication(file, url)
+}
+
+// Records the verified copy at url on the GenericFile, and then
+// saves the replication PremisEvent. The event comes last, so a
+// requeued message that failed to record the URL doesn't save a
+// second event. Setting the URL again is harmless.
+func (replicator *Replicator) RecordReplication(file *bagman.File, url string) (error) {
+	event, err := file.ReplicationEvent(url)
+	if err != nil {
+		return err
+	}
+	err = replicator.ProcUtil.FluctusClient.GenericFileSetReplication(
+		file.Identifier, url, event.DateTime)
+	if err != nil {
+		return fmt.Errorf("Replicated %s, but could not record its replication URL: %v",
+			file.Identifier, err)
+	}
+	event, err = replicator.SaveReplicationEvent(file, event)
+	if err != nil {
+		return err
 	}
 	replicator.ProcUtil.MessageLog.Info(
 		"Saved replication PremisEvent for %s (%s) with event identifier %s",
-		replicationObject.File.Identifier,
-		replicationObject.File.Uuid,
-		event.Identifier)
-	return url, nil
+		file.Identifier, file.Uuid, event.Identifier)
+	return nil
+}
+
+// Returns the number of bytes of the file in the preservation
+// bucket. Encrypted files are larger than their plaintext.
+func storedSize(file *bagman.File) (int64) {
+	if file.Encryption != nil {
+		return file.Encryption.EncryptedSize
+	}
+	return file.Size
+}
+
+// Returns true if the file is too large to copy directly between
+// buckets, so we have to download it and upload it in parts.
+func needsLocalCopy(file *bagman.File) (bool) {
+	return storedSize(file) > bagman.S3_LARGE_FILE
 }
 
 // Copies a file from one bucket to another, across regions,
@@ -173,10 +269,11 @@ func (replicator *Replicator) CopyAndSaveEvent(replicationObject *ReplicationObj
 // of the destination file (that should be in the replication
 // bucket in Oregon), or an error.
 //
-// This does NOT use PUT COPY internally because PUT COPY is
-// limited to files of 5GB or less, and we'll have many files
-// over 5GB. The copy operation downloads data from the S3
-// preservation bucket and uploads it to the replication bucket.
+// Files of 5GB or less are copied within S3 when both buckets
+// belong to the same account, and streamed from one bucket to
+// the other otherwise. PUT COPY and single PUTs are limited to
+// 5GB, so larger files are downloaded from the S3 preservation
+// bucket and uploaded to the replication bucket in parts.
 //
 // As long as we're running in the same region as our S3
 // preservation bucket (USEast), the download should be fast
@@ -193,6 +290,21 @@ func (replicator *Replicator) CopyFile(replicationObject *ReplicationObject) (st
 		return "", err
 	}
 
+	if !needsLocalCopy(replicationObject.File) {
+		replicationObject.NsqMessage.Touch()
+		url, err := replicator.Copier.Copy(
+			replicationObject.File.Uuid,
+			replicationObject.File.MimeType,
+			storedSize(replicationObject.File),
+			copyOptions)
+		if err == nil {
+			replicator.ProcUtil.MessageLog.Info("Finished copy of %s (%s)",
+				replicationObject.File.Identifier,
+				replicationObject.File.Uuid)
+		}
+		return url, err
+	}
+
 	// Touch before dowload, because large files can take a long time!
 	replicationObject.NsqMessage.Touch()
 
@@ -209,27 +321,17 @@ func (replicator *Replicator) CopyFile(replicationObject *ReplicationObject) (st
 	// Touch again before upload, because large files are slow
 	replicationObject.NsqMessage.Touch()
 
-	// Replication client is configured to us USWest-2 (Oregon),
+	// Replication client is configured for the replication region,
 	// but the bucket name should be enough.
-	url := ""
-	if replicationObject.File.Size <= bagman.S3_LARGE_FILE {
-		url, err = replicator.S3ReplicationClient.SaveToS3(
-			replicator.ProcUtil.Config.ReplicationBucket,
-			replicationObject.File.Uuid,
-			replicationObject.File.MimeType,
-			reader,
-			replicationObject.File.Size,
-			copyOptions)
-	} else {
-		url, err = replicator.S3ReplicationClient.SaveLargeFileToS3(
-			replicator.ProcUtil.Config.ReplicationBucket,
-			replicationObject.File.Uuid,
-			replicationObject.File.MimeType,
-			reader,
-			replicationObject.File.Size,
-			copyOptions,
-			bagman.S3_CHUNK_SIZE)
-	}
+	url, err := replicator.S3ReplicationClient.SaveLargeFileToS3(
+		replicator.ProcUtil.Config.ReplicationBucket,
+		replicationObject.File.Uuid,
+		replicationObject.File.MimeType,
+		reader,
+		storedSize(replicationObject.File),
+		copyOptions,
+		bagman.S3_CHUNK_SIZE)
+	reader.Close()
 
 	// Touch so NSQ knows we're not dead yet!
 	replicationObject.NsqMessage.Touch()
@@ -283,6 +385,20 @@ func (replicator *Replicator) GetCopyOptions(file *bagman.File) (s3.Options, err
 	s3Metadata["bag"]         = []string{ resp.Header["X-Amz-Meta-Bag"][0] }
 	s3Metadata["bagpath"]     = []string{ file.Path }
 
+	// Encrypted files carry their wrapped data key in their
+	// metadata. S3 can't check the md5 of their plaintext.
+	encryptionInfo, err := bagman.EncryptionInfoFromS3Headers(resp.Header)
+	if err != nil {
+		return s3.Options{}, fmt.Errorf("Bad encryption metadata on %s/%s: %v",
+			replicator.ProcUtil.Config.PreservationBucket, file.Uuid, err)
+	}
+	if encryptionInfo != nil {
+		for key, value := range encryptionInfo.S3Metadata() {
+			s3Metadata[key] = value
+		}
+		return replicator.S3ReplicationClient.MakeOptions("", s3Metadata), nil
+	}
+
 	base64md5, err := bagman.Base64EncodeMd5(file.Md5)
 	if err != nil {
 		return s3.Options{}, err
@@ -322,14 +438,10 @@ func (replicator *Replicator) DownloadFromPreservation(file *bagman.File) (strin
 	return localPath, nil
 }
 
-// Saves the replication PremisEvent to Fluctus.
-// Param url is the S3 URL we just saved that file to.
-// That should be in Oregon.
-func (replicator *Replicator) SaveReplicationEvent(file *bagman.File, url string) (*bagman.PremisEvent, error) {
-	replicationEvent, err := file.ReplicationEvent(url)
-	if err != nil {
-		return nil, err
-	}
+// Saves the replication PremisEvent to Fluctus. Param
+// replicationEvent comes from file.ReplicationEvent, with the
+// S3 URL of the copy in Oregon.
+func (replicator *Replicator) SaveReplicationEvent(file *bagman.File, replicationEvent *bagman.PremisEvent) (*bagman.PremisEvent, error) {
 	replicator.ProcUtil.MessageLog.Info("Saving replication PremisEvent for %s (%s)",
 		file.Identifier, file.Uuid)
 	savedEvent, err := replicator.ProcUtil.FluctusClient.PremisEventSave(
@@ -342,8 +454,7 @@ func (replicator *Replicator) SaveReplicationEvent(file *bagman.File, url string
 
 // Puts an item into the trouble queue.
 func (replicator *Replicator) SendToTroubleQueue(file *bagman.File) {
-	err := bagman.Enqueue(
-		replicator.ProcUtil.Config.NsqdHttpAddress,
+	err := replicator.ProcUtil.Enqueue(
 		replicator.ProcUtil.Config.FailedReplicationWorker.NsqTopic,
 		file)
 	if err != nil {
@@ -8,7 +8,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"strings"
 )
 
 // TroubleProcessor dumps the ProcessResult structure of
@@ -28,32 +27,35 @@ func NewTroubleProcessor(procUtil *bagman.ProcessUtil) (*TroubleProcessor) {
 }
 
 func (troubleProcessor *TroubleProcessor) HandleMessage(message *nsq.Message) error {
+	return troubleProcessor.ProcessMessage(bagman.NewNsqMessage(message))
+}
+
+// ProcessMessage dumps the ProcessResult in the message to a JSON file.
+// HandleMessage calls this for NSQ messages, and the SyncDriver
+// calls it directly.
+func (troubleProcessor *TroubleProcessor) ProcessMessage(message bagman.Message) error {
 	var result bagman.ProcessResult
-	err := json.Unmarshal(message.Body, &result)
+	err := json.Unmarshal(message.Body(), &result)
 	if err != nil {
 		detailedError := fmt.Errorf(
 			"Could not unmarshal JSON data from nsq: %v. JSON: %s",
-			err, string(message.Body))
+			err, string(message.Body()))
 		troubleProcessor.ProcUtil.MessageLog.Error(detailedError.Error())
 		message.Finish()
 		return detailedError
 	}
 	troubleProcessor.dumpToFile(&result)
+	troubleProcessor.writeReport(&result)
 	troubleProcessor.ProcUtil.MessageLog.Info("Processed %s", result.S3File.Key.Key)
+	message.Finish()
 	return nil
 }
 
 func (troubleProcessor *TroubleProcessor) dumpToFile(result *bagman.ProcessResult) error {
-	outdir := path.Join(troubleProcessor.ProcUtil.Config.LogDirectory, "ingest_failures")
-	if _, err := os.Stat(outdir); os.IsNotExist(err) {
-		err := os.Mkdir(outdir, 0766)
-		if err != nil {
-			panic(err)
-		}
-	}
+	outdir := troubleProcessor.outputDir()
 	filename := fmt.Sprintf("%s_%s",
 		bagman.OwnerOf(result.S3File.BucketName),
-		strings.Replace(result.S3File.Key.Key, ".tar", ".json", -1))
+		bagman.TrimTarExtension(result.S3File.Key.Key) + ".json")
 	json, err := json.MarshalIndent(result, "", "  ")
 	if err != nil {
 		panic(err)
@@ -64,3 +66,34 @@ func (troubleProcessor *TroubleProcessor) dumpToFile(result *bagman.ProcessResul
 	}
 	return nil
 }
+
+// writeReport saves a failure report next to the JSON dump, so
+// admins can see what went wrong and what to do about it without
+// reading the whole result. apt_triage summarizes these reports.
+func (troubleProcessor *TroubleProcessor) writeReport(result *bagman.ProcessResult) {
+	report := result.FailureReport()
+	troubleProcessor.ProcUtil.MessageLog.Warning("%s failed in %s stage (%s): %s Suggested action: %s",
+		result.S3File.Key.Key, report.Stage, report.Classification, report.Error, report.Remediation)
+	filename := fmt.Sprintf("%s_%s",
+		bagman.OwnerOf(result.S3File.BucketName),
+		bagman.TrimTarExtension(result.S3File.Key.Key) + ".report.json")
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(troubleProcessor.outputDir(), filename), data, 0644)
+	}
+	if err != nil {
+		troubleProcessor.ProcUtil.MessageLog.Error("Cannot write failure report for %s: %v",
+			result.S3File.Key.Key, err)
+	}
+}
+
+func (troubleProcessor *TroubleProcessor) outputDir() (string) {
+	outdir := path.Join(troubleProcessor.ProcUtil.Config.LogDirectory, "ingest_failures")
+	if _, err := os.Stat(outdir); os.IsNotExist(err) {
+		err := os.Mkdir(outdir, 0766)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return outdir
+}